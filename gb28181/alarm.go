@@ -0,0 +1,135 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The subscription of alarm from server, to send the alarm events in NOTIFY of the dialog, see GB28181-2016 Annex A.
+type gbSubscription struct {
+	dialog *SIPDialog
+	// The channel or device ID of query.
+	deviceID string
+	// When the subscription expires, unless refreshed.
+	expiresAt time.Time
+}
+
+// Build the response of alarm subscription, in the 200 OK of SUBSCRIBE.
+func utilBuildAlarmSubscribeResponse(deviceID string, sn uint64) string {
+	return fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Response><CmdType>Alarm</CmdType>"+
+		"<SN>%v</SN><DeviceID>%v</DeviceID><Result>OK</Result></Response>\n", sn, deviceID)
+}
+
+// Build the alarm event, the priority 1 to 4 is the highest to lowest, and the method 2 is device alarm, 5 is video
+// alarm, the type is specified by method, for example, 2 of video alarm is motion detection.
+func utilBuildAlarmNotify(deviceID string, sn uint64, priority, method, alarmType int, at time.Time) string {
+	return fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Notify><CmdType>Alarm</CmdType><SN>%v</SN>"+
+		"<DeviceID>%v</DeviceID><AlarmPriority>%v</AlarmPriority><AlarmMethod>%v</AlarmMethod>"+
+		"<AlarmTime>%v</AlarmTime><AlarmDescription>srs-bench</AlarmDescription><Info><AlarmType>%v</AlarmType>"+
+		"</Info></Notify>\n", sn, deviceID, priority, method, at.Format(gbTimeLayout), alarmType)
+}
+
+// AlarmTrigger serves the HTTP endpoint to trigger the alarm of devices on demand, for example:
+//
+//	curl http://localhost:9102/alarm?device=34020000001320000001&method=5&type=2
+//
+// The device is optional, to trigger all devices if empty.
+type AlarmTrigger struct {
+	lock     sync.Mutex
+	sessions map[string]*GBSession
+}
+
+func NewAlarmTrigger() *AlarmTrigger {
+	return &AlarmTrigger{sessions: make(map[string]*GBSession)}
+}
+
+// Add the session of device, to trigger its alarm.
+func (v *AlarmTrigger) Add(session *GBSession) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.sessions[session.sip.conf.DeviceID()] = session
+}
+
+// Remove the session of device when quit.
+func (v *AlarmTrigger) Remove(session *GBSession) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.sessions, session.sip.conf.DeviceID())
+}
+
+// Trigger the alarm of device, or all devices if empty, return the number of NOTIFY sent.
+func (v *AlarmTrigger) Trigger(ctx context.Context, deviceID string, method, alarmType int) (int, error) {
+	var sessions []*GBSession
+	v.lock.Lock()
+	for id, session := range v.sessions {
+		if deviceID == "" || id == deviceID {
+			sessions = append(sessions, session)
+		}
+	}
+	v.lock.Unlock()
+
+	var n int
+	for _, session := range sessions {
+		sent, err := session.NotifyAlarm(ctx, method, alarmType)
+		if err != nil {
+			return n, err
+		}
+		n += sent
+	}
+	return n, nil
+}
+
+func (v *AlarmTrigger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	method, alarmType := 5, 2
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"method", &method}, {"type", &alarmType}} {
+		if s := q.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %v %v", p.name, s), http.StatusBadRequest)
+				return
+			}
+			*p.value = n
+		}
+	}
+
+	n, err := v.Trigger(r.Context(), q.Get("device"), method, alarmType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "{\"notifies\":%v}\n", n)
+}
+
+// Serve listens at addr and serves /alarm, until ctx is done.
+func (v *AlarmTrigger) Serve(ctx context.Context, addr string) error {
+	return utilServeHTTP(ctx, addr, "/alarm", v)
+}
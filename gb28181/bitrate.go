@@ -0,0 +1,217 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"github.com/ossrs/go-oryx-lib/errors"
+	"math"
+	"time"
+)
+
+// BitrateProfile computes the target bitrate over time, to stress the adaptive behavior of server and downstream.
+type BitrateProfile interface {
+	// Target returns the target bitrate in bps, at the elapsed time since start.
+	Target(elapsed time.Duration) uint64
+}
+
+// StepBitrateProfile steps up from Min by Step every Interval, and restarts from Min when exceeds Max.
+type StepBitrateProfile struct {
+	Min, Max, Step uint64
+	Interval       time.Duration
+}
+
+func (v *StepBitrateProfile) Target(elapsed time.Duration) uint64 {
+	if v.Step == 0 || v.Interval <= 0 {
+		return v.Min
+	}
+
+	steps := uint64(elapsed / v.Interval)
+	if n := (v.Max-v.Min)/v.Step + 1; n > 0 {
+		steps %= n
+	}
+	return v.Min + steps*v.Step
+}
+
+// LinearBitrateProfile ramps linearly from Min to Max in Period, and restarts from Min.
+type LinearBitrateProfile struct {
+	Min, Max uint64
+	Period   time.Duration
+}
+
+func (v *LinearBitrateProfile) Target(elapsed time.Duration) uint64 {
+	if v.Period <= 0 {
+		return v.Min
+	}
+
+	ratio := float64(elapsed%v.Period) / float64(v.Period)
+	return v.Min + uint64(ratio*float64(v.Max-v.Min))
+}
+
+// SineBitrateProfile oscillates between Min and Max in Period, starts from the middle.
+type SineBitrateProfile struct {
+	Min, Max uint64
+	Period   time.Duration
+}
+
+func (v *SineBitrateProfile) Target(elapsed time.Duration) uint64 {
+	if v.Period <= 0 {
+		return v.Min
+	}
+
+	ratio := (1 + math.Sin(2*math.Pi*float64(elapsed%v.Period)/float64(v.Period))) / 2
+	return v.Min + uint64(ratio*float64(v.Max-v.Min))
+}
+
+// NewBitrateProfile create the profile by name, step, linear or sine, with the bitrate in [min, max] bps. For step, it
+// steps up by (max-min)/4 every period.
+func NewBitrateProfile(name string, min, max uint64, period time.Duration) (BitrateProfile, error) {
+	if min > max {
+		return nil, errors.Errorf("invalid bitrate min=%v, max=%v", min, max)
+	}
+	if period <= 0 {
+		return nil, errors.Errorf("invalid period %v", period)
+	}
+
+	switch name {
+	case "step":
+		return &StepBitrateProfile{Min: min, Max: max, Step: (max - min) / 4, Interval: period}, nil
+	case "linear":
+		return &LinearBitrateProfile{Min: min, Max: max, Period: period}, nil
+	case "sine":
+		return &SineBitrateProfile{Min: min, Max: max, Period: period}, nil
+	default:
+		return nil, errors.Errorf("invalid bitrate profile %v", name)
+	}
+}
+
+// The shaper to follow the bitrate profile, by a token bucket which is filled at the target bitrate. The frame is
+// dropped if no enough tokens, and padding is sent if too many tokens.
+type bitrateShaper struct {
+	profile BitrateProfile
+	start   time.Time
+	last    time.Time
+	// The available bytes to send, negative means overused.
+	budget float64
+	// Whether dropping the tail of GOP, after a reference frame is dropped, until the next keyframe.
+	dropGOP bool
+}
+
+func newBitrateShaper(profile BitrateProfile, now time.Time) *bitrateShaper {
+	return &bitrateShaper{profile: profile, start: now, last: now}
+}
+
+// Fill the bucket at target bitrate, and return the target in bps. The bucket is limited to 1s of target bitrate, to
+// avoid bursting after long idle.
+func (v *bitrateShaper) Tick(now time.Time) uint64 {
+	target := v.profile.Target(now.Sub(v.start))
+	if d := now.Sub(v.last); d > 0 {
+		v.budget += float64(target) / 8 * d.Seconds()
+		v.last = now
+	}
+
+	if limit := float64(target) / 8; v.budget > limit {
+		v.budget = limit
+	}
+	return target
+}
+
+// Whether allows to send size bytes.
+func (v *bitrateShaper) Allow(size int) bool {
+	return v.budget >= float64(size)
+}
+
+// Consume size bytes sent.
+func (v *bitrateShaper) Consume(size int) {
+	v.budget -= float64(size)
+}
+
+// Whether drop the video frame of size bytes, IDR frames always pass. The non-reference frame is dropped alone if no
+// enough budget. Most encoders mark almost all P frames as reference, so dropping a reference frame also drops the tail
+// of GOP, that is the following frames until the next keyframe, which depend on it.
+func (v *bitrateShaper) Drop(frame *Frame, size int) bool {
+	if utilIsIRAP(frame) {
+		v.dropGOP = false
+		return false
+	}
+	if v.dropGOP {
+		return true
+	}
+	if v.Allow(size) {
+		return false
+	}
+
+	v.dropGOP = !utilIsNonReference(frame)
+	return true
+}
+
+// Padding returns the bytes to pad for the unused budget, at most max bytes.
+func (v *bitrateShaper) Padding(max int) int {
+	if v.budget <= 0 {
+		return 0
+	}
+	return int(math.Min(v.budget, float64(max)))
+}
+
+// Whether the video frame is non-reference, which is safe to drop, that is nal_ref_idc is 0 for H.264, and the
+// sub-layer non-reference picture for H.265, see ITU-T-H.265 7.4.2.2.
+func utilIsNonReference(frame *Frame) bool {
+	var hasSlice bool
+	for _, payload := range frame.Payloads {
+		if len(payload) == 0 {
+			continue
+		}
+
+		if frame.Codec == FrameCodecH265 {
+			if t := NalUnitType((payload[0] & 0x7e) >> 1); t <= NaluTypeSliceRsvIrapVcl23 {
+				if t > 14 || t%2 == 1 {
+					return false
+				}
+				hasSlice = true
+			}
+		} else {
+			if t := payload[0] & 0x1f; t >= 1 && t <= 5 {
+				if payload[0]&0x60 != 0 {
+					return false
+				}
+				hasSlice = true
+			}
+		}
+	}
+	return hasSlice
+}
+
+// Whether the video frame is IDR for H.264, or IRAP for H.265 which starts a new GOP, see ITU-T-H.265 7.4.2.2.
+func utilIsIRAP(frame *Frame) bool {
+	for _, payload := range frame.Payloads {
+		if len(payload) == 0 {
+			continue
+		}
+
+		if frame.Codec == FrameCodecH265 {
+			if t := NalUnitType((payload[0] & 0x7e) >> 1); t >= NaluTypeSliceBlaWlp && t <= NaluTypeSliceRsvIrapVcl23 {
+				return true
+			}
+		} else if payload[0]&0x1f == 5 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"io"
+	"time"
+)
+
+// The MANSCDP query or control from platform, in MESSAGE request, see GB28181-2016 A.2.3.
+type gbQuery struct {
+	XMLName  xml.Name
+	CmdType  string `xml:"CmdType"`
+	SN       uint64 `xml:"SN"`
+	DeviceID string `xml:"DeviceID"`
+	// The time range of RecordInfo query, in format of gbTimeLayout.
+	StartTime string `xml:"StartTime"`
+	EndTime   string `xml:"EndTime"`
+	// The PTZ command of DeviceControl, in hex of 8 bytes.
+	PTZCmd string `xml:"PTZCmd"`
+	// The VKEK of GB35114 encrypted by SM2 public key of device in base64, and its version.
+	VKEK        string `xml:"VKEK"`
+	VKEKVersion string `xml:"VKEKVersion"`
+}
+
+// Parse the MANSCDP XML body of MESSAGE, for example, the Catalog query, or the DeviceControl of PTZ. The encoding is
+// GB2312 generally, but we only care about the ASCII elements, so ignore the charset.
+func parseGBQuery(body string) (*gbQuery, error) {
+	d := xml.NewDecoder(bytes.NewReader([]byte(body)))
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	q := &gbQuery{}
+	if err := d.Decode(q); err != nil {
+		return nil, errors.Wrapf(err, "decode %v", body)
+	}
+	if q.XMLName.Local != "Query" && q.XMLName.Local != "Control" {
+		return nil, errors.Errorf("not query or control %v", q.XMLName.Local)
+	}
+	return q, nil
+}
+
+// The item of channel in Catalog response, see GB28181-2016 A.2.6.4.
+type gbCatalogItem struct {
+	DeviceID     string `xml:"DeviceID"`
+	Name         string `xml:"Name"`
+	Manufacturer string `xml:"Manufacturer"`
+	Model        string `xml:"Model"`
+	Owner        string `xml:"Owner"`
+	CivilCode    string `xml:"CivilCode"`
+	Address      string `xml:"Address"`
+	Parental     int    `xml:"Parental"`
+	ParentID     string `xml:"ParentID"`
+	SafetyWay    int    `xml:"SafetyWay"`
+	RegisterWay  int    `xml:"RegisterWay"`
+	Secrecy      int    `xml:"Secrecy"`
+	Status       string `xml:"Status"`
+	// The extended info of GB28181-2022, omitted for 2016.
+	Info *gbCatalogInfo `xml:"Info,omitempty"`
+}
+
+// The extended info of channel in Catalog response of GB28181-2022, the stream numbers for multiple streams of
+// camera, and the speeds of download separated by slash.
+type gbCatalogInfo struct {
+	PTZType          int    `xml:"PTZType"`
+	StreamNumberList string `xml:"StreamNumberList"`
+	DownloadSpeed    string `xml:"DownloadSpeed"`
+}
+
+type gbCatalogResponse struct {
+	XMLName  xml.Name `xml:"Response"`
+	CmdType  string   `xml:"CmdType"`
+	SN       uint64   `xml:"SN"`
+	DeviceID string   `xml:"DeviceID"`
+	SumNum   int      `xml:"SumNum"`
+	// The channels in this response, Num is the number of items.
+	DeviceList struct {
+		Num   int              `xml:"Num,attr"`
+		Items []*gbCatalogItem `xml:"Item"`
+	} `xml:"DeviceList"`
+}
+
+// The ID of the n-th channel of device, starts from 0. For the 20 digits device ID, the channel ID is the 10 digits
+// center code, the type 131 of camera, and 7 digits sequence, for example, 34020000001310000001. Otherwise, append
+// the sequence to device ID, for example, livestream-1.
+func utilBuildChannelID(deviceID string, n int) string {
+	if len(deviceID) == 20 {
+		return fmt.Sprintf("%v131%07d", deviceID[:10], n+1)
+	}
+	return fmt.Sprintf("%v-%v", deviceID, n+1)
+}
+
+// Build the Catalog responses of channels for query SN, each response contains at most pageSize channels, because a
+// MESSAGE over UDP should not exceed the MTU. The channels carry the extended info if gb2022.
+func utilBuildCatalogResponses(deviceID string, sn uint64, channels, pageSize int, gb2022 bool) ([]string, error) {
+	if pageSize <= 0 {
+		return nil, errors.Errorf("invalid page size %v", pageSize)
+	}
+
+	var civilCode string
+	if len(deviceID) == 20 {
+		civilCode = deviceID[:10]
+	}
+
+	var bodies []string
+	for i := 0; i < channels || (i == 0 && channels == 0); i += pageSize {
+		res := &gbCatalogResponse{CmdType: "Catalog", SN: sn, DeviceID: deviceID, SumNum: channels}
+		for j := i; j < channels && j < i+pageSize; j++ {
+			res.DeviceList.Items = append(res.DeviceList.Items, &gbCatalogItem{
+				DeviceID: utilBuildChannelID(deviceID, j), Name: fmt.Sprintf("Camera %v", j+1),
+				Manufacturer: "srs-bench", Model: "srs-bench", Owner: "srs-bench", CivilCode: civilCode,
+				Address: "srs-bench", ParentID: deviceID, RegisterWay: 1, Status: "ON",
+			})
+			if gb2022 {
+				res.DeviceList.Items[j-i].Info = &gbCatalogInfo{PTZType: 3, StreamNumberList: "0", DownloadSpeed: "1/2/4"}
+			}
+		}
+		res.DeviceList.Num = len(res.DeviceList.Items)
+
+		b, err := xml.Marshal(res)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshal catalog")
+		}
+		bodies = append(bodies, fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n%v\n", string(b)))
+	}
+	return bodies, nil
+}
+
+// The layout of time in MANSCDP, local time without zone, see GB28181-2016 Annex A.
+const gbTimeLayout = "2006-01-02T15:04:05"
+
+// The max records in RecordInfo response, to limit the responses for a query of long time range.
+const gbMaxRecords = 256
+
+// The item of recording in RecordInfo response, see GB28181-2016 A.2.6.
+type gbRecordItem struct {
+	DeviceID  string `xml:"DeviceID"`
+	Name      string `xml:"Name"`
+	FilePath  string `xml:"FilePath"`
+	Address   string `xml:"Address"`
+	StartTime string `xml:"StartTime"`
+	EndTime   string `xml:"EndTime"`
+	Secrecy   int    `xml:"Secrecy"`
+	Type      string `xml:"Type"`
+}
+
+type gbRecordInfoResponse struct {
+	XMLName  xml.Name `xml:"Response"`
+	CmdType  string   `xml:"CmdType"`
+	SN       uint64   `xml:"SN"`
+	DeviceID string   `xml:"DeviceID"`
+	Name     string   `xml:"Name"`
+	SumNum   int      `xml:"SumNum"`
+	// The recordings in this response, Num is the number of items.
+	RecordList struct {
+		Num   int             `xml:"Num,attr"`
+		Items []*gbRecordItem `xml:"Item"`
+	} `xml:"RecordList"`
+}
+
+// Parse the time of MANSCDP in local time.
+func parseGBTime(s string) (time.Time, error) {
+	t, err := time.ParseInLocation(gbTimeLayout, s, time.Local)
+	if err != nil {
+		return t, errors.Wrapf(err, "parse time %v", s)
+	}
+	return t, nil
+}
+
+// Build the RecordInfo responses of channel for query SN, which split the time range of query to synthetic recordings
+// of recordLength, at most gbMaxRecords. Each response contains at most pageSize recordings, like the Catalog.
+func utilBuildRecordInfoResponses(channelID string, sn uint64, start, end time.Time, recordLength time.Duration, pageSize int) ([]string, error) {
+	if pageSize <= 0 {
+		return nil, errors.Errorf("invalid page size %v", pageSize)
+	}
+	if recordLength <= 0 {
+		return nil, errors.Errorf("invalid record length %v", recordLength)
+	}
+
+	var records []*gbRecordItem
+	for t := start; t.Before(end) && len(records) < gbMaxRecords; t = t.Add(recordLength) {
+		recordEnd := t.Add(recordLength)
+		if recordEnd.After(end) {
+			recordEnd = end
+		}
+		records = append(records, &gbRecordItem{
+			DeviceID: channelID, Name: "srs-bench", Address: "srs-bench",
+			FilePath:  fmt.Sprintf("%v/%v.ps", channelID, t.Format("20060102150405")),
+			StartTime: t.Format(gbTimeLayout), EndTime: recordEnd.Format(gbTimeLayout), Type: "time",
+		})
+	}
+
+	var bodies []string
+	for i := 0; i < len(records) || i == 0; i += pageSize {
+		res := &gbRecordInfoResponse{CmdType: "RecordInfo", SN: sn, DeviceID: channelID, Name: "srs-bench",
+			SumNum: len(records),
+		}
+		for j := i; j < len(records) && j < i+pageSize; j++ {
+			res.RecordList.Items = append(res.RecordList.Items, records[j])
+		}
+		res.RecordList.Num = len(res.RecordList.Items)
+
+		b, err := xml.Marshal(res)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshal record info")
+		}
+		bodies = append(bodies, fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n%v\n", string(b)))
+	}
+	return bodies, nil
+}
+
+// Build the MediaStatus notify of channel, the NotifyType 121 is end of file for playback, see GB28181-2016 A.2.5.
+func utilBuildMediaStatus(channelID string, sn uint64) string {
+	return fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Notify><CmdType>MediaStatus</CmdType>"+
+		"<SN>%v</SN><DeviceID>%v</DeviceID><NotifyType>121</NotifyType></Notify>\n", sn, channelID)
+}
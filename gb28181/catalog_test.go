@@ -0,0 +1,494 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGBCatalog(t *testing.T) {
+	q, err := parseGBQuery("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Query><CmdType>Catalog</CmdType>" +
+		"<SN>17</SN><DeviceID>34020000001320000001</DeviceID></Query>")
+	if err != nil {
+		t.Errorf("parse err %+v", err)
+		return
+	}
+	if q.CmdType != "Catalog" || q.SN != 17 || q.DeviceID != "34020000001320000001" {
+		t.Errorf("invalid query %+v", q)
+		return
+	}
+
+	if _, err := parseGBQuery("<Response><CmdType>Catalog</CmdType></Response>"); err == nil {
+		t.Error("should fail for response")
+		return
+	}
+
+	bodies, err := utilBuildCatalogResponses(q.DeviceID, q.SN, 10, 4, false)
+	if err != nil {
+		t.Errorf("build err %+v", err)
+		return
+	}
+	if len(bodies) != 3 {
+		t.Errorf("invalid responses %v", len(bodies))
+		return
+	}
+
+	var ids []string
+	for i, body := range bodies {
+		res := &gbCatalogResponse{}
+		d := xml.NewDecoder(strings.NewReader(body))
+		d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+			return input, nil
+		}
+		if err := d.Decode(res); err != nil {
+			t.Errorf("decode err %+v", err)
+			return
+		}
+		if expect := []int{4, 4, 2}[i]; res.DeviceList.Num != expect || len(res.DeviceList.Items) != expect {
+			t.Errorf("page %v num=%v, items=%v, expect %v", i, res.DeviceList.Num, len(res.DeviceList.Items), expect)
+			return
+		}
+		if res.SumNum != 10 || res.SN != 17 || res.CmdType != "Catalog" {
+			t.Errorf("invalid response %+v", res)
+			return
+		}
+		for _, item := range res.DeviceList.Items {
+			ids = append(ids, item.DeviceID)
+		}
+	}
+	if ids[0] != "34020000001310000001" || ids[9] != "34020000001310000010" {
+		t.Errorf("invalid channel ids %v", ids)
+		return
+	}
+
+	if bodies, err := utilBuildCatalogResponses("livestream", 1, 0, 4, false); err != nil || len(bodies) != 1 {
+		t.Errorf("empty catalog err %+v, responses %v", err, len(bodies))
+		return
+	}
+	if _, err := utilBuildCatalogResponses("livestream", 1, 10, 0, false); err == nil {
+		t.Error("should fail for zero page size")
+		return
+	}
+}
+
+func TestGBRecordInfo(t *testing.T) {
+	q, err := parseGBQuery("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Query><CmdType>RecordInfo</CmdType>" +
+		"<SN>18</SN><DeviceID>34020000001310000001</DeviceID><StartTime>2024-01-01T00:00:00</StartTime>" +
+		"<EndTime>2024-01-01T02:10:00</EndTime><Type>all</Type></Query>")
+	if err != nil {
+		t.Errorf("parse err %+v", err)
+		return
+	}
+	start, err := parseGBTime(q.StartTime)
+	if err != nil {
+		t.Errorf("parse err %+v", err)
+		return
+	}
+	end, err := parseGBTime(q.EndTime)
+	if err != nil {
+		t.Errorf("parse err %+v", err)
+		return
+	}
+
+	// The 2h10m is split to 5 recordings of 30m, the last one is 10m.
+	bodies, err := utilBuildRecordInfoResponses(q.DeviceID, q.SN, start, end, 30*time.Minute, 4)
+	if err != nil {
+		t.Errorf("build err %+v", err)
+		return
+	}
+	if len(bodies) != 2 {
+		t.Errorf("invalid responses %v", len(bodies))
+		return
+	}
+
+	var items []*gbRecordItem
+	for i, body := range bodies {
+		res := &gbRecordInfoResponse{}
+		d := xml.NewDecoder(strings.NewReader(body))
+		d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+			return input, nil
+		}
+		if err := d.Decode(res); err != nil {
+			t.Errorf("decode err %+v", err)
+			return
+		}
+		if expect := []int{4, 1}[i]; res.RecordList.Num != expect || len(res.RecordList.Items) != expect {
+			t.Errorf("page %v num=%v, items=%v, expect %v", i, res.RecordList.Num, len(res.RecordList.Items), expect)
+			return
+		}
+		if res.SumNum != 5 || res.SN != 18 || res.CmdType != "RecordInfo" || res.DeviceID != q.DeviceID {
+			t.Errorf("invalid response %+v", res)
+			return
+		}
+		items = append(items, res.RecordList.Items...)
+	}
+	if items[0].StartTime != "2024-01-01T00:00:00" || items[0].EndTime != "2024-01-01T00:30:00" ||
+		items[4].StartTime != "2024-01-01T02:00:00" || items[4].EndTime != "2024-01-01T02:10:00" {
+		t.Errorf("invalid records %+v %+v", items[0], items[4])
+		return
+	}
+
+	// Empty response for invalid range, and limit the records for long range.
+	if bodies, err := utilBuildRecordInfoResponses(q.DeviceID, 1, end, start, time.Minute, 4); err != nil || len(bodies) != 1 ||
+		!strings.Contains(bodies[0], "<SumNum>0</SumNum>") {
+		t.Errorf("empty record info err %+v, responses %v", err, bodies)
+		return
+	}
+	if bodies, err := utilBuildRecordInfoResponses(q.DeviceID, 1, start, start.Add(24*time.Hour), time.Minute, 256); err != nil ||
+		len(bodies) != 1 || !strings.Contains(bodies[0], fmt.Sprintf("<SumNum>%v</SumNum>", gbMaxRecords)) {
+		t.Errorf("long record info err %+v, responses %v", err, len(bodies))
+		return
+	}
+	if _, err := parseGBTime("2024-01-01 00:00:00"); err == nil {
+		t.Error("should fail for invalid time")
+		return
+	}
+
+	// The playback INVITE with time range, and the answer echos it.
+	invite := sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: q.DeviceID}}, "SIP/2.0", nil,
+		"v=0\r\ns=Playback\r\nu=34020000001310000001:0\r\nc=IN IP4 10.0.0.1\r\nt=1704067200 1704074400\r\n"+
+			"m=video 9000 TCP/RTP/AVP 96\r\na=setup:passive\r\ny=1200000001\r\n", nil)
+	out, err := parseInviteChannel(invite, "")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if !out.playback || out.startTime.Unix() != 1704067200 || out.endTime.Sub(out.startTime) != 2*time.Hour {
+		t.Errorf("invalid playback %+v", out)
+		return
+	}
+	if answer := utilBuildInviteAnswer("34020000001320000001", "127.0.0.1", out); !strings.Contains(answer, "s=Playback\r\n") ||
+		!strings.Contains(answer, "t=1704067200 1704074400\r\n") {
+		t.Errorf("invalid answer %v", answer)
+		return
+	}
+
+	// The download with speed, the time range is required as playback.
+	invite = sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: q.DeviceID}}, "SIP/2.0", nil,
+		"v=0\r\ns=Download\r\nt=1704067200 1704074400\r\nm=video 9000 RTP/AVP 96\r\na=downloadspeed:4\r\n"+
+			"y=1200000001\r\n", nil)
+	if out, err = parseInviteChannel(invite, ""); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if !out.playback || !out.download || out.downloadSpeed != 4 || out.startTime.Unix() != 1704067200 {
+		t.Errorf("invalid download %+v", out)
+		return
+	}
+	if answer := utilBuildInviteAnswer("34020000001320000001", "127.0.0.1", out); !strings.Contains(answer, "s=Download\r\n") ||
+		!strings.Contains(answer, "a=downloadspeed:4\r\n") {
+		t.Errorf("invalid answer %v", answer)
+		return
+	}
+
+	invite = sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: q.DeviceID}}, "SIP/2.0", nil,
+		"v=0\r\ns=Download\r\nt=1704067200 1704074400\r\nm=video 9000 RTP/AVP 96\r\ny=1200000001\r\n", nil)
+	if out, err = parseInviteChannel(invite, ""); err != nil || out.downloadSpeed != 1 {
+		t.Errorf("invalid default download speed %+v, err %+v", out, err)
+		return
+	}
+
+	for _, speed := range []string{"0", "-2", "fast", "1.5"} {
+		invite := sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: q.DeviceID}}, "SIP/2.0", nil,
+			"v=0\r\ns=Download\r\nt=1704067200 1704074400\r\nm=video 9000 RTP/AVP 96\r\na=downloadspeed:"+
+				speed+"\r\ny=1200000001\r\n", nil)
+		if _, err := parseInviteChannel(invite, ""); err == nil {
+			t.Errorf("should fail for downloadspeed %v", speed)
+			return
+		}
+	}
+
+	for _, timing := range []string{"0 0", "1704074400 1704067200", "1704067200", "now 1704074400"} {
+		invite := sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: q.DeviceID}}, "SIP/2.0", nil,
+			"v=0\r\ns=Playback\r\nt="+timing+"\r\nm=video 9000 RTP/AVP 96\r\ny=1200000001\r\n", nil)
+		if _, err := parseInviteChannel(invite, ""); err == nil {
+			t.Errorf("should fail for t=%v", timing)
+			return
+		}
+	}
+
+	// The end of file of playback.
+	status := &struct {
+		CmdType    string `xml:"CmdType"`
+		SN         uint64 `xml:"SN"`
+		DeviceID   string `xml:"DeviceID"`
+		NotifyType int    `xml:"NotifyType"`
+	}{}
+	d := xml.NewDecoder(strings.NewReader(utilBuildMediaStatus(q.DeviceID, 3)))
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := d.Decode(status); err != nil || status.CmdType != "MediaStatus" || status.SN != 3 ||
+		status.DeviceID != q.DeviceID || status.NotifyType != 121 {
+		t.Errorf("invalid media status %+v, err %+v", status, err)
+		return
+	}
+}
+
+func TestGBPTZControl(t *testing.T) {
+	cmd, err := parsePTZCommand("a50f010a202000ff")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if cmd.Cmd != "A50F010A202000FF" || cmd.Action() != "left+up" || cmd.Address != 1 || cmd.PanSpeed != 0x20 ||
+		cmd.TiltSpeed != 0x20 || cmd.ZoomSpeed != 0 {
+		t.Errorf("invalid ptz %v", cmd.String())
+		return
+	}
+	for hex, action := range map[string]string{
+		"A50F0100000000B5": "stop", "A50F0110000010D5": "zoom-in", "A50F01820300003A": "preset-call:3",
+	} {
+		if cmd, err := parsePTZCommand(hex); err != nil || cmd.Action() != action {
+			t.Errorf("invalid ptz %v, err %+v", hex, err)
+			return
+		}
+	}
+	for _, hex := range []string{"A50F010A202000FE", "A40F010A202000FE", "A50E010A202000FE", "A50F010A2020", "XYZ"} {
+		if _, err := parsePTZCommand(hex); err == nil {
+			t.Errorf("should fail for %v", hex)
+			return
+		}
+	}
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 3*time.Second)
+	defer cancel()
+
+	session := NewGBSession(&GBSessionConfig{}, &SIPConfig{addr: fmt.Sprintf("udp://%v", server.LocalAddr()),
+		user: "camera", deviceID: "camera", server: "srs", domain: "ossrs.io"})
+	if err := session.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.Close()
+
+	// The server sends DeviceControl to the device, which responses 200 OK then the result.
+	ip, port := session.sip.localAddr()
+	device := &net.UDPAddr{IP: net.ParseIP(ip), Port: int(port)}
+	for i, ptz := range []string{"A50F010A202000FF", "A50F0100000000B5", "A50F010A202000FE"} {
+		body := fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Control><CmdType>DeviceControl</CmdType>"+
+			"<SN>%v</SN><DeviceID>camera-1</DeviceID><PTZCmd>%v</PTZCmd></Control>\n", i+1, ptz)
+		if err := sipTestRequest(server, device, "MESSAGE", "camera", fmt.Sprintf("ptz-%v", i), 1, body); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+
+		if res, err := sipTestRespond(server, 200, "OK"); err != nil || !strings.HasPrefix(res, "SIP/2.0 200 OK") {
+			t.Errorf("invalid response %v, err %+v", res, err)
+			return
+		}
+		result := []string{"OK", "OK", "ERROR"}[i]
+		if res, err := sipTestRespond(server, 200, "OK"); err != nil || !strings.HasPrefix(res, "MESSAGE ") ||
+			!strings.Contains(res, fmt.Sprintf("<SN>%v</SN>", i+1)) || !strings.Contains(res, "<Result>"+result+"</Result>") {
+			t.Errorf("invalid result %v, err %+v", res, err)
+			return
+		}
+	}
+
+	// The timeline of valid commands, in order.
+	for ctx.Err() == nil && session.Stats().PTZErrors == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	commands := session.PTZCommands()
+	if len(commands) != 2 || commands[0].Action() != "left+up" || commands[1].Action() != "stop" ||
+		commands[0].ChannelID != "camera-1" || commands[1].SN != 2 || commands[1].At.Before(commands[0].At) {
+		t.Errorf("invalid timeline %v", commands)
+		return
+	}
+	if stats := session.Stats(); stats.PTZCommands != 2 || stats.PTZErrors != 1 {
+		t.Errorf("invalid stats %v", stats.String())
+		return
+	}
+}
+
+func TestGBAlarmSubscribe(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 3*time.Second)
+	defer cancel()
+
+	session := NewGBSession(&GBSessionConfig{}, &SIPConfig{addr: fmt.Sprintf("udp://%v", server.LocalAddr()),
+		user: "camera", deviceID: "camera", server: "srs", domain: "ossrs.io"})
+	if err := session.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.Close()
+
+	alarms := NewAlarmTrigger()
+	alarms.Add(session)
+
+	ip, port := session.sip.localAddr()
+	device := &net.UDPAddr{IP: net.ParseIP(ip), Port: int(port)}
+	query := func(cmd string) string {
+		return fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Query><CmdType>%v</CmdType><SN>7</SN>"+
+			"<DeviceID>camera</DeviceID></Query>\n", cmd)
+	}
+
+	// Reject the subscription of other event.
+	if err := sipTestRequest(server, device, "SUBSCRIBE", "camera", "sub-0", 1, query("Catalog"), "Expires: 60"); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if res, err := sipTestRespond(server, 200, "OK"); err != nil || !strings.HasPrefix(res, "SIP/2.0 489 ") {
+		t.Errorf("invalid response %v, err %+v", res, err)
+		return
+	}
+
+	// Accept the subscription with the local tag.
+	if err := sipTestRequest(server, device, "SUBSCRIBE", "camera", "sub-1", 1, query("Alarm"), "Expires: 60",
+		"Event: presence", fmt.Sprintf("Contact: <sip:srs@%v>", server.LocalAddr())); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	res, err := sipTestRespond(server, 200, "OK")
+	if err != nil || !strings.HasPrefix(res, "SIP/2.0 200 OK") || !strings.Contains(res, "<Result>OK</Result>") ||
+		!strings.Contains(res, "Expires: 60") {
+		t.Errorf("invalid response %v, err %+v", res, err)
+		return
+	}
+	var tag string
+	for _, line := range strings.Split(res, "\r\n") {
+		if strings.HasPrefix(line, "To:") && strings.Contains(line, "tag=") {
+			tag = line[strings.Index(line, "tag=")+4:]
+		}
+	}
+	if tag == "" {
+		t.Errorf("no tag of %v", res)
+		return
+	}
+
+	// Trigger the alarm by HTTP, which is sent in the dialog.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		alarms.ServeHTTP(w, httptest.NewRequest("GET", "/alarm?device=camera&method=5&type=2", nil))
+		if w.Code != 200 || !strings.Contains(w.Body.String(), `"notifies":1`) {
+			t.Errorf("invalid trigger %v %v", w.Code, w.Body.String())
+			return
+		}
+
+		req, err := sipTestRespond(server, 200, "OK")
+		if err != nil || !strings.HasPrefix(req, "NOTIFY ") || !strings.Contains(req, "Call-ID: sub-1") ||
+			!strings.Contains(req, fmt.Sprintf("CSeq: %v NOTIFY", i+2)) || !strings.Contains(req, "tag="+tag) ||
+			!strings.Contains(req, "Event: presence") || !strings.Contains(req, "Subscription-State: active;expires=") ||
+			!strings.Contains(req, "<CmdType>Alarm</CmdType>") || !strings.Contains(req, "<AlarmMethod>5</AlarmMethod>") {
+			t.Errorf("invalid notify %v, err %+v", req, err)
+			return
+		}
+	}
+
+	w := httptest.NewRecorder()
+	alarms.ServeHTTP(w, httptest.NewRequest("GET", "/alarm?type=x", nil))
+	if w.Code != 400 {
+		t.Errorf("should fail for invalid type, %v", w.Code)
+		return
+	}
+
+	// Unsubscribe by Expires 0, then no alarm is sent.
+	if err := sipTestRequest(server, device, "SUBSCRIBE", "camera", "sub-1", 2, query("Alarm"), "Expires: 0"); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if res, err := sipTestRespond(server, 200, "OK"); err != nil || !strings.HasPrefix(res, "SIP/2.0 200 OK") {
+		t.Errorf("invalid response %v, err %+v", res, err)
+		return
+	}
+	for ctx.Err() == nil && session.Stats().AlarmSubscribes < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, err := alarms.Trigger(ctx, "", 5, 2); err != nil || n != 0 {
+		t.Errorf("invalid trigger %v, err %+v", n, err)
+		return
+	}
+	if stats := session.Stats(); stats.Alarms != 2 || stats.AlarmSubscribes != 2 {
+		t.Errorf("invalid stats %v", stats.String())
+		return
+	}
+}
+
+func TestGB2022(t *testing.T) {
+	bodies, err := utilBuildCatalogResponses("34020000001320000001", 1, 2, 4, true)
+	if err != nil || len(bodies) != 1 || !strings.Contains(bodies[0], "<Info><PTZType>3</PTZType>"+
+		"<StreamNumberList>0</StreamNumberList><DownloadSpeed>1/2/4</DownloadSpeed></Info>") {
+		t.Errorf("invalid catalog %v, err %+v", bodies, err)
+		return
+	}
+	if bodies, err := utilBuildCatalogResponses("34020000001320000001", 1, 2, 4, false); err != nil ||
+		strings.Contains(bodies[0], "<Info>") {
+		t.Errorf("invalid catalog %v, err %+v", bodies, err)
+		return
+	}
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 3*time.Second)
+	defer cancel()
+
+	session := NewGBSession(&GBSessionConfig{}, &SIPConfig{addr: fmt.Sprintf("udp://%v", server.LocalAddr()),
+		user: "camera", deviceID: "camera", server: "srs", domain: "ossrs.io", gb2022: true})
+	if err := session.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.Close()
+
+	// The version is in both REGISTER and MESSAGE.
+	go session.sip.Register(ctx)
+	if req, err := sipTestRespond(server, 200, "OK"); err != nil || !strings.HasPrefix(req, "REGISTER ") ||
+		!strings.Contains(req, "X-GB-Ver: 3.0") {
+		t.Errorf("invalid register %v, err %+v", req, err)
+		return
+	}
+
+	go session.sip.Message(ctx)
+	if req, err := sipTestRespond(server, 200, "OK"); err != nil || !strings.HasPrefix(req, "MESSAGE ") ||
+		!strings.Contains(req, "X-GB-Ver: 3.0") {
+		t.Errorf("invalid message %v, err %+v", req, err)
+		return
+	}
+}
@@ -0,0 +1,853 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"encoding/binary"
+	"github.com/ossrs/go-oryx-lib/aac"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/yapingcat/gomedia/codec"
+	"github.com/yapingcat/gomedia/mpeg2"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// DemuxFrameSource reads the frames demuxed from a container file, MP4 or MPEG-TS, with the original timestamps of
+// file, so the frame rate and B-frames are preserved.
+type DemuxFrameSource struct {
+	frames []*Frame
+	// The number of frames read.
+	index int
+	// The codec of frames, H.264, H.265 or AAC.
+	codec FrameCodec
+	// The config of AAC, nil for video.
+	audioConfig *aac.AudioSpecificConfig
+}
+
+func (v *DemuxFrameSource) Next() (*Frame, error) {
+	if v.index >= len(v.frames) {
+		return nil, io.EOF
+	}
+
+	frame := v.frames[v.index]
+	v.index++
+
+	// Copy the frame, because the ingester might modify it.
+	return &Frame{
+		Codec: frame.Codec, DTS: frame.DTS, PTS: frame.PTS, Duration: frame.Duration, Payloads: frame.Payloads,
+	}, nil
+}
+
+// Frames returns the number of frames in source.
+func (v *DemuxFrameSource) Frames() int {
+	return len(v.frames)
+}
+
+// AudioConfig returns the AAC profile, sample rate and channels of stream, nil for video.
+func (v *DemuxFrameSource) AudioConfig() *aac.AudioSpecificConfig {
+	return v.audioConfig
+}
+
+// SampleRate returns the sample rate of AAC, 0 for video.
+func (v *DemuxFrameSource) SampleRate() int {
+	if v.audioConfig == nil {
+		return 0
+	}
+	return v.audioConfig.SampleRate.ToHz()
+}
+
+// Whether the file is a container of video and audio, MP4 or MPEG-TS, by the extension.
+func utilIsContainerFile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".mp4", ".m4v", ".mov", ".ts":
+		return true
+	}
+	return false
+}
+
+// NewDemuxFrameSources demuxes the container file of name, MP4 or MPEG-TS by the extension, to the video and audio
+// sources, nil if no such stream. The timestamps are rescaled to clock rate, and start from zero.
+func NewDemuxFrameSources(r io.Reader, name string, clockRate uint64) (video, audio *DemuxFrameSource, err error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "read %v", name)
+	}
+
+	// The decoders of gomedia panic for some invalid data.
+	defer func() {
+		if r := recover(); r != nil {
+			video, audio, err = nil, nil, errors.Errorf("demux %v panic %v", name, r)
+		}
+	}()
+
+	if strings.ToLower(path.Ext(name)) == ".ts" {
+		video, audio, err = utilDemuxTS(b, clockRate)
+	} else {
+		video, audio, err = utilDemuxMP4(b, clockRate)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "demux %v", name)
+	}
+	if video == nil && audio == nil {
+		return nil, nil, errors.Errorf("no H.264, H.265 or AAC in %v", name)
+	}
+
+	// Rebase the timestamps of both streams to start from zero, to keep the A/V sync.
+	base := ^uint64(0)
+	for _, source := range []*DemuxFrameSource{video, audio} {
+		if source != nil && len(source.frames) > 0 && source.frames[0].DTS < base {
+			base = source.frames[0].DTS
+		}
+	}
+	for _, source := range []*DemuxFrameSource{video, audio} {
+		if source == nil {
+			continue
+		}
+		for _, frame := range source.frames {
+			frame.DTS, frame.PTS = frame.DTS-base, frame.PTS-base
+		}
+	}
+	return video, audio, nil
+}
+
+// Demux the MPEG-TS by the packet, PAT, PMT and PES decoders of gomedia. Each video PES is a frame, and each audio PES
+// might contain multiple ADTS frames.
+func utilDemuxTS(b []byte, clockRate uint64) (video, audio *DemuxFrameSource, err error) {
+	const packetSize = 188
+
+	// The PID of PMT, and the stream type of each elementary PID.
+	pmts := make(map[uint16]bool)
+	streams := make(map[uint16]mpeg2.TS_STREAM_TYPE)
+	// The PES to reassemble of each elementary PID.
+	pes := make(map[uint16][]byte)
+
+	onPES := func(pid uint16, data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+
+		pkt := mpeg2.NewPesPacket()
+		if err := pkt.Decode(codec.NewBitStream(data)); err != nil && pkt.Pes_payload == nil {
+			return errors.Wrapf(err, "decode pes of pid %v", pid)
+		}
+		if pkt.PTS_DTS_flags&0x02 == 0 {
+			return errors.Errorf("no PTS of pid %v", pid)
+		}
+
+		dts, pts := utilRescaleTimestamp(pkt.Dts, 90000, clockRate), utilRescaleTimestamp(pkt.Pts, 90000, clockRate)
+		switch streamType := streams[pid]; streamType {
+		case mpeg2.TS_STREAM_H264, mpeg2.TS_STREAM_H265:
+			if video == nil {
+				video = &DemuxFrameSource{codec: FrameCodecH264}
+				if streamType == mpeg2.TS_STREAM_H265 {
+					video.codec = FrameCodecH265
+				}
+			}
+			if nalus := utilSplitAnnexB(pkt.Pes_payload); len(nalus) > 0 {
+				video.frames = append(video.frames, &Frame{Codec: video.codec, DTS: dts, PTS: pts, Payloads: nalus})
+			}
+		case mpeg2.TS_STREAM_AAC:
+			if audio == nil {
+				audio = &DemuxFrameSource{codec: FrameCodecAAC}
+			}
+			return utilDemuxADTS(audio, pkt.Pes_payload, dts, clockRate)
+		}
+		return nil
+	}
+
+	for offset := 0; offset+packetSize <= len(b); offset += packetSize {
+		bs := codec.NewBitStream(b[offset : offset+packetSize])
+		var pkt mpeg2.TSPacket
+		if err := pkt.DecodeHeader(bs); err != nil {
+			return nil, nil, errors.Wrapf(err, "decode ts at %v", offset)
+		}
+		if pkt.Adaptation_field_control&0x01 == 0 {
+			continue // No payload.
+		}
+
+		payload := bs.RemainData()
+		switch _, isStream := streams[pkt.PID]; {
+		case pkt.PID == uint16(mpeg2.TS_PID_PAT) || pmts[pkt.PID]:
+			// Skip the pointer field of PSI.
+			if pkt.Payload_unit_start_indicator == 1 {
+				if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+					return nil, nil, errors.Errorf("invalid psi at %v", offset)
+				}
+				payload = payload[1+int(payload[0]):]
+			}
+
+			if pkt.PID == uint16(mpeg2.TS_PID_PAT) {
+				pat := mpeg2.NewPat()
+				if err := pat.Decode(codec.NewBitStream(payload)); err != nil {
+					return nil, nil, errors.Wrapf(err, "decode pat at %v", offset)
+				}
+				for _, pmt := range pat.Pmts {
+					if pmt.Program_number != 0 {
+						pmts[pmt.PID] = true
+					}
+				}
+			} else {
+				pmt := mpeg2.NewPmt()
+				if err := pmt.Decode(codec.NewBitStream(payload)); err != nil {
+					return nil, nil, errors.Wrapf(err, "decode pmt at %v", offset)
+				}
+				for _, stream := range pmt.Streams {
+					switch t := mpeg2.TS_STREAM_TYPE(stream.StreamType); t {
+					case mpeg2.TS_STREAM_H264, mpeg2.TS_STREAM_H265, mpeg2.TS_STREAM_AAC:
+						streams[stream.Elementary_PID] = t
+					}
+				}
+			}
+		case isStream:
+			if pkt.Payload_unit_start_indicator == 1 {
+				if err := onPES(pkt.PID, pes[pkt.PID]); err != nil {
+					return nil, nil, errors.Wrapf(err, "at %v", offset)
+				}
+				pes[pkt.PID] = nil
+			}
+			pes[pkt.PID] = append(pes[pkt.PID], payload...)
+		}
+	}
+
+	for pid, data := range pes {
+		if err := onPES(pid, data); err != nil {
+			return nil, nil, errors.Wrap(err, "flush")
+		}
+	}
+
+	utilUpdateFrameDurations(video)
+	return video, audio, nil
+}
+
+// Append the ADTS frames in payload to audio source, the DTS of each frame is increased by 1024 samples.
+func utilDemuxADTS(audio *DemuxFrameSource, b []byte, dts, clockRate uint64) error {
+	for len(b) > 0 {
+		asc, err := utilParseADTS(b)
+		if err != nil {
+			return errors.Wrap(err, "adts")
+		}
+		if audio.audioConfig == nil {
+			audio.audioConfig = asc
+		}
+
+		size := int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5])>>5
+		if size < 7 || size > len(b) {
+			return errors.Errorf("invalid ADTS frame length %v, left %v", size, len(b))
+		}
+
+		frame := &Frame{Codec: FrameCodecAAC, DTS: dts, PTS: dts, Payloads: [][]byte{b[:size]}}
+		audio.frames = append(audio.frames, frame)
+
+		dts += 1024 * clockRate / uint64(asc.SampleRate.ToHz())
+		b = b[size:]
+	}
+	return nil
+}
+
+// Update the duration of video frames by the DTS of next frame, the last one is the same as the previous one.
+func utilUpdateFrameDurations(video *DemuxFrameSource) {
+	if video == nil {
+		return
+	}
+
+	frames := video.frames
+	for i := 0; i+1 < len(frames); i++ {
+		if frames[i+1].DTS > frames[i].DTS {
+			frames[i].Duration = frames[i+1].DTS - frames[i].DTS
+		}
+	}
+	if n := len(frames); n > 1 {
+		frames[n-1].Duration = frames[n-2].Duration
+	}
+}
+
+// The box of MP4, the data is the payload without header, see ISO_IEC_14496-12-base-format-2012.pdf, @page 6, @section
+// 4.2 Object Structure.
+type mp4Box struct {
+	typ  string
+	data []byte
+}
+
+// Parse the boxes in b, which is the payload of container box.
+func utilParseMP4Boxes(b []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, errors.Errorf("invalid box header %v bytes", len(b))
+		}
+
+		size, typ, header := uint64(binary.BigEndian.Uint32(b)), string(b[4:8]), uint64(8)
+		if size == 1 {
+			if len(b) < 16 {
+				return nil, errors.Errorf("invalid large box %v", typ)
+			}
+			size, header = binary.BigEndian.Uint64(b[8:]), 16
+		} else if size == 0 {
+			size = uint64(len(b))
+		}
+		if size < header || size > uint64(len(b)) {
+			return nil, errors.Errorf("invalid box %v size %v, left %v", typ, size, len(b))
+		}
+
+		boxes = append(boxes, mp4Box{typ: typ, data: b[header:size]})
+		b = b[size:]
+	}
+	return boxes, nil
+}
+
+// Find the first box by the path of types, for example, mdia, minf, stbl. Return nil if not found.
+func utilFindMP4Box(b []byte, types ...string) ([]byte, error) {
+	for _, typ := range types {
+		boxes, err := utilParseMP4Boxes(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %v", typ)
+		}
+
+		b = nil
+		for _, box := range boxes {
+			if box.typ == typ {
+				b = box.data
+				break
+			}
+		}
+		if b == nil {
+			return nil, nil
+		}
+	}
+	return b, nil
+}
+
+// The sample table of a track in MP4.
+type mp4Track struct {
+	// The handler type, vide or soun.
+	handler string
+	// The time scale of timestamps.
+	timescale uint64
+	// The sample entry in stsd, for example, avc1, hvc1 or mp4a, and its payload.
+	entry     string
+	entryData []byte
+	// The sample tables.
+	stts, ctts, stsc, stsz, stco, co64 []byte
+}
+
+// Demux the MP4 file, the first video track of H.264 or H.265, and the first audio track of AAC. The samples of video
+// are converted from AVCC to NALUs with parameter sets before keyframes, and the AAC raw samples are converted to ADTS.
+func utilDemuxMP4(b []byte, clockRate uint64) (video, audio *DemuxFrameSource, err error) {
+	moov, err := utilFindMP4Box(b, "moov")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "moov")
+	} else if moov == nil {
+		return nil, nil, errors.New("no moov")
+	}
+
+	boxes, err := utilParseMP4Boxes(moov)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse moov")
+	}
+
+	for _, box := range boxes {
+		if box.typ != "trak" {
+			continue
+		}
+
+		track, err := utilParseMP4Track(box.data)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "trak")
+		}
+
+		if track.handler == "vide" && video == nil {
+			if video, err = utilDemuxMP4Video(b, track, clockRate); err != nil {
+				return nil, nil, errors.Wrapf(err, "video %v", track.entry)
+			}
+		} else if track.handler == "soun" && audio == nil {
+			if audio, err = utilDemuxMP4Audio(b, track, clockRate); err != nil {
+				return nil, nil, errors.Wrapf(err, "audio %v", track.entry)
+			}
+		}
+	}
+	return video, audio, nil
+}
+
+func utilParseMP4Track(trak []byte) (*mp4Track, error) {
+	track := &mp4Track{}
+
+	if hdlr, err := utilFindMP4Box(trak, "mdia", "hdlr"); err != nil || len(hdlr) < 12 {
+		return nil, errors.Errorf("invalid hdlr, err %v", err)
+	} else {
+		track.handler = string(hdlr[8:12])
+	}
+
+	// The version 1 of mdhd uses 64 bits time, see ISO_IEC_14496-12-base-format-2012.pdf, @page 24, @section 8.4.2.
+	if mdhd, err := utilFindMP4Box(trak, "mdia", "mdhd"); err != nil || len(mdhd) < 24 {
+		return nil, errors.Errorf("invalid mdhd, err %v", err)
+	} else if mdhd[0] == 1 {
+		if len(mdhd) < 24+4 {
+			return nil, errors.Errorf("invalid mdhd v1 %v bytes", len(mdhd))
+		}
+		track.timescale = uint64(binary.BigEndian.Uint32(mdhd[20:]))
+	} else {
+		track.timescale = uint64(binary.BigEndian.Uint32(mdhd[12:]))
+	}
+	if track.timescale == 0 {
+		return nil, errors.New("zero timescale")
+	}
+
+	stbl, err := utilFindMP4Box(trak, "mdia", "minf", "stbl")
+	if err != nil || stbl == nil {
+		return nil, errors.Errorf("no stbl, err %v", err)
+	}
+	boxes, err := utilParseMP4Boxes(stbl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse stbl")
+	}
+	for _, box := range boxes {
+		switch box.typ {
+		case "stsd":
+			// The full box header and entry count, then the first sample entry.
+			if len(box.data) < 8 {
+				return nil, errors.Errorf("invalid stsd %v bytes", len(box.data))
+			}
+			entries, err := utilParseMP4Boxes(box.data[8:])
+			if err != nil || len(entries) == 0 {
+				return nil, errors.Errorf("invalid stsd entries, err %v", err)
+			}
+			track.entry, track.entryData = entries[0].typ, entries[0].data
+		case "stts":
+			track.stts = box.data
+		case "ctts":
+			track.ctts = box.data
+		case "stsc":
+			track.stsc = box.data
+		case "stsz":
+			track.stsz = box.data
+		case "stco":
+			track.stco = box.data
+		case "co64":
+			track.co64 = box.data
+		}
+	}
+	return track, nil
+}
+
+// The sample of MP4, the timestamps are in timescale of track.
+type mp4Sample struct {
+	offset, size uint64
+	dts          uint64
+	cts          int64
+	duration     uint64
+}
+
+// Build the samples from the sample tables, see ISO_IEC_14496-12-base-format-2012.pdf, @page 40, @section 8.6 Time
+// to Sample Boxes, and @page 57, @section 8.7 Sample Table Boxes.
+func (v *mp4Track) samples() ([]*mp4Sample, error) {
+	// The full box header and entry count.
+	entries := func(b []byte, size int) (int, error) {
+		if len(b) < 8 {
+			return 0, errors.Errorf("invalid box %v bytes", len(b))
+		}
+		n := int(binary.BigEndian.Uint32(b[4:]))
+		if len(b) < 8+n*size {
+			return 0, errors.Errorf("invalid box %v entries of %v bytes, total %v bytes", n, size, len(b))
+		}
+		return n, nil
+	}
+
+	// The sample sizes, fixed if sample_size is not zero.
+	if len(v.stsz) < 12 {
+		return nil, errors.Errorf("invalid stsz %v bytes", len(v.stsz))
+	}
+	fixedSize, count := uint64(binary.BigEndian.Uint32(v.stsz[4:])), int(binary.BigEndian.Uint32(v.stsz[8:]))
+	if fixedSize == 0 && len(v.stsz) < 12+count*4 {
+		return nil, errors.Errorf("invalid stsz %v samples, %v bytes", count, len(v.stsz))
+	}
+
+	samples := make([]*mp4Sample, count)
+	for i := range samples {
+		samples[i] = &mp4Sample{size: fixedSize}
+		if fixedSize == 0 {
+			samples[i].size = uint64(binary.BigEndian.Uint32(v.stsz[12+i*4:]))
+		}
+	}
+
+	// The DTS by the delta of each sample.
+	n, err := entries(v.stts, 8)
+	if err != nil {
+		return nil, errors.Wrap(err, "stts")
+	}
+	var index int
+	var dts uint64
+	for i := 0; i < n; i++ {
+		count, delta := binary.BigEndian.Uint32(v.stts[8+i*8:]), uint64(binary.BigEndian.Uint32(v.stts[12+i*8:]))
+		for j := uint32(0); j < count && index < len(samples); j++ {
+			samples[index].dts, samples[index].duration = dts, delta
+			dts, index = dts+delta, index+1
+		}
+	}
+
+	// The composition offset, signed in version 1.
+	if v.ctts != nil {
+		if n, err = entries(v.ctts, 8); err != nil {
+			return nil, errors.Wrap(err, "ctts")
+		}
+		index = 0
+		for i := 0; i < n; i++ {
+			count, offset := binary.BigEndian.Uint32(v.ctts[8+i*8:]), binary.BigEndian.Uint32(v.ctts[12+i*8:])
+			cts := int64(offset)
+			if v.ctts[0] == 1 {
+				cts = int64(int32(offset))
+			}
+			for j := uint32(0); j < count && index < len(samples); j++ {
+				samples[index].cts, index = cts, index+1
+			}
+		}
+	}
+
+	// The chunk offsets, 32 or 64 bits.
+	var chunks []uint64
+	if v.co64 != nil {
+		if n, err = entries(v.co64, 8); err != nil {
+			return nil, errors.Wrap(err, "co64")
+		}
+		for i := 0; i < n; i++ {
+			chunks = append(chunks, binary.BigEndian.Uint64(v.co64[8+i*8:]))
+		}
+	} else {
+		if n, err = entries(v.stco, 4); err != nil {
+			return nil, errors.Wrap(err, "stco")
+		}
+		for i := 0; i < n; i++ {
+			chunks = append(chunks, uint64(binary.BigEndian.Uint32(v.stco[8+i*4:])))
+		}
+	}
+
+	// The samples of each chunk, the run of chunks is from the first chunk to the first chunk of next entry.
+	if n, err = entries(v.stsc, 12); err != nil {
+		return nil, errors.Wrap(err, "stsc")
+	}
+	index = 0
+	for i := 0; i < n; i++ {
+		first, perChunk := int(binary.BigEndian.Uint32(v.stsc[8+i*12:])), int(binary.BigEndian.Uint32(v.stsc[12+i*12:]))
+		last := len(chunks)
+		if i+1 < n {
+			last = int(binary.BigEndian.Uint32(v.stsc[8+(i+1)*12:])) - 1
+		}
+		if first < 1 || last > len(chunks) {
+			return nil, errors.Errorf("invalid stsc chunk %v-%v of %v", first, last, len(chunks))
+		}
+
+		for chunk := first - 1; chunk < last; chunk++ {
+			offset := chunks[chunk]
+			for j := 0; j < perChunk && index < len(samples); j++ {
+				samples[index].offset, offset, index = offset, offset+samples[index].size, index+1
+			}
+		}
+	}
+	if index != len(samples) {
+		return nil, errors.Errorf("chunks for %v samples of %v", index, len(samples))
+	}
+	return samples, nil
+}
+
+// The data of sample in file.
+func (v *mp4Sample) bytes(b []byte) ([]byte, error) {
+	if v.offset+v.size > uint64(len(b)) {
+		return nil, errors.Errorf("sample %v+%v exceeds file %v bytes", v.offset, v.size, len(b))
+	}
+	return b[v.offset : v.offset+v.size], nil
+}
+
+func utilDemuxMP4Video(b []byte, track *mp4Track, clockRate uint64) (*DemuxFrameSource, error) {
+	// The visual sample entry is 78 bytes, followed by the config box, see ISO_IEC_14496-12-base-format-2012.pdf,
+	// @page 110, @section 12.1.3 Sample entry.
+	if len(track.entryData) < 78 {
+		return nil, errors.Errorf("invalid visual sample entry %v bytes", len(track.entryData))
+	}
+
+	video := &DemuxFrameSource{codec: FrameCodecH264}
+	var config []byte
+	var err error
+	switch track.entry {
+	case "avc1", "avc3":
+		config, err = utilFindMP4Box(track.entryData[78:], "avcC")
+	case "hvc1", "hev1":
+		video.codec = FrameCodecH265
+		config, err = utilFindMP4Box(track.entryData[78:], "hvcC")
+	default:
+		return nil, nil // Ignore other codecs.
+	}
+	if err != nil || config == nil {
+		return nil, errors.Errorf("no decoder config, err %v", err)
+	}
+
+	lengthSize, parameterSets, err := utilParseMP4VideoConfig(config, video.codec)
+	if err != nil {
+		return nil, errors.Wrap(err, "config")
+	}
+
+	samples, err := track.samples()
+	if err != nil {
+		return nil, errors.Wrap(err, "samples")
+	}
+
+	// Make the composition offset not negative, because the PTS should not be less than DTS.
+	var shift int64
+	for _, sample := range samples {
+		if sample.cts < -shift {
+			shift = -sample.cts
+		}
+	}
+
+	for i, sample := range samples {
+		data, err := sample.bytes(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sample %v", i)
+		}
+
+		var nalus [][]byte
+		for len(data) > 0 {
+			if len(data) < lengthSize {
+				return nil, errors.Errorf("invalid NALU length of sample %v", i)
+			}
+
+			var size int
+			for _, v := range data[:lengthSize] {
+				size = size<<8 | int(v)
+			}
+			if size > len(data)-lengthSize {
+				return nil, errors.Errorf("invalid NALU size %v of sample %v, left %v", size, i, len(data))
+			}
+			nalus, data = append(nalus, data[lengthSize:lengthSize+size]), data[lengthSize+size:]
+		}
+
+		frame := &Frame{
+			Codec: video.codec, Payloads: nalus,
+			DTS:      utilRescaleTimestamp(sample.dts, track.timescale, clockRate),
+			PTS:      utilRescaleTimestamp(uint64(int64(sample.dts)+sample.cts+shift), track.timescale, clockRate),
+			Duration: utilRescaleTimestamp(sample.duration, track.timescale, clockRate),
+		}
+
+		// The parameter sets are in the config, so insert them before keyframe like the ANNEXB stream.
+		if utilHasIDRSlice(frame) && !utilIsKeyframe(frame) {
+			frame.Payloads = append(append([][]byte{}, parameterSets...), frame.Payloads...)
+		}
+		video.frames = append(video.frames, frame)
+	}
+	return video, nil
+}
+
+// Parse the NALU length size and parameter sets of avcC or hvcC, see ISO_IEC_14496-15-AVC-format-2012.pdf, @page 16,
+// @section 5.3.3.1.2 Syntax, and @page 74, @section 8.3.3.1.2 Syntax.
+func utilParseMP4VideoConfig(config []byte, c FrameCodec) (lengthSize int, parameterSets [][]byte, err error) {
+	// Read the NALUs in array, each is prefixed by 16 bits length.
+	readNALUs := func(b []byte, n int) ([]byte, error) {
+		for i := 0; i < n; i++ {
+			if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+				return nil, errors.Errorf("invalid parameter set %v of %v", i, n)
+			}
+			size := int(binary.BigEndian.Uint16(b))
+			parameterSets, b = append(parameterSets, b[2:2+size]), b[2+size:]
+		}
+		return b, nil
+	}
+
+	if c == FrameCodecH265 {
+		if len(config) < 23 {
+			return 0, nil, errors.Errorf("invalid hvcC %v bytes", len(config))
+		}
+		lengthSize = int(config[21]&0x03) + 1
+
+		b := config[23:]
+		for i := 0; i < int(config[22]); i++ {
+			if len(b) < 3 {
+				return 0, nil, errors.Errorf("invalid hvcC array %v", i)
+			}
+			if b, err = readNALUs(b[3:], int(binary.BigEndian.Uint16(b[1:]))); err != nil {
+				return 0, nil, errors.Wrapf(err, "hvcC array %v", i)
+			}
+		}
+		return lengthSize, parameterSets, nil
+	}
+
+	if len(config) < 6 {
+		return 0, nil, errors.Errorf("invalid avcC %v bytes", len(config))
+	}
+	lengthSize = int(config[4]&0x03) + 1
+
+	b, err := readNALUs(config[6:], int(config[5]&0x1f))
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "avcC sps")
+	}
+	if len(b) < 1 {
+		return 0, nil, errors.New("no avcC pps")
+	}
+	if _, err = readNALUs(b[1:], int(b[0])); err != nil {
+		return 0, nil, errors.Wrap(err, "avcC pps")
+	}
+	return lengthSize, parameterSets, nil
+}
+
+// Whether the frame has IDR slice, 5 is IDR for H.264, and 16~23 is IRAP for H.265.
+func utilHasIDRSlice(frame *Frame) bool {
+	for _, nalu := range frame.Payloads {
+		if len(nalu) == 0 {
+			continue
+		}
+		if t := NalUnitType((nalu[0] & 0x7e) >> 1); frame.Codec == FrameCodecH265 && t >= NaluTypeSliceBlaWlp && t <= NaluTypeSliceRsvIrapVcl23 {
+			return true
+		} else if frame.Codec != FrameCodecH265 && nalu[0]&0x1f == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+func utilDemuxMP4Audio(b []byte, track *mp4Track, clockRate uint64) (*DemuxFrameSource, error) {
+	if track.entry != "mp4a" {
+		return nil, nil // Ignore other codecs.
+	}
+
+	// The audio sample entry is 28 bytes, and the QuickTime sound description version 1 and 2 has extra 16 and 36
+	// bytes, followed by the esds box.
+	entry := track.entryData
+	if len(entry) < 28 {
+		return nil, errors.Errorf("invalid audio sample entry %v bytes", len(entry))
+	}
+	skip := 28
+	switch binary.BigEndian.Uint16(entry[8:]) {
+	case 1:
+		skip += 16
+	case 2:
+		skip += 36
+	}
+	if len(entry) < skip {
+		return nil, errors.Errorf("invalid audio sample entry %v bytes, skip %v", len(entry), skip)
+	}
+
+	esds, err := utilFindMP4Box(entry[skip:], "esds")
+	if err != nil || esds == nil {
+		return nil, errors.Errorf("no esds, err %v", err)
+	}
+	ascData, err := utilParseMP4ESDS(esds)
+	if err != nil {
+		return nil, errors.Wrap(err, "esds")
+	}
+
+	asc := &aac.AudioSpecificConfig{}
+	if err := asc.UnmarshalBinary(ascData); err != nil {
+		return nil, errors.Wrapf(err, "asc %x", ascData)
+	}
+
+	adts, err := aac.NewADTS()
+	if err != nil {
+		return nil, errors.Wrap(err, "adts")
+	}
+	if err := adts.SetASC(ascData); err != nil {
+		return nil, errors.Wrapf(err, "adts asc %x", ascData)
+	}
+
+	samples, err := track.samples()
+	if err != nil {
+		return nil, errors.Wrap(err, "samples")
+	}
+
+	audio := &DemuxFrameSource{codec: FrameCodecAAC, audioConfig: asc}
+	for i, sample := range samples {
+		data, err := sample.bytes(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sample %v", i)
+		}
+
+		frame, err := adts.Encode(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encode sample %v", i)
+		}
+
+		dts := utilRescaleTimestamp(sample.dts, track.timescale, clockRate)
+		audio.frames = append(audio.frames, &Frame{Codec: FrameCodecAAC, DTS: dts, PTS: dts, Payloads: [][]byte{frame}})
+	}
+	return audio, nil
+}
+
+// Parse the AudioSpecificConfig from esds, which is the DecoderSpecificInfo(0x05) in DecoderConfigDescriptor(0x04) in
+// ES_Descriptor(0x03), see ISO_IEC_14496-1-System-2010.pdf, @page 47, @section 7.2.6.5 ES_Descriptor.
+func utilParseMP4ESDS(esds []byte) ([]byte, error) {
+	// Read the tag and the length in 7 bits of each byte, return the payload of descriptor.
+	readDescriptor := func(b []byte, tag uint8) ([]byte, error) {
+		if len(b) < 2 || b[0] != tag {
+			return nil, errors.Errorf("no descriptor 0x%x", tag)
+		}
+
+		var size, i int
+		for i = 1; i < len(b) && i <= 4; i++ {
+			size = size<<7 | int(b[i]&0x7f)
+			if b[i]&0x80 == 0 {
+				break
+			}
+		}
+		if i >= len(b) || i+1+size > len(b) {
+			return nil, errors.Errorf("invalid descriptor 0x%x size %v, left %v", tag, size, len(b))
+		}
+		return b[i+1 : i+1+size], nil
+	}
+
+	// Skip the full box header.
+	if len(esds) < 4 {
+		return nil, errors.Errorf("invalid esds %v bytes", len(esds))
+	}
+	es, err := readDescriptor(esds[4:], 0x03)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ES_ID and flags, with optional dependsOn_ES_ID, URL and OCR_ES_Id.
+	if len(es) < 3 {
+		return nil, errors.Errorf("invalid es descriptor %v bytes", len(es))
+	}
+	flags, skip := es[2], 3
+	if flags&0x80 != 0 {
+		skip += 2
+	}
+	if flags&0x40 != 0 && len(es) > skip {
+		skip += 1 + int(es[skip])
+	}
+	if flags&0x20 != 0 {
+		skip += 2
+	}
+	if len(es) < skip {
+		return nil, errors.Errorf("invalid es descriptor flags 0x%x", flags)
+	}
+
+	dc, err := readDescriptor(es[skip:], 0x04)
+	if err != nil {
+		return nil, err
+	}
+
+	// The objectTypeIndication, streamType, bufferSizeDB, maxBitrate and avgBitrate.
+	if len(dc) < 13 {
+		return nil, errors.Errorf("invalid decoder config %v bytes", len(dc))
+	}
+	if dc[0] != 0x40 {
+		return nil, errors.Errorf("not AAC object type 0x%x", dc[0])
+	}
+	return readDescriptor(dc[13:], 0x05)
+}
@@ -0,0 +1,542 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// The action to damage the video frame, see FaultRule.
+type FaultAction int
+
+const (
+	// Drop the slices of frame, keep the parameter sets such as SPS and PPS.
+	FaultActionDrop FaultAction = iota
+	// Truncate each slice of frame to random length, keep the NALU header.
+	FaultActionTruncate
+	// Flip a random bit in each slice of frame, except the NALU header.
+	FaultActionFlip
+)
+
+func (v FaultAction) String() string {
+	switch v {
+	case FaultActionDrop:
+		return "drop"
+	case FaultActionTruncate:
+		return "truncate"
+	case FaultActionFlip:
+		return "flip"
+	default:
+		return "unknown"
+	}
+}
+
+// The frames to damage, the keyframes are controlled separately, because damaging keyframe breaks the whole GOP.
+type FaultTarget int
+
+const (
+	// The non-keyframe, such as P or B frame.
+	FaultTargetInterframe FaultTarget = iota
+	// The keyframe, IDR for H.264 or IRAP for H.265.
+	FaultTargetKeyframe
+)
+
+func (v FaultTarget) String() string {
+	if v == FaultTargetKeyframe {
+		return "key"
+	}
+	return "p"
+}
+
+// FaultRule damages every Nth frame of target, for example, drop every 10th P frame.
+type FaultRule struct {
+	Action FaultAction
+	Target FaultTarget
+	Every  uint64
+}
+
+func (v *FaultRule) String() string {
+	return fmt.Sprintf("%v:%v:%v", v.Action, v.Target, v.Every)
+}
+
+// ParseFaultRules parses the rules in action:target:every separated by comma, for example, drop:p:10,flip:key:5
+// where action is drop, truncate or flip, and target is p or key.
+func ParseFaultRules(spec string) ([]*FaultRule, error) {
+	var rules []*FaultRule
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		ss := strings.Split(s, ":")
+		if len(ss) != 3 {
+			return nil, errors.Errorf("invalid fault rule %v", s)
+		}
+
+		rule := &FaultRule{}
+		switch ss[0] {
+		case "drop":
+			rule.Action = FaultActionDrop
+		case "truncate":
+			rule.Action = FaultActionTruncate
+		case "flip":
+			rule.Action = FaultActionFlip
+		default:
+			return nil, errors.Errorf("invalid fault action %v of %v", ss[0], s)
+		}
+
+		switch ss[1] {
+		case "p":
+			rule.Target = FaultTargetInterframe
+		case "key":
+			rule.Target = FaultTargetKeyframe
+		default:
+			return nil, errors.Errorf("invalid fault target %v of %v", ss[1], s)
+		}
+
+		every, err := strconv.ParseUint(ss[2], 10, 64)
+		if err != nil || every == 0 {
+			return nil, errors.Errorf("invalid fault every %v of %v", ss[2], s)
+		}
+		rule.Every = every
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// FaultInjector damages the video frames by rules, to test the error resilience of decoder and server. Note that it
+// intentionally produces the non-conformant stream, the damaged frames are still delivered over network.
+type FaultInjector struct {
+	rules []*FaultRule
+	hevc  bool
+	// The seeded random for truncate length and flip position, to reproduce the same damage.
+	r *rand.Rand
+	// The number of keyframes and interframes.
+	keyframes, interframes uint64
+	// The number of frames damaged by each action.
+	Dropped, Truncated, Flipped uint64
+}
+
+func NewFaultInjector(rules []*FaultRule, seed int64, hevc bool) *FaultInjector {
+	return &FaultInjector{rules: rules, hevc: hevc, r: rand.New(rand.NewSource(seed))}
+}
+
+func (v *FaultInjector) String() string {
+	return fmt.Sprintf("dropped=%v, truncated=%v, flipped=%v", v.Dropped, v.Truncated, v.Flipped)
+}
+
+// Apply damages the NALUs of frame by the first matched rule, returns the damaged NALUs, which might be empty if
+// dropped. The NALUs are copied before damaged, so the source NALUs are never modified.
+func (v *FaultInjector) Apply(nalus [][]byte) [][]byte {
+	var isKeyframe, hasSlice bool
+	for _, nalu := range nalus {
+		if isSlice, isKey := v.sliceType(nalu); isSlice {
+			hasSlice, isKeyframe = true, isKeyframe || isKey
+		}
+	}
+	if !hasSlice {
+		return nalus
+	}
+
+	var target FaultTarget
+	var index uint64
+	if isKeyframe {
+		v.keyframes++
+		target, index = FaultTargetKeyframe, v.keyframes
+	} else {
+		v.interframes++
+		target, index = FaultTargetInterframe, v.interframes
+	}
+
+	var rule *FaultRule
+	for _, r := range v.rules {
+		if r.Target == target && index%r.Every == 0 {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		return nalus
+	}
+
+	headerSize := 1
+	if v.hevc {
+		headerSize = 2
+	}
+
+	var damaged [][]byte
+	for _, nalu := range nalus {
+		if isSlice, _ := v.sliceType(nalu); !isSlice || len(nalu) <= headerSize {
+			damaged = append(damaged, nalu)
+			continue
+		}
+
+		switch rule.Action {
+		case FaultActionTruncate:
+			size := headerSize + v.r.Intn(len(nalu)-headerSize)
+			damaged = append(damaged, append([]byte{}, nalu[:size]...))
+		case FaultActionFlip:
+			b := append([]byte{}, nalu...)
+			pos := headerSize + v.r.Intn(len(b)-headerSize)
+			b[pos] ^= 1 << uint(v.r.Intn(8))
+			damaged = append(damaged, b)
+		}
+	}
+
+	switch rule.Action {
+	case FaultActionDrop:
+		v.Dropped++
+	case FaultActionTruncate:
+		v.Truncated++
+	case FaultActionFlip:
+		v.Flipped++
+	}
+	return damaged
+}
+
+// Whether the NALU is a slice, and whether it's a keyframe slice.
+func (v *FaultInjector) sliceType(nalu []byte) (isSlice, isKeyframe bool) {
+	if len(nalu) == 0 {
+		return false, false
+	}
+
+	if v.hevc {
+		t := NalUnitType((nalu[0] & 0x7e) >> 1)
+		return t <= NaluTypeSliceRsvIrapVcl23, t >= NaluTypeSliceBlaWlp && t <= NaluTypeSliceRsvIrapVcl23
+	}
+
+	t := nalu[0] & 0x1f
+	return t >= 1 && t <= 5, t == 5
+}
+
+// The action to corrupt the PS stream, see PSFaultRule. Unlike FaultAction which damages the video frame, it damages
+// the PS packets, to test the PS demuxer of server.
+type PSFaultAction int
+
+const (
+	// Flip a random bit of pack header, except the start code.
+	PSFaultActionFlipPack PSFaultAction = iota
+	// Truncate the PES packet to random length, keep the start code and PES_packet_length.
+	PSFaultActionTruncatePES
+	// Drop the PSM, so the server doesn't know the codec of following PES packets.
+	PSFaultActionDropPSM
+	// Overwrite the PES_packet_length by a wrong value.
+	PSFaultActionPESLength
+)
+
+func (v PSFaultAction) String() string {
+	switch v {
+	case PSFaultActionFlipPack:
+		return "flip-pack"
+	case PSFaultActionTruncatePES:
+		return "truncate-pes"
+	case PSFaultActionDropPSM:
+		return "drop-psm"
+	case PSFaultActionPESLength:
+		return "pes-length"
+	default:
+		return "unknown"
+	}
+}
+
+// PSFaultRule corrupts the target PS packets of action at the rate, for example, drop 10% of PSM.
+type PSFaultRule struct {
+	Action PSFaultAction
+	// The probability in (0, 1] to corrupt each target packet.
+	Rate float64
+}
+
+func (v *PSFaultRule) String() string {
+	return fmt.Sprintf("%v:%v", v.Action, v.Rate)
+}
+
+// ParsePSFaultRules parses the rules in action:rate separated by comma, for example, drop-psm:0.1,pes-length:0.01
+// where action is flip-pack, truncate-pes, drop-psm or pes-length, and rate is the probability in (0, 1].
+func ParsePSFaultRules(spec string) ([]*PSFaultRule, error) {
+	var rules []*PSFaultRule
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		ss := strings.Split(s, ":")
+		if len(ss) != 2 {
+			return nil, errors.Errorf("invalid ps fault rule %v", s)
+		}
+
+		rule := &PSFaultRule{}
+		switch ss[0] {
+		case "flip-pack":
+			rule.Action = PSFaultActionFlipPack
+		case "truncate-pes":
+			rule.Action = PSFaultActionTruncatePES
+		case "drop-psm":
+			rule.Action = PSFaultActionDropPSM
+		case "pes-length":
+			rule.Action = PSFaultActionPESLength
+		default:
+			return nil, errors.Errorf("invalid ps fault action %v of %v", ss[0], s)
+		}
+
+		rate, err := strconv.ParseFloat(ss[1], 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return nil, errors.Errorf("invalid ps fault rate %v of %v", ss[1], s)
+		}
+		rule.Rate = rate
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// PSFaultInjector corrupts the PS packets by rules before sent over RTP, to fuzz the PS demuxer of server under
+// controlled conditions. Like FaultInjector, the stream is non-conformant intentionally.
+type PSFaultInjector struct {
+	rules []*PSFaultRule
+	// The seeded random for rate, position and length, to reproduce the same corruption.
+	r *rand.Rand
+	// The number of packets corrupted by each action.
+	FlippedPacks, TruncatedPES, DroppedPSM, WrongPESLength uint64
+}
+
+func NewPSFaultInjector(rules []*PSFaultRule, seed int64) *PSFaultInjector {
+	return &PSFaultInjector{rules: rules, r: rand.New(rand.NewSource(seed))}
+}
+
+func (v *PSFaultInjector) String() string {
+	return fmt.Sprintf("flip-pack=%v, truncate-pes=%v, drop-psm=%v, pes-length=%v",
+		v.FlippedPacks, v.TruncatedPES, v.DroppedPSM, v.WrongPESLength)
+}
+
+// Whether to corrupt the packet by action, by the rate of rule.
+func (v *PSFaultInjector) hit(action PSFaultAction) bool {
+	for _, rule := range v.rules {
+		if rule.Action == action && v.r.Float64() < rule.Rate {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply corrupts the packets by rules, returns the packets to send, which might be less than packs if PSM dropped. The
+// corrupted packets are copied, so the source packets are never modified.
+func (v *PSFaultInjector) Apply(packs []*PSPacket) []*PSPacket {
+	corrupted := make([]*PSPacket, 0, len(packs))
+	for _, pack := range packs {
+		switch pack.t {
+		case PSPacketTypePackHeader:
+			if len(pack.ps) == 0 || len(pack.ps[0]) <= 4 || !v.hit(PSFaultActionFlipPack) {
+				break
+			}
+
+			b := append([]byte{}, pack.ps[0]...)
+			b[4+v.r.Intn(len(b)-4)] ^= 1 << uint(v.r.Intn(8))
+			pack = pack.copyWith(append([][]byte{b}, pack.ps[1:]...))
+			v.FlippedPacks++
+		case PSPacketTypeProgramStramMap:
+			if v.hit(PSFaultActionDropPSM) {
+				v.DroppedPSM++
+				continue
+			}
+		case PSPacketTypeVideo, PSPacketTypeAudio:
+			// Each PES starts with 4 bytes start code and 2 bytes PES_packet_length.
+			var ps [][]byte
+			for i, pes := range pack.ps {
+				if len(pes) > 6 && v.hit(PSFaultActionTruncatePES) {
+					pes = append([]byte{}, pes[:6+v.r.Intn(len(pes)-6)]...)
+					v.TruncatedPES++
+				} else if len(pes) >= 6 && v.hit(PSFaultActionPESLength) {
+					pes = append([]byte{}, pes...)
+					length := uint16(pes[4])<<8 | uint16(pes[5])
+					if wrong := uint16(v.r.Intn(65536)); wrong != length {
+						length = wrong
+					} else {
+						length ^= 1
+					}
+					pes[4], pes[5] = uint8(length>>8), uint8(length)
+					v.WrongPESLength++
+				} else if ps == nil {
+					continue
+				}
+
+				if ps == nil {
+					ps = append([][]byte{}, pack.ps[:i]...)
+				}
+				ps = append(ps, pes)
+			}
+			if ps != nil {
+				pack = pack.copyWith(ps)
+			}
+		}
+		corrupted = append(corrupted, pack)
+	}
+	return corrupted
+}
+
+// The action to disturb the RTP packets, see RTPFaultRule. Unlike PSFaultAction, the PS data is intact, while the RTP
+// header or the order of packets is disturbed, like a misbehaving camera, to test the jitter buffer of server.
+type RTPFaultAction int
+
+const (
+	// Jump the sequence number forward by a random gap in [1, 1000], as if the packets are lost.
+	RTPFaultActionSeqJump RTPFaultAction = iota
+	// Send the packet twice, with the same sequence number.
+	RTPFaultActionDuplicate
+	// Hold the packet and send it after the next one, the out-of-order delivery.
+	RTPFaultActionReorder
+	// Rollback the timestamp of packet by a random duration up to 1s.
+	RTPFaultActionTSRollback
+)
+
+func (v RTPFaultAction) String() string {
+	switch v {
+	case RTPFaultActionSeqJump:
+		return "seq-jump"
+	case RTPFaultActionDuplicate:
+		return "duplicate"
+	case RTPFaultActionReorder:
+		return "reorder"
+	case RTPFaultActionTSRollback:
+		return "ts-rollback"
+	default:
+		return "unknown"
+	}
+}
+
+// RTPFaultRule disturbs the RTP packets of action at the rate, for example, duplicate 1% of packets.
+type RTPFaultRule struct {
+	Action RTPFaultAction
+	// The probability in (0, 1] to disturb each packet.
+	Rate float64
+}
+
+func (v *RTPFaultRule) String() string {
+	return fmt.Sprintf("%v:%v", v.Action, v.Rate)
+}
+
+// ParseRTPFaultRules parses the rules in action:rate separated by comma, for example, seq-jump:0.01,reorder:0.05
+// where action is seq-jump, duplicate, reorder or ts-rollback, and rate is the probability in (0, 1].
+func ParseRTPFaultRules(spec string) ([]*RTPFaultRule, error) {
+	var rules []*RTPFaultRule
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		ss := strings.Split(s, ":")
+		if len(ss) != 2 {
+			return nil, errors.Errorf("invalid rtp fault rule %v", s)
+		}
+
+		rule := &RTPFaultRule{}
+		switch ss[0] {
+		case "seq-jump":
+			rule.Action = RTPFaultActionSeqJump
+		case "duplicate":
+			rule.Action = RTPFaultActionDuplicate
+		case "reorder":
+			rule.Action = RTPFaultActionReorder
+		case "ts-rollback":
+			rule.Action = RTPFaultActionTSRollback
+		default:
+			return nil, errors.Errorf("invalid rtp fault action %v of %v", ss[0], s)
+		}
+
+		rate, err := strconv.ParseFloat(ss[1], 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return nil, errors.Errorf("invalid rtp fault rate %v of %v", ss[1], s)
+		}
+		rule.Rate = rate
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// RTPFaultInjector decides how to disturb each RTP packet by rules, which is applied by PSClient when sending. Like
+// PSFaultInjector, the stream is non-conformant intentionally.
+type RTPFaultInjector struct {
+	rules []*RTPFaultRule
+	// The seeded random for rate, gap and rollback, to reproduce the same disturbance.
+	r *rand.Rand
+	// The number of packets disturbed by each action.
+	SeqJumps, Duplicated, Reordered, TSRollbacks uint64
+}
+
+func NewRTPFaultInjector(rules []*RTPFaultRule, seed int64) *RTPFaultInjector {
+	return &RTPFaultInjector{rules: rules, r: rand.New(rand.NewSource(seed))}
+}
+
+func (v *RTPFaultInjector) String() string {
+	return fmt.Sprintf("seq-jump=%v, duplicate=%v, reorder=%v, ts-rollback=%v",
+		v.SeqJumps, v.Duplicated, v.Reordered, v.TSRollbacks)
+}
+
+// Whether to disturb the packet by action, by the rate of rule.
+func (v *RTPFaultInjector) hit(action RTPFaultAction) bool {
+	for _, rule := range v.rules {
+		if rule.Action == action && v.r.Float64() < rule.Rate {
+			return true
+		}
+	}
+	return false
+}
+
+// SeqGap returns the gap to jump the sequence number forward, 0 to keep it continuous.
+func (v *RTPFaultInjector) SeqGap() uint16 {
+	if !v.hit(RTPFaultActionSeqJump) {
+		return 0
+	}
+	v.SeqJumps++
+	return uint16(1 + v.r.Intn(1000))
+}
+
+// Rollback returns the timestamp rolled back by a random duration up to 1s in clock rate, or ts if not hit.
+func (v *RTPFaultInjector) Rollback(ts uint32, clockRate uint64) uint32 {
+	if clockRate == 0 || !v.hit(RTPFaultActionTSRollback) {
+		return ts
+	}
+	v.TSRollbacks++
+	return ts - uint32(1+v.r.Int63n(int64(clockRate)))
+}
+
+// Duplicate returns whether to send the packet twice.
+func (v *RTPFaultInjector) Duplicate() bool {
+	if !v.hit(RTPFaultActionDuplicate) {
+		return false
+	}
+	v.Duplicated++
+	return true
+}
+
+// Reorder returns whether to hold the packet and send it after the next one.
+func (v *RTPFaultInjector) Reorder() bool {
+	if !v.hit(RTPFaultActionReorder) {
+		return false
+	}
+	v.Reordered++
+	return true
+}
@@ -0,0 +1,129 @@
+//go:build ffprobe
+// +build ffprobe
+
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The result of ffprobe, see ffprobe -show_streams -count_frames -of json.
+type ffprobeResult struct {
+	Streams []struct {
+		CodecType    string `json:"codec_type"`
+		CodecName    string `json:"codec_name"`
+		NbReadFrames string `json:"nb_read_frames"`
+	} `json:"streams"`
+}
+
+// Probe the PS file by ffprobe.
+func ffprobePS(t *testing.T, filename string) *ffprobeResult {
+	b, err := exec.Command("ffprobe", "-v", "error", "-f", "mpeg", "-show_streams", "-count_frames",
+		"-of", "json", filename).Output()
+	if err != nil {
+		t.Fatalf("ffprobe %v, err %+v", filename, err)
+	}
+
+	r := &ffprobeResult{}
+	if err := json.Unmarshal(b, r); err != nil {
+		t.Fatalf("parse %v, err %+v", string(b), err)
+	}
+	return r
+}
+
+// Mux the PS from the video and audio file, then check by ffprobe.
+func ffprobeMux(t *testing.T, video string, frames uint64, expectVideo string) {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		t.Skipf("no ffprobe, err %v", err)
+	}
+
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Fatalf("err %+v", err)
+	}
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "srs-bench-ffprobe")
+	if err != nil {
+		t.Fatalf("err %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(path.Join(dir, "output.ps"))
+	if err != nil {
+		t.Fatalf("err %+v", err)
+	}
+	defer f.Close()
+
+	v := NewPSIngester(&IngesterConfig{
+		ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+		psConfig: PSConfig{video: video, audio: "../avatar.aac", fps: 25, maxFrames: frames},
+	})
+	v.onSendPacket = func(pack *PSPackStream) error {
+		_, err := pack.WriteTo(f)
+		return err
+	}
+
+	if err := v.Ingest(ctx); err != nil {
+		t.Fatalf("err %+v", err)
+	}
+
+	r := ffprobePS(t, f.Name())
+	if len(r.Streams) != 2 {
+		t.Fatalf("invalid streams %v", r.Streams)
+	}
+
+	for _, stream := range r.Streams {
+		if stream.CodecType == "video" {
+			if stream.CodecName != expectVideo {
+				t.Errorf("invalid video codec %v, expect %v", stream.CodecName, expectVideo)
+			}
+			if n, err := strconv.ParseUint(stream.NbReadFrames, 10, 64); err != nil || n != frames {
+				t.Errorf("invalid video frames %v, expect %v", stream.NbReadFrames, frames)
+			}
+		} else if stream.CodecType == "audio" && stream.CodecName != "aac" {
+			t.Errorf("invalid audio codec %v", stream.CodecName)
+		}
+	}
+}
+
+func TestFFprobeH264(t *testing.T) {
+	ffprobeMux(t, "../avatar.h264", 50, "h264")
+}
+
+func TestFFprobeH265(t *testing.T) {
+	ffprobeMux(t, "../avatar.h265", 50, "hevc")
+}
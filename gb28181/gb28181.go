@@ -27,14 +27,53 @@ import (
 	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/logger"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 type gbMainConfig struct {
 	sipConfig SIPConfig
 	psConfig  PSConfig
+	// The template of device ID, see ParseDeviceIDTemplate, ignore if empty.
+	idTemplate string
+	// The number of devices to simulate, each with its own device ID, SIP and media connections.
+	devices int
+	// The start delay in ms for each device.
+	delay int
+	// The number of channels of device, each is invited separately.
+	channels int
+	// The number of channels in Catalog response, and the max channels in each response.
+	catalog     int
+	catalogPage int
+	// The listen address to serve metrics in Prometheus format, ignore if empty.
+	metrics string
+	// The interval of keepalive MESSAGE.
+	keepalive time.Duration
+	// Skip all keepalives after sent N, and delay each keepalive, to verify the server times out the device.
+	keepaliveSkip  uint64
+	keepaliveDelay time.Duration
+	// Let the registration lapse after the duration, and register again after it expired for the duration.
+	registerLapse    time.Duration
+	registerReappear time.Duration
+	// Whether send unregister with Expires=0 when lapse and quit.
+	unregister bool
+	// The TCP setup of media, active or passive, overwrite the SDP of INVITE. Use SDP if empty.
+	setup string
+	// Whether response RecordInfo query and notify end of file for playback, and the length of synthetic recordings.
+	playback     bool
+	recordLength time.Duration
+	// The interval to send alarm to subscriptions, 0 to disable, and the listen address to trigger alarm by HTTP.
+	alarmInterval time.Duration
+	alarmHTTP     string
+	// The PEM files of certificate and SM2 private key of GB35114 device, ignore if empty.
+	gb35114Cert string
+	gb35114Key  string
+	// The config of platform mode, to act as the superior platform of the cascade of SRS, ignore if no listen address.
+	platformConfig GBPlatformConfig
 }
 
 func Parse(ctx context.Context) interface{} {
@@ -48,11 +87,81 @@ func Parse(ctx context.Context) interface{} {
 	fl.StringVar(&c.sipConfig.user, "user", "", "")
 	fl.StringVar(&c.sipConfig.server, "server", "", "")
 	fl.StringVar(&c.sipConfig.domain, "domain", "", "")
+	fl.StringVar(&c.sipConfig.username, "username", "", "")
+	fl.StringVar(&c.sipConfig.password, "password", "", "")
+	fl.IntVar(&c.sipConfig.expires, "expires", 3600, "")
 	fl.IntVar(&c.sipConfig.random, "random", 0, "")
+	fl.StringVar(&c.idTemplate, "id-tpl", "", "")
+	fl.IntVar(&c.devices, "nn", 1, "")
+	fl.IntVar(&c.delay, "delay", 50, "")
+	fl.IntVar(&c.channels, "channels", 1, "")
+	fl.IntVar(&c.catalog, "catalog", 0, "")
+	fl.IntVar(&c.catalogPage, "catalog-page", 4, "")
+	fl.StringVar(&c.metrics, "metrics", "", "")
+	fl.DurationVar(&c.keepalive, "keepalive", time.Second, "")
+	fl.Uint64Var(&c.keepaliveSkip, "ka-skip", 0, "")
+	fl.DurationVar(&c.keepaliveDelay, "ka-delay", 0, "")
+	fl.DurationVar(&c.registerLapse, "reg-lapse", 0, "")
+	fl.DurationVar(&c.registerReappear, "reg-reappear", 0, "")
+	fl.BoolVar(&c.unregister, "unregister", false, "")
+	fl.BoolVar(&c.sipConfig.gb2022, "gb2022", false, "")
+	fl.StringVar(&c.gb35114Cert, "gb35114-cert", "", "")
+	fl.StringVar(&c.gb35114Key, "gb35114-key", "", "")
+	fl.BoolVar(&c.psConfig.sm4, "sm4", false, "")
+	fl.StringVar(&c.platformConfig.addr, "platform", "", "")
+	fl.StringVar(&c.platformConfig.mediaIP, "platform-ip", "", "")
 
 	fl.StringVar(&c.psConfig.video, "sv", "", "")
 	fl.StringVar(&c.psConfig.audio, "sa", "", "")
+	fl.StringVar(&c.psConfig.audioCodec, "acodec", "aac", "")
+	fl.StringVar(&c.psConfig.videoCodec, "vcodec", "", "")
 	fl.IntVar(&c.psConfig.fps, "fps", 0, "")
+	fl.StringVar(&c.psConfig.fpsRate, "rate", "", "")
+	fl.StringVar(&c.psConfig.gap, "gap", "error", "")
+	fl.IntVar(&c.psConfig.headerInterval, "hi", 0, "")
+	fl.StringVar(&c.psConfig.headerMode, "hm", "idr", "")
+	fl.StringVar(&c.psConfig.rtcpAddr, "rtcp", "", "")
+	fl.StringVar(&c.psConfig.trace, "trace", "", "")
+	fl.BoolVar(&c.psConfig.sei, "sei", false, "")
+	fl.IntVar(&c.psConfig.fragmentMin, "frag", 0, "")
+	fl.Int64Var(&c.psConfig.fragmentSeed, "seed", 0, "")
+	fl.StringVar(&c.psConfig.framing, "framing", "rfc4571", "")
+	fl.BoolVar(&c.psConfig.rtcpMux, "rtcp-mux", false, "")
+	fl.DurationVar(&c.psConfig.maxDuration, "duration", 0, "")
+	fl.Uint64Var(&c.psConfig.maxFrames, "frames", 0, "")
+	fl.Uint64Var(&c.psConfig.maxBytes, "bytes", 0, "")
+	fl.StringVar(&c.psConfig.tee, "tee", "", "")
+	fl.DurationVar(&c.psConfig.verifyTimeout, "verify", 0, "")
+	fl.StringVar(&c.psConfig.bitrateProfile, "bp", "", "")
+	fl.Uint64Var(&c.psConfig.bitrateMin, "bp-min", 500, "")
+	fl.Uint64Var(&c.psConfig.bitrateMax, "bp-max", 2000, "")
+	fl.DurationVar(&c.psConfig.bitratePeriod, "bp-period", 30*time.Second, "")
+	fl.IntVar(&c.psConfig.audioPT, "apt", 0, "")
+	fl.StringVar(&c.psConfig.clockRates, "clock-rates", "", "")
+	fl.StringVar(&c.psConfig.fault, "fault", "", "")
+	fl.Int64Var(&c.psConfig.faultSeed, "fault-seed", 0, "")
+	fl.StringVar(&c.psConfig.psFault, "ps-fault", "", "")
+	fl.StringVar(&c.psConfig.rtpFault, "rtp-fault", "", "")
+	fl.DurationVar(&c.psConfig.packetGap, "pg", 0, "")
+	fl.Float64Var(&c.psConfig.speed, "speed", 1, "")
+	fl.StringVar(&c.psConfig.drift, "drift", "", "")
+	fl.Uint64Var(&c.psConfig.ssrc, "ssrc", 0, "")
+	fl.DurationVar(&c.psConfig.ssrcChange, "ssrc-change", 0, "")
+	fl.IntVar(&c.psConfig.reconnect, "reconnect", 0, "")
+	fl.DurationVar(&c.psConfig.reconnectBackoff, "reconnect-backoff", time.Second, "")
+	fl.BoolVar(&c.psConfig.reconnectRestart, "reconnect-restart", false, "")
+	fl.IntVar(&c.psConfig.pesLength, "pes", 1400, "")
+	fl.IntVar(&c.psConfig.maxPayload, "payload", 0, "")
+	fl.StringVar(&c.psConfig.media, "media", "", "")
+	fl.StringVar(&c.psConfig.timecodes, "timecodes", "", "")
+	fl.StringVar(&c.psConfig.timestamps, "timestamps", "", "")
+	fl.BoolVar(&c.psConfig.loop, "loop", false, "")
+	fl.StringVar(&c.psConfig.transport, "transport", "", "")
+	fl.StringVar(&c.setup, "setup", "", "")
+	fl.BoolVar(&c.playback, "playback", false, "")
+	fl.DurationVar(&c.recordLength, "record-len", 30*time.Minute, "")
+	fl.DurationVar(&c.alarmInterval, "alarm", 0, "")
+	fl.StringVar(&c.alarmHTTP, "alarm-http", "", "")
 
 	fl.Usage = func() {
 		fmt.Println(fmt.Sprintf("Usage: %v [Options]", os.Args[0]))
@@ -61,35 +170,194 @@ func Parse(ctx context.Context) interface{} {
 		fmt.Println(fmt.Sprintf("SIP:"))
 		fmt.Println(fmt.Sprintf("   -user   The SIP username, ID of device."))
 		fmt.Println(fmt.Sprintf("   -random Append N number to user as random device ID, like 1320000001."))
+		fmt.Println(fmt.Sprintf("   -id-tpl [Optional] The template of 20 digits device ID, overwrite -user and -random, the placeholder is {seq} for sequence from 1, {rand} for random, or {start-end} for range, for example, 340200000013200000{seq} or 3402000000132{1-500}."))
 		fmt.Println(fmt.Sprintf("   -server The SIP server ID, ID of server."))
 		fmt.Println(fmt.Sprintf("   -domain The SIP domain, domain of server and device."))
+		fmt.Println(fmt.Sprintf("   -username [Optional] The username for SIP digest authentication. Default: device ID"))
+		fmt.Println(fmt.Sprintf("   -password [Optional] The password for SIP digest authentication, ignore the 401 or 407 challenge if empty."))
+		fmt.Println(fmt.Sprintf("   -expires [Optional] The expires in seconds of REGISTER, refresh at the half of it. Default: 3600"))
+		fmt.Println(fmt.Sprintf("   -unregister [Optional] Whether send REGISTER with Expires=0 when lapse and quit. Default: false"))
+		fmt.Println(fmt.Sprintf("   -reg-lapse [Optional] Stop refreshing registration and keepalive after the duration, for example, 60s, to let it lapse, 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -reg-reappear [Optional] Register again after the lapsed registration expired for the duration, 0 to never. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -gb2022 [Optional] Whether compatible with GB28181-2022, require SIP over TCP or TLS, send X-GB-Ver: 3.0 and the extended info in Catalog. Default: false"))
+		fmt.Println(fmt.Sprintf("   -gb35114-cert [Optional] The PEM file of SM2 device certificate, to register as a type-A secure device of GB35114 and decrypt the VKEK, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -gb35114-key [Optional] The PEM file of SM2 private key of the device certificate, required by -gb35114-cert."))
+		fmt.Println(fmt.Sprintf("   -sm4    [Optional] Whether encrypt PES payload by SM4-CTR with the VKEK from server, the IV is PTS and stream ID of frame, require -gb35114-cert. Default: false"))
+		fmt.Println(fmt.Sprintf("   -nn     [Optional] The number of devices to simulate, each with its own device ID by -random or -id-tpl. Default: 1"))
+		fmt.Println(fmt.Sprintf("   -delay  [Optional] The start delay in ms for each device to simulate. Default: 50"))
+		fmt.Println(fmt.Sprintf("   -channels [Optional] The number of channels of device, each is invited and streamed separately. Default: 1"))
+		fmt.Println(fmt.Sprintf("   -catalog [Optional] The number of channels in Catalog response, 0 to use -channels. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -catalog-page [Optional] The max channels in each Catalog response MESSAGE. Default: 4"))
+		fmt.Println(fmt.Sprintf("   -metrics [Optional] The listen address to serve /metrics in Prometheus format, for example, :9101, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -keepalive [Optional] The interval of keepalive MESSAGE. Default: 1s"))
+		fmt.Println(fmt.Sprintf("   -alarm  [Optional] The interval to send alarm NOTIFY to the alarm subscriptions of server, for example, 1s, 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -alarm-http [Optional] The listen address to trigger alarm of devices by /alarm?device=id&method=5&type=2, for example, :9102, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -ka-skip [Optional] Skip all keepalives after sent N, to verify the server times out the device, 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -ka-delay [Optional] The extra delay of each keepalive besides the interval, for example, 30s, 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("Platform:"))
+		fmt.Println(fmt.Sprintf("   -platform [Optional] The listen address to act as the superior platform of SRS cascade, udp://ip:port or tcp://ip:port, accept the REGISTER, query Catalog, invite -channels channels with -server as platform ID, and validate the PS media for -duration, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -platform-ip [Optional] The IP in SDP of INVITE for the lower platform to send media to. Default: local IP to lower platform"))
 		fmt.Println(fmt.Sprintf("Publisher:"))
-		fmt.Println(fmt.Sprintf("   -pr     The SIP server address, format is tcp://ip:port over TCP."))
-		fmt.Println(fmt.Sprintf("   -fps    [Optional] The fps of .h264 source file."))
+		fmt.Println(fmt.Sprintf("   -pr     The SIP server address, format is tcp://ip:port over TCP, udp://ip:port over UDP, or tls://ip:port over TLS, the IPv6 is in brackets like udp://[::1]:5060, and tcp6 or udp6 to resolve AAAA only."))
+		fmt.Println(fmt.Sprintf("   -fps    [Optional] The fps of .h264 source file, each frame lasts 90000/fps ticks, for example, 3600 at 25fps. Note that older versions used 2250 ticks at 25fps, so the timestamps differ from them."))
+		fmt.Println(fmt.Sprintf("   -rate   [Optional] The rational fps in num/den of source file, for example, 30000/1001, overwrite -fps."))
 		fmt.Println(fmt.Sprintf("   -sa     [Optional] The file path to read audio, ignore if empty."))
-		fmt.Println(fmt.Sprintf("   -sv     [Optional] The file path to read video, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -acodec [Optional] The codec of audio file, aac for ADTS, pcma or pcmu for raw G.711 samples in 8kHz mono such as .pcm or .g711. Default: aac"))
+		fmt.Println(fmt.Sprintf("   -vcodec [Optional] The video stream type in PSM, h264, h265, svac or mpeg4, the payload of -sv is passed through. Default: by -sv"))
+		fmt.Println(fmt.Sprintf("   -sv     [Optional] The file path to read video, or numbered files such as frames/%%05d.h264, H.265 if .h265 or .hevc, video and audio with timestamps if .mp4 or .ts, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -gap    [Optional] The policy for gap of numbered video files, error or skip. Default: error"))
+		fmt.Println(fmt.Sprintf("   -hi     [Optional] The interval in ms to re-send PS header(PSM) besides keyframes, 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -hm     [Optional] When to send PS header, idr for each keyframe and -hi, interval for only -hi, once for stream start. Default: idr"))
+		fmt.Println(fmt.Sprintf("   -rtcp   [Optional] The UDP address to listen for RTCP RR from server, for example, :9000, ignore if empty. For multiple channels, the port is offset by the index of channel."))
+		fmt.Println(fmt.Sprintf("   -trace  [Optional] The file path to write trace of each frame in JSON lines, ignore if empty. For multiple channels, the file name is suffixed by channel ID."))
+		fmt.Println(fmt.Sprintf("   -sei    [Optional] Whether embed wall clock in SEI before each H.264 IDR or H.265 IRAP, to measure latency. Default: false"))
+		fmt.Println(fmt.Sprintf("   -frag   [Optional] The min size to randomize video PES fragment in [frag, pes], 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -seed   [Optional] The seed to randomize video PES fragment, 0 to use current time. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -framing [Optional] The framing over TCP, rfc4571(2B length) or interleaved($+channel+2B length). Default: rfc4571"))
+		fmt.Println(fmt.Sprintf("   -rtcp-mux [Optional] Whether send SR and receive RR over the media connection. Default: false"))
+		fmt.Println(fmt.Sprintf("   -duration [Optional] Stop after the duration, for example, 30s, 0 to ignore. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -frames [Optional] Stop after sent N video frames, 0 to ignore. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -bytes  [Optional] Stop after sent N bytes, 0 to ignore. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -tee    [Optional] The file path to capture the framed RTP and RTCP packets, ignore if empty. For multiple channels, the file name is suffixed by channel ID."))
+		fmt.Println(fmt.Sprintf("   -verify [Optional] Wait for the duration after connected, fail if media server closes, 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -bp     [Optional] The bitrate profile, step, linear or sine, drop frames or pad to follow it, ignore if empty. A non-reference frame is dropped alone, while a dropped reference frame drops the rest of GOP until the next IDR."))
+		fmt.Println(fmt.Sprintf("   -bp-min [Optional] The min bitrate in kbps of profile. Default: 500"))
+		fmt.Println(fmt.Sprintf("   -bp-max [Optional] The max bitrate in kbps of profile. Default: 2000"))
+		fmt.Println(fmt.Sprintf("   -bp-period [Optional] The period of profile, step up by (max-min)/4 every period for step. Default: 30s"))
+		fmt.Println(fmt.Sprintf("   -apt    [Optional] The RTP payload type of audio, 0 to use the same payload type as video. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -clock-rates [Optional] The RTP clock rate of payload types, for example, 96=90000,97=44100, default to 90000 for video and sample rate for audio."))
+		fmt.Println(fmt.Sprintf("   -fault  [Optional] The rules to damage video in action:target:every, for example, drop:p:10,flip:key:5, action is drop, truncate or flip, target is p or key. Note that the stream is non-conformant intentionally, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -fault-seed [Optional] The seed to damage video, corrupt PS or disturb RTP, 0 to use current time. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -ps-fault [Optional] The rules to corrupt PS in action:rate, for example, drop-psm:0.1,pes-length:0.01, action is flip-pack, truncate-pes, drop-psm or pes-length, rate is in (0, 1]. Note that the stream is non-conformant intentionally, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -rtp-fault [Optional] The rules to disturb RTP in action:rate, for example, seq-jump:0.01,reorder:0.05, action is seq-jump, duplicate, reorder or ts-rollback, rate is in (0, 1]. Note that the stream is non-conformant intentionally, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -pg     [Optional] The gap between RTP packets of a frame, for example, 200us, shrink to deliver frame before next one, 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -speed  [Optional] The speed multiplier of pacing by DTS, for example, 2 to send twice as fast as realtime. Default: 1"))
+		fmt.Println(fmt.Sprintf("   -drift  [Optional] The drift of audio DTS relative to video, in ppm like 100ppm or in ms/min like 6ms/min, negative for audio slower than video, to test the A/V resync of server, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -ssrc   [Optional] The SSRC to overwrite the y= of SDP, the same for all devices to simulate the cloned cameras, collision is allowed. Default: 0 to use SDP"))
+		fmt.Println(fmt.Sprintf("   -ssrc-change [Optional] Change the SSRC to a new one every duration without re-INVITE, for example, 30s, and report the RR of server. Default: 0 to disable"))
+		fmt.Println(fmt.Sprintf("   -reconnect [Optional] Reconnect the TCP media at most N times when it drops, continue the RTP sequence number and timestamp, to simulate the camera over flaky network. Default: 0 to give up"))
+		fmt.Println(fmt.Sprintf("   -reconnect-backoff [Optional] The first backoff to reconnect the media, doubled for each failure up to 30s. Default: 1s"))
+		fmt.Println(fmt.Sprintf("   -reconnect-restart [Optional] Whether restart the RTP sequence number from random and timestamp from zero after reconnected, like a rebooted camera. Default: false"))
+		fmt.Println(fmt.Sprintf("   -pes    [Optional] The max payload length of video PES, for example, 1024 or jumbo 8000. Default: 1400"))
+		fmt.Println(fmt.Sprintf("   -media  [Optional] The declared and sent streams, av, audio for talk device or video for video only camera. Default: by -sv and -sa"))
+		fmt.Println(fmt.Sprintf("   -payload [Optional] The max RTP payload size, fragment a PES to multiple RTP packets if exceeds, 0 to send each PES in one RTP packet. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -timecodes [Optional] The timecodes file of video in mkvmerge v2 format, for variable frame rate, overwrite -fps, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -timestamps [Optional] The file of \"dts pts\" in ms per line for B-frames, repeated as the GOP pattern, overwrite -fps, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -loop   [Optional] Whether replay the -sv and -sa when end, with DTS and PTS keep increasing, for long duration test. Default: false"))
+		fmt.Println(fmt.Sprintf("   -transport [Optional] The transport of media, tcp or udp, overwrite the SDP of INVITE, use SDP if empty."))
+		fmt.Println(fmt.Sprintf("   -setup  [Optional] The TCP setup of media, active to connect to server, or passive to listen for server, overwrite the a=setup of INVITE, use SDP if empty."))
+		fmt.Println(fmt.Sprintf("   -playback [Optional] Whether response RecordInfo query with synthetic recordings, stream the -sv and -sa for INVITE of s=Playback or s=Download in the time range of t=, at the a=downloadspeed for download, pause, scale or seek forward by INFO, and notify MediaStatus when end. Default: false"))
+		fmt.Println(fmt.Sprintf("   -record-len [Optional] The length of each synthetic recording in RecordInfo response. Default: 30m"))
 		fmt.Println(fmt.Sprintf("\n例如，1个推流："))
 		fmt.Println(fmt.Sprintf("   %v -sfu gb28181 -pr tcp://127.0.0.1:5060 -user 34020000001320000001 -server 34020000002000000001 -domain 3402000000", os.Args[0]))
 		fmt.Println(fmt.Sprintf("   %v -sfu gb28181 -pr tcp://127.0.0.1:5060 -user 3402000000 -random 10 -server 34020000002000000001 -domain 3402000000", os.Args[0]))
 		fmt.Println(fmt.Sprintf("   %v -sfu gb28181 -pr tcp://127.0.0.1:5060 -user 3402000000 -random 10 -server 34020000002000000001 -domain 3402000000 -sa avatar.aac -sv avatar.h264 -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sfu gb28181 -pr tcp://127.0.0.1:5060 -user 3402000000 -random 10 -nn 100 -server 34020000002000000001 -domain 3402000000 -sa avatar.aac -sv avatar.h264 -fps 25", os.Args[0]))
 		fmt.Println(fmt.Sprintf("   %v -sfu gb28181 -pr tcp://127.0.0.1:5060 -user livestream -server srs -domain ossrs.io -sa avatar.aac -sv avatar.h264 -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，作为上级平台，接收SRS级联的注册和媒体："))
+		fmt.Println(fmt.Sprintf("   %v -sfu gb28181 -platform udp://0.0.0.0:5061 -server 34020000002000000002 -domain 3402000000 -channels 4 -duration 30s", os.Args[0]))
 		fmt.Println()
 	}
 	if err := fl.Parse(os.Args[1:]); err == flag.ErrHelp {
 		os.Exit(0)
 	}
 
-	showHelp := c.sipConfig.String() == ""
+	// The platform mode accepts the lower platform, which requires no device.
+	if c.platformConfig.addr != "" {
+		if c.sipConfig.server == "" || c.sipConfig.domain == "" || c.channels <= 0 || c.sipConfig.expires <= 0 ||
+			(c.psConfig.transport != "" && c.psConfig.transport != "tcp" && c.psConfig.transport != "udp") {
+			fl.Usage()
+			os.Exit(-1)
+		}
+
+		c.platformConfig.id, c.platformConfig.domain = c.sipConfig.server, c.sipConfig.domain
+		c.platformConfig.expires, c.platformConfig.transport = c.sipConfig.expires, c.psConfig.transport
+		if c.platformConfig.transport == "" {
+			c.platformConfig.transport = "tcp"
+		}
+		c.platformConfig.timeout = 30 * time.Second
+		logger.Tf(ctx, "Run platform with %v, channels=%v, duration=%v", c.platformConfig.String(), c.channels,
+			c.psConfig.maxDuration)
+		return c
+	}
+
+	// Parse the template before generating the device ID.
+	if c.idTemplate != "" {
+		template, err := ParseDeviceIDTemplate(c.idTemplate)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Parse -id-tpl %v failed, err %+v", c.idTemplate, err))
+			os.Exit(-1)
+		}
+		if template.Size() < uint64(c.devices) {
+			fmt.Println(fmt.Sprintf("The -id-tpl %v has %v IDs, not enough for %v devices", c.idTemplate, template.Size(), c.devices))
+			os.Exit(-1)
+		}
+		c.sipConfig.idTemplate = template
+	}
+
+	showHelp := c.sipConfig.String() == "" || c.devices <= 0 || c.keepalive <= 0 || c.catalogPage <= 0 ||
+		c.sipConfig.expires <= 0 || c.psConfig.speed <= 0 || c.recordLength <= 0 || (c.setup != "" && c.setup != "active" && c.setup != "passive")
 	if showHelp {
 		fl.Usage()
 		os.Exit(-1)
 	}
 
+	// The SIP over TCP is mandatory for GB28181-2022.
+	if c.sipConfig.gb2022 && c.sipConfig.Transport() == "UDP" {
+		fmt.Println(fmt.Sprintf("The -gb2022 requires SIP over TCP or TLS, but -pr is %v", c.sipConfig.addr))
+		os.Exit(-1)
+	}
+
+	// The certificate and private key of GB35114, shared by all devices.
+	if c.gb35114Cert != "" || c.gb35114Key != "" {
+		identity, err := loadGB35114Identity(c.gb35114Cert, c.gb35114Key)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Load GB35114 cert=%v, key=%v failed, err %+v", c.gb35114Cert, c.gb35114Key, err))
+			os.Exit(-1)
+		}
+		c.sipConfig.identity = identity
+	}
+	if c.psConfig.sm4 && c.sipConfig.identity == nil {
+		fmt.Println(fmt.Sprintf("The -sm4 requires -gb35114-cert and -gb35114-key for VKEK"))
+		os.Exit(-1)
+	}
+
+	// The device ID is the user if not random or template, which is not unique for devices.
+	if c.devices > 1 && c.sipConfig.random <= 0 && c.sipConfig.idTemplate == nil {
+		fmt.Println(fmt.Sprintf("The -random or -id-tpl is required for %v devices", c.devices))
+		os.Exit(-1)
+	}
+
 	summaryDesc := ""
 	if c.sipConfig.addr != "" {
 		pubString := strings.Join([]string{c.sipConfig.String(), c.psConfig.String()}, ",")
 		summaryDesc = fmt.Sprintf("%v, publish(%v)", summaryDesc, pubString)
 	}
+	if c.devices > 1 {
+		summaryDesc = fmt.Sprintf("%v, devices=%v, delay=%v", summaryDesc, c.devices, c.delay)
+	}
+	if c.metrics != "" {
+		summaryDesc = fmt.Sprintf("%v, metrics=%v", summaryDesc, c.metrics)
+	}
+	if c.keepaliveSkip > 0 || c.keepaliveDelay > 0 {
+		summaryDesc = fmt.Sprintf("%v, keepalive=%v, skip=%v, delay=%v", summaryDesc, c.keepalive, c.keepaliveSkip,
+			c.keepaliveDelay)
+	}
+	if c.registerLapse > 0 {
+		summaryDesc = fmt.Sprintf("%v, lapse=%v, reappear=%v", summaryDesc, c.registerLapse, c.registerReappear)
+	}
+	if c.setup != "" {
+		summaryDesc = fmt.Sprintf("%v, setup=%v", summaryDesc, c.setup)
+	}
+	if c.sipConfig.identity != nil {
+		summaryDesc = fmt.Sprintf("%v, gb35114(%v)", summaryDesc, c.sipConfig.identity.String())
+	}
+	if c.alarmInterval > 0 || c.alarmHTTP != "" {
+		summaryDesc = fmt.Sprintf("%v, alarm=%v, alarm-http=%v", summaryDesc, c.alarmInterval, c.alarmHTTP)
+	}
+	if c.playback {
+		summaryDesc = fmt.Sprintf("%v, playback=%v, record=%v", summaryDesc, c.playback, c.recordLength)
+	}
 	logger.Tf(ctx, "Run benchmark with %v", summaryDesc)
 
 	return c
@@ -98,48 +366,495 @@ func Parse(ctx context.Context) interface{} {
 func Run(ctx context.Context, r0 interface{}) (err error) {
 	conf := r0.(*gbMainConfig)
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if conf.platformConfig.addr != "" {
+		return runPlatform(ctx, conf)
+	}
+
+	// The channels of all devices, and the source files shared by all devices.
+	channels := NewGBChannels()
+	files := NewFileCache()
+	latencies := NewGBLatencies()
+
+	// Run all devices concurrently, quit when any device fails.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Serve the metrics of channels, stop before waiting for the devices.
+	if conf.metrics != "" {
+		metricsCtx, metricsCancel := context.WithCancel(ctx)
+		defer metricsCancel()
+
+		exporter := NewMetricsExporter(channels)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := exporter.Serve(metricsCtx, conf.metrics); err != nil {
+				logger.Ef(ctx, "metrics err %+v", err)
+			}
+		}()
+	}
+
+	// Trigger the alarm of devices by HTTP, stop before waiting for the devices.
+	var alarms *AlarmTrigger
+	if conf.alarmHTTP != "" {
+		alarmCtx, alarmCancel := context.WithCancel(ctx)
+		defer alarmCancel()
+
+		alarms = NewAlarmTrigger()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := alarms.Serve(alarmCtx, conf.alarmHTTP); err != nil {
+				logger.Ef(ctx, "alarm err %+v", err)
+			}
+		}()
+	}
+
+	// Each device has its own device ID, the first one is generated when parsing config.
+	var devices int
+	errs := make(chan error, conf.devices)
+	for i := 0; i < conf.devices && ctx.Err() == nil; i++ {
+		sipConfig := conf.sipConfig
+		if i > 0 {
+			sipConfig.deviceID = ""
+			sipConfig.DeviceID()
+		}
+
+		devices++
+		wg.Add(1)
+		go func(sipConfig *SIPConfig) {
+			defer wg.Done()
+			errs <- runDevice(ctx, conf, sipConfig, channels, files, alarms, latencies)
+		}(&sipConfig)
+
+		if i < conf.devices-1 {
+			time.Sleep(time.Duration(conf.delay) * time.Millisecond)
+		}
+	}
+
+	for i := 0; i < devices; i++ {
+		if err = <-errs; err != nil && ctx.Err() == nil {
+			cancel()
+			return err
+		}
+	}
+
+	for id, stats := range channels.Stats() {
+		logger.Tf(ctx, "Channel %v, %v", id, stats.String())
+	}
+	logger.Tf(ctx, "Latency of %v devices, %v", devices, latencies.String())
+
+	return nil
+}
+
+// Run as the superior platform, wait for the lower platform to register, query its Catalog, invite the channels and
+// receive the media for the duration, then BYE. Fail if any media is not a legal PS stream, or got no frame.
+func runPlatform(ctx context.Context, conf *gbMainConfig) error {
+	platform := NewGBPlatform(&conf.platformConfig)
+	if err := platform.Listen(ctx); err != nil {
+		return errors.Wrap(err, "listen")
+	}
+	defer platform.Close()
+	defer func() {
+		stats := platform.Stats()
+		logger.Tf(ctx, "Platform %v, %v", conf.platformConfig.id, stats.String())
+	}()
+
+	deviceID, err := platform.WaitRegister(ctx)
+	if err != nil {
+		return errors.Wrap(err, "wait register")
+	}
+
+	items, err := platform.QueryCatalog(ctx, deviceID)
+	if err != nil {
+		return errors.Wrapf(err, "catalog of %v", deviceID)
+	}
+	if len(items) == 0 {
+		return errors.Errorf("no channel in catalog of %v", deviceID)
+	}
+	if len(items) > conf.channels {
+		items = items[:conf.channels]
+	}
+
+	// Receive the media of all channels concurrently, stop all when any fails.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	mediaCtx, mediaCancel := context.WithCancel(ctx)
+	if conf.psConfig.maxDuration > 0 {
+		mediaCtx, mediaCancel = context.WithTimeout(ctx, conf.psConfig.maxDuration)
+	}
+	defer mediaCancel()
+
+	var channels []*GBPlatformChannel
+	errs := make(chan error, len(items))
+	for _, item := range items {
+		c, err := platform.Invite(ctx, item.DeviceID)
+		if err != nil {
+			return errors.Wrapf(err, "invite %v", item.DeviceID)
+		}
+		channels = append(channels, c)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Receive(mediaCtx); err != nil {
+				errs <- err
+				mediaCancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Stop the media of channels, which is ignored if quit by signal because the platform is closed.
+	for _, c := range channels {
+		byeCtx, byeCancel := context.WithTimeout(ctx, 3*time.Second)
+		if err := platform.Bye(byeCtx, c); err != nil {
+			logger.Wf(ctx, "Bye channel=%v err %+v", c.channelID, err)
+		}
+		byeCancel()
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+
+	for _, c := range channels {
+		stats := c.Stats()
+		logger.Tf(ctx, "Channel %v, ssrc=%v, bye=%v, %v", c.channelID, c.ssrc, c.Byed(), stats.String())
+		if stats.VideoFrames+stats.AudioFrames == 0 && ctx.Err() == nil {
+			return errors.Errorf("no media of channel=%v, ssrc=%v", c.channelID, c.ssrc)
+		}
+	}
+	return nil
+}
+
+// Load the certificate and SM2 private key of GB35114 from the PEM files.
+func loadGB35114Identity(certFile, keyFile string) (*GB35114Identity, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", certFile)
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", keyFile)
+	}
+	return NewGB35114Identity(certPEM, keyPEM)
+}
+
+// Run a device, register and invite each channel with its own SSRC and media port, and stream each channel once it's
+// invited, quit when any channel fails. The channel stopped by BYE is restarted when re-INVITE.
+func runDevice(ctx context.Context, conf *gbMainConfig, sipConfig *SIPConfig, channels *GBChannels, files *FileCache, alarms *AlarmTrigger, latencies *GBLatencies) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	session := NewGBSession(&GBSessionConfig{
 		regTimeout: 3 * time.Hour, inviteTimeout: 3 * time.Hour,
-	}, &conf.sipConfig)
+	}, sipConfig)
 	defer session.Close()
 
+	session.heartbeatInterval = conf.keepalive
+	session.catalogChannels, session.catalogPageSize = conf.catalog, conf.catalogPage
+	if conf.catalog <= 0 {
+		session.catalogChannels = conf.channels
+	}
+	session.heartbeatSkip, session.heartbeatDelay = conf.keepaliveSkip, conf.keepaliveDelay
+	session.registerLapse, session.registerReappear = conf.registerLapse, conf.registerReappear
+	session.registerUnregister = conf.unregister
+	session.setup = conf.setup
+	session.playback, session.recordLength = conf.playback, conf.recordLength
+	session.alarmInterval = conf.alarmInterval
+	defer func() {
+		stats := session.Stats()
+		logger.Tf(ctx, "Device %v, %v", sipConfig.DeviceID(), stats.String())
+	}()
+
 	if err := session.Connect(ctx); err != nil {
-		return errors.Wrapf(err, "connect %v", conf.sipConfig)
+		return errors.Wrapf(err, "connect %v", sipConfig)
+	}
+
+	if alarms != nil {
+		alarms.Add(session)
+		defer alarms.Remove(session)
 	}
 
 	if err := session.Register(ctx); err != nil {
-		return errors.Wrapf(err, "register %v", conf.sipConfig)
+		return errors.Wrapf(err, "register %v", sipConfig)
 	}
+	stats := session.Stats()
+	latencies.Add(GBLatencyRegister, stats.RegisterLatency)
+
+	// Unregister when quit, even if cancelled by signal, so use a new context.
+	if conf.unregister {
+		defer func() {
+			// Stop the keepalive and refresh first, because the responses of concurrent requests are dropped by
+			// each other.
+			if session.cancel != nil {
+				session.cancel()
+			}
 
-	if err := session.Invite(ctx); err != nil {
-		return errors.Wrapf(err, "invite %v", conf.sipConfig)
+			unregisterCtx, unregisterCancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer unregisterCancel()
+
+			if err := session.UnRegister(unregisterCtx); err != nil {
+				logger.Wf(ctx, "Unregister %v err %+v", sipConfig.DeviceID(), err)
+			}
+		}()
 	}
 
-	if conf.psConfig.video == "" || conf.psConfig.audio == "" {
-		cancel()
+	// Keepalive before INVITE, because the channels of NVR are invited on demand, maybe never.
+	session.startHeartbeat(ctx)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Stream each channel as soon as invited, so the channels are independent, quit when any channel fails. The
+	// streamCtx is cancelled when a channel fails or quit, to stop waiting for INVITE.
+	streamCtx, streamCancel := context.WithCancel(ctx)
+	defer streamCancel()
+
+	// Closed when quit, so the streams never block on the results.
+	quit := make(chan struct{})
+	defer close(quit)
+
+	// The listeners of TCP passive are closed after accepted, or never used if no media.
+	var listeners []*net.TCPListener
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	// The ingester is created before adding channel, because the metrics reads the channels concurrently.
+	hasMedia := conf.psConfig.video != "" || conf.psConfig.audio != ""
+	results := make(chan *gbChannelResult, conf.channels+1)
+	startChannel := func(out *GBChannelOutput) error {
+		latencies.Add(GBLatencyInvite, out.inviteLatency)
+		if out.listener != nil {
+			listeners = append(listeners, out.listener)
+		}
+
+		// The playback stops at the end of time range in stream time, and the download is faster by the multiple of
+		// downloadspeed.
+		psConfig := conf.psConfig
+		var playbackDuration time.Duration
+		if conf.playback && out.download {
+			psConfig.speed *= float64(out.downloadSpeed)
+		}
+		if conf.playback && out.playback {
+			playbackDuration = out.endTime.Sub(out.startTime)
+		}
+
+		// When multiple channels stream, each channel uses its own RTCP port and tee and trace files.
+		if conf.devices*conf.channels > 1 {
+			var err error
+			if psConfig, err = psConfig.ForChannel(channels.Index(out.channelID), out.channelID); err != nil {
+				return err
+			}
+		}
+
+		var vkek []byte
+		if conf.psConfig.sm4 {
+			if vkek, _ = session.VKEK(); vkek == nil {
+				return errors.Errorf("no VKEK for channel %v", out.channelID)
+			}
+		}
+
+		c := &GBChannel{out: out}
+		if hasMedia {
+			c.ingester = NewPSIngester(&IngesterConfig{
+				psConfig:    psConfig,
+				ssrc:        uint32(c.out.ssrc),
+				clockRate:   session.out.clockRate,
+				payloadType: uint8(session.out.payloadType),
+				transport:   c.out.transport,
+				listener:    c.out.listener,
+				files:       files,
+				// The playback is controlled by INFO, and stops at the end of time range.
+				playbackDuration: playbackDuration,
+				control:          c.out.control,
+				// The VKEK should be received before INVITE, to encrypt the PES payload.
+				vkek: vkek,
+			})
+
+			var err error
+			if c.ingester.conf.serverAddr, err = utilBuildMediaAddr(session.sip.conf.addr, c.out.mediaHost, c.out.mediaPort); err != nil {
+				return err
+			}
+		}
+
+		if err := channels.Add(c); err != nil {
+			return errors.Wrapf(err, "channel %v", out.channelID)
+		}
+
+		if !hasMedia {
+			return nil
+		}
+
+		wg.Add(1)
+		go func(c *GBChannel) {
+			defer wg.Done()
+			defer c.ingester.Close()
+
+			err := runChannel(streamCtx, conf, session, c, latencies)
+			if err != nil {
+				streamCancel()
+			}
+			select {
+			case results <- &gbChannelResult{channel: c, err: err}:
+			case <-quit:
+			}
+		}(c)
 		return nil
 	}
 
-	ingester := NewPSIngester(&IngesterConfig{
-		psConfig:    conf.psConfig,
-		ssrc:        uint32(session.out.ssrc),
-		clockRate:   session.out.clockRate,
-		payloadType: uint8(session.out.payloadType),
-	})
-	defer ingester.Close()
+	var streams int
+	for i := 0; (i < conf.channels || i == 0) && streamCtx.Err() == nil; i++ {
+		out, err := session.InviteChannel(streamCtx)
+		if err != nil {
+			if streamCtx.Err() != nil && ctx.Err() == nil {
+				break
+			}
+			return errors.Wrapf(err, "invite %v", sipConfig)
+		}
 
-	if ingester.conf.serverAddr, err = utilBuildMediaAddr(session.sip.conf.addr, session.out.mediaPort); err != nil {
-		return err
+		if err := startChannel(out); err != nil {
+			return err
+		}
+		if hasMedia {
+			streams++
+		}
 	}
 
-	if err := ingester.Ingest(ctx); err != nil {
-		if errors.Cause(err) == io.EOF {
-			logger.Tf(ctx, "EOF, video=%v, audio=%v", conf.psConfig.video, conf.psConfig.audio)
-			return nil
+	// Keep waiting for the re-INVITE of channels stopped by BYE, to restart the media with a new SSRC, while the
+	// registration is kept.
+	invites := make(chan *GBChannelOutput)
+	if hasMedia {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for streamCtx.Err() == nil {
+				out, err := session.InviteChannel(streamCtx)
+				if err != nil {
+					if streamCtx.Err() == nil {
+						logger.Wf(ctx, "Wait re-INVITE err %+v", err)
+					}
+					return
+				}
+
+				select {
+				case invites <- out:
+				case <-streamCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	return waitChannels(ctx, streamCtx, streams, channels, invites, results, startChannel)
+}
+
+// The result of a channel when streaming done.
+type gbChannelResult struct {
+	channel *GBChannel
+	err     error
+}
+
+// Quit when all streams end, or any stream fails, except the streams stopped by BYE which wait for re-INVITE. The
+// channel stopped by BYE is removed when its result arrives, so a fast re-INVITE waits for it to restart the channel.
+func waitChannels(ctx, streamCtx context.Context, streams int, channels *GBChannels, invites <-chan *GBChannelOutput, results <-chan *gbChannelResult, startChannel func(out *GBChannelOutput) error) error {
+	// The re-INVITE of channels which are still streaming, keyed by channel ID.
+	pending := make(map[string]*GBChannelOutput)
+
+	var stopped int
+	done := streamCtx.Done()
+	for streams > 0 || stopped > 0 {
+		select {
+		case <-done:
+			done, stopped = nil, 0
+			streams -= len(pending)
+			pending = make(map[string]*GBChannelOutput)
+		case out := <-invites:
+			if channels.Get(out.channelID) != nil {
+				if done != nil {
+					pending[out.channelID] = out
+					streams++
+				}
+				break
+			}
+
+			if err := startChannel(out); err != nil {
+				return err
+			}
+			if streams++; stopped > 0 {
+				stopped--
+			}
+		case r := <-results:
+			if streams--; r.err != nil && ctx.Err() == nil {
+				return r.err
+			}
+
+			channelID := r.channel.out.channelID
+			if out, ok := pending[channelID]; ok {
+				delete(pending, channelID)
+				channels.Remove(channelID)
+				if err := startChannel(out); err != nil {
+					return err
+				}
+			} else if r.err == nil && r.channel.out.Byed() && done != nil {
+				channels.Remove(channelID)
+				stopped++
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stream the channel until end, and notify the end of file for playback.
+func runChannel(ctx context.Context, conf *gbMainConfig, session *GBSession, c *GBChannel, latencies *GBLatencies) error {
+	// Stop the media by BYE of the dialog.
+	ingestCtx, ingestCancel := context.WithCancel(ctx)
+	defer ingestCancel()
+	go func() {
+		select {
+		case <-ingestCtx.Done():
+		case <-c.out.bye:
+			ingestCancel()
+		}
+	}()
+
+	err := c.ingester.Ingest(ingestCtx)
+
+	// The first media is accepted by server even if the stream fails later.
+	if stats := c.ingester.Stats(); !stats.FirstPacketAt.IsZero() {
+		latencies.Add(GBLatencyFirstMedia, stats.FirstPacketAt.Sub(c.out.ackedAt))
+	}
+
+	// Never notify the MediaStatus for BYE, which is not the end of file.
+	if c.out.Byed() {
+		stats := c.ingester.Stats()
+		logger.Tf(ctx, "Stop channel=%v by BYE, ssrc=%v, %v", c.out.channelID, c.out.ssrc, stats.String())
+		return nil
+	}
+
+	if err != nil {
+		if errors.Cause(err) != io.EOF {
+			return errors.Wrapf(err, "ingest channel=%v", c.out.channelID)
 		}
-		return errors.Wrap(err, "ingest")
+		logger.Tf(ctx, "EOF, channel=%v, video=%v, audio=%v", c.out.channelID, conf.psConfig.video, conf.psConfig.audio)
 	}
 
+	// Notify the end of file for playback, when the source ends or the time range is done, but not stopped by
+	// TEARDOWN.
+	if conf.playback && c.out.playback && !c.out.control.Teardown() {
+		if err := session.NotifyMediaStatus(ctx, c.out.channelID); err != nil {
+			return errors.Wrapf(err, "media status channel=%v", c.out.channelID)
+		}
+	}
 	return nil
 }
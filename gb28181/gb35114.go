@@ -0,0 +1,243 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"math/big"
+	"strings"
+)
+
+// GB35114Identity is the certificate and SM2 private key of a type-A secure device of GB35114, to authenticate the
+// device by SM2 signature when register, and decrypt the VKEK from server.
+type GB35114Identity struct {
+	// The serial number and subject of device certificate.
+	serial  *big.Int
+	subject string
+	// The SM2 private key, whose public key is the same as certificate.
+	key *ecdsa.PrivateKey
+}
+
+// NewGB35114Identity loads the device certificate and SM2 private key in PEM, the key is PKCS#8 or SEC1 format, and
+// should match the public key of certificate.
+func NewGB35114Identity(certPEM, keyPEM []byte) (*GB35114Identity, error) {
+	v := &GB35114Identity{}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate in PEM")
+	}
+	x, y, err := v.parseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "certificate")
+	}
+
+	if block, _ = pem.Decode(keyPEM); block == nil {
+		return nil, errors.New("no private key in PEM")
+	}
+	if v.key, err = parseSM2PrivateKey(block.Type, block.Bytes); err != nil {
+		return nil, errors.Wrap(err, "private key")
+	}
+	if v.key.X.Cmp(x) != 0 || v.key.Y.Cmp(y) != 0 {
+		return nil, errors.Errorf("private key not match certificate %v", v.subject)
+	}
+
+	return v, nil
+}
+
+// Parse the serial, subject and SM2 public key of certificate. Note that crypto/x509 doesn't support the SM2 curve,
+// so we parse the fields we need by ASN.1.
+func (v *GB35114Identity) parseCertificate(der []byte) (*big.Int, *big.Int, error) {
+	var cert struct {
+		TBS struct {
+			Version      int `asn1:"optional,explicit,default:0,tag:0"`
+			SerialNumber *big.Int
+			Signature    pkix.AlgorithmIdentifier
+			Issuer       asn1.RawValue
+			Validity     asn1.RawValue
+			Subject      pkix.RDNSequence
+			PublicKey    struct {
+				Algorithm pkix.AlgorithmIdentifier
+				PublicKey asn1.BitString
+			}
+			Rest []asn1.RawValue `asn1:"optional"`
+		}
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		SignatureValue     asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		return nil, nil, errors.Wrap(err, "unmarshal")
+	}
+
+	var curve asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(cert.TBS.PublicKey.Algorithm.Parameters.FullBytes, &curve); err != nil {
+		return nil, nil, errors.Wrap(err, "curve")
+	}
+	if !curve.Equal(oidSM2) {
+		return nil, nil, errors.Errorf("not SM2 curve %v", curve)
+	}
+
+	x, y := sm2Unmarshal(cert.TBS.PublicKey.PublicKey.RightAlign())
+	if x == nil {
+		return nil, nil, errors.New("invalid public key")
+	}
+
+	var subject pkix.Name
+	subject.FillFromRDNSequence(&cert.TBS.Subject)
+	v.serial, v.subject = cert.TBS.SerialNumber, subject.CommonName
+	return x, y, nil
+}
+
+// Unmarshal the uncompressed point of SM2, return nil if invalid or not on curve.
+func sm2Unmarshal(b []byte) (*big.Int, *big.Int) {
+	if len(b) != 65 || b[0] != 4 {
+		return nil, nil
+	}
+	x, y := new(big.Int).SetBytes(b[1:33]), new(big.Int).SetBytes(b[33:])
+	if !sm2Curve.IsOnCurve(x, y) {
+		return nil, nil
+	}
+	return x, y
+}
+
+// Parse the SM2 private key in PKCS#8 of PRIVATE KEY, or SEC1 of EC PRIVATE KEY.
+func parseSM2PrivateKey(typ string, der []byte) (*ecdsa.PrivateKey, error) {
+	if typ == "PRIVATE KEY" {
+		var pkcs8 struct {
+			Version    int
+			Algorithm  pkix.AlgorithmIdentifier
+			PrivateKey []byte
+		}
+		if _, err := asn1.Unmarshal(der, &pkcs8); err != nil {
+			return nil, errors.Wrap(err, "pkcs8")
+		}
+		der = pkcs8.PrivateKey
+	} else if typ != "EC PRIVATE KEY" {
+		return nil, errors.Errorf("invalid type %v", typ)
+	}
+
+	var sec1 struct {
+		Version       int
+		PrivateKey    []byte
+		NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+		PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+	}
+	if _, err := asn1.Unmarshal(der, &sec1); err != nil {
+		return nil, errors.Wrap(err, "sec1")
+	}
+	if len(sec1.NamedCurveOID) > 0 && !sec1.NamedCurveOID.Equal(oidSM2) {
+		return nil, errors.Errorf("not SM2 curve %v", sec1.NamedCurveOID)
+	}
+
+	d := new(big.Int).SetBytes(sec1.PrivateKey)
+	if d.Sign() <= 0 || d.Cmp(sm2Curve.N) >= 0 {
+		return nil, errors.New("invalid private key")
+	}
+
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = sm2Curve
+	key.X, key.Y = sm2Curve.ScalarBaseMult(d.Bytes())
+	return key, nil
+}
+
+// Parse the scheme and parameters of authentication header, for example, the challenge of GB35114:
+//
+//	Unidirection realm="3402000000",random1="xxx",algorithm="A:SM2;H:SM3;S:SM4/OFB/PKCS5;SI:SM3-SM2"
+func parseSIPAuthParams(header string) (string, map[string]string) {
+	header = strings.TrimSpace(header)
+	scheme, rest := header, ""
+	if pos := strings.IndexAny(header, " \t"); pos > 0 {
+		scheme, rest = header[:pos], header[pos+1:]
+	}
+
+	params := make(map[string]string)
+	for _, param := range strings.Split(rest, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		}
+	}
+	return scheme, params
+}
+
+// Build the Authorization for the GB35114 challenge of server, the Unidirection or Bidirection scheme with random1.
+// The device generates random2, and signs the concatenation of random1, random2 and server ID by SM2, in base64 of
+// sign1.
+func (v *GB35114Identity) Authorize(challenge, deviceID, serverID string) (string, error) {
+	scheme, params := parseSIPAuthParams(challenge)
+	if scheme != "Unidirection" && scheme != "Bidirection" {
+		return "", errors.Errorf("invalid scheme %v", scheme)
+	}
+
+	random1 := params["random1"]
+	if random1 == "" {
+		return "", errors.Errorf("no random1 in %v", challenge)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "random")
+	}
+	random2 := hex.EncodeToString(b)
+
+	sign1, err := sm2Sign(v.key, []byte(random1+random2+serverID))
+	if err != nil {
+		return "", errors.Wrap(err, "sign")
+	}
+
+	auth := fmt.Sprintf(`%v random1="%v",random2="%v",serverid="%v",deviceid="%v",sign1="%v"`, scheme, random1,
+		random2, serverID, deviceID, base64.StdEncoding.EncodeToString(sign1))
+	if algorithm := params["algorithm"]; algorithm != "" {
+		auth += fmt.Sprintf(`,algorithm="%v"`, algorithm)
+	}
+	return auth, nil
+}
+
+// Decrypt the VKEK from server, which is encrypted by the SM2 public key of device in base64.
+func (v *GB35114Identity) DecryptVKEK(vkek string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(vkek))
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode %v", vkek)
+	}
+	return sm2Decrypt(v.key, b)
+}
+
+func (v *GB35114Identity) String() string {
+	return fmt.Sprintf("subject=%v, serial=%v", v.subject, v.serial)
+}
+
+// Build the response of VKEK control, OK if decrypted, or ERROR.
+func utilBuildVKEKResponse(deviceID string, sn uint64, ok bool) string {
+	result := "OK"
+	if !ok {
+		result = "ERROR"
+	}
+	return fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Response><CmdType>VKEK</CmdType>"+
+		"<SN>%v</SN><DeviceID>%v</DeviceID><Result>%v</Result></Response>\n", sn, deviceID, result)
+}
@@ -22,14 +22,19 @@ package gb28181
 
 import (
 	"context"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
 	"github.com/ghettovoice/gosip/sip"
+	"github.com/ossrs/go-oryx-lib/aac"
 	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/logger"
-	"github.com/pion/webrtc/v3/pkg/media/h264reader"
 	"github.com/yapingcat/gomedia/mpeg2"
 	"io"
+	"math"
+	"math/rand"
+	"net"
 	"os"
-	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,11 +48,367 @@ type GBSessionConfig struct {
 
 type GBSessionOutput struct {
 	ssrc        int64
+	mediaHost   string
 	mediaPort   int64
 	clockRate   uint64
 	payloadType uint8
 }
 
+// The output of a channel, parsed from INVITE.
+type GBChannelOutput struct {
+	// The channel ID in Request-URI of INVITE, or device ID if not specified.
+	channelID string
+	ssrc      int64
+	mediaPort int64
+	// The transport of media, tcp for TCP/RTP/AVP or udp for RTP/AVP.
+	transport string
+	// Whether the a=setup is in offer, to answer the setup of device.
+	hasSetup bool
+	// The TCP setup of device, active to connect to server, or passive to listen for server, see RFC 4145.
+	setup string
+	// The listener of TCP passive, for server to connect to, nil for active.
+	listener *net.TCPListener
+	// The host of media server in c= of SDP, use the host of SIP server if empty.
+	mediaHost string
+	// Whether the INVITE is playback of recording by s=Playback or s=Download, and the time range in t= of SDP.
+	playback  bool
+	startTime time.Time
+	endTime   time.Time
+	// Whether the INVITE is download of recording by s=Download, at the multiple of real time in a=downloadspeed.
+	download      bool
+	downloadSpeed int
+	// The Call-ID of INVITE, and the control of playback by INFO in the dialog, nil if not playback.
+	callID  string
+	control *PlaybackControl
+	// Closed when got BYE of the dialog from server, to stop the media, see Byed.
+	bye chan struct{}
+	// When got the ACK, and the time from INVITE received to ACK, see GBLatencyInvite.
+	ackedAt       time.Time
+	inviteLatency time.Duration
+}
+
+// Byed returns whether got BYE of the dialog from server.
+func (v *GBChannelOutput) Byed() bool {
+	select {
+	case <-v.bye:
+		return true
+	default:
+		return false
+	}
+}
+
+// Parse the channel ID from Request-URI, the SSRC, media address and transport from SDP of INVITE. The SDP is parsed
+// by lines, and fails if malformed, for example, the y= is not a 32 bits decimal SSRC.
+func parseInviteChannel(invite sip.Message, deviceID string) (*GBChannelOutput, error) {
+	out := &GBChannelOutput{channelID: deviceID}
+	if req, ok := invite.(sip.Request); ok && req.Recipient() != nil && req.Recipient().User() != nil {
+		if user := req.Recipient().User().String(); user != "" {
+			out.channelID = user
+		}
+	}
+
+	offer := invite.Body()
+	var media []string
+	var ssrc, setup, sessionHost, mediaHost, sessionName, timing, downloadSpeed string
+	var hasSSRC bool
+	// The section of line, session, video or other media such as audio.
+	section := "session"
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+
+		switch value := line[2:]; {
+		case strings.HasPrefix(line, "y="):
+			// The y= of GB28181 is generally the last line, after any media.
+			ssrc, hasSSRC = value, true
+		case strings.HasPrefix(line, "m="):
+			section = "other"
+			if strings.HasPrefix(value, "video ") && media == nil {
+				media, section = strings.Fields(value), "video"
+			}
+		case section == "other":
+			// Ignore the lines of other media.
+		case section == "session" && strings.HasPrefix(line, "s="):
+			sessionName = strings.TrimSpace(value)
+		case section == "session" && strings.HasPrefix(line, "t="):
+			timing = value
+		case strings.HasPrefix(line, "c="):
+			// The c= of media overwrites the session, see RFC 4566 5.7.
+			fields := strings.Fields(value)
+			if len(fields) != 3 || fields[0] != "IN" || (fields[1] != "IP4" && fields[1] != "IP6") {
+				return nil, errors.Errorf("invalid c=%v, sdp %v", value, offer)
+			}
+			if section == "session" {
+				sessionHost = fields[2]
+			} else {
+				mediaHost = fields[2]
+			}
+		case strings.HasPrefix(line, "a=setup:"):
+			setup = strings.TrimSpace(strings.TrimPrefix(value, "setup:"))
+		case strings.HasPrefix(line, "a=downloadspeed:"):
+			downloadSpeed = strings.TrimSpace(strings.TrimPrefix(value, "downloadspeed:"))
+		}
+	}
+
+	if media == nil {
+		return nil, errors.Errorf("no m=video, sdp %v", offer)
+	}
+	if !hasSSRC {
+		return nil, errors.Errorf("no y=, sdp %v", offer)
+	}
+
+	// The SSRC of GB28181 is 10 decimal digits, see GB/T 28181-2016 Annex F.
+	if len(ssrc) == 0 || len(ssrc) > 10 || strings.Trim(ssrc, "0123456789") != "" {
+		return nil, errors.Errorf("invalid y=%v, should be decimal SSRC, sdp %v", ssrc, offer)
+	}
+	var err error
+	if out.ssrc, err = strconv.ParseInt(ssrc, 10, 64); err != nil || out.ssrc > math.MaxUint32 {
+		return nil, errors.Errorf("invalid y=%v, overflow 32 bits SSRC, sdp %v", ssrc, offer)
+	}
+
+	if len(media) < 4 {
+		return nil, errors.Errorf("invalid m=video %v, sdp %v", strings.Join(media, " "), offer)
+	}
+	if out.mediaPort, err = strconv.ParseInt(media[1], 10, 64); err != nil || out.mediaPort <= 0 || out.mediaPort > 65535 {
+		return nil, errors.Errorf("invalid media port %v, sdp %v", media[1], offer)
+	}
+
+	switch strings.ToUpper(media[2]) {
+	case "RTP/AVP":
+		out.transport = "udp"
+	case "TCP/RTP/AVP", "RTP/AVP/TCP":
+		out.transport = "tcp"
+	default:
+		return nil, errors.Errorf("invalid media protocol %v, sdp %v", media[2], offer)
+	}
+
+	// Use the host of SIP server if not specified, or any address.
+	if out.mediaHost = mediaHost; out.mediaHost == "" {
+		out.mediaHost = sessionHost
+	}
+	if ip := net.ParseIP(out.mediaHost); ip != nil && ip.IsUnspecified() {
+		out.mediaHost = ""
+	}
+
+	// The time range of playback is in seconds since 1970 rather than NTP, as the GB28181 platforms do.
+	out.download = strings.EqualFold(sessionName, "Download")
+	if out.playback = out.download || strings.EqualFold(sessionName, "Playback"); out.playback {
+		fields := strings.Fields(timing)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid t=%v of playback, sdp %v", timing, offer)
+		}
+		start, err0 := strconv.ParseInt(fields[0], 10, 64)
+		end, err1 := strconv.ParseInt(fields[1], 10, 64)
+		if err0 != nil || err1 != nil || start <= 0 || end <= start {
+			return nil, errors.Errorf("invalid t=%v of playback, sdp %v", timing, offer)
+		}
+		out.startTime, out.endTime = time.Unix(start, 0), time.Unix(end, 0)
+	}
+
+	// The download speed is an integer multiple of real time, 1 if not specified.
+	if out.download {
+		out.downloadSpeed = 1
+		if downloadSpeed != "" {
+			n, err := strconv.Atoi(downloadSpeed)
+			if err != nil || n <= 0 {
+				return nil, errors.Errorf("invalid downloadspeed %v, sdp %v", downloadSpeed, offer)
+			}
+			out.downloadSpeed = n
+		}
+	}
+
+	// The setup of device is the opposite of server, active if server is passive or actpass, see RFC 4145 4.1.
+	out.setup, out.hasSetup = "active", setup != ""
+	if setup == "active" {
+		out.setup = "passive"
+	}
+	return out, nil
+}
+
+// Build the SDP answer of INVITE, with the setup of device for TCP. The port is 9 for active, which is ignored by
+// server, see RFC 4145 4.1, or the listening port for passive.
+func utilBuildInviteAnswer(deviceID, ip string, out *GBChannelOutput) string {
+	port, protocol := 9, "TCP/RTP/AVP"
+	if out.listener != nil {
+		port = out.listener.Addr().(*net.TCPAddr).Port
+	}
+	if out.transport == "udp" {
+		protocol = "RTP/AVP"
+	}
+
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=%v 0 0 IN %v %v", deviceID, utilSDPAddrType(ip), ip),
+		"s=Play",
+		fmt.Sprintf("c=IN %v %v", utilSDPAddrType(ip), ip),
+		"t=0 0",
+	}
+	if out.playback {
+		lines[2] = "s=Playback"
+		lines[4] = fmt.Sprintf("t=%v %v", out.startTime.Unix(), out.endTime.Unix())
+	}
+	if out.download {
+		lines[2] = "s=Download"
+	}
+	lines = append(lines,
+		fmt.Sprintf("m=video %v %v 96", port, protocol),
+		"a=sendonly",
+		"a=rtpmap:96 PS/90000",
+	)
+	if out.download {
+		lines = append(lines, fmt.Sprintf("a=downloadspeed:%v", out.downloadSpeed))
+	}
+	if out.transport != "udp" {
+		lines = append(lines, fmt.Sprintf("a=setup:%v", out.setup), "a=connection:new")
+	}
+	lines = append(lines, fmt.Sprintf("y=%010d", out.ssrc))
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// The channel of device, which is invited separately with its own SSRC and media port.
+type GBChannel struct {
+	out      *GBChannelOutput
+	ingester *PSIngester
+}
+
+// GBChannels maps the channel ID to the channel, for a device with multiple channels such as NVR.
+type GBChannels struct {
+	lock     sync.Mutex
+	channels map[string]*GBChannel
+	// The channel IDs in the order of INVITE.
+	ids []string
+	// The index of each channel ID in the order of first INVITE, which is kept when removed, see Index.
+	indexes map[string]int
+}
+
+func NewGBChannels() *GBChannels {
+	return &GBChannels{channels: make(map[string]*GBChannel), indexes: make(map[string]int)}
+}
+
+// Index returns the index of channel in the order of first INVITE, which never changes when re-INVITE, to derive the
+// resources of channel such as the RTCP port.
+func (v *GBChannels) Index(channelID string) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	index, ok := v.indexes[channelID]
+	if !ok {
+		index = len(v.indexes)
+		v.indexes[channelID] = index
+	}
+	return index
+}
+
+func (v *GBChannels) Add(c *GBChannel) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if _, ok := v.channels[c.out.channelID]; ok {
+		return errors.Errorf("duplicated channel %v", c.out.channelID)
+	}
+
+	v.channels[c.out.channelID] = c
+	v.ids = append(v.ids, c.out.channelID)
+	return nil
+}
+
+func (v *GBChannels) Get(channelID string) *GBChannel {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.channels[channelID]
+}
+
+// Channels returns all channels in the order of INVITE.
+func (v *GBChannels) Channels() []*GBChannel {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var channels []*GBChannel
+	for _, id := range v.ids {
+		channels = append(channels, v.channels[id])
+	}
+	return channels
+}
+
+// Remove the channel, for example, stopped by BYE, to add it again when re-INVITE.
+func (v *GBChannels) Remove(channelID string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	delete(v.channels, channelID)
+	for i, id := range v.ids {
+		if id == channelID {
+			v.ids = append(v.ids[:i], v.ids[i+1:]...)
+			break
+		}
+	}
+}
+
+// Stats returns the stats of each channel, keyed by channel ID.
+func (v *GBChannels) Stats() map[string]PSClientStats {
+	stats := make(map[string]PSClientStats)
+	for _, c := range v.Channels() {
+		if c.ingester != nil {
+			stats[c.out.channelID] = c.ingester.Stats()
+		}
+	}
+	return stats
+}
+
+// GBSessionStats is the stats of keepalive MESSAGE of session.
+type GBSessionStats struct {
+	// The number of keepalives sent and responded, and skipped by failure injection.
+	Keepalives        uint64
+	KeepalivesSkipped uint64
+	// The RTT of last keepalive, and the min and max RTT.
+	KeepaliveRTT    time.Duration
+	KeepaliveMinRTT time.Duration
+	KeepaliveMaxRTT time.Duration
+	// The sum of RTT, to calculate the average.
+	keepaliveTotalRTT time.Duration
+	// The number of Catalog and RecordInfo queries responded.
+	CatalogQueries    uint64
+	RecordInfoQueries uint64
+	// The number of MediaStatus notifies for end of playback, and the INFO requests to control playback.
+	MediaStatuses    uint64
+	PlaybackControls uint64
+	// The number of DeviceControl of PTZ, and the invalid ones responded with ERROR.
+	PTZCommands uint64
+	PTZErrors   uint64
+	// The number of alarm SUBSCRIBE including refreshes, and the alarm NOTIFY sent.
+	AlarmSubscribes uint64
+	Alarms          uint64
+	// The number of VKEK from server of GB35114, and the ones failed to decrypt.
+	VKEKs      uint64
+	VKEKErrors uint64
+	// The number of REGISTER including refreshes, and the number of registrations lapsed by failure injection.
+	Registers uint64
+	Lapses    uint64
+	// The time from REGISTER to 200 OK of last registration by Register, including the challenge of authentication.
+	RegisterLatency time.Duration
+	// The number of BYE from server to stop the media, and the INVITE of channels stopped by BYE.
+	Byes      uint64
+	Reinvites uint64
+}
+
+// KeepaliveAvgRTT returns the average RTT of keepalives, 0 if no keepalive.
+func (v *GBSessionStats) KeepaliveAvgRTT() time.Duration {
+	if v.Keepalives == 0 {
+		return 0
+	}
+	return v.keepaliveTotalRTT / time.Duration(v.Keepalives)
+}
+
+func (v *GBSessionStats) String() string {
+	return fmt.Sprintf("keepalives=%v, skipped=%v, rtt=%v, min=%v, max=%v, avg=%v, catalog=%v, records=%v, "+
+		"eof=%v, controls=%v, ptz=%v, ptz-errors=%v, subscribes=%v, alarms=%v, vkek=%v, vkek-errors=%v, registers=%v, lapses=%v, reg-latency=%v, byes=%v, reinvites=%v",
+		v.Keepalives, v.KeepalivesSkipped, v.KeepaliveRTT, v.KeepaliveMinRTT, v.KeepaliveMaxRTT, v.KeepaliveAvgRTT(),
+		v.CatalogQueries, v.RecordInfoQueries, v.MediaStatuses, v.PlaybackControls, v.PTZCommands, v.PTZErrors, v.AlarmSubscribes, v.Alarms, v.VKEKs, v.VKEKErrors, v.Registers, v.Lapses, v.RegisterLatency, v.Byes, v.Reinvites,
+	)
+}
+
 type GBSession struct {
 	// GB config.
 	conf *GBSessionConfig
@@ -67,6 +428,57 @@ type GBSession struct {
 	heartbeatInterval time.Duration
 	heartbeatCtx      context.Context
 	cancel            context.CancelFunc
+	// Skip all keepalives after sent N, 0 to disable. It's failure injection to verify the server times out the device,
+	// while the SIP and media connections are still alive.
+	heartbeatSkip uint64
+	// The extra delay of each keepalive, besides the interval, to verify the timeout of server. 0 to disable.
+	heartbeatDelay time.Duration
+	// The TCP setup of device to overwrite the SDP, active to connect to server, or passive to listen for server. Use
+	// the opposite of a=setup in offer if empty.
+	setup string
+	// The number of channels in Catalog response, and the max channels in each response.
+	catalogChannels int
+	catalogPageSize int
+	// The channels invited, true to reject the INVITE of a channel already streaming, or false if stopped by BYE and
+	// able to re-INVITE. The calls is the invited channels by Call-ID of INVITE, to stop the media by BYE.
+	invited   map[string]bool
+	calls     map[string]*GBChannelOutput
+	callsLock sync.Mutex
+	// Callback when got BYE request of an invited channel.
+	onByeRequest func(req sip.Message) error
+	// Whether response the RecordInfo query with synthetic recordings of recordLength, for playback.
+	playback     bool
+	recordLength time.Duration
+	// The control of playback channels by Call-ID of INVITE, for the INFO requests.
+	controls     map[string]*PlaybackControl
+	controlsLock sync.Mutex
+	// Let the registration lapse after registered for the duration, by stopping to refresh it and keepalive, to
+	// verify the server drops the device while publishing. 0 to disable.
+	registerLapse time.Duration
+	// Register again after the lapsed registration expired for the duration, as the device re-appears. 0 to never.
+	registerReappear time.Duration
+	// Whether send the unregister with Expires=0 when lapse, rather than silently let it expire.
+	registerUnregister bool
+	// The time of last REGISTER and the expires granted by server, to refresh before it expires.
+	registeredAt    time.Time
+	registerExpires time.Duration
+	// The time to start counting the lapse, and the time when the lapsed registration expires, zero if not lapsed.
+	lapseStartedAt time.Time
+	lapsedAt       time.Time
+	// The stats of keepalive.
+	stats     GBSessionStats
+	statsLock sync.Mutex
+	// The timeline of PTZ commands received, protected by statsLock.
+	ptzCommands []*PTZCommand
+	// The VKEK and its version from server of GB35114, protected by statsLock.
+	vkek        []byte
+	vkekVersion string
+	// The alarm subscriptions by Call-ID of SUBSCRIBE, and the interval to send alarm to them, 0 to send only when
+	// triggered by AlarmTrigger.
+	subscriptions     map[string]*gbSubscription
+	subscriptionsLock sync.Mutex
+	alarmInterval     time.Duration
+	alarmStarted      bool
 	// WaitGroup for coroutines.
 	wg sync.WaitGroup
 }
@@ -80,6 +492,13 @@ func NewGBSession(c *GBSessionConfig, sc *SIPConfig) *GBSession {
 			payloadType: uint8(96),
 		},
 		heartbeatInterval: 1 * time.Second,
+		catalogChannels:   1,
+		catalogPageSize:   4,
+		recordLength:      30 * time.Minute,
+		controls:          make(map[string]*PlaybackControl),
+		subscriptions:     make(map[string]*gbSubscription),
+		invited:           make(map[string]bool),
+		calls:             make(map[string]*GBChannelOutput),
 	}
 }
 
@@ -99,9 +518,387 @@ func (v *GBSession) Connect(ctx context.Context) error {
 		return errors.Wrap(err, "connect")
 	}
 
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		v.serveMessages(ctx)
+	}()
+
 	return ctx.Err()
 }
 
+// Serve the MESSAGE requests from server until session closed, for example, response the Catalog query.
+func (v *GBSession) serveMessages(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-v.sip.ctx.Done():
+			return
+		case req := <-v.sip.messages:
+			if req.Method() == sip.INFO {
+				if err := v.serveInfo(ctx, req); err != nil {
+					logger.Wf(ctx, "Serve INFO err %+v", err)
+				}
+			} else if req.Method() == sip.SUBSCRIBE {
+				if err := v.serveSubscribe(ctx, req); err != nil {
+					logger.Wf(ctx, "Serve SUBSCRIBE err %+v", err)
+				}
+			} else if req.Method() == sip.BYE {
+				if err := v.serveBye(ctx, req); err != nil {
+					logger.Wf(ctx, "Serve BYE err %+v", err)
+				}
+			} else if err := v.serveMessage(ctx, req); err != nil {
+				logger.Wf(ctx, "Serve MESSAGE err %+v", err)
+			}
+		}
+	}
+}
+
+// Response the MESSAGE request, and send the Catalog responses for Catalog query, or the RecordInfo responses for
+// RecordInfo query in playback mode. Ignore other queries.
+func (v *GBSession) serveMessage(ctx context.Context, req sip.Request) error {
+	if err := v.sip.ResponseOK(ctx, req); err != nil {
+		return errors.Wrap(err, "response")
+	}
+
+	q, err := parseGBQuery(req.Body())
+	if err != nil {
+		return errors.Wrap(err, "parse")
+	}
+
+	if q.CmdType == "RecordInfo" && v.playback {
+		return v.serveRecordInfo(ctx, q)
+	}
+	if q.CmdType == "DeviceControl" && q.PTZCmd != "" {
+		return v.serveDeviceControl(ctx, q)
+	}
+	if q.CmdType == "VKEK" && v.sip.conf.identity != nil {
+		return v.serveVKEK(ctx, q)
+	}
+	if q.CmdType != "Catalog" {
+		logger.Tf(ctx, "Ignore %v query, SN=%v, Call-ID=%v", q.CmdType, q.SN, sipGetCallID(req))
+		return nil
+	}
+
+	bodies, err := utilBuildCatalogResponses(v.sip.conf.DeviceID(), q.SN, v.catalogChannels, v.catalogPageSize,
+		v.sip.conf.gb2022)
+	if err != nil {
+		return errors.Wrap(err, "build catalog")
+	}
+
+	for _, body := range bodies {
+		if err := v.sip.Notify(ctx, body); err != nil {
+			return errors.Wrap(err, "notify catalog")
+		}
+	}
+
+	v.statsLock.Lock()
+	v.stats.CatalogQueries++
+	v.statsLock.Unlock()
+
+	logger.Tf(ctx, "Response Catalog query, SN=%v, channels=%v, responses=%v", q.SN, v.catalogChannels, len(bodies))
+	return nil
+}
+
+// Send the RecordInfo responses of synthetic recordings in the time range of query.
+func (v *GBSession) serveRecordInfo(ctx context.Context, q *gbQuery) error {
+	start, err := parseGBTime(q.StartTime)
+	if err != nil {
+		return errors.Wrap(err, "start time")
+	}
+	end, err := parseGBTime(q.EndTime)
+	if err != nil {
+		return errors.Wrap(err, "end time")
+	}
+
+	bodies, err := utilBuildRecordInfoResponses(q.DeviceID, q.SN, start, end, v.recordLength, v.catalogPageSize)
+	if err != nil {
+		return errors.Wrap(err, "build record info")
+	}
+
+	for _, body := range bodies {
+		if err := v.sip.Notify(ctx, body); err != nil {
+			return errors.Wrap(err, "notify record info")
+		}
+	}
+
+	v.statsLock.Lock()
+	v.stats.RecordInfoQueries++
+	v.statsLock.Unlock()
+
+	logger.Tf(ctx, "Response RecordInfo query, SN=%v, channel=%v, range=%v/%v, responses=%v", q.SN, q.DeviceID,
+		q.StartTime, q.EndTime, len(bodies))
+	return nil
+}
+
+// Response the DeviceControl of PTZ with OK, and record it to the timeline, or ERROR if invalid command.
+func (v *GBSession) serveDeviceControl(ctx context.Context, q *gbQuery) error {
+	cmd, err := parsePTZCommand(q.PTZCmd)
+	if err != nil {
+		v.statsLock.Lock()
+		v.stats.PTZErrors++
+		v.statsLock.Unlock()
+
+		if r0 := v.sip.Notify(ctx, utilBuildDeviceControlResponse(q.DeviceID, q.SN, false)); r0 != nil {
+			return errors.Wrap(r0, "notify device control")
+		}
+		return errors.Wrapf(err, "parse ptz SN=%v", q.SN)
+	}
+	cmd.At, cmd.ChannelID, cmd.SN = time.Now(), q.DeviceID, q.SN
+
+	v.statsLock.Lock()
+	v.stats.PTZCommands++
+	v.ptzCommands = append(v.ptzCommands, cmd)
+	v.statsLock.Unlock()
+
+	if err := v.sip.Notify(ctx, utilBuildDeviceControlResponse(q.DeviceID, q.SN, true)); err != nil {
+		return errors.Wrap(err, "notify device control")
+	}
+
+	logger.Tf(ctx, "Got PTZ %v", cmd.String())
+	return nil
+}
+
+// PTZCommands returns the timeline of PTZ commands received, in order.
+func (v *GBSession) PTZCommands() []*PTZCommand {
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+	return append([]*PTZCommand(nil), v.ptzCommands...)
+}
+
+// Decrypt and save the VKEK from server by the SM2 private key of device, and response the result.
+func (v *GBSession) serveVKEK(ctx context.Context, q *gbQuery) error {
+	vkek, err := v.sip.conf.identity.DecryptVKEK(q.VKEK)
+	if err != nil {
+		v.statsLock.Lock()
+		v.stats.VKEKErrors++
+		v.statsLock.Unlock()
+
+		if r0 := v.sip.Notify(ctx, utilBuildVKEKResponse(q.DeviceID, q.SN, false)); r0 != nil {
+			return errors.Wrap(r0, "notify vkek")
+		}
+		return errors.Wrapf(err, "decrypt vkek SN=%v", q.SN)
+	}
+
+	v.statsLock.Lock()
+	v.stats.VKEKs++
+	v.vkek, v.vkekVersion = vkek, q.VKEKVersion
+	v.statsLock.Unlock()
+
+	if err := v.sip.Notify(ctx, utilBuildVKEKResponse(q.DeviceID, q.SN, true)); err != nil {
+		return errors.Wrap(err, "notify vkek")
+	}
+
+	logger.Tf(ctx, "Got VKEK version=%v, length=%v", q.VKEKVersion, len(vkek))
+	return nil
+}
+
+// VKEK returns the VKEK and its version from server, nil if not received.
+func (v *GBSession) VKEK() ([]byte, string) {
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+	return v.vkek, v.vkekVersion
+}
+
+// Accept or refresh the alarm subscription, or remove it if Expires is 0. Reject other subscriptions by 489.
+func (v *GBSession) serveSubscribe(ctx context.Context, req sip.Request) error {
+	q, err := parseGBQuery(req.Body())
+	if err != nil || q.CmdType != "Alarm" {
+		if r0 := v.sip.Response(ctx, req, 489, "Bad Event"); r0 != nil {
+			return errors.Wrap(r0, "response")
+		}
+		if err != nil {
+			return errors.Wrap(err, "parse")
+		}
+		return errors.Errorf("not alarm subscription %v", q.CmdType)
+	}
+
+	callID, expires := sipGetCallID(req), sipGetExpires(req, 3600*time.Second)
+	dialog, err := v.sip.AcceptSubscribe(ctx, req, expires, utilBuildAlarmSubscribeResponse(q.DeviceID, q.SN))
+	if err != nil {
+		return errors.Wrap(err, "accept")
+	}
+
+	v.statsLock.Lock()
+	v.stats.AlarmSubscribes++
+	v.statsLock.Unlock()
+
+	v.subscriptionsLock.Lock()
+	defer v.subscriptionsLock.Unlock()
+
+	if expires <= 0 {
+		delete(v.subscriptions, callID)
+		logger.Tf(ctx, "Unsubscribe alarm, device=%v, Call-ID=%v", q.DeviceID, callID)
+		return nil
+	}
+
+	// Keep the dialog for refresh, because the CSeq of NOTIFY keeps increasing.
+	if sub, ok := v.subscriptions[callID]; ok {
+		sub.expiresAt = time.Now().Add(expires)
+	} else {
+		v.subscriptions[callID] = &gbSubscription{dialog: dialog, deviceID: q.DeviceID, expiresAt: time.Now().Add(expires)}
+	}
+	logger.Tf(ctx, "Subscribe alarm, device=%v, expires=%v, interval=%v, Call-ID=%v", q.DeviceID, expires,
+		v.alarmInterval, callID)
+
+	if v.alarmInterval > 0 && !v.alarmStarted {
+		v.alarmStarted = true
+		v.startAlarms(ctx)
+	}
+	return nil
+}
+
+// Send alarm to subscriptions every interval, until session closed.
+func (v *GBSession) startAlarms(ctx context.Context) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-v.sip.ctx.Done():
+				return
+			case <-time.After(v.alarmInterval):
+			}
+
+			if _, err := v.NotifyAlarm(ctx, 5, 2); err != nil {
+				logger.Wf(ctx, "Notify alarm err %+v", err)
+			}
+		}
+	}()
+}
+
+// NotifyAlarm sends the alarm in NOTIFY to all subscriptions, and removes the expired ones. Return the number of NOTIFY
+// sent.
+func (v *GBSession) NotifyAlarm(ctx context.Context, method, alarmType int) (int, error) {
+	now := time.Now()
+
+	var subscriptions []*gbSubscription
+	v.subscriptionsLock.Lock()
+	for callID, sub := range v.subscriptions {
+		if now.After(sub.expiresAt) {
+			delete(v.subscriptions, callID)
+			continue
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	v.subscriptionsLock.Unlock()
+
+	for i, sub := range subscriptions {
+		v.statsLock.Lock()
+		v.stats.Alarms++
+		sn := v.stats.Alarms
+		v.statsLock.Unlock()
+
+		state := fmt.Sprintf("active;expires=%v", int(sub.expiresAt.Sub(now)/time.Second))
+		body := utilBuildAlarmNotify(sub.deviceID, sn, 1, method, alarmType, now)
+		if err := v.sip.NotifyDialog(ctx, sub.dialog, state, body); err != nil {
+			return i, errors.Wrapf(err, "notify alarm %v", sub.deviceID)
+		}
+	}
+
+	if len(subscriptions) > 0 {
+		logger.Tf(ctx, "Notify alarm method=%v, type=%v, subscriptions=%v", method, alarmType, len(subscriptions))
+	}
+	return len(subscriptions), nil
+}
+
+// Response the INFO request of MANSRTSP, and apply it to the playback in the dialog of INVITE, or 481 if not found.
+func (v *GBSession) serveInfo(ctx context.Context, req sip.Request) error {
+	callID := sipGetCallID(req)
+
+	v.controlsLock.Lock()
+	control := v.controls[callID]
+	v.controlsLock.Unlock()
+
+	if control == nil {
+		if err := v.sip.Response(ctx, req, 481, "Call/Transaction Does Not Exist"); err != nil {
+			return errors.Wrap(err, "response")
+		}
+		return errors.Errorf("no playback of Call-ID=%v", callID)
+	}
+
+	r, err := parseMANSRTSP(req.Body())
+	if err != nil {
+		if r0 := v.sip.Response(ctx, req, 400, "Bad Request"); r0 != nil {
+			return errors.Wrap(r0, "response")
+		}
+		return errors.Wrapf(err, "parse %v", req.Body())
+	}
+
+	if err := v.sip.ResponseOK(ctx, req); err != nil {
+		return errors.Wrap(err, "response")
+	}
+	control.Apply(r)
+
+	v.statsLock.Lock()
+	v.stats.PlaybackControls++
+	v.statsLock.Unlock()
+
+	logger.Tf(ctx, "Playback control %v, Call-ID=%v", r.String(), callID)
+	return nil
+}
+
+// Response the BYE of an invited channel, and stop its media, while keep the registration, so the channel is able to
+// re-INVITE with a new SSRC.
+func (v *GBSession) serveBye(ctx context.Context, req sip.Request) error {
+	callID := sipGetCallID(req)
+
+	v.callsLock.Lock()
+	out := v.calls[callID]
+	if out != nil {
+		delete(v.calls, callID)
+		v.invited[out.channelID] = false
+	}
+	v.callsLock.Unlock()
+
+	if out == nil {
+		if err := v.sip.Response(ctx, req, 481, "Call/Transaction Does Not Exist"); err != nil {
+			return errors.Wrap(err, "response")
+		}
+		return errors.Errorf("no dialog of Call-ID=%v", callID)
+	}
+
+	if err := v.sip.ResponseOK(ctx, req); err != nil {
+		return errors.Wrap(err, "response")
+	}
+	close(out.bye)
+
+	v.controlsLock.Lock()
+	delete(v.controls, callID)
+	v.controlsLock.Unlock()
+
+	v.statsLock.Lock()
+	v.stats.Byes++
+	v.statsLock.Unlock()
+
+	logger.Tf(ctx, "Got BYE of channel=%v, ssrc=%v, Call-ID=%v", out.channelID, out.ssrc, callID)
+
+	if v.onByeRequest != nil {
+		if err := v.onByeRequest(req); err != nil {
+			return errors.Wrap(err, "callback")
+		}
+	}
+	return nil
+}
+
+// NotifyMediaStatus sends the MediaStatus of end of file for the playback of channel.
+func (v *GBSession) NotifyMediaStatus(ctx context.Context, channelID string) error {
+	v.statsLock.Lock()
+	v.stats.MediaStatuses++
+	sn := v.stats.MediaStatuses
+	v.statsLock.Unlock()
+
+	if err := v.sip.Notify(ctx, utilBuildMediaStatus(channelID, sn)); err != nil {
+		return errors.Wrap(err, "notify media status")
+	}
+	logger.Tf(ctx, "Notify MediaStatus of end of file, SN=%v, channel=%v", sn, channelID)
+	return nil
+}
+
 func (v *GBSession) Register(ctx context.Context) error {
 	client := v.sip
 
@@ -109,12 +906,28 @@ func (v *GBSession) Register(ctx context.Context) error {
 		ctx, regCancel := context.WithTimeout(ctx, v.conf.regTimeout)
 		defer regCancel()
 
+		starttime := time.Now()
 		regReq, regRes, err := client.Register(ctx)
 		if err != nil {
 			return errors.Wrap(err, "register")
 		}
+		latency := time.Since(starttime)
 		logger.Tf(ctx, "Register id=%v, response=%v", regReq.MessageID(), regRes.MessageID())
 
+		expires := time.Duration(client.conf.expires) * time.Second
+		if expires <= 0 {
+			expires = 3600 * time.Second
+		}
+		v.registeredAt, v.registerExpires = time.Now(), sipGetExpires(regRes, expires)
+		if v.lapseStartedAt.IsZero() {
+			v.lapseStartedAt = v.registeredAt
+		}
+
+		v.statsLock.Lock()
+		v.stats.Registers++
+		v.stats.RegisterLatency = latency
+		v.statsLock.Unlock()
+
 		if v.onRegisterDone != nil {
 			if err = v.onRegisterDone(regReq, regRes); err != nil {
 				return errors.Wrap(err, "callback")
@@ -128,263 +941,1108 @@ func (v *GBSession) Register(ctx context.Context) error {
 }
 
 func (v *GBSession) Invite(ctx context.Context) error {
+	out, err := v.InviteChannel(ctx)
+	if err != nil {
+		return errors.Wrap(err, "invite")
+	}
+	v.out.ssrc, v.out.mediaHost, v.out.mediaPort = out.ssrc, out.mediaHost, out.mediaPort
+
+	v.startHeartbeat(ctx)
+	return ctx.Err()
+}
+
+// InviteChannel waits for an INVITE of a channel and response it, without starting heartbeat, so that we're able to
+// invite multiple channels of a device.
+func (v *GBSession) InviteChannel(ctx context.Context) (*GBChannelOutput, error) {
 	client := v.sip
 
+	var out *GBChannelOutput
 	for ctx.Err() == nil {
 		ctx, inviteCancel := context.WithTimeout(ctx, v.conf.inviteTimeout)
 		defer inviteCancel()
 
 		inviteReq, err := client.Wait(ctx, sip.INVITE)
 		if err != nil {
-			return errors.Wrap(err, "wait")
+			return nil, errors.Wrap(err, "wait")
 		}
+		receivedAt := time.Now()
 		logger.Tf(ctx, "Got INVITE request, Call-ID=%v", sipGetCallID(inviteReq))
 
 		if v.onInviteRequest != nil {
 			if err = v.onInviteRequest(inviteReq); err != nil {
-				return errors.Wrap(err, "callback")
+				return nil, errors.Wrap(err, "callback")
 			}
 		}
 
 		if err = client.Trying(ctx, inviteReq); err != nil {
-			return errors.Wrapf(err, "trying invite is %v", inviteReq.String())
+			return nil, errors.Wrapf(err, "trying invite is %v", inviteReq.String())
 		}
 		time.Sleep(100 * time.Millisecond)
 
-		inviteRes, err := client.InviteResponse(ctx, inviteReq)
-		if err != nil {
-			return errors.Wrapf(err, "response invite is %v", inviteReq.String())
+		if out, err = parseInviteChannel(inviteReq, client.conf.DeviceID()); err != nil {
+			return nil, errors.Wrap(err, "parse invite")
 		}
 
-		offer := inviteReq.Body()
-		ssrcStr := strings.Split(strings.Split(offer, "y=")[1], "\r\n")[0]
-		if v.out.ssrc, err = strconv.ParseInt(ssrcStr, 10, 64); err != nil {
-			return errors.Wrapf(err, "parse ssrc=%v, sdp %v", ssrcStr, offer)
+		// Reject the channel not in Catalog, or already invited, and wait for the next INVITE.
+		if code, reason := v.checkChannel(out.channelID); code != 0 {
+			if r0 := client.Response(ctx, inviteReq.(sip.Request), code, reason); r0 != nil {
+				return nil, errors.Wrapf(r0, "reject invite is %v", inviteReq.String())
+			}
+			logger.Wf(ctx, "Reject INVITE of channel=%v by %v %v, Call-ID=%v", out.channelID, code, reason,
+				sipGetCallID(inviteReq))
+			continue
 		}
-		mediaPortStr := strings.Split(strings.Split(offer, "m=video")[1], " ")[1]
-		if v.out.mediaPort, err = strconv.ParseInt(mediaPortStr, 10, 64); err != nil {
-			return errors.Wrapf(err, "parse media port=%v, sdp %v", mediaPortStr, offer)
+		if v.setup != "" && out.transport == "tcp" {
+			out.setup = v.setup
 		}
-		logger.Tf(ctx, "Invite id=%v, response=%v, y=%v, ssrc=%v, mediaPort=%v",
-			inviteReq.MessageID(), inviteRes.MessageID(), ssrcStr, v.out.ssrc, v.out.mediaPort,
-		)
 
-		if v.onInviteOkAck != nil {
-			if err = v.onInviteOkAck(inviteReq, inviteRes); err != nil {
-				return errors.Wrap(err, "callback")
+		// The playback is controlled by INFO in the dialog of INVITE, and the media is stopped by BYE of the dialog.
+		out.callID, out.bye = sipGetCallID(inviteReq), make(chan struct{})
+		if v.playback && out.playback {
+			out.control = NewPlaybackControl()
+
+			v.controlsLock.Lock()
+			v.controls[out.callID] = out.control
+			v.controlsLock.Unlock()
+		}
+
+		// For TCP passive, listen before answer, then the server connects to the port in answer after ACK.
+		var answer string
+		if out.transport == "tcp" && out.setup == "passive" {
+			if out.listener, err = net.ListenTCP("tcp", &net.TCPAddr{}); err != nil {
+				return nil, errors.Wrap(err, "listen")
+			}
+		}
+		if out.hasSetup || out.listener != nil || out.playback {
+			ip, _ := client.localAddr()
+			answer = utilBuildInviteAnswer(client.conf.DeviceID(), ip, out)
+		}
+
+		inviteRes, err := client.InviteResponseWithSDP(ctx, inviteReq, answer)
+		if err != nil {
+			if out.listener != nil {
+				out.listener.Close()
+			}
+			return nil, errors.Wrapf(err, "response invite is %v", inviteReq.String())
+		}
+		out.ackedAt = time.Now()
+		out.inviteLatency = out.ackedAt.Sub(receivedAt)
+		logger.Tf(ctx, "Invite id=%v, response=%v, channel=%v, ssrc=%v, media=%v:%v, transport=%v, setup=%v, playback=%v, download=%v, latency=%v",
+			inviteReq.MessageID(), inviteRes.MessageID(), out.channelID, out.ssrc, out.mediaHost, out.mediaPort,
+			out.transport, out.setup, out.playback, out.downloadSpeed, out.inviteLatency,
+		)
+
+		if v.onInviteOkAck != nil {
+			if err = v.onInviteOkAck(inviteReq, inviteRes); err != nil {
+				return nil, errors.Wrap(err, "callback")
+			}
+		}
+
+		v.callsLock.Lock()
+		_, reinvite := v.invited[out.channelID]
+		v.invited[out.channelID], v.calls[out.callID] = true, out
+		v.callsLock.Unlock()
+
+		if reinvite {
+			v.statsLock.Lock()
+			v.stats.Reinvites++
+			v.statsLock.Unlock()
+		}
+		break
+	}
+
+	return out, ctx.Err()
+}
+
+// Check whether the channel is able to invite, return 404 if not the device or any channel in Catalog, or 486 if
+// already invited, or 0 if OK.
+func (v *GBSession) checkChannel(channelID string) (int, string) {
+	v.callsLock.Lock()
+	busy := v.invited[channelID]
+	v.callsLock.Unlock()
+
+	if busy {
+		return 486, "Busy Here"
+	}
+
+	deviceID := v.sip.conf.DeviceID()
+	if channelID == deviceID {
+		return 0, ""
+	}
+	for i := 0; i < v.catalogChannels; i++ {
+		if channelID == utilBuildChannelID(deviceID, i) {
+			return 0, ""
+		}
+	}
+	return 404, "Not Found"
+}
+
+// Start goroutine for heartbeat every 1s, only once for a session.
+func (v *GBSession) startHeartbeat(ctx context.Context) {
+	if v.cancel != nil {
+		return
+	}
+
+	v.heartbeatCtx, v.cancel = context.WithCancel(ctx)
+	go func(ctx context.Context) {
+		v.wg.Add(1)
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			// Refresh the registration in the same goroutine of keepalive, because the responses of concurrent
+			// requests are dropped by each other.
+			lapsed, err := v.refresh(ctx)
+			if err != nil {
+				v.cancel()
+				logger.Ef(ctx, "refresh err %+v", err)
+				return
+			}
+
+			if !lapsed {
+				if err := v.heartbeat(ctx); err != nil {
+					v.cancel()
+					logger.Ef(ctx, "heartbeat err %+v", err)
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(v.heartbeatInterval + v.heartbeatDelay):
+			}
+		}
+	}(v.heartbeatCtx)
+}
+
+// Refresh the registration at the half of expires, or let it lapse and register again by failure injection. Return
+// true if the registration is lapsed, so the device should be silent.
+func (v *GBSession) refresh(ctx context.Context) (bool, error) {
+	if v.registeredAt.IsZero() {
+		return false, nil
+	}
+
+	now := time.Now()
+	if v.registerLapse > 0 && v.lapsedAt.IsZero() && now.Sub(v.lapseStartedAt) >= v.registerLapse {
+		v.lapsedAt = v.registeredAt.Add(v.registerExpires)
+
+		v.statsLock.Lock()
+		v.stats.Lapses++
+		v.statsLock.Unlock()
+
+		if v.registerUnregister {
+			if err := v.UnRegister(ctx); err != nil {
+				return true, errors.Wrap(err, "unregister")
+			}
+			v.lapsedAt = time.Now()
+		}
+		logger.Tf(ctx, "Let registration lapse, expired at %v, re-appear after %v",
+			v.lapsedAt.Format(time.RFC3339), v.registerReappear)
+	}
+
+	if !v.lapsedAt.IsZero() {
+		if v.registerReappear <= 0 || now.Before(v.lapsedAt.Add(v.registerReappear)) {
+			return true, nil
+		}
+
+		v.lapsedAt, v.lapseStartedAt = time.Time{}, time.Time{}
+		if err := v.Register(ctx); err != nil {
+			return false, errors.Wrap(err, "re-register")
+		}
+		logger.Tf(ctx, "Re-register after lapsed, expires=%v", v.registerExpires)
+		return false, nil
+	}
+
+	if now.Sub(v.registeredAt) >= v.registerExpires/2 {
+		if err := v.Register(ctx); err != nil {
+			return false, errors.Wrap(err, "refresh")
+		}
+		logger.Tf(ctx, "Refresh registration, expires=%v", v.registerExpires)
+	}
+	return false, nil
+}
+
+// Send a keepalive MESSAGE and update the RTT, or skip it by failure injection.
+func (v *GBSession) heartbeat(ctx context.Context) error {
+	v.statsLock.Lock()
+	skip := v.heartbeatSkip > 0 && v.stats.Keepalives >= v.heartbeatSkip
+	if skip {
+		v.stats.KeepalivesSkipped++
+	}
+	v.statsLock.Unlock()
+
+	if skip {
+		return nil
+	}
+
+	starttime := time.Now()
+	req, res, err := v.sip.Message(ctx)
+	if err != nil {
+		return errors.Wrap(err, "keepalive")
+	}
+	rtt := time.Since(starttime)
+
+	v.statsLock.Lock()
+	v.stats.Keepalives++
+	v.stats.KeepaliveRTT, v.stats.keepaliveTotalRTT = rtt, v.stats.keepaliveTotalRTT+rtt
+	if v.stats.KeepaliveMinRTT == 0 || rtt < v.stats.KeepaliveMinRTT {
+		v.stats.KeepaliveMinRTT = rtt
+	}
+	if rtt > v.stats.KeepaliveMaxRTT {
+		v.stats.KeepaliveMaxRTT = rtt
+	}
+	v.statsLock.Unlock()
+
+	if v.onMessageHeartbeat != nil {
+		if err = v.onMessageHeartbeat(req, res); err != nil {
+			return errors.Wrap(err, "callback")
+		}
+	}
+	return nil
+}
+
+// Stats returns the stats of keepalive.
+func (v *GBSession) Stats() GBSessionStats {
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+	return v.stats
+}
+
+func (v *GBSession) Bye(ctx context.Context) error {
+	client := v.sip
+
+	for ctx.Err() == nil {
+		ctx, regCancel := context.WithTimeout(ctx, v.conf.regTimeout)
+		defer regCancel()
+
+		regReq, regRes, err := client.Bye(ctx)
+		if err != nil {
+			return errors.Wrap(err, "bye")
+		}
+		logger.Tf(ctx, "Bye id=%v, response=%v", regReq.MessageID(), regRes.MessageID())
+
+		break
+	}
+
+	return ctx.Err()
+}
+
+func (v *GBSession) UnRegister(ctx context.Context) error {
+	client := v.sip
+
+	for ctx.Err() == nil {
+		ctx, regCancel := context.WithTimeout(ctx, v.conf.regTimeout)
+		defer regCancel()
+
+		regReq, regRes, err := client.UnRegister(ctx)
+		if err != nil {
+			return errors.Wrap(err, "UnRegister")
+		}
+		logger.Tf(ctx, "UnRegister id=%v, response=%v", regReq.MessageID(), regRes.MessageID())
+
+		break
+	}
+
+	return ctx.Err()
+}
+
+type IngesterConfig struct {
+	psConfig    PSConfig
+	ssrc        uint32
+	serverAddr  string
+	clockRate   uint64
+	payloadType uint8
+	// The transport negotiated by SDP, tcp or udp, overwrite by psConfig.transport.
+	transport string
+	// The listener of TCP passive, to accept the connection from server rather than connect to serverAddr.
+	listener *net.TCPListener
+	// The cache of source files shared by ingesters, nil to open files directly.
+	files *FileCache
+	// The duration of playback in stream time, stop when reached, 0 to ignore.
+	playbackDuration time.Duration
+	// The control of playback by INFO, to pause, scale and seek the stream, nil to ignore.
+	control *PlaybackControl
+	// The VKEK of GB35114 from server, the key of SM4 to encrypt PES payload if psConfig.sm4.
+	vkek []byte
+}
+
+type PSIngester struct {
+	conf         *IngesterConfig
+	onSendPacket func(pack *PSPackStream) error
+	cancel       context.CancelFunc
+	// The dts of last PS header(PSM), for header interval.
+	headerDTS uint64
+	hasHeader bool
+	// When to send the PS header, parsed from psConfig.
+	headerMode PSHeaderMode
+	// The video stream type in PSM to overwrite the codec of frame, parsed from psConfig, PS_STREAM_UNKNOW to use the
+	// codec of frame.
+	videoCodec mpeg2.PS_STREAM_TYPE
+	// The frame source of video and audio, open from psConfig if nil.
+	videoSource FrameSource
+	audioSource FrameSource
+	// The media client, for stats.
+	client *PSClient
+	lock   sync.Mutex
+	// The cached keyframe, to response the keyframe request(PLI/FIR) from server.
+	keyframe *Frame
+	// Whether got keyframe request, and send the cached keyframe as next video frame.
+	keyframeRequested bool
+	// The number of video and audio frames consumed, for metrics.
+	videoFrames, audioFrames uint64
+}
+
+func NewPSIngester(c *IngesterConfig) *PSIngester {
+	return &PSIngester{conf: c}
+}
+
+func (v *PSIngester) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	return nil
+}
+
+// Stats returns the stats of media client, or empty if not connected.
+func (v *PSIngester) Stats() PSClientStats {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.client == nil {
+		return PSClientStats{}
+	}
+	return v.client.Stats()
+}
+
+// Frames returns the number of video and audio frames consumed.
+func (v *PSIngester) Frames() (video, audio uint64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.videoFrames, v.audioFrames
+}
+
+func (v *PSIngester) Ingest(ctx context.Context) error {
+	ctx, v.cancel = context.WithCancel(ctx)
+
+	// The SSRC of user overwrites the SDP, which is never registered because the collision is intentional.
+	ssrc := v.conf.ssrc
+	if n := v.conf.psConfig.ssrc; n > math.MaxUint32 {
+		return errors.Errorf("invalid ssrc %v, overflow 32 bits", n)
+	} else if n > 0 {
+		ssrc = uint32(n)
+		logger.Wf(ctx, "PS: Overwrite ssrc=%v of SDP by %v, collision is allowed", v.conf.ssrc, ssrc)
+	} else if err := gSSRCRegistry.Add(ssrc); err != nil {
+		return errors.Wrapf(err, "media=%v", v.conf.serverAddr)
+	} else {
+		defer gSSRCRegistry.Remove(ssrc)
+	}
+
+	framing, err := ParsePSFraming(v.conf.psConfig.framing)
+	if err != nil {
+		return errors.Wrapf(err, "framing")
+	}
+
+	transportName := v.conf.transport
+	if v.conf.psConfig.transport != "" {
+		transportName = v.conf.psConfig.transport
+	}
+	transport, err := ParsePSTransport(transportName)
+	if err != nil {
+		return errors.Wrapf(err, "transport")
+	}
+
+	if v.headerMode, err = ParsePSHeaderMode(v.conf.psConfig.headerMode); err != nil {
+		return errors.Wrapf(err, "header mode")
+	}
+	if v.headerMode == PSHeaderModeInterval && v.conf.psConfig.headerInterval <= 0 {
+		return errors.Errorf("header mode %v requires header interval", v.headerMode)
+	}
+
+	if v.videoCodec, err = ParsePSVideoCodec(v.conf.psConfig.videoCodec); err != nil {
+		return errors.Wrapf(err, "video codec")
+	}
+
+	if n := v.conf.psConfig.pesLength; n < 0 || n > psMaxPesLength {
+		return errors.Errorf("invalid pes length %v, should in [0, %v]", n, psMaxPesLength)
+	}
+	if n := v.conf.psConfig.maxPayload; n < 0 || n > psMaxRTPPayload {
+		return errors.Errorf("invalid rtp payload %v, should in [0, %v]", n, psMaxRTPPayload)
+	}
+
+	if v.conf.psConfig.reconnect > 0 && v.conf.psConfig.reconnectBackoff <= 0 {
+		return errors.Errorf("invalid reconnect backoff %v", v.conf.psConfig.reconnectBackoff)
+	}
+
+	ps := NewPSClient(ssrc, v.conf.serverAddr)
+	ps.transport, ps.framing, ps.rtcpMux = transport, framing, v.conf.psConfig.rtcpMux
+	ps.verifyTimeout, ps.maxPayload = v.conf.psConfig.verifyTimeout, v.conf.psConfig.maxPayload
+	ps.reconnects, ps.reconnectBackoff = v.conf.psConfig.reconnect, v.conf.psConfig.reconnectBackoff
+	ps.reconnectRestart = v.conf.psConfig.reconnectRestart
+	if v.conf.listener != nil && transport == PSTransportTCP {
+		ps.listener = v.conf.listener
+	}
+	if v.conf.psConfig.tee != "" {
+		f, err := os.OpenFile(v.conf.psConfig.tee, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "open tee %v", v.conf.psConfig.tee)
+		}
+		defer f.Close()
+
+		ps.tee = f
+	}
+	if err := ps.Connect(ctx); err != nil {
+		return errors.Wrapf(err, "connect media=%v", v.conf.serverAddr)
+	}
+	defer ps.Close()
+
+	v.lock.Lock()
+	v.client = ps
+	v.lock.Unlock()
+
+	ps.onKeyframeRequest = func() {
+		v.lock.Lock()
+		v.keyframeRequested = true
+		v.lock.Unlock()
+		logger.Tf(ctx, "PS: Got keyframe request, ssrc=%v", v.conf.ssrc)
+	}
+
+	if v.conf.psConfig.rtcpAddr != "" {
+		if err := ps.ListenRTCP(ctx, v.conf.psConfig.rtcpAddr); err != nil {
+			return errors.Wrapf(err, "rtcp")
+		}
+	}
+
+	// The media overwrites the sources, for example, the audio only device ignores the video source.
+	wantVideo, wantAudio := true, true
+	if v.conf.psConfig.media != "" {
+		media, err := ParsePSProfile(v.conf.psConfig.media)
+		if err != nil {
+			return errors.Wrapf(err, "media")
+		}
+		wantVideo, wantAudio = media.HasVideo(), media.HasAudio()
+	}
+
+	video, audio := v.videoSource, v.audioSource
+	if !wantVideo {
+		video = nil
+	}
+	if !wantAudio {
+		audio = nil
+	}
+
+	// Never open the container as ANNEXB stream, even if no video in it.
+	hevc, container := utilIsHEVCFile(v.conf.psConfig.video), utilIsContainerFile(v.conf.psConfig.video)
+	if video == nil && container {
+		f, err := v.conf.files.Open(v.conf.psConfig.video)
+		if err != nil {
+			return errors.Wrapf(err, "Open file %v", v.conf.psConfig.video)
+		}
+
+		fileVideo, fileAudio, err := NewDemuxFrameSources(f, v.conf.psConfig.video, v.conf.clockRate)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Open %v", v.conf.psConfig.video)
+		}
+
+		// Use the audio in file only if no audio file, so the -sa overwrites it.
+		if fileVideo != nil && wantVideo {
+			video, hevc = fileVideo, fileVideo.codec == FrameCodecH265
+		}
+		if fileAudio != nil && wantAudio && audio == nil && v.conf.psConfig.audio == "" {
+			audio = fileAudio
+		}
+		logger.Tf(ctx, "PS: Demux %v, video=%v, audio=%v, hevc=%v", v.conf.psConfig.video, fileVideo != nil,
+			fileAudio != nil, hevc)
+	}
+
+	if video == nil && wantVideo && !container && strings.Contains(v.conf.psConfig.video, "%") {
+		num, den, err := v.frameRate()
+		if err != nil {
+			return errors.Wrapf(err, "rate")
+		}
+
+		numbered, err := NewNumberedFrameSource(v.conf.psConfig.video, v.conf.psConfig.fps, v.conf.clockRate,
+			v.conf.psConfig.gap == "skip")
+		if err != nil {
+			return errors.Wrapf(err, "Open %v", v.conf.psConfig.video)
+		}
+		numbered.SetFrameRate(num, den)
+		video = numbered
+	}
+
+	if video == nil && wantVideo && !container && v.conf.psConfig.video != "" {
+		videoFile, err := v.conf.files.Open(v.conf.psConfig.video)
+		if err != nil {
+			return errors.Wrapf(err, "Open file %v", v.conf.psConfig.video)
+		}
+		defer videoFile.Close()
+
+		num, den, err := v.frameRate()
+		if err != nil {
+			return errors.Wrapf(err, "rate")
+		}
+
+		if hevc {
+			var h265 *H265FrameSource
+			if h265, err = NewH265FrameSource(ctx, videoFile, v.conf.psConfig.fps, v.conf.clockRate); err == nil {
+				h265.SetFrameRate(num, den)
+				video = h265
+			}
+		} else {
+			var h264 *H264FrameSource
+			if h264, err = NewH264FrameSource(ctx, videoFile, v.conf.psConfig.fps, v.conf.clockRate); err == nil {
+				h264.SetFrameRate(num, den)
+				video = h264
+			}
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Open %v", v.conf.psConfig.video)
+		}
+	}
+
+	if video != nil && v.conf.psConfig.timecodes != "" {
+		f, err := v.conf.files.Open(v.conf.psConfig.timecodes)
+		if err != nil {
+			return errors.Wrapf(err, "Open file %v", v.conf.psConfig.timecodes)
+		}
+		defer f.Close()
+
+		durations, err := utilParseTimecodes(f, v.conf.clockRate)
+		if err != nil {
+			return errors.Wrapf(err, "parse timecodes %v", v.conf.psConfig.timecodes)
+		}
+		if video, err = NewVFRFrameSource(video, durations); err != nil {
+			return errors.Wrapf(err, "vfr")
+		}
+		logger.Tf(ctx, "PS: Variable frame rate by %v, frames=%v", v.conf.psConfig.timecodes, len(durations))
+	}
+
+	if video != nil && v.conf.psConfig.timestamps != "" {
+		if v.conf.psConfig.timecodes != "" {
+			return errors.Errorf("timestamps %v conflicts with timecodes %v", v.conf.psConfig.timestamps,
+				v.conf.psConfig.timecodes)
+		}
+
+		f, err := v.conf.files.Open(v.conf.psConfig.timestamps)
+		if err != nil {
+			return errors.Wrapf(err, "Open file %v", v.conf.psConfig.timestamps)
+		}
+		defer f.Close()
+
+		timestamps, err := utilParseTimestamps(f, v.conf.clockRate)
+		if err != nil {
+			return errors.Wrapf(err, "parse timestamps %v", v.conf.psConfig.timestamps)
+		}
+		if video, err = NewTimestampFrameSource(video, timestamps); err != nil {
+			return errors.Wrapf(err, "timestamps")
+		}
+		logger.Tf(ctx, "PS: Video timestamps by %v, frames=%v", v.conf.psConfig.timestamps, len(timestamps))
+	}
+
+	if audio == nil && wantAudio && v.conf.psConfig.audio != "" {
+		_, audioCodec, err := ParsePSAudioCodec(v.conf.psConfig.audioCodec)
+		if err != nil {
+			return errors.Wrapf(err, "audio codec")
+		}
+
+		f, err := v.conf.files.Open(v.conf.psConfig.audio)
+		if err != nil {
+			return errors.Wrapf(err, "Open file %v", v.conf.psConfig.audio)
+		}
+		defer f.Close()
+
+		if audioCodec != FrameCodecAAC {
+			g711, err := NewG711FrameSource(f, audioCodec, v.conf.clockRate)
+			if err != nil {
+				return errors.Wrapf(err, "Open g711 %v", v.conf.psConfig.audio)
+			}
+			logger.Tf(ctx, "PS: Audio %v, codec=%v, rate=%v", v.conf.psConfig.audio, audioCodec, g711.SampleRate())
+			audio = g711
+		} else {
+			aac, err := NewAACFrameSource(f, v.conf.clockRate)
+			if err != nil {
+				return errors.Wrapf(err, "Open aac %v", v.conf.psConfig.audio)
 			}
+			logger.Tf(ctx, "PS: Audio %v, profile=%v, rate=%v, channels=%v", v.conf.psConfig.audio,
+				aac.AudioConfig().Object.ToProfile(), aac.SampleRate(), aac.Channels())
+			audio = aac
 		}
-
-		break
 	}
 
-	// Start goroutine for heartbeat every 1s.
-	v.heartbeatCtx, v.cancel = context.WithCancel(ctx)
-	go func(ctx context.Context) {
-		v.wg.Add(1)
-		defer v.wg.Done()
+	logger.Tf(ctx, "PS: Media stream, tbn=%v, ssrc=%v, pt=%v, Video(%v, fps=%v), Audio(%v)",
+		v.conf.clockRate, v.conf.ssrc, v.conf.payloadType, v.conf.psConfig.video, v.conf.psConfig.fps,
+		v.conf.psConfig.audio)
 
-		for ctx.Err() == nil {
-			req, res, err := client.Message(ctx)
-			if err != nil {
-				v.cancel()
-				logger.Ef(ctx, "heartbeat err %+v", err)
-				return
-			}
+	if video == nil && audio == nil {
+		return errors.New("no video or audio source")
+	}
+	if v.conf.psConfig.media != "" && (wantVideo && video == nil || wantAudio && audio == nil) {
+		return errors.Errorf("no source for media %v, video=%v, audio=%v", v.conf.psConfig.media,
+			v.conf.psConfig.video, v.conf.psConfig.audio)
+	}
 
-			if v.onMessageHeartbeat != nil {
-				if err = v.onMessageHeartbeat(req, res); err != nil {
-					v.cancel()
-					logger.Ef(ctx, "callback err %+v", err)
-					return
-				}
-			}
+	return v.ingest(ctx, ps, video, audio, hevc)
+}
 
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(v.heartbeatInterval):
-			}
-		}
-	}(v.heartbeatCtx)
+// The frame rate in num/den, from rate or fps.
+func (v *PSIngester) frameRate() (num, den uint64, err error) {
+	if v.conf.psConfig.fpsRate != "" {
+		return utilParseFrameRate(v.conf.psConfig.fpsRate)
+	}
+	return uint64(v.conf.psConfig.fps), 1, nil
+}
 
-	return ctx.Err()
+// Scale the media duration to wall clock by the speed multiplier, for example, 2x speed halves the duration. The scale
+// of playback control also multiplies the speed.
+func (v *PSIngester) scale(d time.Duration) time.Duration {
+	speed := v.conf.psConfig.speed
+	if v.conf.control != nil {
+		speed *= v.conf.control.Scale()
+	}
+	if speed > 0 {
+		return time.Duration(float64(d) / speed)
+	}
+	return d
 }
 
-func (v *GBSession) Bye(ctx context.Context) error {
-	client := v.sip
+// The send loop, pull frames from video and audio source, mux to PS and send over RTP.
+func (v *PSIngester) ingest(ctx context.Context, ps *PSClient, video, audio FrameSource, hevc bool) (err error) {
+	lastPrint := time.Now()
+	var videoFrames, audioFrames uint64
+	var audioDTS, videoDTS uint64
+	// The duration of current video frame, 0 for fixed fps.
+	var videoDuration uint64
+	defer func() {
+		stats := ps.Stats()
+		logger.Tf(ctx, "Consume Video(frames=%v, dts=%v, ts=%.2f) and Audio(frames=%v, dts=%v, ts=%.2f), %v",
+			videoFrames, videoDTS, float64(videoDTS)/90.0, audioFrames, audioDTS, float64(audioDTS)/90.0, stats.String(),
+		)
+	}()
 
-	for ctx.Err() == nil {
-		ctx, regCancel := context.WithTimeout(ctx, v.conf.regTimeout)
-		defer regCancel()
+	// Change the SSRC without re-INVITE, the new SSRC is reserved until changed again or end.
+	ssrcChangedAt := time.Now()
+	var changedSSRC uint32
+	defer func() {
+		if changedSSRC == 0 {
+			return
+		}
+		gSSRCRegistry.Remove(changedSSRC)
 
-		regReq, regRes, err := client.Bye(ctx)
-		if err != nil {
-			return errors.Wrap(err, "bye")
+		// How the server reacts, the RR for new SSRC means accepted, the stale RR means the old stream is kept, and
+		// the error means rejected.
+		stats := ps.Stats()
+		logger.Tf(ctx, "PS: SSRC changed %v times, rr=%v, stale-rr=%v, err %v", stats.SSRCChanges,
+			stats.ReceiverReports, stats.StaleReports, err)
+	}()
+
+	var tracer *psFrameTracer
+	if v.conf.psConfig.trace != "" {
+		if tracer, err = newPSFrameTracer(v.conf.psConfig.trace, hevc); err != nil {
+			return errors.Wrapf(err, "trace")
 		}
-		logger.Tf(ctx, "Bye id=%v, response=%v", regReq.MessageID(), regRes.MessageID())
+		defer tracer.Close()
+	}
 
-		break
+	var randomPes *rand.Rand
+	if v.conf.psConfig.fragmentMin > 0 {
+		seed := v.conf.psConfig.fragmentSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		randomPes = rand.New(rand.NewSource(seed))
+		logger.Tf(ctx, "PS: Random video PES fragment, min=%v, seed=%v", v.conf.psConfig.fragmentMin, seed)
 	}
 
-	return ctx.Err()
-}
+	// The declared streams depends on which source is available.
+	profile := PSProfileAudioVideo
+	if video == nil {
+		profile = PSProfileAudioOnly
+	} else if audio == nil {
+		profile = PSProfileVideoOnly
+	}
 
-func (v *GBSession) UnRegister(ctx context.Context) error {
-	client := v.sip
+	// Declare the audio config, to make sure all frames match it.
+	var audioConfig *aac.AudioSpecificConfig
+	audioCodec, audioRate := mpeg2.PS_STREAM_AAC, 0
+	if source, ok := audio.(*AACFrameSource); ok {
+		asc := source.AudioConfig()
+		audioConfig, audioRate = &asc, source.SampleRate()
+	} else if source, ok := audio.(*DemuxFrameSource); ok {
+		audioConfig, audioRate = source.AudioConfig(), source.SampleRate()
+	} else if source, ok := audio.(*G711FrameSource); ok {
+		audioCodec, audioRate = mpeg2.PS_STREAM_G711A, source.SampleRate()
+		if source.codec == FrameCodecPCMU {
+			audioCodec = mpeg2.PS_STREAM_G711U
+		}
+	}
 
-	for ctx.Err() == nil {
-		ctx, regCancel := context.WithTimeout(ctx, v.conf.regTimeout)
-		defer regCancel()
+	// Loop the sources after the audio config is declared, to keep the timestamps increasing for long test.
+	var loops []*LoopFrameSource
+	if v.conf.psConfig.loop {
+		loops = NewLoopFrameSources(video, audio)
+		if loops[0] != nil {
+			video = loops[0]
+		}
+		if loops[1] != nil {
+			audio = loops[1]
+		}
+	}
 
-		regReq, regRes, err := client.UnRegister(ctx)
+	// Drift the audio after loop, so that the drift accumulates across the replays.
+	if conf := &v.conf.psConfig; conf.drift != "" && audio != nil {
+		ppm, err := utilParseDrift(conf.drift)
 		if err != nil {
-			return errors.Wrap(err, "UnRegister")
+			return errors.Wrapf(err, "drift")
 		}
-		logger.Tf(ctx, "UnRegister id=%v, response=%v", regReq.MessageID(), regRes.MessageID())
-
-		break
+		audio = NewDriftFrameSource(audio, ppm)
+		logger.Tf(ctx, "PS: Drift audio by %v, %.2fppm, %.2fms/min", conf.drift, ppm, ppm*60000/1000000)
 	}
 
-	return ctx.Err()
-}
+	// Seek the sources by playback control, after loop to seek in the replays.
+	var seekVideo, seekAudio *SeekFrameSource
+	control := v.conf.control
+	if control != nil {
+		if video != nil {
+			seekVideo = NewSeekFrameSource(video)
+			video = seekVideo
+		}
+		if audio != nil {
+			seekAudio = NewSeekFrameSource(audio)
+			audio = seekAudio
+		}
+	}
 
-type IngesterConfig struct {
-	psConfig    PSConfig
-	ssrc        uint32
-	serverAddr  string
-	clockRate   uint64
-	payloadType uint8
-}
+	// The RTP clock rate is 90kHz for video, and sample rate for audio if in different payload type.
+	audioPT := v.conf.payloadType
+	ps.SetClockRate(v.conf.payloadType, v.conf.clockRate)
+	if v.conf.psConfig.audioPT > 0 {
+		audioPT = uint8(v.conf.psConfig.audioPT)
+		if audioRate > 0 {
+			ps.SetClockRate(audioPT, uint64(audioRate))
+		}
+	}
+	if v.conf.psConfig.clockRates != "" {
+		rates, err := utilParseClockRates(v.conf.psConfig.clockRates)
+		if err != nil {
+			return errors.Wrapf(err, "clock rates")
+		}
+		for pt, rate := range rates {
+			ps.SetClockRate(pt, rate)
+		}
+	}
 
-type PSIngester struct {
-	conf         *IngesterConfig
-	onSendPacket func(pack *PSPackStream) error
-	cancel       context.CancelFunc
-}
+	var encryption cipher.Block
+	if v.conf.psConfig.sm4 {
+		if encryption, err = newSM4Cipher(v.conf.vkek); err != nil {
+			return errors.Wrap(err, "sm4")
+		}
+		logger.Tf(ctx, "PS: Encrypt PES payload by SM4-CTR, vkek=%v bytes", len(v.conf.vkek))
+	}
 
-func NewPSIngester(c *IngesterConfig) *PSIngester {
-	return &PSIngester{conf: c}
-}
+	var fault *FaultInjector
+	if conf := &v.conf.psConfig; conf.fault != "" {
+		rules, err := ParseFaultRules(conf.fault)
+		if err != nil {
+			return errors.Wrapf(err, "fault")
+		}
 
-func (v *PSIngester) Close() error {
-	if v.cancel != nil {
-		v.cancel()
+		seed := conf.faultSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		fault = NewFaultInjector(rules, seed, hevc)
+		logger.Wf(ctx, "PS: Fault injection %v, seed=%v, the stream is non-conformant", rules, seed)
+		defer func() {
+			logger.Tf(ctx, "PS: Fault injection %v", fault.String())
+		}()
 	}
-	return nil
-}
 
-func (v *PSIngester) Ingest(ctx context.Context) error {
-	ctx, v.cancel = context.WithCancel(ctx)
+	if conf := &v.conf.psConfig; conf.psFault != "" {
+		rules, err := ParsePSFaultRules(conf.psFault)
+		if err != nil {
+			return errors.Wrapf(err, "ps fault")
+		}
 
-	ps := NewPSClient(uint32(v.conf.ssrc), v.conf.serverAddr)
-	if err := ps.Connect(ctx); err != nil {
-		return errors.Wrapf(err, "connect media=%v", v.conf.serverAddr)
+		seed := conf.faultSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		psFault := NewPSFaultInjector(rules, seed)
+		ps.SetPSFaultInjector(psFault)
+		logger.Wf(ctx, "PS: PS fault injection %v, seed=%v, the stream is non-conformant", rules, seed)
+		defer func() {
+			logger.Tf(ctx, "PS: PS fault injection %v", psFault.String())
+		}()
 	}
-	defer ps.Close()
 
-	videoFile, err := os.Open(v.conf.psConfig.video)
-	if err != nil {
-		return errors.Wrapf(err, "Open file %v", v.conf.psConfig.video)
-	}
-	defer videoFile.Close()
+	if conf := &v.conf.psConfig; conf.rtpFault != "" {
+		rules, err := ParseRTPFaultRules(conf.rtpFault)
+		if err != nil {
+			return errors.Wrapf(err, "rtp fault")
+		}
 
-	f, err := os.Open(v.conf.psConfig.audio)
-	if err != nil {
-		return errors.Wrapf(err, "Open file %v", v.conf.psConfig.audio)
+		seed := conf.faultSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		rtpFault := NewRTPFaultInjector(rules, seed)
+		ps.SetRTPFaultInjector(rtpFault)
+		logger.Wf(ctx, "PS: RTP fault injection %v, seed=%v, the stream is non-conformant", rules, seed)
+		defer func() {
+			logger.Tf(ctx, "PS: RTP fault injection %v", rtpFault.String())
+		}()
 	}
-	defer f.Close()
 
-	fileSuffix := path.Ext(v.conf.psConfig.video)
-	var h264 *h264reader.H264Reader
-	var h265 *H265Reader
-	if fileSuffix == ".h265" {
-		h265, err = NewReader(videoFile)
-	} else {
-		h264, err = h264reader.NewReader(videoFile)
-	}
-	if err != nil {
-		return errors.Wrapf(err, "Open %v", v.conf.psConfig.video)
+	var shaper *bitrateShaper
+	if conf := &v.conf.psConfig; conf.bitrateProfile != "" {
+		profile, err := NewBitrateProfile(conf.bitrateProfile, conf.bitrateMin*1000, conf.bitrateMax*1000, conf.bitratePeriod)
+		if err != nil {
+			return errors.Wrapf(err, "bitrate")
+		}
+		shaper = newBitrateShaper(profile, time.Now())
+		logger.Tf(ctx, "PS: Bitrate profile %v, %v-%vkbps, period=%v", conf.bitrateProfile, conf.bitrateMin,
+			conf.bitrateMax, conf.bitratePeriod)
 	}
 
-	audio, err := NewAACReader(f)
-	if err != nil {
-		return errors.Wrapf(err, "Open ogg %v", v.conf.psConfig.audio)
+	// The deadline to deliver all packets of a frame is the send time of next frame, for micro-pacing.
+	var frameInterval time.Duration
+	if v.conf.psConfig.packetGap > 0 || ps.transport == PSTransportUDP {
+		num, den, err := v.frameRate()
+		if err != nil {
+			return errors.Wrapf(err, "rate")
+		}
+		if num > 0 {
+			frameInterval = time.Duration(uint64(time.Second) * den / num)
+		}
+		logger.Tf(ctx, "PS: Packet gap %v, frame interval %v, transport %v", v.conf.psConfig.packetGap, frameInterval,
+			ps.transport)
 	}
 
-	// Scale the video samples to 1024 according to AAC, that is 1 video frame means 1024 samples.
-	audioSampleRate := audio.codec.ASC().SampleRate.ToHz()
-	videoSampleRate := 1024 * 1000 / v.conf.psConfig.fps
-	logger.Tf(ctx, "PS: Media stream, tbn=%v, ssrc=%v, pt=%v, Video(%v, fps=%v, rate=%v), Audio(%v, rate=%v, channels=%v)",
-		v.conf.clockRate, v.conf.ssrc, v.conf.payloadType, v.conf.psConfig.video, v.conf.psConfig.fps, videoSampleRate,
-		v.conf.psConfig.audio, audioSampleRate, audio.codec.ASC().Channels)
-
-	lastPrint := time.Now()
-	var aacSamples, avcSamples uint64
-	var audioDTS, videoDTS uint64
-	defer func() {
-		logger.Tf(ctx, "Consume Video(samples=%v, dts=%v, ts=%.2f) and Audio(samples=%v, dts=%v, ts=%.2f)",
-			avcSamples, videoDTS, float64(videoDTS)/90.0, aacSamples, audioDTS, float64(audioDTS)/90.0,
-		)
-	}()
-
 	clock := newWallClock()
+	var controlVersion uint64
+	var sentFrames, droppedFrames uint64
+	var videoFrame *Frame
 	var pack *PSPackStream
 	for ctx.Err() == nil {
+		// Pause, stop, scale or seek by playback control before each pack, then rebase the clock for the change.
+		if control != nil && pack == nil {
+			version, err := control.Wait(ctx)
+			if err != nil {
+				continue
+			}
+
+			paceDTS := audioDTS
+			if audio == nil || videoDTS > audioDTS {
+				paceDTS = videoDTS
+			}
+			if control.Teardown() {
+				logger.Tf(ctx, "PS: Stop by TEARDOWN")
+				return v.writeEndOfStream(ps, profile, paceDTS)
+			}
+
+			if version != controlVersion {
+				controlVersion = version
+				if seek, ok := control.TakeSeek(); ok {
+					dts, err := v.seek(ctx, seekVideo, seekAudio, uint64(seek/time.Millisecond)*v.conf.clockRate/1000)
+					if errors.Cause(err) == io.EOF {
+						if r0 := v.writeEndOfStream(ps, profile, paceDTS); r0 != nil {
+							return errors.Wrap(r0, "end of stream")
+						}
+					}
+					if err != nil {
+						return errors.Wrapf(err, "seek %v", seek)
+					}
+					videoDTS, audioDTS, paceDTS = dts, dts, dts
+				}
+				clock.Rebase(v.scale(time.Duration(paceDTS * uint64(time.Second) / v.conf.clockRate)))
+				logger.Tf(ctx, "PS: Playback control, dts=%v, scale=%v", paceDTS, control.Scale())
+			}
+		}
+
 		if pack == nil {
-			pack = NewPSPackStream(v.conf.payloadType)
+			pack = NewPSPackStreamWithProfile(v.conf.payloadType, profile)
+			if v.conf.psConfig.pesLength > 0 {
+				pack.SetPesLength(v.conf.psConfig.pesLength)
+			}
+			if randomPes != nil {
+				pack.SetRandomPesLength(v.conf.psConfig.fragmentMin, randomPes)
+			}
+			if tracer != nil {
+				pack.onWriteFrame = tracer.OnWriteFrame
+			}
+			if v.conf.psConfig.sei {
+				pack.SetSEI(seiTimestampUUID, utilBuildSEITimestamp(time.Now()))
+			}
+			if audioConfig != nil {
+				pack.SetAudioConfig(audioConfig)
+			}
+			pack.SetAudioPayloadType(audioPT)
+			pack.SetAudioCodec(audioCodec)
+			if fault != nil {
+				pack.SetFaultInjector(fault)
+			}
+			if encryption != nil {
+				pack.SetEncryption(encryption)
+			}
 		}
 
 		// One pack should only contains one video frame.
-		if !pack.hasVideo {
-			if fileSuffix == ".h265" {
-				err = v.writeH265(ctx, pack, h265, videoSampleRate, &avcSamples, &videoDTS)
-			} else {
-				err = v.writeH264(ctx, pack, h264, videoSampleRate, &avcSamples, &videoDTS)
+		if video != nil && !pack.hasVideo {
+			frame, err := video.Next()
+			if err == io.EOF {
+				if r0 := v.writeEndOfStream(ps, profile, videoDTS); r0 != nil {
+					return errors.Wrap(r0, "end of stream")
+				}
 			}
 			if err != nil {
+				return errors.Wrap(err, "Read video")
+			}
+
+			videoFrames++
+			videoDuration = frame.Duration
+			v.lock.Lock()
+			v.videoFrames = videoFrames
+			v.lock.Unlock()
+			videoDTS = frame.DTS
+			frame = v.requestKeyframe(ctx, frame)
+			videoFrame = frame
+			if err = v.writeVideoFrame(pack, frame); err != nil {
 				return errors.Wrap(err, "WriteVideo")
 			}
 		}
 
 		// Always read and consume one audio frame each time.
-		if true {
-			audioFrame, err := audio.NextADTSFrame()
+		if audio != nil {
+			frame, err := audio.Next()
+			if err == io.EOF {
+				if r0 := v.writeEndOfStream(ps, profile, audioDTS); r0 != nil {
+					return errors.Wrap(r0, "end of stream")
+				}
+			}
 			if err != nil {
-				return errors.Wrap(err, "Read AAC")
+				return errors.Wrap(err, "Read audio")
+			}
+
+			// For audio only, each audio frame is a pack, and the first pack has the PSM.
+			if video == nil {
+				if err := v.writeHeader(pack, mpeg2.PS_STREAM_UNKNOW, !v.hasHeader, frame.DTS); err != nil {
+					return errors.Wrap(err, "pack header")
+				}
 			}
 
-			// Each AAC frame contains 1024 samples, DTS = total-samples / sample-rate
-			aacSamples += 1024
-			audioDTS = uint64(v.conf.clockRate*aacSamples) / uint64(audioSampleRate)
-			if time.Now().Sub(lastPrint) > 3*time.Second {
-				lastPrint = time.Now()
-				logger.Tf(ctx, "Consume Video(samples=%v, dts=%v, ts=%.2f) and Audio(samples=%v, dts=%v, ts=%.2f)",
-					avcSamples, videoDTS, float64(videoDTS)/90.0, aacSamples, audioDTS, float64(audioDTS)/90.0,
-				)
+			audioFrames++
+			v.lock.Lock()
+			v.audioFrames = audioFrames
+			v.lock.Unlock()
+			audioDTS = frame.DTS
+			for _, payload := range frame.Payloads {
+				if err = pack.WriteAudio(payload, frame.DTS); err != nil {
+					return errors.Wrapf(err, "write audio %v", len(payload))
+				}
 			}
+		}
 
-			if err = pack.WriteAudio(audioFrame, audioDTS); err != nil {
-				return errors.Wrapf(err, "write audio %v", len(audioFrame))
+		if time.Now().Sub(lastPrint) > 3*time.Second {
+			lastPrint = time.Now()
+			if v.conf.psConfig.rtcpMux {
+				if err := ps.WriteSenderReport(lastPrint, uint32(videoDTS)); err != nil {
+					return errors.Wrap(err, "write sr")
+				}
+			}
+			stats := ps.Stats()
+			logger.Tf(ctx, "Consume Video(frames=%v, dts=%v, ts=%.2f) and Audio(frames=%v, dts=%v, ts=%.2f), %v",
+				videoFrames, videoDTS, float64(videoDTS)/90.0, audioFrames, audioDTS, float64(audioDTS)/90.0, stats.String(),
+			)
+			if shaper != nil {
+				logger.Tf(ctx, "Bitrate target=%vkbps, dropped=%v", shaper.Tick(lastPrint)/1000, droppedFrames)
+			}
+			for i, loop := range loops {
+				if loop != nil {
+					logger.Tf(ctx, "Loop %v, loops=%v, frames=%v", []string{"video", "audio"}[i], loop.Loops(), len(loop.frames))
+				}
 			}
 		}
 
-		// Send pack when got video and enough audio frames.
-		if pack.hasVideo && videoDTS < audioDTS {
-			if err := ps.WritePacksOverRTP(pack.packets); err != nil {
+		// Send pack when got video and enough audio frames, or any frame for audio or video only.
+		if (video == nil || pack.hasVideo) && (audio == nil || video == nil || videoDTS < audioDTS) {
+			// Drop the video frame if exceeds the target bitrate, IDR frames always pass.
+			if shaper != nil {
+				shaper.Tick(time.Now())
+				if videoFrame != nil && shaper.Drop(videoFrame, pack.Size()) {
+					pack.DropVideo()
+					droppedFrames++
+				}
+			}
+
+			sent := ps.Stats().Bytes
+			interval := frameInterval
+			if videoDuration > 0 {
+				interval = time.Duration(videoDuration * uint64(time.Second) / v.conf.clockRate)
+			}
+			interval = v.scale(interval)
+			if gap := v.conf.psConfig.packetGap; gap > 0 {
+				if err := ps.WritePacksOverRTPPaced(pack.packets, gap, time.Now().Add(interval)); err != nil {
+					return errors.Wrap(err, "write")
+				}
+			} else if ps.transport == PSTransportUDP && interval > 0 {
+				// For UDP, spread the packets of frame in half of the frame interval, to avoid bursting the GOP.
+				if err := ps.WritePacksOverRTPPaced(pack.packets, interval, time.Now().Add(interval/2)); err != nil {
+					return errors.Wrap(err, "write")
+				}
+			} else if err := ps.WritePacksOverRTP(pack.packets); err != nil {
 				return errors.Wrap(err, "write")
 			}
+
+			// Pad the unused budget to follow the target bitrate.
+			if shaper != nil {
+				shaper.Consume(int(ps.Stats().Bytes - sent))
+				for shaper.Padding(255) == 255 {
+					sent = ps.Stats().Bytes
+					if err := ps.WritePadding(255); err != nil {
+						return errors.Wrap(err, "padding")
+					}
+					shaper.Consume(int(ps.Stats().Bytes - sent))
+				}
+			}
 			if v.onSendPacket != nil {
 				if err := v.onSendPacket(pack); err != nil {
 					return errors.Wrap(err, "callback")
 				}
 			}
 			pack = nil // Reset pack.
+
+			if d := v.conf.psConfig.ssrcChange; d > 0 && time.Since(ssrcChangedAt) >= d {
+				next, err := gSSRCRegistry.Generate()
+				if err != nil {
+					return errors.Wrap(err, "change ssrc")
+				}
+				if changedSSRC != 0 {
+					gSSRCRegistry.Remove(changedSSRC)
+				}
+
+				stats := ps.Stats()
+				logger.Wf(ctx, "PS: Change ssrc from %v to %v without re-INVITE, %v", ps.SSRC(), next, stats.String())
+				changedSSRC, ssrcChangedAt = next, time.Now()
+				ps.SetSSRC(next)
+			}
+
+			sentFrames++
+			paceDTS := audioDTS
+			if audio == nil || videoDTS > audioDTS {
+				paceDTS = videoDTS
+			}
+			if reason := v.shouldStop(clock.start, sentFrames, paceDTS, ps); reason != "" {
+				logger.Tf(ctx, "PS: Stop by %v", reason)
+				return v.writeEndOfStream(ps, profile, paceDTS)
+			}
 		}
 
-		// One audio frame(1024 samples), the duration is 1024/audioSampleRate in seconds.
-		sampleDuration := time.Duration(uint64(time.Second) * 1024 / uint64(audioSampleRate))
-		if d := clock.Tick(sampleDuration); d > 0 {
+		// Pace by the audio DTS, each audio frame(1024 samples) is 1024/audioSampleRate in seconds.
+		paceDTS := audioDTS
+		if audio == nil {
+			paceDTS = videoDTS
+		}
+		if d := clock.TickTo(v.scale(time.Duration(paceDTS * uint64(time.Second) / v.conf.clockRate))); d > 0 {
 			time.Sleep(d)
 		}
 	}
@@ -392,100 +2050,216 @@ func (v *PSIngester) Ingest(ctx context.Context) error {
 	return nil
 }
 
-func (v *PSIngester) writeH264(ctx context.Context, pack *PSPackStream, h264 *h264reader.H264Reader,
-	videoSampleRate int, avcSamples, videoDTS *uint64) error {
-	var sps, pps *h264reader.NAL
-	var videoFrames []*h264reader.NAL
-	for ctx.Err() == nil {
-		frame, err := h264.NextNAL()
-		if err == io.EOF {
-			return io.EOF
+// Seek the video to the keyframe at or after dts, then the audio to the video, because the decoding starts from the
+// keyframe. Return the DTS of next frame, or io.EOF if no more frames. Ignore if seek backward.
+func (v *PSIngester) seek(ctx context.Context, video, audio *SeekFrameSource, dts uint64) (uint64, error) {
+	to := dts
+	if video != nil {
+		if video.dts > dts {
+			logger.Wf(ctx, "PS: Ignore seek backward to %v, current %v", dts, video.dts)
+			return video.dts, nil
 		}
-		if err != nil {
-			return errors.Wrapf(err, "Read h264")
+
+		var err error
+		if to, err = video.Seek(dts, true); err != nil {
+			return 0, errors.Wrap(err, "seek video")
 		}
+	}
 
-		videoFrames = append(videoFrames, frame)
-		logger.If(ctx, "NALU %v PictureOrderCount=%v, ForbiddenZeroBit=%v, RefIdc=%v, %v bytes",
-			frame.UnitType.String(), frame.PictureOrderCount, frame.ForbiddenZeroBit, frame.RefIdc, len(frame.Data))
+	if audio != nil {
+		if audio.dts > to {
+			logger.Wf(ctx, "PS: Ignore seek backward to %v, current %v", to, audio.dts)
+			return audio.dts, nil
+		}
 
-		if frame.UnitType == h264reader.NalUnitTypeSPS {
-			sps = frame
-		} else if frame.UnitType == h264reader.NalUnitTypePPS {
-			pps = frame
-		} else {
-			break
+		n, err := audio.Seek(to, false)
+		if err != nil {
+			return 0, errors.Wrap(err, "seek audio")
+		}
+		if video == nil {
+			to = n
 		}
 	}
 
-	// We convert the video sample rate to be based over 1024, that is 1024 samples means one video frame.
-	*avcSamples += 1024
-	*videoDTS = uint64(v.conf.clockRate*(*avcSamples)) / uint64(videoSampleRate)
+	logger.Tf(ctx, "PS: Seek to %v, next dts=%v", dts, to)
+	return to, nil
+}
 
-	var err error
-	if sps != nil || pps != nil {
-		err = pack.WriteHeader(mpeg2.PS_STREAM_H264, *videoDTS)
-	} else {
-		err = pack.WritePackHeader(*videoDTS)
+// Write the MPEG program end code as the last packet, for receivers to finalize the stream.
+func (v *PSIngester) writeEndOfStream(ps *PSClient, profile PSProfile, dts uint64) error {
+	pack := NewPSPackStreamWithProfile(v.conf.payloadType, profile)
+	if err := pack.WriteEndOfStream(dts); err != nil {
+		return errors.Wrap(err, "write end code")
 	}
-	if err != nil {
-		return errors.Wrap(err, "pack header")
+
+	if err := ps.WritePacksOverRTP(pack.packets); err != nil {
+		return errors.Wrap(err, "write")
 	}
 
-	for _, frame := range videoFrames {
-		if err = pack.WriteVideo(frame.Data, *videoDTS); err != nil {
-			return errors.Wrapf(err, "write video %v", len(frame.Data))
+	if v.onSendPacket != nil {
+		if err := v.onSendPacket(pack); err != nil {
+			return errors.Wrap(err, "callback")
 		}
 	}
 	return nil
 }
 
-func (v *PSIngester) writeH265(ctx context.Context, pack *PSPackStream, h265 *H265Reader,
-	videoSampleRate int, avcSamples, videoDTS *uint64) error {
-	var vps, sps, pps *NAL
-	var videoFrames []*NAL
-	for ctx.Err() == nil {
-		frame, err := h265.NextNAL()
-		if err == io.EOF {
-			return io.EOF
+// Check the stop conditions, return the reason if should stop, or empty string to continue.
+func (v *PSIngester) shouldStop(start time.Time, sentFrames, dts uint64, ps *PSClient) string {
+	if d := v.conf.playbackDuration; d > 0 {
+		if t := time.Duration(dts * uint64(time.Second) / v.conf.clockRate); t >= d {
+			return fmt.Sprintf("playback=%v, max=%v", t, d)
 		}
-		if err != nil {
-			return errors.Wrapf(err, "Read h265")
+	}
+
+	conf := &v.conf.psConfig
+	if conf.maxFrames > 0 && sentFrames >= conf.maxFrames {
+		return fmt.Sprintf("frames=%v, max=%v", sentFrames, conf.maxFrames)
+	}
+	if conf.maxBytes > 0 {
+		if stats := ps.Stats(); stats.Bytes >= conf.maxBytes {
+			return fmt.Sprintf("bytes=%v, max=%v", stats.Bytes, conf.maxBytes)
 		}
+	}
+	if conf.maxDuration > 0 {
+		if d := time.Now().Sub(start); d >= conf.maxDuration {
+			return fmt.Sprintf("duration=%v, max=%v", d, conf.maxDuration)
+		}
+	}
+	return ""
+}
 
-		videoFrames = append(videoFrames, frame)
-		logger.If(ctx, "NALU %v PictureOrderCount=%v, ForbiddenZeroBit=%v, %v bytes",
-			frame.UnitType, frame.PictureOrderCount, frame.ForbiddenZeroBit, len(frame.Data))
+// Cache the keyframe, or replace the frame by the cached keyframe if got keyframe request. If no cached keyframe yet,
+// keep the request until the next keyframe from source.
+func (v *PSIngester) requestKeyframe(ctx context.Context, frame *Frame) *Frame {
+	v.lock.Lock()
+	defer v.lock.Unlock()
 
-		if frame.UnitType == NaluTypeVps {
-			vps = frame
-		} else if frame.UnitType == NaluTypeSps {
-			sps = frame
-		} else if frame.UnitType == NaluTypePps {
-			pps = frame
-		} else {
-			break
-		}
+	if utilIsKeyframe(frame) {
+		v.keyframe, v.keyframeRequested = frame, false
+		return frame
+	}
+
+	if !v.keyframeRequested || v.keyframe == nil {
+		return frame
 	}
 
-	// We convert the video sample rate to be based over 1024, that is 1024 samples means one video frame.
-	*avcSamples += 1024
-	*videoDTS = uint64(v.conf.clockRate*(*avcSamples)) / uint64(videoSampleRate)
+	v.keyframeRequested = false
+	logger.Tf(ctx, "PS: Send cached keyframe for request, dts=%v", frame.DTS)
+	return &Frame{Codec: v.keyframe.Codec, DTS: frame.DTS, PTS: frame.PTS, Payloads: v.keyframe.Payloads}
+}
 
-	var err error
-	if vps != nil || sps != nil || pps != nil {
-		err = pack.WriteHeader(mpeg2.PS_STREAM_H265, *videoDTS)
-	} else {
-		err = pack.WritePackHeader(*videoDTS)
+// Write the video frame, with PS header before it.
+func (v *PSIngester) writeVideoFrame(pack *PSPackStream, frame *Frame) error {
+	videoCodec, keyframe := mpeg2.PS_STREAM_H264, utilIsKeyframe(frame)
+	if frame.Codec == FrameCodecH265 {
+		videoCodec = mpeg2.PS_STREAM_H265
 	}
-	if err != nil {
+	// Declare the overwritten codec in PSM, while pass through the payload, to test the server with other codecs.
+	if v.videoCodec != mpeg2.PS_STREAM_UNKNOW {
+		videoCodec = v.videoCodec
+	}
+
+	if err := v.writeHeader(pack, videoCodec, keyframe, frame.DTS); err != nil {
 		return errors.Wrap(err, "pack header")
 	}
 
-	for _, frame := range videoFrames {
-		if err = pack.WriteVideo(frame.Data, *videoDTS); err != nil {
-			return errors.Wrapf(err, "write video %v", len(frame.Data))
-		}
+	if err := pack.WriteAccessUnit(frame.Payloads, frame.DTS, frame.PTS); err != nil {
+		return errors.Wrapf(err, "write video %v NALUs", len(frame.Payloads))
 	}
 	return nil
 }
+
+// Write the PS header before video frame. The full header(PSM) is written for keyframe or when the header interval
+// elapsed, and only once if both matched, otherwise only the pack header.
+func (v *PSIngester) writeHeader(pack *PSPackStream, videoCodec mpeg2.PS_STREAM_TYPE, keyframe bool, dts uint64) error {
+	resend := keyframe
+	if v.headerMode != PSHeaderModeKeyframe {
+		resend = !v.hasHeader
+	}
+	if interval := uint64(v.conf.psConfig.headerInterval); interval > 0 && v.headerMode != PSHeaderModeOnce {
+		if !v.hasHeader || dts < v.headerDTS || dts-v.headerDTS >= interval*v.conf.clockRate/1000 {
+			resend = true
+		}
+	}
+
+	if !resend {
+		return pack.WritePackHeader(dts)
+	}
+
+	v.headerDTS, v.hasHeader = dts, true
+	return pack.WriteHeader(videoCodec, dts)
+}
+
+// The trace of a video or audio frame, see psFrameTracer.
+type psFrameTrace struct {
+	// The media type, video or audio.
+	Media string `json:"media"`
+	// The NALU type of the first slice for video, 0 for audio.
+	NALUType int `json:"nalu"`
+	// The NALU types of the access unit for video, empty for audio.
+	NALUs []int `json:"nalus,omitempty"`
+	// The bytes of frame, for video it's the NALUs of access unit without ANNEXB header.
+	Size int    `json:"size"`
+	DTS  uint64 `json:"dts"`
+	PTS  uint64 `json:"pts"`
+	// The total bytes of PES packets.
+	PESSize int `json:"pes"`
+	// The number of RTP packets, each PES is sent in one RTP packet.
+	Fragments int `json:"rtp"`
+}
+
+// Write trace of each frame to file in JSON lines, to plot the timeline when debugging A/V sync issues.
+type psFrameTracer struct {
+	f    *os.File
+	enc  *json.Encoder
+	hevc bool
+}
+
+func newPSFrameTracer(filename string, hevc bool) (*psFrameTracer, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %v", filename)
+	}
+	return &psFrameTracer{f: f, enc: json.NewEncoder(f), hevc: hevc}, nil
+}
+
+func (v *psFrameTracer) Close() error {
+	return v.f.Close()
+}
+
+// Write one trace for each video access unit or audio frame.
+func (v *psFrameTracer) OnWriteFrame(payloads [][]byte, pes *PSPacket) {
+	trace := &psFrameTrace{
+		Media: "audio", DTS: pes.ts, PTS: pes.pts, Fragments: len(pes.ps),
+	}
+	for _, payload := range payloads {
+		trace.Size += len(payload)
+	}
+	for _, p := range pes.ps {
+		trace.PESSize += len(p)
+	}
+
+	if pes.t == PSPacketTypeVideo {
+		trace.Media = "video"
+		for _, nalu := range payloads {
+			if len(nalu) == 0 {
+				continue
+			}
+
+			// The slice is 1~5 for H.264, and 0~31 for H.265.
+			t := int(nalu[0] & 0x1f)
+			slice := t >= 1 && t <= 5
+			if v.hevc {
+				t = int(nalu[0]&0x7e) >> 1
+				slice = t <= 31
+			}
+
+			if trace.NALUs = append(trace.NALUs, t); slice && trace.NALUType == 0 {
+				trace.NALUType = t
+			}
+		}
+	}
+
+	_ = v.enc.Encode(trace)
+}
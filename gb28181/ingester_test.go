@@ -0,0 +1,651 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"context"
+	"fmt"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGBChannels(t *testing.T) {
+	channels := NewGBChannels()
+	for i, id := range []string{"34020000001310000001", "34020000001310000002"} {
+		offer := fmt.Sprintf("v=0\r\nm=video %v TCP/RTP/AVP 96\r\ny=%v\r\n", 9000+i, 100+i)
+		invite := sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: id}, FHost: "3402000000"},
+			"SIP/2.0", nil, offer, nil)
+
+		out, err := parseInviteChannel(invite, "34020000001320000001")
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if out.channelID != id || out.ssrc != int64(100+i) || out.mediaPort != int64(9000+i) {
+			t.Errorf("invalid channel %v, ssrc=%v, port=%v", out.channelID, out.ssrc, out.mediaPort)
+		}
+
+		if err := channels.Add(&GBChannel{out: out, ingester: NewPSIngester(&IngesterConfig{})}); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if err := channels.Add(&GBChannel{out: out}); err == nil {
+			t.Errorf("should fail for duplicated channel %v", id)
+		}
+	}
+
+	if c := channels.Get("34020000001310000002"); c == nil || c.out.ssrc != 101 {
+		t.Errorf("invalid channel %v", c)
+	}
+	if stats := channels.Stats(); len(stats) != 2 {
+		t.Errorf("invalid stats %v", stats)
+	}
+}
+
+func TestGBChannelsConfig(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "gb28181")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Use a free port as the base of RTCP ports.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	base := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	conf := PSConfig{
+		rtcpAddr: fmt.Sprintf("127.0.0.1:%v", base),
+		tee:      path.Join(dir, "tee.ps"), trace: path.Join(dir, "trace.jsonl"),
+	}
+
+	// The index of channel is kept when re-INVITE.
+	channels := NewGBChannels()
+	ids := []string{"34020000001310000001", "34020000001310000002"}
+	for _, id := range ids {
+		channels.Index(id)
+	}
+	if index := channels.Index(ids[0]); index != 0 {
+		t.Errorf("invalid index %v", index)
+	}
+
+	// Both channels stream concurrently, each with its own RTCP port and files.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(ids))
+	for i, id := range ids {
+		c, err := conf.ForChannel(channels.Index(id), id)
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+
+		server, err := newPSTestServer()
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		defer server.Close()
+
+		video := &psTestFrameSource{}
+		for i := 0; i < 5; i++ {
+			video.frames = append(video.frames, &Frame{
+				Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: [][]byte{{0x65, 0x01}},
+			})
+		}
+
+		v := NewPSIngester(&IngesterConfig{ssrc: uint32(1234 + i), serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+			psConfig: c,
+		})
+		v.videoSource = video
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := v.Ingest(ctx); errors.Cause(err) != io.EOF {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		t.Errorf("err %+v", err)
+		return
+	default:
+	}
+
+	for i, id := range ids {
+		if c, _ := conf.ForChannel(i, id); c.rtcpAddr != fmt.Sprintf("127.0.0.1:%v", base+i) {
+			t.Errorf("invalid rtcp %v of channel %v", c.rtcpAddr, id)
+		}
+
+		for _, name := range []string{"tee-" + id + ".ps", "trace-" + id + ".jsonl"} {
+			if b, err := ioutil.ReadFile(path.Join(dir, name)); err != nil || len(b) == 0 {
+				t.Errorf("invalid file %v, %v bytes, err %+v", name, len(b), err)
+			}
+		}
+	}
+	if _, err := os.Stat(conf.tee); err == nil {
+		t.Errorf("should not write %v", conf.tee)
+	}
+}
+
+func TestGBInviteSDP(t *testing.T) {
+	newInvite := func(sdp string) sip.Message {
+		return sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: "34020000001310000001"}},
+			"SIP/2.0", nil, strings.Replace(sdp, "\n", "\r\n", -1), nil)
+	}
+
+	// The c= of media overwrites the session, and the lines of other media are ignored.
+	out, err := parseInviteChannel(newInvite("v=0\no=34020000002000000001 0 0 IN IP4 10.0.0.1\ns=Play\n"+
+		"c=IN IP4 10.0.0.1\nt=0 0\nm=audio 8000 RTP/AVP 8\nc=IN IP4 10.0.0.3\nm=video 9000 RTP/AVP/TCP 96\n"+
+		"c=IN IP4 10.0.0.2\na=recvonly\na=rtpmap:96 PS/90000\ny=0200000001\n"), "")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if out.mediaHost != "10.0.0.2" || out.mediaPort != 9000 || out.transport != "tcp" || out.ssrc != 200000001 {
+		t.Errorf("invalid channel %v", out)
+	}
+
+	// Use the session c=, or the SIP server for any address.
+	for sdp, expect := range map[string]string{
+		"c=IN IP4 10.0.0.1\nm=video 9000 RTP/AVP 96\ny=100\n": "10.0.0.1",
+		"c=IN IP4 0.0.0.0\nm=video 9000 RTP/AVP 96\ny=100\n":  "",
+		"m=video 9000 RTP/AVP 96\ny=100\n":                    "",
+	} {
+		if out, err := parseInviteChannel(newInvite("v=0\n"+sdp), ""); err != nil || out.mediaHost != expect {
+			t.Errorf("invalid host of %v, out %v, err %+v", sdp, out, err)
+		}
+	}
+
+	// Fail for the malformed SDP.
+	for _, sdp := range []string{
+		"m=video 9000 RTP/AVP 96\n",
+		"y=100\n",
+		"m=video 9000 RTP/AVP 96\ny=\n",
+		"m=video 9000 RTP/AVP 96\ny=0x100\n",
+		"m=video 9000 RTP/AVP 96\ny=12345678901\n",
+		"m=video 9000 RTP/AVP 96\ny=9999999999\n",
+		"m=video 0 RTP/AVP 96\ny=100\n",
+		"m=video 9000 RTP/SAVP 96\ny=100\n",
+		"m=video 9000\ny=100\n",
+		"c=IN IP4\nm=video 9000 RTP/AVP 96\ny=100\n",
+		"m=audio 9000 RTP/AVP 8\ny=100\n",
+	} {
+		if _, err := parseInviteChannel(newInvite("v=0\n"+sdp), ""); err == nil {
+			t.Errorf("should fail for %v", sdp)
+		}
+	}
+}
+
+func TestGBKeepalive(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 3*time.Second)
+	defer cancel()
+
+	session := NewGBSession(&GBSessionConfig{}, &SIPConfig{addr: fmt.Sprintf("udp://%v", server.LocalAddr()),
+		user: "camera", deviceID: "camera", server: "srs", domain: "ossrs.io"})
+	session.heartbeatInterval, session.heartbeatSkip = 10*time.Millisecond, 2
+	if err := session.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.Close()
+	session.startHeartbeat(ctx)
+
+	// Only 2 keepalives are sent, then all skipped.
+	for i := 0; i < 2; i++ {
+		if req, err := sipTestRespond(server, 200, "OK"); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		} else if !strings.HasPrefix(req, "MESSAGE ") || !strings.Contains(req, "<CmdType>Keepalive</CmdType>") {
+			t.Errorf("invalid keepalive %v", req)
+			return
+		}
+	}
+
+	for ctx.Err() == nil {
+		if stats := session.Stats(); stats.KeepalivesSkipped >= 3 {
+			if stats.Keepalives != 2 || stats.KeepaliveRTT <= 0 || stats.KeepaliveMinRTT > stats.KeepaliveMaxRTT ||
+				stats.KeepaliveAvgRTT() <= 0 {
+				t.Errorf("invalid stats %v", stats.String())
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("timeout, stats %v", session.Stats())
+}
+
+func TestGBRegisterLapse(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 3*time.Second)
+	defer cancel()
+
+	// Response all requests, the server grants 1s expires, and records the requests by method and Expires.
+	var requests []string
+	var lock sync.Mutex
+	go func() {
+		for ctx.Err() == nil {
+			req, err := sipTestRespond(server, 200, "OK", "Expires: 1")
+			if err != nil {
+				continue
+			}
+
+			r := strings.Split(req, " ")[0]
+			if r == "REGISTER" {
+				for _, line := range strings.Split(req, "\r\n") {
+					if strings.HasPrefix(line, "Expires:") {
+						r = fmt.Sprintf("%v %v", r, strings.TrimSpace(strings.TrimPrefix(line, "Expires:")))
+					}
+				}
+			}
+
+			lock.Lock()
+			requests = append(requests, r)
+			lock.Unlock()
+		}
+	}()
+
+	session := NewGBSession(&GBSessionConfig{regTimeout: time.Second}, &SIPConfig{
+		addr: fmt.Sprintf("udp://%v", server.LocalAddr()), user: "camera", deviceID: "camera", server: "srs",
+		domain: "ossrs.io", expires: 60,
+	})
+	session.heartbeatInterval = 10 * time.Millisecond
+	session.registerLapse, session.registerReappear, session.registerUnregister = 1200*time.Millisecond, 100*time.Millisecond, true
+	if err := session.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.Close()
+
+	if err := session.Register(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	} else if session.registerExpires != time.Second {
+		t.Errorf("invalid expires %v", session.registerExpires)
+		return
+	} else if stats := session.Stats(); stats.RegisterLatency <= 0 {
+		t.Errorf("invalid stats %v", stats.String())
+		return
+	}
+	session.startHeartbeat(ctx)
+
+	// Registered, refreshed at 0.5s and 1s, unregistered at 1.2s, and re-registered at 1.3s.
+	for ctx.Err() == nil {
+		if stats := session.Stats(); stats.Registers >= 4 {
+			if stats.Lapses != 1 {
+				t.Errorf("invalid stats %v", stats.String())
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("timeout, stats %v", session.Stats())
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var registers []string
+	var silent bool
+	for _, r := range requests {
+		if r == "MESSAGE" && silent {
+			t.Errorf("keepalive while lapsed, %v", requests)
+			return
+		}
+		if strings.HasPrefix(r, "REGISTER") {
+			registers = append(registers, r)
+			silent = r == "REGISTER 0"
+		}
+	}
+	if expect := "REGISTER 60,REGISTER 60,REGISTER 60,REGISTER 0,REGISTER 60"; strings.Join(registers, ",") != expect {
+		t.Errorf("invalid registers %v, expect %v", registers, expect)
+		return
+	}
+}
+
+func TestGBInviteChannels(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 5*time.Second)
+	defer cancel()
+
+	session := NewGBSession(&GBSessionConfig{inviteTimeout: 3 * time.Second}, &SIPConfig{
+		addr: fmt.Sprintf("udp://%v", server.LocalAddr()), user: "camera", deviceID: "camera", server: "srs",
+		domain: "ossrs.io",
+	})
+	session.catalogChannels = 2
+	if err := session.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.Close()
+
+	ip, port := session.sip.localAddr()
+	device := &net.UDPAddr{IP: net.ParseIP(ip), Port: int(port)}
+	sdp := "v=0\r\nm=video 9000 TCP/RTP/AVP 96\r\ny=100\r\n"
+
+	invite := func() <-chan *GBChannelOutput {
+		outs := make(chan *GBChannelOutput, 1)
+		go func() {
+			out, err := session.InviteChannel(ctx)
+			if err != nil && ctx.Err() == nil {
+				t.Errorf("err %+v", err)
+			}
+			outs <- out
+		}()
+		return outs
+	}
+	expect := func(callID string, code int) bool {
+		for _, c := range []int{100, code} {
+			res, err := sipTestRespond(server, 200, "OK")
+			if err != nil || !strings.HasPrefix(res, fmt.Sprintf("SIP/2.0 %v ", c)) ||
+				!strings.Contains(res, "Call-ID: "+callID) {
+				t.Errorf("expect %v, response %v, err %+v", c, res, err)
+				return false
+			}
+		}
+		return true
+	}
+
+	// Reject the channel not in Catalog, then accept the channel in Catalog.
+	outs := invite()
+	if err := sipTestRequest(server, device, "INVITE", "other", "invite-0", 1, sdp); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if !expect("invite-0", 404) {
+		return
+	}
+	if err := sipTestRequest(server, device, "INVITE", "camera-1", "invite-1", 1, sdp); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if !expect("invite-1", 200) {
+		return
+	}
+	if err := sipTestRequest(server, device, "ACK", "camera-1", "invite-1", 1, ""); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if out := <-outs; out == nil || out.channelID != "camera-1" || out.ssrc != 100 || out.ackedAt.IsZero() ||
+		out.inviteLatency < 100*time.Millisecond {
+		t.Errorf("invalid channel %v", out)
+		return
+	}
+
+	// Reject the channel already invited.
+	invite()
+	if err := sipTestRequest(server, device, "INVITE", "camera-1", "invite-2", 1, sdp); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if !expect("invite-2", 486) {
+		return
+	}
+	cancel()
+}
+
+func TestGBByeReinvite(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 5*time.Second)
+	defer cancel()
+
+	session := NewGBSession(&GBSessionConfig{inviteTimeout: 3 * time.Second}, &SIPConfig{
+		addr: fmt.Sprintf("udp://%v", server.LocalAddr()), user: "camera", deviceID: "camera", server: "srs",
+		domain: "ossrs.io",
+	})
+	byes := make(chan string, 1)
+	session.onByeRequest = func(req sip.Message) error {
+		byes <- sipGetCallID(req)
+		return nil
+	}
+	if err := session.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.Close()
+
+	ip, port := session.sip.localAddr()
+	device := &net.UDPAddr{IP: net.ParseIP(ip), Port: int(port)}
+	expect := func(callID string, codes ...int) bool {
+		for _, c := range codes {
+			res, err := sipTestRespond(server, 200, "OK")
+			if err != nil || !strings.HasPrefix(res, fmt.Sprintf("SIP/2.0 %v ", c)) ||
+				!strings.Contains(res, "Call-ID: "+callID) {
+				t.Errorf("expect %v, response %v, err %+v", c, res, err)
+				return false
+			}
+		}
+		return true
+	}
+	invite := func(callID, ssrc string) *GBChannelOutput {
+		outs := make(chan *GBChannelOutput, 1)
+		go func() {
+			out, err := session.InviteChannel(ctx)
+			if err != nil && ctx.Err() == nil {
+				t.Errorf("err %+v", err)
+			}
+			outs <- out
+		}()
+
+		sdp := fmt.Sprintf("v=0\r\nm=video 9000 TCP/RTP/AVP 96\r\ny=%v\r\n", ssrc)
+		if err := sipTestRequest(server, device, "INVITE", "camera", callID, 1, sdp); err != nil {
+			t.Errorf("err %+v", err)
+			return nil
+		}
+		if !expect(callID, 100, 200) {
+			return nil
+		}
+		if err := sipTestRequest(server, device, "ACK", "camera", callID, 1, ""); err != nil {
+			t.Errorf("err %+v", err)
+			return nil
+		}
+		return <-outs
+	}
+
+	out := invite("invite-1", "100")
+	if out == nil || out.callID != "invite-1" || out.Byed() {
+		t.Errorf("invalid channel %v", out)
+		return
+	}
+
+	// The BYE stops the media of dialog, and the BYE of unknown dialog is rejected.
+	if err := sipTestRequest(server, device, "BYE", "camera", "invite-1", 2, ""); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if !expect("invite-1", 200) {
+		return
+	}
+	if callID := <-byes; callID != "invite-1" || !out.Byed() {
+		t.Errorf("invalid bye %v of %v", callID, out)
+		return
+	}
+	if err := sipTestRequest(server, device, "BYE", "camera", "invite-1", 3, ""); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if !expect("invite-1", 481) {
+		return
+	}
+
+	// The re-INVITE of the channel stopped by BYE is accepted, with a new SSRC.
+	if out = invite("invite-2", "200"); out == nil || out.channelID != "camera" || out.ssrc != 200 || out.Byed() {
+		t.Errorf("invalid channel %v", out)
+		return
+	}
+	if stats := session.Stats(); stats.Byes != 1 || stats.Reinvites != 1 {
+		t.Errorf("invalid stats %v", stats.String())
+		return
+	}
+
+	// The media of channel is stopped by BYE, without error.
+	media, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer media.Close()
+
+	video := &psTestFrameSource{}
+	for i := 0; i < 1000; i++ {
+		video.frames = append(video.frames, &Frame{
+			Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: [][]byte{{0x65, 0x01}},
+		})
+	}
+	c := &GBChannel{out: out, ingester: NewPSIngester(&IngesterConfig{
+		ssrc: uint32(out.ssrc), serverAddr: media.Addr(), clockRate: 90000, payloadType: 96,
+	})}
+	c.ingester.videoSource = video
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runChannel(ctx, &gbMainConfig{}, session, c, NewGBLatencies())
+	}()
+	select {
+	case <-ctx.Done():
+		t.Errorf("err %+v", ctx.Err())
+		return
+	case <-media.packets:
+	}
+
+	if err := sipTestRequest(server, device, "BYE", "camera", "invite-2", 2, ""); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if !expect("invite-2", 200) {
+		return
+	}
+	if err := <-done; err != nil || !out.Byed() {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestGBByeFastReinvite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 5*time.Second)
+	defer cancel()
+
+	channels := NewGBChannels()
+	started := make(chan *GBChannel, 2)
+	startChannel := func(out *GBChannelOutput) error {
+		c := &GBChannel{out: out}
+		if err := channels.Add(c); err != nil {
+			return err
+		}
+		started <- c
+		return nil
+	}
+
+	first := &GBChannelOutput{channelID: "34020000001310000001", ssrc: 100, bye: make(chan struct{})}
+	if err := startChannel(first); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	old := <-started
+
+	invites, results := make(chan *GBChannelOutput), make(chan *gbChannelResult)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- waitChannels(ctx, ctx, 1, channels, invites, results, startChannel)
+	}()
+
+	// The re-INVITE arrives right after BYE, before the old stream stops, which should wait for the old one.
+	close(first.bye)
+	invites <- &GBChannelOutput{channelID: first.channelID, ssrc: 101, bye: make(chan struct{})}
+	select {
+	case c := <-started:
+		t.Errorf("should not start %v before old stops", c.out.ssrc)
+		return
+	default:
+	}
+
+	select {
+	case err := <-errs:
+		t.Errorf("should not quit, err %+v", err)
+		return
+	case results <- &gbChannelResult{channel: old}:
+	}
+
+	var c *GBChannel
+	select {
+	case <-ctx.Done():
+		t.Errorf("err %+v", ctx.Err())
+		return
+	case c = <-started:
+	}
+	if c.out.ssrc != 101 || channels.Get(first.channelID) != c {
+		t.Errorf("invalid channel %v", c.out)
+	}
+
+	// Quit when the new stream ends.
+	results <- &gbChannelResult{channel: c}
+	if err := <-errs; err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
@@ -0,0 +1,100 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The latencies of signaling and media, collected from all devices and channels.
+const (
+	// The time from REGISTER to 200 OK, including the challenge of authentication.
+	GBLatencyRegister = "register"
+	// The time from INVITE received to ACK, including the delay of device after 100 Trying.
+	GBLatencyInvite = "invite"
+	// The time from ACK to the first RTP packet accepted by the media connection of server.
+	GBLatencyFirstMedia = "first-media"
+)
+
+// GBLatencies collects the latencies of all devices, and reports them in percentiles, to quantify the scalability of
+// signaling when simulating many devices.
+type GBLatencies struct {
+	lock      sync.Mutex
+	latencies map[string][]time.Duration
+}
+
+func NewGBLatencies() *GBLatencies {
+	return &GBLatencies{latencies: make(map[string][]time.Duration)}
+}
+
+// Add a latency of name, for example, GBLatencyRegister of a device.
+func (v *GBLatencies) Add(name string, d time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.latencies[name] = append(v.latencies[name], d)
+}
+
+// Percentile returns the p-th percentile in (0, 100] of latencies of name by nearest rank, and the number of
+// latencies, 0 if none.
+func (v *GBLatencies) Percentile(name string, p float64) (time.Duration, int) {
+	v.lock.Lock()
+	latencies := append([]time.Duration{}, v.latencies[name]...)
+	v.lock.Unlock()
+
+	if len(latencies) == 0 {
+		return 0, 0
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	return utilPercentile(latencies, p), len(latencies)
+}
+
+func (v *GBLatencies) String() string {
+	var sb []string
+	for _, name := range []string{GBLatencyRegister, GBLatencyInvite, GBLatencyFirstMedia} {
+		p50, n := v.Percentile(name, 50)
+		if n == 0 {
+			continue
+		}
+		p90, _ := v.Percentile(name, 90)
+		p99, _ := v.Percentile(name, 99)
+		max, _ := v.Percentile(name, 100)
+		sb = append(sb, fmt.Sprintf("%v(n=%v, p50=%v, p90=%v, p99=%v, max=%v)", name, n, p50, p90, p99, max))
+	}
+	return strings.Join(sb, ", ")
+}
+
+// The p-th percentile in (0, 100] of the sorted durations, by nearest rank.
+func utilPercentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted))/100)) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,156 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// MetricsExporter serves the stats of channels at /metrics in Prometheus text format, labeled by channel, SSRC and
+// media server address, to graph multiple benchmarks in Grafana.
+type MetricsExporter struct {
+	channels *GBChannels
+}
+
+func NewMetricsExporter(channels *GBChannels) *MetricsExporter {
+	return &MetricsExporter{channels: channels}
+}
+
+// The metric of Prometheus, the value of each channel is read from PSClientStats or frames of ingester.
+type gbMetric struct {
+	name, help, kind string
+	value            func(stats *PSClientStats, videoFrames, audioFrames uint64) float64
+}
+
+var gbMetrics = []gbMetric{
+	{"srs_bench_gb_packets_total", "The number of RTP packets sent.", "counter",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.Packets) }},
+	{"srs_bench_gb_bytes_total", "The bytes sent, including RTP header and framing.", "counter",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.Bytes) }},
+	{"srs_bench_gb_padding_packets_total", "The number of padding only RTP packets sent.", "counter",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.PaddingPackets) }},
+	{"srs_bench_gb_video_frames_total", "The number of video frames consumed.", "counter",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(vf) }},
+	{"srs_bench_gb_audio_frames_total", "The number of audio frames consumed.", "counter",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(af) }},
+	{"srs_bench_gb_pes_total", "The number of video and audio PES packets sent.", "counter",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.PES) }},
+	{"srs_bench_gb_keyframe_requests_total", "The number of PLI or FIR from server.", "counter",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.KeyframeRequests) }},
+	{"srs_bench_gb_receiver_reports_total", "The number of RTCP RR from server.", "counter",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.ReceiverReports) }},
+	{"srs_bench_gb_fraction_lost", "The fraction of packets lost since last RR, in [0, 1].", "gauge",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.FractionLost) / 256 }},
+	{"srs_bench_gb_packets_lost", "The cumulative number of packets lost, reported by server.", "gauge",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.TotalLost) }},
+	{"srs_bench_gb_jitter", "The interarrival jitter in timestamp units, reported by server.", "gauge",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.Jitter) }},
+	{"srs_bench_gb_send_bitrate", "The send bitrate in bps, by the bytes sent in the last second.", "gauge",
+		func(s *PSClientStats, vf, af uint64) float64 { return float64(s.Bitrate) }},
+}
+
+func (v *MetricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(v.Encode())
+}
+
+// Encode returns the metrics of all channels in Prometheus text format.
+func (v *MetricsExporter) Encode() []byte {
+	type channelStats struct {
+		labels                   string
+		stats                    PSClientStats
+		videoFrames, audioFrames uint64
+	}
+
+	var channels []*channelStats
+	for _, c := range v.channels.Channels() {
+		if c.ingester == nil {
+			continue
+		}
+
+		s := &channelStats{stats: c.ingester.Stats()}
+		s.videoFrames, s.audioFrames = c.ingester.Frames()
+		s.labels = fmt.Sprintf(`channel="%v",ssrc="%v",server="%v"`, utilEscapeLabel(c.out.channelID),
+			c.out.ssrc, utilEscapeLabel(c.ingester.conf.serverAddr))
+		channels = append(channels, s)
+	}
+
+	var b bytes.Buffer
+	for _, m := range gbMetrics {
+		fmt.Fprintf(&b, "# HELP %v %v\n", m.name, m.help)
+		fmt.Fprintf(&b, "# TYPE %v %v\n", m.name, m.kind)
+		for _, c := range channels {
+			fmt.Fprintf(&b, "%v{%v} %v\n", m.name, c.labels, m.value(&c.stats, c.videoFrames, c.audioFrames))
+		}
+	}
+	return b.Bytes()
+}
+
+// Serve listens at addr and serves /metrics, until ctx is done.
+func (v *MetricsExporter) Serve(ctx context.Context, addr string) error {
+	return utilServeHTTP(ctx, addr, "/metrics", v)
+}
+
+// Listen at addr and serve the handler at path, until ctx is done. The addr is port only, or ip:port.
+func utilServeHTTP(ctx context.Context, addr, path string, handler http.Handler) error {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listen %v", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+
+	srv := &http.Server{
+		Handler: mux,
+		BaseContext: func(listener net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	logger.Tf(ctx, "HTTP listen at %v, path %v", addr, path)
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return errors.Wrapf(err, "serve %v", addr)
+	}
+	return nil
+}
+
+// Escape the label value of Prometheus, the backslash, double-quote and line feed.
+func utilEscapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
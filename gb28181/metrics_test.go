@@ -0,0 +1,120 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGBMetrics(t *testing.T) {
+	channels := NewGBChannels()
+	for i, id := range []string{"34020000001310000001", "34020000001310000002"} {
+		ingester := NewPSIngester(&IngesterConfig{serverAddr: fmt.Sprintf("tcp://127.0.0.1:%v", 9000+i)})
+		ingester.client = NewPSClient(uint32(100+i), ingester.conf.serverAddr)
+		ingester.client.stats = PSClientStats{Packets: uint64(10 + i), Bytes: 1400, FractionLost: 64}
+		ingester.videoFrames, ingester.audioFrames = 25, 43
+
+		out := &GBChannelOutput{channelID: id, ssrc: int64(100 + i), mediaPort: int64(9000 + i)}
+		if err := channels.Add(&GBChannel{out: out, ingester: ingester}); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+	}
+
+	w := httptest.NewRecorder()
+	NewMetricsExporter(channels).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("invalid content type %v", ct)
+	}
+
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE srs_bench_gb_packets_total counter",
+		`srs_bench_gb_packets_total{channel="34020000001310000001",ssrc="100",server="tcp://127.0.0.1:9000"} 10`,
+		`srs_bench_gb_packets_total{channel="34020000001310000002",ssrc="101",server="tcp://127.0.0.1:9001"} 11`,
+		`srs_bench_gb_video_frames_total{channel="34020000001310000001",ssrc="100",server="tcp://127.0.0.1:9000"} 25`,
+		`srs_bench_gb_fraction_lost{channel="34020000001310000002",ssrc="101",server="tcp://127.0.0.1:9001"} 0.25`,
+		"# TYPE srs_bench_gb_jitter gauge",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("no %v in %v", line, body)
+		}
+	}
+
+	if s := utilEscapeLabel("a\"b\\c\n"); s != `a\"b\\c\n` {
+		t.Errorf("invalid label %v", s)
+	}
+}
+
+func TestGBLatencies(t *testing.T) {
+	v := NewGBLatencies()
+	if d, n := v.Percentile(GBLatencyRegister, 50); d != 0 || n != 0 || v.String() != "" {
+		t.Errorf("invalid latency %v, n=%v, %v", d, n, v.String())
+		return
+	}
+
+	// The register latencies are 1ms to 100ms in reverse order, and one invite latency.
+	for i := 100; i > 0; i-- {
+		v.Add(GBLatencyRegister, time.Duration(i)*time.Millisecond)
+	}
+	v.Add(GBLatencyInvite, 120*time.Millisecond)
+	for _, c := range []struct {
+		p      float64
+		expect time.Duration
+	}{
+		{0.1, time.Millisecond}, {50, 50 * time.Millisecond}, {90, 90 * time.Millisecond}, {99.5, 100 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	} {
+		if d, n := v.Percentile(GBLatencyRegister, c.p); d != c.expect || n != 100 {
+			t.Errorf("invalid p%v %v, n=%v", c.p, d, n)
+		}
+	}
+	if s := v.String(); s != "register(n=100, p50=50ms, p90=90ms, p99=99ms, max=100ms), invite(n=1, p50=120ms, p90=120ms, p99=120ms, max=120ms)" {
+		t.Errorf("invalid latencies %v", s)
+	}
+
+	// The first media is when the first RTP packet is written.
+	var b bytes.Buffer
+	client := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	client.conn = &psTestConn{w: &b}
+	if !client.Stats().FirstPacketAt.IsZero() {
+		t.Errorf("invalid stats %v", client.Stats())
+		return
+	}
+	starttime := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := client.WritePacksOverRTP([]*PSPacket{{pt: 96, ts: 3600, ps: [][]byte{{0x00, 0x00, 0x01, 0xba}}}}); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if first := client.Stats().FirstPacketAt; first.Before(starttime) || time.Since(first) < 10*time.Millisecond {
+		t.Errorf("invalid first packet at %v, start %v", first, starttime)
+	}
+}
@@ -0,0 +1,881 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pion/rtp"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GBPlatformConfig is the config of platform mode, which acts as the superior platform of the cascade of SRS, that is,
+// the lower platform registers to us, and we query its Catalog and invite its channels.
+type GBPlatformConfig struct {
+	// The listen address of platform, for example, udp://0.0.0.0:5060 or tcp://0.0.0.0:5060.
+	addr string
+	// The ID and domain of platform, for example, 34020000002000000001 and 3402000000.
+	id     string
+	domain string
+	// The expires in seconds granted to REGISTER of lower platform, 0 to use the Expires of request.
+	expires int
+	// The transport of media, tcp or udp, and the IP in SDP for lower platform to send media to, use the local IP to
+	// lower platform if empty.
+	transport string
+	mediaIP   string
+	// The timeout of each request, for example, INVITE and Catalog query.
+	timeout time.Duration
+}
+
+func (v *GBPlatformConfig) String() string {
+	return fmt.Sprintf("addr=%v, id=%v, domain=%v, expires=%v, transport=%v, media=%v, timeout=%v",
+		v.addr, v.id, v.domain, v.expires, v.transport, v.mediaIP, v.timeout)
+}
+
+type GBPlatformStats struct {
+	// The number of REGISTER including refreshes and unregister, and the keepalives from lower platform.
+	Registers  uint64
+	Keepalives uint64
+	// The number of Catalog responses and channels in them.
+	Catalogs     uint64
+	CatalogItems uint64
+	// The number of channels invited, and the BYE from or to lower platform.
+	Invites  uint64
+	ByesFrom uint64
+	ByesTo   uint64
+}
+
+func (v *GBPlatformStats) String() string {
+	return fmt.Sprintf("registers=%v, keepalives=%v, catalogs=%v, items=%v, invites=%v, byes-from=%v, byes-to=%v",
+		v.Registers, v.Keepalives, v.Catalogs, v.CatalogItems, v.Invites, v.ByesFrom, v.ByesTo)
+}
+
+// The MANSCDP message from lower platform, for example, the Keepalive notify or the Catalog response, see GB28181-2016
+// A.2.5 and A.2.6.
+type gbPlatformMessage struct {
+	XMLName  xml.Name
+	CmdType  string `xml:"CmdType"`
+	SN       uint64 `xml:"SN"`
+	DeviceID string `xml:"DeviceID"`
+	SumNum   int    `xml:"SumNum"`
+	// The channels in Catalog response.
+	DeviceList struct {
+		Num   int              `xml:"Num,attr"`
+		Items []*gbCatalogItem `xml:"Item"`
+	} `xml:"DeviceList"`
+}
+
+// Parse the MANSCDP XML body of MESSAGE from lower platform, ignore the charset like parseGBQuery.
+func parseGBPlatformMessage(body string) (*gbPlatformMessage, error) {
+	d := xml.NewDecoder(bytes.NewReader([]byte(body)))
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	m := &gbPlatformMessage{}
+	if err := d.Decode(m); err != nil {
+		return nil, errors.Wrapf(err, "decode %v", body)
+	}
+	return m, nil
+}
+
+// The SSRC of realtime stream in 10 decimal digits, 0 for realtime, the 4th to 8th digits of domain, and the sequence
+// of 4 digits, see GB28181-2016 Annex F.
+func utilBuildPlatformSSRC(domain string, n int) uint32 {
+	prefix := "00000"
+	if len(domain) >= 8 && strings.Trim(domain[3:8], "0123456789") == "" {
+		prefix = domain[3:8]
+	}
+	ssrc, _ := strconv.ParseUint(fmt.Sprintf("0%v%04d", prefix, n%10000), 10, 32)
+	return uint32(ssrc)
+}
+
+// GBPlatformChannel is a channel of lower platform invited by us, which receives and validates the PS media over RTP.
+type GBPlatformChannel struct {
+	channelID string
+	ssrc      uint32
+	transport string
+	// The dialog of INVITE, to send ACK and BYE.
+	callID string
+	invite sip.Request
+	to     *sip.ToHeader
+	// The listener of TCP and the accepted connection, or the UDP connection, to receive media.
+	listener *net.TCPListener
+	media    *net.TCPConn
+	conn     *net.UDPConn
+	// Closed when got BYE from lower platform.
+	bye chan struct{}
+	// The stats of media.
+	stats GBPlatformChannelStats
+	lock  sync.Mutex
+}
+
+type GBPlatformChannelStats struct {
+	// The number of RTP packets and bytes of payload.
+	Packets uint64
+	Bytes   uint64
+	// The number of packets lost by the gaps of sequence, and the packets whose SSRC is not the y= of INVITE.
+	Lost           uint64
+	SSRCMismatches uint64
+	// The number of video and audio frames demuxed from PS.
+	VideoFrames uint64
+	AudioFrames uint64
+	// The time of first RTP packet, zero if no packet.
+	FirstPacketAt time.Time
+}
+
+func (v *GBPlatformChannelStats) String() string {
+	return fmt.Sprintf("packets=%v, bytes=%v, lost=%v, ssrc-mismatches=%v, video=%v, audio=%v",
+		v.Packets, v.Bytes, v.Lost, v.SSRCMismatches, v.VideoFrames, v.AudioFrames)
+}
+
+// Stats returns the stats of media.
+func (v *GBPlatformChannel) Stats() GBPlatformChannelStats {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.stats
+}
+
+// Byed whether the media is stopped by BYE from lower platform.
+func (v *GBPlatformChannel) Byed() bool {
+	select {
+	case <-v.bye:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close the listener and connections of media.
+func (v *GBPlatformChannel) Close() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.listener != nil {
+		v.listener.Close()
+	}
+	if v.media != nil {
+		v.media.Close()
+	}
+	if v.conn != nil {
+		v.conn.Close()
+	}
+	return nil
+}
+
+// Receive the RTP packets of PS media until ctx done or BYE, and fails if the media is not a legal PS stream, for
+// example, the PES not declared by PSM. The TCP uses the RFC 4571 framing.
+func (v *GBPlatformChannel) Receive(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Unblock reading when done or BYE, but keep the media connection until closed, so that the lower platform is
+	// stopped by BYE rather than the broken connection.
+	var conn *net.TCPConn
+	var connLock sync.Mutex
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-v.bye:
+		}
+
+		if v.listener != nil {
+			v.listener.Close()
+		} else {
+			v.conn.SetReadDeadline(time.Now())
+		}
+
+		connLock.Lock()
+		defer connLock.Unlock()
+		if conn != nil {
+			conn.SetReadDeadline(time.Now())
+		}
+	}()
+
+	var read func() ([]byte, error)
+	if v.listener != nil {
+		c, err := v.listener.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil || v.Byed() {
+				return nil
+			}
+			return errors.Wrapf(err, "accept")
+		}
+
+		connLock.Lock()
+		conn = c
+		connLock.Unlock()
+
+		v.lock.Lock()
+		v.media = c
+		v.lock.Unlock()
+		if ctx.Err() != nil || v.Byed() {
+			return nil
+		}
+
+		r := NewPSFrameReader(c, PSFramingRFC4571)
+		read = func() ([]byte, error) {
+			for {
+				b, isRTCP, err := r.ReadPacket()
+				if err != nil || !isRTCP {
+					return b, err
+				}
+			}
+		}
+	} else {
+		buf := make([]byte, 65536)
+		read = func() ([]byte, error) {
+			n, _, err := v.conn.ReadFrom(buf)
+			return buf[:n], err
+		}
+	}
+
+	unpack := NewPSUnpackStream()
+	unpack.OnFrame = func(frame *Frame) error {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		if frame.Codec == FrameCodecH264 || frame.Codec == FrameCodecH265 {
+			v.stats.VideoFrames++
+		} else {
+			v.stats.AudioFrames++
+		}
+		return nil
+	}
+
+	var lastSeq uint16
+	for {
+		b, err := read()
+		if err != nil {
+			if ctx.Err() != nil || v.Byed() || err == io.EOF {
+				return nil
+			}
+			return errors.Wrapf(err, "read")
+		}
+
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(b); err != nil {
+			return errors.Wrapf(err, "unmarshal rtp %v bytes", len(b))
+		}
+
+		v.lock.Lock()
+		if v.stats.Packets == 0 {
+			v.stats.FirstPacketAt = time.Now()
+		} else if gap := p.SequenceNumber - lastSeq; gap > 1 && gap < 0x8000 {
+			v.stats.Lost += uint64(gap - 1)
+		}
+		if p.SSRC != v.ssrc {
+			v.stats.SSRCMismatches++
+		}
+		v.stats.Packets++
+		v.stats.Bytes += uint64(len(p.Payload))
+		v.lock.Unlock()
+		lastSeq = p.SequenceNumber
+
+		if err := unpack.Write(p.Payload); err != nil {
+			return errors.Wrapf(err, "invalid ps of channel=%v, ssrc=%v", v.channelID, p.SSRC)
+		}
+	}
+}
+
+// GBPlatform is the superior platform, which accepts the REGISTER of lower platform such as the cascade of SRS, queries
+// its Catalog and invites its channels, to test the cascade end to end. The requests to lower platform are sent one by
+// one, because the responses are matched by Call-ID from the same queue.
+type GBPlatform struct {
+	conf *GBPlatformConfig
+	// The SIP stack, and the local address to listen for UDP, nil for TCP.
+	protocol  transport.Protocol
+	incoming  chan sip.Message
+	localAddr *net.UDPAddr
+	port      int
+	// The responses to requests of us.
+	responses chan sip.Response
+	// The device ID and source address of lower platform, notified when registered.
+	lowerID    string
+	lowerAddr  string
+	registered chan struct{}
+	// The Catalog responses of lower platform.
+	catalogs chan *gbPlatformMessage
+	// The channels invited by Call-ID of INVITE.
+	channels     map[string]*GBPlatformChannel
+	channelsLock sync.Mutex
+	// The sequence of CSeq and SSRC.
+	seq     uint
+	ssrcSeq int
+	// The stats of platform.
+	stats     GBPlatformStats
+	statsLock sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func NewGBPlatform(c *GBPlatformConfig) *GBPlatform {
+	return &GBPlatform{
+		conf: c, responses: make(chan sip.Response, 1024), registered: make(chan struct{}, 1),
+		catalogs: make(chan *gbPlatformMessage, 1024), channels: make(map[string]*GBPlatformChannel),
+		seq: 100,
+	}
+}
+
+func (v *GBPlatform) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+
+	v.channelsLock.Lock()
+	defer v.channelsLock.Unlock()
+	for _, c := range v.channels {
+		c.Close()
+	}
+	return nil
+}
+
+// Addr returns the address of platform for lower platform to register, with the actual listening port.
+func (v *GBPlatform) Addr() string {
+	u, err := url.Parse(v.conf.addr)
+	if err != nil {
+		return v.conf.addr
+	}
+	return fmt.Sprintf("%v://%v", u.Scheme, net.JoinHostPort(u.Hostname(), strconv.Itoa(v.port)))
+}
+
+// Stats returns the stats of platform.
+func (v *GBPlatform) Stats() GBPlatformStats {
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+	return v.stats
+}
+
+// Listen for the SIP of lower platform, and serve the requests until closed. The free port is used if port is 0.
+func (v *GBPlatform) Listen(ctx context.Context) error {
+	u, err := url.Parse(v.conf.addr)
+	if err != nil {
+		return errors.Wrapf(err, "parse addr=%v", v.conf.addr)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return errors.Errorf("invalid scheme=%v of addr=%v", u.Scheme, v.conf.addr)
+	}
+
+	host := u.Hostname()
+	if v.port, err = strconv.Atoi(u.Port()); err != nil || v.port < 0 || v.port > 65535 {
+		return errors.Errorf("invalid port of addr=%v", v.conf.addr)
+	}
+
+	// The transport keys the listener by port, so we must know the actual port before listening.
+	if v.port == 0 {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return errors.Wrapf(err, "listen %v", host)
+		}
+		v.port = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	v.ctx, v.cancel = ctx, cancel
+
+	incoming := make(chan sip.Message, 1024)
+	errs := make(chan error, 1)
+	cancels := make(chan struct{})
+	if u.Scheme == "udp" {
+		v.protocol = transport.NewUdpProtocol(incoming, errs, cancels, nil, log.NewDefaultLogrusLogger())
+		v.localAddr = &net.UDPAddr{IP: net.ParseIP(host), Port: v.port}
+	} else {
+		v.protocol = transport.NewTcpProtocol(incoming, errs, cancels, nil, log.NewDefaultLogrusLogger())
+	}
+	v.incoming = incoming
+
+	if err := v.protocol.Listen(transport.NewTarget(utilSIPHost(host), v.port)); err != nil {
+		cancel()
+		close(cancels)
+		return errors.Wrapf(err, "listen %v", v.conf.addr)
+	}
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		<-ctx.Done()
+		close(cancels)
+
+		select {
+		case <-time.After(5 * time.Second):
+			logger.E(ctx, "Wait for protocol cleanup timeout")
+		case <-v.protocol.Done():
+		}
+	}()
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case r0 := <-errs:
+				logger.Ef(ctx, "SIP stack err %+v", r0)
+				cancel()
+			case msg := <-incoming:
+				if req, ok := msg.(sip.Request); ok {
+					if err := v.serveRequest(ctx, req); err != nil {
+						logger.Wf(ctx, "Serve %v err %+v", req.Method(), err)
+					}
+				} else if res, ok := msg.(sip.Response); ok {
+					select {
+					case v.responses <- res:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	logger.Tf(ctx, "Platform listen at %v, %v", v.Addr(), v.conf.String())
+	return nil
+}
+
+// Serve the request of lower platform, the REGISTER, the MESSAGE of keepalive and Catalog response, and the BYE to
+// stop media. Other requests are responded with 405.
+func (v *GBPlatform) serveRequest(ctx context.Context, req sip.Request) error {
+	switch req.Method() {
+	case sip.REGISTER:
+		return v.serveRegister(ctx, req)
+	case sip.MESSAGE:
+		if err := v.response(req, 200, "OK"); err != nil {
+			return errors.Wrap(err, "response")
+		}
+
+		m, err := parseGBPlatformMessage(req.Body())
+		if err != nil {
+			return errors.Wrap(err, "parse")
+		}
+
+		v.statsLock.Lock()
+		defer v.statsLock.Unlock()
+		if m.CmdType == "Keepalive" {
+			v.stats.Keepalives++
+		} else if m.CmdType == "Catalog" && m.XMLName.Local == "Response" {
+			v.stats.Catalogs++
+			v.stats.CatalogItems += uint64(len(m.DeviceList.Items))
+			select {
+			case v.catalogs <- m:
+			default:
+			}
+		}
+		return nil
+	case sip.BYE:
+		callID := sipGetCallID(req)
+
+		v.channelsLock.Lock()
+		c := v.channels[callID]
+		delete(v.channels, callID)
+		v.channelsLock.Unlock()
+
+		if c == nil {
+			return v.response(req, 481, "Call/Transaction Does Not Exist")
+		}
+		if err := v.response(req, 200, "OK"); err != nil {
+			return errors.Wrap(err, "response")
+		}
+		close(c.bye)
+
+		v.statsLock.Lock()
+		v.stats.ByesFrom++
+		v.statsLock.Unlock()
+
+		logger.Tf(ctx, "Got BYE of channel=%v, ssrc=%v, Call-ID=%v", c.channelID, c.ssrc, callID)
+		return nil
+	case sip.ACK:
+		return nil
+	}
+	return v.response(req, 405, "Method Not Allowed")
+}
+
+// Accept the REGISTER of lower platform, response with the granted Expires and the Date to sync time, see GB28181-2016
+// 9.1.2.1. The authentication is not required.
+func (v *GBPlatform) serveRegister(ctx context.Context, req sip.Request) error {
+	var deviceID string
+	if from, ok := req.From(); ok && from.Address != nil && from.Address.User() != nil {
+		deviceID = from.Address.User().String()
+	}
+	if deviceID == "" {
+		return v.response(req, 400, "Bad Request")
+	}
+
+	expires := sipGetExpires(req, 3600*time.Second)
+	if v.conf.expires > 0 && expires > 0 {
+		expires = time.Duration(v.conf.expires) * time.Second
+	}
+
+	res := sip.NewResponseFromRequest("", req, sip.StatusCode(200), "OK", "")
+	sipExpires := sip.Expires(uint32(expires / time.Second))
+	res.AppendHeader(&sipExpires)
+	res.AppendHeader(&sip.GenericHeader{HeaderName: "Date", Contents: time.Now().Format("2006-01-02T15:04:05.000")})
+	if err := v.send(res, req.Source()); err != nil {
+		return errors.Wrap(err, "response")
+	}
+
+	v.statsLock.Lock()
+	v.lowerID, v.lowerAddr = deviceID, req.Source()
+	v.stats.Registers++
+	v.statsLock.Unlock()
+	logger.Tf(ctx, "Got REGISTER of %v from %v, expires=%v, Call-ID=%v", deviceID, req.Source(), expires,
+		sipGetCallID(req))
+
+	if expires > 0 {
+		select {
+		case v.registered <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Response the request of lower platform with status.
+func (v *GBPlatform) response(req sip.Request, code int, reason string) error {
+	res := sip.NewResponseFromRequest("", req, sip.StatusCode(code), reason, "")
+	return v.send(res, req.Source())
+}
+
+// Send the message to addr, which is the source of lower platform. For UDP, the source is used to find the listening
+// socket to send.
+func (v *GBPlatform) send(msg sip.Message, addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrapf(err, "split %v", addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return errors.Wrapf(err, "port of %v", addr)
+	}
+
+	if v.localAddr != nil {
+		msg.SetSource(v.localAddr.String())
+	}
+	if err := v.protocol.Send(transport.NewTarget(utilSIPHost(host), p), msg); err != nil {
+		return errors.Wrapf(err, "send %v", msg.String())
+	}
+	return nil
+}
+
+// The local IP of platform in Via, Contact and SDP, the IP to lower platform if listening at any address.
+func (v *GBPlatform) localIP() string {
+	if v.conf.mediaIP != "" {
+		return v.conf.mediaIP
+	}
+	if u, err := url.Parse(v.conf.addr); err == nil {
+		if ip := net.ParseIP(u.Hostname()); ip != nil && !ip.IsUnspecified() {
+			return ip.String()
+		}
+	}
+
+	if ip, err := utilLocalIP(v.lower()); err == nil {
+		return ip.String()
+	}
+	return "127.0.0.1"
+}
+
+// The source address of lower platform, to send requests to.
+func (v *GBPlatform) lower() string {
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+	return v.lowerAddr
+}
+
+// WaitRegister waits for the lower platform to register, returns its device ID.
+func (v *GBPlatform) WaitRegister(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-v.ctx.Done():
+		return "", v.ctx.Err()
+	case <-v.registered:
+	}
+
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+	return v.lowerID, nil
+}
+
+// Build the request to lower platform, in the dialog if to has tag.
+func (v *GBPlatform) buildRequest(method sip.RequestMethod, user, callID, fromTag string, to *sip.Address, seq uint, contentType, body string) (sip.Request, error) {
+	sipTransport := "TCP"
+	if v.localAddr != nil {
+		sipTransport = "UDP"
+	}
+	ip := utilSIPHost(v.localIP())
+	sipPort := sip.Port(v.port)
+	sipCallID := sip.CallID(callID)
+	sipMaxForwards := sip.MaxForwards(70)
+
+	rb := sip.NewRequestBuilder()
+	rb.SetTransport(sipTransport)
+	rb.SetMethod(method)
+	rb.AddVia(&sip.ViaHop{
+		ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: sipTransport, Host: ip, Port: &sipPort,
+		Params: sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+	})
+	rb.SetFrom(&sip.Address{
+		Uri:    &sip.SipUri{FUser: sip.String{Str: v.conf.id}, FHost: v.conf.domain},
+		Params: sip.NewParams().Add("tag", sip.String{Str: fromTag}),
+	})
+	rb.SetTo(to)
+	rb.SetCallID(&sipCallID)
+	rb.SetSeqNo(seq)
+	rb.SetRecipient(&sip.SipUri{FUser: sip.String{Str: user}, FHost: v.conf.domain})
+	rb.SetContact(&sip.Address{
+		Uri: &sip.SipUri{FUser: sip.String{Str: v.conf.id}, FHost: ip, FPort: &sipPort},
+	})
+	rb.SetMaxForwards(&sipMaxForwards)
+	if body != "" {
+		sipContentType := sip.ContentType(contentType)
+		rb.SetContentType(&sipContentType)
+		rb.SetBody(body)
+	}
+
+	req, err := rb.Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "build request")
+	}
+	return req, nil
+}
+
+// Send the request to lower platform and wait for the final response, the provisional responses are ignored.
+func (v *GBPlatform) request(ctx context.Context, req sip.Request) (sip.Response, error) {
+	if err := v.send(req, v.lower()); err != nil {
+		return nil, errors.Wrapf(err, "send %v", req.Method())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.conf.timeout)
+	defer cancel()
+
+	callID := sipGetCallID(req)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "wait %v response, Call-ID=%v", req.Method(), callID)
+		case <-v.ctx.Done():
+			return nil, v.ctx.Err()
+		case res := <-v.responses:
+			if tv := sipGetCallID(res); tv != callID {
+				logger.Wf(ctx, "Not callID=%v, msg=%v, drop message %v", callID, tv, res.String())
+				continue
+			}
+			if res.StatusCode() < 200 {
+				continue
+			}
+			return res, sipResponseError(res)
+		}
+	}
+}
+
+// QueryCatalog sends the Catalog query to lower platform, and collects the channels in Catalog responses, until got
+// SumNum channels or timeout.
+func (v *GBPlatform) QueryCatalog(ctx context.Context, deviceID string) ([]*gbCatalogItem, error) {
+	v.seq++
+	sn := v.seq
+	body := fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Query>\n<CmdType>Catalog</CmdType>\n"+
+		"<SN>%v</SN>\n<DeviceID>%v</DeviceID>\n</Query>\n", sn, deviceID)
+	req, err := v.buildRequest(sip.MESSAGE, deviceID, fmt.Sprintf("%v", rand.Uint64()),
+		fmt.Sprintf("%v", rand.Uint32()), &sip.Address{
+			Uri: &sip.SipUri{FUser: sip.String{Str: deviceID}, FHost: v.conf.domain},
+		}, v.seq, "Application/MANSCDP+xml", body)
+	if err != nil {
+		return nil, errors.Wrap(err, "build")
+	}
+
+	if _, err := v.request(ctx, req); err != nil {
+		return nil, errors.Wrap(err, "query catalog")
+	}
+	logger.Tf(ctx, "Query Catalog of %v, SN=%v, Call-ID=%v", deviceID, sn, sipGetCallID(req))
+
+	ctx, cancel := context.WithTimeout(ctx, v.conf.timeout)
+	defer cancel()
+
+	var items []*gbCatalogItem
+	for {
+		select {
+		case <-ctx.Done():
+			return items, errors.Wrapf(ctx.Err(), "wait catalog, got %v channels", len(items))
+		case <-v.ctx.Done():
+			return items, v.ctx.Err()
+		case m := <-v.catalogs:
+			if m.SN != uint64(sn) {
+				logger.Wf(ctx, "Drop Catalog of SN=%v, expect %v", m.SN, sn)
+				continue
+			}
+			items = append(items, m.DeviceList.Items...)
+			if len(items) >= m.SumNum {
+				return items, nil
+			}
+		}
+	}
+}
+
+// Invite the channel of lower platform, listen for the media before INVITE, the TCP is passive so that the lower
+// platform connects to us. Send the ACK when got 200 OK.
+func (v *GBPlatform) Invite(ctx context.Context, channelID string) (*GBPlatformChannel, error) {
+	v.ssrcSeq++
+	c := &GBPlatformChannel{
+		channelID: channelID, ssrc: utilBuildPlatformSSRC(v.conf.domain, v.ssrcSeq), transport: v.conf.transport,
+		callID: fmt.Sprintf("%v", rand.Uint64()), bye: make(chan struct{}),
+	}
+
+	var port int
+	protocol := "TCP/RTP/AVP"
+	if c.transport == "udp" {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, errors.Wrap(err, "listen udp")
+		}
+		c.conn, port, protocol = conn, conn.LocalAddr().(*net.UDPAddr).Port, "RTP/AVP"
+	} else {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{})
+		if err != nil {
+			return nil, errors.Wrap(err, "listen tcp")
+		}
+		c.listener, port = listener, listener.Addr().(*net.TCPAddr).Port
+	}
+
+	ip := v.localIP()
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=%v 0 0 IN %v %v", v.conf.id, utilSDPAddrType(ip), ip),
+		"s=Play",
+		fmt.Sprintf("c=IN %v %v", utilSDPAddrType(ip), ip),
+		"t=0 0",
+		fmt.Sprintf("m=video %v %v 96", port, protocol),
+		"a=recvonly",
+		"a=rtpmap:96 PS/90000",
+	}
+	if c.transport != "udp" {
+		lines = append(lines, "a=setup:passive", "a=connection:new")
+	}
+	lines = append(lines, fmt.Sprintf("y=%010d", c.ssrc))
+	offer := strings.Join(lines, "\r\n") + "\r\n"
+
+	v.seq++
+	req, err := v.buildRequest(sip.INVITE, channelID, c.callID, fmt.Sprintf("%v", rand.Uint32()), &sip.Address{
+		Uri: &sip.SipUri{FUser: sip.String{Str: channelID}, FHost: v.conf.domain},
+	}, v.seq, "application/sdp", offer)
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "build")
+	}
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "Subject",
+		Contents: fmt.Sprintf("%v:%010d,%v:0", channelID, c.ssrc, v.conf.id)})
+	c.invite = req
+
+	// Register the channel before INVITE, in case the lower platform BYE immediately.
+	v.channelsLock.Lock()
+	v.channels[c.callID] = c
+	v.channelsLock.Unlock()
+
+	res, err := v.request(ctx, req)
+	if err != nil {
+		v.channelsLock.Lock()
+		delete(v.channels, c.callID)
+		v.channelsLock.Unlock()
+		c.Close()
+		return nil, errors.Wrapf(err, "invite channel=%v", channelID)
+	}
+
+	to, ok := res.To()
+	if !ok {
+		c.Close()
+		return nil, errors.Errorf("no To of response %v", res.String())
+	}
+	c.to = to
+
+	ack, err := v.buildDialogRequest(c, sip.ACK, v.seq)
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "build ack")
+	}
+	if err := v.send(ack, v.lower()); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "ack")
+	}
+
+	v.statsLock.Lock()
+	v.stats.Invites++
+	v.statsLock.Unlock()
+
+	logger.Tf(ctx, "Invite channel=%v, ssrc=%v, transport=%v, media=%v:%v, Call-ID=%v", channelID, c.ssrc,
+		c.transport, ip, port, c.callID)
+	return c, nil
+}
+
+// Build the request in dialog of INVITE, for example, the ACK and BYE, with the tags of INVITE and 200 OK.
+func (v *GBPlatform) buildDialogRequest(c *GBPlatformChannel, method sip.RequestMethod, seq uint) (sip.Request, error) {
+	var fromTag string
+	if from, ok := c.invite.From(); ok {
+		if tag, ok := from.Params.Get("tag"); ok && tag != nil {
+			fromTag = tag.String()
+		}
+	}
+	return v.buildRequest(method, c.channelID, c.callID, fromTag, &sip.Address{Uri: c.to.Address, Params: c.to.Params},
+		seq, "", "")
+}
+
+// Bye stops the media of channel, ignore if already stopped by BYE of lower platform.
+func (v *GBPlatform) Bye(ctx context.Context, c *GBPlatformChannel) error {
+	defer c.Close()
+
+	v.channelsLock.Lock()
+	_, ok := v.channels[c.callID]
+	delete(v.channels, c.callID)
+	v.channelsLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	v.seq++
+	req, err := v.buildDialogRequest(c, sip.BYE, v.seq)
+	if err != nil {
+		return errors.Wrap(err, "build")
+	}
+	if _, err := v.request(ctx, req); err != nil {
+		return errors.Wrapf(err, "bye channel=%v", c.channelID)
+	}
+
+	v.statsLock.Lock()
+	v.stats.ByesTo++
+	v.statsLock.Unlock()
+
+	logger.Tf(ctx, "Bye channel=%v, ssrc=%v, Call-ID=%v", c.channelID, c.ssrc, c.callID)
+	return nil
+}
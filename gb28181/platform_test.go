@@ -0,0 +1,149 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"testing"
+	"time"
+)
+
+func TestGBPlatform(t *testing.T) {
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 10*time.Second)
+	defer cancel()
+
+	if ssrc := utilBuildPlatformSSRC("3402000000", 1); ssrc != 200000001 {
+		t.Errorf("invalid ssrc %v", ssrc)
+		return
+	}
+	if ssrc := utilBuildPlatformSSRC("ossrs.io", 2); ssrc != 2 {
+		t.Errorf("invalid ssrc %v", ssrc)
+		return
+	}
+
+	platform := NewGBPlatform(&GBPlatformConfig{
+		addr: "udp://127.0.0.1:0", id: "srs", domain: "ossrs.io", transport: "tcp", timeout: 3 * time.Second,
+	})
+	if err := platform.Listen(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer platform.Close()
+
+	// The lower platform with 2 channels, which streams the first invited channel until BYE.
+	session := NewGBSession(&GBSessionConfig{regTimeout: 3 * time.Second, inviteTimeout: 3 * time.Second}, &SIPConfig{
+		addr: platform.Addr(), user: "camera", deviceID: "camera", server: "srs", domain: "ossrs.io",
+	})
+	session.catalogChannels = 2
+	defer session.Close()
+
+	lowerErrs := make(chan error, 1)
+	go func() {
+		lowerErrs <- func() error {
+			if err := session.Connect(ctx); err != nil {
+				return err
+			}
+			if err := session.Register(ctx); err != nil {
+				return err
+			}
+			out, err := session.InviteChannel(ctx)
+			if err != nil {
+				return err
+			}
+
+			// The keyframe with SPS and PPS every 25 frames, to start with PSM.
+			video := &psTestFrameSource{}
+			for i := 0; i < 1000; i++ {
+				frame := &Frame{Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600),
+					Payloads: [][]byte{{0x41, 0x01}},
+				}
+				if i%25 == 0 {
+					frame.Payloads = [][]byte{{0x67, 0x64}, {0x68, 0xee}, {0x65, 0x01}}
+				}
+				video.frames = append(video.frames, frame)
+			}
+			ingester := NewPSIngester(&IngesterConfig{
+				ssrc: uint32(out.ssrc), serverAddr: fmt.Sprintf("tcp://%v:%v", out.mediaHost, out.mediaPort),
+				clockRate: 90000, payloadType: 96,
+			})
+			ingester.videoSource = video
+
+			ingestCtx, ingestCancel := context.WithCancel(ctx)
+			defer ingestCancel()
+			go func() {
+				<-out.bye
+				ingestCancel()
+			}()
+			if err := ingester.Ingest(ingestCtx); err != nil && ingestCtx.Err() == nil {
+				return err
+			}
+			return nil
+		}()
+	}()
+
+	deviceID, err := platform.WaitRegister(ctx)
+	if err != nil || deviceID != "camera" {
+		t.Errorf("invalid device %v, err %+v", deviceID, err)
+		return
+	}
+
+	items, err := platform.QueryCatalog(ctx, deviceID)
+	if err != nil || len(items) != 2 || items[0].DeviceID != "camera-1" || items[1].DeviceID != "camera-2" {
+		t.Errorf("invalid catalog %v, err %+v", items, err)
+		return
+	}
+
+	c, err := platform.Invite(ctx, items[0].DeviceID)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	mediaCtx, mediaCancel := context.WithTimeout(ctx, time.Second)
+	defer mediaCancel()
+	if err := c.Receive(mediaCtx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if stats := c.Stats(); stats.VideoFrames == 0 || stats.Packets == 0 || stats.SSRCMismatches != 0 || stats.Lost != 0 {
+		t.Errorf("invalid media %v", stats.String())
+		return
+	}
+
+	if err := platform.Bye(ctx, c); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := <-lowerErrs; err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	if stats := platform.Stats(); stats.Registers != 1 || stats.Catalogs != 1 || stats.CatalogItems != 2 ||
+		stats.Invites != 1 || stats.ByesTo != 1 {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+	if stats := session.Stats(); stats.CatalogQueries != 1 || stats.Byes != 1 {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+}
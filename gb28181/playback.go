@@ -0,0 +1,211 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The MANSRTSP request in INFO body, to control the playback of recording, see GB28181-2016 Annex B.
+type mansRTSPRequest struct {
+	// The method, PLAY, PAUSE or TEARDOWN.
+	Method string
+	CSeq   int
+	// The speed of playback in Scale, 0 if not specified.
+	Scale float64
+	// The position to seek to in Range of npt, relative to the start of recording, ignore if not hasRange.
+	hasRange bool
+	Range    time.Duration
+}
+
+func (v *mansRTSPRequest) String() string {
+	sb := []string{fmt.Sprintf("%v, cseq=%v", v.Method, v.CSeq)}
+	if v.Scale > 0 {
+		sb = append(sb, fmt.Sprintf("scale=%v", v.Scale))
+	}
+	if v.hasRange {
+		sb = append(sb, fmt.Sprintf("range=%v", v.Range))
+	}
+	return strings.Join(sb, ", ")
+}
+
+// Parse the MANSRTSP request, for example:
+//
+//	PLAY MANSRTSP/1.0
+//	CSeq: 2
+//	Scale: 2.0
+//	Range: npt=100-
+//
+// The Range of npt=now- is to resume from the current position, which is not a seek.
+func parseMANSRTSP(body string) (*mansRTSPRequest, error) {
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+
+	fields := strings.Fields(lines[0])
+	if len(fields) != 2 || fields[1] != "MANSRTSP/1.0" {
+		return nil, errors.Errorf("invalid request line %v", lines[0])
+	}
+
+	r := &mansRTSPRequest{Method: strings.ToUpper(fields[0])}
+	switch r.Method {
+	case "PLAY", "PAUSE", "TEARDOWN":
+	default:
+		return nil, errors.Errorf("invalid method %v", fields[0])
+	}
+
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid header %v", line)
+		}
+		value := strings.TrimSpace(kv[1])
+
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "cseq":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse cseq %v", value)
+			}
+			r.CSeq = n
+		case "scale":
+			scale, err := strconv.ParseFloat(value, 64)
+			if err != nil || scale <= 0 {
+				return nil, errors.Errorf("invalid scale %v", value)
+			}
+			r.Scale = scale
+		case "range":
+			npt := strings.SplitN(strings.TrimPrefix(value, "npt="), "-", 2)
+			if len(npt) != 2 || !strings.HasPrefix(value, "npt=") {
+				return nil, errors.Errorf("invalid range %v", value)
+			}
+			start := npt[0]
+			if start == "now" {
+				continue
+			}
+			seconds, err := strconv.ParseFloat(start, 64)
+			if err != nil || seconds < 0 {
+				return nil, errors.Errorf("invalid range %v", value)
+			}
+			r.hasRange, r.Range = true, time.Duration(seconds*float64(time.Second))
+		}
+	}
+	return r, nil
+}
+
+// PlaybackControl is the state of playback controlled by INFO from server, shared by the session which applies the
+// requests, and the ingester which pauses, scales and seeks the stream.
+type PlaybackControl struct {
+	lock sync.Mutex
+	// Whether paused, and the channel to notify the change of state.
+	paused  bool
+	changed chan struct{}
+	// The speed of playback, 1 by default.
+	scale float64
+	// The pending position to seek to, ignore if not hasSeek.
+	hasSeek bool
+	seek    time.Duration
+	// Whether stopped by TEARDOWN.
+	teardown bool
+	// The version of state, increased by each request, for ingester to detect the change.
+	version uint64
+}
+
+func NewPlaybackControl() *PlaybackControl {
+	return &PlaybackControl{changed: make(chan struct{}), scale: 1}
+}
+
+// Apply the MANSRTSP request, PLAY to resume, scale or seek, PAUSE to pause and TEARDOWN to stop.
+func (v *PlaybackControl) Apply(r *mansRTSPRequest) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	switch r.Method {
+	case "PLAY":
+		v.paused = false
+		if r.Scale > 0 {
+			v.scale = r.Scale
+		}
+		if r.hasRange {
+			v.hasSeek, v.seek = true, r.Range
+		}
+	case "PAUSE":
+		v.paused = true
+	case "TEARDOWN":
+		v.paused, v.teardown = false, true
+	}
+
+	v.version++
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+// Wait until not paused, return the version of state.
+func (v *PlaybackControl) Wait(ctx context.Context) (uint64, error) {
+	for {
+		v.lock.Lock()
+		paused, changed, version := v.paused, v.changed, v.version
+		v.lock.Unlock()
+
+		if !paused {
+			return version, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return version, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Scale returns the speed of playback.
+func (v *PlaybackControl) Scale() float64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.scale
+}
+
+// TakeSeek returns and clears the pending position to seek to.
+func (v *PlaybackControl) TakeSeek() (time.Duration, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	seek, hasSeek := v.seek, v.hasSeek
+	v.hasSeek = false
+	return seek, hasSeek
+}
+
+// Teardown whether the playback is stopped by TEARDOWN.
+func (v *PlaybackControl) Teardown() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.teardown
+}
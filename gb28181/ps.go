@@ -21,16 +21,26 @@
 package gb28181
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/cipher"
 	"fmt"
+	"github.com/ossrs/go-oryx-lib/aac"
 	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/yapingcat/gomedia/codec"
 	"github.com/yapingcat/gomedia/mpeg2"
+	"io"
 	"math"
+	"math/rand"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 type PSConfig struct {
@@ -38,8 +48,103 @@ type PSConfig struct {
 	video string
 	// The fps for h264 file.
 	fps int
+	// The rational frame rate in num/den, for example, 30000/1001 for 29.97fps, overwrite fps if not empty.
+	fpsRate string
+	// The policy for gap in numbered video files, error or skip.
+	gap string
 	// The audio source file.
 	audio string
+	// The interval in ms to re-send the PS header(PSM), besides keyframes. 0 to disable.
+	headerInterval int
+	// When to send the PS header(PSM), idr, interval or once, see PSHeaderMode.
+	headerMode string
+	// The UDP address to listen for RTCP RR from server, for example, :9000. Ignore if empty.
+	rtcpAddr string
+	// The file path to write the trace of frames in JSON lines. Ignore if empty.
+	trace string
+	// Whether embed the wall clock in SEI before each IDR, to measure the latency.
+	sei bool
+	// The min size of randomized PES fragment, 0 to use fixed size.
+	fragmentMin int
+	// The seed to randomize the PES fragment, 0 to use current time.
+	fragmentSeed int64
+	// The framing of RTP and RTCP over TCP, rfc4571 or interleaved.
+	framing string
+	// Whether send SR and receive RR over the media connection.
+	rtcpMux bool
+	// Stop when run for the duration, 0 to ignore.
+	maxDuration time.Duration
+	// Stop when sent N video frames, 0 to ignore.
+	maxFrames uint64
+	// Stop when sent N bytes, 0 to ignore.
+	maxBytes uint64
+	// The file path to capture the framed RTP and RTCP packets, in the same framing. Ignore if empty.
+	tee string
+	// The bitrate profile, step, linear or sine, to drop or pad frames to follow the target bitrate. Ignore if empty.
+	bitrateProfile string
+	// The bitrate range in kbps, and the period of profile.
+	bitrateMin    uint64
+	bitrateMax    uint64
+	bitratePeriod time.Duration
+	// Verify the media server by waiting for the duration after connected, fail if closed or reset by server. 0 to
+	// disable, because some servers expect data immediately.
+	verifyTimeout time.Duration
+	// The payload type of audio, 0 to mux audio in the same payload type as video.
+	audioPT int
+	// The RTP clock rate of each payload type, in pt=rate separated by comma, for example, 96=90000,97=44100, to
+	// override the default 90000 for video and sample rate for audio.
+	clockRates string
+	// The fault rules to damage video frames, see ParseFaultRules. Note that it produces non-conformant stream
+	// intentionally, to test the decoder error resilience. Ignore if empty.
+	fault string
+	// The seed of fault injector, 0 to use current time.
+	faultSeed int64
+	// The rules to corrupt PS packets, see ParsePSFaultRules. It's non-conformant intentionally. Ignore if empty.
+	psFault string
+	// The rules to disturb RTP packets, see ParseRTPFaultRules. It's non-conformant intentionally. Ignore if empty.
+	rtpFault string
+	// The gap between RTP packets of a frame, to avoid overrunning the socket buffer of receiver. 0 to send all
+	// packets of frame back-to-back.
+	packetGap time.Duration
+	// The timecodes file of video in mkvmerge format v2, for variable frame rate, overwrite the fps. Ignore if empty.
+	timecodes string
+	// The timestamps file of video, the DTS and PTS in ms of each frame in decode order, for B-frames, overwrite the
+	// fps. Ignore if empty.
+	timestamps string
+	// Whether replay the sources when end, with the timestamps increasing, for long duration test.
+	loop bool
+	// The transport of media, tcp or udp, overwrite the SDP. Use SDP if empty.
+	transport string
+	// The codec of audio file, aac, pcma or pcmu. The G.711 file is raw samples in 8kHz mono.
+	audioCodec string
+	// The stream type of video in PSM, h264, h265, svac or mpeg4, to overwrite the codec of video file, while the
+	// payload is passed through. Use the codec of file if empty.
+	videoCodec string
+	// The speed multiplier of pacing by DTS, for example, 2 to send twice as fast as realtime. 0 is the same as 1.
+	speed float64
+	// The max payload length of video PES, 0 to use the default 1400.
+	pesLength int
+	// The max payload size of RTP, a PES is fragmented to multiple RTP packets if exceeds. 0 to send each PES in one
+	// RTP packet.
+	maxPayload int
+	// The declared and sent streams, av, audio or video, see PSProfile. Detect by the sources if empty.
+	media string
+	// Whether encrypt the PES payload by SM4-CTR with the VKEK of GB35114, see PSPackStream.SetEncryption.
+	sm4 bool
+	// The drift of audio clock relative to video, in ppm like 100ppm, or in ms/min like 6ms/min, positive to make the
+	// audio DTS grow faster than video, see utilParseDrift. Ignore if empty.
+	drift string
+	// The SSRC to overwrite the y= of SDP, which is allowed to collide, for example, the same SSRC for all devices to
+	// simulate the cloned cameras. 0 to use SDP.
+	ssrc uint64
+	// Change the SSRC to a new one every duration without re-INVITE, to test how server handles it. 0 to disable.
+	ssrcChange time.Duration
+	// Reconnect the TCP media at most N times when it drops, 0 to give up. The backoff starts from reconnectBackoff
+	// and doubles for each failure. The sequence number and timestamp continue from where it left off, or restart
+	// like a rebooted camera if reconnectRestart.
+	reconnect        int
+	reconnectBackoff time.Duration
+	reconnectRestart bool
 }
 
 func (v *PSConfig) String() string {
@@ -50,70 +155,1347 @@ func (v *PSConfig) String() string {
 	if v.fps > 0 {
 		sb = append(sb, fmt.Sprintf("fps=%v", v.fps))
 	}
+	if v.fpsRate != "" {
+		sb = append(sb, fmt.Sprintf("rate=%v", v.fpsRate))
+	}
+	if v.gap != "" {
+		sb = append(sb, fmt.Sprintf("gap=%v", v.gap))
+	}
 	if v.audio != "" {
 		sb = append(sb, fmt.Sprintf("audio=%v", v.audio))
 	}
-	return strings.Join(sb, ",")
+	if v.headerInterval > 0 {
+		sb = append(sb, fmt.Sprintf("hi=%v", v.headerInterval))
+	}
+	if v.headerMode != "" && v.headerMode != "idr" {
+		sb = append(sb, fmt.Sprintf("hm=%v", v.headerMode))
+	}
+	if v.rtcpAddr != "" {
+		sb = append(sb, fmt.Sprintf("rtcp=%v", v.rtcpAddr))
+	}
+	if v.trace != "" {
+		sb = append(sb, fmt.Sprintf("trace=%v", v.trace))
+	}
+	if v.sei {
+		sb = append(sb, fmt.Sprintf("sei=%v", v.sei))
+	}
+	if v.fragmentMin > 0 {
+		sb = append(sb, fmt.Sprintf("frag=%v", v.fragmentMin))
+	}
+	if v.fragmentSeed != 0 {
+		sb = append(sb, fmt.Sprintf("seed=%v", v.fragmentSeed))
+	}
+	if v.framing != "" {
+		sb = append(sb, fmt.Sprintf("framing=%v", v.framing))
+	}
+	if v.rtcpMux {
+		sb = append(sb, fmt.Sprintf("rtcp-mux=%v", v.rtcpMux))
+	}
+	if v.maxDuration > 0 {
+		sb = append(sb, fmt.Sprintf("duration=%v", v.maxDuration))
+	}
+	if v.maxFrames > 0 {
+		sb = append(sb, fmt.Sprintf("frames=%v", v.maxFrames))
+	}
+	if v.maxBytes > 0 {
+		sb = append(sb, fmt.Sprintf("bytes=%v", v.maxBytes))
+	}
+	if v.tee != "" {
+		sb = append(sb, fmt.Sprintf("tee=%v", v.tee))
+	}
+	if v.verifyTimeout > 0 {
+		sb = append(sb, fmt.Sprintf("verify=%v", v.verifyTimeout))
+	}
+	if v.bitrateProfile != "" {
+		sb = append(sb, fmt.Sprintf("bitrate=%v(%v-%vkbps/%v)", v.bitrateProfile, v.bitrateMin, v.bitrateMax, v.bitratePeriod))
+	}
+	if v.audioPT > 0 {
+		sb = append(sb, fmt.Sprintf("apt=%v", v.audioPT))
+	}
+	if v.clockRates != "" {
+		sb = append(sb, fmt.Sprintf("clock-rates=%v", v.clockRates))
+	}
+	if v.fault != "" {
+		sb = append(sb, fmt.Sprintf("fault=%v", v.fault))
+	}
+	if v.psFault != "" {
+		sb = append(sb, fmt.Sprintf("ps-fault=%v", v.psFault))
+	}
+	if v.rtpFault != "" {
+		sb = append(sb, fmt.Sprintf("rtp-fault=%v", v.rtpFault))
+	}
+	if v.packetGap > 0 {
+		sb = append(sb, fmt.Sprintf("pg=%v", v.packetGap))
+	}
+	if v.timecodes != "" {
+		sb = append(sb, fmt.Sprintf("timecodes=%v", v.timecodes))
+	}
+	if v.timestamps != "" {
+		sb = append(sb, fmt.Sprintf("timestamps=%v", v.timestamps))
+	}
+	if v.loop {
+		sb = append(sb, "loop")
+	}
+	if v.transport != "" {
+		sb = append(sb, fmt.Sprintf("transport=%v", v.transport))
+	}
+	if v.audioCodec != "" && v.audioCodec != "aac" {
+		sb = append(sb, fmt.Sprintf("acodec=%v", v.audioCodec))
+	}
+	if v.videoCodec != "" {
+		sb = append(sb, fmt.Sprintf("vcodec=%v", v.videoCodec))
+	}
+	if v.speed > 0 && v.speed != 1 {
+		sb = append(sb, fmt.Sprintf("speed=%v", v.speed))
+	}
+	if v.pesLength > 0 && v.pesLength != 1400 {
+		sb = append(sb, fmt.Sprintf("pes=%v", v.pesLength))
+	}
+	if v.maxPayload > 0 {
+		sb = append(sb, fmt.Sprintf("payload=%v", v.maxPayload))
+	}
+	if v.media != "" {
+		sb = append(sb, fmt.Sprintf("media=%v", v.media))
+	}
+	if v.sm4 {
+		sb = append(sb, "sm4")
+	}
+	if v.drift != "" {
+		sb = append(sb, fmt.Sprintf("drift=%v", v.drift))
+	}
+	if v.ssrc > 0 {
+		sb = append(sb, fmt.Sprintf("ssrc=%v", v.ssrc))
+	}
+	if v.ssrcChange > 0 {
+		sb = append(sb, fmt.Sprintf("ssrc-change=%v", v.ssrcChange))
+	}
+	if v.reconnect > 0 {
+		sb = append(sb, fmt.Sprintf("reconnect=%v(%v)", v.reconnect, v.reconnectBackoff))
+	}
+	if v.reconnectRestart {
+		sb = append(sb, "reconnect-restart")
+	}
+	return strings.Join(sb, ",")
+}
+
+// ForChannel returns the config of a channel, when multiple channels stream concurrently. Each channel listens for RTCP
+// at the port offset by its index, and writes the tee and trace to its own file suffixed by the channel ID.
+func (v PSConfig) ForChannel(index int, channelID string) (PSConfig, error) {
+	if v.rtcpAddr != "" {
+		addr, err := utilOffsetPort(v.rtcpAddr, index)
+		if err != nil {
+			return v, errors.Wrapf(err, "rtcp of channel %v", channelID)
+		}
+		v.rtcpAddr = addr
+	}
+	if v.tee != "" {
+		v.tee = utilChannelFile(v.tee, channelID)
+	}
+	if v.trace != "" {
+		v.trace = utilChannelFile(v.trace, channelID)
+	}
+	return v, nil
+}
+
+// The statistic of PSClient, note that the RTCP fields are zero if server never sends RR.
+type PSClientStats struct {
+	// The number of RTP packets sent.
+	Packets uint64
+	// The bytes sent, including the RTP header and framing.
+	Bytes uint64
+	// The RTP payload bytes sent, excluding the RTP header, padding and framing, for the octet count of SR.
+	PayloadBytes uint64
+	// The number of RTCP RR from server for our SSRC.
+	ReceiverReports uint64
+	// The fraction of packets lost since last RR, reported by server.
+	FractionLost uint8
+	// The cumulative number of packets lost, reported by server.
+	TotalLost uint32
+	// The extended highest sequence number received, reported by server.
+	HighestSequence uint32
+	// The interarrival jitter in timestamp units, reported by server.
+	Jitter uint32
+	// The number of PLI or FIR from server for our SSRC.
+	KeyframeRequests uint64
+	// The number of padding only RTP packets sent, included in Packets.
+	PaddingPackets uint64
+	// The send bitrate in bps, updated every second by the bytes sent in the last second.
+	Bitrate uint64
+	// The number of video and audio frames sent, excluding the dropped frames.
+	VideoFrames, AudioFrames uint64
+	// The number of video and audio PES packets sent.
+	PES uint64
+	// The number of SSRC changes without re-INVITE, see PSClient.SetSSRC.
+	SSRCChanges uint64
+	// The number of RR for the previous SSRC after changed, which means the server still tracks the old stream.
+	StaleReports uint64
+	// When the first RTP packet is written to the media connection, zero if none.
+	FirstPacketAt time.Time
+	// The number of reconnects after the media connection dropped, and the total time without connection.
+	Reconnects uint64
+	Downtime   time.Duration
+}
+
+func (v *PSClientStats) String() string {
+	s := fmt.Sprintf("packets=%v, bytes=%v, rr=%v, lost=%v, fraction=%v, highest=%v, jitter=%v, pli=%v, padding=%v, bitrate=%vkbps, video=%v, audio=%v, pes=%v",
+		v.Packets, v.Bytes, v.ReceiverReports, v.TotalLost, v.FractionLost, v.HighestSequence, v.Jitter,
+		v.KeyframeRequests, v.PaddingPackets, v.Bitrate/1000, v.VideoFrames, v.AudioFrames, v.PES,
+	)
+	if v.SSRCChanges > 0 {
+		s += fmt.Sprintf(", ssrc-changes=%v, stale-rr=%v", v.SSRCChanges, v.StaleReports)
+	}
+	if v.Reconnects > 0 {
+		s += fmt.Sprintf(", reconnects=%v, downtime=%v", v.Reconnects, v.Downtime)
+	}
+	return s
+}
+
+// PSPackStreamStats is the statistic of the packets muxed in PSPackStream.
+type PSPackStreamStats struct {
+	// The number of video and audio frames.
+	VideoFrames, AudioFrames uint64
+	// The number of video and audio PES packets.
+	PES uint64
+	// The bytes of PS stream, excluding the RTP header and framing.
+	Bytes uint64
+}
+
+func (v *PSPackStreamStats) String() string {
+	return fmt.Sprintf("video=%v, audio=%v, pes=%v, bytes=%v", v.VideoFrames, v.AudioFrames, v.PES, v.Bytes)
+}
+
+// Count the frames, PES and bytes of packets, each video or audio packet is a frame.
+func utilPSPacketsStats(packs []*PSPacket) PSPackStreamStats {
+	var stats PSPackStreamStats
+	for _, pack := range packs {
+		switch pack.t {
+		case PSPacketTypeVideo:
+			stats.VideoFrames++
+			stats.PES += uint64(len(pack.ps))
+		case PSPacketTypeAudio:
+			stats.AudioFrames++
+			stats.PES += uint64(len(pack.ps))
+		}
+		for _, b := range pack.ps {
+			stats.Bytes += uint64(len(b))
+		}
+	}
+	return stats
+}
+
+// The framing of RTP and RTCP over TCP.
+type PSFraming int
+
+const (
+	// RFC 4571, each packet is prefixed by 2 bytes length in network order. The RTCP is distinguished from RTP by the
+	// packet type in the second byte, which is in [192, 223] for RTCP, see RFC 5761.
+	PSFramingRFC4571 PSFraming = iota
+	// RFC 2326 10.12, each packet is prefixed by 4 bytes, the magic '$', 1 byte channel and 2 bytes length in network
+	// order. The channel is 0 for RTP, 1 for RTCP.
+	PSFramingInterleaved
+)
+
+func (v PSFraming) String() string {
+	if v == PSFramingInterleaved {
+		return "interleaved"
+	}
+	return "rfc4571"
+}
+
+func ParsePSFraming(v string) (PSFraming, error) {
+	switch v {
+	case "", "rfc4571":
+		return PSFramingRFC4571, nil
+	case "interleaved":
+		return PSFramingInterleaved, nil
+	default:
+		return PSFramingRFC4571, errors.Errorf("invalid framing %v", v)
+	}
+}
+
+// The transport of media, TCP with framing, or UDP without framing, which is negotiated by SDP.
+type PSTransport int
+
+const (
+	// The RTP over TCP, TCP/RTP/AVP in SDP, each packet is framed, see PSFraming.
+	PSTransportTCP PSTransport = iota
+	// The RTP over UDP, RTP/AVP in SDP, each packet is a datagram without framing.
+	PSTransportUDP
+)
+
+func (v PSTransport) String() string {
+	if v == PSTransportUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func ParsePSTransport(v string) (PSTransport, error) {
+	switch v {
+	case "", "tcp":
+		return PSTransportTCP, nil
+	case "udp":
+		return PSTransportUDP, nil
+	default:
+		return PSTransportTCP, errors.Errorf("invalid transport %v", v)
+	}
+}
+
+// The mode to send the PS header, that is the pack header with system header and PSM.
+type PSHeaderMode int
+
+const (
+	// Send header on every keyframe, and every header interval if set.
+	PSHeaderModeKeyframe PSHeaderMode = iota
+	// Send header at stream start and every header interval, ignore the keyframes.
+	PSHeaderModeInterval
+	// Send header only once at stream start, to verify the server caches the PSM for players join later.
+	PSHeaderModeOnce
+)
+
+func (v PSHeaderMode) String() string {
+	switch v {
+	case PSHeaderModeInterval:
+		return "interval"
+	case PSHeaderModeOnce:
+		return "once"
+	default:
+		return "idr"
+	}
+}
+
+func ParsePSHeaderMode(v string) (PSHeaderMode, error) {
+	switch v {
+	case "", "idr":
+		return PSHeaderModeKeyframe, nil
+	case "interval":
+		return PSHeaderModeInterval, nil
+	case "once":
+		return PSHeaderModeOnce, nil
+	default:
+		return PSHeaderModeKeyframe, errors.Errorf("invalid header mode %v", v)
+	}
+}
+
+// The video stream types of PSM, which are not defined by gomedia, used by some domestic cameras.
+const (
+	// The MPEG-4 part 2 video, see ISO_IEC_13818-1 Table 2-34 Stream type assignments.
+	PSStreamMPEG4 mpeg2.PS_STREAM_TYPE = 0x10
+	// The SVAC video, see GB/T 28181-2016 Annex C.
+	PSStreamSVAC mpeg2.PS_STREAM_TYPE = 0x80
+)
+
+// ParsePSVideoCodec parses the video codec, h264, h265, svac or mpeg4, to the stream type of PSM. It returns
+// PS_STREAM_UNKNOW if empty, which means to use the codec of video file.
+func ParsePSVideoCodec(v string) (mpeg2.PS_STREAM_TYPE, error) {
+	switch v {
+	case "":
+		return mpeg2.PS_STREAM_UNKNOW, nil
+	case "h264":
+		return mpeg2.PS_STREAM_H264, nil
+	case "h265":
+		return mpeg2.PS_STREAM_H265, nil
+	case "svac":
+		return PSStreamSVAC, nil
+	case "mpeg4":
+		return PSStreamMPEG4, nil
+	default:
+		return mpeg2.PS_STREAM_UNKNOW, errors.Errorf("invalid video codec %v", v)
+	}
+}
+
+// ParsePSAudioCodec parses the audio codec, aac, pcma or pcmu, to the stream type of PSM and the frame codec.
+func ParsePSAudioCodec(v string) (mpeg2.PS_STREAM_TYPE, FrameCodec, error) {
+	switch v {
+	case "", "aac":
+		return mpeg2.PS_STREAM_AAC, FrameCodecAAC, nil
+	case "pcma":
+		return mpeg2.PS_STREAM_G711A, FrameCodecPCMA, nil
+	case "pcmu":
+		return mpeg2.PS_STREAM_G711U, FrameCodecPCMU, nil
+	default:
+		return mpeg2.PS_STREAM_UNKNOW, FrameCodecAAC, errors.Errorf("invalid audio codec %v", v)
+	}
+}
+
+type PSClient struct {
+	// SSRC from SDP.
+	ssrc uint32
+	// The previous SSRC before changed, to identify the stale RR, see SetSSRC.
+	prevSSRC uint32
+	// The server IP address and port to connect to.
+	serverAddr string
+	// Inner state, sequence number.
+	seq uint16
+	// Inner state, media TCP connection
+	conn net.Conn
+	// The transport of media, UDP or TCP.
+	transport PSTransport
+	// The framing of RTP and RTCP over TCP.
+	framing PSFraming
+	// Whether receive RTCP over the media connection.
+	rtcpMux bool
+	// Write the framed packets to tee if not nil, to capture the stream, see PSConfig.tee.
+	tee io.Writer
+	// The hook when got PLI or FIR from server for our SSRC.
+	onKeyframeRequest func()
+	// The payload type and timestamp of last RTP packet, for padding.
+	lastPT uint8
+	lastTS uint32
+	// Verify the server after connected in the duration, see PSConfig.verifyTimeout. 0 to disable.
+	verifyTimeout time.Duration
+	// The data received when verifying.
+	verified []byte
+	// The RTP clock rate of each payload type, default to psClockRate, see SetClockRate.
+	clockRates map[uint8]uint64
+	// The max payload size of RTP, see PSConfig.maxPayload. 0 to send each PES in one RTP packet.
+	maxPayload int
+	// Corrupt the PS packets before sent if not nil, see SetPSFaultInjector.
+	psFault *PSFaultInjector
+	// Disturb the RTP packets when sent if not nil, see SetRTPFaultInjector.
+	rtpFault *RTPFaultInjector
+	// The RTP packet held by reorder of rtpFault, to send after the next one.
+	held *psHeldRTP
+	// The listener of TCP passive, to accept the connection from server, nil to connect to serverAddr.
+	listener *net.TCPListener
+	// Reconnect the TCP media when dropped, see PSConfig.reconnect. The ctx of Connect cancels the backoff.
+	reconnects       int
+	reconnectBackoff time.Duration
+	reconnectRestart bool
+	ctx              context.Context
+	// The PS timestamp of the first packet after restarted by reconnect, the RTP timestamp starts from zero.
+	tsBase  uint64
+	resetTS bool
+	// The max number of recorded RTP headers, 0 to disable, see RecordHeaders.
+	maxHeaders int
+	headers    []PSRTPHeader
+	// Inner state, RTCP UDP connection, nil if not listen.
+	rtcpConn *net.UDPConn
+	// The statistic, protected by lock because RTCP is handled in another coroutine.
+	stats PSClientStats
+	lock  sync.Mutex
+	// The start time and bytes of current window, to update the send bitrate.
+	bitrateAt    time.Time
+	bitrateBytes uint64
+	// WaitGroup for coroutines.
+	wg sync.WaitGroup
+}
+
+// The clock rate of PS system clock, the timestamp of PSPacket is in this rate.
+const psClockRate = 90000
+
+// The max payload length of PES with PTS and DTS, because the PES_packet_length is 16 bits, which includes 13 bytes of
+// the flags and timestamps.
+const psMaxPesLength = 65535 - 13
+
+// The max payload size of RTP, because the length of RFC 4571 framing is 16 bits, which includes 12 bytes RTP header.
+const psMaxRTPPayload = 65535 - 12
+
+// The max backoff to reconnect the media, see PSConfig.reconnectBackoff.
+const psMaxReconnectBackoff = 30 * time.Second
+
+func NewPSClient(ssrc uint32, serverAddr string) *PSClient {
+	return &PSClient{ssrc: ssrc, serverAddr: serverAddr, clockRates: make(map[uint8]uint64)}
+}
+
+// SetClockRate sets the RTP clock rate of payload type, for example, the sample rate for audio. The RTP timestamp is
+// rescaled from the timestamp of PSPacket in 90kHz.
+func (v *PSClient) SetClockRate(pt uint8, rate uint64) {
+	v.clockRates[pt] = rate
+}
+
+// SetPSFaultInjector corrupts the PS packets by the injector before sent over RTP, which produces non-conformant
+// stream intentionally.
+func (v *PSClient) SetPSFaultInjector(fault *PSFaultInjector) {
+	v.psFault = fault
+}
+
+// SetRTPFaultInjector disturbs the sequence number, timestamp and order of RTP packets by the injector, which
+// produces non-conformant stream intentionally.
+func (v *PSClient) SetRTPFaultInjector(fault *RTPFaultInjector) {
+	v.rtpFault = fault
+}
+
+// SSRC returns the SSRC of RTP packets.
+func (v *PSClient) SSRC() uint32 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.ssrc
+}
+
+// SetSSRC changes the SSRC of following RTP packets, without re-INVITE, while the sequence number and timestamp keep
+// increasing. The RR for the previous SSRC is counted as stale.
+func (v *PSClient) SetSSRC(ssrc uint32) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.prevSSRC, v.ssrc = v.ssrc, ssrc
+	v.stats.SSRCChanges++
+}
+
+// ClockRate returns the RTP clock rate of payload type, 90000 if not set.
+func (v *PSClient) ClockRate(pt uint8) uint64 {
+	if rate, ok := v.clockRates[pt]; ok && rate > 0 {
+		return rate
+	}
+	return psClockRate
+}
+
+func (v *PSClient) Close() error {
+	if v.listener != nil {
+		v.listener.Close()
+	}
+	if v.conn != nil {
+		v.conn.Close()
+	}
+	if v.rtcpConn != nil {
+		v.rtcpConn.Close()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+// Stats returns a copy of the current statistic.
+func (v *PSClient) Stats() PSClientStats {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.stats
+}
+
+// ListenRTCP listens at UDP addr and handles RTCP RR from server in a coroutine, so it never blocks the media
+// even if server doesn't send any RTCP.
+func (v *PSClient) ListenRTCP(ctx context.Context, addr string) error {
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "parse rtcp addr=%v", addr)
+	}
+
+	if v.rtcpConn, err = net.ListenUDP("udp", uaddr); err != nil {
+		return errors.Wrapf(err, "listen rtcp addr=%v", addr)
+	}
+	logger.Tf(ctx, "Listen RTCP at %v, ssrc=%v", v.rtcpConn.LocalAddr(), v.ssrc)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := v.rtcpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			if err = v.handleRTCP(buf[:n]); err != nil {
+				logger.Wf(ctx, "Ignore RTCP %v bytes, err %+v", n, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (v *PSClient) handleRTCP(b []byte) error {
+	pkts, err := rtcp.Unmarshal(b)
+	if err != nil {
+		return errors.Wrapf(err, "rtcp unmarshal")
+	}
+
+	// The SSRC might be changed by SetSSRC when sending.
+	v.lock.Lock()
+	ssrc, prevSSRC, changed := v.ssrc, v.prevSSRC, v.stats.SSRCChanges > 0
+	v.lock.Unlock()
+
+	for _, pkt := range pkts {
+		// The keyframe request by PLI or FIR, see RFC 4585 and RFC 5104.
+		var keyframeRequest bool
+		if pli, ok := pkt.(*rtcp.PictureLossIndication); ok {
+			keyframeRequest = pli.MediaSSRC == ssrc
+		} else if fir, ok := pkt.(*rtcp.FullIntraRequest); ok {
+			for _, entry := range fir.FIR {
+				keyframeRequest = keyframeRequest || entry.SSRC == ssrc
+			}
+		}
+
+		if keyframeRequest {
+			v.lock.Lock()
+			v.stats.KeyframeRequests++
+			v.lock.Unlock()
+
+			if v.onKeyframeRequest != nil {
+				v.onKeyframeRequest()
+			}
+		}
+
+		var reports []rtcp.ReceptionReport
+		if rr, ok := pkt.(*rtcp.ReceiverReport); ok {
+			reports = rr.Reports
+		} else if sr, ok := pkt.(*rtcp.SenderReport); ok {
+			reports = sr.Reports
+		}
+
+		for _, report := range reports {
+			if changed && report.SSRC == prevSSRC && prevSSRC != ssrc {
+				v.lock.Lock()
+				v.stats.StaleReports++
+				v.lock.Unlock()
+			}
+			if report.SSRC != ssrc {
+				continue
+			}
+
+			v.lock.Lock()
+			v.stats.ReceiverReports++
+			v.stats.FractionLost = report.FractionLost
+			v.stats.TotalLost = report.TotalLost
+			v.stats.HighestSequence = report.LastSequenceNumber
+			v.stats.Jitter = report.Jitter
+			v.lock.Unlock()
+		}
+	}
+
+	return nil
+}
+
+func (v *PSClient) Connect(ctx context.Context) error {
+	v.ctx = ctx
+	if v.transport == PSTransportUDP {
+		return v.connectUDP(ctx)
+	}
+	return v.connectTCP(ctx)
+}
+
+// Connect to server over TCP, or accept the connection from server for TCP passive.
+func (v *PSClient) connectTCP(ctx context.Context) error {
+	if v.listener != nil {
+		if err := v.accept(ctx); err != nil {
+			return errors.Wrapf(err, "accept at %v", v.listener.Addr())
+		}
+	} else if u, err := url.Parse(v.serverAddr); err != nil {
+		return errors.Wrapf(err, "parse addr=%v", v.serverAddr)
+	} else if addr, err := net.ResolveTCPAddr(u.Scheme, u.Host); err != nil {
+		return errors.Wrapf(err, "parse addr=%v, scheme=%v, host=%v", v.serverAddr, u.Scheme, u.Host)
+	} else if v.conn, err = net.DialTCP(u.Scheme, nil, addr); err != nil {
+		return errors.Wrapf(err, "connect addr=%v as %v", v.serverAddr, addr.String())
+	}
+
+	if v.verifyTimeout > 0 {
+		if err := v.verify(); err != nil {
+			v.conn.Close()
+			return errors.Wrapf(err, "verify addr=%v", v.serverAddr)
+		}
+	}
+
+	if v.rtcpMux {
+		v.wg.Add(1)
+		go func(conn net.Conn, verified []byte) {
+			defer v.wg.Done()
+
+			if err := v.readRTCPOverTCP(conn, verified); err != nil && ctx.Err() == nil {
+				logger.Wf(ctx, "Ignore RTCP over TCP err %+v", err)
+			}
+		}(v.conn, v.verified)
+	}
+
+	return nil
+}
+
+// Accept the connection from server for TCP passive, and close the listener because only one connection is expected,
+// unless reconnect is enabled, which waits for server to connect again.
+func (v *PSClient) accept(ctx context.Context) error {
+	if v.reconnects <= 0 {
+		defer v.listener.Close()
+	}
+
+	// Unblock the accept when ctx done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			v.listener.Close()
+		case <-done:
+		}
+	}()
+
+	conn, err := v.listener.AcceptTCP()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.Wrap(err, "accept")
+	}
+
+	v.conn = conn
+	return nil
+}
+
+// Connect to server over UDP, the RTCP is received over the same socket if rtcpMux. Note that the server is not
+// verified, because UDP is connectionless.
+func (v *PSClient) connectUDP(ctx context.Context) error {
+	var conn *net.UDPConn
+	if u, err := url.Parse(v.serverAddr); err != nil {
+		return errors.Wrapf(err, "parse addr=%v", v.serverAddr)
+	} else if addr, err := net.ResolveUDPAddr("udp", u.Host); err != nil {
+		return errors.Wrapf(err, "parse addr=%v, host=%v", v.serverAddr, u.Host)
+	} else if conn, err = net.DialUDP("udp", nil, addr); err != nil {
+		return errors.Wrapf(err, "connect addr=%v as %v", v.serverAddr, addr.String())
+	}
+	v.conn = conn
+
+	if v.rtcpMux {
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+
+			if err := v.readRTCPOverUDP(); err != nil && ctx.Err() == nil {
+				logger.Wf(ctx, "Ignore RTCP over UDP err %+v", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Read the RTCP packets over UDP, ignore the RTP packets, see RFC 5761.
+func (v *PSClient) readRTCPOverUDP() error {
+	b := make([]byte, 1500)
+	for {
+		n, err := v.conn.Read(b)
+		if err != nil {
+			return errors.Wrap(err, "read")
+		}
+
+		if n < 2 || b[1] < 192 || b[1] > 223 {
+			continue
+		}
+
+		if err := v.handleRTCP(b[:n]); err != nil {
+			logger.Wf(v.ctx, "Ignore RTCP %v bytes, err %+v", n, err)
+		}
+	}
+}
+
+// Verify the server after connected, by waiting for verifyTimeout, and fail if the server closes or resets the
+// connection immediately, which generally means a wrong port. The received data during verifying is kept for reader.
+func (v *PSClient) verify() error {
+	if err := v.conn.SetReadDeadline(time.Now().Add(v.verifyTimeout)); err != nil {
+		return errors.Wrapf(err, "set deadline")
+	}
+
+	b := make([]byte, 1500)
+	n, err := v.conn.Read(b)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		err = nil
+	}
+	if err == io.EOF {
+		return errors.New("closed by server, please check the media port")
+	} else if err != nil {
+		return errors.Wrapf(err, "read, please check the media port")
+	}
+
+	if err := v.conn.SetReadDeadline(time.Time{}); err != nil {
+		return errors.Wrapf(err, "reset deadline")
+	}
+
+	v.verified = b[:n]
+	return nil
+}
+
+// Read the RTCP from server over the media connection, and ignore the RTP.
+func (v *PSClient) readRTCPOverTCP(conn net.Conn, verified []byte) error {
+	// Skip the corrupt packet to find the next one, rather than stop reading RTCP for the rest of session.
+	r := NewPSFrameReader(io.MultiReader(bytes.NewReader(verified), conn), v.framing)
+	r.SetRecover(true)
+
+	var skipped int64
+	for {
+		b, isRTCP, err := r.ReadPacket()
+		if err != nil {
+			return errors.Wrap(err, "read")
+		}
+
+		if n := r.Skipped(); n > skipped {
+			logger.Wf(v.ctx, "Ignore %v bytes of corrupt packet", n-skipped)
+			skipped = n
+		}
+
+		if !isRTCP {
+			continue
+		}
+
+		if err := v.handleRTCP(b); err != nil {
+			logger.Wf(v.ctx, "Ignore RTCP %v bytes, err %+v", len(b), err)
+		}
+	}
+}
+
+// PSFrameReader reads the RTP or RTCP packets over TCP, see PSFraming. It validates the framing strictly, and fails
+// with the stream offset when got invalid framing, or skips bytes to recover if enabled.
+type PSFrameReader struct {
+	r       *bufio.Reader
+	framing PSFraming
+	// The max length of packet, larger is invalid.
+	maxLength int
+	// Whether skip the invalid bytes to recover the framing, rather than fail.
+	recover bool
+	// The offset of stream, in bytes.
+	offset int64
+	// The bytes skipped to recover the framing.
+	skipped int64
+}
+
+func NewPSFrameReader(r io.Reader, framing PSFraming) *PSFrameReader {
+	return &PSFrameReader{r: bufio.NewReaderSize(r, 65535+4), framing: framing, maxLength: 65535}
+}
+
+// SetMaxLength sets the max length of packet, should be in (0, 65535].
+func (v *PSFrameReader) SetMaxLength(n int) {
+	v.maxLength = n
+}
+
+// SetRecover enables to skip the invalid bytes to recover the framing.
+func (v *PSFrameReader) SetRecover(enabled bool) {
+	v.recover = enabled
+}
+
+// Offset returns the offset of stream, in bytes.
+func (v *PSFrameReader) Offset() int64 {
+	return v.offset
+}
+
+// Skipped returns the bytes skipped to recover the framing.
+func (v *PSFrameReader) Skipped() int64 {
+	return v.skipped
+}
+
+// ReadPacket reads a RTP or RTCP packet, returns io.EOF when stream ends at packet boundary.
+func (v *PSFrameReader) ReadPacket() (b []byte, isRTCP bool, err error) {
+	headerSize := 2
+	if v.framing == PSFramingInterleaved {
+		headerSize = 4
+	}
+
+	for {
+		header, err := v.r.Peek(headerSize)
+		if err == io.EOF && len(header) == 0 {
+			return nil, false, io.EOF
+		} else if err != nil {
+			return nil, false, errors.Wrapf(err, "truncated header %v bytes at offset %v", len(header), v.offset)
+		}
+
+		var size int
+		var reason string
+		if v.framing == PSFramingInterleaved {
+			size, isRTCP = int(header[2])<<8|int(header[3]), header[1] == 1
+			if header[0] != '$' {
+				reason = fmt.Sprintf("invalid magic %v", header[0])
+			} else if header[1] > 1 {
+				reason = fmt.Sprintf("invalid channel %v", header[1])
+			}
+		} else {
+			size = int(header[0])<<8 | int(header[1])
+		}
+
+		if reason == "" && size == 0 {
+			reason = "zero length"
+		} else if reason == "" && size > v.maxLength {
+			reason = fmt.Sprintf("length %v exceeds %v", size, v.maxLength)
+		}
+
+		if reason == "" {
+			packet, err := v.r.Peek(headerSize + size)
+			if err != nil && (!v.recover || err != io.EOF) {
+				return nil, false, errors.Wrapf(err, "truncated packet %v of %v bytes at offset %v",
+					len(packet)-headerSize, size, v.offset)
+			}
+
+			b = packet[headerSize:]
+			if v.framing == PSFramingRFC4571 {
+				isRTCP = len(b) > 1 && b[1] >= 192 && b[1] <= 223
+			}
+
+			if len(b) < size {
+				// Only when recovering, the length is plausible but the stream ends.
+				reason = fmt.Sprintf("truncated packet %v of %v bytes", len(b), size)
+			} else if b[0]>>6 != 2 {
+				reason = fmt.Sprintf("invalid version %v", b[0]>>6)
+			} else if isRTCP {
+				if _, err := rtcp.Unmarshal(b); err != nil {
+					reason = fmt.Sprintf("invalid rtcp, %v", err)
+				}
+			} else if err := (&rtp.Packet{}).Unmarshal(b); err != nil {
+				reason = fmt.Sprintf("invalid rtp, %v", err)
+			}
+		}
+
+		if reason != "" {
+			if !v.recover {
+				return nil, false, errors.Errorf("%v at offset %v", reason, v.offset)
+			}
+
+			// Skip one byte and try again, to find the next valid packet.
+			v.r.Discard(1)
+			v.offset++
+			v.skipped++
+			continue
+		}
+
+		// Copy the packet, because the buffer is reused.
+		b = append([]byte(nil), b...)
+		v.r.Discard(headerSize + size)
+		v.offset += int64(headerSize + size)
+		return b, isRTCP, nil
+	}
+}
+
+// The buffers to frame the RTP or RTCP packet, to avoid allocation for each packet.
+var psFramePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1500)
+		return &b
+	},
+}
+
+// Build the framing header for packet of size, see PSFraming. No framing for UDP.
+func (v *PSClient) appendFramingHeader(b []byte, size int, isRTCP bool) []byte {
+	if v.transport == PSTransportUDP {
+		return b
+	}
+	if v.framing == PSFramingInterleaved {
+		var channel uint8
+		if isRTCP {
+			channel = 1
+		}
+		return append(b, '$', channel, uint8(size>>8), uint8(size))
+	}
+	return append(b, uint8(size>>8), uint8(size))
+}
+
+// The packet is dropped when the TCP media restarted, so it's never sent and should not be counted.
+var errPSDropped = errors.New("dropped by restart")
+
+// Write the framed RTP or RTCP packet in one write. If the TCP media drops, reconnect and send the packet again, or
+// drop it and return errPSDropped if restart, because its sequence number is before the restarted one.
+func (v *PSClient) writeFramed(b []byte) error {
+	if _, err := v.conn.Write(b); err != nil {
+		if v.reconnects <= 0 || v.transport != PSTransportTCP {
+			return errors.Wrapf(err, "write %v bytes", len(b))
+		}
+		if r0 := v.reconnect(err); r0 != nil {
+			return errors.Wrapf(r0, "write %v bytes", len(b))
+		}
+		if v.reconnectRestart {
+			return errPSDropped
+		}
+		if _, err := v.conn.Write(b); err != nil {
+			return errors.Wrapf(err, "write %v bytes after reconnected", len(b))
+		}
+	}
+
+	if v.tee != nil {
+		if _, err := v.tee.Write(b); err != nil {
+			return errors.Wrapf(err, "tee %v bytes", len(b))
+		}
+	}
+
+	v.lock.Lock()
+	v.stats.Bytes += uint64(len(b))
+	v.updateBitrate(time.Now())
+	v.lock.Unlock()
+	return nil
 }
 
-type PSClient struct {
-	// SSRC from SDP.
-	ssrc uint32
-	// The server IP address and port to connect to.
-	serverAddr string
-	// Inner state, sequence number.
-	seq uint16
-	// Inner state, media TCP connection
-	conn *net.TCPConn
+// Reconnect the TCP media after the connection dropped by cause, retry with exponential backoff for at most
+// reconnects times. For TCP passive, wait for server to connect again. The sequence number and timestamp restart from
+// random and zero if reconnectRestart, otherwise continue.
+func (v *PSClient) reconnect(cause error) error {
+	v.conn.Close()
+	droppedAt := time.Now()
+	logger.Wf(v.ctx, "PS: Media dropped, ssrc=%v, seq=%v, err %v", v.ssrc, v.seq, cause)
+
+	backoff := v.reconnectBackoff
+	for i := 1; i <= v.reconnects; i++ {
+		select {
+		case <-v.ctx.Done():
+			return v.ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		if err := v.connectTCP(v.ctx); err != nil {
+			logger.Wf(v.ctx, "PS: Reconnect %v/%v media=%v err %+v", i, v.reconnects, v.serverAddr, err)
+			if backoff *= 2; backoff > psMaxReconnectBackoff {
+				backoff = psMaxReconnectBackoff
+			}
+			continue
+		}
+
+		if v.reconnectRestart {
+			v.seq, v.resetTS = uint16(rand.Uint32()), true
+		}
+
+		v.lock.Lock()
+		v.stats.Reconnects++
+		v.stats.Downtime += time.Since(droppedAt)
+		v.lock.Unlock()
+
+		logger.Tf(v.ctx, "PS: Reconnected %v/%v media=%v, ssrc=%v, seq=%v, restart=%v, downtime=%v", i, v.reconnects,
+			v.serverAddr, v.ssrc, v.seq, v.reconnectRestart, time.Since(droppedAt))
+		return nil
+	}
+	return errors.Wrapf(cause, "reconnect %v times", v.reconnects)
 }
 
-func NewPSClient(ssrc uint32, serverAddr string) *PSClient {
-	return &PSClient{ssrc: ssrc, serverAddr: serverAddr}
+// Update the send bitrate when the window is over 1s, by the bytes sent in the window. Should be called with lock.
+func (v *PSClient) updateBitrate(now time.Time) {
+	if v.bitrateAt.IsZero() {
+		v.bitrateAt = now
+		return
+	}
+
+	if elapsed := now.Sub(v.bitrateAt); elapsed >= time.Second {
+		v.stats.Bitrate = uint64(float64(v.stats.Bytes-v.bitrateBytes) * 8 / elapsed.Seconds())
+		v.bitrateAt, v.bitrateBytes = now, v.stats.Bytes
+	}
 }
 
-func (v *PSClient) Close() error {
-	if v.conn != nil {
-		v.conn.Close()
+// Write the RTP or RTCP packet over TCP, see PSFraming.
+func (v *PSClient) writeOverTCP(b []byte, isRTCP bool) error {
+	pb := psFramePool.Get().(*[]byte)
+	defer psFramePool.Put(pb)
+
+	*pb = append(v.appendFramingHeader((*pb)[:0], len(b), isRTCP), b...)
+	if err := v.writeFramed(*pb); err != errPSDropped {
+		return err
 	}
 	return nil
 }
 
-func (v *PSClient) Connect(ctx context.Context) error {
-	if u, err := url.Parse(v.serverAddr); err != nil {
-		return errors.Wrapf(err, "parse addr=%v", v.serverAddr)
-	} else if addr, err := net.ResolveTCPAddr(u.Scheme, u.Host); err != nil {
-		return errors.Wrapf(err, "parse addr=%v, scheme=%v, host=%v", v.serverAddr, u.Scheme, u.Host)
-	} else if v.conn, err = net.DialTCP(u.Scheme, nil, addr); err != nil {
-		return errors.Wrapf(err, "connect addr=%v as %v", v.serverAddr, addr.String())
+// Write the RTP packet over TCP, marshal the RTP header in place to avoid allocation. If padding is not zero, set the
+// padding bit and append padding bytes, the last byte is the padding length, see RFC 3550 5.1. Return errPSDropped
+// without stats and header if the packet is dropped by restart.
+func (v *PSClient) writeRTPOverTCP(pt uint8, ts uint32, payload []byte, padding uint8) error {
+	pb := psFramePool.Get().(*[]byte)
+	defer psFramePool.Put(pb)
+
+	// The RTP header is 12 bytes, version 2, without extension, CSRC and marker.
+	b0 := uint8(0x80)
+	if padding > 0 {
+		b0 |= 0x20
+	}
+
+	b := v.appendFramingHeader((*pb)[:0], 12+len(payload)+int(padding), false)
+	b = append(b, b0, pt&0x7f, uint8(v.seq>>8), uint8(v.seq),
+		uint8(ts>>24), uint8(ts>>16), uint8(ts>>8), uint8(ts),
+		uint8(v.ssrc>>24), uint8(v.ssrc>>16), uint8(v.ssrc>>8), uint8(v.ssrc),
+	)
+	b = append(b, payload...)
+	if padding > 0 {
+		for i := 0; i < int(padding)-1; i++ {
+			b = append(b, 0)
+		}
+		b = append(b, padding)
+	}
+	*pb = b
+
+	v.lastPT, v.lastTS = pt, ts
+	if err := v.writeFramed(b); err != nil {
+		return err
+	}
+
+	// The stats and headers are read by other goroutines, and RecordHeaders might change maxHeaders while sending.
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.stats.PayloadBytes += uint64(len(payload))
+	if v.stats.Packets == 0 {
+		v.stats.FirstPacketAt = time.Now()
+	}
+
+	if v.maxHeaders > 0 {
+		if len(v.headers) >= v.maxHeaders {
+			v.headers = v.headers[1:]
+		}
+		v.headers = append(v.headers, PSRTPHeader{
+			SSRC: v.ssrc, SequenceNumber: v.seq, Timestamp: ts, PayloadType: pt & 0x7f, Padding: padding,
+			PayloadSize: len(payload),
+		})
+	}
+	return nil
+}
+
+// PSRTPHeader is the header of a sent RTP packet, recorded to verify the send logic, see PSClient.RecordHeaders.
+type PSRTPHeader struct {
+	SSRC           uint32
+	SequenceNumber uint16
+	Timestamp      uint32
+	PayloadType    uint8
+	// The padding bytes, 0 if no padding.
+	Padding uint8
+	// The payload size, excluding the header and padding.
+	PayloadSize int
+}
+
+// RecordHeaders records the headers of the latest max RTP packets, 0 to disable, see Headers.
+func (v *PSClient) RecordHeaders(max int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.maxHeaders = max
+	if max <= 0 {
+		v.headers = nil
+	} else if len(v.headers) > max {
+		v.headers = v.headers[len(v.headers)-max:]
+	}
+}
+
+// Headers returns a copy of the recorded RTP headers, in the order of sending.
+func (v *PSClient) Headers() []PSRTPHeader {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return append([]PSRTPHeader{}, v.headers...)
+}
+
+// VerifyRTPContinuity verifies the headers have the constant SSRC, and the sequence number increases by one, modulo
+// the wrap around of 16 bits.
+func VerifyRTPContinuity(headers []PSRTPHeader) error {
+	for i := 1; i < len(headers); i++ {
+		prev, h := &headers[i-1], &headers[i]
+		if h.SSRC != prev.SSRC {
+			return errors.Errorf("SSRC changed from %v to %v at %v", prev.SSRC, h.SSRC, i)
+		}
+		if h.SequenceNumber != prev.SequenceNumber+1 {
+			return errors.Errorf("sequence discontinuity from %v to %v at %v", prev.SequenceNumber, h.SequenceNumber, i)
+		}
+	}
+	return nil
+}
+
+// WritePadding writes a padding only RTP packet, with n bytes padding in [1, 255] and empty payload, which consumes a
+// sequence number, for bandwidth probing or keeping the connection warm. It uses the payload type and timestamp of the
+// last RTP packet.
+func (v *PSClient) WritePadding(n int) error {
+	if n <= 0 || n > 255 {
+		return errors.Errorf("invalid padding %v, should in [1, 255]", n)
+	}
+
+	v.seq++
+	if err := v.writeRTPOverTCP(v.lastPT, v.lastTS, nil, uint8(n)); err == errPSDropped {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "write padding %v", n)
 	}
 
+	v.lock.Lock()
+	v.stats.Packets++
+	v.stats.PaddingPackets++
+	v.lock.Unlock()
 	return nil
 }
 
+// WriteRTCP writes the RTCP packets over the media connection.
+func (v *PSClient) WriteRTCP(pkts []rtcp.Packet) error {
+	b, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return errors.Wrapf(err, "rtcp marshal")
+	}
+
+	return v.writeOverTCP(b, true)
+}
+
+// WriteSenderReport writes the RTCP SR over the media connection, the ts is the RTP timestamp of time now. The octet
+// count is the RTP payload bytes, see RFC 3550 section 6.4.1.
+func (v *PSClient) WriteSenderReport(now time.Time, ts uint32) error {
+	stats := v.Stats()
+	return v.WriteRTCP([]rtcp.Packet{&rtcp.SenderReport{
+		SSRC: v.ssrc, NTPTime: utilToNTPTime(now), RTPTime: ts,
+		PacketCount: uint32(stats.Packets), OctetCount: uint32(stats.PayloadBytes),
+	}})
+}
+
 func (v *PSClient) WritePacksOverRTP(packs []*PSPacket) error {
+	if v.psFault != nil {
+		packs = v.psFault.Apply(packs)
+	}
+
 	for _, pack := range packs {
 		for _, payload := range pack.ps {
-			v.seq++
-			p := rtp.Packet{Header: rtp.Header{
-				Version: 2, PayloadType: uint8(pack.pt), SequenceNumber: v.seq,
-				Timestamp: uint32(pack.ts), SSRC: uint32(v.ssrc),
-			}, Payload: payload}
-
-			b, err := p.Marshal()
-			if err != nil {
-				return errors.Wrapf(err, "rtp marshal")
+			for _, fragment := range v.fragment(payload) {
+				if err := v.writePSOverRTP(pack, fragment); err != nil {
+					return err
+				}
 			}
+		}
+	}
 
-			if _, err = v.conn.Write([]byte{uint8(len(b) >> 8), uint8(len(b))}); err != nil {
-				return errors.Wrapf(err, "write length=%v", len(b))
-			}
+	if err := v.flushHeld(); err != nil {
+		return err
+	}
+
+	v.updatePackStats(packs)
+	return nil
+}
+
+// Update the frames and PES sent, by the packets which are all sent.
+func (v *PSClient) updatePackStats(packs []*PSPacket) {
+	stats := utilPSPacketsStats(packs)
 
-			if _, err = v.conn.Write(b); err != nil {
-				return errors.Wrapf(err, "write payload %v bytes", len(b))
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.stats.VideoFrames += stats.VideoFrames
+	v.stats.AudioFrames += stats.AudioFrames
+	v.stats.PES += stats.PES
+}
+
+// Fragment the PS payload to RTP payloads by the max payload size. The PS over RTP is a byte stream, so the receiver
+// reassembles the PES across RTP packets.
+func (v *PSClient) fragment(payload []byte) [][]byte {
+	if v.maxPayload <= 0 || len(payload) <= v.maxPayload {
+		return [][]byte{payload}
+	}
+
+	fragments := make([][]byte, 0, (len(payload)+v.maxPayload-1)/v.maxPayload)
+	for len(payload) > 0 {
+		n := v.maxPayload
+		if n > len(payload) {
+			n = len(payload)
+		}
+		fragments, payload = append(fragments, payload[:n]), payload[n:]
+	}
+	return fragments
+}
+
+// WritePacksOverRTPPaced writes the packets like WritePacksOverRTP, but waits for gap between RTP packets, to avoid
+// overrunning the small socket buffer of receiver. The gap is reduced to deliver all packets before deadline, which
+// is generally the send time of next frame.
+func (v *PSClient) WritePacksOverRTPPaced(packs []*PSPacket, gap time.Duration, deadline time.Time) error {
+	if v.psFault != nil {
+		packs = v.psFault.Apply(packs)
+	}
+
+	var remaining int
+	for _, pack := range packs {
+		for _, payload := range pack.ps {
+			remaining += len(v.fragment(payload))
+		}
+	}
+
+	for _, pack := range packs {
+		for _, payload := range pack.ps {
+			for _, fragment := range v.fragment(payload) {
+				if err := v.writePSOverRTP(pack, fragment); err != nil {
+					return err
+				}
+
+				// Never wait after the last packet, and shrink the gap if not enough time left, with a margin for
+				// writing.
+				if remaining--; remaining > 0 {
+					d := gap
+					if left := time.Until(deadline) / time.Duration(remaining+1); left < d {
+						d = left
+					}
+					if d > 0 {
+						time.Sleep(d)
+					}
+				}
 			}
 		}
 	}
 
+	if err := v.flushHeld(); err != nil {
+		return err
+	}
+
+	v.updatePackStats(packs)
+	return nil
+}
+
+func (v *PSClient) writePSOverRTP(pack *PSPacket, payload []byte) error {
+	v.seq++
+
+	// The RTP timestamp wraps around, so it's safe to subtract the base even if the packet is before it.
+	if v.resetTS {
+		v.tsBase, v.resetTS = pack.ts, false
+	}
+	rate := v.ClockRate(pack.pt)
+	ts := uint32(utilRescaleTimestamp(pack.ts, psClockRate, rate)) - uint32(utilRescaleTimestamp(v.tsBase, psClockRate, rate))
+	if v.rtpFault != nil {
+		return v.writeRTPWithFault(pack.pt, ts, payload)
+	}
+
+	if err := v.writeRTPOverTCP(pack.pt, ts, payload, 0); err == errPSDropped {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "write rtp")
+	}
+
+	v.lock.Lock()
+	v.stats.Packets++
+	v.lock.Unlock()
+	return nil
+}
+
+// The RTP packet held by reorder, with its sequence number.
+type psHeldRTP struct {
+	pt      uint8
+	seq     uint16
+	ts      uint32
+	payload []byte
+}
+
+// Write the RTP packet disturbed by rtpFault, which might jump the sequence number, rollback the timestamp, duplicate
+// the packet, or hold it to send after the next one.
+func (v *PSClient) writeRTPWithFault(pt uint8, ts uint32, payload []byte) error {
+	fault := v.rtpFault
+	v.seq += fault.SeqGap()
+	ts = fault.Rollback(ts, v.ClockRate(pt))
+
+	// Only hold one packet, the payload is copied because the caller might reuse it.
+	if v.held == nil && fault.Reorder() {
+		v.held = &psHeldRTP{pt: pt, seq: v.seq, ts: ts, payload: append([]byte{}, payload...)}
+		return nil
+	}
+
+	n := 1
+	if fault.Duplicate() {
+		n = 2
+	}
+	for i := 0; i < n; i++ {
+		if err := v.writeRTPOverTCP(pt, ts, payload, 0); err == errPSDropped {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "write rtp")
+		}
+
+		v.lock.Lock()
+		v.stats.Packets++
+		v.lock.Unlock()
+	}
+
+	return v.flushHeld()
+}
+
+// Send the packet held by reorder with its own sequence number, then restore the sequence number.
+func (v *PSClient) flushHeld() error {
+	held := v.held
+	if held == nil {
+		return nil
+	}
+	v.held = nil
+
+	seq := v.seq
+	v.seq = held.seq
+	err := v.writeRTPOverTCP(held.pt, held.ts, held.payload, 0)
+	v.seq = seq
+	if err == errPSDropped {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "write held rtp")
+	}
+
+	v.lock.Lock()
+	v.stats.Packets++
+	v.lock.Unlock()
 	return nil
 }
 
@@ -125,17 +1507,39 @@ const (
 	PSPacketTypeProgramStramMap
 	PSPacketTypeVideo
 	PSPacketTypeAudio
+	PSPacketTypeEndOfStream
 )
 
+func (v PSPacketType) String() string {
+	switch v {
+	case PSPacketTypePackHeader:
+		return "PackHeader"
+	case PSPacketTypeSystemHeader:
+		return "SystemHeader"
+	case PSPacketTypeProgramStramMap:
+		return "PSM"
+	case PSPacketTypeVideo:
+		return "Video"
+	case PSPacketTypeAudio:
+		return "Audio"
+	case PSPacketTypeEndOfStream:
+		return "EndOfStream"
+	default:
+		return "Unknown"
+	}
+}
+
 type PSPacket struct {
 	t  PSPacketType
 	ts uint64
-	pt uint8
-	ps [][]byte
+	// The PTS of frame, which is larger than ts(DTS) for reordered video frames, for example, B-frames.
+	pts uint64
+	pt  uint8
+	ps  [][]byte
 }
 
 func NewPSPacket(t PSPacketType, p []byte, ts uint64, pt uint8) *PSPacket {
-	v := &PSPacket{t: t, ts: ts, pt: pt}
+	v := &PSPacket{t: t, ts: ts, pts: ts, pt: pt}
 	if p != nil {
 		v.ps = append(v.ps, p)
 	}
@@ -147,19 +1551,180 @@ func (v *PSPacket) Append(p []byte) *PSPacket {
 	return v
 }
 
+// Type returns the type of packet, for example, video or PSM.
+func (v *PSPacket) Type() PSPacketType {
+	return v.t
+}
+
+// Timestamp returns the timestamp in clock rate of session, which is the RTP timestamp.
+func (v *PSPacket) Timestamp() uint64 {
+	return v.ts
+}
+
+// PayloadType returns the RTP payload type.
+func (v *PSPacket) PayloadType() uint8 {
+	return v.pt
+}
+
+// Payloads returns the PS data, each is the payload of a RTP packet, should not be modified.
+func (v *PSPacket) Payloads() [][]byte {
+	return v.ps
+}
+
+// Copy the packet with other PS data, for example, the corrupted data by PSFaultInjector.
+func (v *PSPacket) copyWith(ps [][]byte) *PSPacket {
+	return &PSPacket{t: v.t, ts: v.ts, pts: v.pts, pt: v.pt, ps: ps}
+}
+
+// The profile of PS stream, which streams are declared in system header and PSM, because some platforms reject the
+// declared but absent stream, or the undeclared stream.
+type PSProfile int
+
+const (
+	PSProfileAudioVideo PSProfile = iota
+	PSProfileVideoOnly
+	PSProfileAudioOnly
+)
+
+func (v PSProfile) String() string {
+	switch v {
+	case PSProfileVideoOnly:
+		return "video"
+	case PSProfileAudioOnly:
+		return "audio"
+	default:
+		return "av"
+	}
+}
+
+// ParsePSProfile parses the profile av, audio or video, for example, the audio talk device or video only camera.
+func ParsePSProfile(v string) (PSProfile, error) {
+	switch v {
+	case "av":
+		return PSProfileAudioVideo, nil
+	case "video":
+		return PSProfileVideoOnly, nil
+	case "audio":
+		return PSProfileAudioOnly, nil
+	default:
+		return PSProfileAudioVideo, errors.Errorf("invalid profile %v", v)
+	}
+}
+
+func (v PSProfile) HasVideo() bool {
+	return v != PSProfileAudioOnly
+}
+
+func (v PSProfile) HasAudio() bool {
+	return v != PSProfileVideoOnly
+}
+
 type PSPackStream struct {
 	// The RTP paload type.
 	pt uint8
+	// The RTP payload type of audio, default to pt, see SetAudioPayloadType.
+	audioPT uint8
+	// The audio codec in PSM, AAC, G.711A or G.711U, see SetAudioCodec.
+	audioCodec mpeg2.PS_STREAM_TYPE
+	// The declared streams in system header and PSM.
+	profile PSProfile
 	// Split a big media frame to small PES packets.
 	ideaPesLength int
 	// The generated bytes of PS stream data.
 	packets []*PSPacket
 	// Whether has video packet.
 	hasVideo bool
+	// The hook for each video access unit or audio frame written, with the generated PES packets. The payloads are the
+	// NALUs of video, or the ADTS frame of audio.
+	onWriteFrame func(payloads [][]byte, pes *PSPacket)
+	// The video codec in PSM.
+	videoCodec mpeg2.PS_STREAM_TYPE
+	// The SEI uuid and payload to insert before next IDR, in the codec of PSM, see SetSEI.
+	seiUUID [16]byte
+	sei     []byte
+	// The declared audio config by SetAudioConfig, or detected from the first ADTS frame.
+	audioConfig *aac.AudioSpecificConfig
+	// Randomize the PES length in [minPesLength, ideaPesLength] if not nil, see SetRandomPesLength.
+	randomPes    *rand.Rand
+	minPesLength int
+	// Damage the video frames if not nil, see SetFaultInjector.
+	fault *FaultInjector
+	// Encrypt the PES payload by CTR mode of the block cipher if not nil, see SetEncryption.
+	encryption cipher.Block
 }
 
 func NewPSPackStream(pt uint8) *PSPackStream {
-	return &PSPackStream{ideaPesLength: 1400, pt: pt}
+	return NewPSPackStreamWithProfile(pt, PSProfileAudioVideo)
+}
+
+// NewPSPackStreamWithProfile create the PS stream, which only declares and accepts the streams of profile.
+func NewPSPackStreamWithProfile(pt uint8, profile PSProfile) *PSPackStream {
+	return &PSPackStream{ideaPesLength: 1400, pt: pt, audioPT: pt, audioCodec: mpeg2.PS_STREAM_AAC, profile: profile}
+}
+
+// Stats returns the frames, PES and bytes of the packets written.
+func (v *PSPackStream) Stats() PSPackStreamStats {
+	return utilPSPacketsStats(v.packets)
+}
+
+// Packets returns the packets in the order they were written, that is the order to send, so the pack header is always
+// the first one, followed by system header and PSM if any, then the video and audio in the order of write. The returned
+// slice is a copy, but the packets are shared and should not be modified.
+func (v *PSPackStream) Packets() []*PSPacket {
+	return append([]*PSPacket(nil), v.packets...)
+}
+
+// Range calls fn for each packet in the order of Packets, and stops if fn returns error.
+func (v *PSPackStream) Range(fn func(p *PSPacket) error) error {
+	for _, p := range v.packets {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropVideo removes the video packets, for example, to drop the non-reference frame to follow the bitrate.
+func (v *PSPackStream) DropVideo() {
+	var packets []*PSPacket
+	for _, p := range v.packets {
+		if p.t != PSPacketTypeVideo {
+			packets = append(packets, p)
+		}
+	}
+	v.packets = packets
+}
+
+// Size returns the bytes of PS stream data of all packets.
+func (v *PSPackStream) Size() int {
+	var size int
+	for _, p := range v.packets {
+		for _, b := range p.ps {
+			size += len(b)
+		}
+	}
+	return size
+}
+
+// WriteTo writes the PS stream data of all packets to w, without RTP, for example, to save as a .ps file.
+func (v *PSPackStream) WriteTo(w io.Writer) (n int64, err error) {
+	for _, packet := range v.packets {
+		for _, b := range packet.ps {
+			nn, err := w.Write(b)
+			n += int64(nn)
+			if err != nil {
+				return n, errors.Wrapf(err, "write %v bytes", len(b))
+			}
+		}
+	}
+	return n, nil
+}
+
+// WriteEndOfStream writes the MPEG program end code, which should be the last packet of stream.
+func (v *PSPackStream) WriteEndOfStream(dts uint64) error {
+	endCode := []byte{0x00, 0x00, 0x01, 0xb9}
+	v.packets = append(v.packets, NewPSPacket(PSPacketTypeEndOfStream, endCode, dts, v.pt))
+	return nil
 }
 
 func (v *PSPackStream) WriteHeader(videoCodec mpeg2.PS_STREAM_TYPE, dts uint64) error {
@@ -193,21 +1758,27 @@ func (v *PSPackStream) WritePackHeader(dts uint64) error {
 func (v *PSPackStream) WriteSystemHeader(dts uint64) error {
 	w := codec.NewBitStreamWriter(1500)
 
-	system := &mpeg2.System_header{
-		Rate_bound:  159953,
-		Video_bound: 1,
-		Audio_bound: 1,
-		Streams: []*mpeg2.Elementary_Stream{
-			// SrsTsPESStreamIdVideoCommon = 0xe0
-			&mpeg2.Elementary_Stream{Stream_id: uint8(0xe0), P_STD_buffer_bound_scale: 1, P_STD_buffer_size_bound: 128},
-			// SrsTsPESStreamIdAudioCommon = 0xc0
-			&mpeg2.Elementary_Stream{Stream_id: uint8(0xc0), P_STD_buffer_bound_scale: 0, P_STD_buffer_size_bound: 8},
-			// SrsTsPESStreamIdPrivateStream1 = 0xbd
-			&mpeg2.Elementary_Stream{Stream_id: uint8(0xbd), P_STD_buffer_bound_scale: 1, P_STD_buffer_size_bound: 128},
-			// SrsTsPESStreamIdPrivateStream2 = 0xbf
-			&mpeg2.Elementary_Stream{Stream_id: uint8(0xbf), P_STD_buffer_bound_scale: 1, P_STD_buffer_size_bound: 128},
-		},
+	system := &mpeg2.System_header{Rate_bound: 159953}
+	if v.profile.HasVideo() {
+		// SrsTsPESStreamIdVideoCommon = 0xe0
+		system.Video_bound = 1
+		system.Streams = append(system.Streams, &mpeg2.Elementary_Stream{
+			Stream_id: uint8(0xe0), P_STD_buffer_bound_scale: 1, P_STD_buffer_size_bound: 128,
+		})
+	}
+	if v.profile.HasAudio() {
+		// SrsTsPESStreamIdAudioCommon = 0xc0
+		system.Audio_bound = 1
+		system.Streams = append(system.Streams, &mpeg2.Elementary_Stream{
+			Stream_id: uint8(0xc0), P_STD_buffer_bound_scale: 0, P_STD_buffer_size_bound: 8,
+		})
 	}
+	system.Streams = append(system.Streams,
+		// SrsTsPESStreamIdPrivateStream1 = 0xbd
+		&mpeg2.Elementary_Stream{Stream_id: uint8(0xbd), P_STD_buffer_bound_scale: 1, P_STD_buffer_size_bound: 128},
+		// SrsTsPESStreamIdPrivateStream2 = 0xbf
+		&mpeg2.Elementary_Stream{Stream_id: uint8(0xbf), P_STD_buffer_bound_scale: 1, P_STD_buffer_size_bound: 128},
+	)
 
 	system.Encode(w)
 
@@ -218,38 +1789,129 @@ func (v *PSPackStream) WriteSystemHeader(dts uint64) error {
 func (v *PSPackStream) WriteProgramStreamMap(videoCodec mpeg2.PS_STREAM_TYPE, dts uint64) error {
 	w := codec.NewBitStreamWriter(1500)
 
-	psm := &mpeg2.Program_stream_map{
-		Stream_map: []*mpeg2.Elementary_stream_elem{
-			// SrsTsPESStreamIdVideoCommon = 0xe0
-			mpeg2.NewElementary_stream_elem(uint8(videoCodec), 0xe0),
-			// SrsTsPESStreamIdAudioCommon = 0xc0
-			mpeg2.NewElementary_stream_elem(uint8(mpeg2.PS_STREAM_AAC), 0xc0),
-		},
+	psm := &mpeg2.Program_stream_map{}
+	if v.profile.HasVideo() {
+		// SrsTsPESStreamIdVideoCommon = 0xe0
+		psm.Stream_map = append(psm.Stream_map, mpeg2.NewElementary_stream_elem(uint8(videoCodec), 0xe0))
+	}
+	if v.profile.HasAudio() {
+		// SrsTsPESStreamIdAudioCommon = 0xc0
+		psm.Stream_map = append(psm.Stream_map, mpeg2.NewElementary_stream_elem(uint8(v.audioCodec), 0xc0))
 	}
 
 	psm.Current_next_indicator = 1
 	psm.Encode(w)
 
+	v.videoCodec = videoCodec
+
 	v.packets = append(v.packets, NewPSPacket(PSPacketTypeProgramStramMap, w.Bits(), dts, v.pt))
 	return nil
 }
 
+// SetPesLength sets the max payload length of video PES, for example, 1024 or jumbo 8000 like some cameras. The length
+// should be in (0, psMaxPesLength].
+func (v *PSPackStream) SetPesLength(n int) {
+	v.ideaPesLength = n
+}
+
+// SetRandomPesLength splits the video frame to PES packets in random size of [min, ideaPesLength], rather than the
+// fixed ideaPesLength, because real devices don't split frame to equal fragments.
+func (v *PSPackStream) SetRandomPesLength(min int, r *rand.Rand) {
+	v.minPesLength, v.randomPes = min, r
+}
+
+// SetFaultInjector damages the video frames by the injector, which produces non-conformant stream intentionally.
+func (v *PSPackStream) SetFaultInjector(fault *FaultInjector) {
+	v.fault = fault
+}
+
+// SetEncryption encrypts the payload of video and audio PES by CTR mode of the block cipher, for example, SM4 with the
+// VKEK of GB35114. The payloads of a frame are encrypted as a whole before split to PES, by the IV of the PTS and
+// stream ID, see utilEncryptPES.
+func (v *PSPackStream) SetEncryption(block cipher.Block) {
+	v.encryption = block
+}
+
+// SetSEI sets the user data unregistered SEI, which is inserted before the next IDR slice by WriteVideo, that is after
+// the AUD and parameter sets and before the slice. It's H.264 SEI, or H.265 prefix SEI before IRAP slice for HEVC.
+func (v *PSPackStream) SetSEI(uuid [16]byte, payload []byte) {
+	v.seiUUID, v.sei = uuid, append([]byte{}, payload...)
+}
+
 // The nalu is raw data without ANNEXB header.
 func (v *PSPackStream) WriteVideo(nalu []byte, dts uint64) error {
+	return v.WriteAccessUnit([][]byte{nalu}, dts, dts)
+}
+
+// WriteAccessUnit writes the NALUs of a frame, which share the same DTS and PTS, as one video PES packet, which
+// might be fragmented to PES by the ideaPesLength.
+func (v *PSPackStream) WriteAccessUnit(nalus [][]byte, dts, pts uint64) error {
+	if !v.profile.HasVideo() {
+		return errors.Errorf("no video stream for profile %v", v.profile)
+	}
+
+	// The dropped frame is still a video frame of pack, but without any PES packet.
+	if v.fault != nil {
+		if nalus = v.fault.Apply(nalus); len(nalus) == 0 {
+			v.hasVideo = true
+			return nil
+		}
+	}
+
+	// Insert SEI before IDR, 5 is IDR for H.264, and 16~23 is IRAP for H.265.
+	if v.sei != nil {
+		hevc := v.videoCodec == mpeg2.PS_STREAM_H265
+		for i, nalu := range nalus {
+			if len(nalu) == 0 {
+				continue
+			}
+
+			var sei []byte
+			if t := NalUnitType((nalu[0] & 0x7e) >> 1); hevc && t >= NaluTypeSliceBlaWlp && t <= NaluTypeSliceRsvIrapVcl23 {
+				sei = utilBuildHEVCSEIUserData(v.seiUUID, v.sei)
+			} else if !hevc && nalu[0]&0x1f == 5 {
+				sei = utilBuildSEIUserData(v.seiUUID, v.sei)
+			}
+
+			if sei != nil {
+				nalus = append(append(append([][]byte{}, nalus[:i]...), sei), nalus[i:]...)
+				v.sei = nil
+				break
+			}
+		}
+	}
+
 	// Mux frame payload in AnnexB format. Always fresh NALU header for frame, see srs_avc_insert_aud.
-	annexb := append([]byte{0, 0, 0, 1}, nalu...)
+	var annexb []byte
+	for _, nalu := range nalus {
+		annexb = append(append(annexb, 0, 0, 0, 1), nalu...)
+	}
+
+	if pts < dts {
+		return errors.Errorf("invalid pts %v less than dts %v", pts, dts)
+	}
+	if v.encryption != nil {
+		annexb = utilEncryptPES(v.encryption, annexb, pts, 0xe0)
+	}
 
 	video := NewPSPacket(PSPacketTypeVideo, nil, dts, v.pt)
+	video.pts = pts
+
+	for i := 0; i < len(annexb); {
+		pesLength := v.ideaPesLength
+		if v.randomPes != nil && v.minPesLength < v.ideaPesLength {
+			pesLength = v.minPesLength + v.randomPes.Intn(v.ideaPesLength-v.minPesLength+1)
+		}
 
-	for i := 0; i < len(annexb); i += v.ideaPesLength {
-		payloadLength := int(math.Min(float64(v.ideaPesLength), float64(len(annexb)-i)))
+		payloadLength := int(math.Min(float64(pesLength), float64(len(annexb)-i)))
 		bb := annexb[i : i+payloadLength]
+		i += payloadLength
 
 		w := codec.NewBitStreamWriter(65535)
 
 		pes := &mpeg2.PesPacket{
 			Stream_id:     uint8(0xe0),                     // SrsTsPESStreamIdVideoCommon = 0xe0
-			PTS_DTS_flags: uint8(0x03), Dts: dts, Pts: dts, // Both DTS and PTS.
+			PTS_DTS_flags: uint8(0x03), Dts: dts, Pts: pts, // Both DTS and PTS.
 			Pes_payload: bb,
 		}
 		utilUpdatePesPacketLength(pes)
@@ -261,22 +1923,79 @@ func (v *PSPackStream) WriteVideo(nalu []byte, dts uint64) error {
 
 	v.hasVideo = true
 	v.packets = append(v.packets, video)
+
+	if v.onWriteFrame != nil {
+		v.onWriteFrame(nalus, video)
+	}
 	return nil
 }
 
-// Write AAC ADTS frame.
+// SetAudioPayloadType sets the RTP payload type of audio packets, to send audio in different clock rate.
+func (v *PSPackStream) SetAudioPayloadType(pt uint8) {
+	v.audioPT = pt
+}
+
+// SetAudioCodec sets the audio codec in PSM, and WriteAudio accepts ADTS frame for AAC, or raw samples for G.711.
+func (v *PSPackStream) SetAudioCodec(codec mpeg2.PS_STREAM_TYPE) {
+	v.audioCodec = codec
+}
+
+// SetAudioConfig declares the AAC profile, sample rate and channels, so that WriteAudio fails if mismatch, because the
+// audio plays at the wrong speed if the declared sample rate is not the actual one.
+func (v *PSPackStream) SetAudioConfig(asc *aac.AudioSpecificConfig) {
+	v.audioConfig = asc
+}
+
+// AudioConfig returns the declared or detected AAC profile, sample rate and channels, nil if no audio.
+func (v *PSPackStream) AudioConfig() *aac.AudioSpecificConfig {
+	return v.audioConfig
+}
+
+// Write AAC ADTS frame, or G.711 samples for G.711 codec, see SetAudioCodec.
 func (v *PSPackStream) WriteAudio(adts []byte, dts uint64) error {
+	if !v.profile.HasAudio() {
+		return errors.Errorf("no audio stream for profile %v", v.profile)
+	}
+
+	// The G.711 samples are carried in PES as is, without any header.
+	if v.audioCodec == mpeg2.PS_STREAM_AAC {
+		asc, err := utilParseADTS(adts)
+		if err != nil {
+			return errors.Wrapf(err, "parse adts")
+		}
+
+		if v.audioConfig == nil {
+			v.audioConfig = asc
+		} else if v.audioConfig.Object.ToProfile() != asc.Object.ToProfile() || v.audioConfig.SampleRate != asc.SampleRate {
+			return errors.Errorf("audio mismatch, declared %v %vHz, actual %v %vHz",
+				v.audioConfig.Object.ToProfile(), v.audioConfig.SampleRate.ToHz(), asc.Object.ToProfile(), asc.SampleRate.ToHz(),
+			)
+		}
+	} else if len(adts) == 0 {
+		return errors.New("empty G.711 samples")
+	}
+
+	payload := adts
+	if v.encryption != nil {
+		payload = utilEncryptPES(v.encryption, adts, dts, 0xc0)
+	}
+
 	w := codec.NewBitStreamWriter(65535)
 
 	pes := &mpeg2.PesPacket{
 		Stream_id:     uint8(0xc0),                     // SrsTsPESStreamIdAudioCommon = 0xc0
 		PTS_DTS_flags: uint8(0x03), Dts: dts, Pts: dts, // Both DTS and PTS.
-		Pes_payload: adts,
+		Pes_payload: payload,
 	}
 	utilUpdatePesPacketLength(pes)
 
 	pes.Encode(w)
 
-	v.packets = append(v.packets, NewPSPacket(PSPacketTypeAudio, w.Bits(), dts, v.pt))
+	audio := NewPSPacket(PSPacketTypeAudio, w.Bits(), dts, v.audioPT)
+	v.packets = append(v.packets, audio)
+
+	if v.onWriteFrame != nil {
+		v.onWriteFrame([][]byte{adts}, audio)
+	}
 	return nil
 }
@@ -0,0 +1,2697 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ossrs/go-oryx-lib/aac"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/yapingcat/gomedia/codec"
+	"github.com/yapingcat/gomedia/mpeg2"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPSIngesterHeaderInterval(t *testing.T) {
+	v := NewPSIngester(&IngesterConfig{clockRate: 90000})
+	v.conf.psConfig.headerInterval = 500
+
+	// Write 1s at 25fps, with keyframe at frame 0 and 10, so the 500ms cadence should match frame 0 and 10,
+	// which coincide with keyframes, and frame 23 which is 500ms after frame 10.
+	var headers []int
+	for i := 0; i < 25; i++ {
+		pack := NewPSPackStream(96)
+		if err := v.writeHeader(pack, mpeg2.PS_STREAM_H264, i == 0 || i == 10, uint64(i*3600)); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+
+		var psm int
+		for _, p := range pack.packets {
+			if p.t == PSPacketTypeProgramStramMap {
+				psm++
+			}
+		}
+		if psm > 1 {
+			t.Errorf("frame %v has %v PSM", i, psm)
+		}
+		if psm > 0 {
+			headers = append(headers, i)
+		}
+	}
+
+	if len(headers) != 3 || headers[0] != 0 || headers[1] != 10 || headers[2] != 23 {
+		t.Errorf("invalid headers %v", headers)
+	}
+}
+
+func TestPSClientRTCPReceiverReport(t *testing.T) {
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+
+	// No RR yet, should be zero.
+	if stats := v.Stats(); stats.ReceiverReports != 0 {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+
+	rr := &rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{
+		{SSRC: 5678, TotalLost: 100, LastSequenceNumber: 100},
+		{SSRC: 1234, FractionLost: 3, TotalLost: 7, LastSequenceNumber: 65536 + 10, Jitter: 9},
+	}}
+	b, err := rr.Marshal()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	if err := v.handleRTCP(b); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	stats := v.Stats()
+	if stats.ReceiverReports != 1 || stats.TotalLost != 7 || stats.FractionLost != 3 ||
+		stats.HighestSequence != 65536+10 || stats.Jitter != 9 {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+
+	if err := v.handleRTCP([]byte{0x80}); err == nil {
+		t.Errorf("should fail for invalid RTCP")
+	}
+}
+
+func TestPSSSRCCollision(t *testing.T) {
+	// A generator which always collides for the first 3 times.
+	var nn uint32
+	r := newSSRCRegistry(func() uint32 {
+		if nn++; nn <= 3 {
+			return 100
+		}
+		return 100 + nn
+	})
+
+	if err := r.Add(100); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := r.Add(100); err == nil {
+		t.Errorf("should collision")
+		return
+	}
+
+	if ssrc, err := r.Generate(); err != nil || ssrc != 104 {
+		t.Errorf("invalid ssrc=%v, err %+v", ssrc, err)
+		return
+	}
+
+	// A generator which always collides should fail.
+	r.generator = func() uint32 {
+		return 100
+	}
+	if _, err := r.Generate(); err == nil {
+		t.Errorf("should collision")
+		return
+	}
+
+	r.Remove(100)
+	if ssrc, err := r.Generate(); err != nil || ssrc != 100 {
+		t.Errorf("invalid ssrc=%v, err %+v", ssrc, err)
+	}
+}
+
+func TestPSWriteVideoWithSEI(t *testing.T) {
+	// The payload contains start code, which should be prevented.
+	payload := []byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x03, 0xff}
+	sei := utilBuildSEIUserData(seiTimestampUUID, payload)
+	if bytes.Contains(sei, []byte{0x00, 0x00, 0x01}) || bytes.Contains(sei, []byte{0x00, 0x00, 0x00}) {
+		t.Errorf("sei not prevented %v", sei)
+		return
+	}
+
+	if uuid, b, err := utilParseSEIUserData(sei); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	} else if uuid != seiTimestampUUID || !bytes.Equal(b, payload) {
+		t.Errorf("invalid uuid=%v, payload=%v", uuid, b)
+		return
+	}
+
+	// The SEI should be inserted after SPS/PPS and before IDR.
+	var nalus []uint8
+	pack := NewPSPackStream(96)
+	pack.onWriteFrame = func(payloads [][]byte, pes *PSPacket) {
+		for _, frame := range payloads {
+			nalus = append(nalus, frame[0]&0x1f)
+		}
+	}
+	pack.SetSEI(seiTimestampUUID, payload)
+	if err := pack.WriteHeader(mpeg2.PS_STREAM_H264, 0); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	for _, nalu := range [][]byte{{0x67, 0x01}, {0x68, 0x02}, {0x65, 0x03}, {0x41, 0x04}} {
+		if err := pack.WriteVideo(nalu, 0); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+	}
+	if !bytes.Equal(nalus, []uint8{7, 8, 6, 5, 1}) {
+		t.Errorf("invalid nalus %v", nalus)
+	}
+}
+
+// The media server for test, which reads the RTP packets over TCP.
+type psTestServer struct {
+	listener *net.TCPListener
+	// The received RTP packets.
+	packets chan *rtp.Packet
+}
+
+func newPSTestServer() (*psTestServer, error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		return nil, err
+	}
+
+	v := &psTestServer{listener: listener, packets: make(chan *rtp.Packet, 4096)}
+	go func() {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := NewPSFrameReader(conn, PSFramingRFC4571)
+		for {
+			b, _, err := r.ReadPacket()
+			if err != nil {
+				return
+			}
+
+			p := &rtp.Packet{}
+			if err := p.Unmarshal(b); err != nil {
+				return
+			}
+
+			select {
+			case v.packets <- p:
+			default:
+			}
+		}
+	}()
+	return v, nil
+}
+
+func (v *psTestServer) Close() error {
+	return v.listener.Close()
+}
+
+func (v *psTestServer) Addr() string {
+	return fmt.Sprintf("tcp://%v", v.listener.Addr().String())
+}
+
+func TestPSIngesterFrameSource(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	// Generate 10 video frames at 25fps and audio frames at 50fps.
+	video, audio := &psTestFrameSource{}, &psTestFrameSource{}
+	for i := 0; i < 10; i++ {
+		payloads := [][]byte{{0x41, 0x01, 0x02}}
+		if i == 0 {
+			payloads = [][]byte{{0x67, 0x01}, {0x68, 0x02}, {0x65, 0x03}}
+		}
+		video.frames = append(video.frames, &Frame{
+			Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: payloads,
+		})
+	}
+	for i := 0; i < 20; i++ {
+		audio.frames = append(audio.frames, &Frame{
+			Codec: FrameCodecAAC, DTS: uint64(i * 1800), PTS: uint64(i * 1800), Payloads: [][]byte{psTestADTS(aac.SampleRateIndex44kHz, 16)},
+		})
+	}
+
+	v := NewPSIngester(&IngesterConfig{ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96})
+	v.videoSource, v.audioSource = video, audio
+
+	var nnPacks int
+	v.onSendPacket = func(pack *PSPackStream) error {
+		nnPacks++
+		return nil
+	}
+
+	if err := v.Ingest(ctx); errors.Cause(err) != io.EOF {
+		t.Errorf("err %+v", err)
+		return
+	}
+	// Each video frame is a pack, and the last pack is the end of stream.
+	if nnPacks != 11 {
+		t.Errorf("invalid packs %v", nnPacks)
+	}
+
+	// Each video frame is a pack, the first pack contains header(pack, system, PSM), SPS, PPS, IDR and audio.
+	select {
+	case <-ctx.Done():
+		t.Errorf("err %+v", ctx.Err())
+	case p := <-server.packets:
+		if p.SSRC != 1234 || p.PayloadType != 96 || p.SequenceNumber != 1 {
+			t.Errorf("invalid packet %v", p)
+		}
+	}
+}
+
+func TestPSWriteVideoRandomPesLength(t *testing.T) {
+	nalu := make([]byte, 64*1024)
+	for i := range nalu {
+		nalu[i] = uint8(i)
+	}
+	nalu[0] = 0x65
+
+	writeVideo := func(seed int64) ([]int, []byte, error) {
+		pack := NewPSPackStream(96)
+		pack.SetRandomPesLength(200, rand.New(rand.NewSource(seed)))
+		if err := pack.WriteVideo(nalu, 0); err != nil {
+			return nil, nil, err
+		}
+
+		var sizes []int
+		var annexb []byte
+		for _, b := range pack.packets[0].ps {
+			pes := mpeg2.NewPesPacket()
+			if err := pes.Decode(codec.NewBitStream(b)); err != nil {
+				return nil, nil, err
+			}
+			sizes = append(sizes, len(pes.Pes_payload))
+			annexb = append(annexb, pes.Pes_payload...)
+		}
+		return sizes, annexb, nil
+	}
+
+	sizes, annexb, err := writeVideo(100)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// Should reassemble to the original frame.
+	if !bytes.Equal(annexb, append([]byte{0, 0, 0, 1}, nalu...)) {
+		t.Errorf("invalid frame %v bytes", len(annexb))
+	}
+
+	// Should be in [min, ideaPesLength], except the last one, and not all equal.
+	var equals int
+	for i, size := range sizes {
+		if size > 1400 || (size < 200 && i != len(sizes)-1) {
+			t.Errorf("invalid #%v size %v", i, size)
+		}
+		if size == sizes[0] {
+			equals++
+		}
+	}
+	if equals == len(sizes) {
+		t.Errorf("not random %v", sizes)
+	}
+
+	// Should be reproducible by seed.
+	if sizes2, _, err := writeVideo(100); err != nil || fmt.Sprint(sizes) != fmt.Sprint(sizes2) {
+		t.Errorf("not reproducible %v and %v, err %+v", sizes, sizes2, err)
+	}
+}
+
+func TestPSClientInterleavedRTCPMux(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer listener.Close()
+
+	// The server reads 2 packets, RTP then RTCP SR, and responses a RR.
+	channels := make(chan []byte, 2)
+	go func() {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for i := 0; i < 2; i++ {
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return
+			}
+			payload := make([]byte, int(b[2])<<8|int(b[3]))
+			if _, err := io.ReadFull(conn, payload); err != nil {
+				return
+			}
+			channels <- append(b[:2], payload...)
+		}
+
+		// The corrupt RTCP is ignored, and the following RR and PLI are handled.
+		conn.Write([]byte{'$', 1, 0, 4, 0x80, 0xc9, 0x00, 0x05})
+
+		rr := &rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{
+			{SSRC: 1234, FractionLost: 3, TotalLost: 7, LastSequenceNumber: 1},
+		}}
+		b, _ := rr.Marshal()
+		conn.Write(append([]byte{'$', 1, uint8(len(b) >> 8), uint8(len(b))}, b...))
+
+		b, _ = (&rtcp.PictureLossIndication{MediaSSRC: 1234}).Marshal()
+		conn.Write(append([]byte{'$', 1, uint8(len(b) >> 8), uint8(len(b))}, b...))
+
+		// Wait for client to close.
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	ctx := logger.WithContext(context.Background())
+	v := NewPSClient(1234, fmt.Sprintf("tcp://%v", listener.Addr().String()))
+	v.framing, v.rtcpMux = PSFramingInterleaved, true
+	if err := v.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer v.Close()
+
+	if err := v.WritePacksOverRTP([]*PSPacket{{pt: 96, ts: 90000, ps: [][]byte{{0x00, 0x00, 0x01, 0xba}}}}); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := v.WriteSenderReport(time.Now(), 90000); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	if b := <-channels; b[0] != '$' || b[1] != 0 {
+		t.Errorf("invalid rtp header %v", b[:2])
+	} else if p := (&rtp.Packet{}); p.Unmarshal(b[2:]) != nil || p.SSRC != 1234 || p.PayloadType != 96 {
+		t.Errorf("invalid rtp %v", p)
+	}
+
+	if b := <-channels; b[0] != '$' || b[1] != 1 {
+		t.Errorf("invalid rtcp header %v", b[:2])
+	} else if pkts, err := rtcp.Unmarshal(b[2:]); err != nil || len(pkts) != 1 {
+		t.Errorf("invalid rtcp %v, err %+v", pkts, err)
+	} else if sr, ok := pkts[0].(*rtcp.SenderReport); !ok || sr.SSRC != 1234 || sr.PacketCount != 1 || sr.OctetCount != 4 ||
+		sr.RTPTime != 90000 {
+		t.Errorf("invalid sr %v", pkts[0])
+	}
+
+	for i := 0; i < 100 && v.Stats().KeyframeRequests == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := v.Stats(); stats.ReceiverReports != 1 || stats.TotalLost != 7 || stats.FractionLost != 3 ||
+		stats.KeyframeRequests != 1 {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+}
+
+func TestPSIngesterMaxFrames(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	video, audio := &psTestFrameSource{}, &psTestFrameSource{}
+	for i := 0; i < 10; i++ {
+		video.frames = append(video.frames, &Frame{
+			Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: [][]byte{{0x41, 0x01}},
+		})
+	}
+	for i := 0; i < 20; i++ {
+		audio.frames = append(audio.frames, &Frame{
+			Codec: FrameCodecAAC, DTS: uint64(i * 1800), PTS: uint64(i * 1800), Payloads: [][]byte{psTestADTS(aac.SampleRateIndex44kHz, 16)},
+		})
+	}
+
+	v := NewPSIngester(&IngesterConfig{
+		ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+		psConfig: PSConfig{maxFrames: 3},
+	})
+	v.videoSource, v.audioSource = video, audio
+
+	var nnPacks int
+	v.onSendPacket = func(pack *PSPackStream) error {
+		if pack.packets[0].Type() != PSPacketTypeEndOfStream {
+			nnPacks++
+		}
+		return nil
+	}
+
+	// Should stop cleanly, not EOF.
+	if err := v.Ingest(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if nnPacks != 3 {
+		t.Errorf("invalid packs %v", nnPacks)
+	}
+}
+
+func TestPSEndOfStream(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	for _, maxFrames := range []uint64{0, 2} {
+		video := &psTestFrameSource{}
+		for i := 0; i < 3; i++ {
+			video.frames = append(video.frames, &Frame{
+				Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: [][]byte{{0x65, 0x01}},
+			})
+		}
+
+		v := NewPSIngester(&IngesterConfig{
+			ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+			psConfig: PSConfig{maxFrames: maxFrames},
+		})
+		v.videoSource = video
+
+		var ps bytes.Buffer
+		v.onSendPacket = func(pack *PSPackStream) error {
+			_, err := pack.WriteTo(&ps)
+			return err
+		}
+
+		// Should write end code when source is EOF, or stopped by limits.
+		if err := v.Ingest(ctx); err != nil && errors.Cause(err) != io.EOF {
+			t.Errorf("err %+v", err)
+			return
+		}
+
+		b := ps.Bytes()
+		if len(b) < 4 || !bytes.Equal(b[len(b)-4:], []byte{0x00, 0x00, 0x01, 0xb9}) {
+			t.Errorf("invalid end code %v for max=%v", b[len(b)-4:], maxFrames)
+		}
+		if bytes.Count(b, []byte{0x00, 0x00, 0x01, 0xb9}) != 1 {
+			t.Errorf("invalid end codes for max=%v", maxFrames)
+		}
+	}
+}
+
+func TestPSAccessUnit(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	// The IDR frame contains 2 slices, the first_mb_in_slice of the second slice is not 0.
+	var annexb []byte
+	for _, nalu := range [][]byte{
+		{0x67, 0x64}, {0x68, 0xee}, {0x65, 0x88, 0x01}, {0x65, 0x40, 0x02},
+		{0x41, 0x9a, 0x03}, {0x41, 0x9a, 0x04},
+	} {
+		annexb = append(append(annexb, 0, 0, 0, 1), nalu...)
+	}
+
+	source, err := NewH264FrameSource(ctx, bytes.NewReader(annexb), 25, 90000)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	var frames []*Frame
+	for {
+		frame, err := source.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		frames = append(frames, frame)
+	}
+
+	if len(frames) != 3 {
+		t.Errorf("invalid frames %v", len(frames))
+		return
+	}
+	if len(frames[0].Payloads) != 4 || len(frames[1].Payloads) != 1 || len(frames[2].Payloads) != 1 {
+		t.Errorf("invalid NALUs %v, %v, %v", len(frames[0].Payloads), len(frames[1].Payloads), len(frames[2].Payloads))
+	}
+
+	// All NALUs of access unit should be in one video packet, with the same timestamp.
+	pack := NewPSPackStream(96)
+	if err := pack.WriteAccessUnit(frames[0].Payloads, frames[0].DTS, frames[0].PTS); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if len(pack.packets) != 1 || len(pack.packets[0].ps) != 1 || pack.packets[0].ts != frames[0].DTS {
+		t.Errorf("invalid packets %v", len(pack.packets))
+		return
+	}
+
+	pes := &mpeg2.PesPacket{}
+	if err := pes.Decode(codec.NewBitStream(pack.packets[0].ps[0])); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if pes.Dts != frames[0].DTS || pes.Pts != frames[0].PTS || !bytes.Equal(pes.Pes_payload, annexb[:26]) {
+		t.Errorf("invalid pes dts=%v, pts=%v, payload=%v", pes.Dts, pes.Pts, pes.Pes_payload)
+	}
+}
+
+func TestPSProfile(t *testing.T) {
+	for _, c := range []struct {
+		profile PSProfile
+		streams []uint8
+	}{
+		{PSProfileAudioVideo, []uint8{0xe0, 0xc0}},
+		{PSProfileVideoOnly, []uint8{0xe0}},
+		{PSProfileAudioOnly, []uint8{0xc0}},
+	} {
+		pack := NewPSPackStreamWithProfile(96, c.profile)
+		if err := pack.WriteHeader(mpeg2.PS_STREAM_H264, 0); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+
+		// The PSM should only declare the streams of profile.
+		psm := &mpeg2.Program_stream_map{}
+		if err := psm.Decode(codec.NewBitStream(pack.packets[2].ps[0])); err != nil {
+			t.Errorf("profile=%v, err %+v", c.profile, err)
+			return
+		}
+		var streams []uint8
+		for _, elem := range psm.Stream_map {
+			streams = append(streams, elem.Elementary_stream_id)
+		}
+		if !bytes.Equal(streams, c.streams) {
+			t.Errorf("profile=%v, invalid streams %v, expect %v", c.profile, streams, c.streams)
+		}
+
+		// Should reject the undeclared stream.
+		if err := pack.WriteVideo([]byte{0x65}, 0); (err == nil) != c.profile.HasVideo() {
+			t.Errorf("profile=%v, video err %+v", c.profile, err)
+		}
+		if err := pack.WriteAudio(psTestADTS(aac.SampleRateIndex44kHz, 16), 0); (err == nil) != c.profile.HasAudio() {
+			t.Errorf("profile=%v, audio err %+v", c.profile, err)
+		}
+	}
+}
+
+func TestPSIngesterAudioOnly(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	audio := &psTestFrameSource{}
+	for i := 0; i < 5; i++ {
+		audio.frames = append(audio.frames, &Frame{
+			Codec: FrameCodecAAC, DTS: uint64(i * 1800), PTS: uint64(i * 1800), Payloads: [][]byte{psTestADTS(aac.SampleRateIndex44kHz, 16)},
+		})
+	}
+
+	v := NewPSIngester(&IngesterConfig{ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96})
+	v.audioSource = audio
+
+	// Each audio frame is a pack, and only the first pack has the PSM, with an extra end of stream pack.
+	var nnPacks, nnPSM int
+	v.onSendPacket = func(pack *PSPackStream) error {
+		nnPacks++
+		for _, p := range pack.packets {
+			if p.t == PSPacketTypeVideo {
+				t.Errorf("should not have video")
+			} else if p.t == PSPacketTypeProgramStramMap {
+				nnPSM++
+			}
+		}
+		return nil
+	}
+
+	if err := v.Ingest(ctx); errors.Cause(err) != io.EOF {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if nnPacks != 6 || nnPSM != 1 {
+		t.Errorf("invalid packs %v, psm %v", nnPacks, nnPSM)
+	}
+}
+
+// The connection to write to w, for testing and benchmark.
+type psTestConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (v *psTestConn) Write(b []byte) (int, error) {
+	return v.w.Write(b)
+}
+
+func TestPSClientWireFormat(t *testing.T) {
+	var b bytes.Buffer
+	v := NewPSClient(0x12345678, "tcp://127.0.0.1:9000")
+	v.conn, v.seq = &psTestConn{w: &b}, 65534
+
+	payloads := [][]byte{{0x00, 0x00, 0x01, 0xba}, bytes.Repeat([]byte{0xaa}, 1400)}
+	if err := v.WritePacksOverRTP([]*PSPacket{{pt: 96, ts: 0x1234567890, ps: payloads}}); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// Should be identical to the packets marshaled by pion.
+	var expect []byte
+	for i, payload := range payloads {
+		p := rtp.Packet{Header: rtp.Header{
+			Version: 2, PayloadType: 96, SequenceNumber: uint16(65535 + i), Timestamp: 0x34567890, SSRC: 0x12345678,
+		}, Payload: payload}
+		pb, err := p.Marshal()
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		expect = append(append(expect, uint8(len(pb)>>8), uint8(len(pb))), pb...)
+	}
+
+	if !bytes.Equal(b.Bytes(), expect) {
+		t.Errorf("invalid wire format %v bytes, expect %v bytes", b.Len(), len(expect))
+	}
+	if stats := v.Stats(); stats.Packets != 2 || stats.Bytes != uint64(len(expect)) {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+}
+
+func BenchmarkPSClientWritePacks(b *testing.B) {
+	packs := []*PSPacket{{pt: 96, ts: 90000, ps: [][]byte{
+		bytes.Repeat([]byte{0xaa}, 1400), bytes.Repeat([]byte{0xbb}, 1400), bytes.Repeat([]byte{0xcc}, 100),
+	}}}
+
+	// The previous path, which marshals each RTP packet by pion.
+	b.Run("marshal", func(b *testing.B) {
+		conn := &psTestConn{w: ioutil.Discard}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, pack := range packs {
+				for _, payload := range pack.ps {
+					p := rtp.Packet{Header: rtp.Header{
+						Version: 2, PayloadType: pack.pt, SequenceNumber: uint16(i), Timestamp: uint32(pack.ts), SSRC: 1234,
+					}, Payload: payload}
+					pb, err := p.Marshal()
+					if err != nil {
+						b.Fatal(err)
+					}
+					conn.Write([]byte{uint8(len(pb) >> 8), uint8(len(pb))})
+					conn.Write(pb)
+				}
+			}
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+		v.conn = &psTestConn{w: ioutil.Discard}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := v.WritePacksOverRTP(packs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestPSClientTee(t *testing.T) {
+	var b, tee bytes.Buffer
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.conn, v.tee, v.framing = &psTestConn{w: &b}, &tee, PSFramingInterleaved
+
+	if err := v.WritePacksOverRTP([]*PSPacket{{pt: 96, ts: 90000, ps: [][]byte{{0x00, 0x00, 0x01, 0xba}}}}); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := v.WriteSenderReport(time.Now(), 90000); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// The captured bytes should be identical to the sent bytes, in the same framing.
+	if b.Len() == 0 || !bytes.Equal(b.Bytes(), tee.Bytes()) {
+		t.Errorf("invalid tee %v bytes, sent %v bytes", tee.Len(), b.Len())
+	}
+}
+
+func TestPSKeyframeRequest(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	var requests int
+	ps := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	ps.onKeyframeRequest = func() {
+		requests++
+	}
+
+	for _, pkt := range []rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: 1234},
+		&rtcp.PictureLossIndication{MediaSSRC: 5678},
+		&rtcp.FullIntraRequest{FIR: []rtcp.FIREntry{{SSRC: 5678}, {SSRC: 1234}}},
+	} {
+		b, err := pkt.Marshal()
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if err := ps.handleRTCP(b); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+	}
+	if stats := ps.Stats(); requests != 2 || stats.KeyframeRequests != 2 {
+		t.Errorf("invalid requests %v, stats %v", requests, stats.String())
+	}
+
+	idr := &Frame{Codec: FrameCodecH264, DTS: 0, Payloads: [][]byte{{0x67}, {0x68}, {0x65}}}
+	p1 := &Frame{Codec: FrameCodecH264, DTS: 3600, Payloads: [][]byte{{0x41}}}
+	p2 := &Frame{Codec: FrameCodecH264, DTS: 7200, Payloads: [][]byte{{0x41}}}
+
+	// No cached keyframe yet, keep the request until the keyframe.
+	v := NewPSIngester(&IngesterConfig{})
+	v.keyframeRequested = true
+	if frame := v.requestKeyframe(ctx, p1); frame != p1 || !v.keyframeRequested {
+		t.Errorf("should ignore request without keyframe")
+	}
+	if frame := v.requestKeyframe(ctx, idr); frame != idr || v.keyframeRequested {
+		t.Errorf("should clear request by keyframe")
+	}
+
+	// Send the cached keyframe with the timestamp of current frame.
+	v.keyframeRequested = true
+	if frame := v.requestKeyframe(ctx, p1); !utilIsKeyframe(frame) || frame.DTS != 3600 || v.keyframeRequested {
+		t.Errorf("should send cached keyframe, dts=%v", frame.DTS)
+	}
+	if frame := v.requestKeyframe(ctx, p2); frame != p2 {
+		t.Errorf("should not send keyframe without request")
+	}
+}
+
+func TestPSFrameReader(t *testing.T) {
+	p := rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 1, SSRC: 1234}, Payload: []byte{0xba}}
+	pb, err := p.Marshal()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	packet := append([]byte{0, uint8(len(pb))}, pb...)
+
+	for _, c := range []struct {
+		name   string
+		stream []byte
+		expect string
+	}{
+		{"truncated length", append(append([]byte{}, packet...), 0x00), "truncated header 1 bytes at offset 15"},
+		{"truncated payload", append(append([]byte{}, packet...), 0x00, 0x10, 0x80), "truncated packet 1 of 16 bytes at offset 15"},
+		{"zero length", append(append([]byte{}, packet...), 0x00, 0x00), "zero length at offset 15"},
+		{"oversized length", append(append([]byte{}, packet...), 0x08, 0x00), "length 2048 exceeds 1500 at offset 15"},
+		{"garbage payload", append(append([]byte{}, packet...), 0x00, 0x02, 0xff, 0xff), "invalid version 3 at offset 15"},
+	} {
+		r := NewPSFrameReader(bytes.NewReader(c.stream), PSFramingRFC4571)
+		r.SetMaxLength(1500)
+
+		if b, isRTCP, err := r.ReadPacket(); err != nil || isRTCP || !bytes.Equal(b, pb) {
+			t.Errorf("%v: invalid packet %v, err %+v", c.name, b, err)
+			continue
+		}
+		if _, _, err := r.ReadPacket(); err == nil || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("%v: err %v, expect %v", c.name, err, c.expect)
+		}
+	}
+
+	// Should skip the garbage bytes and recover the framing.
+	stream := append(append(append([]byte{}, packet...), 0x00, 0x02, 0xff, 0xff, 0x00), packet...)
+	r := NewPSFrameReader(bytes.NewReader(stream), PSFramingRFC4571)
+	r.SetRecover(true)
+	for i := 0; i < 2; i++ {
+		if b, _, err := r.ReadPacket(); err != nil || !bytes.Equal(b, pb) {
+			t.Errorf("invalid packet %v, err %+v", b, err)
+			return
+		}
+	}
+	if _, _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("should be EOF, err %+v", err)
+	}
+	if r.Skipped() != 5 || r.Offset() != int64(len(stream)) {
+		t.Errorf("invalid skipped %v, offset %v", r.Skipped(), r.Offset())
+	}
+}
+
+// Build an AAC LC stereo ADTS frame, with size bytes raw data.
+func psTestADTS(sampleRate aac.SampleRateIndex, size int) []byte {
+	adts, _ := aac.NewADTS()
+	asc := &aac.AudioSpecificConfig{Object: aac.ObjectTypeLC, SampleRate: sampleRate, Channels: aac.ChannelStereo}
+	if b, err := asc.MarshalBinary(); err != nil {
+		panic(err)
+	} else if err = adts.SetASC(b); err != nil {
+		panic(err)
+	}
+
+	frame, err := adts.Encode(make([]byte, size))
+	if err != nil {
+		panic(err)
+	}
+	return frame
+}
+
+func TestPSClientVerify(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	// The server closes the connection immediately, for example, a wrong port.
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	v := NewPSClient(1234, fmt.Sprintf("tcp://%v", listener.Addr().String()))
+	v.verifyTimeout = 300 * time.Millisecond
+	if err := v.Connect(ctx); err == nil {
+		v.Close()
+		t.Errorf("should fail for server closed")
+	}
+
+	// The server keeps the connection, should be verified.
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	v = NewPSClient(1234, server.Addr())
+	v.verifyTimeout = 100 * time.Millisecond
+	if err := v.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer v.Close()
+
+	if err := v.WritePacksOverRTP([]*PSPacket{{pt: 96, ts: 90000, ps: [][]byte{{0x00, 0x00, 0x01, 0xba}}}}); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestPSPackStreamPackets(t *testing.T) {
+	pack := NewPSPackStream(96)
+	if err := pack.WriteHeader(mpeg2.PS_STREAM_H264, 3600); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := pack.WriteVideo(bytes.Repeat([]byte{0x65}, 2000), 3600); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := pack.WriteAudio(psTestADTS(aac.SampleRateIndex44kHz, 16), 3600); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// Should be in the order of write, and the video is fragmented to 2 PES.
+	var types []PSPacketType
+	var payloads int
+	if err := pack.Range(func(p *PSPacket) error {
+		if p.Timestamp() != 3600 || p.PayloadType() != 96 {
+			return fmt.Errorf("invalid packet %v, ts=%v, pt=%v", p.Type(), p.Timestamp(), p.PayloadType())
+		}
+		types = append(types, p.Type())
+		payloads += len(p.Payloads())
+		return nil
+	}); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	expect := []PSPacketType{
+		PSPacketTypePackHeader, PSPacketTypeSystemHeader, PSPacketTypeProgramStramMap, PSPacketTypeVideo,
+		PSPacketTypeAudio,
+	}
+	if fmt.Sprint(types) != fmt.Sprint(expect) || payloads != 6 || len(pack.Packets()) != 5 {
+		t.Errorf("invalid packets %v, payloads %v", types, payloads)
+	}
+}
+
+func TestPSClientPadding(t *testing.T) {
+	var b bytes.Buffer
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.conn = &psTestConn{w: &b}
+
+	if err := v.WritePadding(0); err == nil {
+		t.Errorf("should fail for zero padding")
+	}
+	if err := v.WritePacksOverRTP([]*PSPacket{{pt: 96, ts: 90000, ps: [][]byte{{0x00, 0x00, 0x01, 0xba}}}}); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := v.WritePadding(200); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	r := NewPSFrameReader(&b, PSFramingRFC4571)
+	for i := 0; i < 2; i++ {
+		pb, _, err := r.ReadPacket()
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(pb); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if p.SequenceNumber != uint16(1+i) || p.PayloadType != 96 || p.Timestamp != 90000 {
+			t.Errorf("invalid packet %v", p)
+		}
+
+		// The padding packet has empty payload, and the last byte is padding length.
+		if i == 1 && (!p.Padding || len(pb) != 12+200 || pb[len(pb)-1] != 200 ||
+			!bytes.Equal(pb[12:len(pb)-1], make([]byte, 199))) {
+			t.Errorf("invalid padding %v, packet %v bytes", p.Padding, len(pb))
+		}
+	}
+
+	if stats := v.Stats(); stats.Packets != 2 || stats.PaddingPackets != 1 {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+}
+
+func TestPSBitrateProfile(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		elapsed time.Duration
+		expect  uint64
+	}{
+		{"step", 0, 1000}, {"step", 31 * time.Second, 1250}, {"step", 121 * time.Second, 2000},
+		{"step", 151 * time.Second, 1000},
+		{"linear", 0, 1000}, {"linear", 15 * time.Second, 1500}, {"linear", 45 * time.Second, 1500},
+		{"sine", 0, 1500}, {"sine", 7500 * time.Millisecond, 2000}, {"sine", 22500 * time.Millisecond, 1000},
+	} {
+		profile, err := NewBitrateProfile(c.name, 1000, 2000, 30*time.Second)
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if target := profile.Target(c.elapsed); target != c.expect {
+			t.Errorf("%v at %v, target %v, expect %v", c.name, c.elapsed, target, c.expect)
+		}
+	}
+
+	if _, err := NewBitrateProfile("unknown", 1000, 2000, time.Second); err == nil {
+		t.Errorf("should fail for unknown profile")
+	}
+
+	// The shaper fills 100KB in 1s at 800kbps, and limits the budget to 1s.
+	now := time.Now()
+	shaper := newBitrateShaper(&LinearBitrateProfile{Min: 800000, Max: 800000, Period: time.Second}, now)
+	shaper.Tick(now.Add(500 * time.Millisecond))
+	if !shaper.Allow(50000) || shaper.Allow(50001) {
+		t.Errorf("invalid budget %v", shaper.budget)
+	}
+	shaper.Consume(60000)
+	if shaper.Padding(255) != 0 {
+		t.Errorf("should not pad when overused")
+	}
+	shaper.Tick(now.Add(10 * time.Second))
+	if shaper.budget != 100000 || shaper.Padding(255) != 255 {
+		t.Errorf("invalid budget %v", shaper.budget)
+	}
+
+	// Only the non-reference frame is droppable.
+	if utilIsNonReference(&Frame{Codec: FrameCodecH264, Payloads: [][]byte{{0x67}, {0x68}, {0x65}}}) ||
+		utilIsNonReference(&Frame{Codec: FrameCodecH264, Payloads: [][]byte{{0x41}}}) ||
+		!utilIsNonReference(&Frame{Codec: FrameCodecH264, Payloads: [][]byte{{0x01}}}) ||
+		!utilIsNonReference(&Frame{Codec: FrameCodecH265, Payloads: [][]byte{{0x00, 0x01}}}) ||
+		utilIsNonReference(&Frame{Codec: FrameCodecH265, Payloads: [][]byte{{0x02, 0x01}}}) {
+		t.Errorf("invalid non-reference frame")
+	}
+
+	// For a stream of reference P frames, the tail of GOP is dropped after a P frame is dropped, until the next IDR.
+	shaper = newBitrateShaper(&LinearBitrateProfile{Min: 800000, Max: 800000, Period: time.Second}, now)
+	shaper.Tick(now.Add(100 * time.Millisecond))
+	idr, p := &Frame{Codec: FrameCodecH264, Payloads: [][]byte{{0x65}}}, &Frame{Codec: FrameCodecH264, Payloads: [][]byte{{0x41}}}
+	var drops []bool
+	for i, size := range []int{5000, 5000, 20000, 1000, 1000, 20000, 1000} {
+		frame := p
+		if i == 5 {
+			frame = idr
+		}
+		dropped := shaper.Drop(frame, size)
+		if !dropped {
+			shaper.Consume(size)
+		}
+		drops = append(drops, dropped)
+	}
+	if fmt.Sprint(drops) != "[false false true true true false true]" {
+		t.Errorf("invalid drops %v", drops)
+	}
+
+	// The non-reference frame is dropped alone.
+	shaper = newBitrateShaper(&LinearBitrateProfile{Min: 800000, Max: 800000, Period: time.Second}, now)
+	shaper.Tick(now.Add(100 * time.Millisecond))
+	b := &Frame{Codec: FrameCodecH264, Payloads: [][]byte{{0x01}}}
+	if !shaper.Drop(b, 20000) || shaper.Drop(p, 1000) {
+		t.Errorf("should only drop the non-reference frame")
+	}
+}
+
+func TestPSClockRate(t *testing.T) {
+	rates, err := utilParseClockRates("96=90000, 97=44100")
+	if err != nil || len(rates) != 2 || rates[96] != 90000 || rates[97] != 44100 {
+		t.Errorf("invalid rates %v, err %+v", rates, err)
+	}
+	for _, s := range []string{"96", "128=90000", "97=0", "97=x"} {
+		if _, err := utilParseClockRates(s); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+
+	var b bytes.Buffer
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.conn = &psTestConn{w: &b}
+	v.SetClockRate(97, 44100)
+
+	// Two seconds of media time in 90kHz, for video and audio.
+	pack := NewPSPackStreamWithProfile(96, PSProfileAudioVideo)
+	pack.SetAudioPayloadType(97)
+	if err := pack.WriteVideo([]byte{0x65, 0x01}, 180000); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := pack.WriteAudio(psTestADTS(aac.SampleRateIndex44kHz, 16), 180000); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := v.WritePacksOverRTP(pack.packets); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	r := NewPSFrameReader(&b, PSFramingRFC4571)
+	for i, expect := range []struct {
+		pt uint8
+		ts uint32
+	}{{96, 180000}, {97, 88200}} {
+		pb, _, err := r.ReadPacket()
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(pb); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if p.PayloadType != expect.pt || p.Timestamp != expect.ts {
+			t.Errorf("packet %v, pt=%v, ts=%v, expect %v", i, p.PayloadType, p.Timestamp, expect)
+		}
+	}
+}
+
+func TestPSFaultInjector(t *testing.T) {
+	for _, s := range []string{"drop", "drop:b:1", "skip:p:1", "drop:p:0", "drop:p:x"} {
+		if _, err := ParseFaultRules(s); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+
+	rules, err := ParseFaultRules("drop:p:3, truncate:p:2, flip:key:2")
+	if err != nil || len(rules) != 3 || rules[1].String() != "truncate:p:2" {
+		t.Errorf("invalid rules %v, err %+v", rules, err)
+		return
+	}
+
+	sps, pps := []byte{0x67, 0x64, 0x00, 0x1f}, []byte{0x68, 0xee, 0x3c, 0x80}
+	idr, p := []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}, []byte{0x41, 0x9a, 0x02, 0x04, 0x08, 0x10}
+
+	// The keyframe 1 and P frame 1 are not damaged, P frame 2 is truncated, P frame 3 is dropped, keyframe 2 is flipped.
+	fault := NewFaultInjector(rules, 1234, false)
+	pack := NewPSPackStreamWithProfile(96, PSProfileVideoOnly)
+	pack.SetFaultInjector(fault)
+	for i, frame := range [][][]byte{{sps, pps, idr}, {p}, {p}, {p}, {sps, pps, idr}} {
+		nalus := fault.Apply(frame)
+		switch i {
+		case 0, 1:
+			if len(nalus) != len(frame) || !bytes.Equal(nalus[len(nalus)-1], frame[len(frame)-1]) {
+				t.Errorf("frame %v should not be damaged", i)
+			}
+		case 3:
+			if len(nalus) != 0 {
+				t.Errorf("frame %v should be dropped", i)
+			}
+		case 2:
+			if len(nalus) != 1 || len(nalus[0]) == 0 || len(nalus[0]) >= len(p) || nalus[0][0] != p[0] {
+				t.Errorf("frame %v should be truncated, %v", i, nalus)
+			}
+		case 4:
+			if len(nalus) != 3 || !bytes.Equal(nalus[1], pps) || nalus[2][0] != idr[0] || bytes.Equal(nalus[2], idr) {
+				t.Errorf("frame %v should be flipped, %v", i, nalus)
+			}
+		}
+	}
+
+	// The source frames should never be modified.
+	if !bytes.Equal(idr, []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}) || !bytes.Equal(p, []byte{0x41, 0x9a, 0x02, 0x04, 0x08, 0x10}) {
+		t.Errorf("source modified")
+	}
+	if fault.Dropped != 1 || fault.Truncated != 1 || fault.Flipped != 1 {
+		t.Errorf("invalid stats %v", fault.String())
+	}
+
+	// The dropped frame is still a video frame, but without PES.
+	fault = NewFaultInjector([]*FaultRule{{Action: FaultActionDrop, Target: FaultTargetInterframe, Every: 1}}, 1234, false)
+	pack.SetFaultInjector(fault)
+	if err := pack.WriteAccessUnit([][]byte{p}, 3600, 3600); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if !pack.hasVideo || len(pack.packets) != 0 {
+		t.Errorf("invalid pack, video=%v, packets=%v", pack.hasVideo, len(pack.packets))
+	}
+}
+
+func TestPSPacketFaultInjector(t *testing.T) {
+	for _, s := range []string{"drop-psm", "drop-psm:0", "drop-psm:1.5", "drop-psm:x", "drop-pes:0.1"} {
+		if _, err := ParsePSFaultRules(s); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+
+	rules, err := ParsePSFaultRules("flip-pack:0.5, drop-psm:1")
+	if err != nil || len(rules) != 2 || rules[0].String() != "flip-pack:0.5" {
+		t.Errorf("invalid rules %v, err %+v", rules, err)
+		return
+	}
+
+	// The pack with header, PSM and a video frame in 3 PES packets.
+	newPack := func() *PSPackStream {
+		pack := NewPSPackStreamWithProfile(96, PSProfileVideoOnly)
+		pack.SetPesLength(100)
+		if err := pack.WriteHeader(mpeg2.PS_STREAM_H264, 0); err != nil {
+			panic(err)
+		}
+		if err := pack.WriteAccessUnit([][]byte{append([]byte{0x65}, make([]byte, 250)...)}, 0, 0); err != nil {
+			panic(err)
+		}
+		return pack
+	}
+
+	for _, c := range []struct {
+		action PSFaultAction
+		verify func(source, packs []*PSPacket, fault *PSFaultInjector) bool
+	}{
+		{PSFaultActionFlipPack, func(source, packs []*PSPacket, fault *PSFaultInjector) bool {
+			header := packs[0].ps[0]
+			return fault.FlippedPacks == 1 && bytes.Equal(header[:4], []byte{0, 0, 1, 0xba}) &&
+				!bytes.Equal(header, source[0].ps[0])
+		}},
+		{PSFaultActionDropPSM, func(source, packs []*PSPacket, fault *PSFaultInjector) bool {
+			for _, p := range packs {
+				if p.t == PSPacketTypeProgramStramMap {
+					return false
+				}
+			}
+			return fault.DroppedPSM == 1 && len(packs) == len(source)-1
+		}},
+		{PSFaultActionTruncatePES, func(source, packs []*PSPacket, fault *PSFaultInjector) bool {
+			video, origin := packs[len(packs)-1].ps, source[len(source)-1].ps
+			for i, pes := range video {
+				if len(pes) < 6 || len(pes) >= len(origin[i]) || !bytes.Equal(pes[:6], origin[i][:6]) {
+					return false
+				}
+			}
+			return fault.TruncatedPES == 3 && len(video) == 3
+		}},
+		{PSFaultActionPESLength, func(source, packs []*PSPacket, fault *PSFaultInjector) bool {
+			video, origin := packs[len(packs)-1].ps, source[len(source)-1].ps
+			for i, pes := range video {
+				if len(pes) != len(origin[i]) || bytes.Equal(pes[4:6], origin[i][4:6]) || !bytes.Equal(pes[6:], origin[i][6:]) {
+					return false
+				}
+			}
+			return fault.WrongPESLength == 3
+		}},
+	} {
+		pack := newPack()
+		source := pack.Packets()
+		var backup [][]byte
+		for _, p := range source {
+			for _, b := range p.ps {
+				backup = append(backup, append([]byte{}, b...))
+			}
+		}
+
+		fault := NewPSFaultInjector([]*PSFaultRule{{Action: c.action, Rate: 1}}, 1234)
+		if packs := fault.Apply(source); !c.verify(source, packs, fault) {
+			t.Errorf("action %v, invalid corruption %v", c.action, fault.String())
+		}
+
+		// The source packets should never be modified.
+		var actual [][]byte
+		for _, p := range source {
+			actual = append(actual, p.ps...)
+		}
+		if !reflect.DeepEqual(actual, backup) {
+			t.Errorf("action %v, source modified", c.action)
+		}
+	}
+}
+
+func TestPSClientPaced(t *testing.T) {
+	var packs []*PSPacket
+	for i := 0; i < 5; i++ {
+		packs = append(packs, &PSPacket{pt: 96, ts: 3600, ps: [][]byte{{0x00, 0x00, 0x01, 0xe0}}})
+	}
+
+	// Should wait for gap between packets, but not after the last one.
+	var b bytes.Buffer
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.conn = &psTestConn{w: &b}
+
+	starttime := time.Now()
+	if err := v.WritePacksOverRTPPaced(packs, 10*time.Millisecond, time.Now().Add(time.Second)); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if d := time.Since(starttime); d < 40*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("invalid duration %v", d)
+	}
+
+	// Should shrink the gap to deliver all packets before deadline.
+	starttime = time.Now()
+	if err := v.WritePacksOverRTPPaced(packs, time.Second, time.Now().Add(40*time.Millisecond)); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if d := time.Since(starttime); d > 200*time.Millisecond {
+		t.Errorf("invalid duration %v", d)
+	}
+
+	if stats := v.Stats(); stats.Packets != 10 {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+}
+
+func TestPSClientRecordHeaders(t *testing.T) {
+	var b bytes.Buffer
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.conn = &psTestConn{w: &b}
+	v.seq = 65533 // To wrap around.
+	v.RecordHeaders(4)
+
+	pack := []*PSPacket{{pt: 96, ts: 3600, ps: [][]byte{{0x00, 0x00, 0x01, 0xba}, {0x00, 0x00, 0x01, 0xe0, 0x00}}}}
+	for i := 0; i < 2; i++ {
+		if err := v.WritePacksOverRTP(pack); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+	}
+	if err := v.WritePadding(100); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// Only keep the latest 4 headers.
+	headers := v.Headers()
+	if len(headers) != 4 {
+		t.Errorf("invalid headers %v", headers)
+		return
+	}
+	if err := VerifyRTPContinuity(headers); err != nil {
+		t.Errorf("err %+v", err)
+	}
+	if h := headers[0]; h.SequenceNumber != 65535 || h.SSRC != 1234 || h.PayloadSize != 5 || h.Timestamp != 3600 {
+		t.Errorf("invalid header %v", h)
+	}
+	if h := headers[3]; h.SequenceNumber != 2 || h.Padding != 100 || h.PayloadSize != 0 {
+		t.Errorf("invalid header %v", h)
+	}
+
+	// Should detect the discontinuity.
+	headers[2].SequenceNumber++
+	if err := VerifyRTPContinuity(headers); err == nil {
+		t.Errorf("should fail for sequence")
+	}
+	headers[2].SequenceNumber--
+	headers[3].SSRC++
+	if err := VerifyRTPContinuity(headers); err == nil {
+		t.Errorf("should fail for SSRC")
+	}
+
+	v.RecordHeaders(0)
+	if headers := v.Headers(); len(headers) != 0 {
+		t.Errorf("invalid headers %v", headers)
+	}
+}
+
+func TestPSClientTCPPassive(t *testing.T) {
+	// The setup of device is the opposite of server.
+	for sdp, expect := range map[string]string{
+		"": "active", "a=setup:passive\r\n": "active", "a=setup:actpass\r\n": "active", "a=setup:active\r\n": "passive",
+	} {
+		invite := sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: "34020000001310000001"}},
+			"SIP/2.0", nil, "v=0\r\nm=video 9000 TCP/RTP/AVP 96\r\n"+sdp+"y=100\r\n", nil)
+		if out, err := parseInviteChannel(invite, ""); err != nil || out.setup != expect || out.hasSetup != (sdp != "") {
+			t.Errorf("invalid channel %v for %v, err %+v", out, sdp, err)
+		}
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer listener.Close()
+
+	// The answer has the listening port and setup of device.
+	out := &GBChannelOutput{ssrc: 100, transport: "tcp", setup: "passive", listener: listener}
+	answer := utilBuildInviteAnswer("34020000001320000001", "127.0.0.1", out)
+	port := listener.Addr().(*net.TCPAddr).Port
+	for _, line := range []string{fmt.Sprintf("m=video %v TCP/RTP/AVP 96", port), "a=setup:passive", "y=0000000100"} {
+		if !strings.Contains(answer, line+"\r\n") {
+			t.Errorf("no %v in answer %v", line, answer)
+		}
+	}
+	out.listener, out.setup = nil, "active"
+	if answer := utilBuildInviteAnswer("34020000001320000001", "127.0.0.1", out); !strings.Contains(answer, "m=video 9 ") ||
+		!strings.Contains(answer, "a=setup:active") {
+		t.Errorf("invalid answer %v", answer)
+	}
+
+	// The server connects to the device, which sends PS over the accepted connection.
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.listener = listener
+	if err := v.Connect(context.Background()); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	pack := NewPSPackStream(96)
+	if err := pack.WriteHeader(mpeg2.PS_STREAM_H264, 0); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := v.WritePacksOverRTP(pack.packets); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	v.Close()
+
+	if b := <-received; len(b) == 0 || uint64(len(b)) != v.Stats().Bytes {
+		t.Errorf("invalid received %v bytes, sent %v", len(b), v.Stats().Bytes)
+	}
+
+	// The accept is canceled by context.
+	listener2, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	v = NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.listener = listener2
+	if err := v.Connect(ctx); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("should be canceled, err %+v", err)
+	}
+}
+
+func TestPSClientUDP(t *testing.T) {
+	for sdp, expect := range map[string]string{
+		"m=video 9000 TCP/RTP/AVP 96\r\n": "tcp", "m=video 9000 RTP/AVP 96\r\n": "udp",
+	} {
+		invite := sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: "34020000001310000001"}},
+			"SIP/2.0", nil, "v=0\r\n"+sdp+"y=100\r\n", nil)
+		if out, err := parseInviteChannel(invite, ""); err != nil || out.transport != expect || out.mediaPort != 9000 {
+			t.Errorf("invalid channel %v, err %+v", out, err)
+		}
+	}
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	v := NewPSClient(1234, fmt.Sprintf("udp://%v", server.LocalAddr().String()))
+	v.transport, v.rtcpMux = PSTransportUDP, true
+	if err := v.Connect(context.Background()); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer v.Close()
+
+	payloads := [][]byte{{0x00, 0x00, 0x01, 0xba}, {0x00, 0x00, 0x01, 0xe0, 0x00}}
+	if err := v.WritePacksOverRTPPaced([]*PSPacket{{pt: 96, ts: 3600, ps: payloads}}, time.Millisecond, time.Now().Add(time.Second)); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// Each RTP packet is a datagram, without framing.
+	b := make([]byte, 1500)
+	var client *net.UDPAddr
+	for i, payload := range payloads {
+		server.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, addr, err := server.ReadFromUDP(b)
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		client = addr
+
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(b[:n]); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if p.SSRC != 1234 || p.SequenceNumber != uint16(i+1) || !bytes.Equal(p.Payload, payload) {
+			t.Errorf("invalid packet %v", p)
+		}
+	}
+	if stats := v.Stats(); stats.Bytes != uint64(12*2+4+5) {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+
+	// Should receive the RTCP over the same socket.
+	pli, err := (&rtcp.PictureLossIndication{MediaSSRC: 1234}).Marshal()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if _, err := server.WriteToUDP(pli, client); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	for i := 0; i < 100 && v.Stats().KeyframeRequests == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := v.Stats(); stats.KeyframeRequests != 1 {
+		t.Errorf("invalid stats %v", stats.String())
+	}
+}
+
+func TestPSUnpackStream(t *testing.T) {
+	pack := NewPSPackStream(96)
+	if err := pack.WriteHeader(mpeg2.PS_STREAM_H264, 3600); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	if err := pack.WriteAccessUnit([][]byte{{0x67, 0x64}, {0x68, 0xee}, idr}, 3600, 7200); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := pack.WriteAudio(psTestADTS(aac.SampleRateIndex44kHz, 16), 3600); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := pack.WriteVideo([]byte{0x41, 0x01}, 7200); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := pack.WriteEndOfStream(7200); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	var frames []*Frame
+	var packs, psms, eos int
+	unpack := NewPSUnpackStream()
+	unpack.OnPackHeader = func(pack *mpeg2.PSPackHeader) error {
+		packs++
+		return nil
+	}
+	unpack.OnProgramStreamMap = func(psm *mpeg2.Program_stream_map) error {
+		psms++
+		return nil
+	}
+	unpack.OnFrame = func(frame *Frame) error {
+		frames = append(frames, frame)
+		return nil
+	}
+	unpack.OnEndOfStream = func() error {
+		eos++
+		return nil
+	}
+
+	// Split the payloads to small pieces, like the RTP packets of server.
+	if err := pack.Range(func(p *PSPacket) error {
+		for _, payload := range p.Payloads() {
+			for len(payload) > 0 {
+				n := 500
+				if n > len(payload) {
+					n = len(payload)
+				}
+				if err := unpack.Write(payload[:n]); err != nil {
+					return err
+				}
+				payload = payload[n:]
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := unpack.Flush(); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	if packs != 1 || psms != 1 || eos != 1 || len(frames) != 3 {
+		t.Errorf("invalid packs=%v, psms=%v, eos=%v, frames=%v", packs, psms, eos, len(frames))
+		return
+	}
+	if f := frames[0]; f.Codec != FrameCodecH264 || f.DTS != 3600 || f.PTS != 7200 || len(f.Payloads) != 3 ||
+		!bytes.Equal(f.Payloads[2], idr) {
+		t.Errorf("invalid video %v, dts=%v, pts=%v, nalus=%v", f.Codec, f.DTS, f.PTS, len(f.Payloads))
+	}
+	if f := frames[1]; f.Codec != FrameCodecAAC || f.DTS != 3600 || len(f.Payloads) != 1 {
+		t.Errorf("invalid audio %v, dts=%v", f.Codec, f.DTS)
+	}
+	if f := frames[2]; f.Codec != FrameCodecH264 || f.DTS != 7200 || !bytes.Equal(f.Payloads[0], []byte{0x41, 0x01}) {
+		t.Errorf("invalid video %v, dts=%v", f.Codec, f.DTS)
+	}
+
+	// Should fail for garbage, or PES before PSM.
+	if err := NewPSUnpackStream().Write([]byte{0x00, 0x00, 0x02, 0xba}); err == nil {
+		t.Errorf("should fail for invalid start code")
+	}
+	pes := NewPSPackStream(96)
+	pes.WriteVideo([]byte{0x41, 0x01}, 3600)
+	if err := NewPSUnpackStream().Write(pes.Packets()[0].Payloads()[0]); err == nil {
+		t.Errorf("should fail for PES before PSM")
+	}
+}
+
+func TestPSWriteHEVC(t *testing.T) {
+	if !utilIsHEVCFile("avatar.hevc") || !utilIsHEVCFile("frames/%05d.H265") || utilIsHEVCFile("avatar.h264") {
+		t.Errorf("invalid hevc file detection")
+		return
+	}
+
+	// The H.265 prefix SEI should be parsed as the same uuid and payload.
+	payload := []byte{0x00, 0x00, 0x01, 0xff}
+	if uuid, b, err := utilParseSEIUserData(utilBuildHEVCSEIUserData(seiTimestampUUID, payload)); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	} else if uuid != seiTimestampUUID || !bytes.Equal(b, payload) {
+		t.Errorf("invalid uuid=%v, payload=%v", uuid, b)
+		return
+	}
+
+	pack := NewPSPackStream(96)
+	pack.SetSEI(seiTimestampUUID, payload)
+	if err := pack.WriteHeader(mpeg2.PS_STREAM_H265, 3600); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	// The AUD, VPS, SPS, PPS and IDR_W_RADL, then a TRAIL_R frame.
+	irap := [][]byte{{0x46, 0x01, 0x10}, {0x40, 0x01}, {0x42, 0x01}, {0x44, 0x01}, {0x26, 0x01, 0xaf}}
+	if err := pack.WriteAccessUnit(irap, 3600, 3600); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := pack.WriteVideo([]byte{0x02, 0x01, 0xd0}, 7200); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	var frames []*Frame
+	var streamType uint8
+	unpack := NewPSUnpackStream()
+	unpack.OnProgramStreamMap = func(psm *mpeg2.Program_stream_map) error {
+		streamType = psm.Stream_map[0].Stream_type
+		return nil
+	}
+	unpack.OnFrame = func(frame *Frame) error {
+		frames = append(frames, frame)
+		return nil
+	}
+	if err := pack.Range(func(p *PSPacket) error {
+		for _, payload := range p.Payloads() {
+			if err := unpack.Write(payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := unpack.Flush(); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	if streamType != uint8(mpeg2.PS_STREAM_H265) || len(frames) != 2 {
+		t.Errorf("invalid stream type 0x%x, frames %v", streamType, len(frames))
+		return
+	}
+
+	// The SEI should be after the AUD and parameter sets, and before the IRAP slice.
+	var types []NalUnitType
+	for _, nalu := range frames[0].Payloads {
+		types = append(types, NalUnitType((nalu[0]&0x7e)>>1))
+	}
+	expect := []NalUnitType{NaluTypeAud, NaluTypeVps, NaluTypeSps, NaluTypePps, NaluTypeSei, NaluTypeSliceIdr}
+	if frames[0].Codec != FrameCodecH265 || fmt.Sprint(types) != fmt.Sprint(expect) {
+		t.Errorf("invalid frame %v, nalus %v", frames[0].Codec, types)
+	}
+	if frames[1].Codec != FrameCodecH265 || frames[1].DTS != 7200 || len(frames[1].Payloads) != 1 {
+		t.Errorf("invalid frame %v, dts=%v", frames[1].Codec, frames[1].DTS)
+	}
+}
+
+func TestPSG711Audio(t *testing.T) {
+	if _, _, err := ParsePSAudioCodec("opus"); err == nil {
+		t.Errorf("should fail for opus")
+		return
+	}
+
+	// The last frame is not a full frame.
+	source, err := NewG711FrameSource(bytes.NewReader(bytes.Repeat([]byte{0xd5}, 330)), FrameCodecPCMA, 90000)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	pack := NewPSPackStreamWithProfile(96, PSProfileAudioOnly)
+	pack.SetAudioCodec(mpeg2.PS_STREAM_G711A)
+	if err := pack.WriteHeader(mpeg2.PS_STREAM_UNKNOW, 0); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	var sizes []int
+	for {
+		frame, err := source.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		sizes = append(sizes, len(frame.Payloads[0]))
+		if err := pack.WriteAudio(frame.Payloads[0], frame.DTS); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+	}
+	if fmt.Sprint(sizes) != "[160 160 10]" {
+		t.Errorf("invalid frames %v", sizes)
+		return
+	}
+
+	var streamType uint8
+	var frames []*Frame
+	unpack := NewPSUnpackStream()
+	unpack.OnProgramStreamMap = func(psm *mpeg2.Program_stream_map) error {
+		streamType = psm.Stream_map[0].Stream_type
+		return nil
+	}
+	unpack.OnFrame = func(frame *Frame) error {
+		frames = append(frames, frame)
+		return nil
+	}
+	if err := pack.Range(func(p *PSPacket) error {
+		for _, payload := range p.Payloads() {
+			if err := unpack.Write(payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// Each 160 samples is 20ms, that is 1800 in 90kHz.
+	if streamType != uint8(mpeg2.PS_STREAM_G711A) || len(frames) != 3 {
+		t.Errorf("invalid stream type 0x%x, frames %v", streamType, len(frames))
+	} else if f := frames[1]; f.Codec != FrameCodecPCMA || f.DTS != 3600 || len(f.Payloads[0]) != 160 {
+		t.Errorf("invalid frame %v, dts=%v, size=%v", f.Codec, f.DTS, len(f.Payloads[0]))
+	}
+}
+
+func TestPSIngesterSpeed(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	// 20 frames of 40ms is 800ms in realtime, and 200ms in 4x speed.
+	video := &psTestFrameSource{}
+	for i := 0; i < 20; i++ {
+		video.frames = append(video.frames, &Frame{
+			Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: [][]byte{{0x41, 0x01}},
+		})
+	}
+
+	v := NewPSIngester(&IngesterConfig{
+		ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+		psConfig: PSConfig{maxFrames: 20, speed: 4},
+	})
+	v.videoSource = video
+
+	starttime := time.Now()
+	if err := v.Ingest(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if elapsed := time.Since(starttime); elapsed < 150*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Errorf("invalid elapsed %v for 4x speed", elapsed)
+	}
+
+	// The bitrate is updated when the window is over 1s.
+	ps := NewPSClient(1234, "")
+	now := time.Now()
+	ps.updateBitrate(now)
+	ps.stats.Bytes = 1000
+	ps.updateBitrate(now.Add(500 * time.Millisecond))
+	if ps.stats.Bitrate != 0 {
+		t.Errorf("invalid bitrate %v", ps.stats.Bitrate)
+	}
+	ps.stats.Bytes = 2000
+	ps.updateBitrate(now.Add(2 * time.Second))
+	if ps.stats.Bitrate != 8000 {
+		t.Errorf("invalid bitrate %v", ps.stats.Bitrate)
+	}
+}
+
+func TestPSPesLengthAndRTPPayload(t *testing.T) {
+	nalu := make([]byte, 4996)
+	nalu[0] = 0x65
+
+	// The 5000 bytes AnnexB frame is split to 5 PES of 1024 bytes, or one jumbo PES.
+	for _, c := range []struct{ pesLength, pes int }{{1024, 5}, {8000, 1}, {0, 4}} {
+		pack := NewPSPackStream(96)
+		if c.pesLength > 0 {
+			pack.SetPesLength(c.pesLength)
+		}
+		if err := pack.WriteAccessUnit([][]byte{nalu}, 3600, 3600); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if video := pack.Packets()[0]; len(video.ps) != c.pes {
+			t.Errorf("pes length %v, invalid pes %v, expect %v", c.pesLength, len(video.ps), c.pes)
+			return
+		}
+	}
+
+	pack := NewPSPackStream(96)
+	pack.SetPesLength(1024)
+	if err := pack.WriteAccessUnit([][]byte{nalu}, 3600, 3600); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	var expect bytes.Buffer
+	if _, err := pack.WriteTo(&expect); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// Each PES is fragmented to RTP packets of 500 bytes payload, the receiver gets the same PS stream.
+	var b bytes.Buffer
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.conn, v.maxPayload = &psTestConn{w: &b}, 500
+	v.RecordHeaders(100)
+	if err := v.WritePacksOverRTP(pack.Packets()); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	headers := v.Headers()
+	// The first 4 PES is 1043 bytes in 3 packets, and the last PES is 923 bytes in 2 packets.
+	var sizes []int
+	for _, h := range headers {
+		sizes = append(sizes, h.PayloadSize)
+	}
+	if expect := "[500 500 43 500 500 43 500 500 43 500 500 43 500 423]"; fmt.Sprint(sizes) != expect {
+		t.Errorf("invalid sizes %v, expect %v", sizes, expect)
+		return
+	}
+	if err := VerifyRTPContinuity(headers); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	var actual []byte
+	for data := b.Bytes(); len(data) > 2; {
+		size := int(data[0])<<8 | int(data[1])
+		actual, data = append(actual, data[2+12:2+size]...), data[2+size:]
+	}
+	if !bytes.Equal(actual, expect.Bytes()) {
+		t.Errorf("invalid stream %v, expect %v", len(actual), expect.Len())
+	}
+}
+
+func TestPSIngesterHeaderMode(t *testing.T) {
+	// Write 1s at 25fps, with keyframe at frame 0 and 10, and 500ms header interval for interval mode.
+	for _, c := range []struct {
+		mode     PSHeaderMode
+		interval int
+		expect   string
+	}{
+		{PSHeaderModeKeyframe, 0, "[0 10]"},
+		{PSHeaderModeKeyframe, 500, "[0 10 23]"},
+		{PSHeaderModeInterval, 500, "[0 13]"},
+		{PSHeaderModeOnce, 500, "[0]"},
+	} {
+		v := NewPSIngester(&IngesterConfig{clockRate: 90000})
+		v.conf.psConfig.headerInterval, v.headerMode = c.interval, c.mode
+
+		var headers []int
+		for i := 0; i < 25; i++ {
+			pack := NewPSPackStream(96)
+			if err := v.writeHeader(pack, mpeg2.PS_STREAM_H264, i == 0 || i == 10, uint64(i*3600)); err != nil {
+				t.Errorf("err %+v", err)
+				return
+			}
+			for _, p := range pack.packets {
+				if p.t == PSPacketTypeProgramStramMap {
+					headers = append(headers, i)
+				}
+			}
+		}
+
+		if fmt.Sprint(headers) != c.expect {
+			t.Errorf("mode %v, interval %v, invalid headers %v, expect %v", c.mode, c.interval, headers, c.expect)
+		}
+	}
+
+	if _, err := ParsePSHeaderMode("never"); err == nil {
+		t.Error("should fail for invalid mode")
+	}
+}
+
+func TestPSIngesterMedia(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	newSources := func() (*psTestFrameSource, *psTestFrameSource) {
+		video, audio := &psTestFrameSource{}, &psTestFrameSource{}
+		for i := 0; i < 5; i++ {
+			video.frames = append(video.frames, &Frame{
+				Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: [][]byte{{0x65, 0x01}},
+			})
+			audio.frames = append(audio.frames, &Frame{
+				Codec: FrameCodecAAC, DTS: uint64(i * 1800), PTS: uint64(i * 1800), Payloads: [][]byte{psTestADTS(aac.SampleRateIndex44kHz, 16)},
+			})
+		}
+		return video, audio
+	}
+
+	// The sources not in media are ignored, and the PSM only declares the streams of media.
+	for _, c := range []struct {
+		media   string
+		profile PSProfile
+		packet  PSPacketType
+	}{
+		{"audio", PSProfileAudioOnly, PSPacketTypeAudio},
+		{"video", PSProfileVideoOnly, PSPacketTypeVideo},
+	} {
+		v := NewPSIngester(&IngesterConfig{ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+			psConfig: PSConfig{media: c.media},
+		})
+		v.videoSource, v.audioSource = newSources()
+
+		var nnPackets int
+		v.onSendPacket = func(pack *PSPackStream) error {
+			if pack.profile != c.profile {
+				t.Errorf("media %v, invalid profile %v", c.media, pack.profile)
+			}
+			for _, p := range pack.packets {
+				if p.t == PSPacketTypeVideo || p.t == PSPacketTypeAudio {
+					if p.t != c.packet {
+						t.Errorf("media %v, should not have %v", c.media, p.t)
+					}
+					nnPackets++
+				}
+			}
+			return nil
+		}
+
+		if err := v.Ingest(ctx); errors.Cause(err) != io.EOF {
+			t.Errorf("media %v, err %+v", c.media, err)
+			return
+		}
+		if nnPackets != 5 {
+			t.Errorf("media %v, invalid packets %v", c.media, nnPackets)
+		}
+	}
+
+	// The media requires the source.
+	v := NewPSIngester(&IngesterConfig{ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+		psConfig: PSConfig{media: "av"},
+	})
+	v.videoSource, _ = newSources()
+	if err := v.Ingest(ctx); err == nil {
+		t.Error("should fail for no audio")
+	}
+}
+
+func TestPSStats(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	// Each video frame is 305 bytes in ANNEXB, which is 4 PES packets of 100 bytes. The audio lasts longer than video,
+	// so all video frames are sent.
+	video, audio := &psTestFrameSource{}, &psTestFrameSource{}
+	for i := 0; i < 10; i++ {
+		if i < 5 {
+			video.frames = append(video.frames, &Frame{
+				Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: [][]byte{append([]byte{0x65}, make([]byte, 300)...)},
+			})
+		}
+		audio.frames = append(audio.frames, &Frame{
+			Codec: FrameCodecAAC, DTS: uint64(i * 1800), PTS: uint64(i * 1800), Payloads: [][]byte{psTestADTS(aac.SampleRateIndex44kHz, 16)},
+		})
+	}
+
+	v := NewPSIngester(&IngesterConfig{ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+		psConfig: PSConfig{pesLength: 100},
+	})
+	v.videoSource, v.audioSource = video, audio
+
+	var expect PSPackStreamStats
+	v.onSendPacket = func(pack *PSPackStream) error {
+		stats := pack.Stats()
+		expect.VideoFrames += stats.VideoFrames
+		expect.AudioFrames += stats.AudioFrames
+		expect.PES += stats.PES
+		expect.Bytes += stats.Bytes
+		return nil
+	}
+
+	if err := v.Ingest(ctx); errors.Cause(err) != io.EOF {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	stats := v.Stats()
+	if expect.VideoFrames != 5 || expect.AudioFrames == 0 || expect.PES != 4*expect.VideoFrames+expect.AudioFrames {
+		t.Errorf("invalid pack stats %v", expect.String())
+	}
+	if stats.VideoFrames != expect.VideoFrames || stats.AudioFrames != expect.AudioFrames || stats.PES != expect.PES {
+		t.Errorf("invalid client stats %v, expect %v", stats.String(), expect.String())
+	}
+	if stats.Bytes <= expect.Bytes {
+		t.Errorf("bytes on wire %v should include RTP header, ps %v", stats.Bytes, expect.Bytes)
+	}
+}
+
+func TestPSPlaybackControl(t *testing.T) {
+	r, err := parseMANSRTSP("PLAY MANSRTSP/1.0\r\nCSeq: 2\r\nScale: 2.0\r\nRange: npt=1.5-\r\n")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if r.Method != "PLAY" || r.CSeq != 2 || r.Scale != 2 || !r.hasRange || r.Range != 1500*time.Millisecond {
+		t.Errorf("invalid request %v", r.String())
+		return
+	}
+
+	// Resume from the current position is not a seek.
+	if r, err := parseMANSRTSP("PLAY MANSRTSP/1.0\nCSeq: 3\nRange: npt=now-\n"); err != nil || r.hasRange || r.Scale != 0 {
+		t.Errorf("invalid resume %v, err %+v", r, err)
+		return
+	}
+	if r, err := parseMANSRTSP("PAUSE MANSRTSP/1.0\r\nCSeq: 4\r\nPauseTime: now\r\n"); err != nil || r.Method != "PAUSE" {
+		t.Errorf("invalid pause %v, err %+v", r, err)
+		return
+	}
+
+	for _, body := range []string{
+		"", "GET MANSRTSP/1.0\r\n", "PLAY RTSP/1.0\r\n", "PLAY MANSRTSP/1.0\r\nCSeq: x\r\n",
+		"PLAY MANSRTSP/1.0\r\nScale: 0\r\n", "PLAY MANSRTSP/1.0\r\nScale: -1\r\n",
+		"PLAY MANSRTSP/1.0\r\nRange: 100-\r\n", "PLAY MANSRTSP/1.0\r\nRange: npt=abc-\r\n",
+		"PLAY MANSRTSP/1.0\r\nCSeq\r\n",
+	} {
+		if _, err := parseMANSRTSP(body); err == nil {
+			t.Errorf("should fail for %v", body)
+			return
+		}
+	}
+
+	// Wait until resumed, and the seek is taken once.
+	control := NewPlaybackControl()
+	pause, _ := parseMANSRTSP("PAUSE MANSRTSP/1.0\r\nCSeq: 1\r\n")
+	control.Apply(pause)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		control.Apply(r)
+	}()
+
+	starttime := time.Now()
+	version, err := control.Wait(context.Background())
+	if err != nil || version != 2 || time.Since(starttime) < 50*time.Millisecond {
+		t.Errorf("invalid wait version=%v, err %+v", version, err)
+		return
+	}
+	if control.Scale() != 2 || control.Teardown() {
+		t.Errorf("invalid control scale=%v", control.Scale())
+		return
+	}
+	if seek, ok := control.TakeSeek(); !ok || seek != 1500*time.Millisecond {
+		t.Errorf("invalid seek %v", seek)
+		return
+	}
+	if _, ok := control.TakeSeek(); ok {
+		t.Error("should take seek once")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	control.Apply(pause)
+	if _, err := control.Wait(ctx); err == nil {
+		t.Error("should timeout when paused")
+		return
+	}
+
+	teardown, _ := parseMANSRTSP("TEARDOWN MANSRTSP/1.0\r\nCSeq: 5\r\n")
+	control.Apply(teardown)
+	if _, err := control.Wait(context.Background()); err != nil || !control.Teardown() {
+		t.Errorf("invalid teardown, err %+v", err)
+		return
+	}
+}
+
+func TestPSIngesterPlaybackControl(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	// The keyframes of video are 0 and 10, and the audio lasts longer than video.
+	newSources := func() (*psTestFrameSource, *psTestFrameSource) {
+		video, audio := &psTestFrameSource{}, &psTestFrameSource{}
+		for i := 0; i < 20; i++ {
+			payloads := [][]byte{{0x41, 0x01, 0x02}}
+			if i%10 == 0 {
+				payloads = [][]byte{{0x67, 0x01}, {0x68, 0x02}, {0x65, 0x03}}
+			}
+			video.frames = append(video.frames, &Frame{
+				Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: payloads,
+			})
+		}
+		for i := 0; i < 44; i++ {
+			audio.frames = append(audio.frames, &Frame{
+				Codec: FrameCodecAAC, DTS: uint64(i * 1800), PTS: uint64(i * 1800), Payloads: [][]byte{psTestADTS(aac.SampleRateIndex44kHz, 16)},
+			})
+		}
+		return video, audio
+	}
+
+	for _, c := range []struct {
+		body     string
+		duration time.Duration
+		// The error and video frames sent.
+		eof       bool
+		minFrames uint64
+		maxFrames uint64
+	}{
+		// Seek to 0.2s, which starts from the next keyframe 10, at 4x speed.
+		{"PLAY MANSRTSP/1.0\r\nCSeq: 1\r\nScale: 4\r\nRange: npt=0.2-\r\n", 0, true, 10, 10},
+		// Stop by TEARDOWN, no frame is sent.
+		{"TEARDOWN MANSRTSP/1.0\r\nCSeq: 1\r\n", 0, false, 0, 0},
+		// Stop at the end of playback.
+		{"PLAY MANSRTSP/1.0\r\nCSeq: 1\r\nScale: 4\r\n", 200 * time.Millisecond, false, 1, 6},
+	} {
+		server, err := newPSTestServer()
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		defer server.Close()
+
+		r, err := parseMANSRTSP(c.body)
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		control := NewPlaybackControl()
+		control.Apply(r)
+
+		v := NewPSIngester(&IngesterConfig{ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+			psConfig: PSConfig{speed: 1}, playbackDuration: c.duration, control: control,
+		})
+		v.videoSource, v.audioSource = newSources()
+
+		err = v.Ingest(ctx)
+		if c.eof && errors.Cause(err) != io.EOF || !c.eof && err != nil {
+			t.Errorf("%v err %+v", c.body, err)
+			return
+		}
+		if stats := v.Stats(); stats.VideoFrames < c.minFrames || stats.VideoFrames > c.maxFrames {
+			t.Errorf("%v invalid frames %v, expect [%v, %v]", c.body, stats.VideoFrames, c.minFrames, c.maxFrames)
+			return
+		}
+	}
+}
+
+func psTestMP4Track(handler string, timescale uint32, entry []byte, delta uint32, ctts []uint32, sizes []uint32,
+	offset uint32) []byte {
+	n := uint32(len(sizes))
+	stbl := [][]byte{
+		psTestMP4Box("stsd", psTestMP4Uint32s(0, 1), entry),
+		psTestMP4Box("stts", psTestMP4Uint32s(0, 1, n, delta)),
+		psTestMP4Box("stsc", psTestMP4Uint32s(0, 1, 1, n, 1)),
+		psTestMP4Box("stsz", psTestMP4Uint32s(0, 0, n), psTestMP4Uint32s(sizes...)),
+		psTestMP4Box("stco", psTestMP4Uint32s(0, 1, offset)),
+	}
+	if ctts != nil {
+		var entries []uint32
+		for _, cts := range ctts {
+			entries = append(entries, 1, cts)
+		}
+		stbl = append(stbl, psTestMP4Box("ctts", psTestMP4Uint32s(0, n), psTestMP4Uint32s(entries...)))
+	}
+
+	return psTestMP4Box("trak", psTestMP4Box("mdia",
+		psTestMP4Box("mdhd", psTestMP4Uint32s(0, 0, 0, timescale, 0, 0)),
+		psTestMP4Box("hdlr", psTestMP4Uint32s(0, 0), []byte(handler), make([]byte, 13)),
+		psTestMP4Box("minf", psTestMP4Box("stbl", stbl...)),
+	))
+}
+
+func TestPSIngesterVideoCodec(t *testing.T) {
+	frame := &Frame{Codec: FrameCodecH264, Payloads: [][]byte{{0x67, 0x42}, {0x68, 0xce}, {0x65, 0x88}}}
+
+	// The PSM declares the overwritten codec, while the payload is passed through.
+	for _, c := range []struct {
+		codec  string
+		expect mpeg2.PS_STREAM_TYPE
+	}{
+		{"", mpeg2.PS_STREAM_H264}, {"h265", mpeg2.PS_STREAM_H265}, {"svac", PSStreamSVAC}, {"mpeg4", PSStreamMPEG4},
+	} {
+		v := NewPSIngester(&IngesterConfig{clockRate: 90000})
+		var err error
+		if v.videoCodec, err = ParsePSVideoCodec(c.codec); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+
+		pack := NewPSPackStream(96)
+		if err := v.writeVideoFrame(pack, frame); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+
+		var streamType uint8
+		var payload []byte
+		for _, p := range pack.packets {
+			if p.t == PSPacketTypeProgramStramMap {
+				psm := &mpeg2.Program_stream_map{}
+				if err := psm.Decode(codec.NewBitStream(p.ps[0])); err != nil {
+					t.Errorf("err %+v", err)
+					return
+				}
+				streamType = psm.Stream_map[0].Stream_type
+			} else if p.t == PSPacketTypeVideo {
+				pes := mpeg2.NewPesPacket()
+				if err := pes.Decode(codec.NewBitStream(p.ps[0])); err != nil {
+					t.Errorf("err %+v", err)
+					return
+				}
+				payload = pes.Pes_payload
+			}
+		}
+
+		if mpeg2.PS_STREAM_TYPE(streamType) != c.expect {
+			t.Errorf("codec %v, invalid stream type 0x%x, expect 0x%x", c.codec, streamType, c.expect)
+		}
+		if expect := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88}; !bytes.Equal(payload, expect) {
+			t.Errorf("codec %v, invalid payload %x", c.codec, payload)
+		}
+	}
+
+	if _, err := ParsePSVideoCodec("vp8"); err == nil {
+		t.Error("should fail for invalid codec")
+	}
+}
+
+func TestPSRTPFaultInjector(t *testing.T) {
+	if rules, err := ParseRTPFaultRules("seq-jump:0.01, duplicate:0.5,reorder:1,ts-rollback:0.1"); err != nil || len(rules) != 4 ||
+		rules[0].Action != RTPFaultActionSeqJump || rules[3].String() != "ts-rollback:0.1" {
+		t.Errorf("invalid rules %v, err %+v", rules, err)
+		return
+	}
+	for _, s := range []string{"seq-jump", "jump:0.1", "reorder:0", "duplicate:1.1", "reorder:x"} {
+		if _, err := ParseRTPFaultRules(s); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+
+	// Send 4 packets of one pack by the action, and verify the recorded headers.
+	pack := []*PSPacket{{pt: 96, ts: 90000, ps: [][]byte{{0x00}, {0x01}, {0x02}, {0x03}}}}
+	for _, c := range []struct {
+		action RTPFaultAction
+		verify func(headers []PSRTPHeader, fault *RTPFaultInjector) bool
+	}{
+		{RTPFaultActionSeqJump, func(headers []PSRTPHeader, fault *RTPFaultInjector) bool {
+			for i := 1; i < len(headers); i++ {
+				if gap := headers[i].SequenceNumber - headers[i-1].SequenceNumber; gap < 2 || gap > 1001 {
+					return false
+				}
+			}
+			return fault.SeqJumps == 4 && len(headers) == 4
+		}},
+		{RTPFaultActionDuplicate, func(headers []PSRTPHeader, fault *RTPFaultInjector) bool {
+			for i := 0; i < len(headers); i += 2 {
+				if headers[i] != headers[i+1] || headers[i].SequenceNumber != uint16(i/2+1) {
+					return false
+				}
+			}
+			return fault.Duplicated == 4 && len(headers) == 8
+		}},
+		{RTPFaultActionReorder, func(headers []PSRTPHeader, fault *RTPFaultInjector) bool {
+			var seqs []uint16
+			for _, h := range headers {
+				seqs = append(seqs, h.SequenceNumber)
+			}
+			return fault.Reordered == 2 && reflect.DeepEqual(seqs, []uint16{2, 1, 4, 3})
+		}},
+		{RTPFaultActionTSRollback, func(headers []PSRTPHeader, fault *RTPFaultInjector) bool {
+			for _, h := range headers {
+				if h.Timestamp >= 90000 {
+					return false
+				}
+			}
+			return fault.TSRollbacks == 4 && VerifyRTPContinuity(headers) == nil
+		}},
+	} {
+		var b bytes.Buffer
+		v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+		v.conn = &psTestConn{w: &b}
+		v.RecordHeaders(10)
+
+		fault := NewRTPFaultInjector([]*RTPFaultRule{{Action: c.action, Rate: 1}}, 1234)
+		v.SetRTPFaultInjector(fault)
+		if err := v.WritePacksOverRTP(pack); err != nil {
+			t.Errorf("action %v, err %+v", c.action, err)
+			return
+		}
+		if headers := v.Headers(); !c.verify(headers, fault) || v.Stats().Packets != uint64(len(headers)) {
+			t.Errorf("action %v, invalid headers %v, %v", c.action, headers, fault.String())
+		}
+	}
+
+	// The held packet is flushed at the end of pack, even it's the last one.
+	var b bytes.Buffer
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.conn = &psTestConn{w: &b}
+	v.RecordHeaders(10)
+	v.SetRTPFaultInjector(NewRTPFaultInjector([]*RTPFaultRule{{Action: RTPFaultActionReorder, Rate: 1}}, 1234))
+	if err := v.WritePacksOverRTP(pack[:1]); err != nil || len(v.Headers()) != 4 || v.held != nil {
+		t.Errorf("invalid headers %v, err %+v", v.Headers(), err)
+		return
+	}
+	if err := v.WritePacksOverRTP([]*PSPacket{{pt: 96, ts: 93600, ps: [][]byte{{0x04}}}}); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if headers := v.Headers(); len(headers) != 5 || headers[4].SequenceNumber != 5 || headers[4].Timestamp != 93600 {
+		t.Errorf("invalid headers %v", headers)
+	}
+}
+
+func TestPSSSRCChange(t *testing.T) {
+	// The RR of previous SSRC after changed is stale.
+	v := NewPSClient(1234, "tcp://127.0.0.1:9000")
+	v.SetSSRC(5678)
+	if v.SSRC() != 5678 {
+		t.Errorf("invalid ssrc %v", v.SSRC())
+		return
+	}
+	b, err := rtcp.Marshal([]rtcp.Packet{&rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{
+		{SSRC: 1234, TotalLost: 10}, {SSRC: 5678, TotalLost: 3},
+	}}})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := v.handleRTCP(b); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if stats := v.Stats(); stats.SSRCChanges != 1 || stats.StaleReports != 1 || stats.ReceiverReports != 1 ||
+		stats.TotalLost != 3 || !strings.Contains(stats.String(), "ssrc-changes=1, stale-rr=1") {
+		t.Errorf("invalid stats %v", stats.String())
+		return
+	}
+
+	ctx := logger.WithContext(context.Background())
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*srsTimeout)*time.Millisecond)
+	defer cancel()
+
+	server, err := newPSTestServer()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	// The SSRC is used by another device, but allowed to collide when overwritten, and changed for each pack.
+	if err := gSSRCRegistry.Add(4321); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer gSSRCRegistry.Remove(4321)
+
+	video := &psTestFrameSource{}
+	for i := 0; i < 3; i++ {
+		video.frames = append(video.frames, &Frame{
+			Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i * 3600), Payloads: [][]byte{{0x65, 0x01}},
+		})
+	}
+
+	ingester := NewPSIngester(&IngesterConfig{
+		ssrc: 1234, serverAddr: server.Addr(), clockRate: 90000, payloadType: 96,
+		psConfig: PSConfig{ssrc: 4321, ssrcChange: time.Nanosecond},
+	})
+	ingester.videoSource = video
+	if err := ingester.Ingest(ctx); errors.Cause(err) != io.EOF {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// The first pack is sent by 4321, then each pack by a new SSRC, with the sequence number continuous.
+	var ssrcs []uint32
+	var seq uint16
+	for len(ssrcs) < 4 {
+		select {
+		case <-ctx.Done():
+			t.Errorf("err %+v", ctx.Err())
+			return
+		case p := <-server.packets:
+			if seq++; p.SequenceNumber != seq {
+				t.Errorf("invalid packet %v", p)
+				return
+			}
+			if len(ssrcs) == 0 || ssrcs[len(ssrcs)-1] != p.SSRC {
+				ssrcs = append(ssrcs, p.SSRC)
+			}
+		}
+	}
+	if ssrcs[0] != 4321 || ssrcs[1] == 4321 || ssrcs[2] == ssrcs[1] || ssrcs[3] == ssrcs[2] {
+		t.Errorf("invalid ssrcs %v", ssrcs)
+	}
+
+	// The changed SSRCs are released after end, while the SSRC of another device is still in use.
+	gSSRCRegistry.lock.Lock()
+	defer gSSRCRegistry.lock.Unlock()
+	for i, ssrc := range ssrcs {
+		if gSSRCRegistry.ssrcs[ssrc] != (i == 0) {
+			t.Errorf("invalid registry %v of %v", gSSRCRegistry.ssrcs, ssrcs)
+		}
+	}
+}
+
+func TestPSReconnect(t *testing.T) {
+	for _, restart := range []bool{false, true} {
+		func() {
+			ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 5*time.Second)
+			defer cancel()
+
+			listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+			if err != nil {
+				t.Errorf("err %+v", err)
+				return
+			}
+			defer listener.Close()
+
+			// Read packets of each connection, the first connection is dropped by server after 5 packets.
+			read := func(n int) ([]*rtp.Packet, error) {
+				conn, err := listener.AcceptTCP()
+				if err != nil {
+					return nil, err
+				}
+				defer conn.Close()
+
+				var packets []*rtp.Packet
+				r := NewPSFrameReader(conn, PSFramingRFC4571)
+				for len(packets) < n {
+					b, _, err := r.ReadPacket()
+					if err != nil {
+						return nil, err
+					}
+					p := &rtp.Packet{}
+					if err := p.Unmarshal(b); err != nil {
+						return nil, err
+					}
+					packets = append(packets, p)
+				}
+				return packets, nil
+			}
+			type result struct {
+				first, second []*rtp.Packet
+				err           error
+			}
+			results := make(chan *result, 1)
+			go func() {
+				r := &result{}
+				if r.first, r.err = read(5); r.err == nil {
+					r.second, r.err = read(5)
+				}
+				results <- r
+			}()
+
+			ps := NewPSClient(100, fmt.Sprintf("tcp://%v", listener.Addr()))
+			ps.reconnects, ps.reconnectBackoff, ps.reconnectRestart = 3, 10*time.Millisecond, restart
+			ps.RecordHeaders(5000)
+			if err := ps.Connect(ctx); err != nil {
+				t.Errorf("err %+v", err)
+				return
+			}
+			defer ps.Close()
+
+			// Write until reconnected and the server got enough packets.
+			var r *result
+			for i := 1; r == nil && i < 5000; i++ {
+				pack := NewPSPacket(PSPacketTypeVideo, []byte{0x00, 0x00, 0x01, 0xe0}, uint64(i*3600), 96)
+				if err := ps.WritePacksOverRTP([]*PSPacket{pack}); err != nil {
+					t.Errorf("err %+v", err)
+					return
+				}
+
+				select {
+				case r = <-results:
+				case <-time.After(time.Millisecond):
+				}
+			}
+			if r == nil || r.err != nil {
+				t.Errorf("restart=%v, invalid result %v", restart, r)
+				return
+			}
+
+			stats := ps.Stats()
+			if stats.Reconnects != 1 {
+				t.Errorf("restart=%v, invalid stats %v", restart, stats.String())
+				return
+			}
+
+			// The sequence number and timestamp continue, or restart from zero timestamp.
+			last, next := r.first[len(r.first)-1], r.second[0]
+			if restart {
+				if next.Timestamp != 0 || r.second[1].Timestamp != 3600 {
+					t.Errorf("invalid restart ts %v, %v", next.Timestamp, r.second[1].Timestamp)
+				}
+			} else if next.SequenceNumber-last.SequenceNumber >= 0x8000 || next.Timestamp <= last.Timestamp ||
+				uint32(next.SequenceNumber-last.SequenceNumber)*3600 != next.Timestamp-last.Timestamp {
+				t.Errorf("invalid resume seq %v->%v, ts %v->%v", last.SequenceNumber, next.SequenceNumber,
+					last.Timestamp, next.Timestamp)
+			}
+			for i := 1; i < len(r.second); i++ {
+				if r.second[i].SequenceNumber != r.second[i-1].SequenceNumber+1 {
+					t.Errorf("invalid seq %v->%v", r.second[i-1].SequenceNumber, r.second[i].SequenceNumber)
+				}
+			}
+
+			// The packet dropped by restart is not counted, so the first header after restart is the first packet
+			// received by server.
+			headers := ps.Headers()
+			if uint64(len(headers)) != stats.Packets {
+				t.Errorf("restart=%v, invalid headers %v, packets %v", restart, len(headers), stats.Packets)
+			}
+			if restart {
+				for i := 1; i < len(headers); i++ {
+					if headers[i].SequenceNumber != headers[i-1].SequenceNumber+1 {
+						if h := headers[i]; h.SequenceNumber != next.SequenceNumber || h.Timestamp != next.Timestamp {
+							t.Errorf("invalid restart header %+v, expect seq=%v", h, next.SequenceNumber)
+						}
+						break
+					}
+				}
+			} else if err := VerifyRTPContinuity(headers); err != nil {
+				t.Errorf("err %+v", err)
+			}
+		}()
+	}
+}
+
+func TestPSFrameTracer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gb28181")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "trace.jsonl")
+	tracer, err := newPSFrameTracer(filename, false)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// The B-frame is decoded after the P-frame, so its PTS is less than the P-frame.
+	pack := NewPSPackStreamWithProfile(96, PSProfileAudioVideo)
+	pack.onWriteFrame = tracer.OnWriteFrame
+	if err := pack.WriteAccessUnit([][]byte{{0x41, 0x9a, 0x01}}, 3600, 10800); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := pack.WriteAccessUnit([][]byte{{0x09, 0x30}, {0x01, 0x9e, 0x02, 0x03}, {0x01, 0x9e, 0x04}}, 7200, 7200); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := pack.WriteAudio(psTestADTS(aac.SampleRateIndex44kHz, 16), 9000); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	tracer.Close()
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	var traces []*psFrameTrace
+	for dec := json.NewDecoder(bytes.NewReader(b)); ; {
+		trace := &psFrameTrace{}
+		if err := dec.Decode(trace); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		traces = append(traces, trace)
+	}
+
+	if len(traces) != 3 {
+		t.Errorf("invalid traces %v", len(traces))
+		return
+	}
+	if v := traces[0]; v.Media != "video" || v.NALUType != 1 || v.Size != 3 || v.DTS != 3600 || v.PTS != 10800 ||
+		v.Fragments != 1 || v.PESSize <= v.Size {
+		t.Errorf("invalid trace %+v", v)
+	}
+	// The access unit of AUD and two slices, should be one trace with the total size.
+	if v := traces[1]; v.Media != "video" || v.NALUType != 1 || len(v.NALUs) != 3 || v.NALUs[0] != 9 || v.Size != 9 ||
+		v.DTS != 7200 || v.PTS != 7200 || v.Fragments != 1 {
+		t.Errorf("invalid trace %+v", v)
+	}
+	if v := traces[2]; v.Media != "audio" || v.NALUType != 0 || v.DTS != 9000 || v.PTS != 9000 || v.Fragments != 1 {
+		t.Errorf("invalid trace %+v", v)
+	}
+}
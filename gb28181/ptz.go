@@ -0,0 +1,124 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"strings"
+	"time"
+)
+
+// The PTZ command of DeviceControl, see GB28181-2016 A.3. The command is 8 bytes:
+//
+//	A5 | version(4bits) check(4bits) | address(8bits) | command | pan speed | tilt speed | zoom speed(4bits)
+//	address high(4bits) | checksum
+//
+// The command is the bits of 0 0 zoom-out zoom-in up down left right for PTZ, or 0x81 to 0x83 for preset, whose number
+// is in the byte of pan speed.
+type PTZCommand struct {
+	// The time when received, the channel and SN of DeviceControl.
+	At        time.Time
+	ChannelID string
+	SN        uint64
+	// The PTZCmd in hex.
+	Cmd string
+	// The address, command byte and speeds parsed from PTZCmd.
+	Address   uint16
+	Command   uint8
+	PanSpeed  uint8
+	TiltSpeed uint8
+	ZoomSpeed uint8
+}
+
+// Parse the PTZCmd in hex, validate the header and checksums.
+func parsePTZCommand(cmd string) (*PTZCommand, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(cmd))
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode %v", cmd)
+	}
+	if len(b) != 8 {
+		return nil, errors.Errorf("invalid length %v of %v", len(b), cmd)
+	}
+	if b[0] != 0xa5 {
+		return nil, errors.Errorf("invalid header 0x%x of %v", b[0], cmd)
+	}
+
+	// The check of byte 2 is the sum of the nibbles of byte 1 and the version, mod 16.
+	if check := (b[0]>>4 + b[0]&0x0f + b[1]>>4) & 0x0f; b[1]&0x0f != check {
+		return nil, errors.Errorf("invalid check 0x%x, expect 0x%x of %v", b[1]&0x0f, check, cmd)
+	}
+
+	// The checksum of byte 8 is the sum of byte 1 to 7, mod 256.
+	var sum uint8
+	for _, c := range b[:7] {
+		sum += c
+	}
+	if b[7] != sum {
+		return nil, errors.Errorf("invalid checksum 0x%x, expect 0x%x of %v", b[7], sum, cmd)
+	}
+
+	return &PTZCommand{
+		Cmd: strings.ToUpper(hex.EncodeToString(b)), Address: uint16(b[6]&0x0f)<<8 | uint16(b[2]), Command: b[3],
+		PanSpeed: b[4], TiltSpeed: b[5], ZoomSpeed: b[6] >> 4,
+	}, nil
+}
+
+// Action describes the command, for example, left+up, zoom-in, stop, or preset-call.
+func (v *PTZCommand) Action() string {
+	switch v.Command {
+	case 0x00:
+		return "stop"
+	case 0x81:
+		return fmt.Sprintf("preset-set:%v", v.PanSpeed)
+	case 0x82:
+		return fmt.Sprintf("preset-call:%v", v.PanSpeed)
+	case 0x83:
+		return fmt.Sprintf("preset-delete:%v", v.PanSpeed)
+	}
+	if v.Command&0xc0 != 0 {
+		return fmt.Sprintf("cmd-0x%02x", v.Command)
+	}
+
+	var actions []string
+	for i, action := range []string{"right", "left", "down", "up", "zoom-in", "zoom-out"} {
+		if v.Command&(1<<uint(i)) != 0 {
+			actions = append(actions, action)
+		}
+	}
+	return strings.Join(actions, "+")
+}
+
+func (v *PTZCommand) String() string {
+	return fmt.Sprintf("channel=%v, SN=%v, cmd=%v, action=%v, pan=%v, tilt=%v, zoom=%v", v.ChannelID, v.SN, v.Cmd,
+		v.Action(), v.PanSpeed, v.TiltSpeed, v.ZoomSpeed)
+}
+
+// Build the response of DeviceControl, the result is OK or ERROR, see GB28181-2016 A.2.6.
+func utilBuildDeviceControlResponse(deviceID string, sn uint64, ok bool) string {
+	result := "OK"
+	if !ok {
+		result = "ERROR"
+	}
+	return fmt.Sprintf("<?xml version=\"1.0\" encoding=\"GB2312\"?>\n<Response><CmdType>DeviceControl</CmdType>"+
+		"<SN>%v</SN><DeviceID>%v</DeviceID><Result>%v</Result></Response>\n", sn, deviceID, result)
+}
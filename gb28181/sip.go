@@ -29,14 +29,16 @@ import (
 	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/logger"
 	"math/rand"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 type SIPConfig struct {
-	// The server address, for example: tcp://127.0.0.1:5060k
+	// The server address, for example: tcp://127.0.0.1:5060k, or udp:// and tls:// for SIP over UDP and TLS
 	addr string
 	// The SIP domain, for example: ossrs.io or 3402000000
 	domain string
@@ -44,8 +46,20 @@ type SIPConfig struct {
 	user string
 	// The N number of random device ID, for example, 10 means 1320000001
 	random int
+	// The template of device ID, overwrite the user and random, nil to ignore. See ParseDeviceIDTemplate.
+	idTemplate *DeviceIDTemplate
 	// The SIP server ID, for example: srs or 34020000002000000001
 	server string
+	// The username and password for digest authentication, the username is default to device ID. Ignore the
+	// challenge of server if no password.
+	username string
+	password string
+	// The expires in seconds of REGISTER, 3600 if not set.
+	expires int
+	// The certificate and SM2 private key of device for GB35114, ignore the GB35114 challenge of server if nil.
+	identity *GB35114Identity
+	// Whether compatible with GB28181-2022, which requires SIP over TCP, and carries the version in X-GB-Ver.
+	gb2022 bool
 	// The cached device id.
 	deviceID string
 }
@@ -59,6 +73,13 @@ func init() {
 }
 
 func (v *SIPConfig) DeviceID() string {
+	for v.deviceID == "" && v.idTemplate != nil {
+		if deviceID := v.idTemplate.Next(); !deviceIDCache[deviceID] {
+			v.deviceID = deviceID
+			deviceIDCache[deviceID] = true
+		}
+	}
+
 	for v.deviceID == "" {
 		// Generate a random ID.
 		var rid string
@@ -76,6 +97,118 @@ func (v *SIPConfig) DeviceID() string {
 	return v.deviceID
 }
 
+// The length of device ID, see GB28181-2016 Annex D.
+const gbDeviceIDLength = 20
+
+// DeviceIDTemplate generates the 20 digits device IDs by the template, which is digits with one placeholder, to fill
+// the rest digits by sequence or random number.
+type DeviceIDTemplate struct {
+	template string
+	// The digits before and after the placeholder.
+	prefix, suffix string
+	// The digits of placeholder, and the range of number in [start, end].
+	width      int
+	start, end uint64
+	// Whether random number, or sequence from start.
+	random bool
+	// The sequence of next device ID.
+	next uint64
+	lock sync.Mutex
+}
+
+// ParseDeviceIDTemplate parses the template like 340200000013200000{seq}, the placeholder is {seq} for sequence from
+// 1, {rand} for random number, or {start-end} for sequence in range, for example, 3402000000132{1-500} for
+// 34020000001320000001 to 34020000001320000500. The placeholder fills the digits to 20.
+func ParseDeviceIDTemplate(template string) (*DeviceIDTemplate, error) {
+	start, end := strings.Index(template, "{"), strings.Index(template, "}")
+	if start < 0 || end < start || strings.Count(template, "{") != 1 || strings.Count(template, "}") != 1 {
+		return nil, errors.Errorf("invalid template %v, should have one placeholder", template)
+	}
+
+	v := &DeviceIDTemplate{template: template, prefix: template[:start], suffix: template[end+1:]}
+	if digits := v.prefix + v.suffix; strings.Trim(digits, "0123456789") != "" {
+		return nil, errors.Errorf("invalid template %v, should be digits", template)
+	}
+
+	// The placeholder should fill at least one digit, and at most 18 digits to avoid overflow.
+	if v.width = gbDeviceIDLength - len(v.prefix) - len(v.suffix); v.width <= 0 || v.width > 18 {
+		return nil, errors.Errorf("invalid template %v, placeholder of %v digits", template, v.width)
+	}
+	max := uint64(1)
+	for i := 0; i < v.width; i++ {
+		max *= 10
+	}
+
+	switch placeholder := template[start+1 : end]; placeholder {
+	case "seq":
+		v.start, v.end = 1, max-1
+	case "rand":
+		v.start, v.end, v.random = 0, max-1, true
+	default:
+		ss := strings.SplitN(placeholder, "-", 2)
+		if len(ss) != 2 {
+			return nil, errors.Errorf("invalid placeholder %v of %v", placeholder, template)
+		}
+
+		var err error
+		if v.start, err = strconv.ParseUint(ss[0], 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "parse start of %v", template)
+		}
+		if v.end, err = strconv.ParseUint(ss[1], 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "parse end of %v", template)
+		}
+		if v.start > v.end || v.end >= max {
+			return nil, errors.Errorf("invalid range %v of %v, should in [0, %v]", placeholder, template, max-1)
+		}
+	}
+	return v, nil
+}
+
+func (v *DeviceIDTemplate) String() string {
+	return v.template
+}
+
+// Size returns the number of device IDs in the range.
+func (v *DeviceIDTemplate) Size() uint64 {
+	return v.end - v.start + 1
+}
+
+// Next returns the next device ID, the sequence wraps around when reached the end, so the caller should check the
+// Size for the number of devices.
+func (v *DeviceIDTemplate) Next() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	n := v.start + v.next%v.Size()
+	if v.random {
+		n = v.start + rand.Uint64()%v.Size()
+	}
+	v.next++
+
+	return fmt.Sprintf("%v%0*d%v", v.prefix, v.width, n, v.suffix)
+}
+
+// Transport returns the SIP transport in Via, UDP, TCP or TLS, by the scheme of server address.
+func (v *SIPConfig) Transport() string {
+	if u, err := url.Parse(v.addr); err == nil {
+		switch u.Scheme {
+		case "udp", "udp4", "udp6":
+			return "UDP"
+		case "tls":
+			return "TLS"
+		}
+	}
+	return "TCP"
+}
+
+// Version returns the version of GB28181 in X-GB-Ver header, 3.0 for 2022, or empty for 2016 without the header.
+func (v *SIPConfig) Version() string {
+	if v.gb2022 {
+		return "3.0"
+	}
+	return ""
+}
+
 func (v *SIPConfig) String() string {
 	sb := []string{}
 	if v.addr != "" {
@@ -86,6 +219,11 @@ func (v *SIPConfig) String() string {
 	}
 	if v.user != "" {
 		sb = append(sb, fmt.Sprintf("user=%v", v.user))
+	}
+	if v.idTemplate != nil {
+		sb = append(sb, fmt.Sprintf("template=%v", v.idTemplate))
+	}
+	if v.user != "" || v.idTemplate != nil {
 		sb = append(sb, fmt.Sprintf("deviceID=%v", v.DeviceID()))
 	}
 	if v.random > 0 {
@@ -94,25 +232,42 @@ func (v *SIPConfig) String() string {
 	if v.server != "" {
 		sb = append(sb, fmt.Sprintf("server=%v", v.server))
 	}
+	if v.username != "" {
+		sb = append(sb, fmt.Sprintf("username=%v", v.username))
+	}
+	if v.password != "" {
+		sb = append(sb, "password=***")
+	}
+	if v.expires > 0 {
+		sb = append(sb, fmt.Sprintf("expires=%v", v.expires))
+	}
+	if v.gb2022 {
+		sb = append(sb, "gb2022")
+	}
 	return strings.Join(sb, ",")
 }
 
 type SIPSession struct {
 	conf      *SIPConfig
-	rb        *sip.RequestBuilder
 	requests  chan sip.Request
 	responses chan sip.Response
-	wg        sync.WaitGroup
-	ctx       context.Context
-	cancel    context.CancelFunc
-	client    *SIPClient
-	seq       uint
+	// The MESSAGE, INFO, SUBSCRIBE and BYE requests from server, for example, the Catalog query and playback control.
+	messages chan sip.Request
+	// The Call-ID and number of requests sent by Notify or in dialog, whose responses are ignored.
+	notifies     map[string]int
+	notifiesLock sync.Mutex
+	wg           sync.WaitGroup
+	ctx          context.Context
+	cancel       context.CancelFunc
+	client       *SIPClient
+	seq          uint
 }
 
 func NewSIPSession(c *SIPConfig) *SIPSession {
 	return &SIPSession{
-		conf: c, client: NewSIPClient(), rb: sip.NewRequestBuilder(),
+		conf: c, client: NewSIPClient(),
 		requests: make(chan sip.Request, 1024), responses: make(chan sip.Response, 1024),
+		messages: make(chan sip.Request, 1024), notifies: make(map[string]int),
 		seq: 100,
 	}
 }
@@ -149,12 +304,20 @@ func (v *SIPSession) Connect(ctx context.Context) error {
 				return
 			case msg := <-v.client.incoming:
 				if req, ok := msg.(sip.Request); ok {
+					requests := v.requests
+					if req.Method() == sip.MESSAGE || req.Method() == sip.INFO || req.Method() == sip.SUBSCRIBE ||
+						req.Method() == sip.BYE {
+						requests = v.messages
+					}
 					select {
-					case v.requests <- req:
+					case requests <- req:
 					case <-v.ctx.Done():
 						return
 					}
 				} else if res, ok := msg.(sip.Response); ok {
+					if v.isNotifyResponse(res) {
+						continue
+					}
 					select {
 					case v.responses <- res:
 					case <-v.ctx.Done():
@@ -170,7 +333,27 @@ func (v *SIPSession) Connect(ctx context.Context) error {
 	return nil
 }
 
+// The address of device in Via and Contact, which is the actual local address for UDP, because server responses to it.
+func (v *SIPSession) localAddr() (string, sip.Port) {
+	if addr := v.client.localAddr; addr != nil {
+		return addr.IP.String(), sip.Port(addr.Port)
+	}
+	if ip := v.client.localIP; ip != nil {
+		return ip.String(), sip.Port(5060)
+	}
+	return "192.168.3.99", sip.Port(5060)
+}
+
+// The local host and port in Via and Contact, the IPv6 address is in brackets, see RFC 3261 25.1.
+func (v *SIPSession) localHost() (string, sip.Port) {
+	ip, port := v.localAddr()
+	return utilSIPHost(ip), port
+}
+
 func (v *SIPSession) Register(ctx context.Context) (sip.Message, sip.Message, error) {
+	if v.conf.expires > 0 {
+		return v.doRegister(ctx, v.conf.expires)
+	}
 	return v.doRegister(ctx, 3600)
 }
 
@@ -183,20 +366,19 @@ func (v *SIPSession) doRegister(ctx context.Context, expires int) (sip.Message,
 		return nil, nil, ctx.Err()
 	}
 
-	sipPort := sip.Port(5060)
+	sipPIP, sipPort := v.localHost()
 	sipCallID := sip.CallID(fmt.Sprintf("%v", rand.Uint64()))
 	sipBranch := fmt.Sprintf("z9hG4bK_%v", rand.Uint32())
 	sipTag := fmt.Sprintf("%v", rand.Uint32())
 	sipMaxForwards := sip.MaxForwards(70)
 	sipExpires := sip.Expires(uint32(expires))
-	sipPIP := "192.168.3.99"
 	v.seq++
 
-	rb := v.rb
-	rb.SetTransport("TCP")
+	rb := sip.NewRequestBuilder()
+	rb.SetTransport(v.conf.Transport())
 	rb.SetMethod(sip.REGISTER)
 	rb.AddVia(&sip.ViaHop{
-		ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: "TCP", Host: sipPIP, Port: &sipPort,
+		ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: v.conf.Transport(), Host: sipPIP, Port: &sipPort,
 		Params: sip.NewParams().Add("branch", sip.String{Str: sipBranch}),
 	})
 	rb.SetFrom(&sip.Address{
@@ -214,6 +396,7 @@ func (v *SIPSession) doRegister(ctx context.Context, expires int) (sip.Message,
 	})
 	rb.SetMaxForwards(&sipMaxForwards)
 	rb.SetExpires(&sipExpires)
+	v.addVersion(rb)
 	req, err := rb.Build()
 	if err != nil {
 		return req, nil, errors.Wrap(err, "build request")
@@ -229,20 +412,7 @@ func (v *SIPSession) doRegister(ctx context.Context, expires int) (sip.Message,
 	}
 	logger.Tf(ctx, "Send REGISTER request, Call-ID=%v, Expires=%v", callID, expires)
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, nil, ctx.Err()
-		case <-v.ctx.Done():
-			return nil, nil, v.ctx.Err()
-		case msg := <-v.responses:
-			if tv := sipGetCallID(msg); tv == callID {
-				return req, msg, nil
-			} else {
-				logger.Wf(v.ctx, "Not callID=%v, msg=%v, drop message %v", callID, tv, msg.String())
-			}
-		}
-	}
+	return v.waitResponse(ctx, req, callID)
 }
 
 func (v *SIPSession) Trying(ctx context.Context, invite sip.Message) error {
@@ -264,6 +434,12 @@ func (v *SIPSession) Trying(ctx context.Context, invite sip.Message) error {
 }
 
 func (v *SIPSession) InviteResponse(ctx context.Context, invite sip.Message) (sip.Message, error) {
+	return v.InviteResponseWithSDP(ctx, invite, "")
+}
+
+// InviteResponseWithSDP responses the INVITE with the SDP answer, for example, the a=setup and media port to listen
+// for TCP passive, and waits for the ACK. The 200 OK has no body if answer is empty.
+func (v *SIPSession) InviteResponseWithSDP(ctx context.Context, invite sip.Message, answer string) (sip.Message, error) {
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
@@ -278,7 +454,11 @@ func (v *SIPSession) InviteResponse(ctx context.Context, invite sip.Message) (si
 		return nil, errors.Errorf("Invalid SIP Call-ID invite %v", invite.String())
 	}
 
-	res := sip.NewResponseFromRequest("", req, sip.StatusCode(200), "OK", "")
+	res := sip.NewResponseFromRequest("", req, sip.StatusCode(200), "OK", answer)
+	if answer != "" {
+		sipContentType := sip.ContentType("application/sdp")
+		res.AppendHeader(&sipContentType)
+	}
 	if err := v.client.Send(res); err != nil {
 		return nil, errors.Wrapf(err, "send response %v", res.String())
 	}
@@ -311,20 +491,19 @@ func (v *SIPSession) Message(ctx context.Context) (sip.Message, sip.Message, err
 		return nil, nil, ctx.Err()
 	}
 
-	sipPort := sip.Port(5060)
+	sipPIP, sipPort := v.localHost()
 	sipCallID := sip.CallID(fmt.Sprintf("%v", rand.Uint64()))
 	sipBranch := fmt.Sprintf("z9hG4bK_%v", rand.Uint32())
 	sipTag := fmt.Sprintf("%v", rand.Uint32())
 	sipMaxForwards := sip.MaxForwards(70)
 	sipExpires := sip.Expires(3600)
-	sipPIP := "192.168.3.99"
 	v.seq++
 
-	rb := v.rb
-	rb.SetTransport("TCP")
+	rb := sip.NewRequestBuilder()
+	rb.SetTransport(v.conf.Transport())
 	rb.SetMethod(sip.MESSAGE)
 	rb.AddVia(&sip.ViaHop{
-		ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: "TCP", Host: sipPIP, Port: &sipPort,
+		ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: v.conf.Transport(), Host: sipPIP, Port: &sipPort,
 		Params: sip.NewParams().Add("branch", sip.String{Str: sipBranch}),
 	})
 	rb.SetFrom(&sip.Address{
@@ -354,6 +533,7 @@ func (v *SIPSession) Message(ctx context.Context) (sip.Message, sip.Message, err
 		"</Notify>\n",
 	}, "\n"))
 
+	v.addVersion(rb)
 	req, err := rb.Build()
 	if err != nil {
 		return req, nil, errors.Wrap(err, "build request")
@@ -369,20 +549,223 @@ func (v *SIPSession) Message(ctx context.Context) (sip.Message, sip.Message, err
 	}
 	logger.Tf(ctx, "Send MESSAGE request, Call-ID=%v", callID)
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, nil, ctx.Err()
-		case <-v.ctx.Done():
-			return nil, nil, v.ctx.Err()
-		case msg := <-v.responses:
-			if tv := sipGetCallID(msg); tv == callID {
-				return req, msg, nil
-			} else {
-				logger.Wf(v.ctx, "Not callID=%v, msg=%v, drop message %v", callID, tv, msg.String())
-			}
+	return v.waitResponse(ctx, req, callID)
+}
+
+// Notify sends a MESSAGE of MANSCDP body to server without waiting for the response, for example, the Catalog response
+// to query, which is a new request of device.
+func (v *SIPSession) Notify(ctx context.Context, body string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	sipPIP, sipPort := v.localHost()
+	sipCallID := sip.CallID(fmt.Sprintf("%v", rand.Uint64()))
+	sipBranch := fmt.Sprintf("z9hG4bK_%v", rand.Uint32())
+	sipTag := fmt.Sprintf("%v", rand.Uint32())
+	sipMaxForwards := sip.MaxForwards(70)
+	sipContentType := sip.ContentType("Application/MANSCDP+xml")
+
+	rb := sip.NewRequestBuilder()
+	rb.SetTransport(v.conf.Transport())
+	rb.SetMethod(sip.MESSAGE)
+	rb.AddVia(&sip.ViaHop{
+		ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: v.conf.Transport(), Host: sipPIP, Port: &sipPort,
+		Params: sip.NewParams().Add("branch", sip.String{Str: sipBranch}),
+	})
+	rb.SetFrom(&sip.Address{
+		Uri:    &sip.SipUri{FUser: sip.String{Str: v.conf.DeviceID()}, FHost: v.conf.domain},
+		Params: sip.NewParams().Add("tag", sip.String{Str: sipTag}),
+	})
+	rb.SetTo(&sip.Address{
+		Uri: &sip.SipUri{FUser: sip.String{Str: v.conf.server}, FHost: v.conf.domain},
+	})
+	rb.SetCallID(&sipCallID)
+	rb.SetSeqNo(1)
+	rb.SetRecipient(&sip.SipUri{FUser: sip.String{Str: v.conf.server}, FHost: v.conf.domain})
+	rb.SetMaxForwards(&sipMaxForwards)
+	rb.SetContentType(&sipContentType)
+	rb.SetBody(body)
+
+	v.addVersion(rb)
+	req, err := rb.Build()
+	if err != nil {
+		return errors.Wrap(err, "build request")
+	}
+
+	v.notifiesLock.Lock()
+	v.notifies[string(sipCallID)]++
+	v.notifiesLock.Unlock()
+
+	if err = v.client.Send(req); err != nil {
+		return errors.Wrapf(err, "send request %v", req.String())
+	}
+	return nil
+}
+
+// Whether the response is for request sent by Notify, which is ignored, and forget the request when got the final
+// response.
+func (v *SIPSession) isNotifyResponse(res sip.Response) bool {
+	v.notifiesLock.Lock()
+	defer v.notifiesLock.Unlock()
+
+	callID := sipGetCallID(res)
+	if v.notifies[callID] == 0 {
+		return false
+	}
+
+	if res.StatusCode() >= 200 {
+		if v.notifies[callID]--; v.notifies[callID] == 0 {
+			delete(v.notifies, callID)
 		}
 	}
+	return true
+}
+
+// SIPDialog is the dialog created by SUBSCRIBE from server, for device to send NOTIFY in it, see RFC 6665 4.2.
+type SIPDialog struct {
+	callID sip.CallID
+	// The address of device with local tag, and the address of server with remote tag.
+	local  *sip.Address
+	remote *sip.Address
+	// The target to send NOTIFY to, the Contact of SUBSCRIBE or the address of server.
+	target sip.Uri
+	// The Event of subscription, and the CSeq of NOTIFY.
+	event string
+	seq   uint
+	lock  sync.Mutex
+}
+
+// AcceptSubscribe responses 200 OK with the body to SUBSCRIBE from server, and returns the dialog to send NOTIFY. The
+// refresh of subscription in the dialog keeps the local tag.
+func (v *SIPSession) AcceptSubscribe(ctx context.Context, req sip.Request, expires time.Duration, body string) (*SIPDialog, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	from, ok := req.From()
+	if !ok {
+		return nil, errors.Errorf("no From of %v", req.String())
+	}
+	to, ok := req.To()
+	if !ok {
+		return nil, errors.Errorf("no To of %v", req.String())
+	}
+	callID, ok := req.CallID()
+	if !ok {
+		return nil, errors.Errorf("no Call-ID of %v", req.String())
+	}
+
+	d := &SIPDialog{callID: *callID, event: "presence", seq: 1, target: from.Address}
+	if c, ok := req.Contact(); ok {
+		d.target = c.Address
+	}
+	for _, h := range req.GetHeaders("Event") {
+		d.event = h.Value()
+	}
+
+	d.remote = &sip.Address{Uri: from.Address, Params: from.Params}
+	d.local = &sip.Address{Uri: to.Address, Params: sip.NewParams()}
+	if to.Params != nil {
+		d.local.Params = to.Params.Clone()
+	}
+	if !d.local.Params.Has("tag") {
+		d.local.Params.Add("tag", sip.String{Str: fmt.Sprintf("%v", rand.Uint32())})
+	}
+
+	res := sip.NewResponseFromRequest("", req, sip.StatusCode(200), "OK", body)
+	if to, ok := res.To(); ok {
+		to.Params = d.local.Params.Clone()
+	}
+	sipExpires := sip.Expires(uint32(expires / time.Second))
+	res.AppendHeader(&sipExpires)
+	if body != "" {
+		sipContentType := sip.ContentType("Application/MANSCDP+xml")
+		res.AppendHeader(&sipContentType)
+	}
+	if err := v.client.Send(res); err != nil {
+		return nil, errors.Wrapf(err, "send response %v", res.String())
+	}
+	return d, nil
+}
+
+// NotifyDialog sends a NOTIFY of MANSCDP body in the dialog of subscription without waiting for the response, the
+// state is the Subscription-State, for example, active;expires=3600.
+func (v *SIPSession) NotifyDialog(ctx context.Context, d *SIPDialog, state, body string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	d.lock.Lock()
+	d.seq++
+	seq := d.seq
+	d.lock.Unlock()
+
+	sipPIP, sipPort := v.localHost()
+	sipBranch := fmt.Sprintf("z9hG4bK_%v", rand.Uint32())
+	sipMaxForwards := sip.MaxForwards(70)
+	sipContentType := sip.ContentType("Application/MANSCDP+xml")
+
+	rb := sip.NewRequestBuilder()
+	rb.SetTransport(v.conf.Transport())
+	rb.SetMethod(sip.NOTIFY)
+	rb.AddVia(&sip.ViaHop{
+		ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: v.conf.Transport(), Host: sipPIP, Port: &sipPort,
+		Params: sip.NewParams().Add("branch", sip.String{Str: sipBranch}),
+	})
+	rb.SetFrom(d.local)
+	rb.SetTo(d.remote)
+	rb.SetCallID(&d.callID)
+	rb.SetSeqNo(seq)
+	rb.SetRecipient(d.target)
+	rb.SetContact(&sip.Address{
+		Uri: &sip.SipUri{FUser: sip.String{Str: v.conf.DeviceID()}, FHost: sipPIP, FPort: &sipPort},
+	})
+	rb.SetMaxForwards(&sipMaxForwards)
+	rb.AddHeader(&sip.GenericHeader{HeaderName: "Event", Contents: d.event})
+	rb.AddHeader(&sip.GenericHeader{HeaderName: "Subscription-State", Contents: state})
+	rb.SetContentType(&sipContentType)
+	rb.SetBody(body)
+
+	v.addVersion(rb)
+	req, err := rb.Build()
+	if err != nil {
+		return errors.Wrap(err, "build request")
+	}
+
+	v.notifiesLock.Lock()
+	v.notifies[string(d.callID)]++
+	v.notifiesLock.Unlock()
+
+	if err = v.client.Send(req); err != nil {
+		return errors.Wrapf(err, "send request %v", req.String())
+	}
+	return nil
+}
+
+// Add the X-GB-Ver header to request if not GB28181-2016, for server to know the version of device.
+func (v *SIPSession) addVersion(rb *sip.RequestBuilder) {
+	if ver := v.conf.Version(); ver != "" {
+		rb.AddHeader(&sip.GenericHeader{HeaderName: "X-GB-Ver", Contents: ver})
+	}
+}
+
+// ResponseOK responses 200 OK to the request from server, for example, the MESSAGE of query.
+func (v *SIPSession) ResponseOK(ctx context.Context, req sip.Request) error {
+	return v.Response(ctx, req, 200, "OK")
+}
+
+// Response the request from server with status, for example, 481 for INFO out of dialog.
+func (v *SIPSession) Response(ctx context.Context, req sip.Request, code int, reason string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	res := sip.NewResponseFromRequest("", req, sip.StatusCode(code), reason, "")
+	if err := v.client.Send(res); err != nil {
+		return errors.Wrapf(err, "send response %v", res.String())
+	}
+	return nil
 }
 
 func (v *SIPSession) Bye(ctx context.Context) (sip.Message, sip.Message, error) {
@@ -390,20 +773,19 @@ func (v *SIPSession) Bye(ctx context.Context) (sip.Message, sip.Message, error)
 		return nil, nil, ctx.Err()
 	}
 
-	sipPort := sip.Port(5060)
+	sipPIP, sipPort := v.localHost()
 	sipCallID := sip.CallID(fmt.Sprintf("%v", rand.Uint64()))
 	sipBranch := fmt.Sprintf("z9hG4bK_%v", rand.Uint32())
 	sipTag := fmt.Sprintf("%v", rand.Uint32())
 	sipMaxForwards := sip.MaxForwards(70)
 	sipExpires := sip.Expires(3600)
-	sipPIP := "192.168.3.99"
 	v.seq++
 
-	rb := v.rb
-	rb.SetTransport("TCP")
+	rb := sip.NewRequestBuilder()
+	rb.SetTransport(v.conf.Transport())
 	rb.SetMethod(sip.BYE)
 	rb.AddVia(&sip.ViaHop{
-		ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: "TCP", Host: sipPIP, Port: &sipPort,
+		ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: v.conf.Transport(), Host: sipPIP, Port: &sipPort,
 		Params: sip.NewParams().Add("branch", sip.String{Str: sipBranch}),
 	})
 	rb.SetFrom(&sip.Address{
@@ -422,6 +804,7 @@ func (v *SIPSession) Bye(ctx context.Context) (sip.Message, sip.Message, error)
 	rb.SetMaxForwards(&sipMaxForwards)
 	rb.SetExpires(&sipExpires)
 
+	v.addVersion(rb)
 	req, err := rb.Build()
 	if err != nil {
 		return req, nil, errors.Wrap(err, "build request")
@@ -437,6 +820,13 @@ func (v *SIPSession) Bye(ctx context.Context) (sip.Message, sip.Message, error)
 	}
 	logger.Tf(ctx, "Send BYE request, Call-ID=%v", callID)
 
+	return v.waitResponse(ctx, req, callID)
+}
+
+// Wait for the response of request by Call-ID. If challenged by 401 or 407, send the request again with the digest
+// credentials or the GB35114 signature, only once because the credentials are wrong if challenged again.
+func (v *SIPSession) waitResponse(ctx context.Context, req sip.Request, callID string) (sip.Message, sip.Message, error) {
+	var authorized bool
 	for {
 		select {
 		case <-ctx.Done():
@@ -444,13 +834,75 @@ func (v *SIPSession) Bye(ctx context.Context) (sip.Message, sip.Message, error)
 		case <-v.ctx.Done():
 			return nil, nil, v.ctx.Err()
 		case msg := <-v.responses:
-			if tv := sipGetCallID(msg); tv == callID {
-				return req, msg, nil
-			} else {
+			if tv := sipGetCallID(msg); tv != callID {
 				logger.Wf(v.ctx, "Not callID=%v, msg=%v, drop message %v", callID, tv, msg.String())
+				continue
+			}
+
+			code := msg.StatusCode()
+			if authorized || (v.conf.password == "" && v.conf.identity == nil) || (code != 401 && code != 407) {
+				return req, msg, sipResponseError(msg)
 			}
+
+			authorized = true
+			if err := v.authorize(req, msg); err != nil {
+				return req, msg, errors.Wrapf(err, "authorize %v", req.Method())
+			}
+			if err := v.client.Send(req); err != nil {
+				return req, nil, errors.Wrapf(err, "send request %v", req.String())
+			}
+			logger.Tf(ctx, "Send %v request with credentials, Call-ID=%v, status=%v", req.Method(), callID, code)
+		}
+	}
+}
+
+// Add the MD5 digest credentials to request for the challenge of response, and increase the CSeq and change the
+// branch, because it's a new request, see RFC 3261 22.2.
+func (v *SIPSession) authorize(req sip.Request, res sip.Response) error {
+	// The GB35114 challenge of Unidirection or Bidirection is answered by the SM2 signature of device.
+	if hdrs := res.GetHeaders("WWW-Authenticate"); len(hdrs) > 0 && v.conf.identity != nil {
+		if scheme, _ := parseSIPAuthParams(hdrs[0].Value()); scheme == "Unidirection" || scheme == "Bidirection" {
+			return v.authorizeGB35114(req, hdrs[0].Value())
 		}
 	}
+
+	username := v.conf.username
+	if username == "" {
+		username = v.conf.DeviceID()
+	}
+
+	if err := sip.AuthorizeRequest(req, res, sip.String{Str: username}, sip.String{Str: v.conf.password}); err != nil {
+		return errors.Wrap(err, "digest")
+	}
+
+	if cseq, ok := req.CSeq(); ok && uint(cseq.SeqNo) > v.seq {
+		v.seq = uint(cseq.SeqNo)
+	}
+	return nil
+}
+
+// Add the Authorization of GB35114 to request for the challenge, and increase the CSeq and change the branch like
+// the digest.
+func (v *SIPSession) authorizeGB35114(req sip.Request, challenge string) error {
+	auth, err := v.conf.identity.Authorize(challenge, v.conf.DeviceID(), v.conf.server)
+	if err != nil {
+		return errors.Wrap(err, "gb35114")
+	}
+	req.RemoveHeader("Authorization")
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "Authorization", Contents: auth})
+
+	if via, ok := req.ViaHop(); ok {
+		via.Params.Add("branch", sip.String{Str: sip.GenerateBranch()})
+	}
+	if cseq, ok := req.CSeq(); ok {
+		cseq := cseq.Clone().(*sip.CSeq)
+		cseq.SeqNo++
+		req.ReplaceHeaders(cseq.Name(), []sip.Header{cseq})
+		if uint(cseq.SeqNo) > v.seq {
+			v.seq = uint(cseq.SeqNo)
+		}
+	}
+	return nil
 }
 
 func (v *SIPSession) Wait(ctx context.Context, method sip.RequestMethod) (sip.Message, error) {
@@ -474,6 +926,72 @@ func (v *SIPSession) Wait(ctx context.Context, method sip.RequestMethod) (sip.Me
 	}
 }
 
+// SIPError is the error response of SIP request, with status code in [300, 699], for example, the 401 to register
+// with credentials, the 503 to back off, or the 403 to fail.
+type SIPError struct {
+	// The method of request, for example, REGISTER.
+	Method sip.RequestMethod
+	// The status code and reason phrase of response, for example, 503 Service Unavailable.
+	StatusCode int
+	Reason     string
+	// The Call-ID and CSeq of response, for log correlation.
+	CallID string
+	CSeq   uint32
+	// The Retry-After of response, 0 if not specified.
+	RetryAfter time.Duration
+}
+
+func (v *SIPError) Error() string {
+	return fmt.Sprintf("SIP %v response %v %v, Call-ID=%v, CSeq=%v", v.Method, v.StatusCode, v.Reason, v.CallID, v.CSeq)
+}
+
+// NeedAuth whether the server requires authentication, should retry with credentials.
+func (v *SIPError) NeedAuth() bool {
+	return v.StatusCode == 401 || v.StatusCode == 407
+}
+
+// Busy whether the server or callee is busy, should retry later, see RetryAfter.
+func (v *SIPError) Busy() bool {
+	switch v.StatusCode {
+	case 408, 480, 486, 500, 503, 504, 600:
+		return true
+	}
+	return false
+}
+
+// Fatal whether the request is rejected and should not retry, for example, 403 Forbidden.
+func (v *SIPError) Fatal() bool {
+	return !v.NeedAuth() && !v.Busy()
+}
+
+// AsSIPError returns the SIPError if err is caused by a SIP error response.
+func AsSIPError(err error) (*SIPError, bool) {
+	r0, ok := errors.Cause(err).(*SIPError)
+	return r0, ok
+}
+
+// Build the SIPError if res is an error response, or nil for 1xx and 2xx.
+func sipResponseError(res sip.Response) error {
+	if res.StatusCode() < 300 {
+		return nil
+	}
+
+	r0 := &SIPError{StatusCode: int(res.StatusCode()), Reason: res.Reason(), CallID: sipGetCallID(res)}
+	if cseq, ok := res.CSeq(); ok {
+		r0.Method, r0.CSeq = cseq.MethodName, cseq.SeqNo
+	}
+	if hs := res.GetHeaders("Retry-After"); len(hs) > 0 {
+		// The Retry-After maybe with comment and parameters, for example, 120 (I'm in a meeting);duration=3600
+		value := strings.TrimSpace(strings.TrimPrefix(hs[0].String(), "Retry-After:"))
+		if ss := strings.FieldsFunc(value, func(r rune) bool { return r < '0' || r > '9' }); len(ss) > 0 {
+			if seconds, err := strconv.Atoi(ss[0]); err == nil {
+				r0.RetryAfter = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return r0
+}
+
 type SIPClient struct {
 	ctx            context.Context
 	cancel         context.CancelFunc
@@ -481,6 +999,10 @@ type SIPClient struct {
 	target         *transport.Target
 	protocol       transport.Protocol
 	cleanupTimeout time.Duration
+	// The local address to listen for UDP, nil for TCP or TLS.
+	localAddr *net.UDPAddr
+	// The local IP to server by route, for TCP or TLS whose connection is managed by the transport.
+	localIP net.IP
 }
 
 func NewSIPClient() *SIPClient {
@@ -513,20 +1035,45 @@ func (v *SIPClient) Connect(ctx context.Context, addr string) error {
 		return errors.Wrapf(err, "parse addr=%v", addr)
 	}
 
-	if prURL.Scheme != "tcp" && prURL.Scheme != "tcp4" {
+	switch prURL.Scheme {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "tls":
+	default:
 		return errors.Errorf("invalid scheme=%v of addr=%v", prURL.Scheme, addr)
 	}
 
-	target, err := transport.NewTargetFromAddr(prURL.Host)
+	// Resolve the server by the family of scheme, for example, AAAA for tcp6 or udp6. The IPv6 host of target is in
+	// brackets, because the transport joins the host and port by colon.
+	network := strings.Replace(strings.Replace(prURL.Scheme, "udp", "tcp", 1), "tls", "tcp", 1)
+	raddr, err := net.ResolveTCPAddr(network, prURL.Host)
 	if err != nil {
-		return errors.Wrapf(err, "create target to %v", prURL.Host)
+		return errors.Wrapf(err, "resolve %v", prURL.Host)
 	}
-	v.target = target
+	v.target = transport.NewTarget(utilSIPHost(raddr.IP.String()), raddr.Port)
 
 	incoming := make(chan sip.Message, 1024)
 	errs := make(chan error, 1)
 	cancels := make(chan struct{}, 1)
-	protocol := transport.NewTcpProtocol(incoming, errs, cancels, nil, log.NewDefaultLogrusLogger())
+	// The TCP and TLS reuse the connection to target, while UDP sends and receives on the listening socket.
+	var protocol transport.Protocol
+	switch prURL.Scheme {
+	case "udp", "udp4", "udp6":
+		protocol = transport.NewUdpProtocol(incoming, errs, cancels, nil, log.NewDefaultLogrusLogger())
+		if v.localAddr, err = utilLocalUDPAddr(raddr.String()); err != nil {
+			return errors.Wrapf(err, "local addr to %v", raddr)
+		}
+		if err = protocol.Listen(transport.NewTarget(utilSIPHost(v.localAddr.IP.String()), v.localAddr.Port)); err != nil {
+			return errors.Wrapf(err, "listen %v", v.localAddr)
+		}
+	case "tls":
+		protocol = transport.NewTlsProtocol(incoming, errs, cancels, nil, log.NewDefaultLogrusLogger())
+	default:
+		protocol = transport.NewTcpProtocol(incoming, errs, cancels, nil, log.NewDefaultLogrusLogger())
+	}
+	if v.localAddr == nil {
+		if v.localIP, err = utilLocalIP(raddr.String()); err != nil {
+			return errors.Wrapf(err, "local ip to %v", raddr)
+		}
+	}
 	v.protocol = protocol
 	v.incoming = incoming
 
@@ -556,6 +1103,11 @@ func (v *SIPClient) Connect(ctx context.Context, addr string) error {
 }
 
 func (v *SIPClient) Send(msg sip.Message) error {
+	// For UDP, the source is used to find the listening socket to send.
+	if v.localAddr != nil {
+		msg.SetSource(v.localAddr.String())
+	}
+
 	logger.Tf(v.ctx, "Send msg %v", msg.String())
 	return v.protocol.Send(v.target, msg)
 }
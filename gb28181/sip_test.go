@@ -0,0 +1,360 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSIPError(t *testing.T) {
+	callID := sip.CallID("1234")
+	rb := sip.NewRequestBuilder()
+	rb.SetMethod(sip.REGISTER)
+	rb.SetCallID(&callID)
+	rb.SetSeqNo(101)
+	rb.SetRecipient(&sip.SipUri{FUser: sip.String{Str: "srs"}, FHost: "ossrs.io"})
+	rb.SetFrom(&sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "camera"}, FHost: "ossrs.io"}})
+	rb.SetTo(&sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "camera"}, FHost: "ossrs.io"}})
+	req, err := rb.Build()
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	if err := sipResponseError(sip.NewResponseFromRequest("", req, 200, "OK", "")); err != nil {
+		t.Errorf("err %+v", err)
+	}
+
+	res := sip.NewResponseFromRequest("", req, 503, "Service Unavailable", "")
+	res.AppendHeader(&sip.GenericHeader{HeaderName: "Retry-After", Contents: "120 (overload);duration=3600"})
+	r0, ok := AsSIPError(errors.Wrap(sipResponseError(res), "register"))
+	if !ok {
+		t.Errorf("should be SIP error")
+		return
+	}
+	if r0.StatusCode != 503 || r0.Method != sip.REGISTER || r0.CallID != "1234" || r0.CSeq != 101 ||
+		r0.RetryAfter != 120*time.Second || !r0.Busy() || r0.Fatal() {
+		t.Errorf("invalid error %v, retry=%v", r0.Error(), r0.RetryAfter)
+	}
+
+	for _, expect := range []struct {
+		code             int
+		auth, busy, fail bool
+	}{{401, true, false, false}, {407, true, false, false}, {486, false, true, false}, {403, false, false, true}} {
+		r0 := &SIPError{StatusCode: expect.code}
+		if r0.NeedAuth() != expect.auth || r0.Busy() != expect.busy || r0.Fatal() != expect.fail {
+			t.Errorf("invalid error %v", r0.Error())
+		}
+	}
+
+	if _, ok := AsSIPError(errors.New("others")); ok {
+		t.Errorf("should not be SIP error")
+	}
+}
+
+func TestSIPTransport(t *testing.T) {
+	for addr, expect := range map[string]string{
+		"tcp://127.0.0.1:5060": "TCP", "udp://127.0.0.1:5060": "UDP", "tls://127.0.0.1:5061": "TLS", "": "TCP",
+	} {
+		if transport := (&SIPConfig{addr: addr}).Transport(); transport != expect {
+			t.Errorf("invalid transport %v of %v, expect %v", transport, addr, expect)
+		}
+	}
+
+	// The media is always over TCP by default, even for SIP over UDP or TLS.
+	for _, addr := range []string{"udp://127.0.0.1:5060", "tls://127.0.0.1:5061", "tcp://127.0.0.1:5060"} {
+		if media, err := utilBuildMediaAddr(addr, "", 9000); err != nil || media != "tcp://127.0.0.1:9000" {
+			t.Errorf("invalid media %v of %v, err %+v", media, addr, err)
+		}
+	}
+
+	// The host in SDP overwrites the SIP server.
+	for host, expect := range map[string]string{"10.0.0.2": "tcp://10.0.0.2:9000", "::1": "tcp://[::1]:9000"} {
+		if media, err := utilBuildMediaAddr("udp://127.0.0.1:5060", host, 9000); err != nil || media != expect {
+			t.Errorf("invalid media %v of %v, err %+v", media, host, err)
+		}
+	}
+
+	// The SIP over UDP listens at local address, and the source of message is set to it.
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	session := NewSIPSession(&SIPConfig{addr: fmt.Sprintf("udp://%v", server.LocalAddr()), user: "camera",
+		server: "srs", domain: "ossrs.io"})
+	if err := session.client.Connect(context.Background(), session.conf.addr); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.client.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 100*time.Millisecond)
+	defer cancel()
+	session.ctx = ctx
+	session.Register(ctx)
+
+	// Each request should be a datagram with a single Via of the actual local address.
+	b := make([]byte, 4096)
+	server.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, addr, err := server.ReadFromUDP(b)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	msg := string(b[:n])
+	if !strings.HasPrefix(msg, "REGISTER ") || strings.Count(msg, "Via:") != 1 ||
+		!strings.Contains(msg, fmt.Sprintf("SIP/2.0/UDP %v", addr.String())) {
+		t.Errorf("invalid message from %v, %v", addr, msg)
+	}
+}
+
+func TestSIPDigestAuth(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 3*time.Second)
+	defer cancel()
+
+	// Use the device ID directly, because the device ID without random is cached and unique in process.
+	session := NewSIPSession(&SIPConfig{addr: fmt.Sprintf("udp://%v", server.LocalAddr()), user: "camera",
+		deviceID: "camera", server: "srs", domain: "ossrs.io", password: "secret"})
+	if err := session.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := session.Register(ctx)
+		errs <- err
+	}()
+
+	if _, err := sipTestRespond(server, 401, "Unauthorized", `WWW-Authenticate: Digest realm="ossrs.io",nonce="abc"`); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	req, err := sipTestRespond(server, 200, "OK")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// The response is MD5(MD5(username:realm:password):nonce:MD5(method:uri)), username default to device ID.
+	md5hex := func(s string) string {
+		b := md5.Sum([]byte(s))
+		return hex.EncodeToString(b[:])
+	}
+	ha1, ha2 := md5hex("camera:ossrs.io:secret"), md5hex("REGISTER:sip:srs@ossrs.io")
+	response := md5hex(fmt.Sprintf("%v:abc:%v", ha1, ha2))
+	if !strings.Contains(req, fmt.Sprintf(`response="%v"`, response)) || !strings.Contains(req, `username="camera"`) ||
+		!strings.Contains(req, "CSeq: 102 REGISTER") {
+		t.Errorf("invalid request %v", req)
+	}
+}
+
+// Read a request from UDP server, and response with the headers of request and the extra headers.
+func sipTestRespond(server *net.UDPConn, code int, reason string, extra ...string) (string, error) {
+	b := make([]byte, 4096)
+	server.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, addr, err := server.ReadFromUDP(b)
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{fmt.Sprintf("SIP/2.0 %v %v", code, reason)}
+	for _, line := range strings.Split(string(b[:n]), "\r\n") {
+		for _, h := range []string{"Via:", "From:", "To:", "Call-ID:", "CSeq:"} {
+			if strings.HasPrefix(line, h) {
+				lines = append(lines, line)
+			}
+		}
+	}
+	lines = append(append(lines, extra...), "Content-Length: 0", "", "")
+	_, err = server.WriteToUDP([]byte(strings.Join(lines, "\r\n")), addr)
+	return string(b[:n]), err
+}
+
+// Send a request from UDP server to device, with the MANSCDP body and extra headers.
+func sipTestRequest(server *net.UDPConn, device *net.UDPAddr, method, user, callID string, cseq int, body string, extra ...string) error {
+	contentType := "Application/MANSCDP+xml"
+	if method == "INVITE" {
+		contentType = "Application/SDP"
+	}
+	lines := []string{
+		fmt.Sprintf("%v sip:%v@ossrs.io SIP/2.0", method, user),
+		fmt.Sprintf("Via: SIP/2.0/UDP %v;branch=z9hG4bK_%v%v", server.LocalAddr(), callID, cseq),
+		"From: <sip:srs@ossrs.io>;tag=srs", "To: <sip:camera@ossrs.io>", fmt.Sprintf("Call-ID: %v", callID),
+		fmt.Sprintf("CSeq: %v %v", cseq, method), "Max-Forwards: 70", fmt.Sprintf("Content-Type: %v", contentType),
+	}
+	lines = append(append(lines, extra...), fmt.Sprintf("Content-Length: %v", len(body)), "", body)
+	_, err := server.WriteToUDP([]byte(strings.Join(lines, "\r\n")), device)
+	return err
+}
+
+func TestSIPIPv6(t *testing.T) {
+	if (&SIPConfig{addr: "udp6://[::1]:5060"}).Transport() != "UDP" || utilSIPHost("::1") != "[::1]" ||
+		utilSIPHost("127.0.0.1") != "127.0.0.1" || utilSDPAddrType("::1") != "IP6" || utilSDPAddrType("10.0.0.2") != "IP4" {
+		t.Error("invalid ipv6 helpers")
+		return
+	}
+
+	// The media follows the family of SIP server, but the host of other family in SDP is allowed for dual-stack.
+	for _, c := range []struct{ addr, host, expect string }{
+		{"udp://[::1]:5060", "", "tcp://[::1]:9000"}, {"tcp6://[::1]:5060", "", "tcp6://[::1]:9000"},
+		{"tcp6://[::1]:5060", "10.0.0.2", "tcp://10.0.0.2:9000"}, {"tcp4://127.0.0.1:5060", "::1", "tcp://[::1]:9000"},
+		{"tcp6://[::1]:5060", "fe80::2", "tcp6://[fe80::2]:9000"},
+	} {
+		if media, err := utilBuildMediaAddr(c.addr, c.host, 9000); err != nil || media != c.expect {
+			t.Errorf("invalid media %v of %v, err %+v", media, c, err)
+		}
+	}
+
+	// The offer of IP6 and the answer in the same family.
+	out, err := parseInviteChannel(sip.NewRequest("", sip.INVITE, &sip.SipUri{FUser: sip.String{Str: "camera"}}, "SIP/2.0",
+		nil, "v=0\r\nc=IN IP6 fe80::2\r\nm=video 9000 TCP/RTP/AVP 96\r\na=setup:active\r\ny=100\r\n", nil), "camera")
+	if err != nil || out.mediaHost != "fe80::2" {
+		t.Errorf("invalid offer %v, err %+v", out, err)
+		return
+	}
+	if answer := utilBuildInviteAnswer("camera", "::1", out); !strings.Contains(answer, "o=camera 0 0 IN IP6 ::1\r\n") ||
+		!strings.Contains(answer, "c=IN IP6 ::1\r\n") {
+		t.Errorf("invalid answer %v", answer)
+		return
+	}
+
+	// The SIP over UDP of IPv6, the host in Via and Contact is in brackets.
+	server, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no ipv6, err %+v", err)
+		return
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 3*time.Second)
+	defer cancel()
+
+	session := NewGBSession(&GBSessionConfig{}, &SIPConfig{addr: fmt.Sprintf("udp6://%v", server.LocalAddr()),
+		user: "camera", deviceID: "camera", server: "srs", domain: "ossrs.io"})
+	if err := session.Connect(ctx); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer session.Close()
+
+	registered := make(chan error, 1)
+	go func() {
+		_, _, err := session.sip.Register(ctx)
+		registered <- err
+	}()
+	_, port := session.sip.localAddr()
+	if req, err := sipTestRespond(server, 200, "OK"); err != nil ||
+		!strings.Contains(req, fmt.Sprintf("Via: SIP/2.0/UDP [::1]:%v", port)) ||
+		!strings.Contains(req, fmt.Sprintf("Contact: <sip:camera@[::1]:%v>", port)) {
+		t.Errorf("invalid register %v, err %+v", req, err)
+		return
+	}
+	if err := <-registered; err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestSIPDeviceIDTemplate(t *testing.T) {
+	for _, s := range []string{
+		"", "3402000000132", "3402000000132{seq}{seq}", "34020000001320000001{seq}", "340200000013200{x}",
+		"3402abc000132{seq}", "3402000000132{5-1}", "340200000013200000{1-100}", "3402000000132}seq{", "3{seq}",
+	} {
+		if _, err := ParseDeviceIDTemplate(s); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+
+	// The sequence fills the digits to 20, and wraps around.
+	v, err := ParseDeviceIDTemplate("340200000013200000{seq}")
+	if err != nil || v.Size() != 99 {
+		t.Errorf("invalid template %v, err %+v", v, err)
+		return
+	}
+	if a, b := v.Next(), v.Next(); a != "34020000001320000001" || b != "34020000001320000002" {
+		t.Errorf("invalid ids %v %v", a, b)
+		return
+	}
+
+	// The range with suffix.
+	if v, err = ParseDeviceIDTemplate("3402000000{8-9}0000001"); err != nil || v.Size() != 2 {
+		t.Errorf("invalid template %v, err %+v", v, err)
+		return
+	}
+	if a, b, c := v.Next(), v.Next(), v.Next(); a != "34020000000080000001" || b != "34020000000090000001" || c != a {
+		t.Errorf("invalid ids %v %v %v", a, b, c)
+		return
+	}
+
+	// The random is in 20 digits.
+	if v, err = ParseDeviceIDTemplate("34020000001320{rand}"); err != nil || v.Size() != 1000000 {
+		t.Errorf("invalid template %v, err %+v", v, err)
+		return
+	}
+	if id := v.Next(); len(id) != 20 || !strings.HasPrefix(id, "34020000001320") || strings.Trim(id, "0123456789") != "" {
+		t.Errorf("invalid id %v", id)
+		return
+	}
+
+	// The device IDs of configs are unique, skip the IDs in use.
+	v, _ = ParseDeviceIDTemplate("3402000000132{9900-9999}")
+	deviceIDCache["34020000001320009901"] = true
+	defer delete(deviceIDCache, "34020000001320009901")
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		conf := &SIPConfig{user: "ignored", random: 10, idTemplate: v}
+		ids = append(ids, conf.DeviceID())
+		defer delete(deviceIDCache, conf.DeviceID())
+	}
+	if !reflect.DeepEqual(ids, []string{"34020000001320009900", "34020000001320009902"}) {
+		t.Errorf("invalid ids %v", ids)
+	}
+	if s := (&SIPConfig{user: "camera", idTemplate: v, deviceID: "camera"}).String(); !strings.Contains(s, "user=camera,template=3402000000132{9900-9999},deviceID=camera") {
+		t.Errorf("invalid config %v", s)
+	}
+}
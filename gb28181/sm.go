@@ -0,0 +1,375 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"math/big"
+	"math/bits"
+)
+
+// Sum the SM3 hash of data, see GB/T 32905-2016. The SM3 is a Merkle-Damgard hash like SHA-256, with 512 bits block
+// and 256 bits digest.
+func sm3Sum(data ...[]byte) [32]byte {
+	var msg []byte
+	for _, b := range data {
+		msg = append(msg, b...)
+	}
+
+	// Pad with 0x80, zeros and the length in bits, to a multiple of 64 bytes.
+	length := uint64(len(msg)) * 8
+	msg = append(msg, 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(msg[len(msg)-8:], length)
+
+	v := [8]uint32{
+		0x7380166f, 0x4914b2b9, 0x172442d7, 0xda8a0600, 0xa96f30bc, 0x163138aa, 0xe38dee4d, 0xb0fb0e4e,
+	}
+	for len(msg) > 0 {
+		sm3Compress(&v, msg[:64])
+		msg = msg[64:]
+	}
+
+	var sum [32]byte
+	for i, x := range v {
+		binary.BigEndian.PutUint32(sum[i*4:], x)
+	}
+	return sum
+}
+
+// Compress a block of 64 bytes to the state.
+func sm3Compress(v *[8]uint32, block []byte) {
+	var w [68]uint32
+	for j := 0; j < 16; j++ {
+		w[j] = binary.BigEndian.Uint32(block[j*4:])
+	}
+	for j := 16; j < 68; j++ {
+		x := w[j-16] ^ w[j-9] ^ bits.RotateLeft32(w[j-3], 15)
+		w[j] = x ^ bits.RotateLeft32(x, 15) ^ bits.RotateLeft32(x, 23) ^ bits.RotateLeft32(w[j-13], 7) ^ w[j-6]
+	}
+
+	a, b, c, d, e, f, g, h := v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7]
+	for j := 0; j < 64; j++ {
+		t, ff, gg := uint32(0x79cc4519), a^b^c, e^f^g
+		if j >= 16 {
+			t, ff, gg = 0x7a879d8a, (a&b)|(a&c)|(b&c), (e&f)|(^e&g)
+		}
+
+		ss1 := bits.RotateLeft32(bits.RotateLeft32(a, 12)+e+bits.RotateLeft32(t, j%32), 7)
+		ss2 := ss1 ^ bits.RotateLeft32(a, 12)
+		tt1 := ff + d + ss2 + (w[j] ^ w[j+4])
+		tt2 := gg + h + ss1 + w[j]
+		d, c, b, a = c, bits.RotateLeft32(b, 9), a, tt1
+		h, g, f, e = g, bits.RotateLeft32(f, 19), e, tt2^bits.RotateLeft32(tt2, 9)^bits.RotateLeft32(tt2, 17)
+	}
+
+	for i, x := range []uint32{a, b, c, d, e, f, g, h} {
+		v[i] ^= x
+	}
+}
+
+// The SM2 curve recommended by GB/T 32918.5-2017, whose a is p-3, so it works with the generic implementation of
+// elliptic.CurveParams.
+var sm2Curve = func() *elliptic.CurveParams {
+	hex := func(s string) *big.Int {
+		v, _ := new(big.Int).SetString(s, 16)
+		return v
+	}
+	return &elliptic.CurveParams{
+		Name:    "SM2",
+		BitSize: 256,
+		P:       hex("FFFFFFFEFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF00000000FFFFFFFFFFFFFFFF"),
+		N:       hex("FFFFFFFEFFFFFFFFFFFFFFFFFFFFFFFF7203DF6B21C6052B53BBF40939D54123"),
+		B:       hex("28E9FA9E9D9F5E344D5A9E4BCF6509A7F39789F515AB8F92DDBCBD414D940E93"),
+		Gx:      hex("32C4AE2C1F1981195F9904466A39C9948FE30BBFF2660BE1715A4589334C74C7"),
+		Gy:      hex("BC3736A2F4F6779C59BDCEE36B692153D0A9877CC62A474002DF32E52139F0A0"),
+	}
+}()
+
+// The OID of SM2 curve in key and certificate, and the default user ID for signature.
+var oidSM2 = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 301}
+var sm2DefaultUID = []byte("1234567812345678")
+
+// The signature of SM2 in DER, the same as ECDSA.
+type sm2Signature struct {
+	R, S *big.Int
+}
+
+// The ciphertext of SM2 in DER, C1 is the point (X, Y), C3 is the hash and C2 is the cipher, see GM/T 0009-2012.
+type sm2Cipher struct {
+	X, Y   *big.Int
+	Hash   []byte
+	Cipher []byte
+}
+
+// Encode the big integer to 32 bytes.
+func sm2Bytes(v *big.Int) []byte {
+	b := make([]byte, 32)
+	return v.FillBytes(b)
+}
+
+// The hash of user ID and public key, Z = SM3(ENTL || ID || a || b || Gx || Gy || x || y).
+func sm2Z(pub *ecdsa.PublicKey, uid []byte) [32]byte {
+	entl := []byte{byte(len(uid) * 8 >> 8), byte(len(uid) * 8)}
+	a := new(big.Int).Sub(sm2Curve.P, big.NewInt(3))
+	return sm3Sum(entl, uid, sm2Bytes(a), sm2Bytes(sm2Curve.B), sm2Bytes(sm2Curve.Gx), sm2Bytes(sm2Curve.Gy),
+		sm2Bytes(pub.X), sm2Bytes(pub.Y))
+}
+
+// Generate a random integer in [1, n-1].
+func sm2RandomK() (*big.Int, error) {
+	k, err := rand.Int(rand.Reader, new(big.Int).Sub(sm2Curve.N, big.NewInt(1)))
+	if err != nil {
+		return nil, errors.Wrap(err, "random")
+	}
+	return k.Add(k, big.NewInt(1)), nil
+}
+
+// Sign the message by SM2 with the default user ID, return the signature in DER.
+func sm2Sign(priv *ecdsa.PrivateKey, msg []byte) ([]byte, error) {
+	z := sm2Z(&priv.PublicKey, sm2DefaultUID)
+	e := new(big.Int).SetBytes(func() []byte { h := sm3Sum(z[:], msg); return h[:] }())
+
+	n := sm2Curve.N
+	d1 := new(big.Int).ModInverse(new(big.Int).Add(priv.D, big.NewInt(1)), n)
+	if d1 == nil {
+		return nil, errors.New("invalid private key")
+	}
+
+	for {
+		k, err := sm2RandomK()
+		if err != nil {
+			return nil, err
+		}
+
+		// The r = (e + x1) mod n, and retry if r is 0 or r + k is n.
+		x1, _ := sm2Curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Add(e, x1)
+		r.Mod(r, n)
+		if r.Sign() == 0 || new(big.Int).Add(r, k).Cmp(n) == 0 {
+			continue
+		}
+
+		// The s = ((1 + d)^-1 * (k - r * d)) mod n, and retry if s is 0.
+		s := new(big.Int).Sub(k, new(big.Int).Mul(r, priv.D))
+		s.Mul(s, d1).Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+
+		return asn1.Marshal(sm2Signature{R: r, S: s})
+	}
+}
+
+// Verify the SM2 signature in DER of message with the default user ID.
+func sm2Verify(pub *ecdsa.PublicKey, msg, sig []byte) bool {
+	var v sm2Signature
+	if rest, err := asn1.Unmarshal(sig, &v); err != nil || len(rest) > 0 {
+		return false
+	}
+
+	n := sm2Curve.N
+	if v.R.Sign() <= 0 || v.S.Sign() <= 0 || v.R.Cmp(n) >= 0 || v.S.Cmp(n) >= 0 {
+		return false
+	}
+	t := new(big.Int).Add(v.R, v.S)
+	if t.Mod(t, n).Sign() == 0 {
+		return false
+	}
+
+	z := sm2Z(pub, sm2DefaultUID)
+	e := new(big.Int).SetBytes(func() []byte { h := sm3Sum(z[:], msg); return h[:] }())
+
+	// The (x1, y1) = s * G + t * P, and R = (e + x1) mod n should equal to r.
+	x1, y1 := sm2Curve.ScalarBaseMult(v.S.Bytes())
+	x2, y2 := sm2Curve.ScalarMult(pub.X, pub.Y, t.Bytes())
+	x, _ := sm2Curve.Add(x1, y1, x2, y2)
+	x.Add(x, e).Mod(x, n)
+	return x.Cmp(v.R) == 0
+}
+
+// The key derivation function of SM2, by SM3 of z and a 32 bits counter from 1.
+func sm2KDF(z []byte, length int) []byte {
+	var key []byte
+	for ct := uint32(1); len(key) < length; ct++ {
+		c := make([]byte, 4)
+		binary.BigEndian.PutUint32(c, ct)
+		h := sm3Sum(z, c)
+		key = append(key, h[:]...)
+	}
+	return key[:length]
+}
+
+// Encrypt the message by SM2 public key, return the ciphertext in DER.
+func sm2Encrypt(pub *ecdsa.PublicKey, msg []byte) ([]byte, error) {
+	for {
+		k, err := sm2RandomK()
+		if err != nil {
+			return nil, err
+		}
+
+		// The C1 = k * G, and (x2, y2) = k * P to derive the key, retry if the key is all zero.
+		x1, y1 := sm2Curve.ScalarBaseMult(k.Bytes())
+		x2, y2 := sm2Curve.ScalarMult(pub.X, pub.Y, k.Bytes())
+		t := sm2KDF(append(sm2Bytes(x2), sm2Bytes(y2)...), len(msg))
+		if new(big.Int).SetBytes(t).Sign() == 0 && len(msg) > 0 {
+			continue
+		}
+
+		c2 := make([]byte, len(msg))
+		for i := range msg {
+			c2[i] = msg[i] ^ t[i]
+		}
+		c3 := sm3Sum(sm2Bytes(x2), msg, sm2Bytes(y2))
+		return asn1.Marshal(sm2Cipher{X: x1, Y: y1, Hash: c3[:], Cipher: c2})
+	}
+}
+
+// Decrypt the ciphertext in DER by SM2 private key, and check the hash.
+func sm2Decrypt(priv *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+	var c sm2Cipher
+	if rest, err := asn1.Unmarshal(data, &c); err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	} else if len(rest) > 0 {
+		return nil, errors.Errorf("trailing %v bytes", len(rest))
+	}
+	if !sm2Curve.IsOnCurve(c.X, c.Y) {
+		return nil, errors.New("C1 not on curve")
+	}
+
+	x2, y2 := sm2Curve.ScalarMult(c.X, c.Y, priv.D.Bytes())
+	t := sm2KDF(append(sm2Bytes(x2), sm2Bytes(y2)...), len(c.Cipher))
+	if new(big.Int).SetBytes(t).Sign() == 0 && len(c.Cipher) > 0 {
+		return nil, errors.New("zero key")
+	}
+
+	msg := make([]byte, len(c.Cipher))
+	for i := range c.Cipher {
+		msg[i] = c.Cipher[i] ^ t[i]
+	}
+	if h := sm3Sum(sm2Bytes(x2), msg, sm2Bytes(y2)); string(h[:]) != string(c.Hash) {
+		return nil, errors.New("hash mismatch")
+	}
+	return msg, nil
+}
+
+// The S-box of SM4, see GB/T 32907-2016.
+var sm4SBox = [256]byte{
+	0xd6, 0x90, 0xe9, 0xfe, 0xcc, 0xe1, 0x3d, 0xb7, 0x16, 0xb6, 0x14, 0xc2, 0x28, 0xfb, 0x2c, 0x05,
+	0x2b, 0x67, 0x9a, 0x76, 0x2a, 0xbe, 0x04, 0xc3, 0xaa, 0x44, 0x13, 0x26, 0x49, 0x86, 0x06, 0x99,
+	0x9c, 0x42, 0x50, 0xf4, 0x91, 0xef, 0x98, 0x7a, 0x33, 0x54, 0x0b, 0x43, 0xed, 0xcf, 0xac, 0x62,
+	0xe4, 0xb3, 0x1c, 0xa9, 0xc9, 0x08, 0xe8, 0x95, 0x80, 0xdf, 0x94, 0xfa, 0x75, 0x8f, 0x3f, 0xa6,
+	0x47, 0x07, 0xa7, 0xfc, 0xf3, 0x73, 0x17, 0xba, 0x83, 0x59, 0x3c, 0x19, 0xe6, 0x85, 0x4f, 0xa8,
+	0x68, 0x6b, 0x81, 0xb2, 0x71, 0x64, 0xda, 0x8b, 0xf8, 0xeb, 0x0f, 0x4b, 0x70, 0x56, 0x9d, 0x35,
+	0x1e, 0x24, 0x0e, 0x5e, 0x63, 0x58, 0xd1, 0xa2, 0x25, 0x22, 0x7c, 0x3b, 0x01, 0x21, 0x78, 0x87,
+	0xd4, 0x00, 0x46, 0x57, 0x9f, 0xd3, 0x27, 0x52, 0x4c, 0x36, 0x02, 0xe7, 0xa0, 0xc4, 0xc8, 0x9e,
+	0xea, 0xbf, 0x8a, 0xd2, 0x40, 0xc7, 0x38, 0xb5, 0xa3, 0xf7, 0xf2, 0xce, 0xf9, 0x61, 0x15, 0xa1,
+	0xe0, 0xae, 0x5d, 0xa4, 0x9b, 0x34, 0x1a, 0x55, 0xad, 0x93, 0x32, 0x30, 0xf5, 0x8c, 0xb1, 0xe3,
+	0x1d, 0xf6, 0xe2, 0x2e, 0x82, 0x66, 0xca, 0x60, 0xc0, 0x29, 0x23, 0xab, 0x0d, 0x53, 0x4e, 0x6f,
+	0xd5, 0xdb, 0x37, 0x45, 0xde, 0xfd, 0x8e, 0x2f, 0x03, 0xff, 0x6a, 0x72, 0x6d, 0x6c, 0x5b, 0x51,
+	0x8d, 0x1b, 0xaf, 0x92, 0xbb, 0xdd, 0xbc, 0x7f, 0x11, 0xd9, 0x5c, 0x41, 0x1f, 0x10, 0x5a, 0xd8,
+	0x0a, 0xc1, 0x31, 0x88, 0xa5, 0xcd, 0x7b, 0xbd, 0x2d, 0x74, 0xd0, 0x12, 0xb8, 0xe5, 0xb4, 0xb0,
+	0x89, 0x69, 0x97, 0x4a, 0x0c, 0x96, 0x77, 0x7e, 0x65, 0xb9, 0xf1, 0x09, 0xc5, 0x6e, 0xc6, 0x84,
+	0x18, 0xf0, 0x7d, 0xec, 0x3a, 0xdc, 0x4d, 0x20, 0x79, 0xee, 0x5f, 0x3e, 0xd7, 0xcb, 0x39, 0x48,
+}
+
+// The SM4 block cipher of 128 bits key and block, with the 32 round keys.
+type sm4Cipher struct {
+	rk [32]uint32
+}
+
+// Create the SM4 block cipher, to use with the modes of crypto/cipher, for example, cipher.NewCTR.
+func newSM4Cipher(key []byte) (cipher.Block, error) {
+	if len(key) != 16 {
+		return nil, errors.Errorf("invalid SM4 key length %v", len(key))
+	}
+
+	k := [4]uint32{
+		binary.BigEndian.Uint32(key[0:]) ^ 0xa3b1bac6, binary.BigEndian.Uint32(key[4:]) ^ 0x56aa3350,
+		binary.BigEndian.Uint32(key[8:]) ^ 0x677d9197, binary.BigEndian.Uint32(key[12:]) ^ 0xb27022dc,
+	}
+
+	v := &sm4Cipher{}
+	for i := 0; i < 32; i++ {
+		// The CK is the bytes of (4i+j)*7 mod 256.
+		var ck uint32
+		for j := 0; j < 4; j++ {
+			ck = ck<<8 | uint32(byte((4*i+j)*7))
+		}
+
+		b := sm4Tau(k[1] ^ k[2] ^ k[3] ^ ck)
+		v.rk[i] = k[0] ^ b ^ bits.RotateLeft32(b, 13) ^ bits.RotateLeft32(b, 23)
+		k[0], k[1], k[2], k[3] = k[1], k[2], k[3], v.rk[i]
+	}
+	return v, nil
+}
+
+// The non-linear substitution of each byte by S-box.
+func sm4Tau(a uint32) uint32 {
+	return uint32(sm4SBox[a>>24])<<24 | uint32(sm4SBox[a>>16&0xff])<<16 | uint32(sm4SBox[a>>8&0xff])<<8 |
+		uint32(sm4SBox[a&0xff])
+}
+
+func (v *sm4Cipher) BlockSize() int {
+	return 16
+}
+
+func (v *sm4Cipher) Encrypt(dst, src []byte) {
+	v.crypt(dst, src, false)
+}
+
+func (v *sm4Cipher) Decrypt(dst, src []byte) {
+	v.crypt(dst, src, true)
+}
+
+// The 32 rounds of SM4, the decryption is the same with the round keys in reverse order.
+func (v *sm4Cipher) crypt(dst, src []byte, decrypt bool) {
+	x := [4]uint32{
+		binary.BigEndian.Uint32(src[0:]), binary.BigEndian.Uint32(src[4:]),
+		binary.BigEndian.Uint32(src[8:]), binary.BigEndian.Uint32(src[12:]),
+	}
+
+	for i := 0; i < 32; i++ {
+		rk := v.rk[i]
+		if decrypt {
+			rk = v.rk[31-i]
+		}
+
+		b := sm4Tau(x[1] ^ x[2] ^ x[3] ^ rk)
+		b = x[0] ^ b ^ bits.RotateLeft32(b, 2) ^ bits.RotateLeft32(b, 10) ^ bits.RotateLeft32(b, 18) ^
+			bits.RotateLeft32(b, 24)
+		x[0], x[1], x[2], x[3] = x[1], x[2], x[3], b
+	}
+
+	binary.BigEndian.PutUint32(dst[0:], x[3])
+	binary.BigEndian.PutUint32(dst[4:], x[2])
+	binary.BigEndian.PutUint32(dst[8:], x[1])
+	binary.BigEndian.PutUint32(dst[12:], x[0])
+}
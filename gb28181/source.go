@@ -0,0 +1,908 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/aac"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type FrameCodec int
+
+const (
+	FrameCodecH264 FrameCodec = iota
+	FrameCodecH265
+	FrameCodecAAC
+	FrameCodecPCMA
+	FrameCodecPCMU
+)
+
+func (v FrameCodec) String() string {
+	switch v {
+	case FrameCodecH264:
+		return "H.264"
+	case FrameCodecH265:
+		return "H.265"
+	case FrameCodecAAC:
+		return "AAC"
+	case FrameCodecPCMA:
+		return "G.711A"
+	case FrameCodecPCMU:
+		return "G.711U"
+	default:
+		return "Unknown"
+	}
+}
+
+func (v FrameCodec) IsVideo() bool {
+	return v == FrameCodecH264 || v == FrameCodecH265
+}
+
+// The media frame from FrameSource.
+type Frame struct {
+	// The codec of frame.
+	Codec FrameCodec
+	// The timestamp in clock rate of session, generally 90kHz.
+	DTS uint64
+	PTS uint64
+	// For video, it's the NALUs without ANNEXB header, for example, SPS, PPS and IDR. For audio, it's ADTS frame.
+	Payloads [][]byte
+	// The duration in clock rate of session, for variable frame rate, or 0 if unknown which means fixed fps.
+	Duration uint64
+}
+
+// FrameSource is the source of media frames, which is pulled by the session, so that we're able to support new
+// codec or container without changing the session.
+type FrameSource interface {
+	// Next returns the next frame, or io.EOF when no more frames.
+	Next() (*Frame, error)
+}
+
+// Read H.264 frames from ANNEXB stream, with fixed fps.
+type H264FrameSource struct {
+	ctx context.Context
+	r   *h264reader.H264Reader
+	// The clock rate of DTS, generally 90kHz.
+	clockRate uint64
+	// The frame rate of stream, in fpsNum/fpsDen, for example, 30000/1001 for 29.97fps.
+	fpsNum uint64
+	fpsDen uint64
+	// The number of frames read.
+	frames uint64
+	// The first NALU of next access unit.
+	pending *h264reader.NAL
+}
+
+func NewH264FrameSource(ctx context.Context, r io.Reader, fps int, clockRate uint64) (*H264FrameSource, error) {
+	h264, err := h264reader.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "h264 reader")
+	}
+	return &H264FrameSource{ctx: ctx, r: h264, clockRate: clockRate, fpsNum: uint64(fps), fpsDen: 1}, nil
+}
+
+// SetFrameRate sets the frame rate in num/den, for example, 30000/1001 for 29.97fps.
+func (v *H264FrameSource) SetFrameRate(num, den uint64) {
+	v.fpsNum, v.fpsDen = num, den
+}
+
+// Next reads NALUs of an access unit, which might be prefixed by SPS, PPS and SEI, or contains multiple slices.
+func (v *H264FrameSource) Next() (*Frame, error) {
+	frame := &Frame{Codec: FrameCodecH264}
+	var hasSlice bool
+	for {
+		nalu := v.pending
+		v.pending = nil
+		if nalu == nil {
+			var err error
+			if nalu, err = v.r.NextNAL(); err == io.EOF && hasSlice {
+				break
+			} else if err == io.EOF {
+				return nil, io.EOF
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "Read h264")
+			}
+		}
+
+		// Start a new access unit, keep the NALU for next frame.
+		if hasSlice && utilIsH264AUStart(nalu.Data) {
+			v.pending = nalu
+			break
+		}
+
+		frame.Payloads = append(frame.Payloads, nalu.Data)
+		logger.If(v.ctx, "NALU %v PictureOrderCount=%v, ForbiddenZeroBit=%v, RefIdc=%v, %v bytes",
+			nalu.UnitType.String(), nalu.PictureOrderCount, nalu.ForbiddenZeroBit, nalu.RefIdc, len(nalu.Data))
+
+		if t := nalu.UnitType; t >= h264reader.NalUnitTypeCodedSliceNonIdr && t <= h264reader.NalUnitTypeCodedSliceIdr {
+			hasSlice = true
+		}
+	}
+
+	v.frames++
+	frame.DTS = utilFrameTimestamp(v.clockRate, v.frames, v.fpsNum, v.fpsDen)
+	frame.PTS = frame.DTS
+	return frame, nil
+}
+
+// Read H.265 frames from ANNEXB stream, with fixed fps.
+type H265FrameSource struct {
+	ctx context.Context
+	r   *H265Reader
+	// The clock rate of DTS, generally 90kHz.
+	clockRate uint64
+	// The frame rate of stream, in fpsNum/fpsDen, for example, 30000/1001 for 29.97fps.
+	fpsNum uint64
+	fpsDen uint64
+	// The number of frames read.
+	frames uint64
+	// The first NALU of next access unit.
+	pending *NAL
+}
+
+func NewH265FrameSource(ctx context.Context, r io.Reader, fps int, clockRate uint64) (*H265FrameSource, error) {
+	h265, err := NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "h265 reader")
+	}
+	return &H265FrameSource{ctx: ctx, r: h265, clockRate: clockRate, fpsNum: uint64(fps), fpsDen: 1}, nil
+}
+
+// SetFrameRate sets the frame rate in num/den, for example, 30000/1001 for 29.97fps.
+func (v *H265FrameSource) SetFrameRate(num, den uint64) {
+	v.fpsNum, v.fpsDen = num, den
+}
+
+// Next reads NALUs of an access unit, which might be prefixed by VPS, SPS, PPS and SEI, or contains multiple slices.
+func (v *H265FrameSource) Next() (*Frame, error) {
+	frame := &Frame{Codec: FrameCodecH265}
+	var hasSlice bool
+	for {
+		nalu := v.pending
+		v.pending = nil
+		if nalu == nil {
+			var err error
+			if nalu, err = v.r.NextNAL(); err == io.EOF && hasSlice {
+				break
+			} else if err == io.EOF {
+				return nil, io.EOF
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "Read h265")
+			}
+		}
+
+		// Start a new access unit, keep the NALU for next frame.
+		if hasSlice && utilIsH265AUStart(nalu.Data) {
+			v.pending = nalu
+			break
+		}
+
+		frame.Payloads = append(frame.Payloads, nalu.Data)
+		logger.If(v.ctx, "NALU %v PictureOrderCount=%v, ForbiddenZeroBit=%v, %v bytes",
+			nalu.UnitType, nalu.PictureOrderCount, nalu.ForbiddenZeroBit, len(nalu.Data))
+
+		// The VCL NALU is in [0, 31].
+		if nalu.UnitType < NaluTypeVps {
+			hasSlice = true
+		}
+	}
+
+	v.frames++
+	frame.DTS = utilFrameTimestamp(v.clockRate, v.frames, v.fpsNum, v.fpsDen)
+	frame.PTS = frame.DTS
+	return frame, nil
+}
+
+// Whether the video frame is keyframe, which is prefixed by sequence header, that is SPS/PPS for H.264, and
+// VPS/SPS/PPS for H.265.
+func utilIsKeyframe(frame *Frame) bool {
+	for _, payload := range frame.Payloads {
+		if len(payload) == 0 {
+			continue
+		}
+		if frame.Codec == FrameCodecH265 {
+			if t := NalUnitType((payload[0] & 0x7e) >> 1); t == NaluTypeVps || t == NaluTypeSps || t == NaluTypePps {
+				return true
+			}
+		} else {
+			if t := h264reader.NalUnitType(payload[0] & 0x1f); t == h264reader.NalUnitTypeSPS || t == h264reader.NalUnitTypePPS {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Calculate the timestamp of the n-th frame at fpsNum/fpsDen frame rate, that is n*clockRate*fpsDen/fpsNum. We always
+// calculate from the frame index rather than accumulating the duration of each frame, so the rounding error never
+// accumulates, and the timestamp is rounded down to the tick, at most one tick earlier than the exact rational value.
+func utilFrameTimestamp(clockRate, n, fpsNum, fpsDen uint64) uint64 {
+	if fpsNum == 0 {
+		return 0
+	}
+	return clockRate * n * fpsDen / fpsNum
+}
+
+// Whether the H.264 NALU starts a new access unit, when previous access unit has slice, see ISO_IEC_14496-10 7.4.1.2.3.
+func utilIsH264AUStart(nalu []byte) bool {
+	if len(nalu) == 0 {
+		return false
+	}
+
+	switch h264reader.NalUnitType(nalu[0] & 0x1f) {
+	case h264reader.NalUnitTypeAUD, h264reader.NalUnitTypeSPS, h264reader.NalUnitTypePPS, h264reader.NalUnitTypeSEI:
+		return true
+	case h264reader.NalUnitTypeCodedSliceNonIdr, h264reader.NalUnitTypeCodedSliceIdr:
+		// The first_mb_in_slice is ue(v), which is 0 only when the first bit is 1.
+		return len(nalu) > 1 && nalu[1]&0x80 != 0
+	}
+	return false
+}
+
+// Whether the H.265 NALU starts a new access unit, when previous access unit has slice, see ITU-T-H.265 7.4.2.4.4.
+func utilIsH265AUStart(nalu []byte) bool {
+	if len(nalu) == 0 {
+		return false
+	}
+
+	t := NalUnitType((nalu[0] & 0x7e) >> 1)
+	switch {
+	case t == NaluTypeAud || t == NaluTypeVps || t == NaluTypeSps || t == NaluTypePps || t == NaluTypeSei:
+		return true
+	case t < NaluTypeVps:
+		// The first_slice_segment_in_pic_flag is the first bit after 2 bytes NALU header.
+		return len(nalu) > 2 && nalu[2]&0x80 != 0
+	}
+	return false
+}
+
+// Read video frames from numbered files, each file is an access unit in ANNEXB format, or a single NALU without start
+// code. The pattern is in printf style, for example, frames/%05d.h264, and the frames are read in the order of number.
+type NumberedFrameSource struct {
+	codec FrameCodec
+	// The printf style pattern of files.
+	pattern string
+	// The numbers of files, in order.
+	numbers []int
+	// Whether skip the missing numbers, or fail.
+	skipGap bool
+	// The clock rate of DTS, generally 90kHz.
+	clockRate uint64
+	// The frame rate of stream, in fpsNum/fpsDen.
+	fpsNum uint64
+	fpsDen uint64
+	// The next number of file to read.
+	next int
+}
+
+// NewNumberedFrameSource finds the files by pattern, for example, frames/%05d.h264, the codec is H.265 if the suffix is
+// .h265 or .hevc, otherwise H.264. If skipGap, the missing number is skipped, and the timestamp is still calculated by
+// the number, so the gap is kept in timeline, otherwise, fail when got a gap in numbering.
+func NewNumberedFrameSource(pattern string, fps int, clockRate uint64, skipGap bool) (*NumberedFrameSource, error) {
+	if strings.Count(pattern, "%") != 1 {
+		return nil, errors.Errorf("invalid pattern %v, should contain one number verb, for example, %%05d", pattern)
+	}
+
+	// Find all files matching the pattern, by converting the number verb to *.
+	verb := regexp.MustCompile(`%0?[0-9]*d`)
+	if !verb.MatchString(pattern) {
+		return nil, errors.Errorf("invalid pattern %v, no number verb", pattern)
+	}
+	files, err := filepath.Glob(verb.ReplaceAllString(pattern, "*"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "glob %v", pattern)
+	}
+
+	var numbers []int
+	for _, file := range files {
+		var n int
+		if _, err := fmt.Sscanf(file, pattern, &n); err == nil && fmt.Sprintf(pattern, n) == file {
+			numbers = append(numbers, n)
+		}
+	}
+	if len(numbers) == 0 {
+		return nil, errors.Errorf("no file for %v", pattern)
+	}
+	sort.Ints(numbers)
+
+	codec := FrameCodecH264
+	if utilIsHEVCFile(pattern) {
+		codec = FrameCodecH265
+	}
+
+	return &NumberedFrameSource{
+		codec: codec, pattern: pattern, numbers: numbers, skipGap: skipGap, clockRate: clockRate,
+		fpsNum: uint64(fps), fpsDen: 1, next: numbers[0],
+	}, nil
+}
+
+// SetFrameRate sets the frame rate in num/den, for example, 30000/1001 for 29.97fps.
+func (v *NumberedFrameSource) SetFrameRate(num, den uint64) {
+	v.fpsNum, v.fpsDen = num, den
+}
+
+func (v *NumberedFrameSource) Next() (*Frame, error) {
+	first, last := v.numbers[0], v.numbers[len(v.numbers)-1]
+	for ; v.next <= last; v.next++ {
+		filename := fmt.Sprintf(v.pattern, v.next)
+		b, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) && v.skipGap {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "read %v", filename)
+		}
+
+		// The timestamp is by number, so the gap is kept in timeline.
+		dts := utilFrameTimestamp(v.clockRate, uint64(v.next-first+1), v.fpsNum, v.fpsDen)
+		v.next++
+
+		return &Frame{Codec: v.codec, DTS: dts, PTS: dts, Payloads: utilSplitAnnexB(b)}, nil
+	}
+	return nil, io.EOF
+}
+
+// Split the ANNEXB stream to NALUs, or the whole as a NALU if no start code.
+func utilSplitAnnexB(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+
+		// The NALU ends before the start code, and the zero byte of 4 bytes start code.
+		if start >= 0 {
+			end := i
+			if end > start && b[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, b[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+
+	if start < 0 {
+		return [][]byte{b}
+	}
+	return append(nalus, b[start:])
+}
+
+// Read video frames from source with variable frame rate, the DTS and PTS are accumulated by the actual durations of
+// frames, rather than the fixed fps of source. The last duration is used if no more durations.
+type VFRFrameSource struct {
+	source FrameSource
+	// The duration of each frame, in clock rate.
+	durations []uint64
+	// The number of frames read, and the DTS of next frame.
+	frames uint64
+	dts    uint64
+}
+
+func NewVFRFrameSource(source FrameSource, durations []uint64) (*VFRFrameSource, error) {
+	if len(durations) == 0 {
+		return nil, errors.New("no durations")
+	}
+	return &VFRFrameSource{source: source, durations: durations}, nil
+}
+
+func (v *VFRFrameSource) Next() (*Frame, error) {
+	frame, err := v.source.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	duration := v.durations[len(v.durations)-1]
+	if v.frames < uint64(len(v.durations)) {
+		duration = v.durations[v.frames]
+	}
+	v.frames++
+
+	// Keep the composition offset of source, for example, the reordered B-frames.
+	var offset uint64
+	if frame.PTS > frame.DTS {
+		offset = frame.PTS - frame.DTS
+	}
+
+	frame.DTS, frame.PTS, frame.Duration = v.dts, v.dts+offset, duration
+	v.dts += duration
+	return frame, nil
+}
+
+// FrameTimestamp is the DTS and PTS of a frame in clock rate.
+type FrameTimestamp struct {
+	DTS uint64
+	PTS uint64
+}
+
+// Read video frames from source with the DTS and PTS of timestamps, for example, the reordered B-frames. The
+// timestamps are repeated if more frames, as the pattern of GOP, so it's OK to describe only one GOP.
+type TimestampFrameSource struct {
+	source     FrameSource
+	timestamps []FrameTimestamp
+	// The duration of the pattern of timestamps, which is the offset of each repeat.
+	period uint64
+	// The number of frames read.
+	frames uint64
+}
+
+func NewTimestampFrameSource(source FrameSource, timestamps []FrameTimestamp) (*TimestampFrameSource, error) {
+	if len(timestamps) < 2 {
+		return nil, errors.Errorf("at least 2 timestamps, got %v", len(timestamps))
+	}
+
+	// The duration of last frame is the same as the previous one.
+	first, last, prev := timestamps[0], timestamps[len(timestamps)-1], timestamps[len(timestamps)-2]
+	period := last.DTS - first.DTS + last.DTS - prev.DTS
+	return &TimestampFrameSource{source: source, timestamps: timestamps, period: period}, nil
+}
+
+func (v *TimestampFrameSource) Next() (*Frame, error) {
+	frame, err := v.source.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	n := uint64(len(v.timestamps))
+	index, offset := v.frames%n, v.frames/n*v.period
+	v.frames++
+
+	ts := v.timestamps[index]
+	frame.DTS, frame.PTS = ts.DTS+offset, ts.PTS+offset
+	if index+1 < n {
+		frame.Duration = v.timestamps[index+1].DTS - ts.DTS
+	} else {
+		frame.Duration = v.timestamps[0].DTS + v.period - ts.DTS
+	}
+	return frame, nil
+}
+
+// Parse the timestamps of frames in clock rate, each line is the DTS and PTS in ms of a frame in decode order, which
+// is separated by space or comma, for example, "0 66.733" for I-frame and "33.367 33.367" for B-frame. The DTS should
+// be increasing, and PTS should not be less than DTS.
+func utilParseTimestamps(r io.Reader, clockRate uint64) ([]FrameTimestamp, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+
+	var timestamps []FrameTimestamp
+	for i, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ','
+		})
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid timestamp %v at line %v", line, i+1)
+		}
+
+		var ts [2]uint64
+		for j, field := range fields {
+			ms, err := strconv.ParseFloat(field, 64)
+			if err != nil || ms < 0 {
+				return nil, errors.Errorf("invalid timestamp %v at line %v", line, i+1)
+			}
+			ts[j] = uint64(math.Round(ms * float64(clockRate) / 1000))
+		}
+
+		dts, pts := ts[0], ts[1]
+		if pts < dts {
+			return nil, errors.Errorf("pts less than dts %v at line %v", line, i+1)
+		}
+		if len(timestamps) > 0 && dts <= timestamps[len(timestamps)-1].DTS {
+			return nil, errors.Errorf("dts %v at line %v not increasing", line, i+1)
+		}
+		timestamps = append(timestamps, FrameTimestamp{DTS: dts, PTS: pts})
+	}
+	return timestamps, nil
+}
+
+// Parse the durations of frames in clock rate, from timecodes in mkvmerge format v2, which is the timestamp in ms of
+// each frame per line, for example, 0, 33.367, 66.733. The durations are rounded from the absolute timestamps, so the
+// rounding error never accumulates. The duration of last frame is the same as the previous one.
+func utilParseTimecodes(r io.Reader, clockRate uint64) ([]uint64, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+
+	var timestamps []uint64
+	for i, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ms, err := strconv.ParseFloat(line, 64)
+		if err != nil || ms < 0 {
+			return nil, errors.Errorf("invalid timecode %v at line %v", line, i+1)
+		}
+
+		ts := uint64(math.Round(ms * float64(clockRate) / 1000))
+		if len(timestamps) > 0 && ts <= timestamps[len(timestamps)-1] {
+			return nil, errors.Errorf("timecode %v at line %v not increasing", line, i+1)
+		}
+		timestamps = append(timestamps, ts)
+	}
+	if len(timestamps) < 2 {
+		return nil, errors.Errorf("at least 2 timecodes, got %v", len(timestamps))
+	}
+
+	var durations []uint64
+	for i := 1; i < len(timestamps); i++ {
+		durations = append(durations, timestamps[i]-timestamps[i-1])
+	}
+	return append(durations, durations[len(durations)-1]), nil
+}
+
+// Read AAC frames from ADTS stream.
+type AACFrameSource struct {
+	r *AACReader
+	// The clock rate of DTS, generally 90kHz.
+	clockRate uint64
+	// The number of samples read, each AAC frame contains 1024 samples.
+	samples uint64
+}
+
+func NewAACFrameSource(r io.Reader, clockRate uint64) (*AACFrameSource, error) {
+	aac, err := NewAACReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "aac reader")
+	}
+	return &AACFrameSource{r: aac, clockRate: clockRate}, nil
+}
+
+func (v *AACFrameSource) SampleRate() int {
+	return v.r.codec.ASC().SampleRate.ToHz()
+}
+
+func (v *AACFrameSource) Channels() int {
+	return int(v.r.codec.ASC().Channels)
+}
+
+// AudioConfig returns the AAC profile, sample rate and channels of stream.
+func (v *AACFrameSource) AudioConfig() aac.AudioSpecificConfig {
+	return *v.r.codec.ASC()
+}
+
+func (v *AACFrameSource) Next() (*Frame, error) {
+	adts, err := v.r.NextADTSFrame()
+	if err != nil {
+		return nil, errors.Wrap(err, "Read AAC")
+	}
+
+	// Each AAC frame contains 1024 samples, DTS = total-samples / sample-rate
+	v.samples += 1024
+	dts := v.clockRate * v.samples / uint64(v.SampleRate())
+
+	// Copy the ADTS frame, because it's overwritten by next read.
+	payload := append([]byte(nil), adts...)
+	return &Frame{Codec: FrameCodecAAC, DTS: dts, PTS: dts, Payloads: [][]byte{payload}}, nil
+}
+
+// The samples of G.711 frame, 20ms at 8kHz, which is the packet time of most devices.
+const g711FrameSamples = 160
+
+// Read G.711 frames from raw A-law or U-law samples, for example, the .pcm or .g711 file, each sample is a byte in
+// 8kHz mono.
+type G711FrameSource struct {
+	r     io.Reader
+	codec FrameCodec
+	// The clock rate of DTS, generally 90kHz.
+	clockRate uint64
+	// The number of samples read.
+	samples uint64
+}
+
+func NewG711FrameSource(r io.Reader, codec FrameCodec, clockRate uint64) (*G711FrameSource, error) {
+	if codec != FrameCodecPCMA && codec != FrameCodecPCMU {
+		return nil, errors.Errorf("invalid g711 codec %v", codec)
+	}
+	return &G711FrameSource{r: r, codec: codec, clockRate: clockRate}, nil
+}
+
+// SampleRate of G.711 is always 8kHz.
+func (v *G711FrameSource) SampleRate() int {
+	return 8000
+}
+
+func (v *G711FrameSource) Next() (*Frame, error) {
+	// The last frame might be less than a full frame, which is still valid.
+	payload := make([]byte, g711FrameSamples)
+	n, err := io.ReadFull(v.r, payload)
+	if err == io.EOF {
+		return nil, err
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrap(err, "Read G.711")
+	}
+
+	// Same to AAC, DTS = total-samples / sample-rate
+	v.samples += uint64(n)
+	dts := v.clockRate * v.samples / uint64(v.SampleRate())
+
+	return &Frame{Codec: v.codec, DTS: dts, PTS: dts, Payloads: [][]byte{payload[:n]}}, nil
+}
+
+// FileCache loads each file once and shares the content with all readers, for example, the simulated devices which
+// stream the same source files, to avoid reading the same file for each device.
+type FileCache struct {
+	lock  sync.Mutex
+	files map[string][]byte
+}
+
+func NewFileCache() *FileCache {
+	return &FileCache{files: make(map[string][]byte)}
+}
+
+// Open returns a reader of the cached content, or loads the file if not cached. If v is nil, open the file directly.
+func (v *FileCache) Open(name string) (io.ReadCloser, error) {
+	if v == nil {
+		return os.Open(name)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	b, ok := v.files[name]
+	if !ok {
+		var err error
+		if b, err = ioutil.ReadFile(name); err != nil {
+			return nil, errors.Wrapf(err, "read %v", name)
+		}
+		v.files[name] = b
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Read frames from source, and replay the frames when source ends, with the timestamps offset by the period of each
+// loop, so the DTS and PTS keep increasing, for long duration test. The frames of the first loop are cached in memory,
+// so it's for the short files, for example, a 10s clip to loop for hours.
+type LoopFrameSource struct {
+	group  *loopFrameGroup
+	source FrameSource
+	// The frames of the first loop.
+	frames []*Frame
+	// Whether the source ends, that is all frames are cached.
+	eof bool
+	// The number of frames read, of all loops.
+	reads uint64
+}
+
+// The video and audio of the loop share the same period, to keep them in sync.
+type loopFrameGroup struct {
+	sources []*LoopFrameSource
+	// The period of loop, the duration from the first to the end of last frame of all sources.
+	period uint64
+}
+
+// NewLoopFrameSources wraps each source as a loop source, ignore if nil. The sources share the same period, which is
+// the longest duration of them, so the streams are in sync after each loop.
+func NewLoopFrameSources(sources ...FrameSource) []*LoopFrameSource {
+	group := &loopFrameGroup{}
+
+	loops := make([]*LoopFrameSource, len(sources))
+	for i, source := range sources {
+		if source != nil {
+			loops[i] = &LoopFrameSource{group: group, source: source}
+			group.sources = append(group.sources, loops[i])
+		}
+	}
+	return loops
+}
+
+func (v *LoopFrameSource) Next() (*Frame, error) {
+	// Read the first loop from source, and cache the frames.
+	if !v.eof && v.reads == uint64(len(v.frames)) {
+		// The source might wrap the EOF, for example, the AAC source.
+		frame, err := v.source.Next()
+		if err != nil && errors.Cause(err) != io.EOF {
+			return nil, err
+		}
+
+		if err == nil {
+			v.frames = append(v.frames, frame)
+		} else {
+			v.eof = true
+			if err = v.group.end(); err != nil {
+				return nil, errors.Wrap(err, "loop")
+			}
+		}
+	}
+
+	if len(v.frames) == 0 {
+		return nil, io.EOF
+	}
+
+	n := uint64(len(v.frames))
+	index, offset := v.reads%n, v.reads/n*v.group.period
+	v.reads++
+
+	// Copy the frame, because the ingester might modify it.
+	frame := v.frames[index]
+	return &Frame{
+		Codec: frame.Codec, DTS: frame.DTS + offset, PTS: frame.PTS + offset, Duration: frame.Duration,
+		Payloads: append([][]byte{}, frame.Payloads...),
+	}, nil
+}
+
+// Loops returns the number of loops started, 1 for the first loop.
+func (v *LoopFrameSource) Loops() uint64 {
+	if len(v.frames) == 0 {
+		return 0
+	}
+	return (v.reads + uint64(len(v.frames)) - 1) / uint64(len(v.frames))
+}
+
+// Called when any source ends, read all frames of other sources, to calculate the period of loop.
+func (v *loopFrameGroup) end() error {
+	if v.period > 0 {
+		return nil
+	}
+
+	var start, end uint64
+	var started bool
+	for i, source := range v.sources {
+		for !source.eof {
+			frame, err := source.source.Next()
+			if errors.Cause(err) == io.EOF {
+				source.eof = true
+			} else if err != nil {
+				return errors.Wrapf(err, "read source %v", i)
+			} else {
+				source.frames = append(source.frames, frame)
+			}
+		}
+
+		frames := source.frames
+		if len(frames) == 0 {
+			continue
+		}
+
+		// The duration of last frame is the same as the previous one, if not specified.
+		first, last := frames[0], frames[len(frames)-1]
+		duration := last.Duration
+		if duration == 0 && len(frames) > 1 {
+			duration = last.DTS - frames[len(frames)-2].DTS
+		}
+
+		if !started || first.DTS < start {
+			start, started = first.DTS, true
+		}
+		if last.DTS+duration > end {
+			end = last.DTS + duration
+		}
+	}
+
+	// Nothing to loop, all sources are empty.
+	if !started {
+		return nil
+	}
+	if end <= start {
+		return errors.Errorf("invalid loop period, start=%v, end=%v", start, end)
+	}
+	v.period = end - start
+	return nil
+}
+
+// DriftFrameSource skews the timestamps of frames by ppm relative to the first frame, to simulate the clock drift of a
+// track, for example, the audio drifts from video by the different crystals of encoders.
+type DriftFrameSource struct {
+	source FrameSource
+	// The drift in ppm, positive to grow faster.
+	ppm float64
+	// The DTS of first frame, the base of drift.
+	base    uint64
+	hasBase bool
+}
+
+func NewDriftFrameSource(source FrameSource, ppm float64) *DriftFrameSource {
+	return &DriftFrameSource{source: source, ppm: ppm}
+}
+
+func (v *DriftFrameSource) Next() (*Frame, error) {
+	frame, err := v.source.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	if !v.hasBase {
+		v.base, v.hasBase = frame.DTS, true
+	}
+
+	// Shift the DTS and PTS by the same offset, to keep the composition time.
+	var offset int64
+	if frame.DTS > v.base {
+		offset = int64(float64(frame.DTS-v.base) * v.ppm / 1000000)
+	}
+	frame.DTS, frame.PTS = uint64(int64(frame.DTS)+offset), uint64(int64(frame.PTS)+offset)
+	return frame, nil
+}
+
+// SeekFrameSource is able to skip frames forward to a position, for example, the seek of playback. The source is
+// read sequentially, so it never seeks backward.
+type SeekFrameSource struct {
+	source FrameSource
+	// The frame read by seek, which is the next frame to return.
+	pending *Frame
+	// The DTS of last frame returned, to reject seeking backward.
+	dts uint64
+}
+
+func NewSeekFrameSource(source FrameSource) *SeekFrameSource {
+	return &SeekFrameSource{source: source}
+}
+
+func (v *SeekFrameSource) Next() (*Frame, error) {
+	if frame := v.pending; frame != nil {
+		v.pending, v.dts = nil, frame.DTS
+		return frame, nil
+	}
+
+	frame, err := v.source.Next()
+	if err != nil {
+		return nil, err
+	}
+	v.dts = frame.DTS
+	return frame, nil
+}
+
+// Seek skips the frames before dts, and the next frame is the first one at or after dts. If keyframe, also skip until
+// the frame with parameter sets, to start decoding from it. Return the DTS of next frame, or io.EOF if no more frames.
+func (v *SeekFrameSource) Seek(dts uint64, keyframe bool) (uint64, error) {
+	if dts < v.dts {
+		return 0, errors.Errorf("seek backward to %v, current %v", dts, v.dts)
+	}
+
+	for {
+		frame := v.pending
+		if frame == nil {
+			var err error
+			if frame, err = v.source.Next(); err != nil {
+				return 0, err
+			}
+		}
+
+		v.pending = nil
+		if frame.DTS >= dts && (!keyframe || utilIsKeyframe(frame)) {
+			v.pending = frame
+			return frame.DTS, nil
+		}
+		v.dts = frame.DTS
+	}
+}
@@ -0,0 +1,730 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/aac"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/yapingcat/gomedia/mpeg2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The frame source for test, which generates frames in memory.
+type psTestFrameSource struct {
+	frames []*Frame
+}
+
+func (v *psTestFrameSource) Next() (*Frame, error) {
+	if len(v.frames) == 0 {
+		return nil, io.EOF
+	}
+	frame := v.frames[0]
+	v.frames = v.frames[1:]
+	return frame, nil
+}
+
+func TestPSFrameTimestamp(t *testing.T) {
+	num, den, err := utilParseFrameRate("30000/1001")
+	if err != nil || num != 30000 || den != 1001 {
+		t.Errorf("invalid rate %v/%v, err %+v", num, den, err)
+		return
+	}
+	if _, _, err := utilParseFrameRate("30/0"); err == nil {
+		t.Errorf("should fail for zero den")
+	}
+
+	// The exact timestamp of 100000th frame at 29.97fps is 100000*90000*1001/30000=300300000.
+	if ts := utilFrameTimestamp(90000, 100000, num, den); ts != 300300000 {
+		t.Errorf("invalid ts %v", ts)
+	}
+
+	// Should never drift more than one tick from the exact rational value.
+	for _, n := range []uint64{1, 7, 99999, 100001, 1000003} {
+		ts := utilFrameTimestamp(90000, n, num, den)
+		if exact := float64(n) * 90000 * 1001 / 30000; float64(ts) > exact || exact-float64(ts) >= 1 {
+			t.Errorf("frame %v, ts %v, exact %v", n, ts, exact)
+		}
+	}
+
+	// The H.264 source should use the rational frame rate.
+	var annexb []byte
+	for i := 0; i < 3; i++ {
+		annexb = append(annexb, 0, 0, 0, 1, 0x41, 0x9a, byte(i))
+	}
+	source, err := NewH264FrameSource(logger.WithContext(context.Background()), bytes.NewReader(annexb), 30, 90000)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	source.SetFrameRate(num, den)
+	for i, expect := range []uint64{3003, 6006, 9009} {
+		if frame, err := source.Next(); err != nil || frame.DTS != expect {
+			t.Errorf("frame %v, expect %v, err %+v", i, expect, err)
+		}
+	}
+}
+
+func TestPSAudioConfig(t *testing.T) {
+	for _, c := range []struct {
+		sampleRate aac.SampleRateIndex
+		hz         int
+		dts        uint64
+	}{
+		{aac.SampleRateIndex44kHz, 44100, 90000 * 1024 / 44100},
+		{aac.SampleRateIndex48kHz, 48000, 90000 * 1024 / 48000},
+	} {
+		// The PS stream should detect the profile and sample rate from ADTS.
+		pack := NewPSPackStream(96)
+		if err := pack.WriteAudio(psTestADTS(c.sampleRate, 16), 0); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if asc := pack.AudioConfig(); asc == nil || asc.Object != aac.ObjectTypeLC || asc.SampleRate.ToHz() != c.hz ||
+			asc.Channels != aac.ChannelStereo {
+			t.Errorf("invalid audio config %v", asc)
+		}
+
+		// Should fail if the sample rate mismatch the declared one.
+		other := aac.SampleRateIndex48kHz
+		if c.sampleRate == other {
+			other = aac.SampleRateIndex44kHz
+		}
+		if err := pack.WriteAudio(psTestADTS(other, 16), 0); err == nil {
+			t.Errorf("should fail for %vHz", other.ToHz())
+		}
+
+		// The DTS of audio source depends on the sample rate. Note that the reader requires 1031 bytes for each frame.
+		var b []byte
+		for i := 0; i < 3; i++ {
+			b = append(b, psTestADTS(c.sampleRate, 1024)...)
+		}
+		source, err := NewAACFrameSource(bytes.NewReader(b), 90000)
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if source.SampleRate() != c.hz || source.AudioConfig().Object.ToProfile() != aac.ProfileLC {
+			t.Errorf("invalid sample rate %v", source.SampleRate())
+		}
+		if frame, err := source.Next(); err != nil || frame.DTS != c.dts {
+			t.Errorf("invalid frame %v, expect dts %v, err %+v", frame, c.dts, err)
+		}
+	}
+}
+
+func TestPSNumberedFrameSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srs-bench-numbered")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// The frame 4 is missing, and the frame 1 contains SPS, PPS and IDR.
+	for n, b := range map[int][]byte{
+		1: {0, 0, 0, 1, 0x67, 0x64, 0, 0, 1, 0x68, 0xee, 0, 0, 0, 1, 0x65, 0x88},
+		2: {0x41, 0x9a, 0x02}, 3: {0, 0, 0, 1, 0x41, 0x9a, 0x03}, 5: {0x41, 0x9a, 0x05},
+	} {
+		if err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf("%05d.h264", n)), b, 0644); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+	}
+	pattern := path.Join(dir, "%05d.h264")
+
+	// Should fail for gap.
+	source, err := NewNumberedFrameSource(pattern, 25, 90000, false)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := source.Next(); err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+	}
+	if _, err := source.Next(); err == nil {
+		t.Errorf("should fail for gap")
+	}
+
+	// Should skip the gap, and keep the gap in timeline.
+	if source, err = NewNumberedFrameSource(pattern, 25, 90000, true); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	var frames []*Frame
+	for {
+		frame, err := source.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		frames = append(frames, frame)
+	}
+
+	if len(frames) != 4 || len(frames[0].Payloads) != 3 || !utilIsKeyframe(frames[0]) || len(frames[1].Payloads) != 1 {
+		t.Errorf("invalid frames %v", len(frames))
+		return
+	}
+	if !bytes.Equal(frames[0].Payloads[1], []byte{0x68, 0xee}) || !bytes.Equal(frames[2].Payloads[0], []byte{0x41, 0x9a, 0x03}) {
+		t.Errorf("invalid NALUs %v", frames[0].Payloads)
+	}
+	for i, dts := range []uint64{3600, 7200, 10800, 18000} {
+		if frames[i].DTS != dts {
+			t.Errorf("frame %v, dts %v, expect %v", i, frames[i].DTS, dts)
+		}
+	}
+}
+
+func TestPSVFRFrameSource(t *testing.T) {
+	for _, s := range []string{"", "0", "0\nabc", "0\n40\n40", "0\n-40"} {
+		if _, err := utilParseTimecodes(strings.NewReader(s), 90000); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+
+	durations, err := utilParseTimecodes(strings.NewReader("# timestamp format v2\n0\n33.367\n66.733\n100\n\n150\n"), 90000)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if expect := []uint64{3003, 3003, 2994, 4500, 4500}; !reflect.DeepEqual(durations, expect) {
+		t.Errorf("invalid durations %v, expect %v", durations, expect)
+	}
+
+	// The frames exceed the durations should use the last duration, and the composition offset of source is kept.
+	source := &psTestFrameSource{}
+	for i := 0; i < 6; i++ {
+		dts, pts := uint64(i*3600), uint64(i*3600)
+		if i == 1 {
+			pts += 7200
+		}
+		source.frames = append(source.frames, &Frame{Codec: FrameCodecH264, DTS: dts, PTS: pts, Payloads: [][]byte{{0x41}}})
+	}
+	vfr, err := NewVFRFrameSource(source, durations)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	for i, c := range []FrameTimestamp{{0, 0}, {3003, 10203}, {6006, 6006}, {9000, 9000}, {13500, 13500}, {18000, 18000}} {
+		frame, err := vfr.Next()
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if frame.DTS != c.DTS || frame.PTS != c.PTS || frame.Duration == 0 {
+			t.Errorf("frame %v, dts=%v, pts=%v, duration=%v, expect %v", i, frame.DTS, frame.PTS, frame.Duration, c)
+		}
+	}
+	if _, err := vfr.Next(); err != io.EOF {
+		t.Errorf("should be EOF, err %+v", err)
+	}
+
+	if _, err := NewVFRFrameSource(source, nil); err == nil {
+		t.Errorf("should fail for no durations")
+	}
+}
+
+func TestPSFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gb28181")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	name := path.Join(dir, "avatar.pcma")
+	if err := ioutil.WriteFile(name, []byte("hello"), 0644); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// Should open the file directly for nil cache.
+	var nilCache *FileCache
+	if f, err := nilCache.Open(name); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	} else {
+		f.Close()
+	}
+
+	// The file is loaded once, and each reader reads from the start.
+	files := NewFileCache()
+	for i := 0; i < 2; i++ {
+		f, err := files.Open(name)
+		if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		if b, err := ioutil.ReadAll(f); err != nil || string(b) != "hello" {
+			t.Errorf("invalid content %v, err %+v", string(b), err)
+			return
+		}
+		os.Remove(name)
+	}
+
+	if _, err := files.Open(path.Join(dir, "none.pcma")); err == nil {
+		t.Errorf("should fail for no file")
+	}
+}
+
+func TestPSSeekFrameSource(t *testing.T) {
+	// The keyframes are 0 and 5.
+	source := &psTestFrameSource{}
+	for i := 0; i < 10; i++ {
+		payloads := [][]byte{{0x41, 0x01}}
+		if i%5 == 0 {
+			payloads = [][]byte{{0x67, 0x01}, {0x68, 0x02}, {0x65, 0x03}}
+		}
+		source.frames = append(source.frames, &Frame{Codec: FrameCodecH264, DTS: uint64(i * 3600), Payloads: payloads})
+	}
+
+	v := NewSeekFrameSource(source)
+	if frame, err := v.Next(); err != nil || frame.DTS != 0 {
+		t.Errorf("invalid frame %v, err %+v", frame, err)
+		return
+	}
+	if dts, err := v.Seek(2*3600, true); err != nil || dts != 5*3600 {
+		t.Errorf("invalid seek %v, err %+v", dts, err)
+		return
+	}
+	if frame, err := v.Next(); err != nil || frame.DTS != 5*3600 {
+		t.Errorf("invalid frame %v, err %+v", frame, err)
+		return
+	}
+	if _, err := v.Seek(3*3600, false); err == nil {
+		t.Error("should fail for seek backward")
+		return
+	}
+	if dts, err := v.Seek(7*3600, false); err != nil || dts != 7*3600 {
+		t.Errorf("invalid seek %v, err %+v", dts, err)
+		return
+	}
+	if _, err := v.Seek(20*3600, true); err != io.EOF {
+		t.Errorf("should be EOF, err %+v", err)
+		return
+	}
+}
+
+func TestPSTimestampFrameSource(t *testing.T) {
+	// The GOP of I P B B in decode order at 30fps, the PTS is reordered.
+	timestamps, err := utilParseTimestamps(strings.NewReader("# dts pts\n0 33.333\n33.333 133.333\n"+
+		"66.667, 66.667\n100 100\n"), 90000)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if fmt.Sprint(timestamps) != "[{0 3000} {3000 12000} {6000 6000} {9000 9000}]" {
+		t.Errorf("invalid timestamps %v", timestamps)
+		return
+	}
+
+	for _, s := range []string{"0 33\n10 0\n", "0 0\n0 33\n", "0\n33\n", "0 x\n33 33\n"} {
+		if _, err := utilParseTimestamps(strings.NewReader(s), 90000); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+
+	video := &psTestFrameSource{}
+	for i := 0; i < 6; i++ {
+		video.frames = append(video.frames, &Frame{Codec: FrameCodecH264, Payloads: [][]byte{{0x41, 0x01}}})
+	}
+	source, err := NewTimestampFrameSource(video, timestamps)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	// The pattern is repeated with the offset of GOP duration.
+	var actual []string
+	for {
+		frame, err := source.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Errorf("err %+v", err)
+			return
+		}
+		actual = append(actual, fmt.Sprintf("%v/%v/%v", frame.DTS, frame.PTS, frame.Duration))
+	}
+	if expect := "[0/3000/3000 3000/12000/3000 6000/6000/3000 9000/9000/3000 12000/15000/3000 15000/24000/3000]"; fmt.Sprint(actual) != expect {
+		t.Errorf("invalid frames %v, expect %v", actual, expect)
+		return
+	}
+
+	// The video PES has the PTS of frame, and PTS should not be less than DTS.
+	pack := NewPSPackStream(96)
+	if err := pack.WriteAccessUnit([][]byte{{0x41, 0x01}}, 3000, 12000); err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	if p := pack.Packets()[0]; p.ts != 3000 || p.pts != 12000 {
+		t.Errorf("invalid packet dts=%v, pts=%v", p.ts, p.pts)
+		return
+	}
+	if err := pack.WriteAccessUnit([][]byte{{0x41, 0x01}}, 12000, 3000); err == nil {
+		t.Error("should fail for pts less than dts")
+	}
+}
+
+func TestPSDemuxTS(t *testing.T) {
+	var ts bytes.Buffer
+	muxer := mpeg2.NewTSMuxer()
+	muxer.OnPacket = func(pkg []byte) {
+		ts.Write(pkg)
+	}
+	videoPID, audioPID := muxer.AddStream(mpeg2.TS_STREAM_H264), muxer.AddStream(mpeg2.TS_STREAM_AAC)
+
+	// The B-frame at 80ms is presented before the P-frame at 40ms.
+	sps, pps := []byte{0x67, 0x42, 0x00, 0x1e}, []byte{0x68, 0xce, 0x3c, 0x80}
+	for _, c := range []struct {
+		dts, pts uint64
+		nalus    [][]byte
+	}{
+		{0, 80, [][]byte{sps, pps, {0x65, 0x88, 0x84}}},
+		{40, 160, [][]byte{{0x41, 0x9a, 0x02}}},
+		{80, 120, [][]byte{{0x01, 0x9e, 0x03}}},
+	} {
+		var b []byte
+		for _, nalu := range c.nalus {
+			b = append(append(b, 0, 0, 0, 1), nalu...)
+		}
+		if err := muxer.Write(videoPID, b, c.pts, c.dts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each audio PES contains two ADTS frames.
+	adts := psTestADTS(aac.SampleRateIndex44kHz, 16)
+	for _, dts := range []uint64{0, 46} {
+		if err := muxer.Write(audioPID, append(append([]byte{}, adts...), adts...), dts, dts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	video, audio, err := NewDemuxFrameSources(&ts, "avatar.ts", 90000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video == nil || audio == nil || video.codec != FrameCodecH264 {
+		t.Fatalf("invalid sources video=%v, audio=%v", video, audio)
+	}
+
+	for i, expect := range [][2]uint64{{0, 7200}, {3600, 14400}, {7200, 10800}} {
+		frame, err := video.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.DTS != expect[0] || frame.PTS != expect[1] || frame.Duration != 3600 {
+			t.Errorf("video %v invalid dts=%v, pts=%v, duration=%v", i, frame.DTS, frame.PTS, frame.Duration)
+		}
+		if i == 0 && (!utilIsKeyframe(frame) || !utilHasIDRSlice(frame)) {
+			t.Errorf("video %v not keyframe with SPS, %v NALUs", i, len(frame.Payloads))
+		}
+	}
+	if _, err := video.Next(); err != io.EOF {
+		t.Errorf("expect EOF, got %v", err)
+	}
+
+	if audio.SampleRate() != 44100 || audio.Frames() != 4 {
+		t.Errorf("invalid audio rate=%v, frames=%v", audio.SampleRate(), audio.Frames())
+	}
+	for i, dts := range []uint64{0, 2089, 4140, 6229} {
+		if frame, err := audio.Next(); err != nil {
+			t.Fatal(err)
+		} else if frame.DTS != dts || !bytes.Equal(frame.Payloads[0], adts) {
+			t.Errorf("audio %v invalid dts=%v, expect %v", i, frame.DTS, dts)
+		}
+	}
+}
+
+// Build the MP4 box of typ, with the payloads.
+func psTestMP4Box(typ string, payloads ...[]byte) []byte {
+	var b []byte
+	for _, payload := range payloads {
+		b = append(b, payload...)
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(8+len(b)))
+	copy(header[4:], typ)
+	return append(header, b...)
+}
+
+// Build the big endian 32 bits values.
+func psTestMP4Uint32s(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(b[i*4:], value)
+	}
+	return b
+}
+
+// Build the trak box with sample tables, all samples in one chunk at offset.
+
+func TestPSDemuxMP4(t *testing.T) {
+	sps, pps := []byte{0x67, 0x42, 0x00, 0x1e}, []byte{0x68, 0xce, 0x3c, 0x80}
+	videoSamples := [][]byte{{0x65, 0x88, 0x84}, {0x41, 0x9a, 0x02}, {0x01, 0x9e, 0x03}}
+	audioSamples := [][]byte{make([]byte, 10), make([]byte, 12)}
+
+	// The mdat follows the ftyp, and the samples are in order of video and audio.
+	ftyp := psTestMP4Box("ftyp", []byte("isom"), psTestMP4Uint32s(0x200))
+	var mdat []byte
+	var videoSizes, audioSizes []uint32
+	for _, sample := range videoSamples {
+		mdat = append(append(mdat, psTestMP4Uint32s(uint32(len(sample)))...), sample...)
+		videoSizes = append(videoSizes, uint32(4+len(sample)))
+	}
+	for _, sample := range audioSamples {
+		mdat = append(mdat, sample...)
+		audioSizes = append(audioSizes, uint32(len(sample)))
+	}
+	videoOffset := uint32(len(ftyp) + 8)
+	audioOffset := videoOffset + uint32(len(mdat)-len(audioSamples[0])-len(audioSamples[1]))
+
+	avcC := append([]byte{0x01, 0x42, 0x00, 0x1e, 0xff, 0xe1, 0x00, byte(len(sps))}, sps...)
+	avcC = append(append(avcC, 0x01, 0x00, byte(len(pps))), pps...)
+	avc1 := psTestMP4Box("avc1", make([]byte, 78), psTestMP4Box("avcC", avcC))
+
+	asc := []byte{0x12, 0x10} // AAC LC, 44.1kHz, stereo.
+	esds := append([]byte{0x05, byte(len(asc))}, asc...)
+	esds = append(append([]byte{0x04, byte(13 + len(esds)), 0x40, 0x15}, make([]byte, 11)...), esds...)
+	esds = append([]byte{0x03, byte(3 + len(esds)), 0x00, 0x01, 0x00}, esds...)
+	mp4a := psTestMP4Box("mp4a", make([]byte, 28), psTestMP4Box("esds", psTestMP4Uint32s(0), esds))
+
+	var file []byte
+	file = append(file, ftyp...)
+	file = append(file, psTestMP4Box("mdat", mdat)...)
+	file = append(file, psTestMP4Box("moov",
+		psTestMP4Track("vide", 1000, avc1, 40, []uint32{80, 120, 40}, videoSizes, videoOffset),
+		psTestMP4Track("soun", 44100, mp4a, 1024, nil, audioSizes, audioOffset),
+	)...)
+
+	video, audio, err := NewDemuxFrameSources(bytes.NewReader(file), "avatar.mp4", 90000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video == nil || audio == nil || video.Frames() != 3 || audio.Frames() != 2 {
+		t.Fatalf("invalid sources video=%v, audio=%v", video, audio)
+	}
+
+	for i, expect := range [][2]uint64{{0, 7200}, {3600, 14400}, {7200, 10800}} {
+		frame, err := video.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.DTS != expect[0] || frame.PTS != expect[1] || frame.Duration != 3600 {
+			t.Errorf("video %v invalid dts=%v, pts=%v, duration=%v", i, frame.DTS, frame.PTS, frame.Duration)
+		}
+
+		// The parameter sets in avcC are inserted before the keyframe.
+		expectNALUs := [][]byte{videoSamples[i]}
+		if i == 0 {
+			expectNALUs = [][]byte{sps, pps, videoSamples[i]}
+		}
+		if !reflect.DeepEqual(frame.Payloads, expectNALUs) {
+			t.Errorf("video %v invalid NALUs %x", i, frame.Payloads)
+		}
+	}
+
+	if audio.SampleRate() != 44100 || audio.AudioConfig().Channels != aac.ChannelStereo {
+		t.Errorf("invalid audio config %v", audio.AudioConfig())
+	}
+	for i, dts := range []uint64{0, 2089} {
+		frame, err := audio.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.DTS != dts || len(frame.Payloads[0]) != 7+len(audioSamples[i]) {
+			t.Errorf("audio %v invalid dts=%v, size=%v", i, frame.DTS, len(frame.Payloads[0]))
+		}
+		if _, err := utilParseADTS(frame.Payloads[0]); err != nil {
+			t.Errorf("audio %v not ADTS, %v", i, err)
+		}
+	}
+}
+
+func TestPSLoopFrameSource(t *testing.T) {
+	video, audio := &psTestFrameSource{}, &psTestFrameSource{}
+	for i := 0; i < 3; i++ {
+		video.frames = append(video.frames, &Frame{
+			Codec: FrameCodecH264, DTS: uint64(i * 3600), PTS: uint64(i*3600 + 3600), Payloads: [][]byte{{0x41, 0x01}},
+		})
+	}
+	for i := 0; i < 4; i++ {
+		audio.frames = append(audio.frames, &Frame{
+			Codec: FrameCodecAAC, DTS: uint64(i * 2089), PTS: uint64(i * 2089), Payloads: [][]byte{{0xff, 0xf1}},
+		})
+	}
+
+	// The period is the longest of video and audio, which is 3 video frames of 10800.
+	loops := NewLoopFrameSources(video, nil, audio)
+	if loops[1] != nil {
+		t.Errorf("should be nil")
+		return
+	}
+
+	read := func(source FrameSource, n int) (actual []string) {
+		for i := 0; i < n; i++ {
+			frame, err := source.Next()
+			if err != nil {
+				t.Errorf("err %+v", err)
+				return
+			}
+			actual = append(actual, fmt.Sprintf("%v/%v", frame.DTS, frame.PTS))
+		}
+		return
+	}
+
+	if actual := read(loops[0], 7); fmt.Sprint(actual) != "[0/3600 3600/7200 7200/10800 10800/14400 14400/18000 18000/21600 21600/25200]" {
+		t.Errorf("invalid video %v", actual)
+	}
+	if actual := read(loops[2], 9); fmt.Sprint(actual) != "[0/0 2089/2089 4178/4178 6267/6267 10800/10800 12889/12889 14978/14978 17067/17067 21600/21600]" {
+		t.Errorf("invalid audio %v", actual)
+	}
+	if loops[0].Loops() != 3 || loops[2].Loops() != 3 {
+		t.Errorf("invalid loops video=%v, audio=%v", loops[0].Loops(), loops[2].Loops())
+	}
+
+	// Never loop empty source, and fail if no period.
+	if _, err := NewLoopFrameSources(&psTestFrameSource{})[0].Next(); err != io.EOF {
+		t.Errorf("expect EOF, got %v", err)
+	}
+	single := &psTestFrameSource{frames: []*Frame{{Codec: FrameCodecH264, Payloads: [][]byte{{0x65}}}}}
+	source := NewLoopFrameSources(single)[0]
+	if _, err := source.Next(); err != nil {
+		t.Errorf("err %+v", err)
+	} else if _, err = source.Next(); err == nil {
+		t.Errorf("should fail for no period")
+	}
+
+	// Loop the real sources, the AAC source wraps the EOF.
+	ctx := logger.WithContext(context.Background())
+	fv, err := os.Open("../avatar.h264")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer fv.Close()
+	fa, err := os.Open("../avatar.aac")
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	defer fa.Close()
+
+	video2, err := NewH264FrameSource(ctx, fv, 25, 90000)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+	audio2, err := NewAACFrameSource(fa, 90000)
+	if err != nil {
+		t.Errorf("err %+v", err)
+		return
+	}
+
+	loops = NewLoopFrameSources(video2, audio2)
+	for _, source := range loops {
+		var dts uint64
+		for source.Loops() < 2 {
+			frame, err := source.Next()
+			if err != nil {
+				t.Errorf("err %+v", err)
+				return
+			}
+			if frame.DTS < dts {
+				t.Errorf("invalid dts %v < %v", frame.DTS, dts)
+				return
+			}
+			dts = frame.DTS
+		}
+	}
+}
+
+func TestPSDriftFrameSource(t *testing.T) {
+	for _, c := range []struct {
+		drift string
+		ppm   float64
+	}{
+		{"100ppm", 100}, {"-50ppm", -50}, {"6ms/min", 100}, {" -1.2ms/min ", -20},
+	} {
+		if ppm, err := utilParseDrift(c.drift); err != nil || ppm-c.ppm > 1e-9 || c.ppm-ppm > 1e-9 {
+			t.Errorf("invalid drift %v of %v, err %+v", ppm, c.drift, err)
+			return
+		}
+	}
+	for _, drift := range []string{"", "100", "xppm", "1000000ppm", "-60000ms/min"} {
+		if _, err := utilParseDrift(drift); err == nil {
+			t.Errorf("should fail for %v", drift)
+			return
+		}
+	}
+
+	// The audio from 1s at 50fps for 10 minutes, drifts 100ppm which is 6ms/min, relative to the first frame.
+	source := &psTestFrameSource{}
+	for i := 0; i < 50*600+1; i++ {
+		dts := uint64(90000 + i*1800)
+		source.frames = append(source.frames, &Frame{Codec: FrameCodecAAC, DTS: dts, PTS: dts + 10})
+	}
+
+	v := NewDriftFrameSource(source, 100)
+	var last *Frame
+	for i := 0; ; i++ {
+		frame, err := v.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil || frame.PTS-frame.DTS != 10 || (last != nil && frame.DTS <= last.DTS) || (i == 0 && frame.DTS != 90000) {
+			t.Errorf("invalid frame %v, err %+v", frame, err)
+			return
+		}
+		last = frame
+	}
+	if expect := uint64(90000 + 600*90000 + 60*90); last == nil || last.DTS != expect {
+		t.Errorf("invalid last %v, expect %v", last, expect)
+		return
+	}
+
+	// The negative drift makes the audio slower, but still increasing.
+	source = &psTestFrameSource{frames: []*Frame{{DTS: 0}, {DTS: 90000 * 60}}}
+	v = NewDriftFrameSource(source, -100)
+	if frame, err := v.Next(); err != nil || frame.DTS != 0 {
+		t.Errorf("invalid frame %v, err %+v", frame, err)
+		return
+	}
+	if frame, err := v.Next(); err != nil || frame.DTS != 90000*60-540 {
+		t.Errorf("invalid frame %v, err %+v", frame, err)
+	}
+}
@@ -0,0 +1,277 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2022 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package gb28181
+
+import (
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/yapingcat/gomedia/codec"
+	"github.com/yapingcat/gomedia/mpeg2"
+)
+
+// PSUnpackStream demuxes the PS stream from the payloads of RTP packets, to act as the platform and verify the PS
+// stream forwarded by server. It validates the stream strictly, fails if not a legal PS stream, for example, the PES
+// packet of stream not declared by PSM.
+type PSUnpackStream struct {
+	// The callbacks for each pack header, system header and PSM, ignore if nil.
+	OnPackHeader       func(pack *mpeg2.PSPackHeader) error
+	OnSystemHeader     func(system *mpeg2.System_header) error
+	OnProgramStreamMap func(psm *mpeg2.Program_stream_map) error
+	// The callback for each video access unit, which is reassembled from PES packets, or each AAC ADTS frame, or each
+	// PES of G.711 samples.
+	OnFrame func(frame *Frame) error
+	// The callback for the MPEG program end code.
+	OnEndOfStream func() error
+	// The bytes not parsed, waiting for more payloads.
+	buf []byte
+	// The offset of stream, in bytes.
+	offset int64
+	// The stream type of each stream ID, declared by PSM.
+	streams map[uint8]mpeg2.PS_STREAM_TYPE
+	// The video frame to reassemble, in ANNEXB.
+	video    []byte
+	videoDTS uint64
+	videoPTS uint64
+	videoID  uint8
+}
+
+func NewPSUnpackStream() *PSUnpackStream {
+	return &PSUnpackStream{streams: make(map[uint8]mpeg2.PS_STREAM_TYPE)}
+}
+
+// Write the payload of a RTP packet, the packets of PS might be split over RTP payloads.
+func (v *PSUnpackStream) Write(payload []byte) error {
+	v.buf = append(v.buf, payload...)
+
+	for len(v.buf) >= 4 {
+		if v.buf[0] != 0 || v.buf[1] != 0 || v.buf[2] != 1 {
+			return errors.Errorf("invalid start code %x at offset %v", v.buf[:4], v.offset)
+		}
+
+		size, err := v.packetSize(v.buf)
+		if err != nil {
+			return errors.Wrapf(err, "at offset %v", v.offset)
+		} else if size == 0 || len(v.buf) < size {
+			return nil // Wait for more data.
+		}
+
+		if err := v.decodePacket(v.buf[:size]); err != nil {
+			return errors.Wrapf(err, "decode 0x%x at offset %v", v.buf[3], v.offset)
+		}
+		v.buf, v.offset = v.buf[size:], v.offset+int64(size)
+	}
+
+	return nil
+}
+
+// Flush the last video frame, and fail if got incomplete packet.
+func (v *PSUnpackStream) Flush() error {
+	if len(v.buf) > 0 {
+		return errors.Errorf("incomplete packet %v bytes at offset %v", len(v.buf), v.offset)
+	}
+	return v.flushVideo()
+}
+
+// The size of packet, 0 if not enough data to know.
+func (v *PSUnpackStream) packetSize(b []byte) (int, error) {
+	switch id := b[3]; {
+	case id == 0xb9: // MPEG_program_end_code
+		return 4, nil
+	case id == 0xba: // pack_start_code
+		if len(b) < 14 {
+			return 0, nil
+		}
+		if b[4]&0xc0 != 0x40 {
+			return 0, errors.Errorf("not MPEG-2 pack header 0x%x", b[4])
+		}
+		return 14 + int(b[13]&0x07), nil
+	case id >= 0xbb: // The system header, PSM and PES, with 2 bytes length.
+		if len(b) < 6 {
+			return 0, nil
+		}
+		size := int(b[4])<<8 | int(b[5])
+		if size == 0 {
+			return 0, errors.Errorf("invalid zero length of 0x%x", id)
+		}
+		return 6 + size, nil
+	default:
+		return 0, errors.Errorf("invalid stream id 0x%x", id)
+	}
+}
+
+func (v *PSUnpackStream) decodePacket(b []byte) (err error) {
+	// The decoder of gomedia panics for some invalid data.
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("decode panic %v", r)
+		}
+	}()
+
+	bs := codec.NewBitStream(b)
+	switch id := b[3]; {
+	case id == 0xb9:
+		if err := v.flushVideo(); err != nil {
+			return err
+		}
+		if v.OnEndOfStream != nil {
+			return v.OnEndOfStream()
+		}
+	case id == 0xba:
+		pack := &mpeg2.PSPackHeader{}
+		if err := pack.Decode(bs); err != nil {
+			return errors.Wrapf(err, "pack header")
+		}
+		if v.OnPackHeader != nil {
+			return v.OnPackHeader(pack)
+		}
+	case id == 0xbb:
+		system := &mpeg2.System_header{}
+		if err := system.Decode(bs); err != nil {
+			return errors.Wrapf(err, "system header")
+		}
+		if v.OnSystemHeader != nil {
+			return v.OnSystemHeader(system)
+		}
+	case id == 0xbc:
+		psm := &mpeg2.Program_stream_map{}
+		if err := psm.Decode(bs); err != nil {
+			return errors.Wrapf(err, "psm")
+		}
+		for _, stream := range psm.Stream_map {
+			v.streams[stream.Elementary_stream_id] = mpeg2.PS_STREAM_TYPE(stream.Stream_type)
+		}
+		if v.OnProgramStreamMap != nil {
+			return v.OnProgramStreamMap(psm)
+		}
+	case id&0xe0 == 0xc0 || id&0xf0 == 0xe0:
+		pes := mpeg2.NewPesPacket()
+		if err := pes.Decode(bs); err != nil {
+			return errors.Wrapf(err, "pes")
+		}
+		return v.onPES(pes)
+	}
+	// Ignore other streams, such as private stream and padding stream.
+	return nil
+}
+
+func (v *PSUnpackStream) onPES(pes *mpeg2.PesPacket) error {
+	streamType, ok := v.streams[pes.Stream_id]
+	if !ok {
+		return errors.Errorf("stream 0x%x not in PSM", pes.Stream_id)
+	}
+
+	hasPTS := pes.PTS_DTS_flags&0x02 != 0
+	dts := pes.Pts
+	if pes.PTS_DTS_flags == 0x03 {
+		dts = pes.Dts
+	}
+
+	switch streamType {
+	case mpeg2.PS_STREAM_H264, mpeg2.PS_STREAM_H265:
+		// The PES with different PTS starts a new frame, or continues the frame if no PTS.
+		if hasPTS && len(v.video) > 0 && (pes.Pts != v.videoPTS || dts != v.videoDTS) {
+			if err := v.flushVideo(); err != nil {
+				return err
+			}
+		}
+		if len(v.video) == 0 {
+			if !hasPTS {
+				return errors.Errorf("no PTS for first PES of frame, stream 0x%x", pes.Stream_id)
+			}
+			v.videoDTS, v.videoPTS, v.videoID = dts, pes.Pts, pes.Stream_id
+		}
+		v.video = append(v.video, pes.Pes_payload...)
+	case mpeg2.PS_STREAM_AAC:
+		// The fragments of video frame are contiguous, so the audio ends the video frame.
+		if err := v.flushVideo(); err != nil {
+			return err
+		}
+		if !hasPTS {
+			return errors.Errorf("no PTS for audio, stream 0x%x", pes.Stream_id)
+		}
+		return v.onADTS(pes.Pes_payload, dts, pes.Pts)
+	case mpeg2.PS_STREAM_G711A, mpeg2.PS_STREAM_G711U:
+		if err := v.flushVideo(); err != nil {
+			return err
+		}
+		if !hasPTS {
+			return errors.Errorf("no PTS for audio, stream 0x%x", pes.Stream_id)
+		}
+
+		// The G.711 samples are carried as is, each PES is a frame.
+		payload := append([]byte{}, pes.Pes_payload...)
+		frame := &Frame{Codec: FrameCodecPCMA, DTS: dts, PTS: pes.Pts, Payloads: [][]byte{payload}}
+		if streamType == mpeg2.PS_STREAM_G711U {
+			frame.Codec = FrameCodecPCMU
+		}
+		if v.OnFrame != nil {
+			return v.OnFrame(frame)
+		}
+	default:
+		return errors.Errorf("unsupported stream type 0x%x of 0x%x", uint8(streamType), pes.Stream_id)
+	}
+	return nil
+}
+
+// Callback each ADTS frame in PES payload, which might contain multiple frames.
+func (v *PSUnpackStream) onADTS(b []byte, dts, pts uint64) error {
+	for len(b) > 0 {
+		if len(b) < 7 || b[0] != 0xff || b[1]&0xf0 != 0xf0 {
+			return errors.Errorf("invalid ADTS %v bytes", len(b))
+		}
+
+		size := int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5])>>5
+		if size < 7 || size > len(b) {
+			return errors.Errorf("invalid ADTS frame length %v, left %v", size, len(b))
+		}
+
+		if v.OnFrame != nil {
+			frame := &Frame{Codec: FrameCodecAAC, DTS: dts, PTS: pts, Payloads: [][]byte{append([]byte{}, b[:size]...)}}
+			if err := v.OnFrame(frame); err != nil {
+				return errors.Wrap(err, "callback")
+			}
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+// Callback the reassembled video frame, split to NALUs without start code.
+func (v *PSUnpackStream) flushVideo() error {
+	if len(v.video) == 0 {
+		return nil
+	}
+
+	annexb := v.video
+	v.video = nil
+
+	frame := &Frame{Codec: FrameCodecH264, DTS: v.videoDTS, PTS: v.videoPTS}
+	if v.streams[v.videoID] == mpeg2.PS_STREAM_H265 {
+		frame.Codec = FrameCodecH265
+	}
+	if frame.Payloads = utilSplitAnnexB(annexb); len(frame.Payloads) == 0 {
+		return errors.Errorf("no NALU in video %v bytes", len(annexb))
+	}
+
+	if v.OnFrame != nil {
+		return v.OnFrame(frame)
+	}
+	return nil
+}
@@ -23,6 +23,8 @@ package gb28181
 import (
 	"bufio"
 	"context"
+	"crypto/cipher"
+	"encoding/binary"
 	"flag"
 	"fmt"
 	"github.com/ghettovoice/gosip/sip"
@@ -30,11 +32,14 @@ import (
 	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/yapingcat/gomedia/mpeg2"
 	"io"
+	"math/rand"
 	"net"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -189,7 +194,7 @@ func (v *GBTestPublisher) Run(ctx context.Context) (err error) {
 		return errors.Wrap(err, "invite")
 	}
 
-	serverAddr, err := utilBuildMediaAddr(v.session.sip.conf.addr, v.session.out.mediaPort)
+	serverAddr, err := utilBuildMediaAddr(v.session.sip.conf.addr, v.session.out.mediaHost, v.session.out.mediaPort)
 	if err != nil {
 		return errors.Wrap(err, "parse")
 	}
@@ -259,6 +264,184 @@ func (v *wallClock) Tick(d time.Duration) time.Duration {
 	return 0
 }
 
+// The registry of SSRC for concurrent clients, because a collision corrupts the session demux of server and skews
+// the benchmark silently.
+type ssrcRegistry struct {
+	// The generator for new SSRC.
+	generator func() uint32
+	// The max retry to regenerate SSRC when collision.
+	maxRetry int
+	// The SSRC in use.
+	ssrcs map[uint32]bool
+	lock  sync.Mutex
+}
+
+var gSSRCRegistry = newSSRCRegistry(rand.Uint32)
+
+func newSSRCRegistry(generator func() uint32) *ssrcRegistry {
+	return &ssrcRegistry{generator: generator, maxRetry: 16, ssrcs: make(map[uint32]bool)}
+}
+
+// Add the SSRC specified by server or user, fail if collision.
+func (v *ssrcRegistry) Add(ssrc uint32) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.ssrcs[ssrc] {
+		return errors.Errorf("ssrc=%v collision", ssrc)
+	}
+	v.ssrcs[ssrc] = true
+	return nil
+}
+
+// Generate a new SSRC, regenerate it when collision.
+func (v *ssrcRegistry) Generate() (uint32, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for i := 0; i < v.maxRetry; i++ {
+		if ssrc := v.generator(); ssrc != 0 && !v.ssrcs[ssrc] {
+			v.ssrcs[ssrc] = true
+			return ssrc, nil
+		}
+	}
+	return 0, errors.Errorf("ssrc collision after %v retries", v.maxRetry)
+}
+
+func (v *ssrcRegistry) Remove(ssrc uint32) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	delete(v.ssrcs, ssrc)
+}
+
+// TickTo ticks the clock to the stream time t, and return the duration to wait.
+func (v *wallClock) TickTo(t time.Duration) time.Duration {
+	return v.Tick(t - v.duration)
+}
+
+// Rebase the clock to the stream time t at now, for example, after pause or seek, to avoid waiting or bursting.
+func (v *wallClock) Rebase(t time.Duration) {
+	v.start, v.duration = time.Now().Add(-t), t
+}
+
+// Parse the ADTS header of AAC frame, to get the object type(profile), sample rate and channels, see
+// ISO_IEC_13818-7-AAC-2004.pdf, @page 26, @section 6.2 Audio Data Transport Stream, ADTS.
+func utilParseADTS(b []byte) (*aac.AudioSpecificConfig, error) {
+	if len(b) < 7 {
+		return nil, errors.Errorf("requires 7 bytes, actual %v bytes", len(b))
+	}
+	if b[0] != 0xff || b[1]&0xf0 != 0xf0 {
+		return nil, errors.Errorf("invalid syncword %#x%x", b[0], b[1]>>4)
+	}
+
+	// The profile in ADTS is object type minus 1, 2bits.
+	asc := &aac.AudioSpecificConfig{
+		Object:     aac.Profile(b[2] >> 6).ToObjectType(),
+		SampleRate: aac.SampleRateIndex((b[2] >> 2) & 0x0f),
+		Channels:   aac.Channels((b[2]&0x01)<<2 | b[3]>>6),
+	}
+	if asc.SampleRate > aac.SampleRateIndex7kHz {
+		return nil, errors.Errorf("invalid sample rate index %v", uint8(asc.SampleRate))
+	}
+	return asc, nil
+}
+
+// Whether the video file is H.265 by the extension, .h265 or .hevc, otherwise H.264.
+func utilIsHEVCFile(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".h265" || ext == ".hevc"
+}
+
+// Parse the frame rate in num/den, for example, 30000/1001 for 29.97fps, or integer such as 25.
+func utilParseFrameRate(rate string) (num, den uint64, err error) {
+	den = 1
+	if ss := strings.SplitN(rate, "/", 2); len(ss) == 2 {
+		if den, err = strconv.ParseUint(ss[1], 10, 64); err != nil {
+			return 0, 0, errors.Wrapf(err, "parse den of %v", rate)
+		}
+		rate = ss[0]
+	}
+
+	if num, err = strconv.ParseUint(rate, 10, 64); err != nil {
+		return 0, 0, errors.Wrapf(err, "parse num of %v", rate)
+	}
+	if num == 0 || den == 0 {
+		return 0, 0, errors.Errorf("invalid rate %v/%v", num, den)
+	}
+	return num, den, nil
+}
+
+// Parse the clock rate of payload types, for example, 96=90000,97=44100.
+func utilParseClockRates(rates string) (map[uint8]uint64, error) {
+	r := make(map[uint8]uint64)
+	for _, s := range strings.Split(rates, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		ss := strings.SplitN(s, "=", 2)
+		if len(ss) != 2 {
+			return nil, errors.Errorf("invalid clock rate %v", s)
+		}
+
+		pt, err := strconv.ParseUint(ss[0], 10, 7)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse pt of %v", s)
+		}
+		rate, err := strconv.ParseUint(ss[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse rate of %v", s)
+		}
+		if rate == 0 {
+			return nil, errors.Errorf("invalid rate %v", s)
+		}
+		r[uint8(pt)] = rate
+	}
+	return r, nil
+}
+
+// Parse the clock drift in ppm like 100ppm, or in ms/min like 6ms/min which is 100ppm, return the drift in ppm. The
+// drift must be in (-1000000, 1000000), to keep the timestamps increasing.
+func utilParseDrift(drift string) (float64, error) {
+	s, scale := strings.TrimSpace(drift), float64(1)
+	if strings.HasSuffix(s, "ppm") {
+		s = strings.TrimSuffix(s, "ppm")
+	} else if strings.HasSuffix(s, "ms/min") {
+		s, scale = strings.TrimSuffix(s, "ms/min"), float64(1000000)/60000
+	} else {
+		return 0, errors.Errorf("invalid drift %v, should be ppm or ms/min", drift)
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse drift %v", drift)
+	}
+	if ppm := v * scale; ppm > -1000000 && ppm < 1000000 {
+		return ppm, nil
+	}
+	return 0, errors.Errorf("invalid drift %v, overflow", drift)
+}
+
+// Rescale the timestamp from clock rate from to clock rate to.
+func utilRescaleTimestamp(ts, from, to uint64) uint64 {
+	if from == to {
+		return ts
+	}
+	return ts * to / from
+}
+
+// Convert time to the 64 bits NTP timestamp, see RFC 3550 4.
+func utilToNTPTime(t time.Time) uint64 {
+	// The seconds between 1900 and 1970.
+	const ntpEpochOffset = 2208988800
+
+	nsec := uint64(t.UnixNano())
+	sec := nsec/uint64(time.Second) + ntpEpochOffset
+	frac := (nsec % uint64(time.Second)) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
 func sipGetCallID(m sip.Message) string {
 	if v, ok := m.CallID(); !ok {
 		return ""
@@ -267,18 +450,124 @@ func sipGetCallID(m sip.Message) string {
 	}
 }
 
-func utilBuildMediaAddr(addr string, mediaPort int64) (string, error) {
-	if u, err := url.Parse(addr); err != nil {
+// Get the expires of REGISTER response granted by server, or the default if no Expires header.
+func sipGetExpires(m sip.Message, def time.Duration) time.Duration {
+	for _, h := range m.GetHeaders("Expires") {
+		if v, err := strconv.ParseUint(strings.TrimSpace(h.Value()), 10, 32); err == nil {
+			return time.Duration(v) * time.Second
+		}
+	}
+	return def
+}
+
+// Find the local IP to server by route, IPv4 or IPv6 by the family of server.
+func utilLocalIP(serverAddr string) (net.IP, error) {
+	// Dial UDP sends nothing, but selects the local IP by route.
+	conn, err := net.Dial("udp", serverAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial %v", serverAddr)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Find the local UDP address to server, with a free port, to listen for SIP over UDP.
+func utilLocalUDPAddr(serverAddr string) (*net.UDPAddr, error) {
+	ip, err := utilLocalIP(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen %v", ip)
+	}
+	defer l.Close()
+
+	return &net.UDPAddr{IP: ip, Port: l.LocalAddr().(*net.UDPAddr).Port}, nil
+}
+
+// Build the media address from the host in SDP, or SIP server address if empty. The scheme is tcp, tcp4 or tcp6 even
+// for SIP over UDP or TLS, because the media transport is negotiated by SDP. The IPv6 host is in brackets.
+func utilBuildMediaAddr(addr, host string, mediaPort int64) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
 		return "", errors.Wrapf(err, "parse %v", addr)
-	} else if addr, err := net.ResolveTCPAddr(u.Scheme, u.Host); err != nil {
+	}
+
+	scheme := strings.Replace(strings.Replace(u.Scheme, "udp", "tcp", 1), "tls", "tcp", 1)
+	if host != "" {
+		// For dual-stack, the host in SDP might be the other family of SIP server.
+		if ip := net.ParseIP(host); ip != nil && scheme != "tcp" && (scheme == "tcp4") != (ip.To4() != nil) {
+			scheme = "tcp"
+		}
+		return fmt.Sprintf("%v://%v", scheme, net.JoinHostPort(host, fmt.Sprint(mediaPort))), nil
+	}
+
+	if addr, err := net.ResolveTCPAddr(scheme, u.Host); err != nil {
 		return "", errors.Wrapf(err, "parse %v scheme=%v, host=%v", addr, u.Scheme, u.Host)
 	} else {
-		return fmt.Sprintf("%v://%v:%v",
-			u.Scheme, addr.IP.String(), mediaPort,
+		return fmt.Sprintf("%v://%v",
+			scheme, net.JoinHostPort(addr.IP.String(), fmt.Sprint(mediaPort)),
 		), nil
 	}
 }
 
+// Offset the port of UDP address, for example, :9000 offset by 2 is :9002. The port 0 is kept, which is allocated by
+// the system.
+func utilOffsetPort(addr string, offset int) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse %v", addr)
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse port of %v", addr)
+	}
+	if n == 0 {
+		return addr, nil
+	}
+	if n += offset; n > 65535 {
+		return "", errors.Errorf("port %v overflow of %v offset %v", n, addr, offset)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n)), nil
+}
+
+// Suffix the file name by channel ID before the extension, for example, tee.ps of channel 1 is tee-1.ps.
+func utilChannelFile(name, channelID string) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%v-%v%v", strings.TrimSuffix(name, ext), channelID, ext)
+}
+
+// The host of IP in SIP URI and Via, the IPv6 address is in brackets, see RFC 3261 25.1.
+func utilSIPHost(ip string) string {
+	if strings.Contains(ip, ":") && !strings.HasPrefix(ip, "[") {
+		return "[" + ip + "]"
+	}
+	return ip
+}
+
+// The address type of IP in SDP o= and c= lines, IP6 for IPv6 or IP4, see RFC 4566 5.7.
+func utilSDPAddrType(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "IP6"
+	}
+	return "IP4"
+}
+
+// Encrypt or decrypt the payload of a frame by CTR mode, the IV is the 64 bits PTS and the stream ID of PES in big
+// endian, then zeros as the counter, so the receiver is able to decrypt each frame independently.
+func utilEncryptPES(block cipher.Block, payload []byte, pts uint64, streamID uint8) []byte {
+	iv := make([]byte, block.BlockSize())
+	binary.BigEndian.PutUint64(iv, pts)
+	iv[8] = streamID
+
+	b := make([]byte, len(payload))
+	cipher.NewCTR(block, iv).XORKeyStream(b, payload)
+	return b
+}
+
 // See SrsMpegPES::decode
 func utilUpdatePesPacketLength(pes *mpeg2.PesPacket) {
 	var nb_required int
@@ -315,6 +604,128 @@ func utilUpdatePesPacketLength(pes *mpeg2.PesPacket) {
 	pes.PES_packet_length = uint16(len(pes.Pes_payload)) + fixed + uint16(pes.PES_header_data_length)
 }
 
+// The UUID of SEI user data unregistered, which carries the wall clock in ms, see utilBuildSEITimestamp.
+var seiTimestampUUID = [16]byte{
+	0x73, 0x72, 0x73, 0x2d, 0x62, 0x65, 0x6e, 0x63, 0x68, 0x2d, 0x6c, 0x61, 0x74, 0x65, 0x6e, 0x63, // srs-bench-latenc
+}
+
+// Build the SEI payload of wall clock in ms, in big-endian.
+func utilBuildSEITimestamp(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()/int64(time.Millisecond)))
+	return b
+}
+
+// Build H.264 SEI NALU of user data unregistered(5), with emulation prevention.
+func utilBuildSEIUserData(uuid [16]byte, payload []byte) []byte {
+	return append([]byte{0x06}, utilEmulationPrevent(utilBuildSEIPayload(uuid, payload))...)
+}
+
+// Build H.265 prefix SEI NALU(39) of user data unregistered(5), with emulation prevention, see ITU-T H.265 7.3.5.
+func utilBuildHEVCSEIUserData(uuid [16]byte, payload []byte) []byte {
+	// The NALU header is forbidden_zero_bit(1), nal_unit_type(6), nuh_layer_id(6) and nuh_temporal_id_plus1(3).
+	return append([]byte{byte(NaluTypeSei) << 1, 0x01}, utilEmulationPrevent(utilBuildSEIPayload(uuid, payload))...)
+}
+
+// Build the RBSP of SEI message of user data unregistered(5), which is the same for H.264 and H.265.
+func utilBuildSEIPayload(uuid [16]byte, payload []byte) []byte {
+	var rbsp []byte
+
+	// The last_payload_type_byte and last_payload_size_byte, see ITU-T H.264 7.3.2.3.1.
+	writeValue := func(v int) {
+		for ; v >= 0xff; v -= 0xff {
+			rbsp = append(rbsp, 0xff)
+		}
+		rbsp = append(rbsp, uint8(v))
+	}
+	writeValue(5)
+	writeValue(len(uuid) + len(payload))
+
+	rbsp = append(rbsp, uuid[:]...)
+	rbsp = append(rbsp, payload...)
+	// The rbsp_trailing_bits.
+	return append(rbsp, 0x80)
+}
+
+// Parse the H.264 SEI NALU or H.265 prefix SEI NALU of user data unregistered(5), return the uuid and payload.
+func utilParseSEIUserData(nalu []byte) (uuid [16]byte, payload []byte, err error) {
+	var rbsp []byte
+	if len(nalu) > 0 && nalu[0]&0x1f == 6 {
+		rbsp = utilEmulationUnprevent(nalu[1:])
+	} else if len(nalu) > 1 && NalUnitType((nalu[0]&0x7e)>>1) == NaluTypeSei {
+		rbsp = utilEmulationUnprevent(nalu[2:])
+	} else {
+		return uuid, nil, errors.Errorf("not sei nalu %v bytes", len(nalu))
+	}
+
+	readValue := func() (int, error) {
+		var v int
+		for len(rbsp) > 0 {
+			b := rbsp[0]
+			rbsp = rbsp[1:]
+			if v += int(b); b != 0xff {
+				return v, nil
+			}
+		}
+		return v, errors.New("no value")
+	}
+
+	payloadType, err := readValue()
+	if err != nil {
+		return uuid, nil, errors.Wrap(err, "payload type")
+	}
+	payloadSize, err := readValue()
+	if err != nil {
+		return uuid, nil, errors.Wrap(err, "payload size")
+	}
+	if payloadType != 5 || payloadSize < len(uuid) || payloadSize > len(rbsp) {
+		return uuid, nil, errors.Errorf("invalid sei type=%v, size=%v, left=%v", payloadType, payloadSize, len(rbsp))
+	}
+
+	copy(uuid[:], rbsp[:len(uuid)])
+	return uuid, rbsp[len(uuid):payloadSize], nil
+}
+
+// Insert emulation_prevention_three_byte, see ITU-T H.264 7.4.1.
+func utilEmulationPrevent(rbsp []byte) []byte {
+	b := make([]byte, 0, len(rbsp)+len(rbsp)/2)
+	var zeros int
+	for _, v := range rbsp {
+		if zeros >= 2 && v <= 3 {
+			b = append(b, 0x03)
+			zeros = 0
+		}
+		b = append(b, v)
+
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return b
+}
+
+// Remove emulation_prevention_three_byte, see ITU-T H.264 7.4.1.
+func utilEmulationUnprevent(ebsp []byte) []byte {
+	b := make([]byte, 0, len(ebsp))
+	var zeros int
+	for _, v := range ebsp {
+		if zeros >= 2 && v == 0x03 {
+			zeros = 0
+			continue
+		}
+		b = append(b, v)
+
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return b
+}
+
 type AACReader struct {
 	codec aac.ADTS
 	r     *bufio.Reader
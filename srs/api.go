@@ -26,7 +26,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/logger"
@@ -87,6 +89,122 @@ func apiRequest(ctx context.Context, r string, req interface{}, res interface{})
 	return nil
 }
 
+// Whether r is a WHIP or WHEP endpoint, like "http://localhost:1985/rtc/v1/whip/?app=live&stream=livestream",
+// rather than a WebRTC url like "webrtc://localhost/live/livestream".
+func isWhipURL(r string) bool {
+	return strings.HasPrefix(r, "http://") || strings.HasPrefix(r, "https://")
+}
+
+// Request the WHIP or WHEP endpoint r by POST the offer SDP, with the token as Bearer if not empty.
+// Return the answer SDP and the url of session resource, which should be DELETE to teardown.
+// @see https://datatracker.ietf.org/doc/draft-ietf-wish-whip/
+// @see https://datatracker.ietf.org/doc/draft-murillo-whep/
+func apiWhipRequest(ctx context.Context, r, token, offer string) (string, string, error) {
+	logger.If(ctx, "Request whip url=%v with %v", r, escapeSDP(offer))
+	logger.Tf(ctx, "Request whip url=%v with %v bytes", r, len(offer))
+
+	req, err := http.NewRequest("POST", r, strings.NewReader(offer))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "HTTP request %v", r)
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Do HTTP request %v", r)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Read response of %v", r)
+	}
+
+	// Some servers, for example SRS before 5.0, response 200 rather than 201.
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return "", "", errors.Errorf("Server fail status=%v %v", res.StatusCode, string(b))
+	}
+
+	// The Location is the session resource, which might be relative to the endpoint.
+	var resource string
+	if location := res.Header.Get("Location"); location != "" {
+		base, err := url.Parse(r)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "Parse url %v", r)
+		}
+
+		u, err := base.Parse(location)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "Parse location %v", location)
+		}
+		resource = u.String()
+	}
+
+	answer := string(b)
+	logger.If(ctx, "Parse whip response to status=%v, resource=%v, sdp=%v",
+		res.StatusCode, resource, escapeSDP(answer))
+	logger.Tf(ctx, "Parse whip response to status=%v, resource=%v, sdp=%v bytes",
+		res.StatusCode, resource, len(answer))
+
+	return answer, resource, nil
+}
+
+// Teardown the WHIP or WHEP session by DELETE the resource, with the token as Bearer if not empty.
+func apiWhipDelete(ctx context.Context, resource, token string) error {
+	req, err := http.NewRequest("DELETE", resource, nil)
+	if err != nil {
+		return errors.Wrapf(err, "HTTP request %v", resource)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "Do HTTP request %v", resource)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("Server fail status=%v", res.StatusCode)
+	}
+	logger.Tf(ctx, "Delete whip resource=%v, status=%v", resource, res.StatusCode)
+
+	return nil
+}
+
+// Request the WHIP or WHEP endpoint if r is a http(s) url, otherwise the SRS RTC API by apiPath.
+// Return the answer SDP and a function to teardown the session, which is never nil.
+func apiSignalRequest(ctx context.Context, apiPath, r, token, offer string) (string, func(), error) {
+	if !isWhipURL(r) {
+		answer, err := apiRtcRequest(ctx, apiPath, r, offer)
+		return answer, func() {}, err
+	}
+
+	answer, resource, err := apiWhipRequest(ctx, r, token, offer)
+	if err != nil {
+		return "", func() {}, err
+	}
+
+	teardown := func() {
+		if resource == "" {
+			return
+		}
+
+		// The ctx is generally cancelled when teardown, so use a new one with the same cid.
+		ctx, cancel := context.WithTimeout(logger.AliasContext(context.Background(), ctx), 3*time.Second)
+		defer cancel()
+
+		if err := apiWhipDelete(ctx, resource, token); err != nil {
+			logger.Wf(ctx, "Delete whip resource=%v err %+v", resource, err)
+		}
+	}
+	return answer, teardown, nil
+}
+
 // The SRS HTTP statistic API.
 type statAPI struct {
 	ctx     context.Context
@@ -0,0 +1,697 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/yapingcat/gomedia/codec"
+)
+
+// The MIME type of AV1, which pion does not define.
+const mimeTypeAV1 = "video/AV1"
+
+// The AV1 codec, pion has no payloader for it, so we must register and packetize by ourselves.
+// @see https://aomediacodec.github.io/av1-rtp-spec/
+var av1Codec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType: mimeTypeAV1, ClockRate: 90000,
+		SDPFmtpLine: "level-idx=5;profile=0;tier=0",
+		RTCPFeedback: []webrtc.RTCPFeedback{
+			{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"},
+			{Type: "nack"}, {Type: "nack", Parameter: "pli"},
+		},
+	},
+	PayloadType: 45,
+}
+
+// The AV1 OBU types, @see https://aomediacodec.github.io/av1-spec/#obu-header-semantics
+const (
+	av1OBUTypeSequenceHeader    = 1
+	av1OBUTypeTemporalDelimiter = 2
+	av1OBUTypeTileList          = 8
+	av1OBUTypePadding           = 15
+)
+
+// The AV1 OBU, the header is 1 byte, or 2 bytes with extension, without the size field.
+type av1OBU struct {
+	Header  []byte
+	Payload []byte
+}
+
+func (v *av1OBU) Type() uint8 {
+	return (v.Header[0] >> 3) & 0x0f
+}
+
+// Marshal the OBU in low overhead bitstream format, with the obu_has_size_field.
+func (v *av1OBU) Marshal(b []byte) []byte {
+	b = append(b, v.Header[0]|0x02)
+	b = append(b, v.Header[1:]...)
+	b = appendLEB128(b, uint64(len(v.Payload)))
+	return append(b, v.Payload...)
+}
+
+// Marshal the OBU in RTP format, without the obu_has_size_field.
+func (v *av1OBU) MarshalRTP() []byte {
+	b := append([]byte{v.Header[0] &^ 0x02}, v.Header[1:]...)
+	return append(b, v.Payload...)
+}
+
+// The temporal delimiter, which starts each temporal unit in low overhead bitstream format.
+var av1TemporalDelimiter = &av1OBU{Header: []byte{av1OBUTypeTemporalDelimiter << 3}}
+
+func appendLEB128(b []byte, value uint64) []byte {
+	for {
+		if value < 0x80 {
+			return append(b, byte(value))
+		}
+		b = append(b, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+}
+
+// Read the LEB128 from b, return the value and number of bytes.
+func readLEB128(b []byte) (uint64, int, error) {
+	var value uint64
+	for i := 0; i < 8 && i < len(b); i++ {
+		value |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, errors.Errorf("invalid leb128 %v bytes", len(b))
+}
+
+// Parse the OBU from b, the OBU without size field uses all left bytes. Return the OBU and
+// number of bytes.
+func parseAV1OBU(b []byte) (*av1OBU, int, error) {
+	if len(b) < 1 {
+		return nil, 0, errors.New("empty obu")
+	}
+
+	headerSize := 1
+	if b[0]&0x04 != 0 {
+		headerSize = 2
+	}
+	if len(b) < headerSize {
+		return nil, 0, errors.Errorf("requires %v bytes header, actual %v", headerSize, len(b))
+	}
+
+	obu := &av1OBU{Header: append([]byte{b[0] &^ 0x02}, b[1:headerSize]...)}
+	if b[0]&0x02 == 0 {
+		obu.Payload = b[headerSize:]
+		return obu, len(b), nil
+	}
+
+	size, n, err := readLEB128(b[headerSize:])
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "read size")
+	}
+	if uint64(len(b)-headerSize-n) < size {
+		return nil, 0, errors.Errorf("requires %v bytes payload, actual %v", size, len(b)-headerSize-n)
+	}
+
+	obu.Payload = b[headerSize+n : headerSize+n+int(size)]
+	return obu, headerSize + n + int(size), nil
+}
+
+// Parse the OBUs in low overhead bitstream format.
+func parseAV1OBUs(b []byte) ([]*av1OBU, error) {
+	var obus []*av1OBU
+	for len(b) > 0 {
+		obu, n, err := parseAV1OBU(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse obu")
+		}
+
+		obus = append(obus, obu)
+		b = b[n:]
+	}
+	return obus, nil
+}
+
+// The fields of AV1 sequence header for AV1CodecConfigurationRecord, the level and tier are of the
+// first operating point. @see https://aomediacodec.github.io/av1-spec/#sequence-header-obu-syntax
+type av1SequenceHeader struct {
+	profile, level, tier                uint8
+	highBitdepth, twelveBit, monochrome uint8
+	subsamplingX, subsamplingY          uint8
+	chromaSamplePosition                uint8
+}
+
+// Parse the payload of sequence header OBU, until the color config.
+func parseAV1SequenceHeader(payload []byte) (h *av1SequenceHeader, err error) {
+	// The bitstream panics if overflow.
+	defer func() {
+		if r := recover(); r != nil {
+			h, err = nil, errors.Errorf("invalid sequence header %v bytes, %v", len(payload), r)
+		}
+	}()
+
+	bs := codec.NewBitStream(payload)
+	flag := func() bool {
+		return bs.GetBit() == 1
+	}
+	uvlc := func() {
+		var zeros int
+		for !flag() {
+			zeros++
+		}
+		if zeros < 32 {
+			bs.SkipBits(zeros)
+		}
+	}
+
+	h = &av1SequenceHeader{profile: bs.Uint8(3)}
+	bs.SkipBits(1) // still_picture
+	reduced := flag()
+
+	var decoderModel, initialDisplayDelay bool
+	var bufferDelayLength int
+	if reduced {
+		h.level = bs.Uint8(5)
+	} else {
+		if flag() { // timing_info_present_flag
+			bs.SkipBits(64) // num_units_in_display_tick, time_scale
+			if flag() {     // equal_picture_interval
+				uvlc()
+			}
+			if decoderModel = flag(); decoderModel {
+				bufferDelayLength = int(bs.Uint8(5)) + 1
+				bs.SkipBits(32 + 5 + 5)
+			}
+		}
+		initialDisplayDelay = flag()
+
+		points := int(bs.Uint8(5)) + 1
+		for i := 0; i < points; i++ {
+			bs.SkipBits(12) // operating_point_idc
+			level, tier := bs.Uint8(5), uint8(0)
+			if level > 7 {
+				tier = bs.GetBit()
+			}
+			if i == 0 {
+				h.level, h.tier = level, tier
+			}
+			if decoderModel && flag() {
+				bs.SkipBits(2*bufferDelayLength + 1)
+			}
+			if initialDisplayDelay && flag() {
+				bs.SkipBits(4)
+			}
+		}
+	}
+
+	widthBits, heightBits := int(bs.Uint8(4))+1, int(bs.Uint8(4))+1
+	bs.SkipBits(widthBits + heightBits)
+	if !reduced && flag() { // frame_id_numbers_present_flag
+		bs.SkipBits(7)
+	}
+	bs.SkipBits(3) // use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+	if !reduced {
+		bs.SkipBits(4) // enable_interintra_compound, enable_masked_compound, enable_warped_motion, enable_dual_filter
+		orderHint := flag()
+		if orderHint {
+			bs.SkipBits(2) // enable_jnt_comp, enable_ref_frame_mvs
+		}
+		if flag() || flag() { // seq_choose_screen_content_tools, seq_force_screen_content_tools
+			if !flag() { // seq_choose_integer_mv
+				bs.SkipBits(1) // seq_force_integer_mv
+			}
+		}
+		if orderHint {
+			bs.SkipBits(3)
+		}
+	}
+	bs.SkipBits(3) // enable_superres, enable_cdef, enable_restoration
+
+	// The color config, @see https://aomediacodec.github.io/av1-spec/#color-config-syntax
+	h.highBitdepth = bs.GetBit()
+	if h.profile == 2 && h.highBitdepth == 1 {
+		h.twelveBit = bs.GetBit()
+	}
+	if h.profile != 1 {
+		h.monochrome = bs.GetBit()
+	}
+
+	primaries, transfer, matrix := uint8(2), uint8(2), uint8(2)
+	if flag() { // color_description_present_flag
+		primaries, transfer, matrix = bs.Uint8(8), bs.Uint8(8), bs.Uint8(8)
+	}
+
+	if h.monochrome == 1 {
+		h.subsamplingX, h.subsamplingY = 1, 1
+		return h, nil
+	}
+	// The sRGB, that is BT.709, sRGB transfer and identity matrix, is 4:4:4.
+	if primaries == 1 && transfer == 13 && matrix == 0 {
+		return h, nil
+	}
+
+	bs.SkipBits(1) // color_range
+	switch {
+	case h.profile == 0:
+		h.subsamplingX, h.subsamplingY = 1, 1
+	case h.profile == 2 && h.twelveBit == 1:
+		if h.subsamplingX = bs.GetBit(); h.subsamplingX == 1 {
+			h.subsamplingY = bs.GetBit()
+		}
+	case h.profile == 2:
+		h.subsamplingX = 1
+	}
+	if h.subsamplingX == 1 && h.subsamplingY == 1 {
+		h.chromaSamplePosition = bs.Uint8(2)
+	}
+	return h, nil
+}
+
+// Generate the AV1CodecConfigurationRecord, with the sequence header OBU as configOBUs.
+// @see https://aomediacodec.github.io/av1-isobmff/#av1codecconfigurationbox-syntax
+func av1CodecConfigurationRecord(sequenceHeader *av1OBU) ([]byte, error) {
+	h, err := parseAV1SequenceHeader(sequenceHeader.Payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse sequence header")
+	}
+
+	b := []byte{
+		0x81, h.profile<<5 | h.level,
+		h.tier<<7 | h.highBitdepth<<6 | h.twelveBit<<5 | h.monochrome<<4 |
+			h.subsamplingX<<3 | h.subsamplingY<<2 | h.chromaSamplePosition,
+		0,
+	}
+	return sequenceHeader.Marshal(b), nil
+}
+
+// The reader for AV1 source, the .ivf with AV01 fourcc, or the .obu in low overhead bitstream
+// format, which each frame is a temporal unit.
+type av1Reader struct {
+	r   *bufio.Reader
+	ivf bool
+	// The temporal delimiter of next temporal unit, read ahead for .obu.
+	next *av1OBU
+}
+
+func newAV1Reader(r io.Reader, ivf bool) (*av1Reader, error) {
+	v := &av1Reader{r: bufio.NewReader(r), ivf: ivf}
+	if !ivf {
+		return v, nil
+	}
+
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(v.r, header); err != nil {
+		return nil, errors.Wrapf(err, "read ivf header")
+	}
+	if string(header[:4]) != "DKIF" {
+		return nil, errors.Errorf("invalid ivf signature %v", string(header[:4]))
+	}
+	if fourcc := string(header[8:12]); fourcc != "AV01" {
+		return nil, errors.Errorf("invalid ivf fourcc %v", fourcc)
+	}
+
+	// Skip the extra header if any.
+	if size := int(binary.LittleEndian.Uint16(header[6:])); size > len(header) {
+		if _, err := v.r.Discard(size - len(header)); err != nil {
+			return nil, errors.Wrapf(err, "skip %v bytes header", size-len(header))
+		}
+	}
+	return v, nil
+}
+
+// Read the OBUs of next temporal unit, return io.EOF when done.
+func (v *av1Reader) NextTemporalUnit() ([]*av1OBU, error) {
+	if v.ivf {
+		header := make([]byte, 12)
+		if _, err := io.ReadFull(v.r, header); err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+
+		frame := make([]byte, binary.LittleEndian.Uint32(header))
+		if _, err := io.ReadFull(v.r, frame); err != nil {
+			return nil, errors.Wrapf(err, "read %v bytes frame", len(frame))
+		}
+		return parseAV1OBUs(frame)
+	}
+
+	var tu []*av1OBU
+	if v.next != nil {
+		tu, v.next = append(tu, v.next), nil
+	}
+
+	for {
+		obu, err := v.nextOBU()
+		if err == io.EOF && len(tu) > 0 {
+			return tu, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if obu.Type() == av1OBUTypeTemporalDelimiter && len(tu) > 0 {
+			v.next = obu
+			return tu, nil
+		}
+		tu = append(tu, obu)
+	}
+}
+
+// Read an OBU from .obu, which must have size field.
+func (v *av1Reader) nextOBU() (*av1OBU, error) {
+	b0, err := v.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if b0&0x02 == 0 {
+		return nil, errors.Errorf("no size field, header=%#x", b0)
+	}
+
+	header := []byte{b0 &^ 0x02}
+	if b0&0x04 != 0 {
+		b1, err := v.r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read extension")
+		}
+		header = append(header, b1)
+	}
+
+	var size uint64
+	for i := 0; ; i++ {
+		b, err := v.r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read size")
+		}
+		if i >= 8 {
+			return nil, errors.New("invalid leb128")
+		}
+
+		size |= uint64(b&0x7f) << (7 * uint(i))
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(v.r, payload); err != nil {
+		return nil, errors.Wrapf(err, "read %v bytes payload", size)
+	}
+	return &av1OBU{Header: header, Payload: payload}, nil
+}
+
+// The AV1 payloader, the payload must be a temporal unit in low overhead bitstream format,
+// which is packetized to OBU elements with size, fragmented if exceed the MTU.
+// @see https://aomediacodec.github.io/av1-rtp-spec/#45-payload-structure
+type av1Payloader struct{}
+
+func (v *av1Payloader) Payload(mtu int, payload []byte) [][]byte {
+	obus, err := parseAV1OBUs(payload)
+	if err != nil || mtu <= 3 {
+		return nil
+	}
+
+	// The N is set for the first packet of a coded video sequence, that is the sequence header.
+	var newSequence bool
+	for _, obu := range obus {
+		newSequence = newSequence || obu.Type() == av1OBUTypeSequenceHeader
+	}
+
+	// The aggregation header is Z|Y|W|N, the W is always 0 for each element has size.
+	var payloads [][]byte
+	var continued bool
+	b := []byte{0}
+	flush := func(fragmented bool) {
+		if continued {
+			b[0] |= 0x80
+		}
+		if fragmented {
+			b[0] |= 0x40
+		}
+		if newSequence && len(payloads) == 0 {
+			b[0] |= 0x08
+		}
+
+		payloads = append(payloads, b)
+		b, continued = []byte{0}, fragmented
+	}
+
+	for _, obu := range obus {
+		// The temporal delimiter and tile list should be removed, and padding is useless.
+		if t := obu.Type(); t == av1OBUTypeTemporalDelimiter || t == av1OBUTypeTileList || t == av1OBUTypePadding {
+			continue
+		}
+
+		for data := obu.MarshalRTP(); len(data) > 0; {
+			// Each element requires at least 1 byte size and 1 byte data.
+			room := mtu - len(b)
+			if room < 2 {
+				flush(false)
+				room = mtu - len(b)
+			}
+
+			n := len(data)
+			for len(appendLEB128(nil, uint64(n)))+n > room {
+				n--
+			}
+
+			b = appendLEB128(b, uint64(n))
+			b = append(b, data[:n]...)
+			if data = data[n:]; len(data) > 0 {
+				flush(true)
+			}
+		}
+	}
+
+	if len(b) > 1 {
+		flush(false)
+	}
+	return payloads
+}
+
+// The AV1 depacketizer, to restore the OBUs from the OBU elements, which might be fragmented.
+type av1Depacketizer struct {
+	// The OBU in fragmentation, nil if not started or dropped.
+	fragment []byte
+}
+
+// Unmarshal the RTP payload, return the OBUs without size field, might be empty if fragmented.
+func (v *av1Depacketizer) Unmarshal(payload []byte) ([]*av1OBU, error) {
+	if len(payload) < 2 {
+		return nil, errors.Errorf("requires 2+ bytes, actual %v", len(payload))
+	}
+
+	aggregation := payload[0]
+	continued, fragmented, w := aggregation&0x80 != 0, aggregation&0x40 != 0, int(aggregation>>4)&0x03
+
+	// Parse the elements, all with size if W is 0, otherwise the last one without size.
+	var elements [][]byte
+	for b, i := payload[1:], 0; len(b) > 0; i++ {
+		size, n := uint64(len(b)), 0
+		if w == 0 || i < w-1 {
+			var err error
+			if size, n, err = readLEB128(b); err != nil {
+				return nil, errors.Wrapf(err, "read element size")
+			}
+			if uint64(len(b)-n) < size {
+				return nil, errors.Errorf("requires %v bytes element, actual %v", size, len(b)-n)
+			}
+		}
+
+		elements = append(elements, b[n:n+int(size)])
+		b = b[n+int(size):]
+	}
+
+	var obus []*av1OBU
+	for i, element := range elements {
+		if i == 0 && continued {
+			// Drop the fragments if lost the start one.
+			if v.fragment == nil {
+				continue
+			}
+			element, v.fragment = append(v.fragment, element...), nil
+		} else if i == 0 {
+			v.fragment = nil
+		}
+
+		if i == len(elements)-1 && fragmented {
+			v.fragment = append([]byte{}, element...)
+			continue
+		}
+
+		if len(element) == 0 {
+			continue
+		}
+		obu, _, err := parseAV1OBU(element)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse obu")
+		}
+		obus = append(obus, obu)
+	}
+	return obus, nil
+}
+
+// The AV1 writer, to dump the RTP packets to .ivf or .obu file, like h264writer of pion.
+type av1Writer struct {
+	w            io.WriteCloser
+	ivf          bool
+	depacketizer av1Depacketizer
+	// The OBUs of current temporal unit, which ends by the marker.
+	obus        []*av1OBU
+	hasKeyFrame bool
+	// The timestamp of first temporal unit, for the pts of ivf.
+	startTS uint32
+}
+
+func newAV1Writer(filename string) (*av1Writer, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %v", filename)
+	}
+
+	v := &av1Writer{w: f, ivf: strings.HasSuffix(filename, ".ivf")}
+	if !v.ivf {
+		return v, nil
+	}
+
+	// The timebase is 1/90000, same as RTP, the size is unknown.
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], "AV01")
+	binary.LittleEndian.PutUint16(header[12:], 640)
+	binary.LittleEndian.PutUint16(header[14:], 480)
+	binary.LittleEndian.PutUint32(header[16:], 90000)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "write ivf header")
+	}
+	return v, nil
+}
+
+func (v *av1Writer) WriteRTP(p *rtp.Packet) error {
+	obus, err := v.depacketizer.Unmarshal(p.Payload)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshal %v bytes", len(p.Payload))
+	}
+
+	v.obus = append(v.obus, obus...)
+	if !p.Marker {
+		return nil
+	}
+
+	obus, v.obus = v.obus, nil
+
+	// Start to write from the sequence header, like h264writer.
+	if !v.hasKeyFrame {
+		for _, obu := range obus {
+			v.hasKeyFrame = v.hasKeyFrame || obu.Type() == av1OBUTypeSequenceHeader
+		}
+		if !v.hasKeyFrame {
+			return nil
+		}
+		v.startTS = p.Timestamp
+	}
+
+	tu := av1TemporalDelimiter.Marshal(nil)
+	for _, obu := range obus {
+		tu = obu.Marshal(tu)
+	}
+
+	if v.ivf {
+		header := make([]byte, 12)
+		binary.LittleEndian.PutUint32(header, uint32(len(tu)))
+		binary.LittleEndian.PutUint64(header[4:], uint64(p.Timestamp-v.startTS))
+		if _, err := v.w.Write(header); err != nil {
+			return errors.Wrapf(err, "write frame header")
+		}
+	}
+
+	if _, err := v.w.Write(tu); err != nil {
+		return errors.Wrapf(err, "write %v bytes", len(tu))
+	}
+	return nil
+}
+
+func (v *av1Writer) Close() error {
+	return v.w.Close()
+}
+
+// Ingest the AV1 source file, packetize and write RTP to the track, return io.EOF when done.
+func (v *videoIngester) ingestAV1(ctx context.Context, source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return errors.Wrapf(err, "Open file %v", source)
+	}
+	defer f.Close()
+
+	av1, err := newAV1Reader(f, strings.HasSuffix(source, ".ivf"))
+	if err != nil {
+		return errors.Wrapf(err, "Open av1 %v", source)
+	}
+
+	// Keep the packetizer for the sequence number and timestamp to be continuous when restart.
+	if v.packetizer == nil {
+		enc := v.sVideoSender.GetParameters().Encodings[0]
+		v.packetizer = rtp.NewPacketizer(
+			rtpOutboundMTU, uint8(enc.PayloadType), uint32(enc.SSRC), &av1Payloader{}, rtp.NewRandomSequencer(), 90000,
+		)
+	}
+
+	clock := newWallClock()
+	sampleDuration := time.Duration(uint64(time.Millisecond) * 1000 / uint64(v.fps))
+	for ctx.Err() == nil {
+		obus, err := av1.NextTemporalUnit()
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Read av1")
+		}
+
+		var tu []byte
+		for _, obu := range obus {
+			tu = obu.Marshal(tu)
+		}
+		logger.If(ctx, "Temporal unit %v obus, %v bytes", len(obus), len(tu))
+
+		for _, p := range v.packetizer.Packetize(tu, uint32(sampleDuration.Seconds()*90000)) {
+			if err = v.sVideoTrackRTP.WriteRTP(p); err != nil {
+				return errors.Wrapf(err, "Write RTP")
+			}
+		}
+
+		if d := clock.Tick(sampleDuration); d > 0 {
+			time.Sleep(d)
+		}
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,103 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"fmt"
+	"time"
+)
+
+// The controller of video bitrate, to ramp or oscillate the bitrate of the pre-encoded source by
+// dropping frames, to test the bandwidth adaptation and remux of server under varying input.
+// @remark The keyframe is never dropped, so the bitrate might exceed the target for large GOP.
+type bitrateController struct {
+	// The bitrate in kbps, ramp from the from to the to, or oscillate between them.
+	from, to int
+	// The duration to ramp linearly from the from to the to, then hold the to.
+	ramp time.Duration
+	// The period of triangle wave, ramp up from the from to the to, then ramp down.
+	wave time.Duration
+	// The media time since start, by the duration of frames.
+	elapsed time.Duration
+	// The token bucket in bytes, might be negative after sending a frame, then drop frames until
+	// it's refilled, so the average bitrate of GOPs follows the target.
+	budget float64
+	// Whether the bucket is initialized, full at start.
+	started bool
+	// Whether drop frames until keyframe, because a reference frame is dropped.
+	waitKeyframe bool
+	// The number of frames sent and dropped.
+	sent, dropped uint64
+}
+
+func newBitrateController(from, to int, ramp, wave time.Duration) *bitrateController {
+	if from <= 0 {
+		from = to
+	}
+	return &bitrateController{from: from, to: to, ramp: ramp, wave: wave}
+}
+
+// Get the target bitrate in kbps, at the media time.
+func (v *bitrateController) Target(elapsed time.Duration) int {
+	progress := 1.0
+	if v.wave > 0 {
+		phase := float64(elapsed%v.wave) / float64(v.wave)
+		if progress = phase * 2; phase > 0.5 {
+			progress = (1 - phase) * 2
+		}
+	} else if v.ramp > 0 && elapsed < v.ramp {
+		progress = float64(elapsed) / float64(v.ramp)
+	}
+	return v.from + int(float64(v.to-v.from)*progress)
+}
+
+// Whether send the frame of size in bytes and duration, the keyframe is always sent, and drop the
+// frames until next keyframe if a reference frame is dropped, to keep the stream decodable.
+func (v *bitrateController) Allow(size int, duration time.Duration, keyframe, reference bool) bool {
+	target := v.Target(v.elapsed)
+	v.elapsed += duration
+
+	// Fill the bucket by target, and allow burst of at most 1s.
+	bytesPerSecond := float64(target) * 1000 / 8
+	if !v.started {
+		v.budget, v.started = bytesPerSecond, true
+	}
+	if v.budget += bytesPerSecond * duration.Seconds(); v.budget > bytesPerSecond {
+		v.budget = bytesPerSecond
+	}
+
+	if keyframe {
+		v.waitKeyframe = false
+	} else if v.waitKeyframe || v.budget < 0 {
+		v.waitKeyframe = v.waitKeyframe || reference
+		v.dropped++
+		return false
+	}
+
+	v.budget -= float64(size)
+	v.sent++
+	return true
+}
+
+func (v *bitrateController) String() string {
+	return fmt.Sprintf("target=%vkbps, from=%v, to=%v, ramp=%v, wave=%v, sent=%v, dropped=%v",
+		v.Target(v.elapsed), v.from, v.to, v.ramp, v.wave, v.sent, v.dropped)
+}
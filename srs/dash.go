@@ -0,0 +1,880 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// Whether the url is DASH, like "http://localhost:8080/live/livestream.mpd", to play by DASH rather
+// than WHEP or HTTP-FLV.
+func isDASHURL(r string) bool {
+	if !strings.HasPrefix(r, "http://") && !strings.HasPrefix(r, "https://") {
+		return false
+	}
+
+	u, err := url.Parse(r)
+	return err == nil && strings.HasSuffix(u.Path, ".mpd")
+}
+
+// The MPD of DASH in XML, only the SegmentTemplate is supported, which is used by SRS and most live
+// streams, either by SegmentTimeline or by the duration of segment.
+// @see https://dashif.org/docs/DASH-IF-IOP-v4.3.pdf
+type dashMPDXML struct {
+	XMLName                    xml.Name         `xml:"MPD"`
+	Type                       string           `xml:"type,attr"`
+	AvailabilityStartTime      string           `xml:"availabilityStartTime,attr"`
+	MediaPresentationDuration  string           `xml:"mediaPresentationDuration,attr"`
+	MinimumUpdatePeriod        string           `xml:"minimumUpdatePeriod,attr"`
+	TimeShiftBufferDepth       string           `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string           `xml:"suggestedPresentationDelay,attr"`
+	MaxSegmentDuration         string           `xml:"maxSegmentDuration,attr"`
+	BaseURL                    string           `xml:"BaseURL"`
+	Periods                    []*dashPeriodXML `xml:"Period"`
+}
+
+type dashPeriodXML struct {
+	ID             string                  `xml:"id,attr"`
+	Start          string                  `xml:"start,attr"`
+	BaseURL        string                  `xml:"BaseURL"`
+	AdaptationSets []*dashAdaptationSetXML `xml:"AdaptationSet"`
+}
+
+type dashAdaptationSetXML struct {
+	ContentType     string                   `xml:"contentType,attr"`
+	MimeType        string                   `xml:"mimeType,attr"`
+	BaseURL         string                   `xml:"BaseURL"`
+	SegmentTemplate *dashSegmentTemplateXML  `xml:"SegmentTemplate"`
+	Representations []*dashRepresentationXML `xml:"Representation"`
+}
+
+type dashRepresentationXML struct {
+	ID              string                  `xml:"id,attr"`
+	Bandwidth       int                     `xml:"bandwidth,attr"`
+	MimeType        string                  `xml:"mimeType,attr"`
+	BaseURL         string                  `xml:"BaseURL"`
+	SegmentTemplate *dashSegmentTemplateXML `xml:"SegmentTemplate"`
+}
+
+type dashSegmentTemplateXML struct {
+	Timescale              uint64  `xml:"timescale,attr"`
+	Duration               uint64  `xml:"duration,attr"`
+	StartNumber            *uint64 `xml:"startNumber,attr"`
+	PresentationTimeOffset uint64  `xml:"presentationTimeOffset,attr"`
+	AvailabilityTimeOffset string  `xml:"availabilityTimeOffset,attr"`
+	Initialization         string  `xml:"initialization,attr"`
+	Media                  string  `xml:"media,attr"`
+	SegmentTimeline        *struct {
+		S []struct {
+			T *uint64 `xml:"t,attr"`
+			D uint64  `xml:"d,attr"`
+			R int     `xml:"r,attr"`
+		} `xml:"S"`
+	} `xml:"SegmentTimeline"`
+}
+
+// The segment of DASH, the time and duration are in timescale of representation.
+type dashSegment struct {
+	number   uint64
+	time     uint64
+	duration uint64
+}
+
+// The representation to play, the highest bandwidth of each adaptation set. The segments are listed
+// by the timeline, or generated by the duration of segment if no timeline.
+type dashRepresentation struct {
+	id          string
+	contentType string
+	bandwidth   int
+	// The base url and templates of initialization and media segments.
+	base                  *url.URL
+	initialization, media string
+	// The timescale and times of SegmentTemplate, and the availability time offset is in seconds, which
+	// might be +Inf for a segment available once it starts.
+	timescale, startNumber, presentationTimeOffset, duration uint64
+	availabilityTimeOffset                                   float64
+	timeline                                                 []*dashSegment
+}
+
+// The url of the segment, or initialization if s is nil.
+func (v *dashRepresentation) URL(s *dashSegment) (*url.URL, error) {
+	tmpl, number, t := v.initialization, uint64(0), uint64(0)
+	if s != nil {
+		tmpl, number, t = v.media, s.number, s.time
+	}
+
+	uri := expandDASHTemplate(tmpl, v.id, v.bandwidth, number, t)
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %v", uri)
+	}
+	return v.base.ResolveReference(ref), nil
+}
+
+// Convert the time in timescale to duration.
+func (v *dashRepresentation) toDuration(t int64) time.Duration {
+	return time.Duration(float64(t) / float64(v.timescale) * float64(time.Second))
+}
+
+// The end of segment in wall clock, to calculate the latency.
+func (v *dashRepresentation) End(m *dashManifest, s *dashSegment) time.Time {
+	t := int64(s.time) - int64(v.presentationTimeOffset) + int64(s.duration)
+	return m.availabilityStartTime.Add(m.periodStart + v.toDuration(t))
+}
+
+// The time when the segment is available, which is availabilityTimeOffset earlier than its end. If
+// the offset is +Inf, the segment is available once it starts.
+// @see https://dashif.org/docs/DASH-IF-IOP-v4.3.pdf#section.4.3
+func (v *dashRepresentation) AvailableAt(m *dashManifest, s *dashSegment) time.Time {
+	if math.IsInf(v.availabilityTimeOffset, 1) {
+		return v.End(m, s).Add(-v.toDuration(int64(s.duration)))
+	}
+	return v.End(m, s).Add(-time.Duration(v.availabilityTimeOffset * float64(time.Second)))
+}
+
+// The segments available now, which are in the time shift buffer for live, or 60s if no buffer depth.
+func (v *dashRepresentation) Segments(m *dashManifest, now time.Time) []*dashSegment {
+	if v.timeline != nil {
+		if !m.dynamic {
+			return v.timeline
+		}
+
+		var segments []*dashSegment
+		for _, s := range v.timeline {
+			if !v.AvailableAt(m, s).After(now) {
+				segments = append(segments, s)
+			}
+		}
+		return segments
+	}
+
+	var first, last int64
+	if !m.dynamic {
+		last = int64(math.Ceil(m.mediaPresentationDuration.Seconds()*float64(v.timescale)/float64(v.duration))) - 1
+	} else {
+		elapsed := now.Sub(m.availabilityStartTime.Add(m.periodStart))
+		if !math.IsInf(v.availabilityTimeOffset, 1) {
+			elapsed += time.Duration(v.availabilityTimeOffset * float64(time.Second))
+		} else {
+			elapsed += v.toDuration(int64(v.duration))
+		}
+		last = int64(elapsed.Seconds()*float64(v.timescale)/float64(v.duration)) - 1
+
+		depth := m.timeShiftBufferDepth
+		if depth <= 0 {
+			depth = 60 * time.Second
+		}
+		if first = last - int64(depth.Seconds()*float64(v.timescale)/float64(v.duration)); first < 0 {
+			first = 0
+		}
+	}
+
+	var segments []*dashSegment
+	for k := first; k <= last; k++ {
+		segments = append(segments, &dashSegment{
+			number:   v.startNumber + uint64(k),
+			time:     v.presentationTimeOffset + uint64(k)*v.duration,
+			duration: v.duration,
+		})
+	}
+	return segments
+}
+
+// The manifest of DASH, only the last period is played, which is the live one.
+type dashManifest struct {
+	dynamic               bool
+	availabilityStartTime time.Time
+	periodStart           time.Duration
+	// The durations of MPD, zero if not specified.
+	mediaPresentationDuration, minimumUpdatePeriod, timeShiftBufferDepth time.Duration
+	suggestedPresentationDelay, maxSegmentDuration                       time.Duration
+	representations                                                      []*dashRepresentation
+}
+
+// The max segment duration, or the max duration of segments if not specified, at least 1s.
+func (v *dashManifest) MaxSegmentDuration() time.Duration {
+	d := v.maxSegmentDuration
+	for _, r := range v.representations {
+		if r.timeline == nil && r.toDuration(int64(r.duration)) > d {
+			d = r.toDuration(int64(r.duration))
+		}
+		for _, s := range r.timeline {
+			if r.toDuration(int64(s.duration)) > d {
+				d = r.toDuration(int64(s.duration))
+			}
+		}
+	}
+
+	if d < time.Second {
+		return time.Second
+	}
+	return d
+}
+
+// The interval to reload the MPD, the minimum update period, or the max segment duration if not
+// specified.
+func (v *dashManifest) UpdatePeriod() time.Duration {
+	if v.minimumUpdatePeriod > 0 {
+		return v.minimumUpdatePeriod
+	}
+	return v.MaxSegmentDuration()
+}
+
+// Parse the MPD, resolve the urls by the url of MPD and BaseURL, and check the compliance, for
+// example, the segment should not exceed the maxSegmentDuration.
+// @see https://dashif.org/docs/DASH-IF-IOP-v4.3.pdf#section.3.2
+func parseDASHManifest(u *url.URL, b []byte) (*dashManifest, error) {
+	mpd := &dashMPDXML{}
+	if err := xml.Unmarshal(b, mpd); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal MPD")
+	}
+
+	m := &dashManifest{dynamic: mpd.Type == "dynamic"}
+	if mpd.Type != "" && mpd.Type != "static" && mpd.Type != "dynamic" {
+		return nil, errors.Errorf("invalid type %v", mpd.Type)
+	}
+
+	if mpd.AvailabilityStartTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, mpd.AvailabilityStartTime)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse availabilityStartTime %v", mpd.AvailabilityStartTime)
+		}
+		m.availabilityStartTime = t
+	} else if m.dynamic {
+		return nil, errors.Errorf("no availabilityStartTime for dynamic MPD")
+	}
+
+	for _, d := range []struct {
+		v     string
+		ptr   *time.Duration
+		label string
+	}{
+		{mpd.MediaPresentationDuration, &m.mediaPresentationDuration, "mediaPresentationDuration"},
+		{mpd.MinimumUpdatePeriod, &m.minimumUpdatePeriod, "minimumUpdatePeriod"},
+		{mpd.TimeShiftBufferDepth, &m.timeShiftBufferDepth, "timeShiftBufferDepth"},
+		{mpd.SuggestedPresentationDelay, &m.suggestedPresentationDelay, "suggestedPresentationDelay"},
+		{mpd.MaxSegmentDuration, &m.maxSegmentDuration, "maxSegmentDuration"},
+	} {
+		duration, err := parseDASHDuration(d.v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %v", d.label)
+		}
+		*d.ptr = duration
+	}
+
+	if len(mpd.Periods) == 0 {
+		return nil, errors.Errorf("no Period")
+	}
+	period := mpd.Periods[len(mpd.Periods)-1]
+	start, err := parseDASHDuration(period.Start)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse Period start %v", period.Start)
+	}
+	m.periodStart = start
+
+	base, err := resolveDASHURL(u, mpd.BaseURL, period.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, as := range period.AdaptationSets {
+		if len(as.Representations) == 0 {
+			return nil, errors.Errorf("no Representation in AdaptationSet %v", as.ContentType)
+		}
+
+		// Choose the highest bandwidth of each adaptation set, like audio and video.
+		rx := as.Representations[0]
+		for _, r := range as.Representations[1:] {
+			if r.Bandwidth > rx.Bandwidth {
+				rx = r
+			}
+		}
+
+		r, err := parseDASHRepresentation(m, as, rx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "representation %v", rx.ID)
+		}
+		if r.base, err = resolveDASHURL(base, as.BaseURL, rx.BaseURL); err != nil {
+			return nil, errors.Wrapf(err, "representation %v", rx.ID)
+		}
+		m.representations = append(m.representations, r)
+	}
+	if len(m.representations) == 0 {
+		return nil, errors.Errorf("no AdaptationSet")
+	}
+	return m, nil
+}
+
+// Parse the representation, the SegmentTemplate of representation overwrites the adaptation set.
+func parseDASHRepresentation(m *dashManifest, as *dashAdaptationSetXML, rx *dashRepresentationXML) (*dashRepresentation, error) {
+	r := &dashRepresentation{id: rx.ID, contentType: as.ContentType, bandwidth: rx.Bandwidth, timescale: 1, startNumber: 1}
+	if r.contentType == "" {
+		mimeType := rx.MimeType
+		if mimeType == "" {
+			mimeType = as.MimeType
+		}
+		r.contentType = strings.Split(mimeType, "/")[0]
+	}
+
+	st := rx.SegmentTemplate
+	if st == nil {
+		st = as.SegmentTemplate
+	}
+	if st == nil || st.Media == "" {
+		return nil, errors.Errorf("no SegmentTemplate with media")
+	}
+
+	r.initialization, r.media = st.Initialization, st.Media
+	r.presentationTimeOffset, r.duration = st.PresentationTimeOffset, st.Duration
+	if st.Timescale > 0 {
+		r.timescale = st.Timescale
+	}
+	if st.StartNumber != nil {
+		r.startNumber = *st.StartNumber
+	}
+
+	if st.AvailabilityTimeOffset == "INF" {
+		r.availabilityTimeOffset = math.Inf(1)
+	} else if st.AvailabilityTimeOffset != "" {
+		ato, err := strconv.ParseFloat(st.AvailabilityTimeOffset, 64)
+		if err != nil || ato < 0 {
+			return nil, errors.Errorf("invalid availabilityTimeOffset %v, err %v", st.AvailabilityTimeOffset, err)
+		}
+		r.availabilityTimeOffset = ato
+	}
+
+	if st.SegmentTimeline == nil {
+		if r.duration == 0 {
+			return nil, errors.Errorf("no duration or SegmentTimeline")
+		}
+		if !m.dynamic && m.mediaPresentationDuration <= 0 {
+			return nil, errors.Errorf("no mediaPresentationDuration for static MPD")
+		}
+		if m.maxSegmentDuration > 0 && r.toDuration(int64(r.duration)) > m.maxSegmentDuration {
+			return nil, errors.Errorf("duration %v exceeds maxSegmentDuration %v", r.duration, m.maxSegmentDuration)
+		}
+		return r, nil
+	}
+
+	// Expand the timeline, the repeat of -1 to the end of period is not supported, treat as no repeat.
+	r.timeline = []*dashSegment{}
+	var t uint64
+	for _, s := range st.SegmentTimeline.S {
+		if s.T != nil {
+			t = *s.T
+		}
+		if s.D == 0 {
+			return nil, errors.Errorf("invalid S t=%v, d=0", t)
+		}
+		if m.maxSegmentDuration > 0 && r.toDuration(int64(s.D)) > m.maxSegmentDuration {
+			return nil, errors.Errorf("S t=%v d=%v exceeds maxSegmentDuration %v", t, s.D, m.maxSegmentDuration)
+		}
+
+		for i := 0; i <= s.R; i++ {
+			number := r.startNumber + uint64(len(r.timeline))
+			r.timeline = append(r.timeline, &dashSegment{number: number, time: t, duration: s.D})
+			t += s.D
+		}
+	}
+	return r, nil
+}
+
+// Resolve the BaseURL one by one, the empty one is ignored.
+func resolveDASHURL(base *url.URL, refs ...string) (*url.URL, error) {
+	for _, ref := range refs {
+		if ref = strings.TrimSpace(ref); ref == "" {
+			continue
+		}
+
+		r, err := url.Parse(ref)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse BaseURL %v", ref)
+		}
+		base = base.ResolveReference(r)
+	}
+	return base, nil
+}
+
+// Parse the duration of ISO 8601, like PT5S, PT1M30.5S or P1DT2H. The years and months are not
+// supported, because they are ambiguous. Return zero for empty string.
+func parseDASHDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if !strings.HasPrefix(s, "P") || len(s) < 3 {
+		return 0, errors.Errorf("invalid duration %v", s)
+	}
+
+	var d time.Duration
+	var inTime bool
+	var number string
+	for _, c := range s[1:] {
+		if c == 'T' {
+			inTime = true
+			continue
+		}
+		if (c >= '0' && c <= '9') || c == '.' {
+			number += string(c)
+			continue
+		}
+
+		f, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parse duration %v", s)
+		}
+
+		var unit time.Duration
+		switch {
+		case c == 'D' && !inTime:
+			unit = 24 * time.Hour
+		case c == 'H' && inTime:
+			unit = time.Hour
+		case c == 'M' && inTime:
+			unit = time.Minute
+		case c == 'S' && inTime:
+			unit = time.Second
+		default:
+			return 0, errors.Errorf("invalid duration %v", s)
+		}
+		d, number = d+time.Duration(f*float64(unit)), ""
+	}
+
+	if number != "" {
+		return 0, errors.Errorf("invalid duration %v", s)
+	}
+	return d, nil
+}
+
+// Expand the template of SegmentTemplate, like $RepresentationID$-$Number%05d$.m4s, the $$ is the
+// escaped $, and the unknown identifier is kept.
+// @see https://dashif.org/docs/DASH-IF-IOP-v4.3.pdf#section.3.2.9.4
+func expandDASHTemplate(tmpl, id string, bandwidth int, number, t uint64) string {
+	var b strings.Builder
+	for {
+		start := strings.Index(tmpl, "$")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(tmpl[start+1:], "$")
+		if end < 0 {
+			break
+		}
+		end += start + 1
+
+		b.WriteString(tmpl[:start])
+		ident, format := tmpl[start+1:end], "%d"
+		if i := strings.Index(ident, "%"); i >= 0 {
+			ident, format = ident[:i], ident[i:]
+		}
+
+		switch ident {
+		case "":
+			b.WriteString("$")
+		case "RepresentationID":
+			b.WriteString(id)
+		case "Number":
+			b.WriteString(fmt.Sprintf(format, number))
+		case "Time":
+			b.WriteString(fmt.Sprintf(format, t))
+		case "Bandwidth":
+			b.WriteString(fmt.Sprintf(format, bandwidth))
+		default:
+			b.WriteString(tmpl[start : end+1])
+		}
+		tmpl = tmpl[end+1:]
+	}
+
+	b.WriteString(tmpl)
+	return b.String()
+}
+
+// Check the reloaded MPD with the previous one, the availabilityStartTime should not change, and the
+// segment of the same number should be the same time and duration.
+// @see https://dashif.org/docs/DASH-IF-IOP-v4.3.pdf#section.4.4.3
+func checkDASHReload(prev, cur *dashManifest) error {
+	if !prev.dynamic && cur.dynamic {
+		return errors.Errorf("MPD changed from static to dynamic")
+	}
+	if prev.dynamic && cur.dynamic && !prev.availabilityStartTime.Equal(cur.availabilityStartTime) {
+		return errors.Errorf("availabilityStartTime changed from %v to %v", prev.availabilityStartTime, cur.availabilityStartTime)
+	}
+
+	for _, r := range cur.representations {
+		for _, p := range prev.representations {
+			if p.id != r.id || len(p.timeline) == 0 || len(r.timeline) == 0 {
+				continue
+			}
+
+			if r.timeline[0].number < p.timeline[0].number {
+				return errors.Errorf("representation %v number decrease from %v to %v", r.id, p.timeline[0].number, r.timeline[0].number)
+			}
+			for _, s := range r.timeline {
+				if s.number < p.timeline[0].number || s.number >= p.timeline[0].number+uint64(len(p.timeline)) {
+					continue
+				}
+				if old := p.timeline[s.number-p.timeline[0].number]; old.time != s.time || old.duration != s.duration {
+					return errors.Errorf("representation %v segment %v changed from t=%v,d=%v to t=%v,d=%v",
+						r.id, s.number, old.time, old.duration, s.time, s.duration)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Check the initialization or media segment, which should be ISO BMFF boxes, or MPEG-TS packets.
+func checkDASHSegment(b []byte, initialization bool) error {
+	if len(b) > 0 && b[0] == 0x47 && len(b)%188 == 0 {
+		return nil
+	}
+	if len(b) < 8 {
+		return errors.Errorf("too small %vB", len(b))
+	}
+
+	switch box := string(b[4:8]); {
+	case initialization && box != "ftyp":
+		return errors.Errorf("initialization should start with ftyp, actual %v", box)
+	case !initialization && box != "styp" && box != "moof" && box != "sidx" && box != "emsg" && box != "prft":
+		return errors.Errorf("segment should start with styp or moof, actual %v", box)
+	}
+	return nil
+}
+
+// The state of a representation to play.
+type dashStream struct {
+	// Whether the initialization is fetched.
+	initialized bool
+	// The next number to fetch, and the expected time of it, to check the continuity.
+	next, nextTime uint64
+	started        bool
+	// The duration of fetched segments, to keep the buffer for VOD.
+	buffered time.Duration
+}
+
+// The DASH player, which reloads the MPD and fetches the segments of each adaptation set like a real
+// player, follows the live edge by availabilityTimeOffset, and checks the continuity of segments.
+type dashPlayer struct {
+	client *http.Client
+	mpd    *url.URL
+	// The last MPD, nil if not loaded.
+	prev *dashManifest
+	// The streams by representation id.
+	streams map[string]*dashStream
+	// The playback clock, to keep the buffer for VOD.
+	playStart time.Time
+	// The number of available segments and the time it changed, to detect stale MPD.
+	available     uint64
+	lastChanged   time.Time
+	staleReported bool
+	// The stat of this player.
+	reloads, segments, gaps, stale, notFound, violations uint64
+}
+
+func newDASHPlayer(mpd *url.URL, config *tls.Config) *dashPlayer {
+	return &dashPlayer{client: newHTTPPlayerClient(config), mpd: mpd, streams: make(map[string]*dashStream)}
+}
+
+func (v *dashPlayer) Close() error {
+	v.client.CloseIdleConnections()
+	return nil
+}
+
+// Count the failure of request, the 404 or other errors.
+func (v *dashPlayer) onFailure(err error) {
+	if errors.Cause(err) == errHTTPNotFound {
+		v.notFound++
+		gStatRTC.DASH.onNotFound()
+	} else {
+		gStatRTC.DASH.onError()
+	}
+}
+
+func (v *dashPlayer) onViolation() {
+	v.violations++
+	gStatRTC.DASH.onViolation()
+}
+
+// Load the MPD, check it with the previous one, and report stale if no new segment for 1.5 times the
+// max segment duration. The new stream starts from the live edge with suggestedPresentationDelay, or 3
+// max segment durations, for live, or the first segment for VOD.
+func (v *dashPlayer) load(ctx context.Context) error {
+	b, err := fetchHTTP(ctx, v.client, v.mpd)
+	if err != nil {
+		return err
+	}
+
+	m, err := parseDASHManifest(v.mpd, b)
+	if err != nil {
+		v.onViolation()
+		return errors.Wrapf(err, "parse %v", v.mpd.String())
+	}
+
+	v.reloads++
+	gStatRTC.DASH.onReload()
+
+	if v.prev == nil {
+		v.playStart, v.lastChanged = time.Now(), time.Now()
+		logger.Tf(ctx, "DASH play %v, dynamic=%v, representations=%v, update=%v, delay=%v, max-segment=%v",
+			v.mpd.String(), m.dynamic, len(m.representations), m.minimumUpdatePeriod, m.suggestedPresentationDelay,
+			m.maxSegmentDuration)
+	} else if err := checkDASHReload(v.prev, m); err != nil {
+		v.onViolation()
+		logger.Wf(ctx, "DASH reload violation %+v", err)
+	}
+
+	now := time.Now()
+	var available uint64
+	for _, r := range m.representations {
+		segments := r.Segments(m, now)
+		if n := len(segments); n > 0 {
+			available += segments[n-1].number + 1
+		}
+
+		if _, ok := v.streams[r.id]; ok {
+			continue
+		}
+
+		s := &dashStream{next: r.startNumber}
+		if len(segments) > 0 {
+			s.next = segments[0].number
+		}
+
+		delay := m.suggestedPresentationDelay
+		if delay <= 0 {
+			delay = 3 * m.MaxSegmentDuration()
+		}
+		for i, d := len(segments)-1, time.Duration(0); m.dynamic && i >= 0; i-- {
+			if d += r.toDuration(int64(segments[i].duration)); d >= delay {
+				s.next = segments[i].number
+				break
+			}
+		}
+
+		v.streams[r.id] = s
+		logger.Tf(ctx, "DASH %v representation %v, bandwidth=%v, timescale=%v, ato=%v, segments=%v, start=%v",
+			r.contentType, r.id, r.bandwidth, r.timescale, r.availabilityTimeOffset, len(segments), s.next)
+	}
+
+	if available > v.available || !m.dynamic {
+		v.available, v.lastChanged, v.staleReported = available, time.Now(), false
+	} else if d := time.Since(v.lastChanged); d > m.MaxSegmentDuration()*3/2 && !v.staleReported {
+		v.stale++
+		gStatRTC.DASH.onStale()
+		logger.Wf(ctx, "DASH MPD stale for %v, max-segment=%v", d, m.MaxSegmentDuration())
+		v.staleReported = true
+	}
+
+	v.prev = m
+	return nil
+}
+
+// Fetch the initialization and the available segments from the next one, keep about 3 max segment
+// durations in buffer for VOD.
+func (v *dashPlayer) play(ctx context.Context, m *dashManifest, r *dashRepresentation) {
+	s := v.streams[r.id]
+
+	// Fetch the initialization once, and continue to fetch segments even if failed, to keep the load.
+	if !s.initialized && r.initialization != "" {
+		s.initialized = true
+		if err := v.fetch(ctx, r, nil, time.Time{}); err != nil && ctx.Err() == nil {
+			v.onFailure(err)
+			logger.Wf(ctx, "DASH fetch %v initialization err %+v", r.id, err)
+		}
+	}
+
+	segments := r.Segments(m, time.Now())
+	if len(segments) > 0 && s.next < segments[0].number {
+		logger.Wf(ctx, "DASH skip %v segments %v to %v, expired", r.id, s.next, segments[0].number-1)
+		s.next = segments[0].number
+	}
+
+	for _, segment := range segments {
+		if segment.number < s.next || ctx.Err() != nil {
+			continue
+		}
+
+		if d := s.buffered - time.Since(v.playStart) - 3*m.MaxSegmentDuration(); !m.dynamic && d > 0 {
+			select {
+			case <-ctx.Done():
+				continue
+			case <-time.After(d):
+			}
+		}
+
+		// The media timeline should be continuous, without gap or overlap.
+		if s.started && segment.time != s.nextTime {
+			v.gaps++
+			gStatRTC.DASH.onGap()
+			logger.Wf(ctx, "DASH %v segment %v gap, time=%v, expect=%v", r.id, segment.number, segment.time, s.nextTime)
+		}
+
+		var end time.Time
+		if m.dynamic {
+			end = r.End(m, segment)
+		}
+		if err := v.fetch(ctx, r, segment, end); err != nil && ctx.Err() == nil {
+			v.onFailure(err)
+			logger.Wf(ctx, "DASH fetch err %+v", err)
+		}
+
+		s.next, s.nextTime, s.started = segment.number+1, segment.time+segment.duration, true
+		s.buffered += r.toDuration(int64(segment.duration))
+	}
+}
+
+// Fetch the initialization if segment is nil, or the media segment, and report the latency to its end.
+func (v *dashPlayer) fetch(ctx context.Context, r *dashRepresentation, segment *dashSegment, end time.Time) error {
+	u, err := r.URL(segment)
+	if err != nil {
+		return errors.Wrapf(err, "representation %v", r.id)
+	}
+
+	start := time.Now()
+	b, err := fetchHTTP(ctx, v.client, u)
+	if err != nil {
+		return err
+	}
+
+	if err := checkDASHSegment(b, segment == nil); err != nil {
+		v.onViolation()
+		logger.Wf(ctx, "DASH %v invalid, %v", u.String(), err)
+	}
+
+	if !end.IsZero() {
+		gStatRTC.DASH.latency.onLatency(time.Since(end))
+	}
+	gStatRTC.DASH.onFetch(len(b), time.Since(start))
+
+	if segment != nil {
+		v.segments++
+		gStatRTC.DASH.onSegment()
+	}
+	return nil
+}
+
+// Whether all segments of VOD are fetched.
+func (v *dashPlayer) done(m *dashManifest) bool {
+	for _, r := range m.representations {
+		segments := r.Segments(m, time.Now())
+		if s := v.streams[r.id]; len(segments) > 0 && s.next <= segments[len(segments)-1].number {
+			return false
+		}
+	}
+	return true
+}
+
+// Play the DASH url, reload the MPD every minimumUpdatePeriod for live, and fetch the segments once
+// available, which is availabilityTimeOffset before the end of segment. For VOD, fetch the segments to
+// keep about 3 max segment durations in buffer, and quit when all segments are fetched.
+func startDASHPlay(ctx context.Context, r string, config *tls.Config) error {
+	ctx = logger.WithContext(ctx)
+
+	logger.Tf(ctx, "Run DASH play url=%v", r)
+
+	u, err := url.Parse(r)
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", r)
+	}
+
+	player := newDASHPlayer(u, config)
+	defer player.Close()
+
+	gStatRTC.DASH.onPlay()
+	defer func() {
+		logger.Tf(ctx, "DASH play done, reloads=%v, segments=%v, gaps=%v, stale=%v, 404=%v, violations=%v",
+			player.reloads, player.segments, player.gaps, player.stale, player.notFound, player.violations)
+	}()
+
+	var reloadAt time.Time
+	for ctx.Err() == nil {
+		// Reload the MPD for live, or retry if failed to load.
+		if m := player.prev; m == nil || (m.dynamic && !time.Now().Before(reloadAt)) {
+			reloadStart := time.Now()
+			if err := player.load(ctx); err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				player.onFailure(err)
+				logger.Wf(ctx, "DASH load MPD err %+v", err)
+			}
+
+			reloadAt = reloadStart.Add(time.Second)
+			if player.prev != nil {
+				reloadAt = reloadStart.Add(player.prev.UpdatePeriod())
+			}
+		}
+
+		m := player.prev
+		if m == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(reloadAt)):
+			}
+			continue
+		}
+
+		for _, r := range m.representations {
+			player.play(ctx, m, r)
+		}
+		if !m.dynamic && player.done(m) {
+			return nil
+		}
+
+		// Wait for the next segment to be available, or to reload the MPD.
+		wakeup := reloadAt
+		for _, r := range m.representations {
+			s := player.streams[r.id]
+			next := &dashSegment{number: s.next, time: s.nextTime, duration: r.duration}
+			if r.timeline != nil {
+				if s.next < r.startNumber || s.next-r.startNumber >= uint64(len(r.timeline)) {
+					continue
+				}
+				next = r.timeline[s.next-r.startNumber]
+			} else if !s.started {
+				next.time = r.presentationTimeOffset + (s.next-r.startNumber)*r.duration
+			}
+
+			if t := r.AvailableAt(m, next); t.Before(wakeup) {
+				wakeup = t
+			}
+		}
+
+		if d := time.Until(wakeup); d > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(d):
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+func TestDashMPD(t *testing.T) {
+	if err := func() error {
+		if !isDASHURL("http://localhost:8080/live/livestream.mpd?token=x") || isDASHURL("http://localhost:8080/live/livestream.m3u8") {
+			return errors.New("invalid url type")
+		}
+
+		for s, d := range map[string]time.Duration{
+			"PT5S": 5 * time.Second, "PT1M30.5S": 90500 * time.Millisecond, "P1DT2H": 26 * time.Hour, "": 0,
+		} {
+			if v, err := parseDASHDuration(s); err != nil || v != d {
+				return errors.Errorf("invalid duration %v, expect %v, actual %v, err %v", s, d, v, err)
+			}
+		}
+		for _, s := range []string{"5S", "P1M", "PT5", "PTS"} {
+			if _, err := parseDASHDuration(s); err == nil {
+				return errors.Errorf("should fail for %v", s)
+			}
+		}
+
+		if v := expandDASHTemplate("$RepresentationID$/$Number%05d$-$Time$-$Bandwidth$$$.m4s", "hd", 800, 7, 9000); v != "hd/00007-9000-800$.m4s" {
+			return errors.Errorf("invalid template %v", v)
+		}
+
+		u, _ := url.Parse("http://localhost:8080/live/livestream.mpd")
+		m, err := parseDASHManifest(u, []byte(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" availabilityStartTime="2021-01-01T00:00:00Z"
+	minimumUpdatePeriod="PT2S" timeShiftBufferDepth="PT10S" maxSegmentDuration="PT2S">
+	<BaseURL>livestream/</BaseURL>
+	<Period start="PT0S">
+		<AdaptationSet contentType="video">
+			<SegmentTemplate timescale="1000" initialization="$RepresentationID$-init.mp4" media="$RepresentationID$-$Time$.m4s">
+				<SegmentTimeline><S t="4000" d="2000" r="1"/><S d="1500"/></SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="low" bandwidth="500000"/>
+			<Representation id="hd" bandwidth="2000000"/>
+		</AdaptationSet>
+		<AdaptationSet mimeType="audio/mp4">
+			<Representation id="audio" bandwidth="48000">
+				<SegmentTemplate timescale="1000" duration="2000" availabilityTimeOffset="1.5" media="audio-$Number$.m4s"/>
+			</Representation>
+		</AdaptationSet>
+	</Period>
+</MPD>`))
+		if err != nil {
+			return errors.Wrapf(err, "parse")
+		}
+		if !m.dynamic || m.minimumUpdatePeriod != 2*time.Second || len(m.representations) != 2 {
+			return errors.Errorf("invalid MPD %+v", m)
+		}
+
+		video, audio := m.representations[0], m.representations[1]
+		if video.id != "hd" || video.contentType != "video" || len(video.timeline) != 3 || video.timeline[2].time != 8000 || video.timeline[2].number != 3 {
+			return errors.Errorf("invalid video %+v", video)
+		}
+		if v, err := video.URL(video.timeline[1]); err != nil || v.String() != "http://localhost:8080/live/livestream/hd-6000.m4s" {
+			return errors.Errorf("invalid url %v, err %v", v, err)
+		}
+
+		// The audio segment of 10s to 12s is available at 10.5s, by availabilityTimeOffset.
+		now := m.availabilityStartTime.Add(10600 * time.Millisecond)
+		segments := audio.Segments(m, now)
+		if audio.contentType != "audio" || len(segments) != 6 || segments[5].number != 6 ||
+			audio.AvailableAt(m, segments[5]).Sub(m.availabilityStartTime) != 10500*time.Millisecond {
+			return errors.Errorf("invalid audio %+v, segments %v", audio, len(segments))
+		}
+		if segments := video.Segments(m, m.availabilityStartTime.Add(7*time.Second)); len(segments) != 1 {
+			return errors.Errorf("invalid video segments %v", len(segments))
+		}
+
+		for _, b := range []string{
+			`<Manifest/>`,
+			`<MPD type="live"><Period><AdaptationSet><Representation><SegmentTemplate duration="1" media="a.m4s"/></Representation></AdaptationSet></Period></MPD>`,
+			`<MPD type="dynamic"><Period><AdaptationSet><Representation><SegmentTemplate duration="1" media="a.m4s"/></Representation></AdaptationSet></Period></MPD>`,
+			`<MPD mediaPresentationDuration="PT10S"></MPD>`,
+			`<MPD mediaPresentationDuration="PT10S"><Period><AdaptationSet><Representation/></AdaptationSet></Period></MPD>`,
+			`<MPD><Period><AdaptationSet><Representation><SegmentTemplate duration="1" media="a.m4s"/></Representation></AdaptationSet></Period></MPD>`,
+			`<MPD mediaPresentationDuration="PT10S" maxSegmentDuration="PT1S"><Period><AdaptationSet><Representation>` +
+				`<SegmentTemplate timescale="1000" duration="2000" media="a.m4s"/></Representation></AdaptationSet></Period></MPD>`,
+		} {
+			if _, err := parseDASHManifest(u, []byte(b)); err == nil {
+				return errors.Errorf("should fail for %v", b)
+			}
+		}
+
+		if err := checkDASHSegment([]byte("\x00\x00\x00\x18ftypiso6"), true); err != nil {
+			return errors.Wrapf(err, "initialization")
+		}
+		if err := checkDASHSegment([]byte("\x00\x00\x00\x18ftypiso6"), false); err == nil {
+			return errors.New("should fail for ftyp segment")
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestDashReload(t *testing.T) {
+	if err := func() error {
+		u, _ := url.Parse("http://localhost:8080/live/livestream.mpd")
+		parse := func(typ, ast string, number, t int, durations ...int) *dashManifest {
+			b := fmt.Sprintf(`<MPD type="%v" availabilityStartTime="%v" mediaPresentationDuration="PT10S"><Period><AdaptationSet>`+
+				`<Representation id="hd"><SegmentTemplate startNumber="%v" media="$Number$.m4s"><SegmentTimeline>`, typ, ast, number)
+			for i, d := range durations {
+				if i == 0 {
+					b += fmt.Sprintf(`<S t="%v" d="%v"/>`, t, d)
+				} else {
+					b += fmt.Sprintf(`<S d="%v"/>`, d)
+				}
+			}
+			m, _ := parseDASHManifest(u, []byte(b+`</SegmentTimeline></SegmentTemplate></Representation></AdaptationSet></Period></MPD>`))
+			return m
+		}
+
+		const ast = "2021-01-01T00:00:00Z"
+		prev := parse("dynamic", ast, 1, 0, 2, 2, 2)
+		for _, cur := range []*dashManifest{parse("dynamic", ast, 2, 2, 2, 2, 2), parse("static", ast, 1, 0, 2, 2, 2, 2)} {
+			if err := checkDASHReload(prev, cur); err != nil {
+				return errors.Wrapf(err, "should ok")
+			}
+		}
+		for i, cur := range []*dashManifest{
+			parse("dynamic", ast, 0, 0, 2, 2),
+			parse("dynamic", ast, 2, 2, 3, 2),
+			parse("dynamic", "2021-01-01T00:00:01Z", 1, 0, 2, 2, 2),
+		} {
+			if err := checkDASHReload(prev, cur); err == nil {
+				return errors.Errorf("should fail for %v", i)
+			}
+		}
+		if err := checkDASHReload(parse("static", ast, 1, 0, 2), prev); err == nil {
+			return errors.New("should fail for static to dynamic")
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestDashPlay(t *testing.T) {
+	if err := func() error {
+		// The VOD of video with a gap, and audio with a 404 segment.
+		var requests []string
+		var lock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			requests = append(requests, r.URL.Path)
+			lock.Unlock()
+
+			switch {
+			case r.URL.Path == "/vod/livestream.mpd":
+				w.Write([]byte(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT3S" maxSegmentDuration="PT1S">
+	<Period>
+		<AdaptationSet contentType="video">
+			<SegmentTemplate timescale="1000" initialization="$RepresentationID$-init.mp4" media="$RepresentationID$-$Time$.m4s">
+				<SegmentTimeline><S t="0" d="1000" r="1"/><S t="3000" d="1000"/></SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="hd" bandwidth="2000000"/>
+		</AdaptationSet>
+		<AdaptationSet contentType="audio">
+			<Representation id="audio" bandwidth="48000">
+				<SegmentTemplate timescale="48000" duration="48000" startNumber="0" initialization="audio-init.mp4" media="audio-$Number%03d$.m4s"/>
+			</Representation>
+		</AdaptationSet>
+	</Period>
+</MPD>`))
+			case r.URL.Path == "/vod/audio-002.m4s":
+				http.NotFound(w, r)
+			case strings.HasSuffix(r.URL.Path, "-init.mp4"):
+				w.Write([]byte("\x00\x00\x00\x10ftypiso6\x00\x00\x00\x00"))
+			default:
+				w.Write([]byte("\x00\x00\x00\x10stypmsdh\x00\x00\x00\x00"))
+			}
+		}))
+		defer server.Close()
+
+		_, _, segments, gaps, _, notFound, violations, _, _ := gStatRTC.DASH.Stat()
+		if err := startDASHPlay(context.Background(), server.URL+"/vod/livestream.mpd", nil); err != nil {
+			return errors.Wrapf(err, "play")
+		}
+
+		_, _, segments2, gaps2, _, notFound2, violations2, _, _ := gStatRTC.DASH.Stat()
+		if segments2 != segments+5 || gaps2 != gaps+1 || notFound2 != notFound+1 || violations2 != violations {
+			return errors.Errorf("invalid segments=%v, gaps=%v, 404=%v, violations=%v",
+				segments2-segments, gaps2-gaps, notFound2-notFound, violations2-violations)
+		}
+		if len(requests) != 9 || requests[1] != "/vod/hd-init.mp4" || requests[4] != "/vod/hd-3000.m4s" || requests[6] != "/vod/audio-000.m4s" {
+			return errors.Errorf("invalid requests %v", requests)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+
+	if err := func() error {
+		// The live stream of 500ms segments, available 250ms before the end by availabilityTimeOffset,
+		// the server responds 404 if requested before available.
+		ast := time.Now().Add(-10 * time.Second).Truncate(time.Millisecond)
+		var early []time.Duration
+		var lock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/live/livestream.mpd" {
+				w.Write([]byte(fmt.Sprintf(`<MPD type="dynamic" availabilityStartTime="%v" minimumUpdatePeriod="PT1S"><Period>`+
+					`<AdaptationSet contentType="video"><Representation id="hd" bandwidth="2000000">`+
+					`<SegmentTemplate timescale="1000" duration="500" availabilityTimeOffset="0.25" media="hd-$Number$.m4s"/>`+
+					`</Representation></AdaptationSet></Period></MPD>`, ast.UTC().Format(time.RFC3339Nano))))
+				return
+			}
+
+			var number int64
+			if _, err := fmt.Sscanf(r.URL.Path, "/live/hd-%d.m4s", &number); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+
+			end := ast.Add(time.Duration(number) * 500 * time.Millisecond)
+			if time.Until(end) > 250*time.Millisecond {
+				http.NotFound(w, r)
+				return
+			}
+
+			lock.Lock()
+			early = append(early, time.Until(end))
+			lock.Unlock()
+			w.Write([]byte("\x00\x00\x00\x10stypmsdh\x00\x00\x00\x00"))
+		}))
+		defer server.Close()
+
+		_, _, segments, gaps, stale, notFound, violations, _, _ := gStatRTC.DASH.Stat()
+		latencies, _, _, _, _, _ := gStatRTC.DASH.latency.Stat()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1300*time.Millisecond)
+		defer cancel()
+		if err := startDASHPlay(ctx, server.URL+"/live/livestream.mpd", nil); err != nil {
+			return errors.Wrapf(err, "play")
+		}
+
+		_, _, segments2, gaps2, stale2, notFound2, violations2, _, _ := gStatRTC.DASH.Stat()
+		latencies2, _, _, _, _, _ := gStatRTC.DASH.latency.Stat()
+		if segments2-segments < 8 || latencies2-latencies != segments2-segments || gaps2 != gaps || stale2 != stale ||
+			notFound2 != notFound || violations2 != violations {
+			return errors.Errorf("invalid segments=%v, latencies=%v, gaps=%v, stale=%v, 404=%v, violations=%v",
+				segments2-segments, latencies2-latencies, gaps2-gaps, stale2-stale, notFound2-notFound, violations2-violations)
+		}
+
+		// Start from 3s before the live edge, then fetch the segments before the end.
+		lock.Lock()
+		defer lock.Unlock()
+		if early[0] > -2500*time.Millisecond || early[len(early)-1] < 100*time.Millisecond {
+			return errors.Errorf("invalid fetch time %v", early)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
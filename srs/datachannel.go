@@ -0,0 +1,156 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pion/webrtc/v3"
+)
+
+// The header of DataChannel message for benchmark, the seq and the send time in ns, then padding.
+const dataChannelMessageHeader = 16
+
+func marshalDataChannelMessage(seq uint64, ts time.Time, size int) []byte {
+	if size < dataChannelMessageHeader {
+		size = dataChannelMessageHeader
+	}
+
+	b := make([]byte, size)
+	binary.BigEndian.PutUint64(b, seq)
+	binary.BigEndian.PutUint64(b[8:], uint64(ts.UnixNano()))
+	return b
+}
+
+func unmarshalDataChannelMessage(b []byte) (uint64, time.Time, error) {
+	if len(b) < dataChannelMessageHeader {
+		return 0, time.Time{}, errors.Errorf("requires %v bytes, actual %v", dataChannelMessageHeader, len(b))
+	}
+
+	seq := binary.BigEndian.Uint64(b)
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(b[8:])))
+	return seq, ts, nil
+}
+
+// Create n DataChannels, each sends messages of size bytes at rate per second when open, until
+// ctx is done or the channel is closed.
+func startDataChannelSenders(ctx context.Context, pc *webrtc.PeerConnection, n, size, rate int) error {
+	for i := 0; i < n; i++ {
+		dc, err := pc.CreateDataChannel(fmt.Sprintf("srs-bench-%v", i), nil)
+		if err != nil {
+			return errors.Wrapf(err, "create datachannel %v", i)
+		}
+
+		dc.OnOpen(func() {
+			logger.Tf(ctx, "DataChannel %v open, size=%v, rate=%v", dc.Label(), size, rate)
+			go sendDataChannel(ctx, dc, size, rate)
+		})
+	}
+	return nil
+}
+
+func sendDataChannel(ctx context.Context, dc *webrtc.DataChannel, size, rate int) {
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	for seq := uint64(0); ctx.Err() == nil; seq++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := dc.Send(marshalDataChannelMessage(seq, time.Now(), size)); err != nil {
+			if ctx.Err() == nil {
+				logger.Wf(ctx, "DataChannel %v send err %+v", dc.Label(), err)
+			}
+			return
+		}
+		gStatRTC.DataChannels.onSent()
+	}
+}
+
+// The receiver of DataChannel messages, to measure the latency and loss by seq of each channel.
+// @remark The latency is right only when sender and receiver use the same clock.
+type dataChannelReceiver struct {
+	ctx  context.Context
+	lock sync.Mutex
+	// The next seq to expect of each channel, by label.
+	expects map[string]uint64
+}
+
+func newDataChannelReceiver(ctx context.Context) *dataChannelReceiver {
+	return &dataChannelReceiver{ctx: ctx, expects: make(map[string]uint64)}
+}
+
+// Create n DataChannels to negotiate the SCTP, and watch all channels, including the ones
+// created by server.
+func (v *dataChannelReceiver) Start(pc *webrtc.PeerConnection, n int) error {
+	for i := 0; i < n; i++ {
+		dc, err := pc.CreateDataChannel(fmt.Sprintf("srs-bench-%v", i), nil)
+		if err != nil {
+			return errors.Wrapf(err, "create datachannel %v", i)
+		}
+		v.watch(dc)
+	}
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		logger.Tf(v.ctx, "DataChannel %v from server, id=%v", dc.Label(), dc.ID())
+		v.watch(dc)
+	})
+	return nil
+}
+
+func (v *dataChannelReceiver) watch(dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := v.onMessage(dc.Label(), msg.Data); err != nil {
+			logger.Wf(v.ctx, "DataChannel %v ignore err %+v", dc.Label(), err)
+		}
+	})
+}
+
+func (v *dataChannelReceiver) onMessage(label string, b []byte) error {
+	seq, ts, err := unmarshalDataChannelMessage(b)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshal")
+	}
+	latency := time.Since(ts)
+
+	// The lost is the gap of seq, and the late ones are not lost.
+	var lost uint64
+	v.lock.Lock()
+	if expect, ok := v.expects[label]; !ok || seq >= expect {
+		if ok {
+			lost = seq - expect
+		}
+		v.expects[label] = seq + 1
+	}
+	v.lock.Unlock()
+
+	gStatRTC.DataChannels.onReceived(latency, lost)
+	return nil
+}
@@ -0,0 +1,72 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/pion/webrtc/v3"
+)
+
+// The DTLS roles in SDP, see https://tools.ietf.org/html/rfc4145#section-4
+const (
+	dtlsRoleActpass = "actpass"
+	dtlsRoleActive  = "active"
+	dtlsRolePassive = "passive"
+)
+
+// Force the DTLS role of offer, for example, active to start ClientHello as DTLS client, while
+// passive to wait for ClientHello as DTLS server, so SRS must choose the other role.
+// Note that pion always offers actpass, and it follows the role of SRS answer.
+func dtlsRoleOffer(offer, role string) (string, error) {
+	switch role {
+	case "", dtlsRoleActpass:
+		return offer, nil
+	case dtlsRoleActive, dtlsRolePassive:
+	default:
+		return "", errors.Errorf("Invalid DTLS role %v", role)
+	}
+
+	if !strings.Contains(offer, "a=setup:actpass") {
+		return "", errors.Errorf("No setup:actpass in offer")
+	}
+	return strings.ReplaceAll(offer, "a=setup:actpass", "a=setup:"+role), nil
+}
+
+// Load a fixed certificate and private key in PEM, instead of generating one for each PC, so
+// the fingerprint is stable across sessions.
+func loadRTCCertificate(certFile, keyFile string) (*webrtc.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load cert=%v, key=%v", certFile, keyFile)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse cert=%v", certFile)
+	}
+
+	certificate := webrtc.CertificateFromX509(pair.PrivateKey, cert)
+	return &certificate, nil
+}
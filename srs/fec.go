@@ -0,0 +1,302 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The ULPFEC in RED, like Chrome, the payload type of ULPFEC is same to pion default codecs.
+// @see https://tools.ietf.org/html/rfc5109
+// @see https://tools.ietf.org/html/rfc2198
+var redCodec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/red", ClockRate: 90000},
+	PayloadType:        115,
+}
+
+var ulpfecCodec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/ulpfec", ClockRate: 90000},
+	PayloadType:        116,
+}
+
+// The max media packets protected by a ULPFEC packet, limited by the 16 bits mask.
+const fecMaxGroup = 16
+
+// The window of received media packets to recover, should be larger than fecMaxGroup.
+const fecRecoverWindow = 128
+
+// Register the RED and ULPFEC codecs for video.
+func registerFECCodecs(m *webrtc.MediaEngine) error {
+	for _, codec := range []webrtc.RTPCodecParameters{redCodec, ulpfecCodec} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return errors.Wrapf(err, "register %v", codec.MimeType)
+		}
+	}
+	return nil
+}
+
+// Whether the SDP negotiates both the RED and ULPFEC.
+func sdpHasFEC(sdp string) bool {
+	return strings.Contains(sdp, " red/90000") && strings.Contains(sdp, " ulpfec/90000")
+}
+
+// Generate the ULPFEC packet payload, to protect the media packets in raw RTP, which sequence
+// number starts from snBase, and at most fecMaxGroup packets.
+func ulpfecEncode(snBase uint16, packets [][]byte) []byte {
+	var mask uint16
+	var protection int
+	for _, pkt := range packets {
+		if len(pkt)-12 > protection {
+			protection = len(pkt) - 12
+		}
+	}
+
+	// The FEC header and level 0 header, with short mask.
+	b := make([]byte, 10+4+protection)
+	for _, pkt := range packets {
+		b[0] ^= pkt[0]
+		b[1] ^= pkt[1]
+		for i := 4; i < 8; i++ {
+			b[i] ^= pkt[i]
+		}
+		binary.BigEndian.PutUint16(b[8:], binary.BigEndian.Uint16(b[8:])^uint16(len(pkt)-12))
+		for i, v := range pkt[12:] {
+			b[14+i] ^= v
+		}
+		mask |= 0x8000 >> (binary.BigEndian.Uint16(pkt[2:]) - snBase)
+	}
+
+	// The E and L bit is zero, for the short mask.
+	b[0] &= 0x3f
+	binary.BigEndian.PutUint16(b[2:], snBase)
+	binary.BigEndian.PutUint16(b[10:], uint16(protection))
+	binary.BigEndian.PutUint16(b[12:], mask)
+	return b
+}
+
+// Recover the lost media packet by the ULPFEC packet payload and the received media packets,
+// only if exactly one protected packet is lost, return nil if nothing to recover.
+func ulpfecDecode(fec []byte, ssrc uint32, received func(seq uint16) []byte) (seq uint16, pkt []byte, err error) {
+	if len(fec) < 14 {
+		return 0, nil, errors.Errorf("fec requires 14 bytes, only %v", len(fec))
+	}
+	if fec[0]&0x80 != 0 || fec[0]&0x40 != 0 {
+		return 0, nil, errors.Errorf("unsupported fec E/L %#x", fec[0])
+	}
+
+	snBase, protection := binary.BigEndian.Uint16(fec[2:]), int(binary.BigEndian.Uint16(fec[10:]))
+	mask := binary.BigEndian.Uint16(fec[12:])
+	if len(fec) < 14+protection {
+		return 0, nil, errors.Errorf("fec requires %v bytes, only %v", 14+protection, len(fec))
+	}
+
+	var lost int
+	var protected [][]byte
+	for i := uint16(0); i < fecMaxGroup; i++ {
+		if mask&(0x8000>>i) == 0 {
+			continue
+		}
+		if v := received(snBase + i); v != nil {
+			protected = append(protected, v)
+		} else {
+			seq, lost = snBase+i, lost+1
+		}
+	}
+	if lost != 1 {
+		return 0, nil, nil
+	}
+
+	// Recover the header and payload by XOR.
+	b := make([]byte, 12+protection)
+	copy(b, fec[:10])
+	copy(b[12:], fec[14:14+protection])
+	for _, v := range protected {
+		b[0] ^= v[0]
+		b[1] ^= v[1]
+		for i := 4; i < 8; i++ {
+			b[i] ^= v[i]
+		}
+		binary.BigEndian.PutUint16(b[8:], binary.BigEndian.Uint16(b[8:])^uint16(len(v)-12))
+		for i := 0; i < len(v)-12 && i < protection; i++ {
+			b[12+i] ^= v[12+i]
+		}
+	}
+
+	size := int(binary.BigEndian.Uint16(b[8:]))
+	if size > protection {
+		return 0, nil, errors.Errorf("invalid length %v, protection %v", size, protection)
+	}
+
+	b[0] = 0x80 | (b[0] & 0x3f)
+	binary.BigEndian.PutUint16(b[2:], seq)
+	binary.BigEndian.PutUint32(b[8:], ssrc)
+	return seq, b[:12+size], nil
+}
+
+// The interceptor of publisher, to send video in RED, and protect every group of media
+// packets by a ULPFEC packet, should be added after the default interceptors.
+type fecEncoderInterceptor struct {
+	// The number of media packets protected by a ULPFEC packet.
+	group int
+	// Whether the answer negotiates the FEC, set before the stream is bound.
+	enabled bool
+	// Other common fields.
+	bypassInterceptor
+}
+
+func newFECEncoderInterceptor(group int) *fecEncoderInterceptor {
+	return &fecEncoderInterceptor{group: group}
+}
+
+func (v *fecEncoderInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !v.enabled || !strings.HasPrefix(info.MimeType, "video/") {
+		return writer
+	}
+
+	// The stream is renumbered, for the sequence number of ULPFEC packets.
+	var lock sync.Mutex
+	var seq, snBase uint16
+	var packets [][]byte
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		media := *header
+		media.SequenceNumber = seq
+		seq++
+
+		pkt, err := (&rtp.Packet{Header: media, Payload: payload}).Marshal()
+		if err != nil {
+			return 0, errors.Wrapf(err, "marshal")
+		}
+		if len(packets) == 0 {
+			snBase = media.SequenceNumber
+		}
+		packets = append(packets, pkt)
+
+		red := media
+		red.PayloadType = uint8(redCodec.PayloadType)
+		n, err := writer.Write(&red, append([]byte{media.PayloadType}, payload...), a)
+		if err != nil || len(packets) < v.group {
+			return n, err
+		}
+
+		fec := rtp.Header{
+			Version: 2, PayloadType: uint8(redCodec.PayloadType), SequenceNumber: seq,
+			Timestamp: media.Timestamp, SSRC: media.SSRC,
+		}
+		seq++
+
+		b := ulpfecEncode(snBase, packets)
+		packets = nil
+		if _, err := writer.Write(&fec, append([]byte{uint8(ulpfecCodec.PayloadType)}, b...), a); err != nil {
+			return n, errors.Wrapf(err, "write fec")
+		}
+		return n, nil
+	})
+}
+
+// The interceptor of player, to decapsulate the RED and recover the lost packets by ULPFEC,
+// should be added after the default interceptors, so that NACK is generated for the RED stream.
+type fecDecoderInterceptor struct {
+	stat *statPeerConnection
+	// To stop NACK for the recovered packets.
+	nack *nackInterceptor
+	// Other common fields.
+	bypassInterceptor
+}
+
+func newFECDecoderInterceptor(stat *statPeerConnection, nack *nackInterceptor) *fecDecoderInterceptor {
+	return &fecDecoderInterceptor{stat: stat, nack: nack}
+}
+
+func (v *fecDecoderInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	// The received media packets, by sequence number modulo the window.
+	var received [fecRecoverWindow][]byte
+	find := func(seq uint16) []byte {
+		if pkt := received[seq%fecRecoverWindow]; pkt != nil && binary.BigEndian.Uint16(pkt[2:]) == seq {
+			return pkt
+		}
+		return nil
+	}
+
+	// The recovered packets to read.
+	var recovered [][]byte
+
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		for {
+			if len(recovered) > 0 {
+				n := copy(b, recovered[0])
+				recovered = recovered[1:]
+				return n, a, nil
+			}
+
+			n, a, err := reader.Read(b, a)
+			if err != nil {
+				return n, a, err
+			}
+
+			var pkt rtp.Packet
+			if err := pkt.Unmarshal(b[:n]); err != nil || pkt.PayloadType != uint8(redCodec.PayloadType) {
+				return n, a, nil
+			}
+
+			rtpRemovePadding(&pkt)
+			pt, data, err := redDecapsulate(pkt.Payload)
+			if err != nil {
+				return n, a, nil
+			}
+
+			// Try to recover the media packet by ULPFEC, which is never delivered.
+			if pt == uint8(ulpfecCodec.PayloadType) {
+				seq, lost, err := ulpfecDecode(data, pkt.SSRC, find)
+				v.stat.onFEC(lost != nil)
+				if err == nil && lost != nil {
+					received[seq%fecRecoverWindow] = lost
+					recovered = append(recovered, lost)
+					v.nack.onRecovered(pkt.SSRC, seq)
+				}
+				continue
+			}
+
+			// Drop the duplicated packet, for example, retransmitted after recovered.
+			if find(pkt.SequenceNumber) != nil {
+				continue
+			}
+
+			pkt.PayloadType, pkt.Payload = pt, data
+			media, err := pkt.Marshal()
+			if err != nil {
+				return n, a, nil
+			}
+			received[pkt.SequenceNumber%fecRecoverWindow] = media
+			return copy(b, media), a, nil
+		}
+	})
+}
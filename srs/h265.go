@@ -0,0 +1,421 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/yapingcat/gomedia/codec"
+)
+
+// The MIME type of H.265, which pion does not define.
+const mimeTypeH265 = "video/H265"
+
+// The H.265 codec, pion has no payloader for it, so we must register and packetize by ourselves.
+// @see https://datatracker.ietf.org/doc/html/rfc7798
+var h265Codec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType: mimeTypeH265, ClockRate: 90000,
+		SDPFmtpLine: "level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST",
+		RTCPFeedback: []webrtc.RTCPFeedback{
+			{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"},
+			{Type: "nack"}, {Type: "nack", Parameter: "pli"},
+		},
+	},
+	PayloadType: 49,
+}
+
+// The H.265 NALU types, @see ITU-T H.265 Table 7-1 and RFC 7798.
+const (
+	h265NALUTypeVPS = 32
+	h265NALUTypeSPS = 33
+	h265NALUTypePPS = 34
+	h265NALUTypeAUD = 35
+	h265NALUTypeAP  = 48
+	h265NALUTypeFU  = 49
+)
+
+// The H.265 NALU, without the start code.
+type h265NAL struct {
+	Data []byte
+}
+
+func (v *h265NAL) Type() uint8 {
+	return (v.Data[0] >> 1) & 0x3f
+}
+
+// Whether VCL NALU, which is the slice of picture.
+func (v *h265NAL) IsVCL() bool {
+	return v.Type() < 32
+}
+
+// Whether IRAP, the BLA, IDR and CRA picture, which is keyframe.
+func (v *h265NAL) IsIRAP() bool {
+	return v.Type() >= 16 && v.Type() <= 23
+}
+
+// Whether the first slice segment of picture, the first_slice_segment_in_pic_flag.
+func (v *h265NAL) IsFirstSlice() bool {
+	return v.IsVCL() && len(v.Data) > 2 && v.Data[2]&0x80 != 0
+}
+
+// The reader for H.265 annexb file, like h264reader of pion.
+type h265Reader struct {
+	r *bufio.Reader
+	// The NALU in reading, and the zero bytes which might be start code.
+	nal     []byte
+	zeros   int
+	started bool
+	// The first NALU of next frame, read ahead.
+	next *h265NAL
+}
+
+func newH265Reader(r io.Reader) *h265Reader {
+	return &h265Reader{r: bufio.NewReader(r)}
+}
+
+// Read the next NALU, return io.EOF when done.
+func (v *h265Reader) NextNAL() (*h265NAL, error) {
+	for {
+		b, err := v.r.ReadByte()
+		if err == io.EOF && v.started && len(v.nal) > 0 {
+			nal := &h265NAL{Data: v.nal}
+			v.nal, v.started = nil, false
+			return nal, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if b == 0 {
+			v.zeros++
+			continue
+		}
+
+		// Got start code 0x000001 or 0x00000001.
+		if b == 1 && v.zeros >= 2 {
+			nal, started := v.nal, v.started
+			v.nal, v.zeros, v.started = nil, 0, true
+			if started && len(nal) > 0 {
+				return &h265NAL{Data: nal}, nil
+			}
+			continue
+		}
+
+		for ; v.zeros > 0; v.zeros-- {
+			v.nal = append(v.nal, 0)
+		}
+		v.nal = append(v.nal, b)
+	}
+}
+
+// Read the NALUs of next frame, that is the parameter sets and SEI, then the slices of a picture.
+func (v *h265Reader) NextFrame() ([]*h265NAL, error) {
+	var frame []*h265NAL
+	var hasVCL bool
+	for {
+		nal := v.next
+		v.next = nil
+
+		if nal == nil {
+			var err error
+			if nal, err = v.NextNAL(); err == io.EOF && len(frame) > 0 {
+				return frame, nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if len(nal.Data) < 2 {
+			continue
+		}
+
+		// Got the start of next frame, either a non-VCL or the first slice of a picture.
+		if hasVCL && (!nal.IsVCL() || nal.IsFirstSlice()) {
+			v.next = nal
+			return frame, nil
+		}
+
+		frame = append(frame, nal)
+		hasVCL = hasVCL || nal.IsVCL()
+	}
+}
+
+// Generate the HEVCDecoderConfigurationRecord by VPS, SPS and PPS, with 4 bytes NALU length.
+// @see ISO/IEC 14496-15 8.3.3.1
+func h265HVCC(vps, sps, pps []byte) (hvcc []byte, err error) {
+	// The bitstream panics if overflow.
+	defer func() {
+		if r := recover(); r != nil {
+			hvcc, err = nil, errors.Errorf("invalid vps/sps/pps %v/%v/%v bytes, %v", len(vps), len(sps), len(pps), r)
+		}
+	}()
+
+	// The parameter sets must be in annexb format, with start code.
+	annexb := func(nalu []byte) []byte {
+		return append([]byte{0, 0, 0, 1}, nalu...)
+	}
+
+	c := codec.NewHEVCRecordConfiguration()
+	c.UpdateVPS(annexb(vps))
+	c.UpdateSPS(annexb(sps))
+	c.UpdatePPS(annexb(pps))
+	return c.Encode(), nil
+}
+
+// Package the NALUs, generally VPS/SPS/PPS, as an aggregation packet.
+// @see https://datatracker.ietf.org/doc/html/rfc7798#section-4.4.2
+func packageAsAP(frames ...*h265NAL) *h265NAL {
+	// The F and LayerId is the same, and TID is the lowest of NALUs, which is generally the same.
+	first := frames[0]
+
+	buf := bytes.Buffer{}
+	buf.WriteByte(first.Data[0]&0x81 | h265NALUTypeAP<<1)
+	buf.WriteByte(first.Data[1])
+
+	for _, frame := range frames {
+		buf.WriteByte(byte(len(frame.Data) >> 8))
+		buf.WriteByte(byte(len(frame.Data)))
+		buf.Write(frame.Data)
+	}
+
+	return &h265NAL{Data: buf.Bytes()}
+}
+
+// The H.265 payloader, the payload must be a NALU without start code, which is packetized as
+// single NALU packet, or fragmentation units if exceed the MTU.
+// @see https://datatracker.ietf.org/doc/html/rfc7798#section-4.4
+type h265Payloader struct{}
+
+func (v *h265Payloader) Payload(mtu int, payload []byte) [][]byte {
+	if len(payload) < 3 || mtu <= 3 {
+		return nil
+	}
+
+	if len(payload) <= mtu {
+		return [][]byte{append([]byte{}, payload...)}
+	}
+
+	// The header of FU is the same as NALU, except the type, then the FU header.
+	nalType := (payload[0] >> 1) & 0x3f
+	header0, header1 := payload[0]&0x81|h265NALUTypeFU<<1, payload[1]
+
+	var payloads [][]byte
+	data, maxFragment := payload[2:], mtu-3
+	for first := true; len(data) > 0; first = false {
+		n := maxFragment
+		if n > len(data) {
+			n = len(data)
+		}
+
+		fuHeader := nalType
+		if first {
+			fuHeader |= 0x80
+		}
+		if n == len(data) {
+			fuHeader |= 0x40
+		}
+
+		b := make([]byte, 3+n)
+		b[0], b[1], b[2] = header0, header1, fuHeader
+		copy(b[3:], data[:n])
+		payloads = append(payloads, b)
+
+		data = data[n:]
+	}
+	return payloads
+}
+
+// The H.265 depacketizer, to restore the NALUs from single NALU packet, AP and FU.
+type h265Depacketizer struct {
+	// The NALU in fragmentation, nil if not started.
+	fu []byte
+}
+
+// Unmarshal the RTP payload, return the NALUs without start code, might be empty for FU.
+func (v *h265Depacketizer) Unmarshal(payload []byte) ([][]byte, error) {
+	if len(payload) < 3 {
+		return nil, errors.Errorf("requires 3+ bytes, actual %v", len(payload))
+	}
+
+	switch nalType := (payload[0] >> 1) & 0x3f; nalType {
+	case h265NALUTypeAP:
+		var nals [][]byte
+		for b := payload[2:]; len(b) > 0; {
+			if len(b) < 2 {
+				return nil, errors.Errorf("requires 2 bytes size, actual %v", len(b))
+			}
+
+			size := int(b[0])<<8 | int(b[1])
+			if len(b) < 2+size {
+				return nil, errors.Errorf("requires %v bytes, actual %v", size, len(b)-2)
+			}
+
+			nals = append(nals, b[2:2+size])
+			b = b[2+size:]
+		}
+		return nals, nil
+	case h265NALUTypeFU:
+		fuHeader := payload[2]
+		if fuHeader&0x80 != 0 {
+			fuType := fuHeader & 0x3f
+			v.fu = []byte{payload[0]&0x81 | fuType<<1, payload[1]}
+		} else if v.fu == nil {
+			// Drop the fragments if lost the start one.
+			return nil, nil
+		}
+
+		v.fu = append(v.fu, payload[3:]...)
+		if fuHeader&0x40 == 0 {
+			return nil, nil
+		}
+
+		nal := v.fu
+		v.fu = nil
+		return [][]byte{nal}, nil
+	default:
+		return [][]byte{payload}, nil
+	}
+}
+
+// The H.265 writer, to dump the RTP packets to annexb file, like h264writer of pion.
+type h265Writer struct {
+	w            io.WriteCloser
+	depacketizer h265Depacketizer
+	hasKeyFrame  bool
+}
+
+func newH265Writer(filename string) (*h265Writer, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %v", filename)
+	}
+	return &h265Writer{w: f}, nil
+}
+
+func (v *h265Writer) WriteRTP(p *rtp.Packet) error {
+	nals, err := v.depacketizer.Unmarshal(p.Payload)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshal %v bytes", len(p.Payload))
+	}
+
+	for _, b := range nals {
+		nal := &h265NAL{Data: b}
+
+		// Start to write from the parameter sets or keyframe, like h264writer.
+		if !v.hasKeyFrame {
+			if t := nal.Type(); t != h265NALUTypeVPS && t != h265NALUTypeSPS && t != h265NALUTypePPS && !nal.IsIRAP() {
+				continue
+			}
+			v.hasKeyFrame = true
+		}
+
+		if _, err := v.w.Write([]byte{0x00, 0x00, 0x00, 0x01}); err != nil {
+			return errors.Wrapf(err, "write start code")
+		}
+		if _, err := v.w.Write(b); err != nil {
+			return errors.Wrapf(err, "write %v bytes", len(b))
+		}
+	}
+	return nil
+}
+
+func (v *h265Writer) Close() error {
+	return v.w.Close()
+}
+
+// Ingest the H.265 source file, packetize and write RTP to the track, return io.EOF when done.
+func (v *videoIngester) ingestH265(ctx context.Context, source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return errors.Wrapf(err, "Open file %v", source)
+	}
+	defer f.Close()
+
+	h265 := newH265Reader(f)
+
+	// Keep the packetizer for the sequence number and timestamp to be continuous when restart.
+	if v.packetizer == nil {
+		enc := v.sVideoSender.GetParameters().Encodings[0]
+		v.packetizer = rtp.NewPacketizer(
+			rtpOutboundMTU, uint8(enc.PayloadType), uint32(enc.SSRC), &h265Payloader{}, rtp.NewRandomSequencer(), 90000,
+		)
+	}
+
+	clock := newWallClock()
+	sampleDuration := time.Duration(uint64(time.Millisecond) * 1000 / uint64(v.fps))
+	for ctx.Err() == nil {
+		oFrames, err := h265.NextFrame()
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Read h265")
+		}
+
+		// Package VPS/SPS/PPS to AP, and append other original frames.
+		var frames, params []*h265NAL
+		for _, frame := range oFrames {
+			if t := frame.Type(); t == h265NALUTypeVPS || t == h265NALUTypeSPS || t == h265NALUTypePPS {
+				params = append(params, frame)
+			}
+		}
+		if len(params) > 0 {
+			frames = append(frames, packageAsAP(params...))
+		}
+		for _, frame := range oFrames {
+			if t := frame.Type(); t != h265NALUTypeVPS && t != h265NALUTypeSPS && t != h265NALUTypePPS {
+				frames = append(frames, frame)
+			}
+		}
+
+		for i, frame := range frames {
+			logger.If(ctx, "NALU type=%v, %v bytes", frame.Type(), len(frame.Data))
+
+			// Use the sample timestamp for frames, only the last packet of frame has marker.
+			var samples uint32
+			if i == len(frames)-1 {
+				samples = uint32(sampleDuration.Seconds() * 90000)
+			}
+
+			for _, p := range v.packetizer.Packetize(frame.Data, samples) {
+				p.Marker = p.Marker && i == len(frames)-1
+				if err = v.sVideoTrackRTP.WriteRTP(p); err != nil {
+					return errors.Wrapf(err, "Write RTP")
+				}
+			}
+		}
+
+		if d := clock.Tick(sampleDuration); d > 0 {
+			time.Sleep(d)
+		}
+	}
+
+	return ctx.Err()
+}
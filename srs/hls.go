@@ -0,0 +1,884 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// Whether the url is HLS, like "http://localhost:8080/live/livestream.m3u8", to play by HLS rather
+// than WHEP or HTTP-FLV.
+func isHLSURL(r string) bool {
+	if !strings.HasPrefix(r, "http://") && !strings.HasPrefix(r, "https://") {
+		return false
+	}
+
+	u, err := url.Parse(r)
+	return err == nil && strings.HasSuffix(u.Path, ".m3u8")
+}
+
+// The variant stream of master playlist.
+type hlsVariant struct {
+	bandwidth int
+	uri       string
+}
+
+type hlsMasterPlaylist struct {
+	variants []*hlsVariant
+}
+
+// The partial segment of LL-HLS, the duration is in seconds.
+type hlsPart struct {
+	uri         string
+	duration    float64
+	independent bool
+}
+
+// The media segment, the discontinuity is whether there is a EXT-X-DISCONTINUITY before it. The
+// program date time is from EXT-X-PROGRAM-DATE-TIME, or deduced from the previous segment, zero if
+// unknown. The parts are the partial segments of LL-HLS, which might be removed for old segments.
+type hlsSegment struct {
+	uri             string
+	duration        float64
+	sequence        uint64
+	discontinuity   bool
+	programDateTime time.Time
+	parts           []*hlsPart
+}
+
+// The media playlist, the LL-HLS fields are the part target, the parts of the open segment whose
+// sequence is EndSequence(), and the URI of EXT-X-PRELOAD-HINT.
+// @see https://datatracker.ietf.org/doc/html/draft-pantos-hls-rfc8216bis#section-4.4.3.7
+type hlsMediaPlaylist struct {
+	version               int
+	targetDuration        int
+	mediaSequence         uint64
+	discontinuitySequence uint64
+	endList               bool
+	segments              []*hlsSegment
+	// The LL-HLS, the part target and hold back are in seconds.
+	partTarget     float64
+	partHoldBack   float64
+	canBlockReload bool
+	openParts      []*hlsPart
+	openDateTime   time.Time
+	preloadHint    string
+}
+
+// Whether it's LL-HLS, which is able to play by parts.
+func (v *hlsMediaPlaylist) IsLowLatency() bool {
+	return v.partTarget > 0
+}
+
+// The duration of part target in time, at least 100ms to avoid reloading too fast.
+func (v *hlsMediaPlaylist) PartTarget() time.Duration {
+	if d := time.Duration(v.partTarget * float64(time.Second)); d > 100*time.Millisecond {
+		return d
+	}
+	return 100 * time.Millisecond
+}
+
+// The duration of target in time, at least 1s to avoid reloading too fast.
+func (v *hlsMediaPlaylist) Target() time.Duration {
+	if v.targetDuration < 1 {
+		return time.Second
+	}
+	return time.Duration(v.targetDuration) * time.Second
+}
+
+// The sequence after the last segment, which is the media sequence if no segment.
+func (v *hlsMediaPlaylist) EndSequence() uint64 {
+	return v.mediaSequence + uint64(len(v.segments))
+}
+
+// Parse the master or media playlist, and check the compliance of RFC 8216, for example, the tags
+// of master and media playlist should not be mixed, and the EXTINF should not exceed the target.
+// @see https://datatracker.ietf.org/doc/html/rfc8216#section-4
+func parseHLSPlaylist(b []byte) (*hlsMasterPlaylist, *hlsMediaPlaylist, error) {
+	master, media := &hlsMasterPlaylist{}, &hlsMediaPlaylist{version: 1, targetDuration: -1}
+
+	var isMaster, isMedia bool
+	var variant *hlsVariant
+	var segment *hlsSegment
+	var parts []*hlsPart
+	var floatDuration bool
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for i := 0; s.Scan(); i++ {
+		line := strings.TrimSpace(s.Text())
+		if i == 0 {
+			if line != "#EXTM3U" {
+				return nil, nil, errors.Errorf("the first line should be #EXTM3U, actual %v", line)
+			}
+			continue
+		}
+		if line == "" || (strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "#EXT")) {
+			continue
+		}
+
+		tag, value := line, ""
+		if index := strings.Index(line, ":"); index > 0 && strings.HasPrefix(line, "#") {
+			tag, value = line[:index], line[index+1:]
+		}
+
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			isMaster = true
+			variant = &hlsVariant{}
+			if v, ok := parseHLSAttributes(value)["BANDWIDTH"]; !ok {
+				return nil, nil, errors.Errorf("no BANDWIDTH in %v", line)
+			} else if bandwidth, err := strconv.Atoi(v); err != nil {
+				return nil, nil, errors.Wrapf(err, "parse BANDWIDTH %v", v)
+			} else {
+				variant.bandwidth = bandwidth
+			}
+		case "#EXT-X-VERSION":
+			version, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "parse %v", line)
+			}
+			media.version = version
+		case "#EXT-X-TARGETDURATION":
+			isMedia = true
+			target, err := strconv.Atoi(value)
+			if err != nil || target < 0 {
+				return nil, nil, errors.Errorf("invalid %v, err %v", line, err)
+			}
+			media.targetDuration = target
+		case "#EXT-X-MEDIA-SEQUENCE", "#EXT-X-DISCONTINUITY-SEQUENCE":
+			isMedia = true
+			if len(media.segments) > 0 || segment != nil {
+				return nil, nil, errors.Errorf("%v should be before the first segment", tag)
+			}
+			sequence, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "parse %v", line)
+			}
+			if tag == "#EXT-X-MEDIA-SEQUENCE" {
+				media.mediaSequence = sequence
+			} else {
+				media.discontinuitySequence = sequence
+			}
+		case "#EXTINF":
+			isMedia = true
+			if segment == nil {
+				segment = &hlsSegment{}
+			} else if segment.duration > 0 {
+				return nil, nil, errors.Errorf("duplicated EXTINF %v", line)
+			}
+			duration := strings.SplitN(value, ",", 2)[0]
+			d, err := strconv.ParseFloat(duration, 64)
+			if err != nil || d <= 0 {
+				return nil, nil, errors.Errorf("invalid %v, err %v", line, err)
+			}
+			segment.duration = d
+			floatDuration = floatDuration || strings.Contains(duration, ".")
+		case "#EXT-X-DISCONTINUITY":
+			isMedia = true
+			if segment == nil {
+				segment = &hlsSegment{}
+			}
+			segment.discontinuity = true
+		case "#EXT-X-PROGRAM-DATE-TIME":
+			isMedia = true
+			if segment == nil {
+				segment = &hlsSegment{}
+			}
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "parse %v", line)
+			}
+			segment.programDateTime = t
+		case "#EXT-X-ENDLIST":
+			isMedia = true
+			media.endList = true
+		case "#EXT-X-PART-INF":
+			isMedia = true
+			target, err := strconv.ParseFloat(parseHLSAttributes(value)["PART-TARGET"], 64)
+			if err != nil || target <= 0 {
+				return nil, nil, errors.Errorf("invalid %v, err %v", line, err)
+			}
+			media.partTarget = target
+		case "#EXT-X-SERVER-CONTROL":
+			isMedia = true
+			attrs := parseHLSAttributes(value)
+			media.canBlockReload = attrs["CAN-BLOCK-RELOAD"] == "YES"
+			if v, ok := attrs["PART-HOLD-BACK"]; ok {
+				holdBack, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return nil, nil, errors.Wrapf(err, "parse PART-HOLD-BACK %v", v)
+				}
+				media.partHoldBack = holdBack
+			}
+		case "#EXT-X-PART":
+			isMedia = true
+			attrs := parseHLSAttributes(value)
+			duration, err := strconv.ParseFloat(attrs["DURATION"], 64)
+			if err != nil || duration <= 0 || attrs["URI"] == "" {
+				return nil, nil, errors.Errorf("invalid %v, err %v", line, err)
+			}
+			parts = append(parts, &hlsPart{uri: attrs["URI"], duration: duration, independent: attrs["INDEPENDENT"] == "YES"})
+		case "#EXT-X-PRELOAD-HINT":
+			isMedia = true
+			if attrs := parseHLSAttributes(value); attrs["TYPE"] == "PART" {
+				media.preloadHint = attrs["URI"]
+			}
+		default:
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			// The URI line, for variant or segment.
+			if variant != nil {
+				variant.uri = line
+				master.variants, variant = append(master.variants, variant), nil
+				continue
+			}
+			if segment == nil || segment.duration <= 0 {
+				return nil, nil, errors.Errorf("no EXTINF for %v", line)
+			}
+			segment.uri, segment.sequence = line, media.mediaSequence+uint64(len(media.segments))
+			segment.parts, parts = parts, nil
+			media.segments, segment = append(media.segments, segment), nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, errors.Wrapf(err, "scan")
+	}
+
+	if isMaster && isMedia {
+		return nil, nil, errors.Errorf("mixed master and media tags")
+	}
+	if isMaster {
+		if variant != nil {
+			return nil, nil, errors.Errorf("no URI for the last EXT-X-STREAM-INF")
+		}
+		return master, nil, nil
+	}
+
+	if media.targetDuration < 0 {
+		return nil, nil, errors.Errorf("no EXT-X-TARGETDURATION")
+	}
+	if segment != nil && segment.duration > 0 {
+		return nil, nil, errors.Errorf("no URI for the last segment")
+	}
+	if floatDuration && media.version < 3 {
+		return nil, nil, errors.Errorf("decimal EXTINF requires version 3, actual %v", media.version)
+	}
+	for i, segment := range media.segments {
+		if int(math.Round(segment.duration)) > media.targetDuration {
+			return nil, nil, errors.Errorf("segment %v duration %v exceeds target %v",
+				segment.sequence, segment.duration, media.targetDuration)
+		}
+
+		// Deduce the program date time from the previous segment, if not discontinuity.
+		if i == 0 || !segment.programDateTime.IsZero() || segment.discontinuity {
+			continue
+		}
+		if prev := media.segments[i-1]; !prev.programDateTime.IsZero() {
+			segment.programDateTime = prev.programDateTime.Add(time.Duration(prev.duration * float64(time.Second)))
+		}
+	}
+
+	// The parts after the last segment, belong to the open segment.
+	media.openParts = parts
+	if segment != nil && !segment.programDateTime.IsZero() {
+		media.openDateTime = segment.programDateTime
+	} else if n := len(media.segments); n > 0 && !media.segments[n-1].programDateTime.IsZero() {
+		last := media.segments[n-1]
+		media.openDateTime = last.programDateTime.Add(time.Duration(last.duration * float64(time.Second)))
+	}
+
+	// The parts should not exceed the part target, and the hold back should be at least 2 part targets.
+	// @see https://datatracker.ietf.org/doc/html/draft-pantos-hls-rfc8216bis#section-4.4.3.7
+	if media.partTarget == 0 && media.preloadHint != "" {
+		return nil, nil, errors.Errorf("EXT-X-PRELOAD-HINT without EXT-X-PART-INF")
+	}
+	if media.partHoldBack > 0 && media.partHoldBack < 2*media.partTarget {
+		return nil, nil, errors.Errorf("PART-HOLD-BACK %v should be at least 2*PART-TARGET %v",
+			media.partHoldBack, media.partTarget)
+	}
+	for _, segment := range append(media.segments, &hlsSegment{sequence: media.EndSequence(), parts: media.openParts}) {
+		for _, part := range segment.parts {
+			if media.partTarget == 0 {
+				return nil, nil, errors.Errorf("EXT-X-PART without EXT-X-PART-INF")
+			}
+			if part.duration > media.partTarget {
+				return nil, nil, errors.Errorf("part %v of segment %v duration %v exceeds target %v",
+					part.uri, segment.sequence, part.duration, media.partTarget)
+			}
+		}
+	}
+	return nil, media, nil
+}
+
+// Parse the attribute list, like BANDWIDTH=1280000,CODECS="avc1.64001f,mp4a.40.2", the quoted
+// value might contain comma.
+func parseHLSAttributes(value string) map[string]string {
+	attrs := make(map[string]string)
+	for len(value) > 0 {
+		index := strings.Index(value, "=")
+		if index <= 0 {
+			break
+		}
+		key := strings.TrimSpace(value[:index])
+		value = value[index+1:]
+
+		var v string
+		if strings.HasPrefix(value, "\"") {
+			if end := strings.Index(value[1:], "\""); end >= 0 {
+				v, value = value[1:end+1], value[end+2:]
+			} else {
+				v, value = value[1:], ""
+			}
+		} else if end := strings.Index(value, ","); end >= 0 {
+			v, value = value[:end], value[end:]
+		} else {
+			v, value = value, ""
+		}
+		attrs[key] = v
+
+		value = strings.TrimPrefix(value, ",")
+	}
+	return attrs
+}
+
+// Check the reloaded playlist with the previous one, the media and discontinuity sequence should never
+// decrease, and the segment of the same sequence should be the same URI.
+// @see https://datatracker.ietf.org/doc/html/rfc8216#section-6.2.2
+func checkHLSReload(prev, cur *hlsMediaPlaylist) error {
+	if cur.mediaSequence < prev.mediaSequence {
+		return errors.Errorf("media sequence decrease from %v to %v", prev.mediaSequence, cur.mediaSequence)
+	}
+	if cur.discontinuitySequence < prev.discontinuitySequence {
+		return errors.Errorf("discontinuity sequence decrease from %v to %v",
+			prev.discontinuitySequence, cur.discontinuitySequence)
+	}
+	if prev.endList && (!cur.endList || len(cur.segments) != len(prev.segments)) {
+		return errors.Errorf("playlist changed after EXT-X-ENDLIST")
+	}
+
+	// The discontinuities removed from the playlist should be counted in discontinuity sequence.
+	var removed uint64
+	for _, segment := range prev.segments {
+		if segment.sequence >= cur.mediaSequence {
+			break
+		}
+		if segment.discontinuity {
+			removed++
+		}
+	}
+	if cur.discontinuitySequence < prev.discontinuitySequence+removed {
+		return errors.Errorf("discontinuity sequence %v should be %v+%v",
+			cur.discontinuitySequence, prev.discontinuitySequence, removed)
+	}
+
+	for _, segment := range cur.segments {
+		if segment.sequence < prev.mediaSequence || segment.sequence >= prev.EndSequence() {
+			continue
+		}
+		if old := prev.segments[segment.sequence-prev.mediaSequence]; old.uri != segment.uri {
+			return errors.Errorf("segment %v changed from %v to %v", segment.sequence, old.uri, segment.uri)
+		}
+	}
+	return nil
+}
+
+// The HLS player, which reloads the media playlist and fetches the segments like a real player, and
+// checks the compliance of playlist and segments. For LL-HLS, it requests the playlist by blocking
+// reload, and fetches the parts and preload hints.
+// @see https://datatracker.ietf.org/doc/html/rfc8216#section-6.3
+// @see https://datatracker.ietf.org/doc/html/draft-pantos-hls-rfc8216bis#section-6.2.5.2
+type hlsPlayer struct {
+	client *http.Client
+	// The url of media playlist, which might be a variant of master playlist.
+	media *url.URL
+	// The last playlist, nil if not loaded.
+	prev *hlsMediaPlaylist
+	// The next segment to fetch, and the next part of it for LL-HLS.
+	next, nextPart uint64
+	// The URI of fetched preload hint, and the time when it's done.
+	hint     string
+	hintDone time.Time
+	// The playback clock, to keep the buffer for VOD.
+	playStart time.Time
+	buffered  time.Duration
+	// The time of last new segment, to detect stale playlist.
+	lastChanged   time.Time
+	staleReported bool
+	// The stat of this player.
+	reloads, segments, parts, discontinuities, stale, notFound, violations uint64
+}
+
+func newHLSPlayer(config *tls.Config) *hlsPlayer {
+	return &hlsPlayer{client: newHTTPPlayerClient(config)}
+}
+
+func (v *hlsPlayer) Close() error {
+	v.client.CloseIdleConnections()
+	return nil
+}
+
+// Create the HTTP client for a player of HLS or DASH, each player uses its own connections, to
+// simulate viewers.
+func newHTTPPlayerClient(config *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}
+}
+
+// The error of HTTP status 404.
+var errHTTPNotFound = errors.New("not found")
+
+// Fetch the url, return errHTTPNotFound if 404.
+func fetchHTTP(ctx context.Context, client *http.Client, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "new request %v", u.String())
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %v", u.String())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errors.Wrapf(errHTTPNotFound, "get %v", u.String())
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("get %v, status=%v", u.String(), res.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", u.String())
+	}
+	return b, nil
+}
+
+// Count the failure of request, the 404 or other errors.
+func (v *hlsPlayer) onFailure(err error) {
+	if errors.Cause(err) == errHTTPNotFound {
+		v.notFound++
+		gStatRTC.HLS.onNotFound()
+	} else {
+		gStatRTC.HLS.onError()
+	}
+}
+
+// Load the playlist, and choose the variant of the highest bandwidth if master playlist.
+func (v *hlsPlayer) load(ctx context.Context, u *url.URL) (*hlsMediaPlaylist, error) {
+	b, err := fetchHTTP(ctx, v.client, u)
+	if err != nil {
+		return nil, err
+	}
+
+	master, media, err := parseHLSPlaylist(b)
+	if err != nil {
+		v.violations++
+		gStatRTC.HLS.onViolation()
+		return nil, errors.Wrapf(err, "parse %v", u.String())
+	}
+	if media != nil {
+		return media, nil
+	}
+	if v.media != nil {
+		return nil, errors.Errorf("variant %v is master playlist", u.String())
+	}
+
+	if len(master.variants) == 0 {
+		return nil, errors.Errorf("no variant in %v", u.String())
+	}
+	variant := master.variants[0]
+	for _, vr := range master.variants[1:] {
+		if vr.bandwidth > variant.bandwidth {
+			variant = vr
+		}
+	}
+
+	ref, err := url.Parse(variant.uri)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse variant %v", variant.uri)
+	}
+	logger.Tf(ctx, "HLS choose variant %v of %v, bandwidth=%v", variant.uri, len(master.variants), variant.bandwidth)
+
+	v.media = u.ResolveReference(ref)
+	return v.load(ctx, v.media)
+}
+
+// Reload the media playlist. For LL-HLS of blocking reload, request the playlist which contains the
+// next part by _HLS_msn and _HLS_part, which should be responded in 3 target durations.
+func (v *hlsPlayer) reload(ctx context.Context) (*hlsMediaPlaylist, error) {
+	if v.prev == nil || !v.prev.canBlockReload || v.prev.endList {
+		return v.load(ctx, v.media)
+	}
+
+	u := *v.media
+	q := u.Query()
+	q.Set("_HLS_msn", strconv.FormatUint(v.next, 10))
+	if v.prev.IsLowLatency() {
+		q.Set("_HLS_part", strconv.FormatUint(v.nextPart, 10))
+	}
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*v.prev.Target())
+	defer cancel()
+
+	media, err := v.load(ctx, &u)
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return media, err
+	}
+
+	// The blocking reload is not responded in time, the playlist is stale.
+	v.stale++
+	gStatRTC.HLS.onStale()
+	return nil, errors.Errorf("blocking reload msn=%v, part=%v timeout", v.next, v.nextPart)
+}
+
+// Fetch the segment or part, check it and report the end-to-end latency by the program date time of
+// its end. The MPEG-TS should be packets of 188 bytes.
+func (v *hlsPlayer) fetchMedia(ctx context.Context, uri string, end time.Time) (int, error) {
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse %v", uri)
+	}
+
+	start := time.Now()
+	b, err := fetchHTTP(ctx, v.client, v.media.ResolveReference(ref))
+	if err != nil {
+		return 0, err
+	}
+
+	if strings.HasSuffix(ref.Path, ".ts") && (len(b) == 0 || len(b)%188 != 0 || b[0] != 0x47) {
+		v.violations++
+		gStatRTC.HLS.onViolation()
+		logger.Wf(ctx, "HLS %v is not MPEG-TS, %vB", uri, len(b))
+	}
+
+	if !end.IsZero() {
+		gStatRTC.HLS.latency.onLatency(time.Since(end))
+	}
+	gStatRTC.HLS.onFetch(len(b), time.Since(start))
+	return len(b), nil
+}
+
+func (v *hlsPlayer) fetchSegment(ctx context.Context, segment *hlsSegment) error {
+	var end time.Time
+	if !segment.programDateTime.IsZero() {
+		end = segment.programDateTime.Add(time.Duration(segment.duration * float64(time.Second)))
+	}
+
+	if _, err := v.fetchMedia(ctx, segment.uri, end); err != nil {
+		return errors.Wrapf(err, "segment %v", segment.sequence)
+	}
+
+	if v.segments++; segment.discontinuity {
+		v.discontinuities++
+		logger.Tf(ctx, "HLS discontinuity at segment %v, %v", segment.sequence, segment.uri)
+	}
+	gStatRTC.HLS.onSegment(segment.discontinuity)
+	return nil
+}
+
+// Check the playlist with the previous one, and report stale if no new segment for 1.5 times the
+// target duration. Return whether there is new segment or part.
+func (v *hlsPlayer) check(ctx context.Context, media *hlsMediaPlaylist) bool {
+	prev := v.prev
+	if prev != nil {
+		if err := checkHLSReload(prev, media); err != nil {
+			v.violations++
+			gStatRTC.HLS.onViolation()
+			logger.Wf(ctx, "HLS reload violation %+v", err)
+		}
+	}
+
+	changed := prev == nil || media.EndSequence() > prev.EndSequence() || media.endList
+	if changed {
+		v.lastChanged, v.staleReported = time.Now(), false
+	} else if d := time.Since(v.lastChanged); d > media.Target()*3/2 && !v.staleReported {
+		v.stale++
+		gStatRTC.HLS.onStale()
+		logger.Wf(ctx, "HLS playlist stale for %v, target=%vs, end=%v", d, media.targetDuration, media.EndSequence())
+		v.staleReported = true
+	}
+
+	return changed || len(media.openParts) > len(prev.openParts)
+}
+
+// Start from 3 target durations from the end for live, or the first for VOD. For LL-HLS, start from
+// the part of hold back, or 3 part targets, from the end, and prefer the independent part.
+func (v *hlsPlayer) start(ctx context.Context, media *hlsMediaPlaylist) {
+	v.next, v.nextPart, v.playStart, v.lastChanged = media.mediaSequence, 0, time.Now(), time.Now()
+
+	if media.endList {
+	} else if media.IsLowLatency() {
+		type position struct {
+			sequence, index uint64
+			part            *hlsPart
+		}
+		var positions []position
+		for _, segment := range append(media.segments, &hlsSegment{sequence: media.EndSequence(), parts: media.openParts}) {
+			for i, part := range segment.parts {
+				positions = append(positions, position{segment.sequence, uint64(i), part})
+			}
+		}
+
+		holdBack := media.partHoldBack
+		if holdBack <= 0 {
+			holdBack = 3 * media.partTarget
+		}
+
+		v.next = media.EndSequence()
+		for i, d := len(positions)-1, 0.0; i >= 0; i-- {
+			if d += positions[i].part.duration; d < holdBack {
+				continue
+			}
+			for ; i > 0 && !positions[i].part.independent; i-- {
+			}
+			v.next, v.nextPart = positions[i].sequence, positions[i].index
+			break
+		}
+	} else {
+		for i, d := len(media.segments)-1, 0.0; i >= 0; i-- {
+			if d += media.segments[i].duration; d >= float64(3*media.targetDuration) {
+				v.next = media.segments[i].sequence
+				break
+			}
+		}
+	}
+
+	logger.Tf(ctx, "HLS play %v, target=%vs, part=%vs, block=%v, sequence=%v, segments=%v, start=%v/%v, vod=%v",
+		v.media.String(), media.targetDuration, media.partTarget, media.canBlockReload, media.mediaSequence,
+		len(media.segments), v.next, v.nextPart, media.endList)
+}
+
+// Fetch the segments from the next one, keep about 3 target durations in buffer for VOD.
+func (v *hlsPlayer) playSegments(ctx context.Context, media *hlsMediaPlaylist) {
+	for _, segment := range media.segments {
+		if segment.sequence < v.next || ctx.Err() != nil {
+			continue
+		}
+
+		if d := v.buffered - time.Since(v.playStart) - 3*media.Target(); d > 0 {
+			select {
+			case <-ctx.Done():
+				continue
+			case <-time.After(d):
+			}
+		}
+
+		if err := v.fetchSegment(ctx, segment); err != nil && ctx.Err() == nil {
+			v.onFailure(err)
+			logger.Wf(ctx, "HLS fetch err %+v", err)
+		}
+
+		v.next = segment.sequence + 1
+		v.buffered += time.Duration(segment.duration * float64(time.Second))
+	}
+}
+
+// Fetch the parts from the next one, or the whole segment if its parts are removed. Then fetch the
+// preload hint, which blocks until the part is available.
+func (v *hlsPlayer) playParts(ctx context.Context, media *hlsMediaPlaylist) {
+	open := &hlsSegment{sequence: media.EndSequence(), parts: media.openParts, programDateTime: media.openDateTime}
+	for _, segment := range append(media.segments, open) {
+		if segment.sequence < v.next || ctx.Err() != nil {
+			continue
+		}
+		if segment.sequence > v.next {
+			v.next, v.nextPart = segment.sequence, 0
+		}
+
+		// The parts of old segment is removed, fetch the whole segment.
+		if len(segment.parts) == 0 && segment != open {
+			if err := v.fetchSegment(ctx, segment); err != nil && ctx.Err() == nil {
+				v.onFailure(err)
+				logger.Wf(ctx, "HLS fetch err %+v", err)
+			}
+			v.next, v.nextPart = segment.sequence+1, 0
+			continue
+		}
+
+		offset := 0.0
+		for i, part := range segment.parts {
+			offset += part.duration
+			if uint64(i) < v.nextPart || ctx.Err() != nil {
+				continue
+			}
+
+			var end time.Time
+			if !segment.programDateTime.IsZero() {
+				end = segment.programDateTime.Add(time.Duration(offset * float64(time.Second)))
+			}
+
+			// The part is fetched by preload hint, only measure the latency.
+			if part.uri == v.hint {
+				if !end.IsZero() {
+					gStatRTC.HLS.latency.onLatency(v.hintDone.Sub(end))
+				}
+			} else if _, err := v.fetchMedia(ctx, part.uri, end); err != nil {
+				if ctx.Err() == nil {
+					v.onFailure(err)
+					logger.Wf(ctx, "HLS fetch part %v of %v err %+v", i, segment.sequence, err)
+				}
+			}
+
+			v.parts++
+			gStatRTC.HLS.onPart()
+			v.nextPart = uint64(i) + 1
+		}
+
+		if segment != open {
+			if v.segments++; segment.discontinuity {
+				v.discontinuities++
+				logger.Tf(ctx, "HLS discontinuity at segment %v, %v", segment.sequence, segment.uri)
+			}
+			gStatRTC.HLS.onSegment(segment.discontinuity)
+			v.next, v.nextPart = segment.sequence+1, 0
+		}
+	}
+
+	// Fetch the preload hint, which is the next part.
+	if media.preloadHint == "" || media.preloadHint == v.hint || ctx.Err() != nil {
+		return
+	}
+	if _, err := v.fetchMedia(ctx, media.preloadHint, time.Time{}); err != nil {
+		if ctx.Err() == nil {
+			v.onFailure(err)
+			logger.Wf(ctx, "HLS fetch preload hint err %+v", err)
+		}
+		return
+	}
+	v.hint, v.hintDone = media.preloadHint, time.Now()
+}
+
+// Play the HLS url, reload the media playlist every target duration, or half of it if unchanged. For
+// live stream, start from the segment which is at least 3 target durations from the end, and report
+// stale if no new segment for 1.5 times target duration. For VOD, fetch the segments to keep about 3
+// target durations in buffer, and quit when all segments are fetched. For LL-HLS, fetch the parts and
+// preload hints, and reload by blocking request without waiting.
+func startHLSPlay(ctx context.Context, r string, config *tls.Config) error {
+	ctx = logger.WithContext(ctx)
+
+	logger.Tf(ctx, "Run HLS play url=%v", r)
+
+	u, err := url.Parse(r)
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", r)
+	}
+
+	player := newHLSPlayer(config)
+	defer player.Close()
+
+	gStatRTC.HLS.onPlay()
+	defer func() {
+		logger.Tf(ctx, "HLS play done, reloads=%v, segments=%v, parts=%v, discontinuities=%v, stale=%v, 404=%v, violations=%v",
+			player.reloads, player.segments, player.parts, player.discontinuities, player.stale, player.notFound, player.violations)
+	}()
+
+	for ctx.Err() == nil {
+		// The default interval to retry, if failed to load the playlist.
+		interval := time.Second
+		if player.prev != nil {
+			interval = player.prev.Target() / 2
+		}
+
+		reloadStart := time.Now()
+		var media *hlsMediaPlaylist
+		if player.media == nil {
+			if media, err = player.load(ctx, u); err == nil && player.media == nil {
+				player.media = u
+			}
+		} else {
+			media, err = player.reload(ctx)
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			player.onFailure(err)
+			logger.Wf(ctx, "HLS load playlist err %+v", err)
+		} else {
+			player.reloads++
+			gStatRTC.HLS.onReload()
+
+			if player.prev == nil {
+				player.start(ctx, media)
+			}
+			changed := player.check(ctx, media)
+
+			// The segments expired before fetched, the player is too slow.
+			if player.next < media.mediaSequence {
+				logger.Wf(ctx, "HLS skip segments %v to %v, expired", player.next, media.mediaSequence-1)
+				player.next, player.nextPart = media.mediaSequence, 0
+			}
+
+			if media.IsLowLatency() && !media.endList {
+				player.playParts(ctx, media)
+			} else {
+				player.playSegments(ctx, media)
+			}
+
+			if media.endList && player.next >= media.EndSequence() {
+				return nil
+			}
+
+			// Reload immediately for blocking reload, or every part target for LL-HLS, or every target.
+			switch {
+			case media.canBlockReload && changed:
+				interval = 0
+			case media.IsLowLatency() && changed:
+				interval = media.PartTarget()
+			case media.IsLowLatency():
+				interval = media.PartTarget() / 2
+			case changed:
+				interval = media.Target()
+			default:
+				interval = media.Target() / 2
+			}
+			player.prev = media
+		}
+
+		// Reload the playlist, measured from the last time began loading.
+		if d := interval - time.Since(reloadStart); d > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(d):
+			}
+		}
+	}
+	return nil
+}
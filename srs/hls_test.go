@@ -0,0 +1,284 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+func TestHlsPlaylist(t *testing.T) {
+	if err := func() error {
+		if !isHLSURL("http://localhost:8080/live/livestream.m3u8?token=x") || isHLSURL("http://localhost:8080/live/livestream.flv") {
+			return errors.New("invalid url type")
+		}
+
+		master, media, err := parseHLSPlaylist([]byte("#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS=\"avc1.64001f,mp4a.40.2\",RESOLUTION=640x360\nlow/index.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=2400000,CODECS=\"avc1.640028,mp4a.40.2\"\nhigh/index.m3u8\n"))
+		if err != nil {
+			return errors.Wrapf(err, "parse master")
+		}
+		if media != nil || len(master.variants) != 2 || master.variants[1].bandwidth != 2400000 || master.variants[1].uri != "high/index.m3u8" {
+			return errors.Errorf("invalid master %+v", master)
+		}
+
+		_, media, err = parseHLSPlaylist([]byte("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-MEDIA-SEQUENCE:10\n#EXT-X-TARGETDURATION:5\n" +
+			"#EXTINF:4.960, no desc\nlivestream-10.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:5.2\nlivestream-11.ts\n"))
+		if err != nil {
+			return errors.Wrapf(err, "parse media")
+		}
+		if media.targetDuration != 5 || media.EndSequence() != 12 || media.endList || len(media.segments) != 2 {
+			return errors.Errorf("invalid media %+v", media)
+		}
+		if s := media.segments[1]; s.sequence != 11 || !s.discontinuity || s.duration != 5.2 || s.uri != "livestream-11.ts" {
+			return errors.Errorf("invalid segment %+v", s)
+		}
+
+		for _, b := range []string{
+			"#EXT-X-TARGETDURATION:5\n#EXTINF:5,\na.ts\n",
+			"#EXTM3U\n#EXTINF:5,\na.ts\n",
+			"#EXTM3U\n#EXT-X-TARGETDURATION:5\n#EXTINF:5.6,\na.ts\n",
+			"#EXTM3U\n#EXT-X-TARGETDURATION:5\n#EXTINF:4.5,\na.ts\n",
+			"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:5\n#EXTINF:5,\na.ts\n#EXT-X-MEDIA-SEQUENCE:1\n",
+			"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:5\na.ts\n",
+			"#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nlow.m3u8\n#EXT-X-TARGETDURATION:5\n",
+			"#EXTM3U\n#EXT-X-STREAM-INF:RESOLUTION=640x360\nlow.m3u8\n",
+		} {
+			if _, _, err := parseHLSPlaylist([]byte(b)); err == nil {
+				return errors.Errorf("should fail for %v", b)
+			}
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestHlsReload(t *testing.T) {
+	if err := func() error {
+		parse := func(sequence, discontinuity int, segments ...string) *hlsMediaPlaylist {
+			b := fmt.Sprintf("#EXTM3U\n#EXT-X-TARGETDURATION:5\n#EXT-X-MEDIA-SEQUENCE:%v\n#EXT-X-DISCONTINUITY-SEQUENCE:%v\n",
+				sequence, discontinuity)
+			for _, segment := range segments {
+				if strings.HasPrefix(segment, "!") {
+					b, segment = b+"#EXT-X-DISCONTINUITY\n", segment[1:]
+				}
+				b += fmt.Sprintf("#EXTINF:5,\n%v\n", segment)
+			}
+			_, media, _ := parseHLSPlaylist([]byte(b))
+			return media
+		}
+
+		prev := parse(1, 0, "1.ts", "!2.ts", "3.ts")
+		if err := checkHLSReload(prev, parse(2, 1, "2.ts", "3.ts", "4.ts")); err != nil {
+			return errors.Wrapf(err, "should ok")
+		}
+		if err := checkHLSReload(prev, parse(3, 1, "3.ts", "4.ts")); err != nil {
+			return errors.Wrapf(err, "should ok for discontinuity removed")
+		}
+		for i, cur := range []*hlsMediaPlaylist{
+			parse(0, 0, "0.ts", "1.ts"),
+			parse(3, 0, "3.ts", "4.ts"),
+			parse(2, 0, "2.ts", "3x.ts", "4.ts"),
+		} {
+			if err := checkHLSReload(prev, cur); err == nil {
+				return errors.Errorf("should fail for %v", i)
+			}
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestHlsPlay(t *testing.T) {
+	if err := func() error {
+		// The VOD of two TS segments and a 404 segment, by master playlist.
+		var requests []string
+		var lock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			requests = append(requests, r.URL.Path)
+			lock.Unlock()
+
+			switch r.URL.Path {
+			case "/live/livestream.m3u8":
+				w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nhd/index.m3u8\n"))
+			case "/live/hd/index.m3u8":
+				w.Write([]byte("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXTINF:1.0,\n0.ts\n" +
+					"#EXTINF:1.0,\n1.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:1.0,\n2.ts\n#EXT-X-ENDLIST\n"))
+			case "/live/hd/0.ts", "/live/hd/2.ts":
+				b := make([]byte, 188*2)
+				b[0], b[188] = 0x47, 0x47
+				w.Write(b)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+
+		_, _, segments, _, discontinuities, _, notFound, violations, _, _ := gStatRTC.HLS.Stat()
+		if err := startHLSPlay(context.Background(), server.URL+"/live/livestream.m3u8", nil); err != nil {
+			return errors.Wrapf(err, "play")
+		}
+
+		_, _, segments2, _, discontinuities2, _, notFound2, violations2, _, _ := gStatRTC.HLS.Stat()
+		if segments2 != segments+2 || discontinuities2 != discontinuities+1 || notFound2 != notFound+1 || violations2 != violations {
+			return errors.Errorf("invalid segments=%v, discontinuities=%v, 404=%v, violations=%v",
+				segments2-segments, discontinuities2-discontinuities, notFound2-notFound, violations2-violations)
+		}
+		if len(requests) != 5 || requests[1] != "/live/hd/index.m3u8" || requests[4] != "/live/hd/2.ts" {
+			return errors.Errorf("invalid requests %v", requests)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestHlsLowLatency(t *testing.T) {
+	if err := func() error {
+		_, media, err := parseHLSPlaylist([]byte("#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:1\n" +
+			"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.6\n#EXT-X-PART-INF:PART-TARGET=0.2\n" +
+			"#EXT-X-PROGRAM-DATE-TIME:2021-01-01T00:00:00.000Z\n" +
+			"#EXT-X-PART:DURATION=0.2,URI=\"p0.0.ts\",INDEPENDENT=YES\n#EXT-X-PART:DURATION=0.2,URI=\"p0.1.ts\"\n" +
+			"#EXTINF:0.4,\ns0.ts\n#EXT-X-PART:DURATION=0.2,URI=\"p1.0.ts\",INDEPENDENT=YES\n" +
+			"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"p1.1.ts\"\n"))
+		if err != nil {
+			return errors.Wrapf(err, "parse")
+		}
+		if !media.IsLowLatency() || !media.canBlockReload || media.partHoldBack != 0.6 || media.preloadHint != "p1.1.ts" {
+			return errors.Errorf("invalid media %+v", media)
+		}
+		if s := media.segments[0]; len(s.parts) != 2 || !s.parts[0].independent || s.parts[1].uri != "p0.1.ts" {
+			return errors.Errorf("invalid segment %+v", s)
+		}
+		if len(media.openParts) != 1 || media.EndSequence() != 1 || media.openDateTime.Sub(media.segments[0].programDateTime) != 400*time.Millisecond {
+			return errors.Errorf("invalid open parts %+v, %v", media.openParts, media.openDateTime)
+		}
+
+		for _, b := range []string{
+			"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-PART-INF:PART-TARGET=0.2\n#EXT-X-PART:DURATION=0.3,URI=\"a.ts\"\n",
+			"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-PART:DURATION=0.2,URI=\"a.ts\"\n",
+			"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"a.ts\"\n",
+			"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=0.3\n#EXT-X-PART-INF:PART-TARGET=0.2\n",
+		} {
+			if _, _, err := parseHLSPlaylist([]byte(b)); err == nil {
+				return errors.Errorf("should fail for %v", b)
+			}
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+
+	if err := func() error {
+		// The live stream of 2 parts per segment, each part is available 200ms after the previous one,
+		// and the blocking reload and preload hint wait for the part.
+		const part = 200 * time.Millisecond
+		base := time.Now().Add(-6 * part)
+		available := func(msn, index uint64) <-chan time.Time {
+			return time.After(time.Until(base.Add(time.Duration(msn*2+index+1) * part)))
+		}
+
+		var requests []string
+		var lock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			requests = append(requests, r.URL.RequestURI())
+			lock.Unlock()
+
+			var msn, index uint64
+			if r.URL.Path == "/live/livestream.m3u8" {
+				if q := r.URL.Query(); q.Get("_HLS_msn") != "" {
+					msn, _ = strconv.ParseUint(q.Get("_HLS_msn"), 10, 64)
+					index, _ = strconv.ParseUint(q.Get("_HLS_part"), 10, 64)
+					<-available(msn, index)
+				}
+
+				parts := uint64(time.Since(base) / part)
+				b := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:1\n#EXT-X-PART-INF:PART-TARGET=0.2\n" +
+					"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.6\n" +
+					fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%v\n", base.UTC().Format(time.RFC3339Nano))
+				for i := uint64(0); i < parts; i++ {
+					b += fmt.Sprintf("#EXT-X-PART:DURATION=0.2,URI=\"p%v.%v.ts\"", i/2, i%2)
+					if i%2 == 0 {
+						b += ",INDEPENDENT=YES"
+					}
+					if b += "\n"; i%2 == 1 {
+						b += fmt.Sprintf("#EXTINF:0.4,\ns%v.ts\n", i/2)
+					}
+				}
+				b += fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"p%v.%v.ts\"\n", parts/2, parts%2)
+				w.Write([]byte(b))
+				return
+			}
+
+			if _, err := fmt.Sscanf(r.URL.Path, "/live/p%d.%d.ts", &msn, &index); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			<-available(msn, index)
+
+			b := make([]byte, 188)
+			b[0] = 0x47
+			w.Write(b)
+		}))
+		defer server.Close()
+
+		_, _, _, parts, _, stale, notFound, violations, errs, _ := gStatRTC.HLS.Stat()
+		latencies, _, _, _, _, _ := gStatRTC.HLS.latency.Stat()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+		if err := startHLSPlay(ctx, server.URL+"/live/livestream.m3u8", nil); err != nil {
+			return errors.Wrapf(err, "play")
+		}
+
+		_, _, _, parts2, _, stale2, notFound2, violations2, errs2, _ := gStatRTC.HLS.Stat()
+		latencies2, _, _, _, _, _ := gStatRTC.HLS.latency.Stat()
+		if parts2-parts < 5 || latencies2-latencies < 5 || stale2 != stale || notFound2 != notFound || violations2 != violations || errs2 != errs {
+			return errors.Errorf("invalid parts=%v, latencies=%v, stale=%v, 404=%v, violations=%v, errors=%v",
+				parts2-parts, latencies2-latencies, stale2-stale, notFound2-notFound, violations2-violations, errs2-errs)
+		}
+
+		// Start from the independent part 0.6s from the end, then fetch the parts by preload hint.
+		lock.Lock()
+		defer lock.Unlock()
+		if len(requests) < 8 || requests[1] != "/live/p1.0.ts" || requests[5] != "/live/p3.0.ts" ||
+			!strings.HasSuffix(requests[6], "?_HLS_msn=3&_HLS_part=0") || requests[7] != "/live/p3.1.ts" {
+			return errors.Errorf("invalid requests %v", requests)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
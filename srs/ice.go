@@ -0,0 +1,63 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Build the configuration of PC, with the TURN server if not empty, and only use the relay
+// candidates if relay, for clients behind restrictive NATs.
+func newRTCConfiguration(turn, username, credential string, relay bool) webrtc.Configuration {
+	var configuration webrtc.Configuration
+	if turn != "" {
+		configuration.ICEServers = []webrtc.ICEServer{{
+			URLs: strings.Split(turn, ","), Username: username, Credential: credential,
+		}}
+	}
+	if relay {
+		configuration.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	return configuration
+}
+
+// Describe the nominated candidate pair, to check whether the session is relayed.
+func describeSelectedCandidatePair(pc *webrtc.PeerConnection) string {
+	stats := pc.GetStats()
+
+	describe := func(id string) string {
+		if c, ok := stats[id].(webrtc.ICECandidateStats); ok {
+			return fmt.Sprintf("%v %v:%v", c.CandidateType, c.IP, c.Port)
+		}
+		return id
+	}
+
+	for _, s := range stats {
+		if pair, ok := s.(webrtc.ICECandidatePairStats); ok && pair.Nominated {
+			return fmt.Sprintf("local=%v, remote=%v",
+				describe(pair.LocalCandidateID), describe(pair.RemoteCandidateID))
+		}
+	}
+	return "no nominated pair"
+}
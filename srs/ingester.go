@@ -23,6 +23,7 @@ package srs
 import (
 	"context"
 	"io"
+	"math/rand"
 	"os"
 	"strings"
 	"time"
@@ -40,16 +41,61 @@ import (
 
 type videoIngester struct {
 	sourceVideo       string
+	trackID           string
 	fps               int
 	markerInterceptor *rtpInterceptor
 	sVideoTrack       *webrtc.TrackLocalStaticSample
 	sVideoSender      *webrtc.RTPSender
 	ready             context.Context
 	readyCancel       context.CancelFunc
+	// The number of simulcast layers, and the sources of layers, reuse the last one if not enough.
+	simulcast        int
+	simulcastSources []string
+	// The simulcast layers, empty if disabled.
+	layers         []*simulcastLayer
+	ridExtensionID uint8
+	// For H.265 and AV1, pion has no payloader, so we packetize and write RTP to track by ourselves.
+	sVideoTrackRTP *webrtc.TrackLocalStaticRTP
+	packetizer     rtp.Packetizer
+	// Whether insert SEI of wall-clock time before each H.264 frame, for player to measure latency.
+	latency bool
+	// The controller to ramp or cap the bitrate by dropping frames, nil to disable.
+	bitrate *bitrateController
+	// The SSRC of track, to dispatch the RTP when multiple tracks share the marker interceptor.
+	ssrc uint32
+}
+
+// Get the codec of video source which pion has no payloader, nil for pion builtin codecs.
+func videoCodecOfSource(source string) *webrtc.RTPCodecParameters {
+	if strings.HasSuffix(source, ".h265") {
+		return &h265Codec
+	}
+	if strings.HasSuffix(source, ".ivf") || strings.HasSuffix(source, ".obu") {
+		return &av1Codec
+	}
+	return nil
+}
+
+// Register the opus and the video codec only, so that the server must choose it for video.
+func registerSingleVideoCodec(m *webrtc.MediaEngine, codec webrtc.RTPCodecParameters) error {
+	opus := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}
+	if err := m.RegisterCodec(opus, webrtc.RTPCodecTypeAudio); err != nil {
+		return errors.Wrapf(err, "register %v", opus.MimeType)
+	}
+
+	if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+		return errors.Wrapf(err, "register %v", codec.MimeType)
+	}
+	return nil
 }
 
 func newVideoIngester(sourceVideo string) *videoIngester {
-	v := &videoIngester{markerInterceptor: &rtpInterceptor{}, sourceVideo: sourceVideo}
+	v := &videoIngester{markerInterceptor: &rtpInterceptor{}, sourceVideo: sourceVideo, trackID: "video"}
 	v.ready, v.readyCancel = context.WithCancel(context.Background())
 	return v
 }
@@ -65,58 +111,219 @@ func (v *videoIngester) Close() error {
 func (v *videoIngester) AddTrack(pc *webrtc.PeerConnection, fps int) error {
 	v.fps = fps
 
-	mimeType, trackID := "video/H264", "video"
-	if strings.HasSuffix(v.sourceVideo, ".ivf") {
-		mimeType = "video/VP8"
-	}
+	mimeType, trackID := "video/H264", v.trackID
 
 	var err error
-	v.sVideoTrack, err = webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000}, trackID, "pion",
-	)
-	if err != nil {
-		return errors.Wrapf(err, "Create video track")
-	}
+	if codec := videoCodecOfSource(v.sourceVideo); codec != nil {
+		v.sVideoTrackRTP, err = webrtc.NewTrackLocalStaticRTP(codec.RTPCodecCapability, trackID, "pion")
+		if err != nil {
+			return errors.Wrapf(err, "Create video track")
+		}
+
+		v.sVideoSender, err = pc.AddTrack(v.sVideoTrackRTP)
+	} else {
+		v.sVideoTrack, err = webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000}, trackID, "pion",
+		)
+		if err != nil {
+			return errors.Wrapf(err, "Create video track")
+		}
 
-	v.sVideoSender, err = pc.AddTrack(v.sVideoTrack)
+		v.sVideoSender, err = pc.AddTrack(v.sVideoTrack)
+	}
 	if err != nil {
 		return errors.Wrapf(err, "Add video track")
 	}
+
+	if v.simulcast > 1 && v.sVideoTrackRTP != nil {
+		return errors.Errorf("simulcast not support %v", v.sourceVideo)
+	}
+	if v.simulcast > 1 {
+		if err := v.addSimulcastLayers(); err != nil {
+			return errors.Wrapf(err, "Add simulcast")
+		}
+	}
+
+	v.ssrc = uint32(v.sVideoSender.GetParameters().Encodings[0].SSRC)
+	v.markerInterceptor.rtpWriter = v.writeRTP
 	return err
 }
 
-func (v *videoIngester) Ingest(ctx context.Context) error {
-	source, sender, track, fps := v.sourceVideo, v.sVideoSender, v.sVideoTrack, v.fps
+// Whether the RTP of SSRC is sent by this track, including the simulcast layers.
+func (v *videoIngester) hasSSRC(ssrc uint32) bool {
+	if v.ssrc == ssrc {
+		return true
+	}
+	for _, layer := range v.layers {
+		if layer.ssrc == ssrc {
+			return true
+		}
+	}
+	return false
+}
 
-	f, err := os.Open(source)
-	if err != nil {
-		return errors.Wrapf(err, "Open file %v", source)
+// Write the RTP by the video track of its SSRC, because the tracks share the marker interceptor which handles all
+// RTP packets, and the other packets such as audio are written to next directly.
+func videoTracksRTPWriter(tracks []*videoIngester) interceptor.RTPWriterFunc {
+	return func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		for _, track := range tracks {
+			if track.hasSSRC(header.SSRC) {
+				return track.writeRTP(header, payload, attributes)
+			}
+		}
+		return tracks[0].markerInterceptor.nextRTPWriter.Write(header, payload, attributes)
 	}
-	defer f.Close()
+}
 
-	// TODO: FIXME: Support ivf for vp8.
-	h264, err := h264reader.NewReader(f)
-	if err != nil {
-		return errors.Wrapf(err, "Open h264 %v", source)
+func (v *videoIngester) addSimulcastLayers() error {
+	if v.simulcast > len(simulcastRIDs) {
+		return errors.Errorf("simulcast %v exceed %v layers", v.simulcast, len(simulcastRIDs))
+	}
+
+	params := v.sVideoSender.GetParameters()
+	for _, extension := range params.HeaderExtensions {
+		if extension.URI == sdp.SDESRTPStreamIDURI {
+			v.ridExtensionID = uint8(extension.ID)
+		}
+	}
+	if v.ridExtensionID == 0 {
+		return errors.Errorf("no extension %v", sdp.SDESRTPStreamIDURI)
 	}
 
+	for i := 0; i < v.simulcast; i++ {
+		layer := &simulcastLayer{rid: simulcastRIDs[i], source: v.sourceVideo, ssrc: rand.Uint32()}
+		if i == 0 {
+			layer.ssrc = uint32(params.Encodings[0].SSRC)
+		}
+
+		if len(v.simulcastSources) > 0 {
+			layer.source = v.simulcastSources[len(v.simulcastSources)-1]
+			if i < len(v.simulcastSources) {
+				layer.source = v.simulcastSources[i]
+			}
+		}
+		v.layers = append(v.layers, layer)
+	}
+	return nil
+}
+
+func (v *videoIngester) writeRTP(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+	// For STAP-A and SEI, set marker to false, to make Chrome happy.
+	// TODO: Should we decode to check whether SPS/PPS?
+	if v.sVideoTrackRTP == nil && len(payload) > 0 {
+		if t := payload[0] & 0x1f; t == h264NALUTypeSTAPA || t == h264NALUTypeSEI {
+			header.Marker = false
+		}
+	}
+
+	// For simulcast, identify the layer by RID.
+	for _, layer := range v.layers {
+		if layer.ssrc == header.SSRC {
+			if err := header.SetExtension(v.ridExtensionID, []byte(layer.rid)); err != nil {
+				return 0, errors.Wrapf(err, "set rid %v", layer.rid)
+			}
+			break
+		}
+	}
+
+	return v.markerInterceptor.nextRTPWriter.Write(header, payload, attributes)
+}
+
+func (v *videoIngester) Ingest(ctx context.Context) error {
+	sender, track, fps := v.sVideoSender, v.sVideoTrack, v.fps
+
 	enc := sender.GetParameters().Encodings[0]
 	codec := sender.GetParameters().Codecs[0]
 	headers := sender.GetParameters().HeaderExtensions
 	logger.Tf(ctx, "Video %v, tbn=%v, fps=%v, ssrc=%v, pt=%v, header=%v",
 		codec.MimeType, codec.ClockRate, fps, enc.SSRC, codec.PayloadType, headers)
 
+	if v.sVideoTrackRTP != nil {
+		// OK, we are ready.
+		v.readyCancel()
+
+		if strings.HasSuffix(v.sourceVideo, ".h265") {
+			return v.ingestH265(ctx, v.sourceVideo)
+		}
+		return v.ingestAV1(ctx, v.sourceVideo)
+	}
+
+	if len(v.layers) == 0 {
+		// OK, we are ready.
+		v.readyCancel()
+
+		return v.ingest(ctx, v.sourceVideo, track.WriteSample)
+	}
+
+	// For simulcast, all layers restart when any of them done, to keep in sync.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(v.layers))
+	for i, layer := range v.layers {
+		write := track.WriteSample
+		if i > 0 {
+			layer.setup(uint8(enc.PayloadType), v.markerInterceptor)
+			write = layer.WriteSample
+		}
+		logger.Tf(ctx, "Video simulcast layer %v", layer)
+
+		go func(source string, write func(media.Sample) error) {
+			errs <- v.ingest(ctx, source, write)
+			cancel()
+		}(layer.source, write)
+	}
+
 	// OK, we are ready.
 	v.readyCancel()
 
+	err := <-errs
+	for i := 1; i < len(v.layers); i++ {
+		<-errs
+	}
+	return err
+}
+
+// Ingest the H.264 source file, write each frame as sample, return io.EOF when done.
+func (v *videoIngester) ingest(ctx context.Context, source string, write func(media.Sample) error) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return errors.Wrapf(err, "Open file %v", source)
+	}
+	defer f.Close()
+
+	// TODO: FIXME: Support ivf for vp8.
+	h264, err := h264reader.NewReader(f)
+	if err != nil {
+		return errors.Wrapf(err, "Open h264 %v", source)
+	}
+
 	clock := newWallClock()
+	fps := v.fps
 	sampleDuration := time.Duration(uint64(time.Millisecond) * 1000 / uint64(fps))
+
+	// For bitrate control, hold the last sample of frame, to extend its duration by the dropped
+	// frames, so the timestamp of the next frame is right.
+	var pending *media.Sample
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+		sample := *pending
+		pending = nil
+		return write(sample)
+	}
+	reportTime := time.Now()
+
 	for ctx.Err() == nil {
 		var sps, pps *h264reader.NAL
 		var oFrames []*h264reader.NAL
 		for ctx.Err() == nil {
 			frame, err := h264.NextNAL()
 			if err == io.EOF {
+				if err := flush(); err != nil {
+					return errors.Wrapf(err, "Write sample")
+				}
 				return io.EOF
 			}
 			if err != nil {
@@ -142,6 +349,10 @@ func (v *videoIngester) Ingest(ctx context.Context) error {
 			stapA := packageAsSTAPA(sps, pps)
 			frames = append(frames, stapA)
 		}
+		// Insert the SEI of wall-clock time, the latency is measured from the frame is sent.
+		if v.latency {
+			frames = append(frames, &h264reader.NAL{Data: h264LatencySEI(time.Now())})
+		}
 		// Append other original frames.
 		for _, frame := range oFrames {
 			if frame.UnitType != h264reader.NalUnitTypeSPS && frame.UnitType != h264reader.NalUnitTypePPS {
@@ -149,26 +360,43 @@ func (v *videoIngester) Ingest(ctx context.Context) error {
 			}
 		}
 
+		// Drop the frame if exceed the bitrate, and extend the duration of previous frame.
+		if v.bitrate != nil {
+			var size int
+			var keyframe, reference bool
+			for _, frame := range frames {
+				size += len(frame.Data)
+				keyframe = keyframe || frame.UnitType == h264reader.NalUnitTypeCodedSliceIdr
+				reference = reference || frame.RefIdc != 0
+			}
+
+			if !v.bitrate.Allow(size, sampleDuration, keyframe, reference) {
+				if pending != nil {
+					pending.Duration += sampleDuration
+				}
+				frames = nil
+			} else if err := flush(); err != nil {
+				return errors.Wrapf(err, "Write sample")
+			}
+
+			if time.Since(reportTime) > 5*time.Second {
+				logger.Tf(ctx, "Video bitrate %v", v.bitrate)
+				reportTime = time.Now()
+			}
+		}
+
 		// Covert frames to sample(buffers).
 		for i, frame := range frames {
 			sample := media.Sample{Data: frame.Data, Duration: sampleDuration}
 			// Use the sample timestamp for frames.
 			if i != len(frames)-1 {
 				sample.Duration = 0
+			} else if v.bitrate != nil {
+				pending = &sample
+				break
 			}
 
-			// For STAP-A, set marker to false, to make Chrome happy.
-			if ri := v.markerInterceptor; ri.rtpWriter == nil {
-				ri.rtpWriter = func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
-					// TODO: Should we decode to check whether SPS/PPS?
-					if len(payload) > 0 && payload[0]&0x1f == 24 {
-						header.Marker = false // 24, STAP-A
-					}
-					return ri.nextRTPWriter.Write(header, payload, attributes)
-				}
-			}
-
-			if err = track.WriteSample(sample); err != nil {
+			if err = write(sample); err != nil {
 				return errors.Wrapf(err, "Write sample")
 			}
 		}
@@ -188,6 +416,10 @@ type audioIngester struct {
 	sAudioSender          *webrtc.RTPSender
 	ready                 context.Context
 	readyCancel           context.CancelFunc
+	// For source not ogg opus, transcode by FFmpeg, with bitrate in kbps and frame size in ms.
+	ffmpeg    string
+	bitrate   int
+	frameSize float64
 }
 
 func newAudioIngester(sourceAudio string) *audioIngester {
@@ -227,9 +459,17 @@ func (v *audioIngester) AddTrack(pc *webrtc.PeerConnection) error {
 func (v *audioIngester) Ingest(ctx context.Context) error {
 	source, sender, track := v.sourceAudio, v.sAudioSender, v.sAudioTrack
 
-	f, err := os.Open(source)
-	if err != nil {
-		return errors.Wrapf(err, "Open file %v", source)
+	var f readSeekCloser
+	if isOpusSource(source) {
+		var err error
+		if f, err = os.Open(source); err != nil {
+			return errors.Wrapf(err, "Open file %v", source)
+		}
+	} else {
+		var err error
+		if f, err = newOpusTranscoder(ctx, v.ffmpeg, source, v.bitrate, v.frameSize); err != nil {
+			return errors.Wrapf(err, "Transcode %v", source)
+		}
 	}
 	defer f.Close()
 
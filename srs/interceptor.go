@@ -156,3 +156,57 @@ func (v *bypassInterceptor) UnbindRemoteStream(info *interceptor.StreamInfo) {
 func (v *bypassInterceptor) Close() error {
 	return nil
 }
+
+// The interceptor to collect the stat of RTP and RTCP for a PC, should be the first one added
+// to registry, so that it sees all packets on wire, such as the NACK retransmissions and RTCP
+// reports generated by other interceptors.
+type statInterceptor struct {
+	stat *statPeerConnection
+	// Other common fields.
+	bypassInterceptor
+}
+
+func newStatInterceptor(stat *statPeerConnection) *statInterceptor {
+	return &statInterceptor{stat: stat}
+}
+
+func (v *statInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err == nil {
+			if pkts, err := rtcp.Unmarshal(b[:n]); err == nil {
+				v.stat.onRTCP(pkts, false)
+			}
+		}
+		return n, a, err
+	})
+}
+
+func (v *statInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, a interceptor.Attributes) (int, error) {
+		v.stat.onRTCP(pkts, true)
+		return writer.Write(pkts, a)
+	})
+}
+
+func (v *statInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	v.stat.onStream(info.SSRC, info.ClockRate)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, a)
+		if err == nil {
+			v.stat.onRTP(header.MarshalSize()+len(payload), true)
+		}
+		return n, err
+	})
+}
+
+func (v *statInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	v.stat.onStream(info.SSRC, info.ClockRate)
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err == nil {
+			v.stat.onRTP(n, false)
+		}
+		return n, a, err
+	})
+}
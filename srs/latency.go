@@ -0,0 +1,168 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The SEI payload type of user data unregistered.
+const h264SEIUserDataUnregistered = 5
+
+// The UUID of SEI user data, to identify the wall-clock time of publisher.
+var latencySEIUUID = []byte{
+	0x73, 0x72, 0x73, 0x2d, 0x62, 0x65, 0x6e, 0x63, 0x68, 0x2d, 0x6c, 0x61, 0x74, 0x65, 0x6e, 0x63,
+}
+
+// Remove the emulation prevention bytes of NALU.
+func h264UnescapeRBSP(b []byte) []byte {
+	rbsp := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if i >= 2 && b[i] == 0x03 && b[i-1] == 0 && b[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, b[i])
+	}
+	return rbsp
+}
+
+// Insert the emulation prevention bytes of NALU.
+func h264EscapeRBSP(rbsp []byte) []byte {
+	b := make([]byte, 0, len(rbsp)+4)
+	var zeros int
+	for _, v := range rbsp {
+		if zeros >= 2 && v <= 0x03 {
+			b, zeros = append(b, 0x03), 0
+		}
+		b = append(b, v)
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return b
+}
+
+// Generate the SEI NALU of wall-clock time in us, as user data unregistered.
+// @see ITU-T H.264 D.1.6
+func h264LatencySEI(now time.Time) []byte {
+	payload := make([]byte, len(latencySEIUUID)+8)
+	copy(payload, latencySEIUUID)
+	binary.BigEndian.PutUint64(payload[len(latencySEIUUID):], uint64(now.UnixNano()/int64(time.Microsecond)))
+
+	rbsp := append([]byte{h264SEIUserDataUnregistered, byte(len(payload))}, payload...)
+	return append([]byte{h264NALUTypeSEI}, h264EscapeRBSP(append(rbsp, 0x80))...)
+}
+
+// Parse the wall-clock time from SEI NALU, return false if not the latency SEI.
+func parseH264LatencySEI(nal []byte) (time.Time, bool) {
+	if len(nal) < 2 || nal[0]&0x1f != h264NALUTypeSEI {
+		return time.Time{}, false
+	}
+
+	// Parse the SEI messages, the payload type and size are coded by 0xff bytes.
+	rbsp := h264UnescapeRBSP(nal[1:])
+	for len(rbsp) > 1 {
+		var pt, size int
+		for len(rbsp) > 0 && rbsp[0] == 0xff {
+			pt, rbsp = pt+0xff, rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			break
+		}
+		pt, rbsp = pt+int(rbsp[0]), rbsp[1:]
+
+		for len(rbsp) > 0 && rbsp[0] == 0xff {
+			size, rbsp = size+0xff, rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			break
+		}
+		size, rbsp = size+int(rbsp[0]), rbsp[1:]
+
+		if len(rbsp) < size {
+			break
+		}
+		payload := rbsp[:size]
+		rbsp = rbsp[size:]
+
+		if pt == int(h264SEIUserDataUnregistered) && size == len(latencySEIUUID)+8 && bytes.HasPrefix(payload, latencySEIUUID) {
+			us := int64(binary.BigEndian.Uint64(payload[len(latencySEIUUID):]))
+			return time.Unix(0, us*int64(time.Microsecond)), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// The interceptor of player, to measure the latency by the SEI of H.264 from publisher, should
+// be added after the FEC and RED decoders.
+// @remark The latency is right only when publisher and player use the same clock.
+type latencyInterceptor struct {
+	stat *statLatency
+	// Other common fields.
+	bypassInterceptor
+}
+
+func newLatencyInterceptor(stat *statLatency) *latencyInterceptor {
+	return &latencyInterceptor{stat: stat}
+}
+
+func (v *latencyInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	if !strings.EqualFold(info.MimeType, webrtc.MimeTypeH264) {
+		return reader
+	}
+
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err != nil {
+			return n, a, err
+		}
+
+		var pkt rtp.Packet
+		if err := pkt.Unmarshal(b[:n]); err != nil || len(pkt.Payload) == 0 {
+			return n, a, nil
+		}
+
+		// The SEI is small, in single NALU packet or STAP-A.
+		nals := [][]byte{pkt.Payload}
+		if pkt.Payload[0]&0x1f == h264NALUTypeSTAPA {
+			var d h264Depacketizer
+			if nals, err = d.Unmarshal(pkt.Payload); err != nil {
+				return n, a, nil
+			}
+		}
+
+		for _, nal := range nals {
+			if ts, ok := parseH264LatencySEI(nal); ok {
+				v.stat.onLatency(time.Since(ts))
+			}
+		}
+		return n, a, nil
+	})
+}
@@ -0,0 +1,110 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"context"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	vnet_proxy "github.com/ossrs/srs-bench/vnet"
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+)
+
+// The network migrator runs the PC in vnet, and proxies to the real server by UDP proxy, to
+// simulate the client network change by switching the real socket, while the ICE ufrag is not
+// changed, so SRS should keep the session alive and send to the new address.
+type networkMigrator struct {
+	router  *vnet.Router
+	network *vnet.Net
+	proxy   *vnet_proxy.UDPProxy
+}
+
+func newNetworkMigrator(clientIP string) (*networkMigrator, error) {
+	v := &networkMigrator{}
+
+	var err error
+	if v.router, err = vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "0.0.0.0/0", // Accept all ip, no sub router.
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	}); err != nil {
+		return nil, errors.Wrapf(err, "create router")
+	}
+
+	v.network = vnet.NewNet(&vnet.NetConfig{
+		StaticIP: clientIP,
+	})
+	if err = v.router.AddNet(v.network); err != nil {
+		return nil, errors.Wrapf(err, "create network %v", clientIP)
+	}
+
+	if v.proxy, err = vnet_proxy.NewProxy(v.router); err != nil {
+		return nil, errors.Wrapf(err, "create proxy")
+	}
+
+	if err = v.router.Start(); err != nil {
+		return nil, errors.Wrapf(err, "start router")
+	}
+	return v, nil
+}
+
+func (v *networkMigrator) Close() error {
+	_ = v.proxy.Close()
+	return v.router.Stop()
+}
+
+// Run the PC in vnet.
+func (v *networkMigrator) SetupSettingEngine(s *webrtc.SettingEngine) {
+	s.SetVNet(v.network)
+}
+
+// Proxy the vnet to the real server, by the candidate of answer.
+func (v *networkMigrator) Proxy(answer string) error {
+	address, err := parseAddressOfCandidate(answer)
+	if err != nil {
+		return errors.Wrapf(err, "parse address of %v", answer)
+	}
+
+	if err := v.proxy.Proxy(v.network, address); err != nil {
+		return errors.Wrapf(err, "proxy %v to %v", v.network, address)
+	}
+	return nil
+}
+
+// Switch the real socket for each interval, until ctx is done.
+func (v *networkMigrator) Run(ctx context.Context, interval time.Duration) {
+	for n := 1; ; n++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		if err := v.proxy.Migrate(); err != nil {
+			logger.Wf(ctx, "Migrate #%v err %+v", n, err)
+			continue
+		}
+		logger.Tf(ctx, "Migrate #%v, switch to new client address", n)
+	}
+}
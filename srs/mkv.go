@@ -0,0 +1,297 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The EBML and Matroska element IDs, @see https://www.matroska.org/technical/elements.html
+const (
+	ebmlIDHeader             = 0x1A45DFA3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+	mkvIDSegment             = 0x18538067
+	mkvIDInfo                = 0x1549A966
+	mkvIDTimestampScale      = 0x2AD7B1
+	mkvIDDuration            = 0x4489
+	mkvIDMuxingApp           = 0x4D80
+	mkvIDWritingApp          = 0x5741
+	mkvIDTracks              = 0x1654AE6B
+	mkvIDTrackEntry          = 0xAE
+	mkvIDTrackNumber         = 0xD7
+	mkvIDTrackUID            = 0x73C5
+	mkvIDTrackType           = 0x83
+	mkvIDFlagLacing          = 0x9C
+	mkvIDCodecID             = 0x86
+	mkvIDCodecPrivate        = 0x63A2
+	mkvIDCodecDelay          = 0x56AA
+	mkvIDSeekPreRoll         = 0x56BB
+	mkvIDVideo               = 0xE0
+	mkvIDPixelWidth          = 0xB0
+	mkvIDPixelHeight         = 0xBA
+	mkvIDAudio               = 0xE1
+	mkvIDSamplingFrequency   = 0xB5
+	mkvIDChannels            = 0x9F
+	mkvIDCluster             = 0x1F43B675
+	mkvIDTimestamp           = 0xE7
+	mkvIDSimpleBlock         = 0xA3
+)
+
+// The unknown size of EBML element, in 8 bytes.
+const ebmlUnknownSize = 0x01FFFFFFFFFFFFFF
+
+// The max duration of cluster, the block timestamp is int16 in ms.
+const mkvMaxClusterDuration = 30 * time.Second
+
+// Encode the EBML element ID, which is already in the VINT format.
+func ebmlID(id uint32) []byte {
+	switch {
+	case id > 0xffffff:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xffff:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xff:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// Encode the EBML size in VINT, use the minimal length.
+func ebmlSize(size uint64) []byte {
+	for n := 1; n < 8; n++ {
+		// The all ones is reserved for unknown size.
+		if size < (1<<(7*uint(n)))-1 {
+			b := make([]byte, n)
+			for i := n - 1; i >= 0; i-- {
+				b[i], size = byte(size), size>>8
+			}
+			b[0] |= 0x80 >> uint(n-1)
+			return b
+		}
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, size|0x0100000000000000)
+	return b
+}
+
+func ebmlElement(id uint32, data ...[]byte) []byte {
+	var size int
+	for _, v := range data {
+		size += len(v)
+	}
+
+	b := append(ebmlID(id), ebmlSize(uint64(size))...)
+	for _, v := range data {
+		b = append(b, v...)
+	}
+	return b
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	n := 1
+	for ; n < 8 && v>>(8*uint(n)) != 0; n++ {
+	}
+
+	b := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		b[i], v = byte(v), v>>8
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(v))
+	return ebmlElement(id, b)
+}
+
+func ebmlString(id uint32, v string) []byte {
+	return ebmlElement(id, []byte(v))
+}
+
+// The Matroska muxer, the segment and duration are updated when close, and each cluster starts
+// from a video keyframe, or limited by duration.
+type mkvMuxer struct {
+	f *os.File
+	// The offset of segment data and the duration value, to update when close.
+	segmentOffset  int64
+	durationOffset int64
+	duration       time.Duration
+	// The tracks number, zero if no such track.
+	videoTrack, audioTrack uint64
+	// The cluster in writing, nil if not started.
+	cluster     *bytes.Buffer
+	clusterTime time.Duration
+}
+
+func newMKVMuxer(filename string) (*mkvMuxer, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %v", filename)
+	}
+	return &mkvMuxer{f: f}, nil
+}
+
+func (v *mkvMuxer) WriteHeader(tracks *recordTracks) error {
+	header := ebmlElement(ebmlIDHeader,
+		ebmlUint(ebmlIDVersion, 1), ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4), ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, "matroska"), ebmlUint(ebmlIDDocTypeVersion, 4), ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	)
+
+	// The segment is unknown size, updated when close.
+	segment := append(ebmlID(mkvIDSegment), ebmlSize(ebmlUnknownSize)...)
+	v.segmentOffset = int64(len(header) + len(segment))
+
+	info := ebmlElement(mkvIDInfo,
+		ebmlUint(mkvIDTimestampScale, uint64(time.Millisecond)),
+		ebmlString(mkvIDMuxingApp, "srs-bench"), ebmlString(mkvIDWritingApp, "srs-bench"),
+		ebmlFloat(mkvIDDuration, 0),
+	)
+	v.durationOffset = v.segmentOffset + int64(len(info)) - 8
+
+	var entries [][]byte
+	if tracks.avcc != nil {
+		v.videoTrack = uint64(len(entries) + 1)
+		entries = append(entries, ebmlElement(mkvIDTrackEntry,
+			ebmlUint(mkvIDTrackNumber, v.videoTrack), ebmlUint(mkvIDTrackUID, v.videoTrack),
+			ebmlUint(mkvIDTrackType, 1), ebmlUint(mkvIDFlagLacing, 0),
+			ebmlString(mkvIDCodecID, "V_MPEG4/ISO/AVC"), ebmlElement(mkvIDCodecPrivate, tracks.avcc),
+			ebmlElement(mkvIDVideo,
+				ebmlUint(mkvIDPixelWidth, uint64(tracks.width)), ebmlUint(mkvIDPixelHeight, uint64(tracks.height)),
+			),
+		))
+	}
+	if tracks.channels > 0 {
+		// The codec delay and seek preroll are in ns, @see https://wiki.xiph.org/MatroskaOpus
+		v.audioTrack = uint64(len(entries) + 1)
+		entries = append(entries, ebmlElement(mkvIDTrackEntry,
+			ebmlUint(mkvIDTrackNumber, v.audioTrack), ebmlUint(mkvIDTrackUID, v.audioTrack),
+			ebmlUint(mkvIDTrackType, 2), ebmlUint(mkvIDFlagLacing, 0),
+			ebmlString(mkvIDCodecID, "A_OPUS"), ebmlElement(mkvIDCodecPrivate, tracks.OpusHead()),
+			ebmlUint(mkvIDCodecDelay, 0), ebmlUint(mkvIDSeekPreRoll, uint64(80*time.Millisecond)),
+			ebmlElement(mkvIDAudio,
+				ebmlFloat(mkvIDSamplingFrequency, 48000), ebmlUint(mkvIDChannels, uint64(tracks.channels)),
+			),
+		))
+	}
+
+	for _, b := range [][]byte{header, segment, info, ebmlElement(mkvIDTracks, entries...)} {
+		if _, err := v.f.Write(b); err != nil {
+			return errors.Wrapf(err, "write %v bytes", len(b))
+		}
+	}
+	return nil
+}
+
+func (v *mkvMuxer) WriteVideo(pts time.Duration, keyframe bool, data []byte) error {
+	return v.writeBlock(v.videoTrack, pts, keyframe, keyframe, data)
+}
+
+func (v *mkvMuxer) WriteAudio(pts time.Duration, data []byte) error {
+	return v.writeBlock(v.audioTrack, pts, v.videoTrack == 0, true, data)
+}
+
+// Write the block, start a new cluster if required or the timestamp overflows.
+func (v *mkvMuxer) writeBlock(track uint64, pts time.Duration, newCluster, keyframe bool, data []byte) error {
+	if track == 0 {
+		return nil
+	}
+
+	if rel := pts - v.clusterTime; v.cluster == nil || (newCluster && rel >= time.Second) ||
+		rel >= mkvMaxClusterDuration || rel <= -mkvMaxClusterDuration {
+		if err := v.flushCluster(); err != nil {
+			return err
+		}
+		v.cluster, v.clusterTime = &bytes.Buffer{}, pts
+		v.cluster.Write(ebmlUint(mkvIDTimestamp, uint64(pts/time.Millisecond)))
+	}
+
+	// The block header is track number, timestamp relative to cluster and flags.
+	var flags byte
+	if keyframe {
+		flags = 0x80
+	}
+	rel := int16((pts - v.clusterTime) / time.Millisecond)
+	block := append(ebmlSize(track), byte(uint16(rel)>>8), byte(rel), flags)
+	v.cluster.Write(ebmlElement(mkvIDSimpleBlock, block, data))
+
+	if pts > v.duration {
+		v.duration = pts
+	}
+	return nil
+}
+
+func (v *mkvMuxer) flushCluster() error {
+	if v.cluster == nil {
+		return nil
+	}
+
+	b := ebmlElement(mkvIDCluster, v.cluster.Bytes())
+	v.cluster = nil
+	if _, err := v.f.Write(b); err != nil {
+		return errors.Wrapf(err, "write cluster %v bytes", len(b))
+	}
+	return nil
+}
+
+// Write the last cluster, and update the size of segment and the duration.
+func (v *mkvMuxer) Close() error {
+	defer v.f.Close()
+
+	if v.segmentOffset == 0 {
+		return nil
+	}
+	if err := v.flushCluster(); err != nil {
+		return err
+	}
+
+	end, err := v.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrapf(err, "seek")
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(end-v.segmentOffset)|0x0100000000000000)
+	if _, err := v.f.WriteAt(b, v.segmentOffset-8); err != nil {
+		return errors.Wrapf(err, "update segment")
+	}
+
+	binary.BigEndian.PutUint64(b, math.Float64bits(float64(v.duration/time.Millisecond)))
+	if _, err := v.f.WriteAt(b, v.durationOffset); err != nil {
+		return errors.Wrapf(err, "update duration")
+	}
+	return nil
+}
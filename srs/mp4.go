@@ -0,0 +1,302 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The timescale of tracks in MP4, the opus must be 48000.
+const (
+	mp4VideoTimescale = 90000
+	mp4AudioTimescale = 48000
+)
+
+// The duration of fragment for audio only, otherwise each fragment starts from a video keyframe.
+const mp4FragmentDuration = time.Second
+
+func mp4Box(typ string, data ...[]byte) []byte {
+	size := 8
+	for _, v := range data {
+		size += len(v)
+	}
+
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, v := range data {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// The full box with version and flags.
+func mp4FullBox(typ string, version uint8, flags uint32, data ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, data...)...)
+}
+
+func mp4U16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func mp4U32(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func mp4U64(v uint64) []byte {
+	return append(mp4U32(uint32(v>>32)), mp4U32(uint32(v))...)
+}
+
+// The unity matrix of mvhd and tkhd.
+func mp4Matrix() []byte {
+	var b []byte
+	for _, v := range []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
+		b = append(b, mp4U32(v)...)
+	}
+	return b
+}
+
+// The sample of MP4 track in fragment.
+type mp4Sample struct {
+	dts      uint64
+	keyframe bool
+	data     []byte
+}
+
+// The track of MP4, the samples of current fragment.
+type mp4Track struct {
+	id        uint32
+	timescale uint32
+	samples   []*mp4Sample
+	// The duration of the last sample, to guess the next one.
+	lastDuration uint32
+}
+
+// The fragmented MP4 muxer, the moov has no samples, and each fragment is a moof and mdat. The
+// fragment starts from a video keyframe, or the duration for audio only.
+// @see ISO/IEC 14496-12
+type mp4Muxer struct {
+	f            *os.File
+	video, audio *mp4Track
+	sequence     uint32
+}
+
+func newMP4Muxer(filename string) (*mp4Muxer, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %v", filename)
+	}
+	return &mp4Muxer{f: f}, nil
+}
+
+func (v *mp4Muxer) WriteHeader(tracks *recordTracks) error {
+	ftyp := mp4Box("ftyp", []byte("iso5"), mp4U32(512), []byte("iso5iso6mp41"))
+
+	var traks, trexs [][]byte
+	if tracks.avcc != nil {
+		v.video = &mp4Track{id: uint32(len(traks) + 1), timescale: mp4VideoTimescale}
+
+		// The AVC sample entry, @see ISO/IEC 14496-15 5.4.2
+		entry := mp4Box("avc1",
+			make([]byte, 6), mp4U16(1), make([]byte, 16),
+			mp4U16(uint16(tracks.width)), mp4U16(uint16(tracks.height)),
+			mp4U32(0x00480000), mp4U32(0x00480000), mp4U32(0), mp4U16(1), make([]byte, 32), mp4U16(0x18), mp4U16(0xffff),
+			mp4Box("avcC", tracks.avcc),
+		)
+		traks = append(traks, v.trak(v.video, "vide", uint32(tracks.width), uint32(tracks.height),
+			mp4FullBox("vmhd", 0, 1, make([]byte, 8)), entry))
+		trexs = append(trexs, v.trex(v.video))
+	}
+	if tracks.channels > 0 {
+		v.audio = &mp4Track{id: uint32(len(traks) + 1), timescale: mp4AudioTimescale}
+
+		// The opus sample entry, @see https://opus-codec.org/docs/opus_in_isobmff.html
+		dOps := append([]byte{0, byte(tracks.channels)}, mp4U16(0)...)
+		dOps = append(dOps, mp4U32(48000)...)
+		dOps = append(dOps, 0, 0, 0)
+		entry := mp4Box("Opus",
+			make([]byte, 6), mp4U16(1), make([]byte, 8),
+			mp4U16(uint16(tracks.channels)), mp4U16(16), mp4U32(0), mp4U32(48000<<16),
+			mp4Box("dOps", dOps),
+		)
+		traks = append(traks, v.trak(v.audio, "soun", 0, 0, mp4FullBox("smhd", 0, 0, make([]byte, 4)), entry))
+		trexs = append(trexs, v.trex(v.audio))
+	}
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		mp4U32(0), mp4U32(0), mp4U32(1000), mp4U32(0), mp4U32(0x10000), mp4U16(0x100), make([]byte, 10),
+		mp4Matrix(), make([]byte, 24), mp4U32(uint32(len(traks)+1)),
+	)
+	moov := mp4Box("moov", append(append([][]byte{mvhd}, traks...), mp4Box("mvex", trexs...))...)
+
+	for _, b := range [][]byte{ftyp, moov} {
+		if _, err := v.f.Write(b); err != nil {
+			return errors.Wrapf(err, "write %v bytes", len(b))
+		}
+	}
+	return nil
+}
+
+// Generate the trak box, without samples.
+func (v *mp4Muxer) trak(track *mp4Track, handler string, width, height uint32, mhd, entry []byte) []byte {
+	var volume uint16
+	if handler == "soun" {
+		volume = 0x100
+	}
+
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		mp4U32(0), mp4U32(0), mp4U32(track.id), mp4U32(0), mp4U32(0), make([]byte, 8),
+		mp4U16(0), mp4U16(0), mp4U16(volume), mp4U16(0), mp4Matrix(), mp4U32(width<<16), mp4U32(height<<16),
+	)
+	mdhd := mp4FullBox("mdhd", 0, 0, mp4U32(0), mp4U32(0), mp4U32(track.timescale), mp4U32(0), mp4U16(0x55c4), mp4U16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, mp4U32(0), []byte(handler), make([]byte, 12), []byte("srs-bench\x00"))
+
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4U32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4U32(1), entry),
+		mp4FullBox("stts", 0, 0, mp4U32(0)), mp4FullBox("stsc", 0, 0, mp4U32(0)),
+		mp4FullBox("stsz", 0, 0, mp4U32(0), mp4U32(0)), mp4FullBox("stco", 0, 0, mp4U32(0)),
+	)
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mhd, dinf, stbl)))
+}
+
+func (v *mp4Muxer) trex(track *mp4Track) []byte {
+	return mp4FullBox("trex", 0, 0, mp4U32(track.id), mp4U32(1), mp4U32(0), mp4U32(0), mp4U32(0))
+}
+
+func (v *mp4Muxer) WriteVideo(pts time.Duration, keyframe bool, data []byte) error {
+	if v.video == nil {
+		return nil
+	}
+
+	if keyframe && len(v.video.samples) > 0 {
+		if err := v.flush(pts); err != nil {
+			return err
+		}
+	}
+
+	v.video.samples = append(v.video.samples, &mp4Sample{dts: mp4Timestamp(pts, v.video.timescale), keyframe: keyframe, data: data})
+	return nil
+}
+
+func (v *mp4Muxer) WriteAudio(pts time.Duration, data []byte) error {
+	if v.audio == nil {
+		return nil
+	}
+
+	if samples := v.audio.samples; v.video == nil && len(samples) > 0 &&
+		mp4Timestamp(pts, v.audio.timescale)-samples[0].dts >= mp4Timestamp(mp4FragmentDuration, v.audio.timescale) {
+		if err := v.flush(pts); err != nil {
+			return err
+		}
+	}
+
+	v.audio.samples = append(v.audio.samples, &mp4Sample{dts: mp4Timestamp(pts, v.audio.timescale), keyframe: true, data: data})
+	return nil
+}
+
+func mp4Timestamp(pts time.Duration, timescale uint32) uint64 {
+	return uint64(pts) * uint64(timescale) / uint64(time.Second)
+}
+
+// Write the fragment of samples, the next is the pts of next fragment, for the duration of the
+// last sample.
+func (v *mp4Muxer) flush(next time.Duration) error {
+	var tracks []*mp4Track
+	for _, track := range []*mp4Track{v.video, v.audio} {
+		if track != nil && len(track.samples) > 0 {
+			tracks = append(tracks, track)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	// The size of moof is fixed by the number of samples, so we calculate it by an empty offset.
+	v.sequence++
+	moof := v.moof(tracks, next, 0)
+	moof = v.moof(tracks, next, uint32(len(moof)+8))
+
+	var mdat [][]byte
+	for _, track := range tracks {
+		for _, sample := range track.samples {
+			mdat = append(mdat, sample.data)
+		}
+		track.samples = nil
+	}
+
+	for _, b := range [][]byte{moof, mp4Box("mdat", mdat...)} {
+		if _, err := v.f.Write(b); err != nil {
+			return errors.Wrapf(err, "write %v bytes", len(b))
+		}
+	}
+	return nil
+}
+
+// Generate the moof, the offset is the start of samples in mdat, relative to the moof.
+func (v *mp4Muxer) moof(tracks []*mp4Track, next time.Duration, offset uint32) []byte {
+	trafs := [][]byte{mp4FullBox("mfhd", 0, 0, mp4U32(v.sequence))}
+	for _, track := range tracks {
+		// The trun has data offset, duration, size and flags of samples.
+		trun := [][]byte{mp4U32(uint32(len(track.samples))), mp4U32(offset)}
+		for i, sample := range track.samples {
+			duration := track.lastDuration
+			if i < len(track.samples)-1 {
+				duration = uint32(track.samples[i+1].dts - sample.dts)
+			} else if end := mp4Timestamp(next, track.timescale); end > sample.dts && track == v.video {
+				duration = uint32(end - sample.dts)
+			}
+			track.lastDuration = duration
+
+			flags := uint32(0x01010000)
+			if sample.keyframe {
+				flags = 0x02000000
+			}
+			trun = append(trun, mp4U32(duration), mp4U32(uint32(len(sample.data))), mp4U32(flags))
+			offset += uint32(len(sample.data))
+		}
+
+		// The base is the moof, @see ISO/IEC 14496-12 8.8.7.1
+		trafs = append(trafs, mp4Box("traf",
+			mp4FullBox("tfhd", 0, 0x020000, mp4U32(track.id)),
+			mp4FullBox("tfdt", 1, 0, mp4U64(track.samples[0].dts)),
+			mp4FullBox("trun", 0, 0x000701, trun...),
+		))
+	}
+	return mp4Box("moof", trafs...)
+}
+
+func (v *mp4Muxer) Close() error {
+	defer v.f.Close()
+
+	// Guess the end of the last fragment by the last sample.
+	var next time.Duration
+	if v.video != nil && len(v.video.samples) > 0 {
+		last := v.video.samples[len(v.video.samples)-1]
+		next = time.Duration((last.dts + uint64(v.video.lastDuration)) * uint64(time.Second) / uint64(v.video.timescale))
+	}
+	return v.flush(next)
+}
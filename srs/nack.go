@@ -0,0 +1,224 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// The window of sequence number to wait for retransmission, same to the default size of pion
+// NACK generator, the lost packet out of window is never repaired.
+const nackTrackerWindow = 512
+
+// The tracker of lost packets for a SSRC, to count the repaired and unrepaired packets, and
+// cap the NACK requests for each lost packet.
+type nackTracker struct {
+	started bool
+	highest uint16
+	// The NACK requests of lost packets, by sequence number.
+	lost map[uint16]int
+}
+
+func newNackTracker() *nackTracker {
+	return &nackTracker{lost: make(map[uint16]int)}
+}
+
+// Got a RTP packet, return whether it's a repaired lost packet, and the number of lost packets
+// out of window, which are never repaired.
+func (v *nackTracker) onPacket(seq uint16) (repaired bool, unrepaired int) {
+	if !v.started {
+		v.started, v.highest = true, seq
+		return
+	}
+
+	// The older packet, repaired if it's lost.
+	diff := seq - v.highest
+	if diff == 0 || diff >= 0x8000 {
+		if _, ok := v.lost[seq]; ok {
+			delete(v.lost, seq)
+			repaired = true
+		}
+		return
+	}
+
+	// The gap is too large to repair.
+	if diff > nackTrackerWindow {
+		unrepaired = len(v.lost) + int(diff) - 1
+		v.lost, v.highest = make(map[uint16]int), seq
+		return
+	}
+
+	for lost := v.highest + 1; lost != seq; lost++ {
+		v.lost[lost] = 0
+	}
+	v.highest = seq
+
+	for lost := range v.lost {
+		if v.highest-lost >= nackTrackerWindow {
+			delete(v.lost, lost)
+			unrepaired++
+		}
+	}
+	return
+}
+
+// Filter the sequence numbers to request by NACK, ignore the packet which is not lost, for
+// example, recovered by FEC, or has been requested for max times, no limit if max is 0.
+func (v *nackTracker) filter(seqs []uint16, max int) []uint16 {
+	var requests []uint16
+	for _, seq := range seqs {
+		n, ok := v.lost[seq]
+		if !ok || (max > 0 && n >= max) {
+			continue
+		}
+		v.lost[seq] = n + 1
+		requests = append(requests, seq)
+	}
+	return requests
+}
+
+// The lost packet is recovered by FEC, neither repaired nor unrepaired.
+func (v *nackTracker) onRecovered(seq uint16) {
+	delete(v.lost, seq)
+}
+
+// The interceptor to cap the NACK requests and count the retransmissions of player, should be
+// added after the statInterceptor and before the NACK generator.
+type nackInterceptor struct {
+	stat *statPeerConnection
+	// The max NACK requests for each lost packet, no limit if 0.
+	max int
+	// The trackers by SSRC.
+	lock     sync.Mutex
+	trackers map[uint32]*nackTracker
+	// Other common fields.
+	bypassInterceptor
+}
+
+func newNackInterceptor(stat *statPeerConnection, max int) *nackInterceptor {
+	return &nackInterceptor{stat: stat, max: max, trackers: make(map[uint32]*nackTracker)}
+}
+
+func (v *nackInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, a interceptor.Attributes) (int, error) {
+		filtered := make([]rtcp.Packet, 0, len(pkts))
+		for _, pkt := range pkts {
+			if nack, ok := pkt.(*rtcp.TransportLayerNack); ok {
+				if pkt = v.filter(nack); pkt == nil {
+					continue
+				}
+			}
+			filtered = append(filtered, pkt)
+		}
+
+		if len(filtered) == 0 {
+			return 0, nil
+		}
+		return writer.Write(filtered, a)
+	})
+}
+
+// Filter the NACK, return nil if no packet to request.
+func (v *nackInterceptor) filter(nack *rtcp.TransportLayerNack) rtcp.Packet {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var seqs []uint16
+	for i := range nack.Nacks {
+		seqs = append(seqs, nack.Nacks[i].PacketList()...)
+	}
+
+	if tracker, ok := v.trackers[nack.MediaSSRC]; ok {
+		seqs = tracker.filter(seqs, v.max)
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+
+	v.stat.onNackRequests(len(seqs))
+	return &rtcp.TransportLayerNack{
+		SenderSSRC: nack.SenderSSRC, MediaSSRC: nack.MediaSSRC,
+		Nacks: rtcp.NackPairsFromSequenceNumbers(seqs),
+	}
+}
+
+func (v *nackInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	v.lock.Lock()
+	tracker := newNackTracker()
+	v.trackers[info.SSRC] = tracker
+	v.lock.Unlock()
+
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err != nil {
+			return n, a, err
+		}
+
+		var header rtp.Header
+		if err := header.Unmarshal(b[:n]); err != nil {
+			return n, a, nil
+		}
+
+		v.lock.Lock()
+		repaired, unrepaired := tracker.onPacket(header.SequenceNumber)
+		v.lock.Unlock()
+
+		v.stat.onRetransmission(repaired, unrepaired)
+		return n, a, nil
+	})
+}
+
+// The lost packet of stream is recovered by FEC, no need to request it.
+func (v *nackInterceptor) onRecovered(ssrc uint32, seq uint16) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if tracker, ok := v.trackers[ssrc]; ok {
+		tracker.onRecovered(seq)
+	}
+}
+
+// The lost packets of stream are never repaired.
+func (v *nackInterceptor) UnbindRemoteStream(info *interceptor.StreamInfo) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if tracker, ok := v.trackers[info.SSRC]; ok {
+		v.stat.onRetransmission(false, len(tracker.lost))
+		delete(v.trackers, info.SSRC)
+	}
+}
+
+// The lost packets of all streams are never repaired, because pion never unbinds the stream.
+func (v *nackInterceptor) Close() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for ssrc, tracker := range v.trackers {
+		v.stat.onRetransmission(false, len(tracker.lost))
+		delete(v.trackers, ssrc)
+	}
+	return nil
+}
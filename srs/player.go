@@ -39,12 +39,48 @@ import (
 	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
 )
 
+// The options of player, parsed from the flags, see Run.
+type playOptions struct {
+	// The file to dump audio and video, only for the first stream, and to record the stream.
+	dumpAudio, dumpVideo, record string
+	enableAudioLevel, enableTWCC bool
+	// The interval in seconds to send PLI, and the number of video tracks.
+	pli, videoTracks int
+	enableNACK       bool
+	nackMax          int
+	// The FEC and RED, enabled if not zero.
+	fec, red      int
+	latency       bool
+	token         string
+	dataChannels  int
+	dtlsRole      string
+	sdpRewrite    *sdpRewriter
+	migrate       int
+	configuration webrtc.Configuration
+}
+
 // @see https://github.com/pion/webrtc/blob/master/examples/save-to-disk/main.go
-func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioLevel, enableTWCC bool, pli int) error {
+func startPlay(ctx context.Context, r string, opts playOptions) error {
 	ctx = logger.WithContext(ctx)
 
-	logger.Tf(ctx, "Run play url=%v, audio=%v, video=%v, audio-level=%v, twcc=%v",
-		r, dumpAudio, dumpVideo, enableAudioLevel, enableTWCC)
+	logger.Tf(ctx, "Run play url=%v, audio=%v, video=%v, record=%v, audio-level=%v, twcc=%v, tracks=%v, nack=%v, nack-max=%v, fec=%v, red=%v, latency=%v",
+		r, opts.dumpAudio, opts.dumpVideo, opts.record, opts.enableAudioLevel, opts.enableTWCC, opts.videoTracks, opts.enableNACK, opts.nackMax, opts.fec, opts.red, opts.latency)
+
+	// The stat of PC, report when done.
+	stat := gStatRTC.PeerConnections.Add("play")
+	defer func() {
+		logger.Tf(ctx, "Stat %v", stat)
+	}()
+
+	// For network migration, run PC in vnet and proxy to SRS.
+	var migrator *networkMigrator
+	if opts.migrate > 0 {
+		var err error
+		if migrator, err = newNetworkMigrator(*srsVnetClientIP); err != nil {
+			return errors.Wrapf(err, "Create migrator")
+		}
+		defer migrator.Close()
+	}
 
 	// For audio-level.
 	webrtcNewPeerConnection := func(configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
@@ -52,9 +88,24 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 		if err := m.RegisterDefaultCodecs(); err != nil {
 			return nil, err
 		}
+		for _, codec := range []webrtc.RTPCodecParameters{h265Codec, av1Codec} {
+			if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+				return nil, err
+			}
+		}
+		if opts.fec > 0 {
+			if err := registerFECCodecs(m); err != nil {
+				return nil, err
+			}
+		}
+		if opts.red > 0 {
+			if err := registerAudioREDCodec(m); err != nil {
+				return nil, err
+			}
+		}
 
 		for _, extension := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdp.TransportCCURI} {
-			if extension == sdp.TransportCCURI && !enableTWCC {
+			if extension == sdp.TransportCCURI && !opts.enableTWCC {
 				continue
 			}
 			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
@@ -65,7 +116,7 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 		// https://github.com/pion/ion/issues/130
 		// https://github.com/pion/ion-sfu/pull/373/files#diff-6f42c5ac6f8192dd03e5a17e9d109e90cb76b1a4a7973be6ce44a89ffd1b5d18R73
 		for _, extension := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdp.AudioLevelURI} {
-			if extension == sdp.AudioLevelURI && !enableAudioLevel {
+			if extension == sdp.AudioLevelURI && !opts.enableAudioLevel {
 				continue
 			}
 			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeAudio); err != nil {
@@ -73,16 +124,51 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 			}
 		}
 
+		// Collect the stat first, to see all packets of other interceptors. Always count the
+		// retransmissions, even if NACK is disabled, for the never repaired packets.
 		i := &interceptor.Registry{}
-		if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		i.Add(newStatInterceptor(stat))
+		nack := newNackInterceptor(stat, opts.nackMax)
+		i.Add(nack)
+
+		// Send TWCC feedback, for the congestion control of server.
+		if opts.enableTWCC {
+			m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC}, webrtc.RTPCodecTypeVideo)
+			i.Add(newTWCCInterceptor(stat))
+		}
+
+		if opts.enableNACK {
+			if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+				return nil, err
+			}
+		} else if err := webrtc.ConfigureRTCPReports(i); err != nil {
 			return nil, err
 		}
 
-		api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+		// Recover by FEC after NACK, which requests the lost packets of RED, not the recovered.
+		if opts.fec > 0 {
+			i.Add(newFECDecoderInterceptor(stat, nack))
+		}
+		if opts.red > 0 {
+			i.Add(newREDDecoderInterceptor(stat, nack))
+		}
+
+		// Measure the latency by SEI, after the packets are restored by FEC.
+		if opts.latency {
+			i.Add(newLatencyInterceptor(&gStatRTC.Latency))
+		}
+
+		s := webrtc.SettingEngine{}
+		if migrator != nil {
+			migrator.SetupSettingEngine(&s)
+		}
+
+		api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
 		return api.NewPeerConnection(configuration)
 	}
 
-	pc, err := webrtcNewPeerConnection(webrtc.Configuration{})
+	start := time.Now()
+	pc, err := webrtcNewPeerConnection(opts.configuration)
 	if err != nil {
 		return errors.Wrapf(err, "Create PC")
 	}
@@ -98,9 +184,17 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 	pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionRecvonly,
 	})
-	pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
-		Direction: webrtc.RTPTransceiverDirectionRecvonly,
-	})
+	for i := 0; i < opts.videoTracks; i++ {
+		pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+	}
+
+	if opts.dataChannels > 0 {
+		if err := newDataChannelReceiver(ctx).Start(pc, opts.dataChannels); err != nil {
+			return errors.Wrapf(err, "Start datachannels")
+		}
+	}
 
 	offer, err := pc.CreateOffer(nil)
 	if err != nil {
@@ -111,9 +205,27 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 		return errors.Wrapf(err, "Set offer %v", offer)
 	}
 
-	answer, err := apiRtcRequest(ctx, "/rtc/v1/play", r, offer.SDP)
+	// Only change the DTLS role of offer to SRS, pion follows the role of answer.
+	offerSDP, err := dtlsRoleOffer(offer.SDP, opts.dtlsRole)
 	if err != nil {
-		return errors.Wrapf(err, "Api request offer=%v", offer.SDP)
+		return errors.Wrapf(err, "DTLS role %v offer=%v", opts.dtlsRole, offer.SDP)
+	}
+
+	// Rewrite the offer and answer by rules, to probe the SDP parser of server.
+	offerSDP = opts.sdpRewrite.Offer(offerSDP)
+
+	answer, teardown, err := apiSignalRequest(ctx, "/rtc/v1/play", r, opts.token, offerSDP)
+	if err != nil {
+		return errors.Wrapf(err, "Api request offer=%v", offerSDP)
+	}
+	defer teardown()
+
+	answer = opts.sdpRewrite.Answer(answer)
+
+	if migrator != nil {
+		if err := migrator.Proxy(answer); err != nil {
+			return errors.Wrapf(err, "Proxy answer=%v", answer)
+		}
 	}
 
 	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
@@ -122,9 +234,27 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 		return errors.Wrapf(err, "Set answer %v", answer)
 	}
 
+	// Record the H.264 and opus to a file, besides the dumpers.
+	var recorder *rtcRecorder
+	if opts.record != "" {
+		if recorder, err = newRTCRecorder(opts.record); err != nil {
+			return errors.Wrapf(err, "New recorder")
+		}
+		logger.Tf(ctx, "Open recorder file=%v", opts.record)
+	}
+	defer func() {
+		if recorder != nil {
+			if err := recorder.Close(); err != nil {
+				logger.Wf(ctx, "Close recorder file=%v err %+v", opts.record, err)
+			}
+		}
+	}()
+
 	var da media.Writer
 	var dv_vp8 media.Writer
 	var dv_h264 media.Writer
+	var dv_h265 media.Writer
+	var dv_av1 media.Writer
 	defer func() {
 		if da != nil {
 			da.Close()
@@ -135,6 +265,12 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 		if dv_h264 != nil {
 			dv_h264.Close()
 		}
+		if dv_h265 != nil {
+			dv_h265.Close()
+		}
+		if dv_av1 != nil {
+			dv_av1.Close()
+		}
 	}()
 
 	handleTrack := func(ctx context.Context, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) error {
@@ -144,7 +280,7 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 				return
 			}
 
-			if pli <= 0 {
+			if opts.pli <= 0 {
 				return
 			}
 
@@ -152,7 +288,7 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 				select {
 				case <-ctx.Done():
 					return
-				case <-time.After(time.Duration(pli) * time.Second):
+				case <-time.After(time.Duration(opts.pli) * time.Second):
 					_ = pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{
 						MediaSSRC: uint32(track.SSRC()),
 					}})
@@ -174,46 +310,91 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 		logger.Tf(ctx, "Got track %v, pt=%v, tbn=%v, %v",
 			codec.MimeType, codec.PayloadType, codec.ClockRate, trackDesc)
 
+		// For multiple video tracks, only dump and record the first one, and read the others.
+		if track.Kind() == webrtc.RTPCodecTypeVideo && !isFirstVideoReceiver(pc, receiver) {
+			if err = writeTrackToDisk(ctx, track); err != nil {
+				return errors.Wrapf(err, "Read video")
+			}
+			return nil
+		}
+
+		var rw media.Writer
+		if recorder != nil {
+			if rw = recorder.Track(codec); rw == nil {
+				logger.Wf(ctx, "Ignore record track %v", codec.MimeType)
+			}
+		}
+
 		if codec.MimeType == "audio/opus" {
-			if da == nil && dumpAudio != "" {
-				if da, err = oggwriter.New(dumpAudio, codec.ClockRate, codec.Channels); err != nil {
+			if da == nil && opts.dumpAudio != "" {
+				if da, err = oggwriter.New(opts.dumpAudio, codec.ClockRate, codec.Channels); err != nil {
 					return errors.Wrapf(err, "New audio dumper")
 				}
 				logger.Tf(ctx, "Open ogg writer file=%v, tbn=%v, channels=%v",
-					dumpAudio, codec.ClockRate, codec.Channels)
+					opts.dumpAudio, codec.ClockRate, codec.Channels)
 			}
 
-			if err = writeTrackToDisk(ctx, da, track); err != nil {
+			if err = writeTrackToDisk(ctx, track, da, rw); err != nil {
 				return errors.Wrapf(err, "Write audio disk")
 			}
 		} else if codec.MimeType == "video/VP8" {
-			if dumpVideo != "" && !strings.HasSuffix(dumpVideo, ".ivf") {
-				return errors.Errorf("%v should be .ivf for VP8", dumpVideo)
+			if opts.dumpVideo != "" && !strings.HasSuffix(opts.dumpVideo, ".ivf") {
+				return errors.Errorf("%v should be .ivf for VP8", opts.dumpVideo)
 			}
 
-			if dv_vp8 == nil && dumpVideo != "" {
-				if dv_vp8, err = ivfwriter.New(dumpVideo); err != nil {
+			if dv_vp8 == nil && opts.dumpVideo != "" {
+				if dv_vp8, err = ivfwriter.New(opts.dumpVideo); err != nil {
 					return errors.Wrapf(err, "New video dumper")
 				}
-				logger.Tf(ctx, "Open ivf writer file=%v", dumpVideo)
+				logger.Tf(ctx, "Open ivf writer file=%v", opts.dumpVideo)
 			}
 
-			if err = writeTrackToDisk(ctx, dv_vp8, track); err != nil {
+			if err = writeTrackToDisk(ctx, track, dv_vp8, rw); err != nil {
 				return errors.Wrapf(err, "Write video disk")
 			}
 		} else if codec.MimeType == "video/H264" {
-			if dumpVideo != "" && !strings.HasSuffix(dumpVideo, ".h264") {
-				return errors.Errorf("%v should be .h264 for H264", dumpVideo)
+			if opts.dumpVideo != "" && !strings.HasSuffix(opts.dumpVideo, ".h264") {
+				return errors.Errorf("%v should be .h264 for H264", opts.dumpVideo)
+			}
+
+			if dv_h264 == nil && opts.dumpVideo != "" {
+				if dv_h264, err = h264writer.New(opts.dumpVideo); err != nil {
+					return errors.Wrapf(err, "New video dumper")
+				}
+				logger.Tf(ctx, "Open h264 writer file=%v", opts.dumpVideo)
+			}
+
+			if err = writeTrackToDisk(ctx, track, dv_h264, rw); err != nil {
+				return errors.Wrapf(err, "Write video disk")
+			}
+		} else if codec.MimeType == mimeTypeH265 {
+			if opts.dumpVideo != "" && !strings.HasSuffix(opts.dumpVideo, ".h265") {
+				return errors.Errorf("%v should be .h265 for H265", opts.dumpVideo)
+			}
+
+			if dv_h265 == nil && opts.dumpVideo != "" {
+				if dv_h265, err = newH265Writer(opts.dumpVideo); err != nil {
+					return errors.Wrapf(err, "New video dumper")
+				}
+				logger.Tf(ctx, "Open h265 writer file=%v", opts.dumpVideo)
 			}
 
-			if dv_h264 == nil && dumpVideo != "" {
-				if dv_h264, err = h264writer.New(dumpVideo); err != nil {
+			if err = writeTrackToDisk(ctx, track, dv_h265, rw); err != nil {
+				return errors.Wrapf(err, "Write video disk")
+			}
+		} else if codec.MimeType == mimeTypeAV1 {
+			if opts.dumpVideo != "" && !strings.HasSuffix(opts.dumpVideo, ".ivf") && !strings.HasSuffix(opts.dumpVideo, ".obu") {
+				return errors.Errorf("%v should be .ivf or .obu for AV1", opts.dumpVideo)
+			}
+
+			if dv_av1 == nil && opts.dumpVideo != "" {
+				if dv_av1, err = newAV1Writer(opts.dumpVideo); err != nil {
 					return errors.Wrapf(err, "New video dumper")
 				}
-				logger.Tf(ctx, "Open h264 writer file=%v", dumpVideo)
+				logger.Tf(ctx, "Open av1 writer file=%v", opts.dumpVideo)
 			}
 
-			if err = writeTrackToDisk(ctx, dv_h264, track); err != nil {
+			if err = writeTrackToDisk(ctx, track, dv_av1, rw); err != nil {
 				return errors.Wrapf(err, "Write video disk")
 			}
 		} else {
@@ -235,6 +416,10 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		logger.If(ctx, "ICE state %v", state)
 
+		if state == webrtc.ICEConnectionStateConnected {
+			logger.Tf(ctx, "ICE connected in %v, %v", time.Since(start), describeSelectedCandidatePair(pc))
+		}
+
 		if state == webrtc.ICEConnectionStateFailed || state == webrtc.ICEConnectionStateClosed {
 			if ctx.Err() != nil {
 				return
@@ -248,6 +433,18 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 	// Wait for event from context or tracks.
 	var wg sync.WaitGroup
 
+	// Switch the client address for each interval, SRS should keep the session alive.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if migrator == nil {
+			return
+		}
+
+		migrator.Run(ctx, time.Duration(opts.migrate)*time.Second)
+	}()
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -266,7 +463,17 @@ func startPlay(ctx context.Context, r, dumpAudio, dumpVideo string, enableAudioL
 	return err
 }
 
-func writeTrackToDisk(ctx context.Context, w media.Writer, track *webrtc.TrackRemote) error {
+// Whether the receiver is of the first video transceiver of PC.
+func isFirstVideoReceiver(pc *webrtc.PeerConnection, receiver *webrtc.RTPReceiver) bool {
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Kind() == webrtc.RTPCodecTypeVideo {
+			return transceiver.Receiver() == receiver
+		}
+	}
+	return false
+}
+
+func writeTrackToDisk(ctx context.Context, track *webrtc.TrackRemote, writers ...media.Writer) error {
 	for ctx.Err() == nil {
 		pkt, _, err := track.ReadRTP()
 		if err != nil {
@@ -276,15 +483,17 @@ func writeTrackToDisk(ctx context.Context, w media.Writer, track *webrtc.TrackRe
 			return errors.Wrapf(err, "Read RTP")
 		}
 
-		if w == nil {
-			continue
-		}
-
-		if err := w.WriteRTP(pkt); err != nil {
-			if len(pkt.Payload) <= 2 {
+		for _, w := range writers {
+			if w == nil {
 				continue
 			}
-			logger.Wf(ctx, "Ignore write RTP %vB err %+v", len(pkt.Payload), err)
+
+			if err := w.WriteRTP(pkt); err != nil {
+				if len(pkt.Payload) <= 2 {
+					continue
+				}
+				logger.Wf(ctx, "Ignore write RTP %vB err %+v", len(pkt.Payload), err)
+			}
 		}
 	}
 
@@ -22,7 +22,9 @@ package srs
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,27 +35,94 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
+// The options of publisher, parsed from the flags, see Run.
+type publishOptions struct {
+	// The source files, the video of simulcast layers are separated by comma.
+	sourceAudio, sourceVideo     string
+	fps                          int
+	enableAudioLevel, enableTWCC bool
+	simulcast, videoTracks       int
+	token                        string
+	// The audio transcoded by FFmpeg, with the bitrate in kbps and frame size in ms.
+	ffmpeg         string
+	audioBitrate   int
+	audioFrameSize float64
+	// The video bitrate in kbps, ramp from videoBitrateFrom in videoRamp seconds, or wave in videoWave seconds.
+	videoBitrate, videoBitrateFrom, videoRamp, videoWave int
+	// The FEC and RED, enabled if not zero.
+	fec, red int
+	latency  bool
+	// The number of datachannels, and the size and rate of messages.
+	dataChannels, dataChannelSize, dataChannelRate int
+	dtlsRole                                       string
+	sdpRewrite                                     *sdpRewriter
+	migrate                                        int
+	configuration                                  webrtc.Configuration
+}
+
 // @see https://github.com/pion/webrtc/blob/master/examples/play-from-disk/main.go
-func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps int, enableAudioLevel, enableTWCC bool) error {
+func startPublish(ctx context.Context, r string, opts publishOptions) error {
 	ctx = logger.WithContext(ctx)
 
-	logger.Tf(ctx, "Run publish url=%v, audio=%v, video=%v, fps=%v, audio-level=%v, twcc=%v",
-		r, sourceAudio, sourceVideo, fps, enableAudioLevel, enableTWCC)
+	logger.Tf(ctx, "Run publish url=%v, audio=%v, video=%v, fps=%v, audio-level=%v, twcc=%v, simulcast=%v, tracks=%v, vbitrate=%v, fec=%v, red=%v, latency=%v",
+		r, opts.sourceAudio, opts.sourceVideo, opts.fps, opts.enableAudioLevel, opts.enableTWCC, opts.simulcast, opts.videoTracks, opts.videoBitrate, opts.fec, opts.red, opts.latency)
+
+	// The SEI of latency is only for H.264.
+	if opts.latency && (opts.sourceVideo == "" || videoCodecOfSource(opts.sourceVideo) != nil) {
+		logger.Wf(ctx, "Ignore latency for video %v, H.264 only", opts.sourceVideo)
+	}
 
 	// Filter for SPS/PPS marker.
 	var aIngester *audioIngester
 	var vIngester *videoIngester
+	// All video tracks in the same PC, the first one is vIngester.
+	var vIngesters []*videoIngester
+
+	// For ULPFEC in RED of video and RED of audio, enabled if server accepts it.
+	var fecEncoder *fecEncoderInterceptor
+	var redEncoder *redEncoderInterceptor
+
+	// The stat of PC, report when done.
+	stat := gStatRTC.PeerConnections.Add("publish")
+	defer func() {
+		logger.Tf(ctx, "Stat %v", stat)
+	}()
+
+	// For network migration, run PC in vnet and proxy to SRS.
+	var migrator *networkMigrator
+	if opts.migrate > 0 {
+		var err error
+		if migrator, err = newNetworkMigrator(*srsVnetClientIP); err != nil {
+			return errors.Wrapf(err, "Create migrator")
+		}
+		defer migrator.Close()
+	}
 
 	// For audio-level and sps/pps marker.
 	// TODO: FIXME: Should share with player.
 	webrtcNewPeerConnection := func(configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
+		// For H.265 and AV1, only register it for video, because the server might choose other codecs.
 		m := &webrtc.MediaEngine{}
-		if err := m.RegisterDefaultCodecs(); err != nil {
+		if codec := videoCodecOfSource(opts.sourceVideo); codec != nil {
+			if err := registerSingleVideoCodec(m, *codec); err != nil {
+				return nil, err
+			}
+		} else if err := m.RegisterDefaultCodecs(); err != nil {
 			return nil, err
 		}
+		if opts.fec > 0 {
+			if err := registerFECCodecs(m); err != nil {
+				return nil, err
+			}
+		}
+		if opts.red > 0 {
+			if err := registerAudioREDCodec(m); err != nil {
+				return nil, err
+			}
+		}
 
 		for _, extension := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdp.TransportCCURI} {
-			if extension == sdp.TransportCCURI && !enableTWCC {
+			if extension == sdp.TransportCCURI && !opts.enableTWCC {
 				continue
 			}
 			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
@@ -64,7 +133,7 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 		// https://github.com/pion/ion/issues/130
 		// https://github.com/pion/ion-sfu/pull/373/files#diff-6f42c5ac6f8192dd03e5a17e9d109e90cb76b1a4a7973be6ce44a89ffd1b5d18R73
 		for _, extension := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdp.AudioLevelURI} {
-			if extension == sdp.AudioLevelURI && !enableAudioLevel {
+			if extension == sdp.AudioLevelURI && !opts.enableAudioLevel {
 				continue
 			}
 			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeAudio); err != nil {
@@ -72,25 +141,65 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 			}
 		}
 
+		// Collect the stat first, to see all packets of other interceptors.
 		registry := &interceptor.Registry{}
+		registry.Add(newStatInterceptor(stat))
 		if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
 			return nil, err
 		}
 
-		if sourceAudio != "" {
-			aIngester = newAudioIngester(sourceAudio)
+		// Protect the video by FEC, outer of NACK responder, so the RED and FEC packets are retransmitted.
+		if opts.fec > 0 {
+			fecEncoder = newFECEncoderInterceptor(opts.fec)
+			registry.Add(fecEncoder)
+		}
+		if opts.red > 0 {
+			redEncoder = newREDEncoderInterceptor(opts.red)
+			registry.Add(redEncoder)
+		}
+
+		if opts.sourceAudio != "" {
+			aIngester = newAudioIngester(opts.sourceAudio)
+			aIngester.ffmpeg, aIngester.bitrate, aIngester.frameSize = opts.ffmpeg, opts.audioBitrate, opts.audioFrameSize
 			registry.Add(aIngester.audioLevelInterceptor)
 		}
-		if sourceVideo != "" {
-			vIngester = newVideoIngester(sourceVideo)
+		if opts.sourceVideo != "" {
+			// For simulcast, the sources of layers are separated by comma.
+			sources := strings.Split(opts.sourceVideo, ",")
+			vIngester = newVideoIngester(sources[0])
+			vIngester.simulcast, vIngester.simulcastSources = opts.simulcast, sources
 			registry.Add(vIngester.markerInterceptor)
+
+			// The other video tracks share the marker interceptor, which handles all RTP packets, and dispatches them to
+			// the track by SSRC.
+			for i := 0; i < opts.videoTracks; i++ {
+				track := vIngester
+				if i > 0 {
+					track = newVideoIngester(sources[0])
+					track.trackID = fmt.Sprintf("video%v", i)
+					track.markerInterceptor = vIngester.markerInterceptor
+				}
+
+				track.latency = opts.latency
+				if opts.videoBitrate > 0 {
+					track.bitrate = newBitrateController(opts.videoBitrateFrom, opts.videoBitrate,
+						time.Duration(opts.videoRamp)*time.Second, time.Duration(opts.videoWave)*time.Second)
+				}
+				vIngesters = append(vIngesters, track)
+			}
+		}
+
+		s := webrtc.SettingEngine{}
+		if migrator != nil {
+			migrator.SetupSettingEngine(&s)
 		}
 
-		api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry))
+		api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry), webrtc.WithSettingEngine(s))
 		return api.NewPeerConnection(configuration)
 	}
 
-	pc, err := webrtcNewPeerConnection(webrtc.Configuration{})
+	start := time.Now()
+	pc, err := webrtcNewPeerConnection(opts.configuration)
 	if err != nil {
 		return errors.Wrapf(err, "Create PC")
 	}
@@ -99,7 +208,7 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 		if pc != nil {
 			pc.Close()
 		}
-		if vIngester != nil {
+		for _, vIngester := range vIngesters {
 			vIngester.Close()
 		}
 		if aIngester != nil {
@@ -108,11 +217,14 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 	}
 	defer doClose()
 
-	if vIngester != nil {
-		if err := vIngester.AddTrack(pc, fps); err != nil {
-			return errors.Wrapf(err, "Add track")
+	for _, vIngester := range vIngesters {
+		if err := vIngester.AddTrack(pc, opts.fps); err != nil {
+			return errors.Wrapf(err, "Add track %v", vIngester.trackID)
 		}
 	}
+	if len(vIngesters) > 1 {
+		vIngester.markerInterceptor.rtpWriter = videoTracksRTPWriter(vIngesters)
+	}
 
 	if aIngester != nil {
 		if err := aIngester.AddTrack(pc); err != nil {
@@ -120,6 +232,12 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 		}
 	}
 
+	if opts.dataChannels > 0 {
+		if err := startDataChannelSenders(ctx, pc, opts.dataChannels, opts.dataChannelSize, opts.dataChannelRate); err != nil {
+			return errors.Wrapf(err, "Start datachannels")
+		}
+	}
+
 	offer, err := pc.CreateOffer(nil)
 	if err != nil {
 		return errors.Wrapf(err, "Create Offer")
@@ -129,9 +247,46 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 		return errors.Wrapf(err, "Set offer %v", offer)
 	}
 
-	answer, err := apiRtcRequest(ctx, "/rtc/v1/publish", r, offer.SDP)
+	// For simulcast, only the server knows the layers, pion always sends the single SSRC.
+	offerSDP := offer.SDP
+	if vIngester != nil && len(vIngester.layers) > 0 {
+		if offerSDP, err = simulcastOffer(offer.SDP, vIngester.layers); err != nil {
+			return errors.Wrapf(err, "Simulcast offer=%v", offer.SDP)
+		}
+	}
+
+	// Only change the DTLS role of offer to SRS, pion follows the role of answer.
+	if offerSDP, err = dtlsRoleOffer(offerSDP, opts.dtlsRole); err != nil {
+		return errors.Wrapf(err, "DTLS role %v offer=%v", opts.dtlsRole, offerSDP)
+	}
+
+	// Rewrite the offer and answer by rules, to probe the SDP parser of server.
+	offerSDP = opts.sdpRewrite.Offer(offerSDP)
+
+	answer, teardown, err := apiSignalRequest(ctx, "/rtc/v1/publish", r, opts.token, offerSDP)
 	if err != nil {
-		return errors.Wrapf(err, "Api request offer=%v", offer.SDP)
+		return errors.Wrapf(err, "Api request offer=%v", offerSDP)
+	}
+	defer teardown()
+
+	answer = opts.sdpRewrite.Answer(answer)
+
+	if migrator != nil {
+		if err := migrator.Proxy(answer); err != nil {
+			return errors.Wrapf(err, "Proxy answer=%v", answer)
+		}
+	}
+
+	// The stream is bound when set answer, so enable FEC before it.
+	if fecEncoder != nil {
+		if fecEncoder.enabled = sdpHasFEC(answer); !fecEncoder.enabled {
+			logger.Wf(ctx, "Disable FEC for server does not support RED and ULPFEC")
+		}
+	}
+	if redEncoder != nil {
+		if redEncoder.enabled = sdpHasAudioRED(answer); !redEncoder.enabled {
+			logger.Wf(ctx, "Disable RED for server does not support audio RED")
+		}
 	}
 
 	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
@@ -145,6 +300,10 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 	// ICE state management.
 	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		logger.Tf(ctx, "ICE state %v", state)
+
+		if state == webrtc.ICEConnectionStateConnected {
+			logger.Tf(ctx, "ICE connected in %v, %v", time.Since(start), describeSelectedCandidatePair(pc))
+		}
 	})
 
 	pc.OnSignalingStateChange(func(state webrtc.SignalingState) {
@@ -186,6 +345,18 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 		doClose() // Interrupt the RTCP read.
 	}()
 
+	// Switch the client address for each interval, SRS should keep the session alive.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if migrator == nil {
+			return
+		}
+
+		migrator.Run(ctx, time.Duration(opts.migrate)*time.Second)
+	}()
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -219,14 +390,14 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 		select {
 		case <-ctx.Done():
 		case <-pcDoneCtx.Done():
-			logger.Tf(ctx, "PC(ICE+DTLS+SRTP) done, start ingest audio %v", sourceAudio)
+			logger.Tf(ctx, "PC(ICE+DTLS+SRTP) done, start ingest audio %v", opts.sourceAudio)
 		}
 
 		// Read audio and send out.
 		for ctx.Err() == nil {
 			if err := aIngester.Ingest(ctx); err != nil {
 				if errors.Cause(err) == io.EOF {
-					logger.Tf(ctx, "EOF, restart ingest audio %v", sourceAudio)
+					logger.Tf(ctx, "EOF, restart ingest audio %v", opts.sourceAudio)
 					continue
 				}
 				logger.Wf(ctx, "Ignore audio err %+v", err)
@@ -234,52 +405,46 @@ func startPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps i
 		}
 	}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		if vIngester == nil {
-			return
-		}
-
-		select {
-		case <-ctx.Done():
-		case <-pcDoneCtx.Done():
-			logger.Tf(ctx, "PC(ICE+DTLS+SRTP) done, start read video packets")
-		}
+	for _, vIngester := range vIngesters {
+		wg.Add(1)
+		go func(vIngester *videoIngester) {
+			defer wg.Done()
 
-		buf := make([]byte, 1500)
-		for ctx.Err() == nil {
-			if _, _, err := vIngester.sVideoSender.Read(buf); err != nil {
-				return
+			select {
+			case <-ctx.Done():
+			case <-pcDoneCtx.Done():
+				logger.Tf(ctx, "PC(ICE+DTLS+SRTP) done, start read video packets of %v", vIngester.trackID)
 			}
-		}
-	}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+			buf := make([]byte, 1500)
+			for ctx.Err() == nil {
+				if _, _, err := vIngester.sVideoSender.Read(buf); err != nil {
+					return
+				}
+			}
+		}(vIngester)
 
-		if vIngester == nil {
-			return
-		}
+		wg.Add(1)
+		go func(vIngester *videoIngester) {
+			defer wg.Done()
 
-		select {
-		case <-ctx.Done():
-		case <-pcDoneCtx.Done():
-			logger.Tf(ctx, "PC(ICE+DTLS+SRTP) done, start ingest video %v", sourceVideo)
-		}
+			select {
+			case <-ctx.Done():
+			case <-pcDoneCtx.Done():
+				logger.Tf(ctx, "PC(ICE+DTLS+SRTP) done, start ingest video %v of %v", opts.sourceVideo, vIngester.trackID)
+			}
 
-		for ctx.Err() == nil {
-			if err := vIngester.Ingest(ctx); err != nil {
-				if errors.Cause(err) == io.EOF {
-					logger.Tf(ctx, "EOF, restart ingest video %v", sourceVideo)
-					continue
+			for ctx.Err() == nil {
+				if err := vIngester.Ingest(ctx); err != nil {
+					if errors.Cause(err) == io.EOF {
+						logger.Tf(ctx, "EOF, restart ingest video %v of %v", opts.sourceVideo, vIngester.trackID)
+						continue
+					}
+					logger.Wf(ctx, "Ignore video err %+v", err)
 				}
-				logger.Wf(ctx, "Ignore video err %+v", err)
 			}
-		}
-	}()
+		}(vIngester)
+	}
 
 	wg.Add(1)
 	go func() {
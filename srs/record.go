@@ -0,0 +1,461 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/yapingcat/gomedia/codec"
+)
+
+// The H.264 NALU types, @see ITU-T H.264 Table 7-1 and RFC 6184.
+const (
+	h264NALUTypeIDR   = 5
+	h264NALUTypeSEI   = 6
+	h264NALUTypeSPS   = 7
+	h264NALUTypePPS   = 8
+	h264NALUTypeAUD   = 9
+	h264NALUTypeSTAPA = 24
+	h264NALUTypeFUA   = 28
+)
+
+// The H.264 depacketizer, to restore the NALUs from single NALU packet, STAP-A and FU-A.
+type h264Depacketizer struct {
+	// The NALU in fragmentation, nil if not started.
+	fu []byte
+}
+
+// Unmarshal the RTP payload, return the NALUs without start code, might be empty for FU-A.
+func (v *h264Depacketizer) Unmarshal(payload []byte) ([][]byte, error) {
+	if len(payload) < 2 {
+		return nil, errors.Errorf("requires 2+ bytes, actual %v", len(payload))
+	}
+
+	switch nalType := payload[0] & 0x1f; nalType {
+	case h264NALUTypeSTAPA:
+		var nals [][]byte
+		for b := payload[1:]; len(b) > 0; {
+			if len(b) < 2 {
+				return nil, errors.Errorf("requires 2 bytes size, actual %v", len(b))
+			}
+
+			size := int(b[0])<<8 | int(b[1])
+			if len(b) < 2+size {
+				return nil, errors.Errorf("requires %v bytes, actual %v", size, len(b)-2)
+			}
+
+			nals = append(nals, b[2:2+size])
+			b = b[2+size:]
+		}
+		return nals, nil
+	case h264NALUTypeFUA:
+		fuHeader := payload[1]
+		if fuHeader&0x80 != 0 {
+			v.fu = []byte{payload[0]&0xe0 | fuHeader&0x1f}
+		} else if v.fu == nil {
+			// Drop the fragments if lost the start one.
+			return nil, nil
+		}
+
+		v.fu = append(v.fu, payload[2:]...)
+		if fuHeader&0x40 == 0 {
+			return nil, nil
+		}
+
+		nal := v.fu
+		v.fu = nil
+		return [][]byte{nal}, nil
+	default:
+		return [][]byte{payload}, nil
+	}
+}
+
+// Parse the resolution of H.264 SPS without start code.
+func h264SPSResolution(sps []byte) (width, height int, err error) {
+	var rbsp []byte
+	if len(sps) > 1 {
+		rbsp = h264UnescapeRBSP(sps[1:])
+	}
+
+	// The bitstream panics if overflow.
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("invalid sps %v bytes, %v", len(sps), r)
+		}
+	}()
+
+	var s codec.SPS
+	s.Decode(codec.NewBitStream(rbsp))
+
+	// The crop unit is 2 for 4:2:0, and doubled for field.
+	cropX, cropY := 2, 2*(2-int(s.Frame_mbs_only_flag))
+	width = (int(s.Pic_width_in_mbs_minus1)+1)*16 - cropX*int(s.Frame_crop_left_offset+s.Frame_crop_right_offset)
+	height = (2-int(s.Frame_mbs_only_flag))*(int(s.Pic_height_in_map_units_minus1)+1)*16 -
+		cropY*int(s.Frame_crop_top_offset+s.Frame_crop_bottom_offset)
+	return
+}
+
+// Generate the AVCDecoderConfigurationRecord by SPS and PPS, with 4 bytes NALU length.
+// @see ISO/IEC 14496-15 5.2.4.1
+func h264AVCC(sps, pps []byte) []byte {
+	b := []byte{0x01, sps[1], sps[2], sps[3], 0xff, 0xe1, byte(len(sps) >> 8), byte(len(sps))}
+	b = append(b, sps...)
+	b = append(b, 0x01, byte(len(pps)>>8), byte(len(pps)))
+	return append(b, pps...)
+}
+
+// The tracks of record file, to write the header of container.
+type recordTracks struct {
+	// The H.264 video, nil if no video.
+	avcc          []byte
+	width, height int
+	// The opus audio, zero channels if no audio.
+	channels int
+}
+
+// The OpusHead of opus, @see https://datatracker.ietf.org/doc/html/rfc7845#section-5.1
+func (v *recordTracks) OpusHead() []byte {
+	b := []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, byte(v.channels), 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[12:], 48000)
+	return b
+}
+
+// The container of record file, the pts is relative to the start of file.
+type recordMuxer interface {
+	WriteHeader(tracks *recordTracks) error
+	WriteVideo(pts time.Duration, keyframe bool, data []byte) error
+	WriteAudio(pts time.Duration, data []byte) error
+	Close() error
+}
+
+// The frame to record, the video is in AVCC, that is NALUs with 4 bytes length.
+type recordSample struct {
+	video    bool
+	keyframe bool
+	pts      time.Duration
+	data     []byte
+}
+
+// The max audio samples before the header is written, about 10s for 20ms opus.
+const recordMaxPending = 500
+
+// The time to wait for the other track, to write the header of file.
+const recordWaitTracks = 3 * time.Second
+
+// The recorder of player, to write the H.264 and opus to .mkv or .mp4 file. The header is
+// written when all tracks are ready, that is the opus packet and H.264 keyframe with SPS/PPS,
+// and the timestamp of track is mapped to time by its first packet. Note that the SPS is not
+// updated, so the resolution should not change.
+type rtcRecorder struct {
+	filename string
+	muxer    recordMuxer
+	// The time to calculate the pts by the first packet of track.
+	start time.Time
+	lock  sync.Mutex
+	// The tracks bound by player, nil if not bound.
+	audio, video *recordTrack
+	// The tracks of header, nil if not written.
+	tracks *recordTracks
+	// The samples before header is written, and the time of the first one.
+	pending   []*recordSample
+	pendingAt time.Time
+	// The pts of the first sample, which is the start of file.
+	base time.Duration
+}
+
+func newRTCRecorder(filename string) (*rtcRecorder, error) {
+	v := &rtcRecorder{filename: filename, start: time.Now()}
+
+	var err error
+	switch path.Ext(filename) {
+	case ".mkv":
+		v.muxer, err = newMKVMuxer(filename)
+	case ".mp4":
+		v.muxer, err = newMP4Muxer(filename)
+	default:
+		err = errors.Errorf("Should be .mkv or .mp4, actual %v", filename)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %v", filename)
+	}
+	return v, nil
+}
+
+// Get the writer for track, return nil if codec is not supported.
+func (v *rtcRecorder) Track(c webrtc.RTPCodecParameters) media.Writer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	track := &recordTrack{recorder: v, clockRate: c.ClockRate, channels: int(c.Channels)}
+	if strings.EqualFold(c.MimeType, webrtc.MimeTypeOpus) && v.audio == nil {
+		if track.channels == 0 {
+			track.channels = 2
+		}
+		v.audio = track
+		return track
+	}
+	if strings.EqualFold(c.MimeType, webrtc.MimeTypeH264) && v.video == nil {
+		track.video, track.waitKeyframe = true, true
+		v.video = track
+		return track
+	}
+	return nil
+}
+
+func (v *rtcRecorder) onSample(s *recordSample) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.tracks != nil {
+		return v.writeSample(s)
+	}
+
+	if len(v.pending) == 0 {
+		v.pendingAt = time.Now()
+	}
+	v.pending = append(v.pending, s)
+	if len(v.pending) > recordMaxPending {
+		v.pending = v.pending[1:]
+	}
+
+	return v.writeHeader(false)
+}
+
+// Write the header when tracks are ready, or force to write the ready ones.
+func (v *rtcRecorder) writeHeader(force bool) error {
+	audioReady := v.audio != nil && v.audio.started
+	videoReady := v.video != nil && v.video.sps != nil
+	if !audioReady && !videoReady {
+		return nil
+	}
+
+	if !force {
+		// Wait for the other track, which might be not bound or ready.
+		if (v.audio != nil && !audioReady) || (v.video != nil && !videoReady) {
+			return nil
+		}
+		if (v.audio == nil || v.video == nil) && time.Since(v.pendingAt) < recordWaitTracks {
+			return nil
+		}
+	}
+
+	tracks := &recordTracks{}
+	if videoReady {
+		tracks.avcc, tracks.width, tracks.height = h264AVCC(v.video.sps, v.video.pps), v.video.width, v.video.height
+	}
+	if audioReady {
+		tracks.channels = v.audio.channels
+	}
+	if err := v.muxer.WriteHeader(tracks); err != nil {
+		return errors.Wrapf(err, "write header")
+	}
+	v.tracks = tracks
+
+	// Start from the first keyframe, or the first audio if no video.
+	pending := v.pending
+	v.pending = nil
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].pts < pending[j].pts
+	})
+
+	v.base = -1
+	for _, s := range pending {
+		if s.video == videoReady && v.base < 0 {
+			v.base = s.pts
+		}
+	}
+	for _, s := range pending {
+		if err := v.writeSample(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *rtcRecorder) writeSample(s *recordSample) error {
+	if v.base < 0 {
+		if s.video != (v.tracks.avcc != nil) {
+			return nil
+		}
+		v.base = s.pts
+	}
+
+	pts := s.pts - v.base
+	if pts < 0 {
+		return nil
+	}
+
+	if s.video && v.tracks.avcc != nil {
+		return v.muxer.WriteVideo(pts, s.keyframe, s.data)
+	}
+	if !s.video && v.tracks.channels > 0 {
+		return v.muxer.WriteAudio(pts, s.data)
+	}
+	return nil
+}
+
+func (v *rtcRecorder) Close() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.tracks == nil {
+		if err := v.writeHeader(true); err != nil {
+			return errors.Wrapf(err, "write header")
+		}
+	}
+	return v.muxer.Close()
+}
+
+// The track of recorder, to depacketize the RTP and map the timestamp to pts.
+type recordTrack struct {
+	recorder  *rtcRecorder
+	clockRate uint32
+	channels  int
+	// The first packet, and the unwrapped timestamp.
+	started   bool
+	firstAt   time.Duration
+	lastTS    uint32
+	timestamp int64
+	lastSeq   uint16
+	// For H.264, the frame in assembling, and the parameter sets.
+	video        bool
+	depacketizer h264Depacketizer
+	frame        [][]byte
+	frameTS      uint32
+	marker       bool
+	waitKeyframe bool
+	sps, pps     []byte
+	width        int
+	height       int
+}
+
+func (v *recordTrack) WriteRTP(pkt *rtp.Packet) error {
+	if !v.started {
+		v.started, v.firstAt = true, time.Since(v.recorder.start)
+		v.lastTS, v.frameTS, v.lastSeq = pkt.Timestamp, pkt.Timestamp, pkt.SequenceNumber-1
+	}
+
+	// Drop the frame if lost packet, and wait for keyframe.
+	lost := pkt.SequenceNumber != v.lastSeq+1
+	if diff := pkt.SequenceNumber - v.lastSeq; diff == 0 || diff >= 0x8000 {
+		return nil
+	}
+	v.lastSeq = pkt.SequenceNumber
+
+	v.timestamp += int64(int32(pkt.Timestamp - v.lastTS))
+	v.lastTS = pkt.Timestamp
+
+	if !v.video {
+		return v.recorder.onSample(&recordSample{pts: v.pts(pkt.Timestamp), data: append([]byte{}, pkt.Payload...)})
+	}
+
+	// Write the frame when got the next one, because the marker might be set for each NALU, for
+	// example, the SPS and PPS. The frame is complete if lost packets after its marker.
+	if pkt.Timestamp != v.frameTS && len(v.frame) > 0 && (!lost || v.marker) {
+		if err := v.flush(); err != nil {
+			return err
+		}
+	}
+	if lost {
+		v.frame, v.depacketizer.fu, v.waitKeyframe = nil, nil, true
+	}
+	v.frameTS, v.marker = pkt.Timestamp, pkt.Marker
+
+	nals, err := v.depacketizer.Unmarshal(pkt.Payload)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshal %v bytes", len(pkt.Payload))
+	}
+	for _, nal := range nals {
+		v.frame = append(v.frame, append([]byte{}, nal...))
+	}
+	return nil
+}
+
+// Convert the timestamp to pts, by the time of first packet.
+func (v *recordTrack) pts(ts uint32) time.Duration {
+	d := v.timestamp + int64(int32(ts-v.lastTS))
+	return v.firstAt + time.Duration(d)*time.Second/time.Duration(v.clockRate)
+}
+
+// Write the frame in AVCC, ignore before the keyframe.
+func (v *recordTrack) flush() error {
+	frame := v.frame
+	v.frame = nil
+
+	var keyframe bool
+	var data []byte
+	for _, nal := range frame {
+		if len(nal) == 0 {
+			continue
+		}
+
+		switch nal[0] & 0x1f {
+		case h264NALUTypeIDR:
+			keyframe = true
+		case h264NALUTypeSPS:
+			// Ignore the changed SPS, because the header is written.
+			if width, height, err := h264SPSResolution(nal); err == nil && len(nal) >= 4 && v.sps == nil {
+				v.sps, v.width, v.height = nal, width, height
+			}
+		case h264NALUTypePPS:
+			if v.pps == nil {
+				v.pps = nal
+			}
+		}
+
+		data = append(data, byte(len(nal)>>24), byte(len(nal)>>16), byte(len(nal)>>8), byte(len(nal)))
+		data = append(data, nal...)
+	}
+
+	if v.waitKeyframe && (!keyframe || v.sps == nil || v.pps == nil) {
+		return nil
+	}
+	v.waitKeyframe = false
+
+	return v.recorder.onSample(&recordSample{video: true, keyframe: keyframe, pts: v.pts(v.frameTS), data: data})
+}
+
+func (v *recordTrack) Close() error {
+	return nil
+}
+
+// Get the record file of stream, insert the index before the extension if multiple streams.
+func recordFilename(filename string, index, streams int) string {
+	if strings.Contains(filename, "%") {
+		return fmt.Sprintf(filename, index)
+	}
+	if streams <= 1 {
+		return filename
+	}
+
+	ext := path.Ext(filename)
+	return fmt.Sprintf("%v_%v%v", strings.TrimSuffix(filename, ext), index, ext)
+}
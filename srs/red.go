@@ -0,0 +1,272 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The RED for opus, like Chrome, the redundant blocks are the previous packets.
+// @see https://tools.ietf.org/html/rfc2198
+var audioREDCodec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType: "audio/red", ClockRate: 48000, Channels: 2, SDPFmtpLine: "111/111",
+	},
+	PayloadType: 63,
+}
+
+// The max redundancy distance of audio RED.
+const redMaxDistance = 8
+
+// Register the RED codec for audio.
+func registerAudioREDCodec(m *webrtc.MediaEngine) error {
+	if err := m.RegisterCodec(audioREDCodec, webrtc.RTPCodecTypeAudio); err != nil {
+		return errors.Wrapf(err, "register %v", audioREDCodec.MimeType)
+	}
+	return nil
+}
+
+// Whether the SDP negotiates the RED for audio.
+func sdpHasAudioRED(sdp string) bool {
+	return strings.Contains(sdp, " red/48000")
+}
+
+// The block of RED, the timestamp offset is zero for the primary block.
+type redBlock struct {
+	pt       uint8
+	tsOffset uint32
+	data     []byte
+}
+
+// Parse the RED payload to blocks, the last one is the primary block.
+func redDecode(payload []byte) ([]*redBlock, error) {
+	var blocks []*redBlock
+	var offset int
+	for {
+		if len(payload) < offset+1 {
+			return nil, errors.Errorf("red requires %v bytes, only %v", offset+1, len(payload))
+		}
+		if payload[offset]&0x80 == 0 {
+			blocks = append(blocks, &redBlock{pt: payload[offset] & 0x7f})
+			offset++
+			break
+		}
+		if len(payload) < offset+4 {
+			return nil, errors.Errorf("red requires %v bytes, only %v", offset+4, len(payload))
+		}
+
+		v := binary.BigEndian.Uint32(payload[offset:])
+		blocks = append(blocks, &redBlock{
+			pt: uint8(v>>24) & 0x7f, tsOffset: (v >> 10) & 0x3fff, data: make([]byte, v&0x3ff),
+		})
+		offset += 4
+	}
+
+	for _, block := range blocks[:len(blocks)-1] {
+		if len(payload) < offset+len(block.data) {
+			return nil, errors.Errorf("red requires %v bytes, only %v", offset+len(block.data), len(payload))
+		}
+		block.data = payload[offset : offset+len(block.data)]
+		offset += len(block.data)
+	}
+	blocks[len(blocks)-1].data = payload[offset:]
+	return blocks, nil
+}
+
+// Parse the RED payload, return the payload type and data of the primary block, ignore the
+// redundant blocks.
+func redDecapsulate(payload []byte) (uint8, []byte, error) {
+	blocks, err := redDecode(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	primary := blocks[len(blocks)-1]
+	return primary.pt, primary.data, nil
+}
+
+// Generate the RED payload by blocks, the last one is the primary block. The redundant block
+// is ignored if its timestamp offset or size overflows.
+func redEncode(blocks []*redBlock) []byte {
+	var redundant []*redBlock
+	for _, block := range blocks[:len(blocks)-1] {
+		if block.tsOffset < 0x4000 && len(block.data) < 0x400 {
+			redundant = append(redundant, block)
+		}
+	}
+
+	var b []byte
+	for _, block := range redundant {
+		b = append(b, 0x80|block.pt, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], 0x80000000|uint32(block.pt)<<24|block.tsOffset<<10|uint32(len(block.data)))
+	}
+
+	primary := blocks[len(blocks)-1]
+	b = append(b, primary.pt&0x7f)
+	for _, block := range redundant {
+		b = append(b, block.data...)
+	}
+	return append(b, primary.data...)
+}
+
+// Remove the padding of RTP packet, which is not part of the payload.
+func rtpRemovePadding(pkt *rtp.Packet) {
+	if !pkt.Padding || len(pkt.Payload) == 0 {
+		return
+	}
+	if size := int(pkt.Payload[len(pkt.Payload)-1]); size <= len(pkt.Payload) {
+		pkt.Payload = pkt.Payload[:len(pkt.Payload)-size]
+		pkt.Padding = false
+	}
+}
+
+// The interceptor of publisher, to send opus in RED with the previous packets as redundant
+// blocks, should be added after the default interceptors.
+type redEncoderInterceptor struct {
+	// The number of previous packets in each RED packet.
+	distance int
+	// Whether the answer negotiates the RED, set before the stream is bound.
+	enabled bool
+	// Other common fields.
+	bypassInterceptor
+}
+
+func newREDEncoderInterceptor(distance int) *redEncoderInterceptor {
+	return &redEncoderInterceptor{distance: distance}
+}
+
+func (v *redEncoderInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !v.enabled || !strings.EqualFold(info.MimeType, webrtc.MimeTypeOpus) {
+		return writer
+	}
+
+	// The previous packets, the timestamp offset of block is the timestamp.
+	var lock sync.Mutex
+	var previous []*redBlock
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		blocks := make([]*redBlock, 0, len(previous)+1)
+		for _, block := range previous {
+			blocks = append(blocks, &redBlock{pt: block.pt, tsOffset: header.Timestamp - block.tsOffset, data: block.data})
+		}
+		blocks = append(blocks, &redBlock{pt: header.PayloadType, data: payload})
+
+		previous = append(previous, &redBlock{pt: header.PayloadType, tsOffset: header.Timestamp, data: append([]byte{}, payload...)})
+		if len(previous) > v.distance {
+			previous = previous[len(previous)-v.distance:]
+		}
+
+		red := *header
+		red.PayloadType = uint8(audioREDCodec.PayloadType)
+		return writer.Write(&red, redEncode(blocks), a)
+	})
+}
+
+// The interceptor of player, to decapsulate the RED of opus and recover the lost packets by the
+// redundant blocks, should be added after the default interceptors, like fecDecoderInterceptor.
+type redDecoderInterceptor struct {
+	stat *statPeerConnection
+	// To stop NACK for the recovered packets.
+	nack *nackInterceptor
+	// Other common fields.
+	bypassInterceptor
+}
+
+func newREDDecoderInterceptor(stat *statPeerConnection, nack *nackInterceptor) *redDecoderInterceptor {
+	return &redDecoderInterceptor{stat: stat, nack: nack}
+}
+
+func (v *redDecoderInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	// The received sequence numbers plus one, by sequence number modulo the window.
+	var received [fecRecoverWindow]int
+	var started bool
+	var first uint16
+	isReceived := func(seq uint16) bool {
+		return received[seq%fecRecoverWindow] == int(seq)+1
+	}
+
+	// The recovered and primary packets to read.
+	var packets [][]byte
+
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		for {
+			if len(packets) > 0 {
+				n := copy(b, packets[0])
+				packets = packets[1:]
+				return n, a, nil
+			}
+
+			n, a, err := reader.Read(b, a)
+			if err != nil {
+				return n, a, err
+			}
+
+			var pkt rtp.Packet
+			if err := pkt.Unmarshal(b[:n]); err != nil || pkt.PayloadType != uint8(audioREDCodec.PayloadType) {
+				return n, a, nil
+			}
+
+			rtpRemovePadding(&pkt)
+			blocks, err := redDecode(pkt.Payload)
+			if err != nil {
+				return n, a, nil
+			}
+			if !started {
+				started, first = true, pkt.SequenceNumber
+			}
+
+			// The redundant blocks are the previous packets, recover the lost one which is after the
+			// first packet. The primary block is dropped if duplicated, for example, retransmitted.
+			for i, block := range blocks {
+				seq := pkt.SequenceNumber - uint16(len(blocks)-1-i)
+				if isReceived(seq) || int16(seq-first) < 0 {
+					continue
+				}
+
+				media := pkt
+				media.SequenceNumber, media.Timestamp = seq, pkt.Timestamp-block.tsOffset
+				media.PayloadType, media.Payload = block.pt, block.data
+				raw, err := media.Marshal()
+				if err != nil {
+					continue
+				}
+
+				received[seq%fecRecoverWindow] = int(seq) + 1
+				packets = append(packets, raw)
+
+				if i < len(blocks)-1 {
+					v.stat.onRedRecovered()
+					v.nack.onRecovered(pkt.SSRC, seq)
+				}
+			}
+		}
+	})
+}
@@ -21,14 +21,24 @@
 package srs
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"strings"
 	"sync"
 	"testing"
@@ -43,6 +53,7 @@ import (
 	"github.com/pion/interceptor"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 )
 
 // Test for https://github.com/ossrs/srs/pull/2483
@@ -2063,3 +2074,1054 @@ func TestRtcPublish_HttpFlvPlay(t *testing.T) {
 		}()
 	}()
 }
+
+func TestRtcH265_PayloadRoundtrip(t *testing.T) {
+	if err := func() error {
+		// The VPS/SPS/PPS, an IDR exceed MTU, then two slices of a TRAIL picture.
+		vps, sps, pps := []byte{0x40, 0x01, 0x0c}, []byte{0x42, 0x01, 0x01}, []byte{0x44, 0x01, 0xc1}
+		idr := append([]byte{0x26, 0x01, 0xaf}, bytes.Repeat([]byte{0xab}, 3000)...)
+		slice0, slice1 := []byte{0x02, 0x01, 0xd0, 0x01}, []byte{0x02, 0x01, 0x40, 0x02}
+
+		var annexb []byte
+		for _, nal := range [][]byte{vps, sps, pps, idr, slice0, slice1} {
+			annexb = append(append(annexb, 0x00, 0x00, 0x00, 0x01), nal...)
+		}
+
+		r := newH265Reader(bytes.NewReader(annexb))
+		keyframe, err := r.NextFrame()
+		if err != nil {
+			return errors.Wrapf(err, "read keyframe")
+		}
+		if len(keyframe) != 4 || !keyframe[3].IsIRAP() {
+			return errors.Errorf("invalid keyframe %v nalus", len(keyframe))
+		}
+
+		frame, err := r.NextFrame()
+		if err != nil {
+			return errors.Wrapf(err, "read frame")
+		}
+		if len(frame) != 2 || !frame[0].IsFirstSlice() || frame[1].IsFirstSlice() {
+			return errors.Errorf("invalid frame %v nalus", len(frame))
+		}
+
+		if _, err := r.NextFrame(); err != io.EOF {
+			return errors.Errorf("should be EOF, actual %v", err)
+		}
+
+		// Packetize the parameter sets as AP, and IDR as FU, then restore them.
+		var payloads [][]byte
+		payloader := &h265Payloader{}
+		for _, nal := range []*h265NAL{packageAsAP(keyframe[:3]...), keyframe[3], frame[0], frame[1]} {
+			payloads = append(payloads, payloader.Payload(rtpOutboundMTU, nal.Data)...)
+		}
+		if len(payloads) != 6 {
+			return errors.Errorf("invalid %v payloads", len(payloads))
+		}
+
+		var nals [][]byte
+		var depacketizer h265Depacketizer
+		for _, payload := range payloads {
+			if len(payload) > rtpOutboundMTU {
+				return errors.Errorf("payload %v exceed mtu", len(payload))
+			}
+
+			b, err := depacketizer.Unmarshal(payload)
+			if err != nil {
+				return errors.Wrapf(err, "unmarshal")
+			}
+			nals = append(nals, b...)
+		}
+
+		expects := [][]byte{vps, sps, pps, idr, slice0, slice1}
+		if len(nals) != len(expects) {
+			return errors.Errorf("invalid %v nalus", len(nals))
+		}
+		for i, nal := range nals {
+			if !bytes.Equal(nal, expects[i]) {
+				return errors.Errorf("nalu %v mismatch %v bytes", i, len(nal))
+			}
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcAV1_PayloadRoundtrip(t *testing.T) {
+	if err := func() error {
+		// The sequence header, a frame with extension exceed MTU, and a small frame.
+		seq := &av1OBU{Header: []byte{av1OBUTypeSequenceHeader << 3}, Payload: []byte{0x00, 0x00, 0x00}}
+		frame := &av1OBU{Header: []byte{6<<3 | 0x04, 0x08}, Payload: bytes.Repeat([]byte{0xab}, 3000)}
+		small := &av1OBU{Header: []byte{6 << 3}, Payload: []byte{0x01, 0x02}}
+
+		// Write two temporal units in .obu, which starts with temporal delimiter.
+		var obu []byte
+		for _, tu := range [][]*av1OBU{{seq, frame}, {small}} {
+			obu = av1TemporalDelimiter.Marshal(obu)
+			for _, o := range tu {
+				obu = o.Marshal(obu)
+			}
+		}
+
+		r, err := newAV1Reader(bytes.NewReader(obu), false)
+		if err != nil {
+			return errors.Wrapf(err, "new reader")
+		}
+
+		var payloads [][]byte
+		payloader := &av1Payloader{}
+		for {
+			tu, err := r.NextTemporalUnit()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return errors.Wrapf(err, "read tu")
+			}
+
+			var b []byte
+			for _, o := range tu {
+				b = o.Marshal(b)
+			}
+			payloads = append(payloads, payloader.Payload(rtpOutboundMTU, b)...)
+		}
+		if len(payloads) != 4 || payloads[0][0]&0x08 == 0 || payloads[3][0]&0x08 != 0 {
+			return errors.Errorf("invalid %v payloads", len(payloads))
+		}
+
+		var obus []*av1OBU
+		var depacketizer av1Depacketizer
+		for _, payload := range payloads {
+			if len(payload) > rtpOutboundMTU {
+				return errors.Errorf("payload %v exceed mtu", len(payload))
+			}
+
+			o, err := depacketizer.Unmarshal(payload)
+			if err != nil {
+				return errors.Wrapf(err, "unmarshal")
+			}
+			obus = append(obus, o...)
+		}
+
+		expects := []*av1OBU{seq, frame, small}
+		if len(obus) != len(expects) {
+			return errors.Errorf("invalid %v obus", len(obus))
+		}
+		for i, o := range obus {
+			if !bytes.Equal(o.Marshal(nil), expects[i].Marshal(nil)) {
+				return errors.Errorf("obu %v mismatch %v bytes", i, len(o.Payload))
+			}
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcOpus_TranscodeArgs(t *testing.T) {
+	if err := func() error {
+		if !isOpusSource("avatar.ogg") || !isOpusSource("avatar.opus") || isOpusSource("avatar.aac") {
+			return errors.New("invalid opus source")
+		}
+
+		// The raw PCM must specify the format before input.
+		args := strings.Join(opusTranscodeArgs("avatar.pcm", 32, 10), " ")
+		if !strings.HasPrefix(args, "-f s16le -ar 48000 -ac 2 -i avatar.pcm") {
+			return errors.Errorf("invalid pcm args %v", args)
+		}
+
+		// Each page has only one packet, so the page duration is the frame size.
+		args = strings.Join(opusTranscodeArgs("avatar.aac", 48, 2.5), " ")
+		if !strings.HasPrefix(args, "-i avatar.aac") {
+			return errors.Errorf("invalid aac args %v", args)
+		}
+		for _, expect := range []string{"-c:a libopus", "-b:a 48k", "-frame_duration 2.5", "-page_duration 2500", "-f ogg"} {
+			if !strings.Contains(args, expect) {
+				return errors.Errorf("no %v in %v", expect, args)
+			}
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcDataChannel_LatencyAndLoss(t *testing.T) {
+	if err := func() error {
+		_, received0, lost0, _, _ := gStatRTC.DataChannels.Stat()
+
+		// The seq 2 and 3 of a are lost, and seq 1 of b is lost by the gap, which is not counted again when late.
+		r := newDataChannelReceiver(logger.WithContext(context.Background()))
+		now := time.Now()
+		for _, m := range []struct {
+			label string
+			seq   uint64
+		}{
+			{"a", 0}, {"a", 1}, {"a", 4}, {"b", 0}, {"b", 2}, {"b", 1},
+		} {
+			b := marshalDataChannelMessage(m.seq, now.Add(-10*time.Millisecond), 8)
+			if len(b) != dataChannelMessageHeader {
+				return errors.Errorf("invalid size %v", len(b))
+			}
+			if err := r.onMessage(m.label, b); err != nil {
+				return errors.Wrapf(err, "message %v", m)
+			}
+		}
+
+		if err := r.onMessage("a", []byte{0x01}); err == nil {
+			return errors.New("should fail for short message")
+		}
+
+		_, received, lost, avgLatency, _ := gStatRTC.DataChannels.Stat()
+		if received-received0 != 6 || lost-lost0 != 3 {
+			return errors.Errorf("invalid received=%v, lost=%v", received-received0, lost-lost0)
+		}
+		if avgLatency < 10 {
+			return errors.Errorf("invalid latency %v", avgLatency)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcTURN_Configuration(t *testing.T) {
+	if err := func() error {
+		if c := newRTCConfiguration("", "", "", false); len(c.ICEServers) != 0 || c.ICETransportPolicy != webrtc.ICETransportPolicyAll {
+			return errors.Errorf("invalid default %v", c)
+		}
+
+		c := newRTCConfiguration("turn:a:3478,turns:b:5349", "user", "pass", true)
+		if len(c.ICEServers) != 1 || len(c.ICEServers[0].URLs) != 2 || c.ICEServers[0].Username != "user" {
+			return errors.Errorf("invalid servers %v", c.ICEServers)
+		}
+		if c.ICEServers[0].Credential != "pass" || c.ICETransportPolicy != webrtc.ICETransportPolicyRelay {
+			return errors.Errorf("invalid relay %v", c)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcDTLS_RoleAndCertificate(t *testing.T) {
+	if err := func() error {
+		offer := "v=0\r\na=setup:actpass\r\nm=audio\r\na=setup:actpass\r\n"
+		if r, err := dtlsRoleOffer(offer, dtlsRoleActpass); err != nil || r != offer {
+			return errors.Errorf("invalid actpass %v, err %v", r, err)
+		}
+		if r, err := dtlsRoleOffer(offer, dtlsRolePassive); err != nil || strings.Count(r, "a=setup:passive") != 2 {
+			return errors.Errorf("invalid passive %v, err %v", r, err)
+		}
+		if _, err := dtlsRoleOffer(offer, "holdconn"); err == nil {
+			return errors.New("should fail for invalid role")
+		}
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		if err != nil {
+			return errors.Wrapf(err, "generate key")
+		}
+		tpl := x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+		der, err := x509.CreateCertificate(cryptorand.Reader, &tpl, &tpl, &key.PublicKey, key)
+		if err != nil {
+			return errors.Wrapf(err, "create cert")
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return errors.Wrapf(err, "marshal key")
+		}
+
+		dir, err := ioutil.TempDir("", "srs-bench-dtls")
+		if err != nil {
+			return errors.Wrapf(err, "temp dir")
+		}
+		defer os.RemoveAll(dir)
+
+		certFile, keyFile := dir+"/server.crt", dir+"/server.key"
+		if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+			return errors.Wrapf(err, "write cert")
+		}
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			return errors.Wrapf(err, "write key")
+		}
+
+		// The fingerprint should be stable, for the same certificate.
+		var fingerprints []string
+		for i := 0; i < 2; i++ {
+			certificate, err := loadRTCCertificate(certFile, keyFile)
+			if err != nil {
+				return errors.Wrapf(err, "load certificate")
+			}
+			fps, err := certificate.GetFingerprints()
+			if err != nil || len(fps) == 0 {
+				return errors.Errorf("invalid fingerprints %v, err %v", fps, err)
+			}
+			fingerprints = append(fingerprints, fps[0].Value)
+		}
+		if fingerprints[0] != fingerprints[1] {
+			return errors.Errorf("fingerprint changed %v", fingerprints)
+		}
+
+		if _, err := loadRTCCertificate(certFile, certFile); err == nil {
+			return errors.New("should fail for invalid key")
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcStat_PeerConnection(t *testing.T) {
+	if err := func() error {
+		stat := newStatPeerConnection("publish-1")
+		stat.onStream(0x01, 90000)
+		stat.onStream(0x02, 48000)
+
+		for i := 0; i < 10; i++ {
+			stat.onRTP(1000, true)
+		}
+		stat.onRTP(500, false)
+
+		// We send SR, then got RR with the LSR and 100ms delay, about 100ms RTT.
+		stat.onRTCP([]rtcp.Packet{&rtcp.SenderReport{SSRC: 0x01, NTPTime: 0x1122334455667788}}, true)
+		stat.srs[0x33445566] = stat.srs[0x33445566].Add(-200 * time.Millisecond)
+		stat.onRTCP([]rtcp.Packet{
+			&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{
+				{SSRC: 0x01, TotalLost: 3, Jitter: 900, LastSenderReport: 0x33445566, Delay: 65536 / 10},
+				{SSRC: 0x02, TotalLost: 2, Jitter: 960},
+			}},
+			&rtcp.TransportLayerNack{}, &rtcp.PictureLossIndication{},
+		}, false)
+		stat.onRTCP([]rtcp.Packet{&rtcp.FullIntraRequest{}}, true)
+
+		stat.sampleAt = stat.sampleAt.Add(-time.Second)
+		stat.Sample(stat.sampleAt.Add(time.Second))
+
+		s := stat.Stat()
+		if s.PacketsOut != 10 || s.BytesOut != 10000 || s.KbpsOut != 80 || s.PacketsIn != 1 || s.KbpsIn != 4 {
+			return errors.Errorf("invalid rtp %v", s)
+		}
+		if s.NackIn != 1 || s.PliIn != 1 || s.FirOut != 1 || s.NackOut != 0 {
+			return errors.Errorf("invalid feedback %v", s)
+		}
+		if s.Lost != 5 || s.Jitter != 20 {
+			return errors.Errorf("invalid lost or jitter %v", s)
+		}
+		if s.RTT < 99 || s.RTT > 150 {
+			return errors.Errorf("invalid rtt %v", s.RTT)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcNACK_RepairedAndUnrepaired(t *testing.T) {
+	if err := func() error {
+		tracker := newNackTracker()
+
+		// Lost 101, 102 and 103, with sequence number wrap.
+		for _, seq := range []uint16{65534, 65535, 0, 100, 104} {
+			if repaired, unrepaired := tracker.onPacket(seq); repaired || unrepaired != 0 {
+				return errors.Errorf("invalid seq=%v, repaired=%v, unrepaired=%v", seq, repaired, unrepaired)
+			}
+		}
+		if len(tracker.lost) != 102 {
+			return errors.Errorf("invalid lost %v", len(tracker.lost))
+		}
+
+		// Request 101 and 102 for 3 times, but only 2 times allowed.
+		for i, expect := range []int{2, 2, 0} {
+			if seqs := tracker.filter([]uint16{101, 102}, 2); len(seqs) != expect {
+				return errors.Errorf("invalid #%v requests %v", i, seqs)
+			}
+		}
+
+		// Retransmit 101, duplicated 101 is not repaired.
+		if repaired, _ := tracker.onPacket(101); !repaired {
+			return errors.New("should repaired")
+		}
+		if repaired, _ := tracker.onPacket(101); repaired {
+			return errors.New("should not repaired")
+		}
+
+		// All other lost packets are out of window.
+		if _, unrepaired := tracker.onPacket(104 + nackTrackerWindow); unrepaired != 101 {
+			return errors.Errorf("invalid unrepaired %v", unrepaired)
+		}
+
+		// For large gap, all packets are never repaired.
+		lost := len(tracker.lost)
+		if _, unrepaired := tracker.onPacket(104 + nackTrackerWindow*3); unrepaired != lost+nackTrackerWindow*2-1 {
+			return errors.Errorf("invalid unrepaired %v for large gap", unrepaired)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcTWCC_Feedback(t *testing.T) {
+	if err := func() error {
+		recorder := newTWCCRecorder(0x01)
+		recorder.mediaSSRC = 0x02
+
+		// Lost 1, and 2 is 100ms later as large delta, with sequence number wrap.
+		start := time.Now()
+		recorder.Record(65535, start)
+		recorder.Record(0, start.Add(time.Millisecond))
+		recorder.Record(2, start.Add(101*time.Millisecond))
+		recorder.Record(0, start.Add(102*time.Millisecond))
+
+		fb := recorder.BuildFeedback()
+		b, err := fb.Marshal()
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", fb)
+		}
+
+		var parsed rtcp.TransportLayerCC
+		if err := parsed.Unmarshal(b); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", b)
+		}
+		if parsed.BaseSequenceNumber != 65535 || parsed.PacketStatusCount != 4 || len(parsed.RecvDeltas) != 3 {
+			return errors.Errorf("invalid feedback %v", parsed)
+		}
+		if d := parsed.RecvDeltas[1]; d.Type != rtcp.TypeTCCPacketReceivedSmallDelta || d.Delta != 1000 {
+			return errors.Errorf("invalid delta %v", d)
+		}
+		if d := parsed.RecvDeltas[2]; d.Type != rtcp.TypeTCCPacketReceivedLargeDelta || d.Delta != 100000 {
+			return errors.Errorf("invalid delta %v", d)
+		}
+
+		// The late packet 1 is ignored, the next feedback starts from 3.
+		recorder.Record(1, start.Add(110*time.Millisecond))
+		if fb := recorder.BuildFeedback(); fb != nil {
+			return errors.Errorf("should be nil, actual %v", fb)
+		}
+		recorder.Record(4, start.Add(120*time.Millisecond))
+		if fb := recorder.BuildFeedback(); fb.BaseSequenceNumber != 3 || fb.PacketStatusCount != 2 || fb.FbPktCount != 1 {
+			return errors.Errorf("invalid feedback %v", fb)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcFEC_Recover(t *testing.T) {
+	if err := func() error {
+		// Protect 4 packets with different size, and marker and extension.
+		var packets [][]byte
+		for i, size := range []int{100, 30, 200, 1} {
+			pkt := &rtp.Packet{Header: rtp.Header{
+				Version: 2, PayloadType: 102, SequenceNumber: uint16(65534 + i),
+				Timestamp: uint32(3000 * (i / 2)), SSRC: 0x1234, Marker: i%2 == 1,
+			}, Payload: bytes.Repeat([]byte{byte(i + 1)}, size)}
+			if i == 2 {
+				if err := pkt.SetExtension(3, []byte{0x01, 0x02}); err != nil {
+					return errors.Wrapf(err, "extension")
+				}
+			}
+
+			b, err := pkt.Marshal()
+			if err != nil {
+				return errors.Wrapf(err, "marshal")
+			}
+			packets = append(packets, b)
+		}
+		fec := ulpfecEncode(65534, packets)
+
+		// Recover each lost packet by the others.
+		for lost := range packets {
+			received := func(seq uint16) []byte {
+				if i := int(seq - 65534); i < len(packets) && i != lost {
+					return packets[i]
+				}
+				return nil
+			}
+
+			seq, pkt, err := ulpfecDecode(fec, 0x1234, received)
+			if err != nil {
+				return errors.Wrapf(err, "decode #%v", lost)
+			}
+			if seq != uint16(65534+lost) || !bytes.Equal(pkt, packets[lost]) {
+				return errors.Errorf("invalid #%v seq=%v, pkt=%v", lost, seq, len(pkt))
+			}
+		}
+
+		// Not recoverable if lost 2 packets.
+		if _, pkt, err := ulpfecDecode(fec, 0x1234, func(seq uint16) []byte { return nil }); err != nil || pkt != nil {
+			return errors.Errorf("should not recover, err %v", err)
+		}
+
+		// The RED with a redundant block, the primary is the last one.
+		pt, data, err := redDecapsulate([]byte{0x80 | 102, 0x00, 0x10, 0x02, 116, 0xaa, 0xbb, 0xcc})
+		if err != nil {
+			return errors.Wrapf(err, "red")
+		}
+		if pt != 116 || !bytes.Equal(data, []byte{0xcc}) {
+			return errors.Errorf("invalid pt=%v, data=%v", pt, data)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcRED_Audio(t *testing.T) {
+	if err := func() error {
+		// Two redundant blocks, the oversized one is ignored.
+		payload := redEncode([]*redBlock{
+			{pt: 111, tsOffset: 1920, data: bytes.Repeat([]byte{0x01}, 1024)},
+			{pt: 111, tsOffset: 1920, data: []byte{0x02, 0x02}},
+			{pt: 111, tsOffset: 960, data: []byte{0x03}},
+			{pt: 111, data: []byte{0x04, 0x04, 0x04}},
+		})
+
+		blocks, err := redDecode(payload)
+		if err != nil {
+			return errors.Wrapf(err, "decode")
+		}
+		if len(blocks) != 3 {
+			return errors.Errorf("invalid blocks %v", len(blocks))
+		}
+		for i, expect := range []*redBlock{
+			{pt: 111, tsOffset: 1920, data: []byte{0x02, 0x02}},
+			{pt: 111, tsOffset: 960, data: []byte{0x03}},
+			{pt: 111, data: []byte{0x04, 0x04, 0x04}},
+		} {
+			if b := blocks[i]; b.pt != expect.pt || b.tsOffset != expect.tsOffset || !bytes.Equal(b.data, expect.data) {
+				return errors.Errorf("invalid #%v pt=%v, ts=%v, data=%v", i, b.pt, b.tsOffset, b.data)
+			}
+		}
+
+		// The primary block only.
+		if pt, data, err := redDecapsulate([]byte{111, 0x05}); err != nil || pt != 111 || !bytes.Equal(data, []byte{0x05}) {
+			return errors.Errorf("invalid pt=%v, data=%v, err %v", pt, data, err)
+		}
+
+		// The RED negotiated by SDP.
+		if !sdpHasAudioRED("a=rtpmap:63 red/48000/2\r\n") || sdpHasAudioRED("a=rtpmap:115 red/90000\r\n") {
+			return errors.New("invalid audio RED in SDP")
+		}
+		if !sdpHasFEC("a=rtpmap:115 red/90000\r\na=rtpmap:116 ulpfec/90000\r\n") {
+			return errors.New("invalid FEC in SDP")
+		}
+
+		// The corrupt RED.
+		if _, err := redDecode([]byte{0x80 | 111, 0x00, 0x10}); err == nil {
+			return errors.New("should fail")
+		}
+		if _, err := redDecode([]byte{0x80 | 111, 0x00, 0x10, 0x02, 111, 0x01}); err == nil {
+			return errors.New("should fail")
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcRecord_H264(t *testing.T) {
+	if err := func() error {
+		sps, _ := hex.DecodeString("67640020acd940c029b011000003000100000300320f183196")
+		pps, _ := hex.DecodeString("68ebecb22c")
+		if width, height, err := h264SPSResolution(sps); err != nil || width != 768 || height != 320 {
+			return errors.Errorf("invalid resolution %vx%v, err %v", width, height, err)
+		}
+		if _, _, err := h264SPSResolution(sps[:3]); err == nil {
+			return errors.New("should fail")
+		}
+
+		// The STAP-A of SPS and PPS, and the IDR in FU-A.
+		var d h264Depacketizer
+		stapA := append([]byte{0x78, 0x00, byte(len(sps))}, sps...)
+		stapA = append(append(stapA, 0x00, byte(len(pps))), pps...)
+		if nals, err := d.Unmarshal(stapA); err != nil || len(nals) != 2 || !bytes.Equal(nals[1], pps) {
+			return errors.Errorf("invalid STAP-A %v, err %v", nals, err)
+		}
+		for i, payload := range [][]byte{{0x7c, 0x85, 0x01}, {0x7c, 0x05, 0x02}, {0x7c, 0x45, 0x03}} {
+			nals, err := d.Unmarshal(payload)
+			if err != nil || (i < 2 && len(nals) != 0) {
+				return errors.Errorf("invalid #%v FU-A %v, err %v", i, nals, err)
+			}
+			if i == 2 && (len(nals) != 1 || !bytes.Equal(nals[0], []byte{0x65, 0x01, 0x02, 0x03})) {
+				return errors.Errorf("invalid FU-A %v", nals)
+			}
+		}
+
+		// Record to both containers, the frame before keyframe and the lost frame is ignored.
+		for _, ext := range []string{".mkv", ".mp4"} {
+			filename := path.Join(os.TempDir(), fmt.Sprintf("srs-bench-record-%v%v", os.Getpid(), ext))
+			defer os.Remove(filename)
+
+			r, err := newRTCRecorder(filename)
+			if err != nil {
+				return errors.Wrapf(err, "create")
+			}
+
+			audio := r.Track(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}})
+			video := r.Track(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}})
+			if vp8 := r.Track(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}}); vp8 != nil {
+				return errors.New("should not record VP8")
+			}
+
+			for i, pkt := range []*rtp.Packet{
+				{Header: rtp.Header{SequenceNumber: 0, Timestamp: 0, Marker: true}, Payload: []byte{0x41, 0x01}},
+				{Header: rtp.Header{SequenceNumber: 1, Timestamp: 3600}, Payload: stapA},
+				{Header: rtp.Header{SequenceNumber: 2, Timestamp: 3600, Marker: true}, Payload: []byte{0x65, 0x01}},
+				{Header: rtp.Header{SequenceNumber: 3, Timestamp: 7200, Marker: true}, Payload: []byte{0x41, 0x02}},
+				{Header: rtp.Header{SequenceNumber: 5, Timestamp: 10800, Marker: true}, Payload: []byte{0x41, 0x03}},
+				{Header: rtp.Header{SequenceNumber: 6, Timestamp: 14400, Marker: true}, Payload: []byte{0x41, 0x04}},
+			} {
+				if err := video.WriteRTP(pkt); err != nil {
+					return errors.Wrapf(err, "write video #%v", i)
+				}
+				if err := audio.WriteRTP(&rtp.Packet{Header: rtp.Header{
+					SequenceNumber: uint16(i), Timestamp: uint32(960 * i),
+				}, Payload: []byte{0xfc, byte(i)}}); err != nil {
+					return errors.Wrapf(err, "write audio #%v", i)
+				}
+			}
+			if err := r.Close(); err != nil {
+				return errors.Wrapf(err, "close")
+			}
+
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return errors.Wrapf(err, "read")
+			}
+			if ext == ".mkv" && (!bytes.HasPrefix(b, []byte{0x1a, 0x45, 0xdf, 0xa3}) || !bytes.Contains(b, []byte("V_MPEG4/ISO/AVC")) || !bytes.Contains(b, []byte("A_OPUS"))) {
+				return errors.Errorf("invalid mkv %v bytes", len(b))
+			}
+			if ext == ".mp4" && (!bytes.Equal(b[4:8], []byte("ftyp")) || !bytes.Contains(b, []byte("avcC")) || !bytes.Contains(b, []byte("dOps")) || !bytes.Contains(b, []byte("moof"))) {
+				return errors.Errorf("invalid mp4 %v bytes", len(b))
+			}
+
+			// The first frame is dropped because no keyframe, and the frames after lost.
+			if bytes.Contains(b, []byte{0x00, 0x00, 0x00, 0x02, 0x41, 0x01}) || bytes.Contains(b, []byte{0x00, 0x00, 0x00, 0x02, 0x41, 0x03}) {
+				return errors.Errorf("should drop frame of %v", ext)
+			}
+			if !bytes.Contains(b, append([]byte{0x00, 0x00, 0x00, byte(len(sps))}, sps...)) || !bytes.Contains(b, []byte{0x00, 0x00, 0x00, 0x02, 0x41, 0x02}) {
+				return errors.Errorf("should record frame of %v", ext)
+			}
+		}
+
+		if v := recordFilename("a.mp4", 1, 2); v != "a_1.mp4" {
+			return errors.Errorf("invalid %v", v)
+		}
+		if v := recordFilename("a_%d.mkv", 1, 2); v != "a_1.mkv" {
+			return errors.Errorf("invalid %v", v)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcLatency_SEI(t *testing.T) {
+	if err := func() error {
+		// The timestamp with zero bytes, which should be escaped.
+		ts := time.Unix(0, 0x000000000100*int64(time.Microsecond))
+		sei := h264LatencySEI(ts)
+		if bytes.Contains(sei, []byte{0, 0, 0}) || bytes.Contains(sei, []byte{0, 0, 1}) {
+			return errors.Errorf("not escaped %v", hex.EncodeToString(sei))
+		}
+		if v, ok := parseH264LatencySEI(sei); !ok || !v.Equal(ts) {
+			return errors.Errorf("invalid ts=%v, ok=%v", v, ok)
+		}
+
+		// Ignore other SEI and NALUs.
+		if _, ok := parseH264LatencySEI([]byte{0x06, 0x05, 0x01, 0x00, 0x80}); ok {
+			return errors.New("should ignore other SEI")
+		}
+		if _, ok := parseH264LatencySEI([]byte{0x65, 0x88}); ok {
+			return errors.New("should ignore IDR")
+		}
+
+		// The SEI in STAP-A, measured by interceptor.
+		var stat statLatency
+		i := newLatencyInterceptor(&stat)
+		nal := h264LatencySEI(time.Now().Add(-100 * time.Millisecond))
+		payload := append([]byte{h264NALUTypeSTAPA, 0, 2, 0x67, 0x42}, byte(len(nal)>>8), byte(len(nal)))
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 102, SSRC: 0x1234}, Payload: append(payload, nal...)}
+		b, err := pkt.Marshal()
+		if err != nil {
+			return errors.Wrapf(err, "marshal")
+		}
+
+		info := &interceptor.StreamInfo{MimeType: webrtc.MimeTypeH264}
+		reader := i.BindRemoteStream(info, interceptor.RTPReaderFunc(func(p []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+			return copy(p, b), a, nil
+		}))
+		if _, _, err := reader.Read(make([]byte, 1500), nil); err != nil {
+			return errors.Wrapf(err, "read")
+		}
+		if count, avg, _, _, _, _ := stat.Stat(); count != 1 || avg < 100 || avg > 1000 {
+			return errors.Errorf("invalid count=%v, avg=%v", count, avg)
+		}
+
+		// The percentiles of histogram.
+		stat = statLatency{}
+		for i := 1; i <= 100; i++ {
+			stat.onLatency(time.Duration(i) * time.Millisecond)
+		}
+		stat.onLatency(-time.Second)
+		stat.onLatency(time.Minute)
+		if count, _, p50, p90, p99, max := stat.Stat(); count != 102 || p50 != 50 || p90 != 91 || p99 != 100 || max != 60000 {
+			return errors.Errorf("invalid count=%v, p50=%v, p90=%v, p99=%v, max=%v", count, p50, p90, p99, max)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcSDP_Rewrite(t *testing.T) {
+	if err := func() error {
+		offer := strings.Join([]string{
+			"v=0", "m=video 9 UDP/TLS/RTP/SAVPF 96 102", "a=mid:0",
+			"a=extmap:3 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01",
+			"a=rtpmap:96 VP8/90000", "a=rtpmap:102 H264/90000", "",
+		}, "\r\n")
+
+		// Strip the TWCC extension, reorder codecs, and inject a malformed line.
+		r, err := newSDPRewriter([]string{
+			`s/^a=extmap:.*transport-wide-cc.*\r\n//`,
+			`s|^(m=video \S+ \S+) (\d+) (\d+)|$1 $3 $2|`,
+			`s/^a=mid:0\r\n/${0}a=bad-line\r\n/`,
+		}, nil)
+		if err != nil {
+			return errors.Wrapf(err, "new")
+		}
+
+		expect := strings.Join([]string{
+			"v=0", "m=video 9 UDP/TLS/RTP/SAVPF 102 96", "a=mid:0", "a=bad-line",
+			"a=rtpmap:96 VP8/90000", "a=rtpmap:102 H264/90000", "",
+		}, "\r\n")
+		if v := r.Offer(offer); v != expect {
+			return errors.Errorf("invalid offer %v", escapeSDP(v))
+		}
+		if v := r.Answer(offer); v != offer {
+			return errors.Errorf("invalid answer %v", escapeSDP(v))
+		}
+
+		// The nil rewriter, and the invalid rules.
+		var nr *sdpRewriter
+		if nr.Offer(offer) != offer || nr.Answer(offer) != offer {
+			return errors.New("nil rewriter should not change SDP")
+		}
+		for _, rule := range []string{"", "a=b", "s/a/b", "s/a/b/c", "s//b/", "s/(/b/"} {
+			if _, err := newSDPRewriter(nil, []string{rule}); err == nil {
+				return errors.Errorf("rule %v should fail", rule)
+			}
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcBitrate_Controller(t *testing.T) {
+	if err := func() error {
+		// Ramp from 100kbps to 800kbps in 10s, then hold.
+		ramp := newBitrateController(100, 800, 10*time.Second, 0)
+		for elapsed, expect := range map[time.Duration]int{0: 100, 5 * time.Second: 450, 10 * time.Second: 800, time.Minute: 800} {
+			if v := ramp.Target(elapsed); v != expect {
+				return errors.Errorf("ramp %v expect %v actual %v", elapsed, expect, v)
+			}
+		}
+
+		// Oscillate between 100kbps and 800kbps, in period of 10s.
+		wave := newBitrateController(100, 800, 0, 10*time.Second)
+		for elapsed, expect := range map[time.Duration]int{0: 100, 5 * time.Second: 800, 7500 * time.Millisecond: 450, 10 * time.Second: 100} {
+			if v := wave.Target(elapsed); v != expect {
+				return errors.Errorf("wave %v expect %v actual %v", elapsed, expect, v)
+			}
+		}
+
+		// The cap of 80kbps, 10KB/s, the bucket is full at start.
+		c := newBitrateController(0, 80, 0, 0)
+		if c.Target(0) != 80 {
+			return errors.Errorf("invalid target %v", c.Target(0))
+		}
+		if !c.Allow(8000, 40*time.Millisecond, true, true) || !c.Allow(3000, 40*time.Millisecond, false, true) {
+			return errors.New("should allow in burst")
+		}
+		// Drop the reference frame, and wait for keyframe even the bucket is refilled.
+		if c.Allow(100, 40*time.Millisecond, false, true) {
+			return errors.New("should drop for bucket is empty")
+		}
+		for i := 0; i < 50; i++ {
+			if c.Allow(100, 40*time.Millisecond, false, false) {
+				return errors.New("should drop until keyframe")
+			}
+		}
+		// The keyframe is always sent, even exceed the bucket.
+		if !c.Allow(20000, 40*time.Millisecond, true, true) {
+			return errors.New("should allow keyframe")
+		}
+		if c.sent != 3 || c.dropped != 51 {
+			return errors.Errorf("invalid sent=%v, dropped=%v", c.sent, c.dropped)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcTracks_MultipleVideo(t *testing.T) {
+	if err := func() error {
+		m := &webrtc.MediaEngine{}
+		if err := m.RegisterDefaultCodecs(); err != nil {
+			return errors.Wrapf(err, "register codecs")
+		}
+
+		// Like -tracks 3, the other tracks share the marker interceptor of the first one.
+		var tracks []*videoIngester
+		registry := &interceptor.Registry{}
+		for i := 0; i < 3; i++ {
+			track := newVideoIngester("avatar.h264")
+			if i == 0 {
+				registry.Add(track.markerInterceptor)
+			} else {
+				track.trackID = fmt.Sprintf("video%v", i)
+				track.markerInterceptor = tracks[0].markerInterceptor
+			}
+			tracks = append(tracks, track)
+		}
+
+		api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry))
+		pc, err := api.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			return errors.Wrapf(err, "create pc")
+		}
+		defer pc.Close()
+
+		for _, track := range tracks {
+			if err := track.AddTrack(pc, 25); err != nil {
+				return errors.Wrapf(err, "add track %v", track.trackID)
+			}
+		}
+
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			return errors.Wrapf(err, "create offer")
+		}
+		if n := strings.Count(offer.SDP, "m=video"); n != 3 {
+			return errors.Errorf("invalid video m-lines %v", n)
+		}
+		trackIDs := make(map[string]bool)
+		for _, line := range strings.Split(offer.SDP, "\r\n") {
+			if strings.HasPrefix(line, "a=msid:") {
+				trackIDs[line] = true
+			}
+		}
+		if len(trackIDs) != 3 || !trackIDs["a=msid:pion video"] || !trackIDs["a=msid:pion video2"] {
+			return errors.Errorf("invalid track ids %v", trackIDs)
+		}
+
+		// The RTP is written by the track of SSRC, and the audio is written to next directly.
+		tracks[0].markerInterceptor.rtpWriter = videoTracksRTPWriter(tracks)
+		var markers []bool
+		tracks[0].markerInterceptor.nextRTPWriter = interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+			markers = append(markers, header.Marker)
+			return len(payload), nil
+		})
+		for _, ssrc := range []uint32{tracks[2].ssrc, 0} {
+			if _, err := tracks[0].markerInterceptor.Write(&rtp.Header{SSRC: ssrc, Marker: true}, []byte{h264NALUTypeSTAPA}, nil); err != nil {
+				return errors.Wrapf(err, "write ssrc %v", ssrc)
+			}
+		}
+		if fmt.Sprint(markers) != "[false true]" {
+			return errors.Errorf("invalid markers %v", markers)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcWhip_Publish(t *testing.T) {
+	if err := func() error {
+		var requests []string
+		var lock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			requests = append(requests, fmt.Sprintf("%v %v %v", r.Method, r.URL.Path, r.Header.Get("Authorization")))
+			lock.Unlock()
+
+			switch {
+			case r.Method == "POST" && r.URL.Path == "/rtc/v1/whip/":
+				if ct := r.Header.Get("Content-Type"); ct != "application/sdp" {
+					http.Error(w, ct, http.StatusBadRequest)
+					return
+				}
+				b, _ := ioutil.ReadAll(r.Body)
+				// The Location is relative to the endpoint.
+				w.Header().Set("Location", "resource/abc")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("answer of " + string(b)))
+			case r.Method == "DELETE" && r.URL.Path == "/rtc/v1/whip/resource/abc":
+				w.WriteHeader(http.StatusOK)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+
+		ctx := logger.WithContext(context.Background())
+		r := server.URL + "/rtc/v1/whip/?app=live&stream=livestream"
+		answer, teardown, err := apiSignalRequest(ctx, "/rtc/v1/publish", r, "token", "offer")
+		if err != nil {
+			return errors.Wrapf(err, "whip %v", r)
+		}
+		if answer != "answer of offer" {
+			return errors.Errorf("invalid answer %v", answer)
+		}
+
+		teardown()
+
+		lock.Lock()
+		defer lock.Unlock()
+		expects := []string{
+			"POST /rtc/v1/whip/ Bearer token",
+			"DELETE /rtc/v1/whip/resource/abc Bearer token",
+		}
+		if strings.Join(requests, ",") != strings.Join(expects, ",") {
+			return errors.Errorf("invalid requests %v", requests)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcWhep_Play(t *testing.T) {
+	if err := func() error {
+		var requests []string
+		var lock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			requests = append(requests, fmt.Sprintf("%v %v %v", r.Method, r.URL.Path, r.Header.Get("Authorization")))
+			lock.Unlock()
+
+			switch {
+			case r.Method == "POST" && r.URL.Path == "/rtc/v1/whep/":
+				// Like SRS before 5.0, response 200 rather than 201.
+				if r.URL.Query().Get("stream") == "livestream" {
+					w.Header().Set("Location", "/rtc/v1/whep/resource/abc")
+				}
+				w.Write([]byte("answer"))
+			case r.Method == "DELETE" && r.URL.Path == "/rtc/v1/whep/resource/abc":
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+
+		ctx := logger.WithContext(context.Background())
+		for _, c := range []struct{ stream, token string }{{"livestream", "token"}, {"nolocation", ""}} {
+			r := server.URL + "/rtc/v1/whep/?app=live&stream=" + c.stream
+			answer, teardown, err := apiSignalRequest(ctx, "/rtc/v1/play", r, c.token, "offer")
+			if err != nil {
+				return errors.Wrapf(err, "whep %v", r)
+			}
+			if answer != "answer" {
+				return errors.Errorf("invalid answer %v", answer)
+			}
+			teardown()
+		}
+
+		// There is no Bearer without token, and no DELETE without Location.
+		lock.Lock()
+		defer lock.Unlock()
+		expects := []string{
+			"POST /rtc/v1/whep/ Bearer token",
+			"DELETE /rtc/v1/whep/resource/abc Bearer token",
+			"POST /rtc/v1/whep/ ",
+		}
+		if strings.Join(requests, ",") != strings.Join(expects, ",") {
+			return errors.Errorf("invalid requests %v", requests)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtcSimulcast_Layers(t *testing.T) {
+	if err := func() error {
+		m := &webrtc.MediaEngine{}
+		if err := m.RegisterDefaultCodecs(); err != nil {
+			return errors.Wrapf(err, "register codecs")
+		}
+		for _, extension := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
+				return errors.Wrapf(err, "register %v", extension)
+			}
+		}
+
+		// Like -simulcast 3 with sources of two layers, the last layer reuses the last source.
+		track := newVideoIngester("avatar.h264")
+		track.simulcast, track.simulcastSources = 3, []string{"avatar.h264", "avatar-small.h264"}
+		registry := &interceptor.Registry{}
+		registry.Add(track.markerInterceptor)
+
+		api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry))
+		pc, err := api.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			return errors.Wrapf(err, "create pc")
+		}
+		defer pc.Close()
+
+		if err := track.AddTrack(pc, 25); err != nil {
+			return errors.Wrapf(err, "add track")
+		}
+		if len(track.layers) != 3 || track.ridExtensionID == 0 {
+			return errors.Errorf("invalid layers %v, rid extension %v", track.layers, track.ridExtensionID)
+		}
+		for i, rid := range []string{"a", "b", "c"} {
+			if layer := track.layers[i]; layer.rid != rid || layer.ssrc == 0 {
+				return errors.Errorf("invalid layer %v", layer)
+			}
+		}
+		if track.layers[0].ssrc != track.ssrc || track.layers[2].source != "avatar-small.h264" {
+			return errors.Errorf("invalid layers %v", track.layers)
+		}
+
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			return errors.Wrapf(err, "create offer")
+		}
+		offerSDP, err := simulcastOffer(offer.SDP, track.layers)
+		if err != nil {
+			return errors.Wrapf(err, "simulcast offer")
+		}
+		for _, line := range []string{
+			"a=rid:a send", "a=rid:b send", "a=rid:c send", "a=simulcast:send a;b;c",
+			fmt.Sprintf("a=ssrc:%v cname:", track.layers[1].ssrc), fmt.Sprintf("a=ssrc:%v cname:", track.layers[2].ssrc),
+		} {
+			if !strings.Contains(offerSDP, "\r\n"+line) {
+				return errors.Errorf("no %v in %v", line, offerSDP)
+			}
+		}
+
+		// Each layer is identified by the RID header extension, while other SSRC is not.
+		var rids []string
+		track.markerInterceptor.nextRTPWriter = interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+			rids = append(rids, string(header.GetExtension(track.ridExtensionID)))
+			return len(payload), nil
+		})
+		for _, ssrc := range []uint32{track.layers[0].ssrc, track.layers[1].ssrc, track.layers[2].ssrc, 0} {
+			if _, err := track.markerInterceptor.Write(&rtp.Header{SSRC: ssrc}, []byte{0x65}, nil); err != nil {
+				return errors.Wrapf(err, "write ssrc %v", ssrc)
+			}
+		}
+		if fmt.Sprint(rids) != "[a b c ]" {
+			return errors.Errorf("invalid rids %v", rids)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
@@ -0,0 +1,1437 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/aac"
+	"github.com/ossrs/go-oryx-lib/amf0"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/flv"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/ossrs/go-oryx-lib/rtmp"
+	"github.com/ossrs/srs-bench/gb28181"
+)
+
+// Whether the url is RTMP or RTMPS, to publish by RTMP rather than RTC.
+func isRTMPURL(r string) bool {
+	return strings.HasPrefix(r, "rtmp://") || strings.HasPrefix(r, "rtmps://")
+}
+
+// Whether the url is HTTP-FLV or HTTPS-FLV, like "https://localhost/live/livestream.flv", to publish
+// or play by FLV rather than WHIP or WHEP. The ws:// or wss:// is always WebSocket-FLV.
+func isFLVURL(r string) bool {
+	if strings.HasPrefix(r, "ws://") || strings.HasPrefix(r, "wss://") {
+		return true
+	}
+	if !strings.HasPrefix(r, "http://") && !strings.HasPrefix(r, "https://") {
+		return false
+	}
+
+	u, err := url.Parse(r)
+	return err == nil && strings.HasSuffix(u.Path, ".flv")
+}
+
+// Whether the source is a container of video and audio, MP4 or MPEG-TS.
+func isContainerSource(source string) bool {
+	switch strings.ToLower(path.Ext(source)) {
+	case ".mp4", ".m4v", ".mov", ".ts":
+		return true
+	}
+	return false
+}
+
+// The FLV tag to send in RTMP message, the timestamp in ms.
+type rtmpTag struct {
+	tagType   flv.TagType
+	timestamp uint32
+	data      []byte
+}
+
+// The codec of RTMP frame, the AV1 is only for RTMP, which is in enhanced RTMP.
+type rtmpFrameCodec int
+
+const (
+	rtmpFrameCodecH264 rtmpFrameCodec = iota
+	rtmpFrameCodecH265
+	rtmpFrameCodecAV1
+	rtmpFrameCodecAAC
+)
+
+func (v rtmpFrameCodec) String() string {
+	switch v {
+	case rtmpFrameCodecH264:
+		return "H.264"
+	case rtmpFrameCodecH265:
+		return "H.265"
+	case rtmpFrameCodecAV1:
+		return "AV1"
+	case rtmpFrameCodecAAC:
+		return "AAC"
+	default:
+		return "Unknown"
+	}
+}
+
+// The media frame to mux to FLV tags, the timestamp is in ms.
+type rtmpFrame struct {
+	codec    rtmpFrameCodec
+	dts, pts uint64
+	// For video, it's the NALUs without start code, or the OBUs of AV1 temporal unit in low overhead
+	// format. For audio, it's ADTS frames.
+	payloads [][]byte
+}
+
+// The source of RTMP frames, io.EOF when no more frames.
+type rtmpFrameSource interface {
+	Next() (*rtmpFrame, error)
+}
+
+// Read the H.264, H.265 and AAC frames from the file source of GB28181, which also reads MP4/TS and
+// loops the sources in sync.
+type rtmpFileFrameSource struct {
+	source gb28181.FrameSource
+}
+
+func (v *rtmpFileFrameSource) Next() (*rtmpFrame, error) {
+	frame, err := v.source.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	var codec rtmpFrameCodec
+	switch frame.Codec {
+	case gb28181.FrameCodecH264:
+		codec = rtmpFrameCodecH264
+	case gb28181.FrameCodecH265:
+		codec = rtmpFrameCodecH265
+	case gb28181.FrameCodecAAC:
+		codec = rtmpFrameCodecAAC
+	default:
+		return nil, errors.Errorf("RTMP not support %v", frame.Codec)
+	}
+	return &rtmpFrame{codec: codec, dts: frame.DTS, pts: frame.PTS, payloads: frame.Payloads}, nil
+}
+
+// The enhanced RTMP, the video tag with fourCC for HEVC and AV1, the first byte is the IsExHeader,
+// FrameType and PacketType. @see https://github.com/veovera/enhanced-rtmp
+const (
+	rtmpExVideoHeader = 0x80
+	// The packet type of enhanced video tag.
+	rtmpPacketTypeSequenceStart = 0
+	rtmpPacketTypeCodedFrames   = 1
+	rtmpPacketTypeSequenceEnd   = 2
+	rtmpPacketTypeCodedFramesX  = 3
+	rtmpPacketTypeMetadata      = 4
+)
+
+// The fourCC of video codecs in enhanced RTMP.
+const (
+	rtmpFourCCAVC  = "avc1"
+	rtmpFourCCHEVC = "hvc1"
+	rtmpFourCCAV1  = "av01"
+)
+
+// Build the enhanced video tag, the CodedFrames of AVC and HEVC has the CTS, or use CodedFramesX
+// without CTS if it's zero.
+func rtmpExVideoTag(fourCC string, packetType uint8, keyframe bool, cts int32, data []byte) []byte {
+	frameType := flv.VideoFrameTypeInterframe
+	if keyframe {
+		frameType = flv.VideoFrameTypeKeyframe
+	}
+
+	hasCTS := packetType == rtmpPacketTypeCodedFrames && fourCC != rtmpFourCCAV1
+	if hasCTS && cts == 0 {
+		packetType, hasCTS = rtmpPacketTypeCodedFramesX, false
+	}
+
+	tag := append([]byte{rtmpExVideoHeader | byte(frameType)<<4 | packetType}, fourCC...)
+	if hasCTS {
+		tag = append(tag, byte(cts>>16), byte(cts>>8), byte(cts))
+	}
+	return append(tag, data...)
+}
+
+// The muxer from H.264, H.265, AV1 and AAC frames to FLV tags, which sends the sequence header
+// before the first frame, and when it's changed. The H.265 and AV1 are in enhanced RTMP.
+type rtmpFLVMuxer struct {
+	// The last video sequence header, that is the avcC, hvcC or av1C.
+	videoConfig []byte
+	// The ASC of the last sequence header, and the decoder of ADTS.
+	asc  []byte
+	adts aac.ADTS
+	// The packagers of FLV tag body.
+	videoPackager flv.VideoPackager
+	audioPackager flv.AudioPackager
+}
+
+func newRTMPFLVMuxer() (*rtmpFLVMuxer, error) {
+	v := &rtmpFLVMuxer{}
+
+	var err error
+	if v.adts, err = aac.NewADTS(); err != nil {
+		return nil, errors.Wrapf(err, "new adts")
+	}
+	if v.videoPackager, err = flv.NewVideoPackager(); err != nil {
+		return nil, errors.Wrapf(err, "new video packager")
+	}
+	if v.audioPackager, err = flv.NewAudioPackager(); err != nil {
+		return nil, errors.Wrapf(err, "new audio packager")
+	}
+	return v, nil
+}
+
+// Mux the frame in ms to FLV tags, the video is NALUs without start code, and the audio is ADTS.
+func (v *rtmpFLVMuxer) Mux(frame *rtmpFrame) ([]*rtmpTag, error) {
+	switch frame.codec {
+	case rtmpFrameCodecH264:
+		return v.muxH264(frame)
+	case rtmpFrameCodecH265:
+		return v.muxH265(frame)
+	case rtmpFrameCodecAV1:
+		return v.muxAV1(frame)
+	case rtmpFrameCodecAAC:
+		return v.muxAAC(frame)
+	}
+	return nil, errors.Errorf("RTMP not support %v", frame.codec)
+}
+
+func (v *rtmpFLVMuxer) muxH264(frame *rtmpFrame) ([]*rtmpTag, error) {
+	var sps, pps []byte
+	var keyframe bool
+	var avcc bytes.Buffer
+	for _, nalu := range frame.payloads {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & 0x1f {
+		case h264NALUTypeSPS:
+			sps = nalu
+			continue
+		case h264NALUTypePPS:
+			pps = nalu
+			continue
+		case h264NALUTypeAUD:
+			continue
+		case h264NALUTypeIDR:
+			keyframe = true
+		}
+
+		avcc.Write([]byte{byte(len(nalu) >> 24), byte(len(nalu) >> 16), byte(len(nalu) >> 8), byte(len(nalu))})
+		avcc.Write(nalu)
+	}
+
+	var tags []*rtmpTag
+	if sps != nil && pps != nil {
+		if avcC := h264AVCC(sps, pps); !bytes.Equal(avcC, v.videoConfig) {
+			v.videoConfig = avcC
+
+			tag, err := v.videoPackager.Encode(&flv.VideoFrame{
+				CodecID: flv.VideoCodecAVC, FrameType: flv.VideoFrameTypeKeyframe,
+				Trait: flv.VideoFrameTraitSequenceHeader, Raw: avcC,
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "encode sequence header")
+			}
+			tags = append(tags, &rtmpTag{tagType: flv.TagTypeVideo, timestamp: uint32(frame.dts), data: tag})
+		}
+	}
+
+	// Drop the frames before the sequence header.
+	if v.videoConfig == nil || avcc.Len() == 0 {
+		return tags, nil
+	}
+
+	frameType := flv.VideoFrameTypeInterframe
+	if keyframe {
+		frameType = flv.VideoFrameTypeKeyframe
+	}
+	tag, err := v.videoPackager.Encode(&flv.VideoFrame{
+		CodecID: flv.VideoCodecAVC, FrameType: frameType, Trait: flv.VideoFrameTraitNALU,
+		CTS: int32(frame.pts - frame.dts), Raw: avcc.Bytes(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "encode frame")
+	}
+	return append(tags, &rtmpTag{tagType: flv.TagTypeVideo, timestamp: uint32(frame.dts), data: tag}), nil
+}
+
+func (v *rtmpFLVMuxer) muxH265(frame *rtmpFrame) ([]*rtmpTag, error) {
+	var vps, sps, pps []byte
+	var keyframe bool
+	var hvcc bytes.Buffer
+	for _, nalu := range frame.payloads {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		nal := &h265NAL{Data: nalu}
+		switch nal.Type() {
+		case h265NALUTypeVPS:
+			vps = nalu
+			continue
+		case h265NALUTypeSPS:
+			sps = nalu
+			continue
+		case h265NALUTypePPS:
+			pps = nalu
+			continue
+		case h265NALUTypeAUD:
+			continue
+		}
+		keyframe = keyframe || nal.IsIRAP()
+
+		hvcc.Write([]byte{byte(len(nalu) >> 24), byte(len(nalu) >> 16), byte(len(nalu) >> 8), byte(len(nalu))})
+		hvcc.Write(nalu)
+	}
+
+	var tags []*rtmpTag
+	if vps != nil && sps != nil && pps != nil {
+		hvcC, err := h265HVCC(vps, sps, pps)
+		if err != nil {
+			return nil, errors.Wrapf(err, "hvcC")
+		}
+
+		if !bytes.Equal(hvcC, v.videoConfig) {
+			v.videoConfig = hvcC
+
+			tag := rtmpExVideoTag(rtmpFourCCHEVC, rtmpPacketTypeSequenceStart, true, 0, hvcC)
+			tags = append(tags, &rtmpTag{tagType: flv.TagTypeVideo, timestamp: uint32(frame.dts), data: tag})
+		}
+	}
+
+	// Drop the frames before the sequence header.
+	if v.videoConfig == nil || hvcc.Len() == 0 {
+		return tags, nil
+	}
+
+	tag := rtmpExVideoTag(rtmpFourCCHEVC, rtmpPacketTypeCodedFrames, keyframe, int32(frame.pts-frame.dts), hvcc.Bytes())
+	return append(tags, &rtmpTag{tagType: flv.TagTypeVideo, timestamp: uint32(frame.dts), data: tag}), nil
+}
+
+// Mux the AV1 temporal unit, the keyframe is the one with sequence header.
+func (v *rtmpFLVMuxer) muxAV1(frame *rtmpFrame) ([]*rtmpTag, error) {
+	var keyframe bool
+	var tags []*rtmpTag
+	for _, payload := range frame.payloads {
+		obu, _, err := parseAV1OBU(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse obu")
+		}
+		if obu.Type() != av1OBUTypeSequenceHeader {
+			continue
+		}
+		keyframe = true
+
+		av1C, err := av1CodecConfigurationRecord(obu)
+		if err != nil {
+			return nil, errors.Wrapf(err, "av1C")
+		}
+
+		if !bytes.Equal(av1C, v.videoConfig) {
+			v.videoConfig = av1C
+
+			tag := rtmpExVideoTag(rtmpFourCCAV1, rtmpPacketTypeSequenceStart, true, 0, av1C)
+			tags = append(tags, &rtmpTag{tagType: flv.TagTypeVideo, timestamp: uint32(frame.dts), data: tag})
+		}
+	}
+
+	// Drop the frames before the sequence header.
+	if v.videoConfig == nil || len(frame.payloads) == 0 {
+		return tags, nil
+	}
+
+	tag := rtmpExVideoTag(rtmpFourCCAV1, rtmpPacketTypeCodedFrames, keyframe, 0, bytes.Join(frame.payloads, nil))
+	return append(tags, &rtmpTag{tagType: flv.TagTypeVideo, timestamp: uint32(frame.dts), data: tag}), nil
+}
+
+func (v *rtmpFLVMuxer) muxAAC(frame *rtmpFrame) ([]*rtmpTag, error) {
+	var tags []*rtmpTag
+	for _, payload := range frame.payloads {
+		// The payload might contain multiple ADTS frames, each is 1024 samples.
+		for i := 0; len(payload) > 0; i++ {
+			raw, left, err := v.adts.Decode(payload)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decode adts")
+			}
+			payload = left
+
+			asc := v.adts.ASC()
+			audio := &flv.AudioFrame{SoundFormat: flv.AudioCodecAAC, SoundSize: flv.AudioSampleBits16bits}
+			audio.SoundRate.From(asc.SampleRate)
+			audio.SoundType.From(asc.Channels)
+			timestamp := uint32(frame.dts) + uint32(i*1024*1000/asc.SampleRate.ToHz())
+
+			if b, err := asc.MarshalBinary(); err != nil {
+				return nil, errors.Wrapf(err, "marshal asc")
+			} else if !bytes.Equal(b, v.asc) {
+				v.asc = b
+
+				audio.Trait, audio.Raw = flv.AudioFrameTraitSequenceHeader, b
+				tag, err := v.audioPackager.Encode(audio)
+				if err != nil {
+					return nil, errors.Wrapf(err, "encode sequence header")
+				}
+				tags = append(tags, &rtmpTag{tagType: flv.TagTypeAudio, timestamp: timestamp, data: tag})
+			}
+
+			audio.Trait, audio.Raw = flv.AudioFrameTraitRaw, raw
+			tag, err := v.audioPackager.Encode(audio)
+			if err != nil {
+				return nil, errors.Wrapf(err, "encode frame")
+			}
+			tags = append(tags, &rtmpTag{tagType: flv.TagTypeAudio, timestamp: timestamp, data: tag})
+		}
+	}
+	return tags, nil
+}
+
+// The frame source of AV1 for RTMP, each frame is a temporal unit without the temporal delimiter,
+// and the OBUs are in low overhead bitstream format. It loops the bitstream when ends, and the DTS
+// keeps increasing by the frames.
+type av1FrameSource struct {
+	r *av1Reader
+	// The bitstream to loop, and whether it's IVF.
+	b   []byte
+	ivf bool
+	// The clock rate of DTS, and the frame rate of stream.
+	clockRate uint64
+	fps       uint64
+	// The number of frames read.
+	frames uint64
+}
+
+func newAV1FrameSource(b []byte, ivf bool, fps int, clockRate uint64) (*av1FrameSource, error) {
+	av1, err := newAV1Reader(bytes.NewReader(b), ivf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "av1 reader")
+	}
+	return &av1FrameSource{r: av1, b: b, ivf: ivf, clockRate: clockRate, fps: uint64(fps)}, nil
+}
+
+func (v *av1FrameSource) Next() (*rtmpFrame, error) {
+	obus, err := v.r.NextTemporalUnit()
+	if err == io.EOF && v.frames > 0 {
+		if v.r, err = newAV1Reader(bytes.NewReader(v.b), v.ivf); err != nil {
+			return nil, errors.Wrapf(err, "av1 reader")
+		}
+		obus, err = v.r.NextTemporalUnit()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	frame := &rtmpFrame{codec: rtmpFrameCodecAV1, dts: v.clockRate * v.frames / v.fps}
+	frame.pts = frame.dts
+	v.frames++
+
+	for _, obu := range obus {
+		if obu.Type() != av1OBUTypeTemporalDelimiter {
+			frame.payloads = append(frame.payloads, obu.Marshal(nil))
+		}
+	}
+	return frame, nil
+}
+
+// Open the video and audio sources in ms, loop in sync, nil if no such stream. The video is .h264,
+// .h265, .ivf or .obu, or the container MP4/TS which also provides the audio if no audio source.
+func openRTMPSources(ctx context.Context, sourceAudio, sourceVideo string, fps int) (rtmpFrameSource, rtmpFrameSource, error) {
+	var video, audio gb28181.FrameSource
+	var av1 *av1FrameSource
+
+	if isContainerSource(sourceVideo) {
+		f, err := os.Open(sourceVideo)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "open %v", sourceVideo)
+		}
+		defer f.Close()
+
+		v, a, err := gb28181.NewDemuxFrameSources(f, sourceVideo, 1000)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "demux %v", sourceVideo)
+		}
+		if v != nil {
+			video = v
+		}
+		if a != nil && sourceAudio == "" {
+			audio = a
+		}
+	} else if sourceVideo != "" {
+		b, err := ioutil.ReadFile(sourceVideo)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "read %v", sourceVideo)
+		}
+
+		switch {
+		case strings.HasSuffix(sourceVideo, ".h265"):
+			if video, err = gb28181.NewH265FrameSource(ctx, bytes.NewReader(b), fps, 1000); err != nil {
+				return nil, nil, errors.Wrapf(err, "h265 %v", sourceVideo)
+			}
+		case strings.HasSuffix(sourceVideo, ".ivf") || strings.HasSuffix(sourceVideo, ".obu"):
+			ivf := strings.HasSuffix(sourceVideo, ".ivf")
+			if av1, err = newAV1FrameSource(b, ivf, fps, 1000); err != nil {
+				return nil, nil, errors.Wrapf(err, "av1 %v", sourceVideo)
+			}
+		default:
+			if video, err = gb28181.NewH264FrameSource(ctx, bytes.NewReader(b), fps, 1000); err != nil {
+				return nil, nil, errors.Wrapf(err, "h264 %v", sourceVideo)
+			}
+		}
+	}
+
+	if sourceAudio != "" {
+		b, err := ioutil.ReadFile(sourceAudio)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "read %v", sourceAudio)
+		}
+
+		if audio, err = gb28181.NewAACFrameSource(bytes.NewReader(b), 1000); err != nil {
+			return nil, nil, errors.Wrapf(err, "aac %v", sourceAudio)
+		}
+	}
+
+	// Convert to interface only if not nil, to keep the nil of stream. The AV1 loops by itself.
+	var videoSource, audioSource rtmpFrameSource
+	loops := gb28181.NewLoopFrameSources(video, audio)
+	if loops[0] != nil {
+		videoSource = &rtmpFileFrameSource{source: loops[0]}
+	}
+	if loops[1] != nil {
+		audioSource = &rtmpFileFrameSource{source: loops[1]}
+	}
+	if av1 != nil {
+		videoSource = av1
+	}
+	return videoSource, audioSource, nil
+}
+
+// Publish the video and audio sources to RTMP url, paced by the timestamp of frames. The source is
+// .h264, .h265, .ivf or .obu and .aac, or MP4/TS, or FLV which is sent by tags. The H.265 and AV1
+// are in enhanced RTMP. The config is used for RTMPS.
+func startRTMPPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps int, config *tls.Config) error {
+	ctx = logger.WithContext(ctx)
+
+	logger.Tf(ctx, "Run RTMP publish url=%v, audio=%v, video=%v, fps=%v", r, sourceAudio, sourceVideo, fps)
+
+	client := &RTMPClient{tlsConfig: config}
+	defer client.Close()
+
+	start := time.Now()
+	if err := client.Publish(ctx, r); err != nil {
+		return errors.Wrapf(err, "Publish %v", r)
+	}
+	logger.Tf(ctx, "RTMP publish stream=%v ok, cost=%v, tls-handshake=%v", client.streamID, time.Since(start), client.handshake)
+
+	gStatRTC.RTMP.onPublish()
+	if client.handshake > 0 {
+		gStatRTC.RTMP.handshake.onLatency(client.handshake)
+	}
+
+	// Interrupt the IO when done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+
+	// Send the tag as RTMP message.
+	send := rtmpPacedSender(ctx, func(tag *rtmpTag) error {
+		m := rtmp.NewStreamMessage(client.streamID)
+		m.MessageType = rtmp.MessageType(tag.tagType)
+		m.Timestamp = uint64(tag.timestamp)
+		m.Payload = tag.data
+		if err := client.proto.WriteMessage(m); err != nil {
+			return errors.Wrapf(err, "write %v %vB", tag.tagType, len(tag.data))
+		}
+
+		gStatRTC.RTMP.onSent(len(tag.data))
+		return nil
+	})
+
+	err := publishSources(ctx, sourceAudio, sourceVideo, fps, send)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Publish the video and audio sources to HTTP-FLV url by POST in chunked body, or WebSocket-FLV url
+// that each tag is a binary message, paced like RTMP. The config is used for HTTPS and WSS.
+func startFLVPublish(ctx context.Context, r, sourceAudio, sourceVideo string, fps int, config *tls.Config) error {
+	ctx = logger.WithContext(ctx)
+
+	logger.Tf(ctx, "Run FLV publish url=%v, audio=%v, video=%v, fps=%v", r, sourceAudio, sourceVideo, fps)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	w, handshake, err := openFLVWriter(ctx, r, config)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.Wrapf(err, "Publish %v", r)
+	}
+	defer w.Close()
+	logger.Tf(ctx, "FLV publish ok, cost=%v, tls-handshake=%v", time.Since(start), handshake)
+
+	gStatRTC.RTMP.onPublish()
+	if handshake > 0 {
+		gStatRTC.RTMP.handshake.onLatency(handshake)
+	}
+
+	// Interrupt the IO when done.
+	go func() {
+		<-ctx.Done()
+		w.Close()
+	}()
+
+	// Mux the header and each tag to buffer, then write it at once, which is a message of WebSocket.
+	var b bytes.Buffer
+	muxer, err := flv.NewMuxer(&b)
+	if err != nil {
+		return errors.Wrapf(err, "new muxer")
+	}
+
+	hasVideo := sourceVideo != ""
+	hasAudio := sourceAudio != "" || strings.HasSuffix(sourceVideo, ".flv") || isContainerSource(sourceVideo)
+	if err := muxer.WriteHeader(hasVideo, hasAudio); err != nil {
+		return errors.Wrapf(err, "mux header")
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return errors.Wrapf(err, "write header")
+	}
+
+	send := rtmpPacedSender(ctx, func(tag *rtmpTag) error {
+		b.Reset()
+		if err := muxer.WriteTag(tag.tagType, tag.timestamp, tag.data); err != nil {
+			return errors.Wrapf(err, "mux %v", tag.tagType)
+		}
+		if _, err := w.Write(b.Bytes()); err != nil {
+			return errors.Wrapf(err, "write %v %vB", tag.tagType, len(tag.data))
+		}
+
+		gStatRTC.RTMP.onSent(len(tag.data))
+		return nil
+	})
+
+	err = publishSources(ctx, sourceAudio, sourceVideo, fps, send)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Open the writer of FLV stream, the WebSocket for ws or wss, or the body of POST request for http or
+// https, which fails when the response is received, because the server should never respond before
+// the stream is done. Return the cost of TLS handshake.
+func openFLVWriter(ctx context.Context, r string, config *tls.Config) (io.WriteCloser, time.Duration, error) {
+	u, err := url.Parse(r)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "parse %v", r)
+	}
+
+	if u.Scheme == "ws" || u.Scheme == "wss" {
+		return dialWebSocket(ctx, u, config)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	trace, handshake := newTLSHandshakeTrace()
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "POST", r, pr)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "new request %v", r)
+	}
+	req.Header.Set("Content-Type", "video/x-flv")
+
+	// The body is in chunked encoding, and written until the response or error.
+	go func() {
+		defer transport.CloseIdleConnections()
+
+		res, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			pr.CloseWithError(errors.Wrapf(err, "post %v", r))
+			return
+		}
+		res.Body.Close()
+		pr.CloseWithError(errors.Errorf("post %v, response status=%v", r, res.StatusCode))
+	}()
+
+	// Write nothing to wait for connected, and the handshake is done.
+	if _, err := pw.Write(nil); err != nil {
+		return nil, 0, errors.Wrapf(err, "connect")
+	}
+	return pw, *handshake, nil
+}
+
+// Pace the tags by timestamp in ms to follow the wall-clock, then write it.
+func rtmpPacedSender(ctx context.Context, write func(tag *rtmpTag) error) func(tag *rtmpTag) error {
+	start := time.Now()
+	return func(tag *rtmpTag) error {
+		if d := time.Duration(tag.timestamp)*time.Millisecond - time.Since(start); d > 30*time.Millisecond {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(d):
+			}
+		}
+		return write(tag)
+	}
+}
+
+// Publish the FLV file by tags, or the frames of sources.
+func publishSources(ctx context.Context, sourceAudio, sourceVideo string, fps int, send func(tag *rtmpTag) error) error {
+	if strings.HasSuffix(sourceVideo, ".flv") {
+		return publishFLVFile(ctx, sourceVideo, send)
+	}
+	return publishFrameSources(ctx, sourceAudio, sourceVideo, fps, send)
+}
+
+// Publish the FLV file by tags, loop with the timestamp continued.
+func publishFLVFile(ctx context.Context, source string, send func(tag *rtmpTag) error) error {
+	var offset, last uint32
+	for ctx.Err() == nil {
+		err := func() error {
+			f, err := os.Open(source)
+			if err != nil {
+				return errors.Wrapf(err, "open %v", source)
+			}
+			defer f.Close()
+
+			demuxer, err := flv.NewDemuxer(f)
+			if err != nil {
+				return errors.Wrapf(err, "demux %v", source)
+			}
+			if _, _, _, err = demuxer.ReadHeader(); err != nil {
+				return errors.Wrapf(err, "read header")
+			}
+
+			for ctx.Err() == nil {
+				tagType, tagSize, timestamp, err := demuxer.ReadTagHeader()
+				if err != nil {
+					return err
+				}
+
+				tag, err := demuxer.ReadTag(tagSize)
+				if err != nil {
+					return err
+				}
+
+				if tagType != flv.TagTypeVideo && tagType != flv.TagTypeAudio {
+					continue
+				}
+
+				last = offset + timestamp
+				if err := send(&rtmpTag{tagType: tagType, timestamp: last, data: tag}); err != nil {
+					return errors.Wrapf(err, "send")
+				}
+			}
+			return ctx.Err()
+		}()
+
+		if errors.Cause(err) != io.EOF && errors.Cause(err) != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// Restart after the last tag, about a frame later.
+		offset = last + 40
+		logger.Tf(ctx, "EOF, restart ingest %v, offset=%vms", source, offset)
+	}
+	return ctx.Err()
+}
+
+// Publish the frames of video and audio sources, the frame with smaller timestamp first.
+func publishFrameSources(ctx context.Context, sourceAudio, sourceVideo string, fps int, send func(tag *rtmpTag) error) error {
+	video, audio, err := openRTMPSources(ctx, sourceAudio, sourceVideo, fps)
+	if err != nil {
+		return errors.Wrapf(err, "open sources")
+	}
+
+	muxer, err := newRTMPFLVMuxer()
+	if err != nil {
+		return errors.Wrapf(err, "new muxer")
+	}
+
+	var videoFrame, audioFrame *rtmpFrame
+	for ctx.Err() == nil {
+		if video != nil && videoFrame == nil {
+			if videoFrame, err = video.Next(); err != nil {
+				return errors.Wrapf(err, "read video")
+			}
+		}
+		if audio != nil && audioFrame == nil {
+			if audioFrame, err = audio.Next(); err != nil {
+				return errors.Wrapf(err, "read audio")
+			}
+		}
+
+		frame := videoFrame
+		if frame == nil || (audioFrame != nil && audioFrame.dts < frame.dts) {
+			frame, audioFrame = audioFrame, nil
+		} else {
+			videoFrame = nil
+		}
+
+		tags, err := muxer.Mux(frame)
+		if err != nil {
+			return errors.Wrapf(err, "mux %v", frame.codec)
+		}
+
+		for _, tag := range tags {
+			if err := send(tag); err != nil {
+				return errors.Wrapf(err, "send")
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// The chunk stream to read RTMP messages, because the vendored protocol ignores the timestamp in
+// message header unless it's extended, and panics when a message is split to multiple chunks.
+type rtmpChunkReader struct {
+	r         *bufio.Reader
+	chunkSize uint32
+	chunks    map[uint32]*rtmpChunkStream
+}
+
+// The state of a chunk stream, the header is inherited by the following chunks.
+type rtmpChunkStream struct {
+	timestamp, delta uint32
+	extended         bool
+	length           uint32
+	messageType      rtmp.MessageType
+	// The payload of partial message, nil if waiting for the first chunk of message.
+	payload []byte
+}
+
+func newRTMPChunkReader(r *bufio.Reader) *rtmpChunkReader {
+	return &rtmpChunkReader{r: r, chunkSize: 128, chunks: make(map[uint32]*rtmpChunkStream)}
+}
+
+// Read the next entire message, and apply the set chunk size message.
+func (v *rtmpChunkReader) ReadMessage() (*rtmp.Message, error) {
+	u24 := func(b []byte) uint32 {
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	}
+
+	for {
+		b := make([]byte, 11)
+		if _, err := io.ReadFull(v.r, b[:1]); err != nil {
+			return nil, errors.Wrapf(err, "read basic header")
+		}
+
+		format, cid := b[0]>>6, uint32(b[0]&0x3f)
+		if cid == 0 {
+			if _, err := io.ReadFull(v.r, b[:1]); err != nil {
+				return nil, errors.Wrapf(err, "read cid")
+			}
+			cid = 64 + uint32(b[0])
+		} else if cid == 1 {
+			if _, err := io.ReadFull(v.r, b[:2]); err != nil {
+				return nil, errors.Wrapf(err, "read cid")
+			}
+			cid = 64 + uint32(b[0]) + uint32(b[1])*256
+		}
+
+		chunk, ok := v.chunks[cid]
+		if !ok {
+			chunk = &rtmpChunkStream{}
+			v.chunks[cid] = chunk
+		}
+		first := chunk.payload == nil
+
+		// The message header, 11, 7, 3 or 0 bytes for fmt 0, 1, 2 or 3.
+		header := b[:[]int{11, 7, 3, 0}[format]]
+		if _, err := io.ReadFull(v.r, header); err != nil {
+			return nil, errors.Wrapf(err, "read message header")
+		}
+		if format <= 2 {
+			chunk.delta, chunk.extended = u24(header), u24(header) == 0xffffff
+		}
+		if format <= 1 {
+			chunk.length, chunk.messageType = u24(header[3:]), rtmp.MessageType(header[6])
+		}
+
+		// The extended timestamp is also carried by the fmt 3 chunks, like Adobe and SRS.
+		if chunk.extended {
+			if _, err := io.ReadFull(v.r, b[:4]); err != nil {
+				return nil, errors.Wrapf(err, "read extended timestamp")
+			}
+			if format <= 2 {
+				chunk.delta = uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+			}
+		}
+
+		// The timestamp is absolute for fmt 0, or delta for others, which is applied once a message.
+		if format == 0 {
+			chunk.timestamp = chunk.delta
+		} else if first {
+			chunk.timestamp += chunk.delta
+		}
+
+		if first {
+			chunk.payload = make([]byte, 0, chunk.length)
+		}
+
+		size := chunk.length - uint32(len(chunk.payload))
+		if size > v.chunkSize {
+			size = v.chunkSize
+		}
+		payload := chunk.payload[len(chunk.payload) : uint32(len(chunk.payload))+size]
+		if _, err := io.ReadFull(v.r, payload); err != nil {
+			return nil, errors.Wrapf(err, "read %vB payload", size)
+		}
+		if chunk.payload = chunk.payload[:uint32(len(chunk.payload))+size]; uint32(len(chunk.payload)) < chunk.length {
+			continue
+		}
+
+		m := rtmp.NewMessage()
+		m.MessageType, m.Timestamp, m.Payload = chunk.messageType, uint64(chunk.timestamp&0x7fffffff), chunk.payload
+		chunk.payload = nil
+
+		if m.MessageType == rtmp.MessageTypeSetChunkSize && len(m.Payload) >= 4 {
+			v.chunkSize = (uint32(m.Payload[0])<<24 | uint32(m.Payload[1])<<16 | uint32(m.Payload[2])<<8 |
+				uint32(m.Payload[3])) & 0x7fffffff
+		}
+		return m, nil
+	}
+}
+
+// The RTMP play client, which writes and decodes the commands by protocol, while reads the messages
+// by the chunk reader.
+type rtmpPlayClient struct {
+	// The lock for conn, which might be closed by other goroutine when connecting.
+	lock     sync.Mutex
+	closed   bool
+	conn     net.Conn
+	proto    *rtmp.Protocol
+	reader   *rtmpChunkReader
+	streamID int
+	// The TLS config for rtmps, and the cost of TLS handshake.
+	tlsConfig *tls.Config
+	handshake time.Duration
+}
+
+func newRTMPPlayClient(config *tls.Config) *rtmpPlayClient {
+	return &rtmpPlayClient{tlsConfig: config}
+}
+
+func (v *rtmpPlayClient) Close() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.closed = true; v.conn != nil {
+		return v.conn.Close()
+	}
+	return nil
+}
+
+// Connect to the url and play the stream, return when got the onStatus of play.
+func (v *rtmpPlayClient) Play(ctx context.Context, r string) error {
+	u, err := url.Parse(r)
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", r)
+	}
+
+	index := strings.LastIndex(r, "/")
+	if index <= 0 {
+		return errors.Errorf("invalid url %v", r)
+	}
+	tcURL, stream := r[:index], r[index+1:]
+
+	conn, handshake, err := dialRTMP(ctx, u, v.tlsConfig)
+	if err != nil {
+		return errors.Wrapf(err, "connect %v", u.Host)
+	}
+
+	v.lock.Lock()
+	v.conn, v.handshake = conn, handshake
+	closed := v.closed
+	v.lock.Unlock()
+	if closed {
+		conn.Close()
+		return errors.Errorf("closed")
+	}
+
+	br := bufio.NewReader(v.conn)
+	hs := rtmp.NewHandshake(rand.New(rand.NewSource(time.Now().UnixNano())))
+	if err := hs.WriteC0S0(v.conn); err != nil {
+		return errors.Wrapf(err, "write c0")
+	}
+	if err := hs.WriteC1S1(v.conn); err != nil {
+		return errors.Wrapf(err, "write c1")
+	}
+	if _, err := hs.ReadC0S0(br); err != nil {
+		return errors.Wrapf(err, "read s0")
+	}
+	s1, err := hs.ReadC1S1(br)
+	if err != nil {
+		return errors.Wrapf(err, "read s1")
+	}
+	if _, err := hs.ReadC2S2(br); err != nil {
+		return errors.Wrapf(err, "read s2")
+	}
+	if err := hs.WriteC2S2(v.conn, s1); err != nil {
+		return errors.Wrapf(err, "write c2")
+	}
+
+	// Never read by protocol, the messages are read by the chunk reader.
+	v.proto, v.reader = rtmp.NewProtocol(v.conn), newRTMPChunkReader(br)
+
+	connect := rtmp.NewConnectAppPacket()
+	connect.CommandObject.Set("tcUrl", amf0.NewString(tcURL))
+	if err := v.proto.WritePacket(connect, 0); err != nil {
+		return errors.Wrapf(err, "connect %v", tcURL)
+	}
+	if _, err := v.expect(func(pkt rtmp.Packet) bool {
+		_, ok := pkt.(*rtmp.ConnectAppResPacket)
+		return ok
+	}); err != nil {
+		return errors.Wrapf(err, "connect %v", tcURL)
+	}
+
+	createStream := rtmp.NewCreateStreamPacket()
+	if err := v.proto.WritePacket(createStream, 0); err != nil {
+		return errors.Wrapf(err, "create stream")
+	}
+	if pkt, err := v.expect(func(pkt rtmp.Packet) bool {
+		_, ok := pkt.(*rtmp.CreateStreamResPacket)
+		return ok
+	}); err != nil {
+		return errors.Wrapf(err, "create stream")
+	} else {
+		v.streamID = int(pkt.(*rtmp.CreateStreamResPacket).StreamID)
+	}
+
+	play := rtmp.NewPlayPacket()
+	play.StreamName = *amf0.NewString(stream)
+	if err := v.proto.WritePacket(play, v.streamID); err != nil {
+		return errors.Wrapf(err, "play %v", stream)
+	}
+	if _, err := v.expect(func(pkt rtmp.Packet) bool {
+		call, ok := pkt.(*rtmp.CallPacket)
+		return ok && call.CommandName == "onStatus"
+	}); err != nil {
+		return errors.Wrapf(err, "play %v", stream)
+	}
+	return nil
+}
+
+// Read messages until the AMF0 command matches, ignore other messages.
+func (v *rtmpPlayClient) expect(match func(pkt rtmp.Packet) bool) (rtmp.Packet, error) {
+	for {
+		m, err := v.reader.ReadMessage()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read message")
+		}
+		if m.MessageType != rtmp.MessageTypeAMF0Command {
+			continue
+		}
+
+		pkt, err := v.proto.DecodeMessage(m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode message")
+		}
+		if match(pkt) {
+			return pkt, nil
+		}
+	}
+}
+
+// Read the next message, including the audio, video and others.
+func (v *rtmpPlayClient) ReadMessage() (*rtmp.Message, error) {
+	return v.reader.ReadMessage()
+}
+
+// The checker of video tags, the legacy AVC and HEVC, or enhanced RTMP with fourCC. The sequence
+// header must be received before frames, and the NALUs or OBUs of frames must be complete.
+type rtmpVideoChecker struct {
+	// The fourCC of sequence header, empty if not received.
+	fourCC string
+	// The NALU length size of AVC and HEVC, 0 for AV1.
+	lengthSize int
+}
+
+func newRTMPVideoChecker() *rtmpVideoChecker {
+	return &rtmpVideoChecker{}
+}
+
+// Check the video tag, return the fourCC if it's a sequence header.
+func (v *rtmpVideoChecker) Check(tag []byte) (sequenceHeader string, err error) {
+	if len(tag) < 5 {
+		return "", errors.Errorf("invalid video %vB", len(tag))
+	}
+
+	// The enhanced RTMP, the CodedFrames of AVC and HEVC has 3 bytes CTS.
+	if tag[0]&rtmpExVideoHeader != 0 {
+		packetType, fourCC, body := tag[0]&0x0f, string(tag[1:5]), tag[5:]
+		switch packetType {
+		case rtmpPacketTypeSequenceStart:
+			return fourCC, v.configure(fourCC, body)
+		case rtmpPacketTypeCodedFrames, rtmpPacketTypeCodedFramesX:
+			if packetType == rtmpPacketTypeCodedFrames && fourCC != rtmpFourCCAV1 {
+				if len(body) < 3 {
+					return "", errors.Errorf("invalid %v frame %vB", fourCC, len(tag))
+				}
+				body = body[3:]
+			}
+			return "", v.checkFrame(fourCC, body)
+		}
+		return "", nil
+	}
+
+	// The legacy AVC, and HEVC with codec id 12.
+	var fourCC string
+	switch flv.VideoCodec(tag[0] & 0x0f) {
+	case flv.VideoCodecAVC:
+		fourCC = rtmpFourCCAVC
+	case flv.VideoCodecHEVC:
+		fourCC = rtmpFourCCHEVC
+	default:
+		return "", nil
+	}
+
+	switch flv.VideoFrameTrait(tag[1]) {
+	case flv.VideoFrameTraitSequenceHeader:
+		return fourCC, v.configure(fourCC, tag[5:])
+	case flv.VideoFrameTraitNALU:
+		return "", v.checkFrame(fourCC, tag[5:])
+	}
+	return "", nil
+}
+
+// Parse the avcC, hvcC or av1C for the NALU length size.
+func (v *rtmpVideoChecker) configure(fourCC string, config []byte) error {
+	switch fourCC {
+	case rtmpFourCCAVC:
+		if len(config) < 7 || config[0] != 1 {
+			return errors.Errorf("invalid avcC %vB", len(config))
+		}
+		v.lengthSize = int(config[4]&0x03) + 1
+	case rtmpFourCCHEVC:
+		if len(config) < 23 || config[0] != 1 {
+			return errors.Errorf("invalid hvcC %vB", len(config))
+		}
+		v.lengthSize = int(config[21]&0x03) + 1
+	case rtmpFourCCAV1:
+		if len(config) < 4 || config[0] != 0x81 {
+			return errors.Errorf("invalid av1C %vB", len(config))
+		}
+		if _, err := parseAV1OBUs(config[4:]); err != nil {
+			return errors.Wrapf(err, "av1C config obus")
+		}
+		v.lengthSize = 0
+	default:
+		return errors.Errorf("not support fourCC %v", fourCC)
+	}
+
+	v.fourCC = fourCC
+	return nil
+}
+
+func (v *rtmpVideoChecker) checkFrame(fourCC string, frame []byte) error {
+	if v.fourCC != fourCC {
+		return errors.Errorf("no sequence header for %v, actual %v", fourCC, v.fourCC)
+	}
+
+	if fourCC == rtmpFourCCAV1 {
+		if _, err := parseAV1OBUs(frame); err != nil {
+			return errors.Wrapf(err, "av1 obus")
+		}
+		return nil
+	}
+
+	for p := frame; len(p) > 0; {
+		if len(p) < v.lengthSize {
+			return errors.Errorf("invalid %v NALU length, left %vB", fourCC, len(p))
+		}
+
+		var size int
+		for _, b := range p[:v.lengthSize] {
+			size = size<<8 | int(b)
+		}
+		if p = p[v.lengthSize:]; size == 0 || size > len(p) {
+			return errors.Errorf("invalid %v NALU %vB, left %vB", fourCC, size, len(p))
+		}
+		p = p[size:]
+	}
+	return nil
+}
+
+// The checker of the FLV tags played from RTMP or HTTP-FLV, verify the timestamp of each track is
+// monotonic, and the audio and video are complete.
+type rtmpPlayChecker struct {
+	// The label of protocol in logs, RTMP or FLV.
+	label string
+	// The start time of connecting, to measure the first frame.
+	start         time.Time
+	video         *rtmpVideoChecker
+	audioPackager flv.AudioPackager
+	// The last timestamp of audio and video, -1 if no message.
+	lastAudio, lastVideo int64
+	messages, backwards  uint64
+}
+
+func newRTMPPlayChecker(label string, start time.Time) (*rtmpPlayChecker, error) {
+	v := &rtmpPlayChecker{label: label, start: start, video: newRTMPVideoChecker(), lastAudio: -1, lastVideo: -1}
+
+	var err error
+	if v.audioPackager, err = flv.NewAudioPackager(); err != nil {
+		return nil, errors.Wrapf(err, "new audio packager")
+	}
+	return v, nil
+}
+
+// Check the tag in ms, ignore the tags except audio and video.
+func (v *rtmpPlayChecker) Check(ctx context.Context, tagType flv.TagType, timestamp int64, tag []byte) error {
+	if (tagType != flv.TagTypeVideo && tagType != flv.TagTypeAudio) || len(tag) == 0 {
+		return nil
+	}
+
+	last := &v.lastVideo
+	if tagType == flv.TagTypeAudio {
+		last = &v.lastAudio
+		if _, err := v.audioPackager.Decode(tag); err != nil {
+			return errors.Wrapf(err, "decode audio %vB", len(tag))
+		}
+	} else {
+		if fourCC, err := v.video.Check(tag); err != nil {
+			return errors.Wrapf(err, "check video")
+		} else if fourCC != "" {
+			logger.Tf(ctx, "%v play video sequence header, fourCC=%v, %vB", v.label, fourCC, len(tag))
+		}
+	}
+
+	if v.messages++; v.messages == 1 {
+		logger.Tf(ctx, "%v play first %v, cost=%v", v.label, tagType, time.Since(v.start))
+		gStatRTC.RTMPPlay.firstFrame.onLatency(time.Since(v.start))
+	}
+
+	backward := *last >= 0 && timestamp < *last
+	if backward {
+		v.backwards++
+		logger.Wf(ctx, "%v play %v timestamp backward from %v to %v", v.label, tagType, *last, timestamp)
+	}
+	*last = timestamp
+
+	gStatRTC.RTMPPlay.onRecv(len(tag), backward)
+	return nil
+}
+
+// Play the RTMP or RTMPS url, and check the FLV tags by rtmpPlayChecker, and measure the cost from
+// connecting to the first audio or video frame. The video of H.264, and H.265 or AV1 in enhanced RTMP,
+// are also checked. The config is used for RTMPS.
+func startRTMPPlay(ctx context.Context, r string, config *tls.Config) error {
+	ctx = logger.WithContext(ctx)
+
+	logger.Tf(ctx, "Run RTMP play url=%v", r)
+
+	client := newRTMPPlayClient(config)
+	defer client.Close()
+
+	// Interrupt the IO when done, even if waiting for the response of play.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+
+	start := time.Now()
+	if err := client.Play(ctx, r); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.Wrapf(err, "Play %v", r)
+	}
+	logger.Tf(ctx, "RTMP play stream=%v ok, cost=%v, tls-handshake=%v", client.streamID, time.Since(start), client.handshake)
+
+	gStatRTC.RTMPPlay.onPlay()
+	if client.handshake > 0 {
+		gStatRTC.RTMPPlay.handshake.onLatency(client.handshake)
+	}
+
+	checker, err := newRTMPPlayChecker("RTMP", start)
+	if err != nil {
+		return errors.Wrapf(err, "new checker")
+	}
+	defer func() {
+		logger.Tf(ctx, "RTMP play done, messages=%v, backwards=%v", checker.messages, checker.backwards)
+	}()
+
+	for ctx.Err() == nil {
+		m, err := client.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return errors.Wrapf(err, "read message")
+		}
+
+		if err := checker.Check(ctx, flv.TagType(m.MessageType), int64(m.Timestamp), m.Payload); err != nil {
+			return errors.Wrapf(err, "check %v", flv.TagType(m.MessageType))
+		}
+	}
+	return nil
+}
+
+// Play the HTTP-FLV or WebSocket-FLV url, check the FLV tags like RTMP. The config is used for HTTPS
+// and WSS.
+func startFLVPlay(ctx context.Context, r string, config *tls.Config) error {
+	ctx = logger.WithContext(ctx)
+
+	logger.Tf(ctx, "Run FLV play url=%v", r)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	body, handshake, err := openFLVReader(ctx, r, config)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.Wrapf(err, "Play %v", r)
+	}
+	defer body.Close()
+	logger.Tf(ctx, "FLV play ok, cost=%v, tls-handshake=%v", time.Since(start), handshake)
+
+	gStatRTC.RTMPPlay.onPlay()
+	if handshake > 0 {
+		gStatRTC.RTMPPlay.handshake.onLatency(handshake)
+	}
+
+	// Interrupt the IO when done.
+	go func() {
+		<-ctx.Done()
+		body.Close()
+	}()
+
+	demuxer, err := flv.NewDemuxer(body)
+	if err != nil {
+		return errors.Wrapf(err, "new demuxer")
+	}
+	defer demuxer.Close()
+
+	if _, _, _, err := demuxer.ReadHeader(); err != nil {
+		return errors.Wrapf(err, "read header")
+	}
+
+	checker, err := newRTMPPlayChecker("FLV", start)
+	if err != nil {
+		return errors.Wrapf(err, "new checker")
+	}
+	defer func() {
+		logger.Tf(ctx, "FLV play done, messages=%v, backwards=%v", checker.messages, checker.backwards)
+	}()
+
+	for ctx.Err() == nil {
+		tagType, tagSize, timestamp, err := demuxer.ReadTagHeader()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return errors.Wrapf(err, "read tag header")
+		}
+
+		tag, err := demuxer.ReadTag(tagSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return errors.Wrapf(err, "read tag")
+		}
+
+		if err := checker.Check(ctx, tagType, int64(timestamp), tag); err != nil {
+			return errors.Wrapf(err, "check %v", tagType)
+		}
+	}
+	return nil
+}
+
+// Open the reader of FLV stream, the WebSocket for ws or wss, or the body of GET response for http or
+// https. Return the cost of TLS handshake.
+func openFLVReader(ctx context.Context, r string, config *tls.Config) (io.ReadCloser, time.Duration, error) {
+	u, err := url.Parse(r)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "parse %v", r)
+	}
+
+	if u.Scheme == "ws" || u.Scheme == "wss" {
+		return dialWebSocket(ctx, u, config)
+	}
+
+	// Each player uses its own connection, never reuse.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	defer transport.CloseIdleConnections()
+
+	trace, handshake := newTLSHandshakeTrace()
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "GET", r, nil)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "new request %v", r)
+	}
+
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "get %v", r)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, 0, errors.Errorf("get %v, status=%v", r, res.StatusCode)
+	}
+	return res.Body, *handshake, nil
+}
+
+// Trace the cost of TLS handshake of HTTPS request, which is 0 for HTTP.
+func newTLSHandshakeTrace() (*httptrace.ClientTrace, *time.Duration) {
+	var start time.Time
+	var handshake time.Duration
+	return &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			start = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			handshake = time.Since(start)
+		},
+	}, &handshake
+}
@@ -21,12 +21,24 @@
 package srs
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -637,3 +649,508 @@ func TestRtmpPublish_HttpFlvPlayNoVideo(t *testing.T) {
 		t.Errorf("err %+v", err)
 	}
 }
+
+func TestRtmpFLVMuxer(t *testing.T) {
+	if err := func() error {
+		m, err := newRTMPFLVMuxer()
+		if err != nil {
+			return errors.Wrapf(err, "new muxer")
+		}
+
+		// The frame before the sequence header is dropped.
+		sps, pps := []byte{0x67, 0x42, 0xc0, 0x1e}, []byte{0x68, 0xce, 0x3c, 0x80}
+		if tags, err := m.Mux(&rtmpFrame{codec: rtmpFrameCodecH264, payloads: [][]byte{{0x41, 0x9a}}}); err != nil {
+			return errors.Wrapf(err, "mux")
+		} else if len(tags) != 0 {
+			return errors.Errorf("invalid tags %v", len(tags))
+		}
+
+		// The sequence header and keyframe, with CTS.
+		frame := &rtmpFrame{codec: rtmpFrameCodecH264, dts: 40, pts: 120, payloads: [][]byte{
+			{0x09, 0xf0}, sps, pps, {0x65, 0x88, 0x84},
+		}}
+		tags, err := m.Mux(frame)
+		if err != nil {
+			return errors.Wrapf(err, "mux")
+		}
+		if len(tags) != 2 || tags[0].timestamp != 40 || tags[1].timestamp != 40 {
+			return errors.Errorf("invalid tags %v", len(tags))
+		}
+		if b := tags[0].data; b[0] != 0x17 || b[1] != 0 {
+			return errors.Errorf("invalid sequence header %v", hex.EncodeToString(b))
+		}
+		if b := tags[1].data; !bytes.Equal(b, []byte{0x17, 1, 0, 0, 80, 0, 0, 0, 3, 0x65, 0x88, 0x84}) {
+			return errors.Errorf("invalid keyframe %v", hex.EncodeToString(b))
+		}
+
+		// The same sequence header is not sent again.
+		if tags, err := m.Mux(frame); err != nil {
+			return errors.Wrapf(err, "mux")
+		} else if len(tags) != 1 {
+			return errors.Errorf("invalid tags %v", len(tags))
+		}
+
+		// The AAC sequence header and two raw frames in one payload, 44.1KHz stereo.
+		adts := []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x1f, 0xfc, 0x21}
+		tags, err = m.Mux(&rtmpFrame{codec: rtmpFrameCodecAAC, dts: 100, payloads: [][]byte{
+			append(append([]byte{}, adts...), adts...),
+		}})
+		if err != nil {
+			return errors.Wrapf(err, "mux")
+		}
+		if len(tags) != 3 || tags[0].timestamp != 100 || tags[2].timestamp != 123 {
+			return errors.Errorf("invalid tags %v", len(tags))
+		}
+		if b := tags[0].data; !bytes.Equal(b, []byte{0xaf, 0, 0x12, 0x10}) {
+			return errors.Errorf("invalid asc %v", hex.EncodeToString(b))
+		}
+		if b := tags[1].data; !bytes.Equal(b, []byte{0xaf, 1, 0x21}) {
+			return errors.Errorf("invalid raw %v", hex.EncodeToString(b))
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtmpChunkReader(t *testing.T) {
+	if err := func() error {
+		var b bytes.Buffer
+		// The set chunk size to 8, by fmt 0.
+		b.Write([]byte{0x02, 0, 0, 0, 0, 0, 4, 1, 0, 0, 0, 0, 0, 0, 0, 8})
+		// The audio of 10 bytes at 100ms, by fmt 0 and 3.
+		b.Write([]byte{0x04, 0, 0, 100, 0, 0, 10, 8, 1, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 0xc4, 8, 9})
+		// The audio of 10 bytes with delta 20ms, by fmt 2 and 3.
+		b.Write([]byte{0x84, 0, 0, 20, 0, 1, 2, 3, 4, 5, 6, 7, 0xc4, 8, 9})
+		// The audio of 10 bytes with the same delta, by fmt 3.
+		b.Write([]byte{0xc4, 0, 1, 2, 3, 4, 5, 6, 7, 0xc4, 8, 9})
+		// The video with extended timestamp, by fmt 0.
+		b.Write([]byte{0x06, 0xff, 0xff, 0xff, 0, 0, 3, 9, 1, 0, 0, 0, 1, 0, 0, 0, 0x17, 1, 0})
+		// The audio of 2 bytes with delta 10ms, by fmt 1.
+		b.Write([]byte{0x44, 0, 0, 10, 0, 0, 2, 8, 0xaf, 1})
+
+		r := newRTMPChunkReader(bufio.NewReader(&b))
+		for _, expect := range []struct {
+			messageType rtmp.MessageType
+			timestamp   uint64
+			size        int
+		}{
+			{rtmp.MessageTypeSetChunkSize, 0, 4},
+			{rtmp.MessageTypeAudio, 100, 10},
+			{rtmp.MessageTypeAudio, 120, 10},
+			{rtmp.MessageTypeAudio, 140, 10},
+			{rtmp.MessageTypeVideo, 0x1000000, 3},
+			{rtmp.MessageTypeAudio, 150, 2},
+		} {
+			m, err := r.ReadMessage()
+			if err != nil {
+				return errors.Wrapf(err, "read")
+			}
+			if m.MessageType != expect.messageType || m.Timestamp != expect.timestamp || len(m.Payload) != expect.size {
+				return errors.Errorf("invalid message %v %v %vB, expect %+v", m.MessageType, m.Timestamp, len(m.Payload), expect)
+			}
+		}
+		if r.chunkSize != 8 {
+			return errors.Errorf("invalid chunk size %v", r.chunkSize)
+		}
+		if _, err := r.ReadMessage(); errors.Cause(err) != io.EOF {
+			return errors.Errorf("should EOF, err %v", err)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtmpEnhancedHEVC(t *testing.T) {
+	if err := func() error {
+		m, err := newRTMPFLVMuxer()
+		if err != nil {
+			return errors.Wrapf(err, "new muxer")
+		}
+
+		vps, _ := hex.DecodeString("40010c01ffff01600000030090000003000003003f959809")
+		sps, _ := hex.DecodeString("42010101600000030090000003000003003fa00602014165959a4932bc05a708000003000800000300c840")
+		pps, _ := hex.DecodeString("4401c172b46240")
+
+		// The sequence header and IDR, with CTS.
+		tags, err := m.Mux(&rtmpFrame{codec: rtmpFrameCodecH265, dts: 40, pts: 80, payloads: [][]byte{
+			{0x46, 0x01, 0x50}, vps, sps, pps, {0x26, 0x01, 0xaf},
+		}})
+		if err != nil {
+			return errors.Wrapf(err, "mux")
+		}
+		if len(tags) != 2 {
+			return errors.Errorf("invalid tags %v", len(tags))
+		}
+		if b := tags[0].data; b[0] != 0x90 || string(b[1:5]) != rtmpFourCCHEVC || b[5] != 1 {
+			return errors.Errorf("invalid sequence header %v", hex.EncodeToString(b))
+		}
+		if b := tags[1].data; !bytes.Equal(b, []byte{0x91, 'h', 'v', 'c', '1', 0, 0, 40, 0, 0, 0, 3, 0x26, 0x01, 0xaf}) {
+			return errors.Errorf("invalid keyframe %v", hex.EncodeToString(b))
+		}
+
+		// The inter frame without CTS, in CodedFramesX.
+		tags, err = m.Mux(&rtmpFrame{codec: rtmpFrameCodecH265, dts: 80, pts: 80, payloads: [][]byte{{0x02, 0x01, 0xd0}}})
+		if err != nil {
+			return errors.Wrapf(err, "mux")
+		}
+		if len(tags) != 1 || !bytes.Equal(tags[0].data, []byte{0xa3, 'h', 'v', 'c', '1', 0, 0, 0, 3, 0x02, 0x01, 0xd0}) {
+			return errors.Errorf("invalid inter frame %v", len(tags))
+		}
+
+		// The checker rejects frames before the sequence header.
+		c := newRTMPVideoChecker()
+		if _, err := c.Check(tags[0].data); err == nil {
+			return errors.New("should fail without sequence header")
+		}
+		if fourCC, err := c.Check(rtmpExVideoTag(rtmpFourCCHEVC, rtmpPacketTypeSequenceStart, true, 0, m.videoConfig)); err != nil {
+			return errors.Wrapf(err, "check sequence header")
+		} else if fourCC != rtmpFourCCHEVC || c.lengthSize != 4 {
+			return errors.Errorf("invalid fourCC %v, length size %v", fourCC, c.lengthSize)
+		}
+		if _, err := c.Check(tags[0].data); err != nil {
+			return errors.Wrapf(err, "check frame")
+		}
+
+		// The NALU length overflows.
+		if _, err := c.Check([]byte{0xa3, 'h', 'v', 'c', '1', 0, 0, 0, 9, 0x02, 0x01}); err == nil {
+			return errors.New("should fail for overflow NALU")
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtmpEnhancedAV1(t *testing.T) {
+	if err := func() error {
+		// The reduced still picture header, main profile, level 8, 4:2:0 with colocated chroma.
+		sequenceHeader := &av1OBU{Header: []byte{av1OBUTypeSequenceHeader << 3}, Payload: []byte{0x1a, 0x0c, 0xff, 0xc0, 0x04}}
+		if h, err := parseAV1SequenceHeader(sequenceHeader.Payload); err != nil {
+			return errors.Wrapf(err, "parse")
+		} else if h.profile != 0 || h.level != 8 || h.subsamplingX != 1 || h.subsamplingY != 1 || h.chromaSamplePosition != 1 {
+			return errors.Errorf("invalid sequence header %+v", h)
+		}
+		if _, err := parseAV1SequenceHeader([]byte{0x1a}); err == nil {
+			return errors.New("should fail for truncated header")
+		}
+
+		m, err := newRTMPFLVMuxer()
+		if err != nil {
+			return errors.Wrapf(err, "new muxer")
+		}
+
+		frame := &av1OBU{Header: []byte{6 << 3}, Payload: []byte{0x10, 0x20}}
+		tags, err := m.Mux(&rtmpFrame{codec: rtmpFrameCodecAV1, dts: 40, pts: 40, payloads: [][]byte{
+			sequenceHeader.Marshal(nil), frame.Marshal(nil),
+		}})
+		if err != nil {
+			return errors.Wrapf(err, "mux")
+		}
+		if len(tags) != 2 {
+			return errors.Errorf("invalid tags %v", len(tags))
+		}
+		if b := tags[0].data; !bytes.Equal(b[:9], []byte{0x90, 'a', 'v', '0', '1', 0x81, 0x08, 0x0d, 0}) {
+			return errors.Errorf("invalid sequence header %v", hex.EncodeToString(b))
+		}
+		// The AV1 has no CTS, so it's CodedFrames.
+		if b := tags[1].data; b[0] != 0x91 || string(b[1:5]) != rtmpFourCCAV1 {
+			return errors.Errorf("invalid keyframe %v", hex.EncodeToString(b))
+		}
+
+		c := newRTMPVideoChecker()
+		for _, tag := range tags {
+			if _, err := c.Check(tag.data); err != nil {
+				return errors.Wrapf(err, "check %v", hex.EncodeToString(tag.data))
+			}
+		}
+		if c.fourCC != rtmpFourCCAV1 {
+			return errors.Errorf("invalid fourCC %v", c.fourCC)
+		}
+
+		// The AV1 source loops the bitstream, and the DTS keeps increasing.
+		td := &av1OBU{Header: []byte{av1OBUTypeTemporalDelimiter << 3}}
+		var b []byte
+		for _, obu := range []*av1OBU{td, sequenceHeader, frame, td, frame} {
+			b = obu.Marshal(b)
+		}
+		source, err := newAV1FrameSource(b, false, 25, 1000)
+		if err != nil {
+			return errors.Wrapf(err, "new source")
+		}
+		for i, n := range []int{2, 1, 2} {
+			f, err := source.Next()
+			if err != nil {
+				return errors.Wrapf(err, "next %v", i)
+			}
+			if f.codec != rtmpFrameCodecAV1 || f.dts != uint64(i*40) || len(f.payloads) != n {
+				return errors.Errorf("invalid frame %v, dts=%v, payloads=%v", i, f.dts, len(f.payloads))
+			}
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtmpFrameSourcesLoop(t *testing.T) {
+	if err := func() error {
+		// Publish the sources for a minute, which loops both the video and audio, and the AAC source wraps the EOF.
+		ctx, cancel := context.WithCancel(logger.WithContext(context.Background()))
+		defer cancel()
+
+		timestamps := make(map[flv.TagType]uint32)
+		err := publishFrameSources(ctx, "../avatar.aac", "../avatar.h264", 25, func(tag *rtmpTag) error {
+			if tag.timestamp < timestamps[tag.tagType] {
+				return errors.Errorf("invalid %v timestamp %v < %v", tag.tagType, tag.timestamp, timestamps[tag.tagType])
+			}
+			timestamps[tag.tagType] = tag.timestamp
+
+			if timestamps[flv.TagTypeVideo] > 60000 && timestamps[flv.TagTypeAudio] > 60000 {
+				cancel()
+			}
+			return nil
+		})
+		if err != context.Canceled {
+			return errors.Wrapf(err, "publish timestamps=%v", timestamps)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestRtmpTLS(t *testing.T) {
+	if err := func() error {
+		if !isRTMPURL("rtmps://localhost/live/livestream") || !isFLVURL("https://localhost/live/livestream.flv?token=x") ||
+			isFLVURL("https://localhost/rtc/v1/whep/?app=live&stream=livestream") || isFLVURL("rtmp://localhost/live/livestream.flv") {
+			return errors.New("invalid url type")
+		}
+
+		// The HTTPS-FLV server, with the H.264 sequence header and keyframe.
+		m, err := newRTMPFLVMuxer()
+		if err != nil {
+			return errors.Wrapf(err, "new muxer")
+		}
+		tags, err := m.Mux(&rtmpFrame{codec: rtmpFrameCodecH264, dts: 40, pts: 40, payloads: [][]byte{
+			{0x67, 0x42, 0xc0, 0x1e}, {0x68, 0xce, 0x3c, 0x80}, {0x65, 0x88, 0x84},
+		}})
+		if err != nil {
+			return errors.Wrapf(err, "mux")
+		}
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			muxer, _ := flv.NewMuxer(w)
+			muxer.WriteHeader(true, false)
+			for _, tag := range tags {
+				muxer.WriteTag(tag.tagType, tag.timestamp, tag.data)
+			}
+		}))
+		// Ignore the handshake errors, which is expected for SNI mismatch.
+		server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		server.StartTLS()
+		defer server.Close()
+
+		ca, err := ioutil.TempFile("", "srs-bench-ca-*.pem")
+		if err != nil {
+			return errors.Wrapf(err, "create ca")
+		}
+		defer os.Remove(ca.Name())
+		pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		ca.Close()
+
+		// Verify the server by CA, and the SNI of host is 127.0.0.1 in the certificate.
+		config, err := newTLSConfig(ca.Name(), "", "", "", false)
+		if err != nil {
+			return errors.Wrapf(err, "tls config")
+		}
+
+		players, messages, _, _, _ := gStatRTC.RTMPPlay.Stat()
+		err = startFLVPlay(context.Background(), server.URL+"/live/livestream.flv", config)
+		if errors.Cause(err) != io.EOF {
+			return errors.Errorf("should EOF, err %+v", err)
+		}
+		if players2, messages2, _, _, _ := gStatRTC.RTMPPlay.Stat(); players2 != players+1 || messages2 != messages+2 {
+			return errors.Errorf("invalid players %v->%v, messages %v->%v", players, players2, messages, messages2)
+		}
+		if count, _, _, _, _, _ := gStatRTC.RTMPPlay.handshake.Stat(); count == 0 {
+			return errors.New("no TLS handshake")
+		}
+
+		// The RTMPS only does the TLS handshake.
+		u, err := url.Parse(strings.Replace(server.URL, "https://", "rtmps://", 1))
+		if err != nil {
+			return errors.Wrapf(err, "parse")
+		}
+		conn, handshake, err := dialRTMP(context.Background(), u, config)
+		if err != nil {
+			return errors.Wrapf(err, "dial")
+		}
+		conn.Close()
+		if handshake <= 0 {
+			return errors.Errorf("invalid handshake %v", handshake)
+		}
+
+		// The SNI mismatch with the certificate, unless insecure.
+		if config, err = newTLSConfig(ca.Name(), "", "", "srs.example.net", false); err != nil {
+			return errors.Wrapf(err, "tls config")
+		}
+		if _, _, err := dialRTMP(context.Background(), u, config); err == nil {
+			return errors.New("should fail for SNI mismatch")
+		}
+		if config, err = newTLSConfig("", "", "", "srs.example.net", true); err != nil {
+			return errors.Wrapf(err, "tls config")
+		}
+		if conn, _, err := dialRTMP(context.Background(), u, config); err != nil {
+			return errors.Wrapf(err, "dial insecure")
+		} else {
+			conn.Close()
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestFlvPublishPOST(t *testing.T) {
+	if err := func() error {
+		if !isFLVURL("ws://localhost:8080/live/livestream") || !isFLVURL("http://localhost:8080/live/livestream.flv") {
+			return errors.New("invalid url type")
+		}
+
+		// The server reads the FLV tags in the chunked body of POST.
+		result := make(chan error, 1)
+		var tags []flv.TagType
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result <- func() error {
+				if r.Method != "POST" || r.Header.Get("Content-Type") != "video/x-flv" || r.ContentLength != -1 {
+					return errors.Errorf("invalid request %v %v %v", r.Method, r.Header.Get("Content-Type"), r.ContentLength)
+				}
+
+				demuxer, _ := flv.NewDemuxer(r.Body)
+				if _, _, hasAudio, err := demuxer.ReadHeader(); err != nil || !hasAudio {
+					return errors.Errorf("invalid header, audio=%v, err %v", hasAudio, err)
+				}
+				for {
+					tagType, tagSize, _, err := demuxer.ReadTagHeader()
+					if err == io.EOF {
+						return nil
+					} else if err != nil {
+						return errors.Wrapf(err, "read tag header")
+					}
+					if _, err := demuxer.ReadTag(tagSize); err != nil {
+						return errors.Wrapf(err, "read tag")
+					}
+					tags = append(tags, tagType)
+				}
+			}()
+		}))
+		defer server.Close()
+
+		w, handshake, err := openFLVWriter(context.Background(), server.URL+"/live/livestream.flv", nil)
+		if err != nil {
+			return errors.Wrapf(err, "open")
+		}
+		if handshake != 0 {
+			return errors.Errorf("invalid handshake %v", handshake)
+		}
+
+		var b bytes.Buffer
+		muxer, _ := flv.NewMuxer(&b)
+		muxer.WriteHeader(true, true)
+		muxer.WriteTag(flv.TagTypeAudio, 0, []byte{0xaf, 0x00, 0x12, 0x10})
+		muxer.WriteTag(flv.TagTypeVideo, 0, []byte{0x17, 0x02, 0, 0, 0})
+		if _, err := w.Write(b.Bytes()); err != nil {
+			return errors.Wrapf(err, "write")
+		}
+		w.Close()
+
+		if err := <-result; err != nil {
+			return errors.Wrapf(err, "server")
+		}
+		if len(tags) != 2 || tags[0] != flv.TagTypeAudio || tags[1] != flv.TagTypeVideo {
+			return errors.Errorf("invalid tags %v", tags)
+		}
+		return nil
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
+
+func TestFlvPublishWebSocket(t *testing.T) {
+	if err := func() error {
+		// The server echoes the binary message in two fragments after a ping, then close and expect the pong.
+		result := make(chan error, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result <- func() error {
+				conn, rw, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					return errors.Wrapf(err, "hijack")
+				}
+				defer conn.Close()
+
+				h := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + webSocketGUID))
+				fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+					"Sec-WebSocket-Accept: %v\r\n\r\n", base64.StdEncoding.EncodeToString(h[:]))
+
+				readFrame := func() (byte, []byte, error) {
+					b := make([]byte, 6)
+					if _, err := io.ReadFull(rw, b); err != nil {
+						return 0, nil, err
+					}
+					if b[1]&0x80 == 0 || b[1]&0x7f > 125 {
+						return 0, nil, errors.Errorf("invalid frame %v", hex.EncodeToString(b))
+					}
+					payload := make([]byte, b[1]&0x7f)
+					if _, err := io.ReadFull(rw, payload); err != nil {
+						return 0, nil, err
+					}
+					for i := range payload {
+						payload[i] ^= b[2+i%4]
+					}
+					return b[0], payload, nil
+				}
+
+				opcode, payload, err := readFrame()
+				if err != nil || opcode != 0x82 {
+					return errors.Errorf("invalid message %x, err %v", opcode, err)
+				}
+				conn.Write([]byte{0x89, 2, 'h', 'i'})
+				conn.Write(append([]byte{0x02, 2}, payload[:2]...))
+				conn.Write(append([]byte{0x80, byte(len(payload) - 2)}, payload[2:]...))
+				conn.Write([]byte{0x88, 0})
+
+				if opcode, payload, err := readFrame(); err != nil || opcode != 0x8a || string(payload) != "hi" {
+					return errors.Errorf("invalid pong %x %v, err %v", opcode, string(payload), err)
+				}
+				return nil
+			}()
+		}))
+		defer server.Close()
+
+		u, err := url.Parse(strings.Replace(server.URL, "http://", "ws://", 1) + "/live/livestream.flv")
+		if err != nil {
+			return errors.Wrapf(err, "parse")
+		}
+		ws, _, err := dialWebSocket(context.Background(), u, nil)
+		if err != nil {
+			return errors.Wrapf(err, "dial")
+		}
+		defer ws.Close()
+
+		if _, err := ws.Write([]byte("FLV\x01")); err != nil {
+			return errors.Wrapf(err, "write")
+		}
+		b, err := ioutil.ReadAll(ws)
+		if err != nil {
+			return errors.Wrapf(err, "read")
+		}
+		if string(b) != "FLV\x01" {
+			return errors.Errorf("invalid echo %v", hex.EncodeToString(b))
+		}
+		return <-result
+	}(); err != nil {
+		t.Errorf("err %+v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The flag which can be set multiple times, for example, -sdp-offer a -sdp-offer b.
+type stringsFlag []string
+
+func (v *stringsFlag) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *stringsFlag) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+// The rule to rewrite SDP, in sed style s/pattern/replacement/, the delimiter is the char after s.
+type sdpRewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Parse the rule like s/pattern/replacement/, the pattern is multi-line mode so ^ and $ match each
+// line, and the \r and \n of replacement are unescaped to inject lines.
+func parseSDPRewriteRule(rule string) (*sdpRewriteRule, error) {
+	if len(rule) < 4 || rule[0] != 's' {
+		return nil, errors.Errorf("Invalid rule %v, should be s/pattern/replacement/", rule)
+	}
+
+	delimiter := rule[1:2]
+	parts := strings.Split(rule[2:], delimiter)
+	if len(parts) != 3 || parts[0] == "" || parts[2] != "" {
+		return nil, errors.Errorf("Invalid rule %v, should be s%vpattern%vreplacement%v", rule, delimiter, delimiter, delimiter)
+	}
+
+	pattern, err := regexp.Compile("(?m)" + parts[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "compile %v", parts[0])
+	}
+
+	replacement := strings.NewReplacer(`\r`, "\r", `\n`, "\n").Replace(parts[1])
+	return &sdpRewriteRule{pattern: pattern, replacement: replacement}, nil
+}
+
+// The rewriter of the local offer and remote answer, to add or strip extensions, reorder codecs,
+// or inject malformed lines, to probe the SDP parser of server.
+type sdpRewriter struct {
+	offer  []*sdpRewriteRule
+	answer []*sdpRewriteRule
+}
+
+func newSDPRewriter(offers, answers []string) (*sdpRewriter, error) {
+	v := &sdpRewriter{}
+	for _, rule := range offers {
+		r, err := parseSDPRewriteRule(rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "offer rule")
+		}
+		v.offer = append(v.offer, r)
+	}
+	for _, rule := range answers {
+		r, err := parseSDPRewriteRule(rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "answer rule")
+		}
+		v.answer = append(v.answer, r)
+	}
+	return v, nil
+}
+
+func (v *sdpRewriter) rewrite(sdp string, rules []*sdpRewriteRule) string {
+	for _, rule := range rules {
+		sdp = rule.pattern.ReplaceAllString(sdp, rule.replacement)
+	}
+	return sdp
+}
+
+// Rewrite the offer to send to server, the local description of pion is not changed.
+func (v *sdpRewriter) Offer(offer string) string {
+	if v == nil {
+		return offer
+	}
+	return v.rewrite(offer, v.offer)
+}
+
+// Rewrite the answer from server, before set to pion as the remote description.
+func (v *sdpRewriter) Answer(answer string) string {
+	if v == nil {
+		return answer
+	}
+	return v.rewrite(answer, v.answer)
+}
@@ -0,0 +1,121 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// The RIDs of simulcast layers, at most 3 layers.
+var simulcastRIDs = []string{"a", "b", "c"}
+
+// A simulcast layer, identified by RID, with independent encoding from its own source.
+// The first layer is sent by the video track, while others are packetized here and write
+// to the RTP writer directly, with new SSRC.
+type simulcastLayer struct {
+	rid    string
+	source string
+	ssrc   uint32
+	// The packetizer and writer, only for layers except the first one.
+	packetizer rtp.Packetizer
+	writer     interceptor.RTPWriter
+}
+
+func (v *simulcastLayer) String() string {
+	return fmt.Sprintf("rid=%v, ssrc=%v, source=%v", v.rid, v.ssrc, v.source)
+}
+
+// Packetize the H.264 sample to RTP packets and write out, like TrackLocalStaticSample.
+func (v *simulcastLayer) WriteSample(sample media.Sample) error {
+	samples := uint32(sample.Duration.Seconds() * 90000)
+	for _, p := range v.packetizer.Packetize(sample.Data, samples) {
+		if _, err := v.writer.Write(&p.Header, p.Payload, nil); err != nil {
+			return errors.Wrapf(err, "write rid=%v, ssrc=%v", v.rid, v.ssrc)
+		}
+	}
+	return nil
+}
+
+func (v *simulcastLayer) setup(pt uint8, writer interceptor.RTPWriter) {
+	if v.packetizer == nil {
+		v.packetizer = rtp.NewPacketizer(
+			rtpOutboundMTU, pt, v.ssrc, &codecs.H264Payloader{}, rtp.NewRandomSequencer(), 90000,
+		)
+	}
+	v.writer = writer
+}
+
+// Build the simulcast offer from the offer of pion, which only has one SSRC for video. We
+// add the SSRC of other layers, like Firefox, and the RID of layers, like Chrome.
+// @see https://datatracker.ietf.org/doc/html/rfc8853
+func simulcastOffer(offer string, layers []*simulcastLayer) (string, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return "", errors.Wrapf(err, "unmarshal %v", offer)
+	}
+
+	var video *sdp.MediaDescription
+	for _, md := range desc.MediaDescriptions {
+		if md.MediaName.Media == "video" {
+			video = md
+			break
+		}
+	}
+	if video == nil {
+		return "", errors.New("no video")
+	}
+
+	// Copy the attributes of the SSRC of first layer, like cname and msid.
+	var attrs []sdp.Attribute
+	prefix := fmt.Sprintf("%v ", layers[0].ssrc)
+	for _, attr := range video.Attributes {
+		if attr.Key == "ssrc" && strings.HasPrefix(attr.Value, prefix) {
+			attrs = append(attrs, attr)
+		}
+	}
+	for _, layer := range layers[1:] {
+		for _, attr := range attrs {
+			value := fmt.Sprintf("%v %v", layer.ssrc, strings.TrimPrefix(attr.Value, prefix))
+			video.WithValueAttribute("ssrc", value)
+		}
+	}
+
+	var rids []string
+	for _, layer := range layers {
+		video.WithValueAttribute("rid", fmt.Sprintf("%v send", layer.rid))
+		rids = append(rids, layer.rid)
+	}
+	video.WithValueAttribute("simulcast", fmt.Sprintf("send %v", strings.Join(rids, ";")))
+
+	b, err := desc.Marshal()
+	if err != nil {
+		return "", errors.Wrapf(err, "marshal")
+	}
+	return string(b), nil
+}
@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pion/webrtc/v3"
 	"net"
 	"net/http"
 	"os"
@@ -34,17 +35,43 @@ import (
 	"time"
 )
 
-var sr, dumpAudio, dumpVideo string
-var pli int
+var sr, dumpAudio, dumpVideo, record string
+var pli, nackMax int
+var playNACK bool
 
 var pr, sourceAudio, sourceVideo string
-var fps int
+var fps, simulcast int
+
+var ffmpeg string
+var audioBitrate int
+var audioFrameSize float64
+
+var videoBitrate, videoBitrateFrom, videoRamp, videoWave int
 
 var audioLevel, videoTWCC bool
 
-var clients, streams, delay int
+var whipToken string
+
+var dataChannels, dataChannelSize, dataChannelRate int
+
+var turnServer, turnUsername, turnCredential string
+var forceRelay bool
+
+var dtlsRole, dtlsCert, dtlsKey string
+
+var tlsCA, tlsCert, tlsKey, tlsServerName string
+var tlsInsecure bool
 
-var statListen string
+var sdpOffers, sdpAnswers stringsFlag
+
+var migrate int
+
+var fec, red int
+var latency bool
+
+var clients, streams, delay, videoTracks int
+
+var statListen, statJSON string
 
 func Parse(ctx context.Context) {
 	fl := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
@@ -55,21 +82,56 @@ func Parse(ctx context.Context) {
 	fl.StringVar(&sr, "sr", "", "")
 	fl.StringVar(&dumpAudio, "da", "", "")
 	fl.StringVar(&dumpVideo, "dv", "", "")
+	fl.StringVar(&record, "record", "", "")
 	fl.IntVar(&pli, "pli", 10, "")
+	fl.BoolVar(&playNACK, "nack", true, "")
+	fl.IntVar(&nackMax, "nack-max", 0, "")
 
 	fl.StringVar(&pr, "pr", "", "")
 	fl.StringVar(&sourceAudio, "sa", "", "")
 	fl.StringVar(&sourceVideo, "sv", "", "")
 	fl.IntVar(&fps, "fps", 0, "")
+	fl.IntVar(&simulcast, "simulcast", 0, "")
+	fl.IntVar(&videoBitrate, "vbitrate", 0, "")
+	fl.IntVar(&videoBitrateFrom, "vbitrate-from", 0, "")
+	fl.IntVar(&videoRamp, "vramp", 0, "")
+	fl.IntVar(&videoWave, "vwave", 0, "")
+	fl.StringVar(&ffmpeg, "ffmpeg", "ffmpeg", "")
+	fl.IntVar(&audioBitrate, "abitrate", 48, "")
+	fl.Float64Var(&audioFrameSize, "aframe", 20, "")
 
 	fl.BoolVar(&audioLevel, "al", true, "")
 	fl.BoolVar(&videoTWCC, "twcc", true, "")
+	fl.StringVar(&whipToken, "token", "", "")
+	fl.IntVar(&dataChannels, "dc", 0, "")
+	fl.IntVar(&dataChannelSize, "dcsize", 1024, "")
+	fl.IntVar(&dataChannelRate, "dcrate", 10, "")
+	fl.StringVar(&turnServer, "turn", "", "")
+	fl.StringVar(&turnUsername, "turn-user", "", "")
+	fl.StringVar(&turnCredential, "turn-pass", "", "")
+	fl.BoolVar(&forceRelay, "relay", false, "")
+	fl.StringVar(&dtlsRole, "dtls-role", "actpass", "")
+	fl.StringVar(&dtlsCert, "dtls-cert", "", "")
+	fl.StringVar(&dtlsKey, "dtls-key", "", "")
+	fl.StringVar(&tlsCA, "tls-ca", "", "")
+	fl.StringVar(&tlsCert, "tls-cert", "", "")
+	fl.StringVar(&tlsKey, "tls-key", "", "")
+	fl.StringVar(&tlsServerName, "tls-sni", "", "")
+	fl.BoolVar(&tlsInsecure, "tls-insecure", false, "")
+	fl.Var(&sdpOffers, "sdp-offer", "")
+	fl.Var(&sdpAnswers, "sdp-answer", "")
+	fl.IntVar(&migrate, "migrate", 0, "")
+	fl.IntVar(&fec, "fec", 0, "")
+	fl.IntVar(&red, "red", 0, "")
+	fl.BoolVar(&latency, "latency", false, "")
 
 	fl.IntVar(&clients, "nn", 1, "")
 	fl.IntVar(&streams, "sn", 1, "")
 	fl.IntVar(&delay, "delay", 50, "")
+	fl.IntVar(&videoTracks, "tracks", 1, "")
 
 	fl.StringVar(&statListen, "stat", "", "")
+	fl.StringVar(&statJSON, "stat-json", "", "")
 
 	fl.Usage = func() {
 		fmt.Println(fmt.Sprintf("Usage: %v [Options]", os.Args[0]))
@@ -78,19 +140,56 @@ func Parse(ctx context.Context) {
 		fmt.Println(fmt.Sprintf("   -nn     The number of clients to simulate. Default: 1"))
 		fmt.Println(fmt.Sprintf("   -sn     The number of streams to simulate. Variable: %%d. Default: 1"))
 		fmt.Println(fmt.Sprintf("   -delay  The start delay in ms for each client or stream to simulate. Default: 50"))
+		fmt.Println(fmt.Sprintf("   -tracks [Optional] The number of video tracks in each PC, publisher sends and player receives, all in one bundle. Default: 1"))
 		fmt.Println(fmt.Sprintf("   -al     [Optional] Whether enable audio-level. Default: true"))
-		fmt.Println(fmt.Sprintf("   -twcc   [Optional] Whether enable vdieo-twcc. Default: true"))
+		fmt.Println(fmt.Sprintf("   -twcc   [Optional] Whether enable video-twcc, and player sends TWCC feedback. Default: true"))
 		fmt.Println(fmt.Sprintf("   -stat   [Optional] The stat server API listen port."))
+		fmt.Println(fmt.Sprintf("   -stat-json [Optional] The file to write the stat of each PC in JSON, like RTT, jitter, lost, NACK, PLI and bitrate."))
+		fmt.Println(fmt.Sprintf("   -token  [Optional] The Bearer token for WHIP/WHEP url, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -dc     [Optional] The number of DataChannels for each client, publisher sends and player receives. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -dcsize [Optional] The size in bytes of DataChannel message, at least 16. Default: 1024"))
+		fmt.Println(fmt.Sprintf("   -dcrate [Optional] The messages per second of each DataChannel. Default: 10"))
+		fmt.Println(fmt.Sprintf("   -turn   [Optional] The TURN server url, like turn:host:3478?transport=udp, separated by comma, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -turn-user [Optional] The username of TURN server."))
+		fmt.Println(fmt.Sprintf("   -turn-pass [Optional] The credential of TURN server."))
+		fmt.Println(fmt.Sprintf("   -relay  [Optional] Whether only use the relay candidates of TURN server. Default: false"))
+		fmt.Println(fmt.Sprintf("   -dtls-role [Optional] The DTLS role of offer, actpass, active(DTLS client) or passive(DTLS server). Default: actpass"))
+		fmt.Println(fmt.Sprintf("   -dtls-cert [Optional] The fixed DTLS certificate in PEM, generate one for each PC if empty."))
+		fmt.Println(fmt.Sprintf("   -dtls-key [Optional] The private key in PEM of DTLS certificate, RSA or ECDSA."))
+		fmt.Println(fmt.Sprintf("   -tls-ca [Optional] The CA certificates in PEM to verify the server of RTMPS, HTTPS-FLV or WSS, use system CA if empty."))
+		fmt.Println(fmt.Sprintf("   -tls-insecure [Optional] Whether skip verifying the certificate of RTMPS, HTTPS-FLV or WSS server. Default: false"))
+		fmt.Println(fmt.Sprintf("   -tls-sni [Optional] The server name for SNI and verifying the certificate, use the host of url if empty."))
+		fmt.Println(fmt.Sprintf("   -tls-cert [Optional] The client certificate in PEM of RTMPS, HTTPS-FLV or WSS, for mutual TLS."))
+		fmt.Println(fmt.Sprintf("   -tls-key [Optional] The private key in PEM of TLS client certificate."))
+		fmt.Println(fmt.Sprintf("   -sdp-offer [Optional] The rule to rewrite the offer to server, like s/pattern/replacement/ or s|pattern|replacement|, the pattern is multi-line regexp, and \\r\\n in replacement is CRLF. Repeatable."))
+		fmt.Println(fmt.Sprintf("   -sdp-answer [Optional] The rule to rewrite the answer from server, like -sdp-offer. Repeatable."))
+		fmt.Println(fmt.Sprintf("   -migrate [Optional] The interval in seconds to switch the client address, to simulate network change. Default: 0(disabled)"))
+		fmt.Println(fmt.Sprintf("   -fec    [Optional] Enable ULPFEC in RED for video, publisher protects every N packets(1~16) by a FEC packet, player recovers lost packets. Default: 0(disabled)"))
+		fmt.Println(fmt.Sprintf("   -red    [Optional] Enable RED for opus, publisher sends N(1~%v) previous packets in each packet, player recovers lost packets. Default: 0(disabled)", redMaxDistance))
+		fmt.Println(fmt.Sprintf("   -latency [Optional] Whether publisher embeds the wall-clock time in H.264 SEI, and player reports the end-to-end latency percentiles. The clocks should be synchronized. Default: false"))
 		fmt.Println(fmt.Sprintf("Player or Subscriber:"))
-		fmt.Println(fmt.Sprintf("   -sr     The url to play/subscribe. If sn exceed 1, auto append variable %%d."))
+		fmt.Println(fmt.Sprintf("   -sr     The url to play/subscribe, webrtc:// or http(s):// for WHEP, rtmp(s):// for RTMP, http(s)://*.flv for HTTP-FLV, ws(s):// for WebSocket-FLV, http(s)://*.m3u8 for HLS and LL-HLS, or http(s)://*.mpd for DASH. If sn exceed 1, auto append variable %%d."))
 		fmt.Println(fmt.Sprintf("   -da     [Optional] The file path to dump audio, ignore if empty."))
-		fmt.Println(fmt.Sprintf("   -dv     [Optional] The file path to dump video, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -dv     [Optional] The file path to dump video, .h264, .h265, .ivf(VP8 or AV1) or .obu(AV1), ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -record [Optional] The file path to record H.264 and opus, .mkv or .mp4, ignore if empty. If sn exceed 1, auto append _%%d before the extension."))
 		fmt.Println(fmt.Sprintf("   -pli    [Optional] PLI request interval in seconds. Default: 10"))
+		fmt.Println(fmt.Sprintf("   -nack   [Optional] Whether request retransmission by NACK. Default: true"))
+		fmt.Println(fmt.Sprintf("   -nack-max [Optional] The max NACK requests for each lost packet, no limit if 0. Default: 0"))
 		fmt.Println(fmt.Sprintf("Publisher:"))
-		fmt.Println(fmt.Sprintf("   -pr     The url to publish. If sn exceed 1, auto append variable %%d."))
-		fmt.Println(fmt.Sprintf("   -fps    [Optional] The fps of .h264 source file."))
-		fmt.Println(fmt.Sprintf("   -sa     [Optional] The file path to read audio, ignore if empty."))
-		fmt.Println(fmt.Sprintf("   -sv     [Optional] The file path to read video, ignore if empty."))
+		fmt.Println(fmt.Sprintf("   -pr     The url to publish, webrtc:// or http(s):// for WHIP, rtmp(s):// for RTMP, http(s)://*.flv for HTTP-FLV POST, or ws(s):// for WebSocket-FLV. If sn exceed 1, auto append variable %%d."))
+		fmt.Println(fmt.Sprintf("   -fps    [Optional] The fps of video source file."))
+		fmt.Println(fmt.Sprintf("   -sa     [Optional] The file path to read audio, ignore if empty. Transcode by FFmpeg if not .ogg or .opus, like .aac, .wav or .pcm(s16le 48KHz stereo)."))
+		fmt.Println(fmt.Sprintf("   -ffmpeg [Optional] The FFmpeg binary to transcode audio. Default: ffmpeg"))
+		fmt.Println(fmt.Sprintf("   -abitrate [Optional] The bitrate in kbps of transcoded opus. Default: 48"))
+		fmt.Println(fmt.Sprintf("   -aframe [Optional] The frame size in ms of transcoded opus, 2.5, 5, 10, 20, 40 or 60. Default: 20"))
+		fmt.Println(fmt.Sprintf("   -sv     [Optional] The file path to read video, .h264, .h265, .ivf(AV1) or .obu(AV1), ignore if empty. Separated by comma for simulcast layers."))
+		fmt.Println(fmt.Sprintf("   -simulcast [Optional] The number of simulcast layers with rid a/b/c, 2 or 3, 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -vbitrate [Optional] The target or cap of H.264 video bitrate in kbps, by dropping frames except keyframes, 0 to disable. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -vbitrate-from [Optional] The start bitrate in kbps, to ramp to or oscillate with -vbitrate. Default: 0(same as -vbitrate)"))
+		fmt.Println(fmt.Sprintf("   -vramp  [Optional] The seconds to ramp linearly from -vbitrate-from to -vbitrate, then hold. Default: 0"))
+		fmt.Println(fmt.Sprintf("   -vwave  [Optional] The period in seconds to oscillate between -vbitrate-from and -vbitrate. Default: 0"))
+		fmt.Println(fmt.Sprintf("   For RTMP or FLV, the -sv is .h264, .h265, .ivf, .obu, .flv, .mp4 or .ts, and the -sa is .aac, ignore the -sa of .flv."))
+		fmt.Println(fmt.Sprintf("   For RTMP or FLV, the H.265 and AV1 are published in enhanced RTMP, with fourCC hvc1 and av01."))
 		fmt.Println(fmt.Sprintf("\n例如，1个播放，1个推流:"))
 		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream", os.Args[0]))
 		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.h264 -fps 25", os.Args[0]))
@@ -104,6 +203,73 @@ func Parse(ctx context.Context) {
 		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream_%%d -sn 2 -sa avatar.ogg -sv avatar.h264 -fps 25", os.Args[0]))
 		fmt.Println(fmt.Sprintf("\n例如，1个录制："))
 		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -da avatar.ogg -dv avatar.h264", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，2个流，每个流录制为一个MP4文件："))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream_%%d -sn 2 -record livestream_%%d.mp4", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个H.265推流，1个H.265录制："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.h265 -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -dv avatar.h265", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个播放，强制通过TURN中继："))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -turn turn:turn.example.com:3478 -turn-user user -turn-pass pass -relay", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个播放，强制作为DTLS服务器，使用固定的证书："))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -dtls-role passive -dtls-cert server.crt -dtls-key server.key", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个推流，每10秒切换一次客户端地址，模拟网络切换："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.h264 -fps 25 -migrate 10", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个播放，每个丢包最多请求3次重传，统计修复和未修复的丢包："))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -nack-max 3 -stat-json stat.json", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个推流，每4个包一个FEC包，1个播放通过FEC恢复丢包："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.h264 -fps 25 -fec 4", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -fec 1 -stat-json stat.json", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个推流，音频冗余2个包，1个播放通过冗余恢复丢包："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.h264 -fps 25 -red 2", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -red 1 -stat-json stat.json", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个推流，3个播放，通过SEI中的时间戳统计端到端延迟："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.h264 -fps 25 -latency", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -nn 3 -latency -stat-json stat.json", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个推流和1个播放，每个PC有4个视频轨道，对比每个流一个PC的资源消耗："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.h264 -fps 25 -tracks 4", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -tracks 4", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个流，3个播放，每个客户端的统计写入JSON文件："))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -nn 3 -stat-json stat.json", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个推流，3个播放，每个客户端2个DataChannel，每秒100个1KB消息："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -dc 2 -dcsize 1024 -dcrate 100", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -nn 3 -dc 2", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个推流，音频从AAC转码为Opus："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.aac -abitrate 32 -aframe 10 -sv avatar.h264 -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个AV1推流，1个AV1录制："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.ivf -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -dv avatar.obu", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个推流，视频码率在30秒内从100kbps爬升到800kbps，或每20秒在两者之间波动："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.h264 -fps 25 -vbitrate 800 -vbitrate-from 100 -vramp 30", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sa avatar.ogg -sv avatar.h264 -fps 25 -vbitrate 800 -vbitrate-from 100 -vwave 20", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，10个RTMP推流，从H.264和AAC文件，或者FLV或MP4文件："))
+		fmt.Println(fmt.Sprintf("   %v -pr rtmp://localhost/live/livestream_%%d -sn 10 -sa avatar.aac -sv avatar.h264 -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -pr rtmp://localhost/live/livestream_%%d -sn 10 -sv avatar.flv", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个增强RTMP推流，H.265或AV1："))
+		fmt.Println(fmt.Sprintf("   %v -pr rtmp://localhost/live/livestream -sa avatar.aac -sv avatar.h265 -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -pr rtmp://localhost/live/livestream -sa avatar.aac -sv avatar.ivf -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，3个RTMP播放，检查时间戳单调递增，统计首帧时间："))
+		fmt.Println(fmt.Sprintf("   %v -sr rtmp://localhost/live/livestream -nn 3", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，RTMPS推流和HTTPS-FLV播放，使用自签名证书，统计TLS握手时间："))
+		fmt.Println(fmt.Sprintf("   %v -pr rtmps://localhost/live/livestream -sa avatar.aac -sv avatar.h264 -fps 25 -tls-ca ca.crt", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sr https://localhost/live/livestream.flv -nn 3 -tls-insecure", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，HTTP-FLV POST推流，或WebSocket-FLV推流和播放："))
+		fmt.Println(fmt.Sprintf("   %v -pr http://localhost:8080/live/livestream.flv -sv avatar.flv", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -pr ws://localhost:8080/live/livestream.flv -sa avatar.aac -sv avatar.h264 -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("   %v -sr ws://localhost:8080/live/livestream.flv -nn 3", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1000个HLS播放，检查播放列表合规，统计过期播放列表和404切片："))
+		fmt.Println(fmt.Sprintf("   %v -sr http://localhost:8080/live/livestream.m3u8 -nn 1000 -delay 10", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，100个LL-HLS播放，阻塞刷新播放列表并拉取分片和预加载提示，统计端到端延迟："))
+		fmt.Println(fmt.Sprintf("   %v -sr http://localhost:8080/live/livestream.m3u8 -nn 100", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1000个DASH播放，跟随直播边缘拉取切片，检查切片连续性："))
+		fmt.Println(fmt.Sprintf("   %v -sr http://localhost:8080/live/livestream.mpd -nn 1000 -delay 10", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个3层Simulcast推流："))
+		fmt.Println(fmt.Sprintf("   %v -pr webrtc://localhost/live/livestream -sv avatar.h264,avatar_360p.h264,avatar_180p.h264 -simulcast 3 -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个WHIP推流："))
+		fmt.Println(fmt.Sprintf("   %v -pr \"http://localhost:1985/rtc/v1/whip/?app=live&stream=livestream\" -token xxx -sa avatar.ogg -sv avatar.h264 -fps 25", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个WHEP播放："))
+		fmt.Println(fmt.Sprintf("   %v -sr \"http://localhost:1985/rtc/v1/whep/?app=live&stream=livestream\" -token xxx", os.Args[0]))
+		fmt.Println(fmt.Sprintf("\n例如，1个播放，删除offer中的TWCC扩展，在answer中注入错误的行："))
+		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream -sdp-offer 's/^a=extmap:.*transport-wide-cc.*\\r\\n//' -sdp-answer 's/^a=mid:1\\r\\n/${0}a=bad-line\\r\\n/'", os.Args[0]))
 		fmt.Println(fmt.Sprintf("\n例如，1个明文播放："))
 		fmt.Println(fmt.Sprintf("   %v -sr webrtc://localhost/live/livestream?encrypt=false", os.Args[0]))
 		fmt.Println()
@@ -114,7 +280,7 @@ func Parse(ctx context.Context) {
 	if sr == "" && pr == "" {
 		showHelp = true
 	}
-	if pr != "" && (sourceAudio == "" && sourceVideo == "") {
+	if pr != "" && (sourceAudio == "" && sourceVideo == "" && dataChannels <= 0) {
 		showHelp = true
 	}
 	if showHelp {
@@ -127,25 +293,185 @@ func Parse(ctx context.Context) {
 	}
 
 	summaryDesc := fmt.Sprintf("clients=%v, delay=%v, al=%v, twcc=%v, stat=%v", clients, delay, audioLevel, videoTWCC, statListen)
+	if statJSON != "" {
+		summaryDesc = fmt.Sprintf("%v, stat-json=%v", summaryDesc, statJSON)
+	}
+	if fec > 0 {
+		summaryDesc = fmt.Sprintf("%v, fec=%v", summaryDesc, fec)
+	}
+	if red > 0 {
+		summaryDesc = fmt.Sprintf("%v, red=%v", summaryDesc, red)
+	}
+	if latency {
+		summaryDesc = fmt.Sprintf("%v, latency=%v", summaryDesc, latency)
+	}
+	if videoTracks > 1 {
+		summaryDesc = fmt.Sprintf("%v, tracks=%v", summaryDesc, videoTracks)
+	}
+	if turnServer != "" {
+		summaryDesc = fmt.Sprintf("%v, turn=%v, relay=%v", summaryDesc, turnServer, forceRelay)
+	}
+	if len(sdpOffers) > 0 || len(sdpAnswers) > 0 {
+		summaryDesc = fmt.Sprintf("%v, sdp(offer=%v, answer=%v)", summaryDesc, len(sdpOffers), len(sdpAnswers))
+	}
+	if dtlsRole != dtlsRoleActpass || dtlsCert != "" {
+		summaryDesc = fmt.Sprintf("%v, dtls(role=%v, cert=%v, key=%v)", summaryDesc, dtlsRole, dtlsCert, dtlsKey)
+	}
+	if tlsCA != "" || tlsCert != "" || tlsServerName != "" || tlsInsecure {
+		summaryDesc = fmt.Sprintf("%v, tls(ca=%v, sni=%v, insecure=%v, cert=%v, key=%v)",
+			summaryDesc, tlsCA, tlsServerName, tlsInsecure, tlsCert, tlsKey)
+	}
+	if migrate > 0 {
+		summaryDesc = fmt.Sprintf("%v, migrate=%vs", summaryDesc, migrate)
+	}
+	if dataChannels > 0 {
+		summaryDesc = fmt.Sprintf("%v, dc=%v, dcsize=%v, dcrate=%v", summaryDesc, dataChannels, dataChannelSize, dataChannelRate)
+	}
+	if whipToken != "" {
+		summaryDesc = fmt.Sprintf("%v, token=%v bytes", summaryDesc, len(whipToken))
+	}
 	if sr != "" {
-		summaryDesc = fmt.Sprintf("%v, play(url=%v, da=%v, dv=%v, pli=%v)", summaryDesc, sr, dumpAudio, dumpVideo, pli)
+		summaryDesc = fmt.Sprintf("%v, play(url=%v, da=%v, dv=%v, record=%v, pli=%v, nack=%v, nack-max=%v)",
+			summaryDesc, sr, dumpAudio, dumpVideo, record, pli, playNACK, nackMax)
 	}
 	if pr != "" {
-		summaryDesc = fmt.Sprintf("%v, publish(url=%v, sa=%v, sv=%v, fps=%v)",
-			summaryDesc, pr, sourceAudio, sourceVideo, fps)
+		summaryDesc = fmt.Sprintf("%v, publish(url=%v, sa=%v, sv=%v, fps=%v, simulcast=%v)",
+			summaryDesc, pr, sourceAudio, sourceVideo, fps, simulcast)
+		if sourceAudio != "" && !isOpusSource(sourceAudio) {
+			summaryDesc = fmt.Sprintf("%v, transcode(ffmpeg=%v, abitrate=%v, aframe=%v)",
+				summaryDesc, ffmpeg, audioBitrate, audioFrameSize)
+		}
+		if videoBitrate > 0 {
+			summaryDesc = fmt.Sprintf("%v, vbitrate(to=%v, from=%v, ramp=%v, wave=%v)",
+				summaryDesc, videoBitrate, videoBitrateFrom, videoRamp, videoWave)
+		}
 	}
 	logger.Tf(ctx, "Run benchmark with %v", summaryDesc)
 
 	checkFlags := func() error {
-		if dumpVideo != "" && !strings.HasSuffix(dumpVideo, ".h264") && !strings.HasSuffix(dumpVideo, ".ivf") {
-			return errors.Errorf("Should be .ivf or .264, actual %v", dumpVideo)
+		if dumpVideo != "" && !strings.HasSuffix(dumpVideo, ".h264") && !strings.HasSuffix(dumpVideo, ".h265") &&
+			!strings.HasSuffix(dumpVideo, ".ivf") && !strings.HasSuffix(dumpVideo, ".obu") {
+			return errors.Errorf("Should be .ivf, .obu, .264 or .h265, actual %v", dumpVideo)
+		}
+
+		if record != "" && !strings.HasSuffix(record, ".mkv") && !strings.HasSuffix(record, ".mp4") {
+			return errors.Errorf("Should be .mkv or .mp4, actual %v", record)
+		}
+
+		if (isRTMPURL(sr) || isFLVURL(sr) || isHLSURL(sr) || isDASHURL(sr)) && (dumpAudio != "" || dumpVideo != "" || record != "" || latency || dataChannels > 0 || videoTracks > 1) {
+			return errors.Errorf("RTMP, FLV, HLS or DASH play not support da, dv, record, latency, dc or tracks")
+		}
+
+		if isRTMPURL(pr) || isFLVURL(pr) {
+			if sourceVideo != "" && !strings.HasSuffix(sourceVideo, ".h264") && !strings.HasSuffix(sourceVideo, ".h265") &&
+				!strings.HasSuffix(sourceVideo, ".ivf") && !strings.HasSuffix(sourceVideo, ".obu") &&
+				!strings.HasSuffix(sourceVideo, ".flv") && !isContainerSource(sourceVideo) {
+				return errors.Errorf("RTMP or FLV video should be .h264, .h265, .ivf, .obu, .flv, .mp4 or .ts, actual %v", sourceVideo)
+			}
+			if sourceAudio != "" && (!strings.HasSuffix(sourceAudio, ".aac") || strings.HasSuffix(sourceVideo, ".flv")) {
+				return errors.Errorf("RTMP or FLV audio should be .aac without .flv video, actual %v", sourceAudio)
+			}
+			if simulcast > 1 || videoBitrate > 0 || videoTracks > 1 || fec > 0 || red > 0 || dataChannels > 0 {
+				return errors.Errorf("RTMP or FLV not support simulcast, vbitrate, tracks, fec, red or dc")
+			}
+		} else if sourceVideo != "" {
+			for _, source := range strings.Split(sourceVideo, ",") {
+				if !strings.HasSuffix(source, ".h264") && !strings.HasSuffix(source, ".h265") &&
+					!strings.HasSuffix(source, ".ivf") && !strings.HasSuffix(source, ".obu") {
+					return errors.Errorf("Should be .264, .h265, .ivf or .obu, actual %v", source)
+				}
+			}
 		}
 
-		if sourceVideo != "" && !strings.HasSuffix(sourceVideo, ".h264") {
-			return errors.Errorf("Should be .264, actual %v", sourceVideo)
+		if sourceAudio != "" && !isOpusSource(sourceAudio) && !isRTMPURL(pr) && !isFLVURL(pr) {
+			if audioBitrate <= 0 {
+				return errors.Errorf("Audio bitrate should >0, actual %v", audioBitrate)
+			}
+
+			valid := false
+			for _, v := range []float64{2.5, 5, 10, 20, 40, 60} {
+				valid = valid || v == audioFrameSize
+			}
+			if !valid {
+				return errors.Errorf("Audio frame should be 2.5, 5, 10, 20, 40 or 60, actual %v", audioFrameSize)
+			}
 		}
 
-		if sourceVideo != "" && strings.HasSuffix(sourceVideo, ".h264") && fps <= 0 {
+		if dataChannels > 0 && (dataChannelSize < dataChannelMessageHeader || dataChannelRate <= 0) {
+			return errors.Errorf("DataChannel size should >=%v and rate >0, actual size=%v, rate=%v",
+				dataChannelMessageHeader, dataChannelSize, dataChannelRate)
+		}
+
+		if dtlsRole != dtlsRoleActpass && dtlsRole != dtlsRoleActive && dtlsRole != dtlsRolePassive {
+			return errors.Errorf("DTLS role should be actpass, active or passive, actual %v", dtlsRole)
+		}
+		if (dtlsCert == "") != (dtlsKey == "") {
+			return errors.Errorf("DTLS cert and key should be both set, cert=%v, key=%v", dtlsCert, dtlsKey)
+		}
+		if (tlsCert == "") != (tlsKey == "") {
+			return errors.Errorf("TLS cert and key should be both set, cert=%v, key=%v", tlsCert, tlsKey)
+		}
+		if _, err := newTLSConfig(tlsCA, tlsCert, tlsKey, tlsServerName, tlsInsecure); err != nil {
+			return errors.Wrapf(err, "TLS config")
+		}
+		if _, err := newSDPRewriter(sdpOffers, sdpAnswers); err != nil {
+			return errors.Wrapf(err, "SDP rewrite")
+		}
+		if nackMax < 0 {
+			return errors.Errorf("NACK max should >=0, actual %v", nackMax)
+		}
+		if fec < 0 || fec > fecMaxGroup {
+			return errors.Errorf("FEC should be 0~%v, actual %v", fecMaxGroup, fec)
+		}
+		if red < 0 || red > redMaxDistance {
+			return errors.Errorf("RED should be 0~%v, actual %v", redMaxDistance, red)
+		}
+		if migrate < 0 {
+			return errors.Errorf("Migrate interval should >=0, actual %v", migrate)
+		}
+		if migrate > 0 && turnServer != "" {
+			return errors.Errorf("Migrate does not support TURN server %v", turnServer)
+		}
+		if forceRelay && turnServer == "" {
+			return errors.Errorf("Relay requires TURN server")
+		}
+		if turnServer != "" {
+			for _, turn := range strings.Split(turnServer, ",") {
+				if !strings.HasPrefix(turn, "turn:") && !strings.HasPrefix(turn, "turns:") {
+					return errors.Errorf("Should be turn: or turns:, actual %v", turn)
+				}
+			}
+		}
+
+		if simulcast < 0 || simulcast > 3 {
+			return errors.Errorf("Simulcast should be 0, 2 or 3, actual %v", simulcast)
+		}
+		if simulcast > 1 && (sourceVideo == "" || videoCodecOfSource(sourceVideo) != nil) {
+			return errors.Errorf("Simulcast requires H.264 video, actual %v", sourceVideo)
+		}
+
+		if videoBitrate < 0 || videoBitrateFrom < 0 || videoRamp < 0 || videoWave < 0 {
+			return errors.Errorf("Video bitrate should >=0, actual vbitrate=%v, from=%v, ramp=%v, wave=%v",
+				videoBitrate, videoBitrateFrom, videoRamp, videoWave)
+		}
+		if videoBitrate == 0 && (videoBitrateFrom > 0 || videoRamp > 0 || videoWave > 0) {
+			return errors.Errorf("Video bitrate control requires -vbitrate")
+		}
+		if videoRamp > 0 && videoWave > 0 {
+			return errors.Errorf("Video ramp %v conflicts with wave %v", videoRamp, videoWave)
+		}
+		if videoBitrate > 0 && (simulcast > 1 || sourceVideo == "" || videoCodecOfSource(sourceVideo) != nil) {
+			return errors.Errorf("Video bitrate requires H.264 video without simulcast, actual %v", sourceVideo)
+		}
+
+		if videoTracks < 1 || videoTracks > 16 {
+			return errors.Errorf("Video tracks should be 1~16, actual %v", videoTracks)
+		}
+		if videoTracks > 1 && simulcast > 1 {
+			return errors.Errorf("Video tracks %v conflicts with simulcast %v", videoTracks, simulcast)
+		}
+
+		if sourceVideo != "" && fps <= 0 && !strings.HasSuffix(sourceVideo, ".flv") && !isContainerSource(sourceVideo) {
 			return errors.Errorf("Video fps should >0, actual %v", fps)
 		}
 		return nil
@@ -159,9 +485,161 @@ func Parse(ctx context.Context) {
 func Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 
+	// For TURN server, all PCs use the same configuration.
+	configuration := newRTCConfiguration(turnServer, turnUsername, turnCredential, forceRelay)
+
+	// Use the fixed DTLS certificate for all PCs, to keep the same fingerprint.
+	if dtlsCert != "" {
+		certificate, err := loadRTCCertificate(dtlsCert, dtlsKey)
+		if err != nil {
+			cancel()
+			return errors.Wrapf(err, "load DTLS certificate")
+		}
+		configuration.Certificates = []webrtc.Certificate{*certificate}
+	}
+
+	// Use the same TLS config for all RTMPS, HTTPS-FLV and WSS clients.
+	tlsConfig, err := newTLSConfig(tlsCA, tlsCert, tlsKey, tlsServerName, tlsInsecure)
+	if err != nil {
+		cancel()
+		return errors.Wrapf(err, "TLS config")
+	}
+
+	// Rewrite the offer and answer of all PCs, to probe the SDP parser of server.
+	sdpRewrite, err := newSDPRewriter(sdpOffers, sdpAnswers)
+	if err != nil {
+		cancel()
+		return errors.Wrapf(err, "SDP rewriter")
+	}
+
 	// Run tasks.
 	var wg sync.WaitGroup
 
+	// Report the stat of peer connections, and write to JSON file when required.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				logger.Tf(ctx, "RTC %v", gStatRTC.PeerConnections.Sample(time.Now()))
+			}
+
+			if statJSON != "" {
+				if err := writeStatJSON(statJSON); err != nil {
+					logger.Wf(ctx, "write stat to %v err %+v", statJSON, err)
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	// Report the DataChannel messages.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if dataChannels <= 0 {
+			return
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+				logger.Tf(ctx, "DataChannel %v", &gStatRTC.DataChannels)
+			}
+		}
+	}()
+
+	// Report the RTMP publishers and players.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if !isRTMPURL(pr) && !isFLVURL(pr) && !isRTMPURL(sr) && !isFLVURL(sr) {
+			return
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+
+			if isRTMPURL(pr) || isFLVURL(pr) {
+				logger.Tf(ctx, "RTMP %v", &gStatRTC.RTMP)
+			}
+			if isRTMPURL(sr) || isFLVURL(sr) {
+				logger.Tf(ctx, "RTMP play %v", &gStatRTC.RTMPPlay)
+			}
+		}
+	}()
+
+	// Report the HLS players.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if !isHLSURL(sr) {
+			return
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+				logger.Tf(ctx, "HLS %v", &gStatRTC.HLS)
+			}
+		}
+	}()
+
+	// Report the DASH players.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if !isDASHURL(sr) {
+			return
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+				logger.Tf(ctx, "DASH %v", &gStatRTC.DASH)
+			}
+		}
+	}()
+
+	// Report the end-to-end latency of all streams.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if !latency || sr == "" {
+			return
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+				logger.Tf(ctx, "Latency %v", &gStatRTC.Latency)
+			}
+		}
+	}()
+
 	// Run STAT API server.
 	wg.Add(1)
 	go func() {
@@ -204,6 +682,23 @@ func Run(ctx context.Context) error {
 		}
 	}()
 
+	// The options of players and publishers, the dumpers and recorder are set for each player.
+	playOpts := playOptions{
+		enableAudioLevel: audioLevel, enableTWCC: videoTWCC, pli: pli, videoTracks: videoTracks,
+		enableNACK: playNACK, nackMax: nackMax, fec: fec, red: red, latency: latency, token: whipToken,
+		dataChannels: dataChannels, dtlsRole: dtlsRole, sdpRewrite: sdpRewrite, migrate: migrate,
+		configuration: configuration,
+	}
+	publishOpts := publishOptions{
+		sourceAudio: sourceAudio, sourceVideo: sourceVideo, fps: fps, enableAudioLevel: audioLevel,
+		enableTWCC: videoTWCC, simulcast: simulcast, videoTracks: videoTracks, token: whipToken, ffmpeg: ffmpeg,
+		audioBitrate: audioBitrate, audioFrameSize: audioFrameSize, videoBitrate: videoBitrate,
+		videoBitrateFrom: videoBitrateFrom, videoRamp: videoRamp, videoWave: videoWave, fec: fec, red: red,
+		latency: latency, dataChannels: dataChannels, dataChannelSize: dataChannelSize,
+		dataChannelRate: dataChannelRate, dtlsRole: dtlsRole, sdpRewrite: sdpRewrite, migrate: migrate,
+		configuration: configuration,
+	}
+
 	// Run all subscribers or players.
 	for i := 0; sr != "" && i < streams && ctx.Err() == nil; i++ {
 		r_auto := sr
@@ -223,22 +718,66 @@ func Run(ctx context.Context) error {
 				da, dv = "", ""
 			}
 
+			// Record each stream by the first client.
+			var rf string
+			if j == 0 && record != "" {
+				rf = recordFilename(record, i, streams)
+			}
+
 			gStatRTC.Subscribers.Expect++
 			gStatRTC.Subscribers.Alive++
 
 			wg.Add(1)
-			go func(sr, da, dv string) {
+			go func(sr, da, dv, rf string) {
 				defer wg.Done()
 				defer func() {
 					gStatRTC.Subscribers.Alive--
 				}()
 
-				if err := startPlay(ctx, sr, da, dv, audioLevel, videoTWCC, pli); err != nil {
+				if isRTMPURL(sr) {
+					if err := startRTMPPlay(ctx, sr, tlsConfig); err != nil {
+						if errors.Cause(err) != context.Canceled {
+							logger.Wf(ctx, "Run err %+v", err)
+						}
+					}
+					return
+				}
+
+				if isFLVURL(sr) {
+					if err := startFLVPlay(ctx, sr, tlsConfig); err != nil {
+						if errors.Cause(err) != context.Canceled {
+							logger.Wf(ctx, "Run err %+v", err)
+						}
+					}
+					return
+				}
+
+				if isHLSURL(sr) {
+					if err := startHLSPlay(ctx, sr, tlsConfig); err != nil {
+						if errors.Cause(err) != context.Canceled {
+							logger.Wf(ctx, "Run err %+v", err)
+						}
+					}
+					return
+				}
+
+				if isDASHURL(sr) {
+					if err := startDASHPlay(ctx, sr, tlsConfig); err != nil {
+						if errors.Cause(err) != context.Canceled {
+							logger.Wf(ctx, "Run err %+v", err)
+						}
+					}
+					return
+				}
+
+				opts := playOpts
+				opts.dumpAudio, opts.dumpVideo, opts.record = da, dv, rf
+				if err := startPlay(ctx, sr, opts); err != nil {
 					if errors.Cause(err) != context.Canceled {
 						logger.Wf(ctx, "Run err %+v", err)
 					}
 				}
-			}(r2, da, dv)
+			}(r2, da, dv, rf)
 
 			time.Sleep(time.Duration(delay) * time.Millisecond)
 		}
@@ -266,7 +805,25 @@ func Run(ctx context.Context) error {
 				gStatRTC.Publishers.Alive--
 			}()
 
-			if err := startPublish(ctx, pr, sourceAudio, sourceVideo, fps, audioLevel, videoTWCC); err != nil {
+			if isRTMPURL(pr) {
+				if err := startRTMPPublish(ctx, pr, sourceAudio, sourceVideo, fps, tlsConfig); err != nil {
+					if errors.Cause(err) != context.Canceled {
+						logger.Wf(ctx, "Run err %+v", err)
+					}
+				}
+				return
+			}
+
+			if isFLVURL(pr) {
+				if err := startFLVPublish(ctx, pr, sourceAudio, sourceVideo, fps, tlsConfig); err != nil {
+					if errors.Cause(err) != context.Canceled {
+						logger.Wf(ctx, "Run err %+v", err)
+					}
+				}
+				return
+			}
+
+			if err := startPublish(ctx, pr, publishOpts); err != nil {
 				if errors.Cause(err) != context.Canceled {
 					logger.Wf(ctx, "Run err %+v", err)
 				}
@@ -23,10 +23,16 @@ package srs
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pion/rtcp"
 )
 
 type statRTC struct {
@@ -38,11 +44,857 @@ type statRTC struct {
 		Expect int `json:"expect"`
 		Alive  int `json:"alive"`
 	} `json:"subscribers"`
-	PeerConnection interface{} `json:"random-pc"`
+	PeerConnection  interface{}         `json:"random-pc"`
+	DataChannels    statDataChannel     `json:"datachannels"`
+	Latency         statLatency         `json:"latency"`
+	RTMP            statRTMP            `json:"rtmp"`
+	RTMPPlay        statRTMPPlay        `json:"rtmp-play"`
+	HLS             statHLS             `json:"hls"`
+	DASH            statDASH            `json:"dash"`
+	PeerConnections statPeerConnections `json:"peers"`
+}
+
+// The stat of DataChannel messages, for all peer connections.
+type statDataChannel struct {
+	lock       sync.Mutex
+	sent       uint64
+	received   uint64
+	lost       uint64
+	latencySum time.Duration
+	latencyMax time.Duration
+}
+
+func (v *statDataChannel) onSent() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.sent++
+}
+
+func (v *statDataChannel) onReceived(latency time.Duration, lost uint64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.received++
+	v.lost += lost
+	v.latencySum += latency
+	if latency > v.latencyMax {
+		v.latencyMax = latency
+	}
+}
+
+// Get the stat, the latency in ms.
+func (v *statDataChannel) Stat() (sent, received, lost uint64, avgLatency, maxLatency float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.received > 0 {
+		avgLatency = float64(v.latencySum/time.Duration(v.received)) / float64(time.Millisecond)
+	}
+	maxLatency = float64(v.latencyMax) / float64(time.Millisecond)
+	return v.sent, v.received, v.lost, avgLatency, maxLatency
+}
+
+func (v *statDataChannel) String() string {
+	sent, received, lost, avgLatency, maxLatency := v.Stat()
+	return fmt.Sprintf("sent=%v, received=%v, lost=%v, latency=%.2fms, max=%.2fms",
+		sent, received, lost, avgLatency, maxLatency)
+}
+
+func (v *statDataChannel) MarshalJSON() ([]byte, error) {
+	sent, received, lost, avgLatency, maxLatency := v.Stat()
+	return json.Marshal(&struct {
+		Sent       uint64  `json:"sent"`
+		Received   uint64  `json:"received"`
+		Lost       uint64  `json:"lost"`
+		AvgLatency float64 `json:"latency"`
+		MaxLatency float64 `json:"max-latency"`
+	}{
+		sent, received, lost, avgLatency, maxLatency,
+	})
+}
+
+// The buckets of latency histogram, each bucket is 1ms, the last one is for overflow.
+const statLatencyBuckets = 10 * 1000
+
+// The end-to-end latency of all streams, measured by player from the SEI of publisher.
+type statLatency struct {
+	lock    sync.Mutex
+	buckets [statLatencyBuckets + 1]uint64
+	count   uint64
+	sum     time.Duration
+	max     time.Duration
+}
+
+func (v *statLatency) onLatency(latency time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// The clock of publisher might be ahead of player.
+	if latency < 0 {
+		latency = 0
+	}
+
+	bucket := int(latency / time.Millisecond)
+	if bucket > statLatencyBuckets {
+		bucket = statLatencyBuckets
+	}
+	v.buckets[bucket]++
+
+	v.count++
+	v.sum += latency
+	if latency > v.max {
+		v.max = latency
+	}
+}
+
+// Get the percentile of latency in ms, the p is in (0, 100], by the histogram.
+func (v *statLatency) percentile(p float64) float64 {
+	target := uint64(float64(v.count)*p/100 + 0.5)
+	if target == 0 {
+		target = 1
+	}
+
+	var n uint64
+	for i, b := range v.buckets {
+		if n += b; n >= target {
+			if i == statLatencyBuckets {
+				return float64(v.max) / float64(time.Millisecond)
+			}
+			return float64(i)
+		}
+	}
+	return float64(v.max) / float64(time.Millisecond)
+}
+
+// Get the stat, the latency in ms.
+func (v *statLatency) Stat() (count uint64, avg, p50, p90, p99, max float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.count == 0 {
+		return
+	}
+
+	avg = float64(v.sum/time.Duration(v.count)) / float64(time.Millisecond)
+	max = float64(v.max) / float64(time.Millisecond)
+	return v.count, avg, v.percentile(50), v.percentile(90), v.percentile(99), max
+}
+
+func (v *statLatency) String() string {
+	count, avg, p50, p90, p99, max := v.Stat()
+	return fmt.Sprintf("samples=%v, avg=%.2fms, p50=%vms, p90=%vms, p99=%vms, max=%.2fms",
+		count, avg, p50, p90, p99, max)
+}
+
+func (v *statLatency) MarshalJSON() ([]byte, error) {
+	count, avg, p50, p90, p99, max := v.Stat()
+	return json.Marshal(&struct {
+		Samples uint64  `json:"samples"`
+		Avg     float64 `json:"avg"`
+		P50     float64 `json:"p50"`
+		P90     float64 `json:"p90"`
+		P99     float64 `json:"p99"`
+		Max     float64 `json:"max"`
+	}{
+		count, avg, p50, p90, p99, max,
+	})
+}
+
+// The stat of RTMP and FLV publishers, the bytes is the payload of messages, and the handshake is the
+// cost of TLS handshake of RTMPS, HTTPS or WSS, no samples without TLS.
+type statRTMP struct {
+	lock       sync.Mutex
+	start      time.Time
+	publishers uint64
+	messages   uint64
+	bytes      uint64
+	handshake  statLatency
+}
+
+func (v *statRTMP) onPublish() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.publishers++; v.start.IsZero() {
+		v.start = time.Now()
+	}
+}
+
+func (v *statRTMP) onSent(size int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.messages++
+	v.bytes += uint64(size)
+}
+
+// Get the stat, the bitrate in kbps is the average since the first publisher.
+func (v *statRTMP) Stat() (publishers, messages, bytes uint64, kbps float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if d := time.Since(v.start); !v.start.IsZero() && d > 0 {
+		kbps = float64(v.bytes*8) / 1000 / d.Seconds()
+	}
+	return v.publishers, v.messages, v.bytes, kbps
+}
+
+func (v *statRTMP) String() string {
+	publishers, messages, bytes, kbps := v.Stat()
+	return fmt.Sprintf("publishers=%v, messages=%v, bytes=%v, send=%.0fkbps, tls-handshake(%v)",
+		publishers, messages, bytes, kbps, &v.handshake)
+}
+
+func (v *statRTMP) MarshalJSON() ([]byte, error) {
+	publishers, messages, bytes, kbps := v.Stat()
+	return json.Marshal(&struct {
+		Publishers uint64       `json:"publishers"`
+		Messages   uint64       `json:"messages"`
+		Bytes      uint64       `json:"bytes"`
+		Kbps       float64      `json:"send-kbps"`
+		Handshake  *statLatency `json:"tls-handshake"`
+	}{
+		publishers, messages, bytes, kbps, &v.handshake,
+	})
+}
+
+// The stat of RTMP and HTTP-FLV players, the backwards is the messages with timestamp smaller than the
+// previous one of the same track, and the first frame is the cost from connecting to the first audio or
+// video. The handshake is the cost of TLS handshake of RTMPS, HTTPS or WSS.
+type statRTMPPlay struct {
+	lock       sync.Mutex
+	start      time.Time
+	players    uint64
+	messages   uint64
+	bytes      uint64
+	backwards  uint64
+	firstFrame statLatency
+	handshake  statLatency
+}
+
+func (v *statRTMPPlay) onPlay() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.players++; v.start.IsZero() {
+		v.start = time.Now()
+	}
+}
+
+func (v *statRTMPPlay) onRecv(size int, backward bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.messages++
+	v.bytes += uint64(size)
+	if backward {
+		v.backwards++
+	}
+}
+
+// Get the stat, the bitrate in kbps is the average since the first player.
+func (v *statRTMPPlay) Stat() (players, messages, bytes, backwards uint64, kbps float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if d := time.Since(v.start); !v.start.IsZero() && d > 0 {
+		kbps = float64(v.bytes*8) / 1000 / d.Seconds()
+	}
+	return v.players, v.messages, v.bytes, v.backwards, kbps
+}
+
+func (v *statRTMPPlay) String() string {
+	players, messages, bytes, backwards, kbps := v.Stat()
+	return fmt.Sprintf("players=%v, messages=%v, bytes=%v, recv=%.0fkbps, backwards=%v, first-frame(%v), tls-handshake(%v)",
+		players, messages, bytes, kbps, backwards, &v.firstFrame, &v.handshake)
+}
+
+func (v *statRTMPPlay) MarshalJSON() ([]byte, error) {
+	players, messages, bytes, backwards, kbps := v.Stat()
+	return json.Marshal(&struct {
+		Players    uint64       `json:"players"`
+		Messages   uint64       `json:"messages"`
+		Bytes      uint64       `json:"bytes"`
+		Kbps       float64      `json:"recv-kbps"`
+		Backwards  uint64       `json:"backwards"`
+		FirstFrame *statLatency `json:"first-frame"`
+		Handshake  *statLatency `json:"tls-handshake"`
+	}{
+		players, messages, bytes, kbps, backwards, &v.firstFrame, &v.handshake,
+	})
+}
+
+// The stat of HLS players, the stale is a playlist without new segment for 1.5 times the target
+// duration, the not-found is a segment of 404, and the violation is a playlist or segment breaks the
+// RFC 8216. The errors is the other failures of requests, and the segment cost is the download time.
+type statHLS struct {
+	lock            sync.Mutex
+	start           time.Time
+	players         uint64
+	reloads         uint64
+	segments        uint64
+	parts           uint64
+	bytes           uint64
+	discontinuities uint64
+	stale           uint64
+	notFound        uint64
+	violations      uint64
+	errors          uint64
+	// The cost to fetch a segment or part.
+	fetchCost statLatency
+	// The end-to-end latency, from the program date time of media to fetched.
+	latency statLatency
+}
+
+func (v *statHLS) onPlay() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.players++; v.start.IsZero() {
+		v.start = time.Now()
+	}
+}
+
+func (v *statHLS) onReload() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.reloads++
+}
+
+func (v *statHLS) onFetch(size int, cost time.Duration) {
+	v.fetchCost.onLatency(cost)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.bytes += uint64(size)
+}
+
+func (v *statHLS) onSegment(discontinuity bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.segments++
+	if discontinuity {
+		v.discontinuities++
+	}
+}
+
+func (v *statHLS) onPart() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.parts++
+}
+
+func (v *statHLS) onStale() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.stale++
+}
+
+func (v *statHLS) onNotFound() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.notFound++
+}
+
+func (v *statHLS) onViolation() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.violations++
+}
+
+func (v *statHLS) onError() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.errors++
+}
+
+// Get the stat, the bitrate in kbps is the average since the first player.
+func (v *statHLS) Stat() (players, reloads, segments, parts, discontinuities, stale, notFound, violations, errs uint64, kbps float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if d := time.Since(v.start); !v.start.IsZero() && d > 0 {
+		kbps = float64(v.bytes*8) / 1000 / d.Seconds()
+	}
+	return v.players, v.reloads, v.segments, v.parts, v.discontinuities, v.stale, v.notFound, v.violations, v.errors, kbps
+}
+
+func (v *statHLS) String() string {
+	players, reloads, segments, parts, discontinuities, stale, notFound, violations, errs, kbps := v.Stat()
+	return fmt.Sprintf("players=%v, reloads=%v, segments=%v, parts=%v, recv=%.0fkbps, discontinuities=%v, stale=%v, 404=%v, violations=%v, errors=%v, fetch-cost(%v), latency(%v)",
+		players, reloads, segments, parts, kbps, discontinuities, stale, notFound, violations, errs, &v.fetchCost, &v.latency)
+}
+
+func (v *statHLS) MarshalJSON() ([]byte, error) {
+	players, reloads, segments, parts, discontinuities, stale, notFound, violations, errs, kbps := v.Stat()
+	return json.Marshal(&struct {
+		Players         uint64       `json:"players"`
+		Reloads         uint64       `json:"reloads"`
+		Segments        uint64       `json:"segments"`
+		Parts           uint64       `json:"parts"`
+		Kbps            float64      `json:"recv-kbps"`
+		Discontinuities uint64       `json:"discontinuities"`
+		Stale           uint64       `json:"stale"`
+		NotFound        uint64       `json:"not-found"`
+		Violations      uint64       `json:"violations"`
+		Errors          uint64       `json:"errors"`
+		FetchCost       *statLatency `json:"fetch-cost"`
+		Latency         *statLatency `json:"latency"`
+	}{
+		players, reloads, segments, parts, kbps, discontinuities, stale, notFound, violations, errs, &v.fetchCost, &v.latency,
+	})
+}
+
+// The stat of DASH players, the gaps are the discontinuities of media timeline.
+type statDASH struct {
+	lock       sync.Mutex
+	start      time.Time
+	players    uint64
+	reloads    uint64
+	segments   uint64
+	bytes      uint64
+	gaps       uint64
+	stale      uint64
+	notFound   uint64
+	violations uint64
+	errors     uint64
+	// The cost to fetch a segment.
+	fetchCost statLatency
+	// The end-to-end latency, from the end of segment in wall clock to fetched.
+	latency statLatency
+}
+
+func (v *statDASH) onPlay() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.players++; v.start.IsZero() {
+		v.start = time.Now()
+	}
+}
+
+func (v *statDASH) onReload() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.reloads++
+}
+
+func (v *statDASH) onFetch(size int, cost time.Duration) {
+	v.fetchCost.onLatency(cost)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.bytes += uint64(size)
+}
+
+func (v *statDASH) onSegment() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.segments++
+}
+
+func (v *statDASH) onGap() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.gaps++
+}
+
+func (v *statDASH) onStale() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.stale++
+}
+
+func (v *statDASH) onNotFound() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.notFound++
+}
+
+func (v *statDASH) onViolation() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.violations++
+}
+
+func (v *statDASH) onError() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.errors++
+}
+
+// Get the stat, the bitrate in kbps is the average since the first player.
+func (v *statDASH) Stat() (players, reloads, segments, gaps, stale, notFound, violations, errs uint64, kbps float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if d := time.Since(v.start); !v.start.IsZero() && d > 0 {
+		kbps = float64(v.bytes*8) / 1000 / d.Seconds()
+	}
+	return v.players, v.reloads, v.segments, v.gaps, v.stale, v.notFound, v.violations, v.errors, kbps
+}
+
+func (v *statDASH) String() string {
+	players, reloads, segments, gaps, stale, notFound, violations, errs, kbps := v.Stat()
+	return fmt.Sprintf("players=%v, reloads=%v, segments=%v, recv=%.0fkbps, gaps=%v, stale=%v, 404=%v, violations=%v, errors=%v, fetch-cost(%v), latency(%v)",
+		players, reloads, segments, kbps, gaps, stale, notFound, violations, errs, &v.fetchCost, &v.latency)
+}
+
+func (v *statDASH) MarshalJSON() ([]byte, error) {
+	players, reloads, segments, gaps, stale, notFound, violations, errs, kbps := v.Stat()
+	return json.Marshal(&struct {
+		Players    uint64       `json:"players"`
+		Reloads    uint64       `json:"reloads"`
+		Segments   uint64       `json:"segments"`
+		Kbps       float64      `json:"recv-kbps"`
+		Gaps       uint64       `json:"gaps"`
+		Stale      uint64       `json:"stale"`
+		NotFound   uint64       `json:"not-found"`
+		Violations uint64       `json:"violations"`
+		Errors     uint64       `json:"errors"`
+		FetchCost  *statLatency `json:"fetch-cost"`
+		Latency    *statLatency `json:"latency"`
+	}{
+		players, reloads, segments, kbps, gaps, stale, notFound, violations, errs, &v.fetchCost, &v.latency,
+	})
+}
+
+// The stat of a peer connection, like the getStats of browser, collected by statInterceptor.
+type statPeerConnection struct {
+	lock  sync.Mutex
+	label string
+	// The RTP packets and bytes.
+	packetsIn, bytesIn   uint64
+	packetsOut, bytesOut uint64
+	// The RTCP feedbacks, in is received from peer, out is sent to peer.
+	nackIn, nackOut uint64
+	pliIn, pliOut   uint64
+	firIn, firOut   uint64
+	// The lost packets requested by NACK, and the repaired or never repaired lost packets.
+	nackRequests, repaired, unrepaired uint64
+	// The TWCC feedbacks sent, and the receive rate in kbps, which is the send rate of peer.
+	twccFeedbacks                      uint64
+	recvKbps, recvKbpsMin, recvKbpsMax float64
+	// The ULPFEC packets received, and the lost packets recovered by FEC.
+	fecPackets, fecRecovered uint64
+	// The lost audio packets recovered by the redundant blocks of RED.
+	redRecovered uint64
+	// The clock rate of streams by SSRC, to convert the jitter to ms.
+	clockRates map[uint32]uint32
+	// The latest reception report by SSRC, for both the received and sent streams.
+	lost   map[uint32]uint32
+	jitter map[uint32]float64
+	// The time of SR sent by the middle 32 bits of NTP, to calculate the RTT by RR.
+	srs map[uint32]time.Time
+	rtt time.Duration
+	// The bitrate in kbps, sampled by interval.
+	sampleAt                      time.Time
+	sampleBytesIn, sampleBytesOut uint64
+	kbpsIn, kbpsOut               float64
+}
+
+func newStatPeerConnection(label string) *statPeerConnection {
+	return &statPeerConnection{
+		label:      label,
+		clockRates: make(map[uint32]uint32),
+		lost:       make(map[uint32]uint32),
+		jitter:     make(map[uint32]float64),
+		srs:        make(map[uint32]time.Time),
+		sampleAt:   time.Now(),
+	}
+}
+
+func (v *statPeerConnection) onStream(ssrc, clockRate uint32) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.clockRates[ssrc] = clockRate
+}
+
+func (v *statPeerConnection) onRTP(n int, out bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if out {
+		v.packetsOut++
+		v.bytesOut += uint64(n)
+	} else {
+		v.packetsIn++
+		v.bytesIn += uint64(n)
+	}
+}
+
+func (v *statPeerConnection) onNackRequests(n int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.nackRequests += uint64(n)
+}
+
+func (v *statPeerConnection) onRetransmission(repaired bool, unrepaired int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if repaired {
+		v.repaired++
+	}
+	v.unrepaired += uint64(unrepaired)
+}
+
+func (v *statPeerConnection) onFEC(recovered bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.fecPackets++
+	if recovered {
+		v.fecRecovered++
+	}
+}
+
+func (v *statPeerConnection) onRedRecovered() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.redRecovered++
+}
+
+func (v *statPeerConnection) onTWCCFeedback() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.twccFeedbacks++
+}
+
+func (v *statPeerConnection) onReceiveRate(kbps float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.recvKbps = kbps
+	if v.recvKbpsMin == 0 || kbps < v.recvKbpsMin {
+		v.recvKbpsMin = kbps
+	}
+	if kbps > v.recvKbpsMax {
+		v.recvKbpsMax = kbps
+	}
+}
+
+func (v *statPeerConnection) onRTCP(pkts []rtcp.Packet, out bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	count := func(received, sent *uint64) {
+		if out {
+			*sent++
+		} else {
+			*received++
+		}
+	}
+
+	now := time.Now()
+	for _, pkt := range pkts {
+		switch pkt := pkt.(type) {
+		case *rtcp.TransportLayerNack:
+			count(&v.nackIn, &v.nackOut)
+		case *rtcp.PictureLossIndication:
+			count(&v.pliIn, &v.pliOut)
+		case *rtcp.FullIntraRequest:
+			count(&v.firIn, &v.firOut)
+		case *rtcp.SenderReport:
+			if out {
+				v.onSenderReport(pkt, now)
+			}
+			v.onReceptionReports(pkt.Reports, out, now)
+		case *rtcp.ReceiverReport:
+			v.onReceptionReports(pkt.Reports, out, now)
+		}
+	}
+}
+
+func (v *statPeerConnection) onSenderReport(pkt *rtcp.SenderReport, now time.Time) {
+	// Remove the expired SR, which is never responded by RR.
+	for lsr, sentAt := range v.srs {
+		if now.Sub(sentAt) > 30*time.Second {
+			delete(v.srs, lsr)
+		}
+	}
+	v.srs[uint32(pkt.NTPTime>>16)] = now
+}
+
+// The reception reports, for the received streams if out, or the sent streams if not.
+func (v *statPeerConnection) onReceptionReports(reports []rtcp.ReceptionReport, out bool, now time.Time) {
+	for _, r := range reports {
+		v.lost[r.SSRC] = r.TotalLost
+		if clockRate := v.clockRates[r.SSRC]; clockRate > 0 {
+			v.jitter[r.SSRC] = float64(r.Jitter) * 1000 / float64(clockRate)
+		}
+
+		// The RTT is the time since our SR, minus the delay of peer, in 1/65536 seconds.
+		if sentAt, ok := v.srs[r.LastSenderReport]; ok && !out && r.LastSenderReport != 0 {
+			delay := time.Duration(r.Delay) * time.Second / 65536
+			if rtt := now.Sub(sentAt) - delay; rtt >= 0 {
+				v.rtt = rtt
+			}
+		}
+	}
+}
+
+// Sample the bitrate, should be called by interval.
+func (v *statPeerConnection) Sample(now time.Time) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if elapsed := now.Sub(v.sampleAt).Seconds(); elapsed > 0 {
+		v.kbpsIn = float64(v.bytesIn-v.sampleBytesIn) * 8 / 1000 / elapsed
+		v.kbpsOut = float64(v.bytesOut-v.sampleBytesOut) * 8 / 1000 / elapsed
+	}
+	v.sampleAt, v.sampleBytesIn, v.sampleBytesOut = now, v.bytesIn, v.bytesOut
+}
+
+type statPeerConnectionSnapshot struct {
+	Label      string  `json:"label"`
+	PacketsIn  uint64  `json:"packets-in"`
+	BytesIn    uint64  `json:"bytes-in"`
+	KbpsIn     float64 `json:"kbps-in"`
+	PacketsOut uint64  `json:"packets-out"`
+	BytesOut   uint64  `json:"bytes-out"`
+	KbpsOut    float64 `json:"kbps-out"`
+	NackIn     uint64  `json:"nack-in"`
+	NackOut    uint64  `json:"nack-out"`
+	PliIn      uint64  `json:"pli-in"`
+	PliOut     uint64  `json:"pli-out"`
+	FirIn      uint64  `json:"fir-in"`
+	FirOut     uint64  `json:"fir-out"`
+	Requests   uint64  `json:"nack-requests"`
+	Repaired   uint64  `json:"repaired"`
+	Unrepaired uint64  `json:"unrepaired"`
+	Feedbacks  uint64  `json:"twcc-feedbacks"`
+	RecvKbps   float64 `json:"recv-kbps"`
+	RecvMin    float64 `json:"recv-kbps-min"`
+	RecvMax    float64 `json:"recv-kbps-max"`
+	FEC        uint64  `json:"fec-packets"`
+	Recovered  uint64  `json:"fec-recovered"`
+	Redundant  uint64  `json:"red-recovered"`
+	Lost       uint64  `json:"lost"`
+	Jitter     float64 `json:"jitter"`
+	RTT        float64 `json:"rtt"`
+}
+
+// Get the stat, the jitter is the max of streams and the RTT is the latest, both in ms.
+func (v *statPeerConnection) Stat() *statPeerConnectionSnapshot {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	s := &statPeerConnectionSnapshot{
+		Label: v.label, PacketsIn: v.packetsIn, BytesIn: v.bytesIn, KbpsIn: v.kbpsIn,
+		PacketsOut: v.packetsOut, BytesOut: v.bytesOut, KbpsOut: v.kbpsOut,
+		NackIn: v.nackIn, NackOut: v.nackOut, PliIn: v.pliIn, PliOut: v.pliOut, FirIn: v.firIn, FirOut: v.firOut,
+		Requests: v.nackRequests, Repaired: v.repaired, Unrepaired: v.unrepaired,
+		Feedbacks: v.twccFeedbacks, RecvKbps: v.recvKbps, RecvMin: v.recvKbpsMin, RecvMax: v.recvKbpsMax,
+		FEC: v.fecPackets, Recovered: v.fecRecovered, Redundant: v.redRecovered,
+		RTT: float64(v.rtt) / float64(time.Millisecond),
+	}
+	for _, lost := range v.lost {
+		s.Lost += uint64(lost)
+	}
+	for _, jitter := range v.jitter {
+		if jitter > s.Jitter {
+			s.Jitter = jitter
+		}
+	}
+	return s
+}
+
+func (v *statPeerConnection) String() string {
+	s := v.Stat()
+	desc := fmt.Sprintf("%v in=%.0fkbps/%vpkts, out=%.0fkbps/%vpkts, nack=%v/%v, pli=%v/%v, fir=%v/%v, lost=%v, jitter=%.2fms, rtt=%.2fms",
+		s.Label, s.KbpsIn, s.PacketsIn, s.KbpsOut, s.PacketsOut, s.NackIn, s.NackOut, s.PliIn, s.PliOut, s.FirIn, s.FirOut,
+		s.Lost, s.Jitter, s.RTT)
+	if s.Requests > 0 || s.Repaired > 0 || s.Unrepaired > 0 {
+		desc = fmt.Sprintf("%v, requests=%v, repaired=%v, unrepaired=%v", desc, s.Requests, s.Repaired, s.Unrepaired)
+	}
+	if s.Feedbacks > 0 {
+		desc = fmt.Sprintf("%v, twcc=%v, recv=%.0fkbps(%.0f~%.0f)", desc, s.Feedbacks, s.RecvKbps, s.RecvMin, s.RecvMax)
+	}
+	if s.FEC > 0 {
+		desc = fmt.Sprintf("%v, fec=%v, recovered=%v", desc, s.FEC, s.Recovered)
+	}
+	if s.Redundant > 0 {
+		desc = fmt.Sprintf("%v, red-recovered=%v", desc, s.Redundant)
+	}
+	return desc
+}
+
+func (v *statPeerConnection) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.Stat())
+}
+
+// The stat of all peer connections, including the closed ones, for the final result.
+type statPeerConnections struct {
+	lock  sync.Mutex
+	peers []*statPeerConnection
+	// To generate the label of peer.
+	nn int
+}
+
+func (v *statPeerConnections) Add(kind string) *statPeerConnection {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.nn++
+	peer := newStatPeerConnection(fmt.Sprintf("%v-%v", kind, v.nn))
+	v.peers = append(v.peers, peer)
+	return peer
+}
+
+func (v *statPeerConnections) Peers() []*statPeerConnection {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return append([]*statPeerConnection{}, v.peers...)
+}
+
+// Sample the bitrate of all peers, and get the summary.
+func (v *statPeerConnections) Sample(now time.Time) string {
+	peers := v.Peers()
+
+	var kbpsIn, kbpsOut, rtt float64
+	var lost, nack, pli uint64
+	var nnRTT int
+	for _, peer := range peers {
+		peer.Sample(now)
+
+		s := peer.Stat()
+		kbpsIn, kbpsOut, lost = kbpsIn+s.KbpsIn, kbpsOut+s.KbpsOut, lost+s.Lost
+		nack, pli = nack+s.NackIn+s.NackOut, pli+s.PliIn+s.PliOut
+
+		// The player never sends SR, so there is no RTT.
+		if s.RTT > 0 {
+			rtt, nnRTT = rtt+s.RTT, nnRTT+1
+		}
+	}
+	if nnRTT > 0 {
+		rtt /= float64(nnRTT)
+	}
+
+	return fmt.Sprintf("peers=%v, in=%.0fkbps, out=%.0fkbps, lost=%v, nack=%v, pli=%v, rtt=%.2fms",
+		len(peers), kbpsIn, kbpsOut, lost, nack, pli, rtt)
+}
+
+func (v *statPeerConnections) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.Peers())
 }
 
 var gStatRTC statRTC
 
+// Write the stat of all peer connections to file in JSON.
+func writeStatJSON(filename string) error {
+	b, err := json.MarshalIndent(&gStatRTC.PeerConnections, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal")
+	}
+
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return errors.Wrapf(err, "write %v", filename)
+	}
+	return nil
+}
+
 func handleStat(ctx context.Context, mux *http.ServeMux, l string) {
 	if strings.HasPrefix(l, ":") {
 		l = "127.0.0.1" + l
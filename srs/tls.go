@@ -0,0 +1,115 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// Build the TLS config for RTMPS, HTTPS-FLV and WSS, use the system CA if caFile is empty. The serverName
+// overrides the SNI and the name to verify, which is the host of url if empty. The client certificate
+// is optional, for the server requires mutual TLS.
+func newTLSConfig(caFile, certFile, keyFile, serverName string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure}
+
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read ca=%v", caFile)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificate in ca=%v", caFile)
+		}
+	}
+
+	if certFile != "" {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load cert=%v, key=%v", certFile, keyFile)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// Dial the RTMP url, the default port is 1935 for rtmp and 443 for rtmps. For rtmps, return the cost
+// of TLS handshake, which is 0 for rtmp.
+func dialRTMP(ctx context.Context, u *url.URL, config *tls.Config) (net.Conn, time.Duration, error) {
+	if u.Scheme == "rtmps" {
+		if config == nil {
+			config = &tls.Config{}
+		}
+		return dialURL(ctx, u, "443", config)
+	}
+	return dialURL(ctx, u, "1935", nil)
+}
+
+// Dial the host of url, use the port if not specified. Do the TLS handshake if config is not nil, and
+// return the cost of it. The conn is closed if ctx is done while handshaking.
+func dialURL(ctx context.Context, u *url.URL, port string, config *tls.Config) (net.Conn, time.Duration, error) {
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "dial %v", u.Host)
+	}
+
+	if config == nil {
+		return conn, 0, nil
+	}
+
+	// Use the host of url as SNI, if not specified.
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = u.Hostname()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	start := time.Now()
+	tc := tls.Client(conn, config)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, 0, errors.Wrapf(err, "tls handshake %v, sni=%v", u.Host, config.ServerName)
+	}
+	return tc, time.Since(start), nil
+}
@@ -0,0 +1,132 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// Whether the audio source is ogg opus, which is ingested directly, others are transcoded by FFmpeg.
+func isOpusSource(source string) bool {
+	return strings.HasSuffix(source, ".ogg") || strings.HasSuffix(source, ".opus")
+}
+
+// Build the FFmpeg args to transcode the audio source to ogg opus in stdout. Each page has only one
+// packet of frameSize in ms, because the ingester writes a page as a sample. The bitrate is in kbps.
+func opusTranscodeArgs(source string, bitrate int, frameSize float64) []string {
+	var args []string
+
+	// The raw PCM has no header, so it must be s16le 48KHz stereo.
+	if strings.HasSuffix(source, ".pcm") || strings.HasSuffix(source, ".s16le") {
+		args = append(args, "-f", "s16le", "-ar", "48000", "-ac", "2")
+	}
+	args = append(args, "-i", source, "-vn")
+
+	args = append(args, "-c:a", "libopus", "-ar", "48000", "-ac", "2")
+	args = append(args, "-b:a", fmt.Sprintf("%vk", bitrate))
+	args = append(args, "-frame_duration", fmt.Sprintf("%v", frameSize))
+	args = append(args, "-page_duration", fmt.Sprintf("%v", int(frameSize*1000)))
+
+	return append(args, "-f", "ogg", "-y", "pipe:1")
+}
+
+// The audio source, file or FFmpeg, for oggreader.
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// The FFmpeg process to transcode audio source to ogg opus.
+type opusTranscoder struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	// Whether FFmpeg is quit and waited.
+	done bool
+}
+
+func newOpusTranscoder(ctx context.Context, ffmpeg, source string, bitrate int, frameSize float64) (*opusTranscoder, error) {
+	// Check the source here, or the error of FFmpeg is hard to understand.
+	if _, err := os.Stat(source); err != nil {
+		return nil, errors.Wrapf(err, "stat %v", source)
+	}
+
+	v := &opusTranscoder{}
+	v.cmd = exec.CommandContext(ctx, ffmpeg, opusTranscodeArgs(source, bitrate, frameSize)...)
+	v.cmd.Stderr = &v.stderr
+
+	var err error
+	if v.stdout, err = v.cmd.StdoutPipe(); err != nil {
+		return nil, errors.Wrapf(err, "pipe stdout")
+	}
+
+	logger.Tf(ctx, "Transcode audio by %v %v", ffmpeg, strings.Join(v.cmd.Args[1:], " "))
+	if err := v.cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "start %v", ffmpeg)
+	}
+	return v, nil
+}
+
+// Read the ogg opus from stdout of FFmpeg, return io.EOF only if FFmpeg quit normally.
+func (v *opusTranscoder) Read(b []byte) (int, error) {
+	n, err := v.stdout.Read(b)
+	if err != io.EOF || v.done {
+		return n, err
+	}
+
+	v.done = true
+	if err := v.cmd.Wait(); err != nil {
+		return n, errors.Wrapf(err, "ffmpeg %v", lastLines(v.stderr.String(), 3))
+	}
+	return n, err
+}
+
+// The oggreader requires io.ReadSeeker, but never seek, so it's not supported.
+func (v *opusTranscoder) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("not seekable")
+}
+
+func (v *opusTranscoder) Close() error {
+	if !v.done {
+		v.done = true
+		_ = v.cmd.Process.Kill()
+		_ = v.cmd.Wait()
+	}
+	return nil
+}
+
+// Get the last n lines of s, to show the reason of failure.
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\\n")
+}
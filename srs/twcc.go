@@ -0,0 +1,268 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+// The max packets in a TWCC feedback, the others are reported by the next feedback.
+const twccMaxPacketsPerFeedback = 1024
+
+// The received packet with transport-wide sequence number.
+type twccArrival struct {
+	seq     int64
+	arrival time.Time
+}
+
+// The recorder to generate TWCC feedback, see
+// https://tools.ietf.org/html/draft-holmer-rmcat-transport-wide-cc-extensions-01
+type twccRecorder struct {
+	senderSSRC, mediaSSRC uint32
+	// The highest unwrapped sequence number.
+	started bool
+	highest int64
+	// The arrivals not reported yet, and the next sequence number to report.
+	arrivals []twccArrival
+	nextSeq  int64
+	// The count of feedback packets, wrap around.
+	fbPktCount uint8
+}
+
+func newTWCCRecorder(senderSSRC uint32) *twccRecorder {
+	return &twccRecorder{senderSSRC: senderSSRC, nextSeq: -1}
+}
+
+func (v *twccRecorder) Record(seq uint16, arrival time.Time) {
+	if !v.started {
+		v.started, v.highest = true, int64(seq)
+	}
+
+	unwrapped := v.highest + int64(int16(seq-uint16(v.highest)))
+	if unwrapped > v.highest {
+		v.highest = unwrapped
+	}
+
+	v.arrivals = append(v.arrivals, twccArrival{seq: unwrapped, arrival: arrival})
+}
+
+// Build the feedback of the recorded packets, return nil if no packet.
+func (v *twccRecorder) BuildFeedback() *rtcp.TransportLayerCC {
+	// Ignore the packets which are already reported, for example, reported as lost.
+	sort.Slice(v.arrivals, func(i, j int) bool {
+		return v.arrivals[i].seq < v.arrivals[j].seq
+	})
+	for len(v.arrivals) > 0 && v.arrivals[0].seq < v.nextSeq {
+		v.arrivals = v.arrivals[1:]
+	}
+	if len(v.arrivals) == 0 {
+		return nil
+	}
+
+	// Report the lost packets since last feedback, unless the gap is too large.
+	base := v.arrivals[0].seq
+	if v.nextSeq >= 0 && base-v.nextSeq < twccMaxPacketsPerFeedback {
+		base = v.nextSeq
+	}
+
+	// The reference time is in multiples of 64ms, and the deltas are in multiples of 250us.
+	referenceTime := v.arrivals[0].arrival.UnixNano() / int64(time.Microsecond) / 64000
+	last := referenceTime * 64000
+
+	var symbols []uint16
+	var deltas []*rtcp.RecvDelta
+	var seq int64
+	for seq = base; seq < base+twccMaxPacketsPerFeedback && len(v.arrivals) > 0; seq++ {
+		if v.arrivals[0].seq != seq {
+			symbols = append(symbols, rtcp.TypeTCCPacketNotReceived)
+			continue
+		}
+
+		// Ignore the duplicated packets.
+		arrival := v.arrivals[0].arrival.UnixNano() / int64(time.Microsecond)
+		for len(v.arrivals) > 0 && v.arrivals[0].seq == seq {
+			v.arrivals = v.arrivals[1:]
+		}
+
+		delta := (arrival - last) / rtcp.TypeTCCDeltaScaleFactor
+		if delta >= 0 && delta <= 0xff {
+			symbols = append(symbols, rtcp.TypeTCCPacketReceivedSmallDelta)
+			deltas = append(deltas, &rtcp.RecvDelta{Type: rtcp.TypeTCCPacketReceivedSmallDelta, Delta: delta * rtcp.TypeTCCDeltaScaleFactor})
+		} else {
+			if delta < -0x8000 {
+				delta = -0x8000
+			} else if delta > 0x7fff {
+				delta = 0x7fff
+			}
+			symbols = append(symbols, rtcp.TypeTCCPacketReceivedLargeDelta)
+			deltas = append(deltas, &rtcp.RecvDelta{Type: rtcp.TypeTCCPacketReceivedLargeDelta, Delta: delta * rtcp.TypeTCCDeltaScaleFactor})
+		}
+		last += delta * rtcp.TypeTCCDeltaScaleFactor
+	}
+	v.nextSeq = seq
+
+	// Use the status vector chunk of 2 bits symbol, 7 symbols for each chunk.
+	var chunks []rtcp.PacketStatusChunk
+	for i := 0; i < len(symbols); i += 7 {
+		end := i + 7
+		if end > len(symbols) {
+			end = len(symbols)
+		}
+		chunks = append(chunks, &rtcp.StatusVectorChunk{
+			Type: rtcp.TypeTCCStatusVectorChunk, SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit, SymbolList: symbols[i:end],
+		})
+	}
+
+	fb := &rtcp.TransportLayerCC{
+		SenderSSRC: v.senderSSRC, MediaSSRC: v.mediaSSRC,
+		BaseSequenceNumber: uint16(base), PacketStatusCount: uint16(len(symbols)),
+		ReferenceTime: uint32(referenceTime) & 0xffffff, FbPktCount: v.fbPktCount,
+		PacketChunks: chunks, RecvDeltas: deltas,
+	}
+	v.fbPktCount++
+
+	// The length without padding, the header and fixed fields is 20 bytes.
+	size := 20 + 2*len(chunks)
+	for _, delta := range deltas {
+		if delta.Type == rtcp.TypeTCCPacketReceivedSmallDelta {
+			size++
+		} else {
+			size += 2
+		}
+	}
+	fb.Header = rtcp.Header{
+		Padding: size%4 != 0, Count: rtcp.FormatTCC, Type: rtcp.TypeTransportSpecificFeedback,
+		Length: fb.Len()/4 - 1,
+	}
+	return fb
+}
+
+// The interceptor to send TWCC feedback of player, and report the receive rate, which is the
+// send rate of server controlled by its congestion control.
+type twccInterceptor struct {
+	stat     *statPeerConnection
+	interval time.Duration
+	// The recorder for all streams, because the sequence number is transport-wide.
+	lock     sync.Mutex
+	recorder *twccRecorder
+	// The received bytes to calculate the receive rate.
+	rateAt    time.Time
+	rateBytes int
+	// To stop the feedback loop.
+	closeOnce sync.Once
+	closed    chan struct{}
+	// Other common fields.
+	bypassInterceptor
+}
+
+func newTWCCInterceptor(stat *statPeerConnection) *twccInterceptor {
+	return &twccInterceptor{
+		stat: stat, interval: 100 * time.Millisecond, recorder: newTWCCRecorder(rand.Uint32()),
+		rateAt: time.Now(), closed: make(chan struct{}),
+	}
+}
+
+func (v *twccInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	var id uint8
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == sdp.TransportCCURI {
+			id = uint8(extension.ID)
+		}
+	}
+	if id == 0 {
+		return reader
+	}
+
+	v.lock.Lock()
+	if v.recorder.mediaSSRC == 0 {
+		v.recorder.mediaSSRC = info.SSRC
+	}
+	v.lock.Unlock()
+
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err != nil {
+			return n, a, err
+		}
+
+		var header rtp.Header
+		if err := header.Unmarshal(b[:n]); err != nil {
+			return n, a, nil
+		}
+
+		if ext := header.GetExtension(id); len(ext) >= 2 {
+			v.lock.Lock()
+			v.recorder.Record(uint16(ext[0])<<8|uint16(ext[1]), time.Now())
+			v.rateBytes += n
+			v.lock.Unlock()
+		}
+		return n, a, nil
+	})
+}
+
+func (v *twccInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	go v.loop(writer)
+	return writer
+}
+
+func (v *twccInterceptor) loop(writer interceptor.RTCPWriter) {
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.closed:
+			return
+		case now := <-ticker.C:
+			v.lock.Lock()
+			fb := v.recorder.BuildFeedback()
+			if elapsed := now.Sub(v.rateAt); elapsed >= time.Second {
+				if v.rateBytes > 0 {
+					v.stat.onReceiveRate(float64(v.rateBytes) * 8 / 1000 / elapsed.Seconds())
+				}
+				v.rateAt, v.rateBytes = now, 0
+			}
+			v.lock.Unlock()
+
+			if fb == nil {
+				continue
+			}
+			if _, err := writer.Write([]rtcp.Packet{fb}, interceptor.Attributes{}); err == nil {
+				v.stat.onTWCCFeedback()
+			}
+		}
+	}
+}
+
+func (v *twccInterceptor) Close() error {
+	v.closeOnce.Do(func() {
+		close(v.closed)
+	})
+	return nil
+}
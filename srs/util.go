@@ -23,6 +23,7 @@ package srs
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/ossrs/go-oryx-lib/amf0"
@@ -236,6 +237,9 @@ func packageAsSTAPA(frames ...*h264reader.NAL) *h264reader.NAL {
 	}
 }
 
+// The MTU of RTP packets we packetize by ourselves, same as pion.
+const rtpOutboundMTU = 1200
+
 type wallClock struct {
 	start    time.Time
 	duration time.Duration
@@ -1283,7 +1287,11 @@ type RTMPClient struct {
 
 	streamID int
 
-	conn  *net.TCPConn
+	// The TLS config for rtmps, and the cost of TLS handshake.
+	tlsConfig *tls.Config
+	handshake time.Duration
+
+	conn  net.Conn
 	proto *rtmp.Protocol
 }
 
@@ -1294,7 +1302,7 @@ func (v *RTMPClient) Close() error {
 	return nil
 }
 
-func (v *RTMPClient) connect(rtmpUrl string) error {
+func (v *RTMPClient) connect(ctx context.Context, rtmpUrl string) error {
 	v.rtmpUrl = rtmpUrl
 
 	if index := strings.LastIndex(rtmpUrl, "/"); index <= 0 {
@@ -1311,22 +1319,12 @@ func (v *RTMPClient) connect(rtmpUrl string) error {
 	}
 	v.rtmpUrlObject = rtmpUrlObject
 
-	port := rtmpUrlObject.Port()
-	if port == "" {
-		port = "1935"
-	}
-
-	// Connect to TCP server.
-	rtmpAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v", rtmpUrlObject.Hostname(), port))
-	if err != nil {
-		return err
-	}
-
-	c, err := net.DialTCP("tcp4", nil, rtmpAddr)
+	// Connect to TCP server, and TLS handshake for rtmps.
+	c, handshake, err := dialRTMP(ctx, rtmpUrlObject, v.tlsConfig)
 	if err != nil {
 		return err
 	}
-	v.conn = c
+	v.conn, v.handshake = c, handshake
 
 	// RTMP Handshake with server.
 	hs := rtmp.NewHandshake(rand.New(rand.NewSource(time.Now().UnixNano())))
@@ -1371,7 +1369,7 @@ func (v *RTMPClient) connect(rtmpUrl string) error {
 }
 
 func (v *RTMPClient) Publish(ctx context.Context, rtmpUrl string) error {
-	if err := v.connect(rtmpUrl); err != nil {
+	if err := v.connect(ctx, rtmpUrl); err != nil {
 		return err
 	}
 	p := v.proto
@@ -1408,7 +1406,7 @@ func (v *RTMPClient) Publish(ctx context.Context, rtmpUrl string) error {
 }
 
 func (v *RTMPClient) Play(ctx context.Context, rtmpUrl string) error {
-	if err := v.connect(rtmpUrl); err != nil {
+	if err := v.connect(ctx, rtmpUrl); err != nil {
 		return err
 	}
 	p := v.proto
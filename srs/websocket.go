@@ -0,0 +1,239 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2021 Winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package srs
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The opcodes of WebSocket frame, @see https://datatracker.ietf.org/doc/html/rfc6455#section-5.2
+const (
+	webSocketOpcodeContinuation = 0x0
+	webSocketOpcodeText         = 0x1
+	webSocketOpcodeBinary       = 0x2
+	webSocketOpcodeClose        = 0x8
+	webSocketOpcodePing         = 0x9
+	webSocketOpcodePong         = 0xa
+)
+
+// The GUID to generate the Sec-WebSocket-Accept from key.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The minimal WebSocket client for WS-FLV, without extensions. Each Write sends a binary message, and
+// Read returns the payload of data messages as a stream, while replies pong for ping.
+// @see https://datatracker.ietf.org/doc/html/rfc6455
+type webSocketConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// The lock for writing, the pong and close might be written when reading.
+	lock sync.Mutex
+	// The left bytes of the current data frame to read.
+	left uint64
+}
+
+// Dial the ws or wss url and upgrade to WebSocket, the default port is 80 for ws and 443 for wss.
+// Return the cost of TLS handshake for wss.
+func dialWebSocket(ctx context.Context, u *url.URL, config *tls.Config) (*webSocketConn, time.Duration, error) {
+	port, secure := "80", u.Scheme == "wss"
+	if secure {
+		if port = "443"; config == nil {
+			config = &tls.Config{}
+		}
+	} else {
+		config = nil
+	}
+
+	conn, handshake, err := dialURL(ctx, u, port, config)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "dial")
+	}
+
+	ws := &webSocketConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := ws.upgrade(ctx, u); err != nil {
+		conn.Close()
+		return nil, 0, errors.Wrapf(err, "upgrade %v", u.String())
+	}
+	return ws, handshake, nil
+}
+
+func (v *webSocketConn) upgrade(ctx context.Context, u *url.URL) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return errors.Wrapf(err, "random key")
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+
+	// Interrupt the IO when done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			v.conn.Close()
+		case <-done:
+		}
+	}()
+
+	req := fmt.Sprintf("GET %v HTTP/1.1\r\nHost: %v\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %v\r\nSec-WebSocket-Version: 13\r\n\r\n", u.RequestURI(), u.Host, key)
+	if _, err := v.conn.Write([]byte(req)); err != nil {
+		return errors.Wrapf(err, "write request")
+	}
+
+	res, err := http.ReadResponse(v.r, nil)
+	if err != nil {
+		return errors.Wrapf(err, "read response")
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return errors.Errorf("status=%v", res.StatusCode)
+	}
+
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	if accept := res.Header.Get("Sec-WebSocket-Accept"); accept != base64.StdEncoding.EncodeToString(h[:]) {
+		return errors.Errorf("invalid accept %v", accept)
+	}
+	return nil
+}
+
+// Write a frame with the payload masked by a random key, as client.
+func (v *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch size := len(payload); {
+	case size < 126:
+		header[1] = byte(size)
+	case size <= 0xffff:
+		header[1] = 126
+		header = append(header, byte(size>>8), byte(size))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(size))
+	}
+	header[1] |= 0x80
+
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return errors.Wrapf(err, "random mask")
+	}
+	header = append(header, mask...)
+
+	b := append(header, payload...)
+	for i, masked := 0, b[len(header):]; i < len(masked); i++ {
+		masked[i] ^= mask[i%4]
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	_, err := v.conn.Write(b)
+	return err
+}
+
+// Write p as a binary message.
+func (v *webSocketConn) Write(p []byte) (int, error) {
+	if err := v.writeFrame(webSocketOpcodeBinary, p); err != nil {
+		return 0, errors.Wrapf(err, "write %vB", len(p))
+	}
+	return len(p), nil
+}
+
+// Read the payload of data frames, return io.EOF if got close frame.
+func (v *webSocketConn) Read(p []byte) (int, error) {
+	for v.left == 0 {
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(v.r, b); err != nil {
+			return 0, err
+		}
+
+		opcode, size := b[0]&0x0f, uint64(b[1]&0x7f)
+		if b[1]&0x80 != 0 {
+			return 0, errors.Errorf("server frame should not be masked")
+		}
+
+		switch size {
+		case 126:
+			if _, err := io.ReadFull(v.r, b); err != nil {
+				return 0, err
+			}
+			size = uint64(binary.BigEndian.Uint16(b))
+		case 127:
+			b = make([]byte, 8)
+			if _, err := io.ReadFull(v.r, b); err != nil {
+				return 0, err
+			}
+			size = binary.BigEndian.Uint64(b)
+		}
+
+		switch opcode {
+		case webSocketOpcodeContinuation, webSocketOpcodeText, webSocketOpcodeBinary:
+			v.left = size
+			continue
+		}
+
+		// The control frame, the payload is at most 125 bytes.
+		if size > 125 {
+			return 0, errors.Errorf("invalid control frame %v, %vB", opcode, size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(v.r, payload); err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case webSocketOpcodeClose:
+			return 0, io.EOF
+		case webSocketOpcodePing:
+			if err := v.writeFrame(webSocketOpcodePong, payload); err != nil {
+				return 0, errors.Wrapf(err, "pong")
+			}
+		}
+	}
+
+	if uint64(len(p)) > v.left {
+		p = p[:v.left]
+	}
+	n, err := v.r.Read(p)
+	v.left -= uint64(n)
+	return n, err
+}
+
+// Send the close frame and close the conn.
+func (v *webSocketConn) Close() error {
+	v.writeFrame(webSocketOpcodeClose, []byte{0x03, 0xe8})
+	return v.conn.Close()
+}
@@ -92,6 +92,11 @@ type aUDPProxyWorker struct {
 	// value is *net.UDPConn
 	endpoints sync.Map
 
+	// The vnet socket and real server, to create the real socket for endpoint.
+	ctx        context.Context
+	vnetSocket net.PacketConn
+	realAddr   *net.UDPAddr
+
 	// For cleanup.
 	ctxDisposeCancel context.CancelFunc
 	wg               sync.WaitGroup
@@ -129,6 +134,12 @@ func (v *aUDPProxyWorker) Proxy(ctx context.Context, client *Net, serverAddr *ne
 		_ = vnetSocket.Close()
 	}()
 
+	// The real server we proxy to, for utest to mock it.
+	v.ctx, v.vnetSocket, v.realAddr = ctx, vnetSocket, serverAddr
+	if v.mockRealServerAddr != nil {
+		v.realAddr = v.mockRealServerAddr
+	}
+
 	// Got new vnet client, start a new endpoint.
 	findEndpointBy := func(addr net.Addr) (*net.UDPConn, error) {
 		// Exists binding.
@@ -137,50 +148,8 @@ func (v *aUDPProxyWorker) Proxy(ctx context.Context, client *Net, serverAddr *ne
 			return value.(*net.UDPConn), nil
 		}
 
-		// The real server we proxy to, for utest to mock it.
-		realAddr := serverAddr
-		if v.mockRealServerAddr != nil {
-			realAddr = v.mockRealServerAddr
-		}
-
 		// Got new vnet client, create new endpoint.
-		realSocket, err := net.DialUDP("udp4", nil, realAddr)
-		if err != nil {
-			return nil, err
-		}
-
-		// User stop proxy, we should close the socket.
-		go func() {
-			<-ctx.Done()
-			_ = realSocket.Close()
-		}()
-
-		// Bind address.
-		v.endpoints.Store(addr.String(), realSocket)
-
-		// Got packet from real serverAddr, we should proxy it to vnet.
-		v.wg.Add(1)
-		go func(vnetClientAddr net.Addr) {
-			defer v.wg.Done()
-
-			buf := make([]byte, 1500)
-			for {
-				n, _, err := realSocket.ReadFrom(buf)
-				if err != nil {
-					return
-				}
-
-				if n <= 0 {
-					continue // Drop packet
-				}
-
-				if _, err := vnetSocket.WriteTo(buf[:n], vnetClientAddr); err != nil {
-					return
-				}
-			}
-		}(addr)
-
-		return realSocket, nil
+		return v.dialEndpoint(addr)
 	}
 
 	// Start a proxy goroutine.
@@ -205,11 +174,54 @@ func (v *aUDPProxyWorker) Proxy(ctx context.Context, client *Net, serverAddr *ne
 				continue // Drop packet.
 			}
 
+			// The real socket might be closed by migration, drop the packet.
 			if _, err := realSocket.Write(buf[:n]); err != nil {
-				return
+				continue
 			}
 		}
 	}()
 
 	return nil
 }
+
+// Create a real socket to server for the vnet client, and proxy the packets from real server
+// to the vnet client.
+func (v *aUDPProxyWorker) dialEndpoint(vnetClientAddr net.Addr) (*net.UDPConn, error) {
+	realSocket, err := net.DialUDP("udp4", nil, v.realAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// User stop proxy, we should close the socket.
+	go func() {
+		<-v.ctx.Done()
+		_ = realSocket.Close()
+	}()
+
+	// Bind address.
+	v.endpoints.Store(vnetClientAddr.String(), realSocket)
+
+	// Got packet from real serverAddr, we should proxy it to vnet.
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := realSocket.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if n <= 0 {
+				continue // Drop packet
+			}
+
+			if _, err := v.vnetSocket.WriteTo(buf[:n], vnetClientAddr); err != nil {
+				return
+			}
+		}
+	}()
+
+	return realSocket, nil
+}
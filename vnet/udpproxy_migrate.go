@@ -0,0 +1,40 @@
+package vnet
+
+import (
+	"net"
+)
+
+// Migrate switches the real socket of each vnet client to a new one, so the real server will
+// see the client address change, to simulate the network change of client, for example, from
+// WiFi to 4G. The vnet client is not aware of the migration.
+func (v *UDPProxy) Migrate() (err error) {
+	v.workers.Range(func(key, value interface{}) bool {
+		err = value.(*aUDPProxyWorker).Migrate()
+		return err == nil
+	})
+	return
+}
+
+func (v *aUDPProxyWorker) Migrate() (err error) {
+	v.endpoints.Range(func(key, value interface{}) bool {
+		previous, ok := value.(*net.UDPConn)
+		if !ok {
+			return true
+		}
+
+		addr, rerr := net.ResolveUDPAddr("udp4", key.(string))
+		if rerr != nil {
+			err = rerr
+			return false
+		}
+
+		// Bind the new real socket before closing the previous one, to reduce packet loss.
+		if _, err = v.dialEndpoint(addr); err != nil {
+			return false
+		}
+
+		_ = previous.Close()
+		return true
+	})
+	return
+}